@@ -0,0 +1,63 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"time"
+)
+
+var abortCanaryCmd = &cobra.Command{
+	Use:   "abort-canary",
+	Short: "Remove a key's canary data.",
+	Long:  `Abort-canary removes the data that in --canary put in <key>/canary - the canary hosts go back to the key on the next out.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		checkAbortCanaryFlags()
+		AutoEnable()
+	},
+	Run: abortCanaryRun,
+}
+
+func abortCanaryRun(cmd *cobra.Command, args []string) {
+	start := time.Now()
+	c, err := Connect(ConsulServer, Token)
+	if err != nil {
+		LogFatal("Could not connect to Consul.", KeyAbortCanaryLocation, "consul_connect")
+	}
+	if DryRunSkip(fmt.Sprintf("remove '%s'", CanaryKey(KeyAbortCanaryLocation))) {
+		RunTime(start, KeyAbortCanaryLocation, "dry_run")
+		return
+	}
+	aborted, err := AbortCanary(c, KeyAbortCanaryLocation)
+	ExitOnError(err, KeyAbortCanaryLocation, "abort_canary")
+	if !aborted {
+		fmt.Printf("There's no canary for '%s'.\n", KeyAbortCanaryLocation)
+		exitRun(ExitNoChange, start, KeyAbortCanaryLocation, "no_canary", "")
+	}
+	if DatadogAPIKey != "" && DatadogAPPKey != "" {
+		DDCanaryEvent(DDAPIConnect(DatadogAPIKey, DatadogAPPKey), KeyAbortCanaryLocation, "aborted")
+	}
+	fmt.Printf("Removed the canary for '%s'.\n", KeyAbortCanaryLocation)
+	RunTime(start, KeyAbortCanaryLocation, "complete")
+}
+
+func checkAbortCanaryFlags() {
+	Log("Checking cli flags.", "debug")
+	if KeyAbortCanaryLocation == "" {
+		fmt.Println("Need a key location in -k")
+		os.Exit(1)
+	}
+	Log("Required cli flags present.", "debug")
+}
+
+var (
+	// KeyAbortCanaryLocation is the key whose canary is removed.
+	KeyAbortCanaryLocation string
+)
+
+func init() {
+	RootCmd.AddCommand(abortCanaryCmd)
+	abortCanaryCmd.Flags().StringVarP(&KeyAbortCanaryLocation, "key", "k", "", "key whose canary to remove")
+}
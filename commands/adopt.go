@@ -0,0 +1,69 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"strings"
+	"time"
+)
+
+// Adopt lets out read a key another tool wrote - one without a checksum key.
+// The checksum and meta keys are saved the first time it's read.
+var Adopt bool
+
+// AdoptKey saves the checksum, updated, encoding and meta keys for a key that
+// doesn't have a checksum. The data is the key's data key - or the plain key
+// at <prefix>/<key> that consul-template and envconsul read, which is saved
+// as the data. It returns false if there's a checksum or nothing to adopt.
+func AdoptKey(c *consul.Client, key string) (bool, error) {
+	checksum, err := Get(c, KeyPath(key, "checksum"))
+	if err != nil || strings.TrimSpace(checksum) != "" {
+		return false, err
+	}
+	source := KeyPath(key, "data")
+	data, err := Get(c, source)
+	if err != nil {
+		return false, err
+	}
+	if data == "" {
+		source = strings.TrimSuffix(KeyRoot(key), "/")
+		if data, err = Get(c, source); err != nil {
+			return false, err
+		}
+	}
+	if data == "" {
+		Log(fmt.Sprintf("adopt key='%s' data='false' - nothing to adopt.", key), "info")
+		return false, nil
+	}
+	checksum = StoreChecksum(data)
+	if DryRunSkip(fmt.Sprintf("adopt '%s' from '%s' size='%d' checksum='%s'", key, source, len(data), checksum)) {
+		return false, nil
+	}
+	if !atomicWrites() {
+		return false, fmt.Errorf("--adopt needs a backend with transactions - not --backend %s", Backend)
+	}
+	stored, err := EncodeData(key, data)
+	if err != nil {
+		return false, err
+	}
+	saved, err := SaveCAS(c, key, stored, checksum, StoreChecksums(data), metaOp(key, "adopt:"+source))
+	if err != nil || !saved {
+		return saved, err
+	}
+	Log(fmt.Sprintf("adopt key='%s' source='%s' checksum='%s' saved='true'", key, source, checksum), "info")
+	Audit(AuditRecord{Event: AuditKey, Key: key, NewChecksum: checksum, ByteDelta: len(stored)})
+	return true, nil
+}
+
+// adoptOut adopts every key out reads with --adopt.
+func adoptOut(c *consul.Client, start time.Time) {
+	if !Adopt {
+		return
+	}
+	for _, key := range outKeys() {
+		_, err := AdoptKey(c, key)
+		outExitOnError(err, key, "adopt", start)
+	}
+}
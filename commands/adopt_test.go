@@ -0,0 +1,45 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"testing"
+)
+
+func TestAdoptKey(t *testing.T) {
+	tc, c := newTestConsul(t)
+	PrefixLocation = "testing"
+	tc.put("testing/app", exampleData)
+
+	saved, err := AdoptKey(c, "app")
+	if err != nil || !saved {
+		t.Fatalf("The plain key should be adopted: %v %v", saved, err)
+	}
+	if data, _ := tc.value("testing/app/data"); data != exampleData {
+		t.Errorf("The plain key should be saved as the data: %q", data)
+	}
+	if checksum, _ := tc.value("testing/app/checksum"); checksum != exampleDataSHA {
+		t.Errorf("The checksum should be backfilled: %q", checksum)
+	}
+	if meta, _ := GetMeta(c, "app"); meta == nil || meta.Source != "adopt:testing/app" {
+		t.Errorf("The meta key should say where it was adopted from: %+v", meta)
+	}
+
+	// It's only adopted once.
+	puts := tc.count("PUT")
+	if saved, err := AdoptKey(c, "app"); err != nil || saved || tc.count("PUT") != puts {
+		t.Errorf("A key with a checksum shouldn't be adopted again: %v %v", saved, err)
+	}
+
+	// A data key without a checksum.
+	tc.put("testing/hosts/data", exampleData)
+	if saved, err := AdoptKey(c, "hosts"); err != nil || !saved {
+		t.Fatalf("The data key should be adopted: %v %v", saved, err)
+	}
+	if checksum, _ := tc.value("testing/hosts/checksum"); checksum != exampleDataSHA {
+		t.Errorf("The checksum should be backfilled: %q", checksum)
+	}
+	if saved, err := AdoptKey(c, "missing"); err != nil || saved {
+		t.Errorf("There's nothing to adopt: %v %v", saved, err)
+	}
+}
@@ -0,0 +1,93 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"strings"
+	"time"
+)
+
+// AnnounceKey is the key out saves the checksum it applied under - so a
+// deploy can watch the new data reach every host.
+var AnnounceKey string
+
+// announceRefresh is how often a host that's up to date announces again - so
+// rollout-status --prune-after can tell it from a host that's gone.
+const announceRefresh = 24 * time.Hour
+
+// Announcement is what a host saves in <prefix>/_applied/<key>/<hostname>
+// once out has applied the data. Key is the key that was read - a canary
+// reads <key>/canary.
+type Announcement struct {
+	Host     string   `json:"host"`
+	Key      string   `json:"key"`
+	Checksum string   `json:"checksum"`
+	Applied  string   `json:"applied"`
+	Files    []string `json:"files"`
+	Version  string   `json:"version"`
+	RunID    string   `json:"run_id,omitempty"`
+}
+
+// AnnouncePath is where host announces what it applied for key.
+func AnnouncePath(key, host string) string {
+	return hostKeyRoot("applied", key) + host
+}
+
+// ParseAnnouncement reads an announcement.
+func ParseAnnouncement(value string) (Announcement, error) {
+	var announcement Announcement
+	err := json.Unmarshal([]byte(value), &announcement)
+	return announcement, err
+}
+
+// Announce saves that this host applied checksum from key to files.
+func Announce(c *consul.Client, announceKey, key, checksum string, files []string) error {
+	host := GetHostname()
+	value, _ := json.Marshal(Announcement{
+		Host:     host,
+		Key:      key,
+		Checksum: strings.TrimSpace(checksum),
+		Applied:  ReturnCurrentUTC(),
+		Files:    files,
+		Version:  Version,
+		RunID:    RunID,
+	})
+	path := AnnouncePath(announceKey, host)
+	if err := Set(c, path, string(value)); err != nil {
+		return err
+	}
+	Log(fmt.Sprintf("announce key='%s' path='%s' checksum='%s'", announceKey, path, strings.TrimSpace(checksum)), "info")
+	return nil
+}
+
+// announceOut announces what out applied with --announce-key. When nothing
+// changed it's only saved if the host announced a different checksum or
+// hasn't announced for announceRefresh - so a run that didn't do anything
+// doesn't write to Consul. A failure is logged:
+// the files were still written.
+func announceOut(c *consul.Client, key, checksum string, changed bool) {
+	if AnnounceKey == "" {
+		return
+	}
+	checksum = strings.TrimSpace(checksum)
+	if !changed {
+		value, err := Get(c, AnnouncePath(AnnounceKey, GetHostname()))
+		if err == nil && value != "" {
+			announced, err := ParseAnnouncement(value)
+			applied, _ := time.Parse(time.RFC3339, announced.Applied)
+			if err == nil && announced.Checksum == checksum && announced.Key == key && time.Since(applied) < announceRefresh {
+				Log(fmt.Sprintf("announce key='%s' checksum='%s' announced='true'", AnnounceKey, checksum), "debug")
+				return
+			}
+		}
+	}
+	if DryRunSkip(fmt.Sprintf("announce checksum '%s' in '%s'", checksum, AnnouncePath(AnnounceKey, GetHostname()))) {
+		return
+	}
+	if err := Announce(c, AnnounceKey, key, checksum, FilestoWrite); err != nil {
+		Log(fmt.Sprintf("announce key='%s' message='%v' announced='false'", AnnounceKey, err), "error")
+	}
+}
@@ -0,0 +1,40 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"testing"
+)
+
+func TestAnnounceOut(t *testing.T) {
+	tc, c := newTestConsul(t)
+	PrefixLocation = "testing"
+	AnnounceKey = "hosts"
+	defer func() { AnnounceKey = "" }()
+	path := "testing/_applied/hosts/" + GetHostname()
+
+	announceOut(c, "hosts", exampleDataSHA+"\n", true)
+	value, ok := tc.value(path)
+	if !ok {
+		t.Fatal("The checksum should be announced after a write.")
+	}
+	announcement, err := ParseAnnouncement(value)
+	if err != nil || announcement.Checksum != exampleDataSHA || announcement.Key != "hosts" || announcement.Host != GetHostname() {
+		t.Errorf("The announcement should have the host and checksum: %v %v", announcement, err)
+	}
+
+	// A run that didn't change anything doesn't write it again.
+	puts := tc.count("PUT")
+	announceOut(c, "hosts", exampleDataSHA, false)
+	if tc.count("PUT") != puts {
+		t.Error("The same checksum shouldn't be announced again.")
+	}
+	announceOut(c, "hosts/canary", exampleDataSHA, false)
+	if tc.count("PUT") == puts {
+		t.Error("A different key should be announced.")
+	}
+	value, _ = tc.value(path)
+	if announcement, _ := ParseAnnouncement(value); announcement.Key != "hosts/canary" {
+		t.Errorf("The key that was read should be announced: %v", announcement)
+	}
+}
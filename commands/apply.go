@@ -0,0 +1,650 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"github.com/smallfish/simpleyaml"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+var applyCmd = &cobra.Command{
+	Use:   "apply",
+	Short: "Run many out and in definitions from a manifest.",
+	Long:  `Apply is for hosts that manage lots of keys - every entry in the manifest is run as its own out or in with a pool of workers.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		checkApplyFlags()
+		AutoEnable()
+	},
+	Run: applyRun,
+}
+
+func applyRun(cmd *cobra.Command, args []string) {
+	start := time.Now()
+
+	data, err := ioutil.ReadFile(ApplyManifest)
+	if err != nil {
+		fmt.Printf("Could not read the manifest: %v\n", err)
+		os.Exit(1)
+	}
+	var services []ApplyService
+	entries, err := ParseManifest(data)
+	if err == nil {
+		services, err = ParseServices(data, entries)
+	}
+	if err != nil {
+		fmt.Printf("Could not parse the manifest: %v\n", err)
+		os.Exit(1)
+	}
+	Log(fmt.Sprintf("apply manifest='%s' entries='%d' services='%d' workers='%d'", ApplyManifest, len(entries), len(services), ApplyWorkers), "info")
+
+	EntryTokens(entries)
+	globals, secrets := ApplyGlobalArgs(RootCmd.PersistentFlags()), ApplyGlobalEnv(RootCmd.PersistentFlags())
+	results, serviceResults := ApplyServices(entries, services, ApplyWorkers, func(entry ApplyEntry) int {
+		return runApplyEntry(append([]string{entry.Direction}, append(EntryGlobalArgs(globals, entry), entry.Args()...)...), EntryGlobalEnv(secrets, entry))
+	}, RunCommand)
+
+	failed := printApplyResults(os.Stdout, results, serviceResults)
+	total := len(results) + len(serviceResults)
+	Log(fmt.Sprintf("apply entries='%d' services='%d' failed='%d'", len(results), len(serviceResults), failed), "info")
+	if code := ApplyExitCode(total, failed); code != 0 {
+		exitRun(code, start, "apply", "apply_failed", "")
+	}
+	RunTime(start, "apply", "complete")
+}
+
+// ApplyExitCode is 0 when nothing failed, ExitSomeFailed when some of the
+// entries and services failed and ExitAllFailed when all of them did - so
+// cron can tell one broken key from a broken host.
+func ApplyExitCode(total, failed int) int {
+	switch {
+	case failed == 0:
+		return ExitWrote
+	case failed < total:
+		return ExitSomeFailed
+	}
+	return ExitAllFailed
+}
+
+// applyResultName is what an entry's exit code means.
+func applyResultName(code int) string {
+	switch code {
+	case ExitWrote:
+		return "written"
+	case ExitNoChange:
+		return "unchanged"
+	case ExitDeferred:
+		return "deferred"
+	}
+	if Skipped(code) {
+		return "skipped"
+	}
+	return "failed"
+}
+
+// printApplyResults prints a line for every entry and service, sends the
+// apply_entry metric for each entry and returns how many failed.
+func printApplyResults(out io.Writer, results []ApplyResult, serviceResults []ServiceResult) int {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tKEY\tFILE\tEXIT\tRESULT")
+	failed := 0
+	counts := make(map[string]int)
+	for _, result := range results {
+		name := applyResultName(result.Code)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", result.Entry.Direction, result.Entry.Key, lsValue(result.Entry.File), result.Code, name)
+		StatsdApplyEntry(result.Entry.Key, result.Entry.Direction, name, result.Code)
+		counts[name]++
+		if !Succeeded(result.Code) && !Skipped(result.Code) {
+			failed++
+		}
+	}
+	for _, result := range serviceResults {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", "exec", result.Service.Name, lsValue(result.Service.Exec), "-", result.Status)
+		if result.Status == ServiceFailed || result.Status == ServiceSkipped {
+			failed++
+		}
+	}
+	w.Flush()
+	fmt.Fprintf(out, "%d entries: %d written, %d unchanged, %d deferred, %d skipped, %d failed", len(results), counts["written"], counts["unchanged"], counts["deferred"], counts["skipped"], counts["failed"])
+	if len(serviceResults) > 0 {
+		fmt.Fprintf(out, " - %d services, %d failed", len(serviceResults), failed-counts["failed"])
+	}
+	fmt.Fprintln(out)
+	return failed
+}
+
+// ApplyEntry is a single out or in from a manifest.
+type ApplyEntry struct {
+	Direction string
+	Key       string
+	File      string
+	Chmod     string
+	Owner     string
+	Group     string
+	Length    int
+	Exec      string
+	Sorted    bool
+	Sort      string
+	Unique    bool
+
+	// Outputs are the files an out writes from the key when there's more
+	// than one - File is the first of them.
+	Outputs []ApplyOutput
+
+	// Service is the ApplyService the entry belongs to - blank for none.
+	Service string
+
+	// Prefix is the entry's --prefix and TokenFile its --token-file - so one
+	// manifest can manage keys from teams that don't share a token.
+	Prefix    string
+	TokenFile string
+}
+
+// ApplyOutput is one of the files an entry writes and the format it's in.
+type ApplyOutput struct {
+	File   string
+	Format string
+}
+
+// ApplyResult is the exit code from running an ApplyEntry.
+type ApplyResult struct {
+	Entry ApplyEntry
+	Code  int
+}
+
+// ParseManifest reads the entries from a yaml manifest - see docs/cli.md for
+// an example.
+func ParseManifest(data []byte) ([]ApplyEntry, error) {
+	manifest, err := simpleyaml.NewYaml(data)
+	if err != nil {
+		return nil, err
+	}
+	size, err := manifest.Get("entries").GetArraySize()
+	if err != nil {
+		return nil, errors.New("the manifest needs a list of entries")
+	}
+	var entries []ApplyEntry
+	for i := 0; i < size; i++ {
+		item := manifest.Get("entries").GetIndex(i)
+		entry := ApplyEntry{}
+		entry.Direction, _ = item.Get("direction").String()
+		entry.Key, _ = item.Get("key").String()
+		entry.File, _ = item.Get("file").String()
+		entry.Chmod = configMode(item.Get("chmod"))
+		entry.Owner, _ = item.Get("owner").String()
+		entry.Group, _ = item.Get("group").String()
+		entry.Length, _ = item.Get("length").Int()
+		entry.Exec, _ = item.Get("exec").String()
+		entry.Sorted, _ = item.Get("sorted").Bool()
+		entry.Sort, _ = item.Get("sort").String()
+		entry.Unique, _ = item.Get("unique").Bool()
+		entry.Service, _ = item.Get("service").String()
+		entry.Prefix, _ = item.Get("prefix").String()
+		entry.TokenFile, _ = item.Get("token_file").String()
+		if entry.Direction == "" {
+			entry.Direction = "out"
+		}
+		if entry.Direction != "out" && entry.Direction != "in" {
+			return nil, fmt.Errorf("entry %d: direction needs to be out or in", i)
+		}
+		outputs, _ := item.Get("outputs").GetArraySize()
+		for j := 0; j < outputs; j++ {
+			output := ApplyOutput{}
+			output.File, _ = item.Get("outputs").GetIndex(j).Get("file").String()
+			output.Format, _ = item.Get("outputs").GetIndex(j).Get("format").String()
+			if output.Format == "" {
+				output.Format = "raw"
+			}
+			if output.File == "" {
+				return nil, fmt.Errorf("entry %d: output %d needs a file", i, j)
+			}
+			if !ValidFormat(output.Format) {
+				return nil, fmt.Errorf("entry %d: unknown format '%s' - use one of: %v", i, output.Format, outputFormats)
+			}
+			entry.Outputs = append(entry.Outputs, output)
+		}
+		if len(entry.Outputs) > 0 {
+			if entry.File != "" || entry.Direction != "out" {
+				return nil, fmt.Errorf("entry %d: outputs are for an out without a file", i)
+			}
+			entry.File = entry.Outputs[0].File
+		}
+		if entry.Key == "" || entry.File == "" {
+			return nil, fmt.Errorf("entry %d: needs a key and a file", i)
+		}
+		if _, err := ParseFileMode(entry.Chmod); entry.Chmod != "" && err != nil {
+			return nil, fmt.Errorf("entry %d: %v", i, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// ApplyService is a set of entries that feed the same service - its exec runs
+// once after all of them instead of once for every file. The service only runs
+// once the services in After are done.
+type ApplyService struct {
+	Name  string
+	Exec  string
+	After []string
+
+	// level is how many services have to run first.
+	level int
+}
+
+// The status of a service once its entries have run.
+const (
+	// ServiceRan is when something was written - and the exec ran if there is one.
+	ServiceRan = "ran"
+
+	// ServiceUnchanged is when nothing was written so the exec didn't run.
+	ServiceUnchanged = "unchanged"
+
+	// ServiceFailed is when an entry or the exec failed.
+	ServiceFailed = "failed"
+
+	// ServiceSkipped is when a service in After failed so nothing in the service ran.
+	ServiceSkipped = "skipped"
+)
+
+// ServiceResult is what happened to an ApplyService - Code is the exec's exit code.
+type ServiceResult struct {
+	Service ApplyService
+	Status  string
+	Code    int
+}
+
+// ParseServices reads the services from a yaml manifest and checks that every
+// service the entries refer to exists and that nothing in After loops back on
+// itself. They're returned in the order they run.
+func ParseServices(data []byte, entries []ApplyEntry) ([]ApplyService, error) {
+	manifest, err := simpleyaml.NewYaml(data)
+	if err != nil {
+		return nil, err
+	}
+	var services []ApplyService
+	index := make(map[string]int)
+	size, _ := manifest.Get("services").GetArraySize()
+	for i := 0; i < size; i++ {
+		item := manifest.Get("services").GetIndex(i)
+		service := ApplyService{}
+		service.Name, _ = item.Get("name").String()
+		service.Exec, _ = item.Get("exec").String()
+		after, _ := item.Get("after").Array()
+		for _, name := range after {
+			service.After = append(service.After, fmt.Sprintf("%v", name))
+		}
+		if service.Name == "" {
+			return nil, fmt.Errorf("service %d: needs a name", i)
+		}
+		if _, ok := index[service.Name]; ok {
+			return nil, fmt.Errorf("service '%s' is in the manifest twice", service.Name)
+		}
+		index[service.Name] = len(services)
+		services = append(services, service)
+	}
+	for i, entry := range entries {
+		if _, ok := index[entry.Service]; entry.Service != "" && !ok {
+			return nil, fmt.Errorf("entry %d: there's no service '%s'", i, entry.Service)
+		}
+	}
+	// 0 hasn't been looked at, 1 is being looked at and 2 is done.
+	state := make([]int, len(services))
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case 1:
+			return fmt.Errorf("service '%s' runs after itself", services[i].Name)
+		case 2:
+			return nil
+		}
+		state[i] = 1
+		for _, name := range services[i].After {
+			j, ok := index[name]
+			if !ok {
+				return fmt.Errorf("service '%s' is after '%s' which isn't a service", services[i].Name, name)
+			}
+			if err := visit(j); err != nil {
+				return err
+			}
+			if services[j].level+1 > services[i].level {
+				services[i].level = services[j].level + 1
+			}
+		}
+		state[i] = 2
+		return nil
+	}
+	for i := range services {
+		if err := visit(i); err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(services, func(i, j int) bool { return services[i].level < services[j].level })
+	return services, nil
+}
+
+// ApplyServices runs the entries a level at a time - the entries that aren't
+// in a service and the services that don't have to wait go first - with a
+// pool of workers for each level. After each level runExec runs the exec of
+// every service that wrote something. A service whose entry or exec failed
+// stops the services that are after it. The results are in the same order as
+// the entries and services.
+func ApplyServices(entries []ApplyEntry, services []ApplyService, workers int, run func(ApplyEntry) int, runExec func(string) int) ([]ApplyResult, []ServiceResult) {
+	results := make([]ApplyResult, len(entries))
+	serviceResults := make([]ServiceResult, len(services))
+	index := make(map[string]int)
+	levels := 0
+	for i, service := range services {
+		index[service.Name] = i
+		serviceResults[i].Service = service
+		if service.level+1 > levels {
+			levels = service.level + 1
+		}
+	}
+	if levels == 0 {
+		levels = 1
+	}
+	// skipped returns true if a service that has to run first failed.
+	skipped := func(service ApplyService) bool {
+		for _, name := range service.After {
+			if status := serviceResults[index[name]].Status; status == ServiceFailed || status == ServiceSkipped {
+				return true
+			}
+		}
+		return false
+	}
+	for level := 0; level < levels; level++ {
+		var batch []int
+		var batchEntries []ApplyEntry
+		for i, entry := range entries {
+			if entry.Service == "" && level > 0 {
+				continue
+			}
+			if entry.Service != "" {
+				service := services[index[entry.Service]]
+				if service.level != level {
+					continue
+				}
+				if skipped(service) {
+					results[i] = ApplyResult{Entry: entry, Code: ExitError}
+					continue
+				}
+			}
+			batch, batchEntries = append(batch, i), append(batchEntries, entry)
+		}
+		for j, result := range Apply(batchEntries, workers, run) {
+			results[batch[j]] = result
+		}
+		for i, service := range services {
+			if service.level != level {
+				continue
+			}
+			serviceResults[i].Status = serviceStatus(service, entries, results, skipped(service))
+			if serviceResults[i].Status != ServiceRan || service.Exec == "" {
+				continue
+			}
+			Log(fmt.Sprintf("apply service='%s' exec='%s'", service.Name, service.Exec), "info")
+			if serviceResults[i].Code = runExec(service.Exec); serviceResults[i].Code != 0 {
+				serviceResults[i].Status = ServiceFailed
+			}
+		}
+	}
+	return results, serviceResults
+}
+
+// serviceStatus is ServiceRan if one of the service's entries wrote its file
+// or key and none of them failed - a Skipped entry didn't do either.
+func serviceStatus(service ApplyService, entries []ApplyEntry, results []ApplyResult, skipped bool) string {
+	if skipped {
+		return ServiceSkipped
+	}
+	status := ServiceUnchanged
+	for i, entry := range entries {
+		if entry.Service != service.Name {
+			continue
+		}
+		switch {
+		case Skipped(results[i].Code):
+		case !Succeeded(results[i].Code):
+			return ServiceFailed
+		case results[i].Code == ExitWrote:
+			status = ServiceRan
+		}
+	}
+	return status
+}
+
+// Args turns the entry into the flags for an out or in.
+func (entry ApplyEntry) Args() []string {
+	args := []string{"-k", entry.Key}
+	if len(entry.Outputs) == 0 {
+		args = append(args, "-f", entry.File)
+	}
+	for _, output := range entry.Outputs {
+		args = append(args, "-f", output.File, "--format", output.Format)
+	}
+	if entry.Chmod != "" {
+		args = append(args, "-c", entry.Chmod)
+	}
+	if entry.Owner != "" {
+		args = append(args, "-o", entry.Owner)
+	}
+	if entry.Group != "" {
+		args = append(args, "--group", entry.Group)
+	}
+	if entry.Length != 0 {
+		args = append(args, "-l", strconv.Itoa(entry.Length))
+	}
+	if entry.Exec != "" {
+		args = append(args, "-e", entry.Exec)
+	}
+	if entry.Sorted && entry.Direction == "in" {
+		args = append(args, "-S")
+	}
+	if entry.Sort != "" && entry.Direction == "in" {
+		args = append(args, "--sort", entry.Sort)
+	}
+	if entry.Unique && entry.Direction == "in" {
+		args = append(args, "--unique")
+	}
+	if entry.Prefix != "" {
+		args = append(args, "-p", entry.Prefix)
+	}
+	if entry.TokenFile != "" {
+		args = append(args, "--token-file", entry.TokenFile)
+	}
+	return args
+}
+
+// EntryTokens gives every entry without a token_file the one for its prefix
+// in prefix_tokens.
+func EntryTokens(entries []ApplyEntry) {
+	for i, entry := range entries {
+		if entry.TokenFile != "" {
+			continue
+		}
+		prefix := entry.Prefix
+		if prefix == "" {
+			prefix = PrefixLocation
+		}
+		entries[i].TokenFile = PrefixTokenFile(prefix)
+	}
+}
+
+// EntryGlobalArgs are the globals for an entry - the ones that pick the
+// token are left off when the entry has its own.
+func EntryGlobalArgs(globals []string, entry ApplyEntry) []string {
+	if entry.TokenFile == "" {
+		return globals
+	}
+	var args []string
+	for _, arg := range globals {
+		if strings.HasPrefix(arg, "--token=") || strings.HasPrefix(arg, "--token-file=") || strings.HasPrefix(arg, "--vault-consul-role=") {
+			continue
+		}
+		args = append(args, arg)
+	}
+	return args
+}
+
+// ApplyGlobalArgs passes along every global flag that was set - on the command
+// line, in the config file or from the environment - and the RunID so every
+// entry is logged with the same one. The secretFlags go in ApplyGlobalEnv.
+func ApplyGlobalArgs(flags *pflag.FlagSet) []string {
+	var args []string
+	flags.Visit(func(flag *pflag.Flag) {
+		if _, secret := secretFlags[flag.Name]; secret || flag.Name == "run-id" || flag.Name == "config" {
+			return
+		}
+		if slice, ok := flag.Value.(pflag.SliceValue); ok {
+			for _, item := range slice.GetSlice() {
+				args = append(args, fmt.Sprintf("--%s=%s", flag.Name, item))
+			}
+			return
+		}
+		args = append(args, fmt.Sprintf("--%s=%s", flag.Name, flag.Value.String()))
+	})
+	if RunID != "" {
+		args = append(args, fmt.Sprintf("--run-id=%s", RunID))
+	}
+	return args
+}
+
+// secretFlags are the global flags that are passed to the commands apply runs
+// in their environment instead - anyone on the host can read another
+// process's arguments.
+var secretFlags = map[string]string{
+	"token":           "KVEXPRESS_TOKEN",
+	"vault-token":     "KVEXPRESS_VAULT_TOKEN",
+	"redis-password":  "KVEXPRESS_REDIS_PASSWORD",
+	"zk-auth":         "KVEXPRESS_ZK_AUTH",
+	"datadog_api_key": "KVEXPRESS_DATADOG_API_KEY",
+	"datadog_app_key": "KVEXPRESS_DATADOG_APP_KEY",
+}
+
+// ApplyGlobalEnv is the environment that passes along the secretFlags that
+// were set.
+func ApplyGlobalEnv(flags *pflag.FlagSet) []string {
+	var env []string
+	flags.Visit(func(flag *pflag.Flag) {
+		if name, secret := secretFlags[flag.Name]; secret {
+			env = append(env, name+"="+flag.Value.String())
+		}
+	})
+	sort.Strings(env)
+	return env
+}
+
+// EntryGlobalEnv is ApplyGlobalEnv for an entry - the token is left off when
+// the entry has its own.
+func EntryGlobalEnv(env []string, entry ApplyEntry) []string {
+	if entry.TokenFile == "" {
+		return env
+	}
+	var kept []string
+	for _, value := range env {
+		if !strings.HasPrefix(value, secretFlags["token"]+"=") {
+			kept = append(kept, value)
+		}
+	}
+	return kept
+}
+
+// SecretEnv sets the secretFlags apply passed in the environment - unless
+// they were passed as flags too - and takes them out of the environment so
+// --exec and the hooks don't get them.
+func SecretEnv(flags *pflag.FlagSet) {
+	for name, env := range secretFlags {
+		value, ok := os.LookupEnv(env)
+		if !ok {
+			continue
+		}
+		os.Unsetenv(env)
+		if flag := flags.Lookup(name); flag != nil && !flag.Changed {
+			if err := flags.Set(name, value); err != nil {
+				Log(fmt.Sprintf("env='%s' flag='%s' message='%v'", env, name, err), "info")
+			}
+		}
+	}
+}
+
+// Apply runs every entry with a pool of workers and returns the results in the
+// same order as the entries.
+func Apply(entries []ApplyEntry, workers int, run func(ApplyEntry) int) []ApplyResult {
+	if workers < 1 {
+		workers = 1
+	}
+	results := make([]ApplyResult, len(entries))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = ApplyResult{Entry: entries[i], Code: run(entries[i])}
+			}
+		}()
+	}
+	for i := range entries {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+// runApplyEntry runs kvexpress again with args and returns its exit code. Each
+// entry gets its own process so one entry's flags or exit can't affect another.
+func runApplyEntry(args, env []string) int {
+	self, err := os.Executable()
+	if err != nil {
+		self = os.Args[0]
+	}
+	Log(fmt.Sprintf("apply exec='%s' args='%v'", self, args), "debug")
+	command := exec.CommandContext(RunContext(), self, args...)
+	command.Env = append(os.Environ(), env...)
+	out, err := command.CombinedOutput()
+	if len(out) > 0 {
+		fmt.Print(string(out))
+	}
+	if err != nil {
+		Log(fmt.Sprintf("apply args='%v' message='%v'", args, err), "info")
+	}
+	return ProcessExitCode(err)
+}
+
+func checkApplyFlags() {
+	Log("Checking cli flags.", "debug")
+	if ApplyManifest == "" {
+		fmt.Println("Need a manifest in -m")
+		os.Exit(1)
+	}
+	Log("Required cli flags present.", "debug")
+}
+
+var (
+	// ApplyManifest is the yaml file that lists the entries to run.
+	ApplyManifest string
+
+	// ApplyWorkers is how many entries are run at once.
+	ApplyWorkers int
+)
+
+func init() {
+	RootCmd.AddCommand(applyCmd)
+	applyCmd.Flags().StringVarP(&ApplyManifest, "manifest", "m", "", "yaml manifest of out and in entries")
+	applyCmd.Flags().IntVarP(&ApplyWorkers, "workers", "w", 4, "how many entries to run at once")
+}
@@ -0,0 +1,58 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"strings"
+	"time"
+)
+
+// ApplyAfter is how long a new checksum has to stay the same before out
+// writes it - so data that flaps isn't applied halfway through.
+var ApplyAfter time.Duration
+
+// holdOut stops with ExitDeferred if the files would change to checksum but
+// the key hasn't been saved for ApplyAfter yet. The wait is from the key's
+// updated time, which every save of new data moves - so data that flaps and
+// comes back still starts the wait over. A key without one falls back to when
+// this host first saw the checksum in the pending file.
+func holdOut(c *consul.Client, key string, targets []OutTarget, checksum string, start time.Time) {
+	if ApplyAfter <= 0 || !targetsPending(targets, checksum) {
+		return
+	}
+	checksum = strings.TrimSpace(checksum)
+	now := time.Now()
+	since, ok := keyUpdated(c, key)
+	if !ok {
+		if since, ok = PendingSince(key, checksum); !ok {
+			since = now
+		}
+	}
+	savePending(key, checksum)
+	if waited := now.Sub(since); waited < ApplyAfter {
+		Log(fmt.Sprintf("apply_after='%s' key='%s' checksum='%s' stable='%s' - not writing until it's stable.", ApplyAfter, key, checksum, waited.Round(time.Second)), "info")
+		StatsdDeferred(key)
+		exitRun(ExitDeferred, start, key, "apply_after", "")
+	}
+	Log(fmt.Sprintf("apply_after='%s' key='%s' checksum='%s' stable='%s' - writing.", ApplyAfter, key, checksum, now.Sub(since).Round(time.Second)), "info")
+}
+
+// keyUpdated is the time key's data was last saved - false if it can't be
+// read or isn't a time.
+func keyUpdated(c *consul.Client, key string) (time.Time, bool) {
+	if c == nil {
+		return time.Time{}, false
+	}
+	value, err := Get(c, KeyPath(key, "updated"))
+	if err != nil {
+		Log(fmt.Sprintf("apply_after key='%s' message='%v' - using the pending file.", key, err), "debug")
+		return time.Time{}, false
+	}
+	updated, err := time.Parse(time.RFC3339, strings.TrimSpace(value))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return updated, true
+}
@@ -0,0 +1,81 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHoldOut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvexpress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	TmpDir = dir
+	PrefixLocation = "testing"
+	ApplyAfter = 10 * time.Minute
+	defer func() { TmpDir, ApplyAfter = "", 0 }()
+	targets := []OutTarget{{File: filepath.Join(dir, "hosts"), Output: exampleData}}
+
+	savePending("hosts", exampleDataSHA+"\n")
+	since, ok := PendingSince("hosts", exampleDataSHA)
+	if !ok || time.Since(since) > time.Minute {
+		t.Fatalf("The checksum should be pending from now: %v %t", since, ok)
+	}
+	if _, ok := PendingSince("hosts", "sha256:other"); ok {
+		t.Error("Another checksum isn't pending.")
+	}
+
+	// The same checksum keeps the time it was first seen - so it can be written.
+	old := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	ioutil.WriteFile(PendingPath("hosts"), []byte(old+" "+exampleDataSHA+"\n"), 0644)
+	savePending("hosts", exampleDataSHA)
+	if since, _ := PendingSince("hosts", exampleDataSHA); since.UTC().Format(time.RFC3339) != old {
+		t.Errorf("The time the checksum was first held back should be kept: %v", since)
+	}
+	holdOut(nil, "hosts", targets, exampleDataSHA, time.Now())
+
+	// A new checksum starts the wait over.
+	savePending("hosts", "sha256:other")
+	if _, ok := PendingSince("hosts", exampleDataSHA); ok {
+		t.Error("A new checksum should replace the one that was pending.")
+	}
+}
+
+func TestHoldOutUpdated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvexpress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	TmpDir = dir
+	PrefixLocation = "testing"
+	ApplyAfter = 10 * time.Minute
+	defer func() { TmpDir, ApplyAfter = "", 0 }()
+	targets := []OutTarget{{File: filepath.Join(dir, "hosts"), Output: exampleData}}
+	tc, c := newTestConsul(t)
+
+	if _, ok := keyUpdated(c, "hosts"); ok {
+		t.Error("A key without an updated time should fall back to the pending file.")
+	}
+	tc.put("testing/hosts/updated", "yesterday")
+	if _, ok := keyUpdated(c, "hosts"); ok {
+		t.Error("An updated that isn't a time should fall back to the pending file.")
+	}
+
+	// The key was saved an hour ago - a host that only sees it now writes it.
+	old := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	tc.put("testing/hosts/updated", old)
+	if updated, ok := keyUpdated(c, "hosts"); !ok || updated.Format(time.RFC3339) != old {
+		t.Errorf("The wait should be from the key's updated time: %v %t", updated, ok)
+	}
+	holdOut(c, "hosts", targets, exampleDataSHA, time.Now())
+	if _, ok := PendingSince("hosts", exampleDataSHA); !ok {
+		t.Error("The checksum should still be saved in the pending file.")
+	}
+}
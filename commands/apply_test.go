@@ -0,0 +1,333 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"bytes"
+	"github.com/spf13/pflag"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testManifest = []byte(`---
+entries:
+  - key: hosts
+    file: /etc/hosts.consul
+    chmod: 0644
+    owner: root
+    group: wheel
+    length: 5
+    exec: "sudo pkill -HUP dnsmasq"
+  - direction: in
+    key: services
+    file: /etc/services
+    sorted: true
+    sort: version
+    unique: true`)
+
+func TestParseManifest(t *testing.T) {
+	entries, err := ParseManifest(testManifest)
+	if err != nil {
+		t.Fatalf("Could not parse the manifest: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("There should be 2 entries: %d", len(entries))
+	}
+	out := []string{"-k", "hosts", "-f", "/etc/hosts.consul", "-c", "0644", "-o", "root", "--group", "wheel", "-l", "5", "-e", "sudo pkill -HUP dnsmasq"}
+	if entries[0].Direction != "out" || !reflect.DeepEqual(entries[0].Args(), out) {
+		t.Errorf("The out entry is wrong: %s %v", entries[0].Direction, entries[0].Args())
+	}
+	in := []string{"-k", "services", "-f", "/etc/services", "-S", "--sort", "version", "--unique"}
+	if entries[1].Direction != "in" || !reflect.DeepEqual(entries[1].Args(), in) {
+		t.Errorf("The in entry is wrong: %s %v", entries[1].Direction, entries[1].Args())
+	}
+}
+
+func TestParseManifestOutputs(t *testing.T) {
+	entries, err := ParseManifest([]byte(`---
+entries:
+  - key: app
+    outputs:
+      - file: /etc/app/config.json
+        format: json
+      - file: /etc/default/app
+        format: env-file
+      - file: /etc/systemd/system/app.service.d/kvexpress.conf
+        format: systemd-dropin
+    exec: "sudo systemctl daemon-reload && sudo systemctl restart app"`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"-k", "app", "-f", "/etc/app/config.json", "--format", "json", "-f", "/etc/default/app", "--format", "env-file", "-f", "/etc/systemd/system/app.service.d/kvexpress.conf", "--format", "systemd-dropin", "-e", "sudo systemctl daemon-reload && sudo systemctl restart app"}
+	if !reflect.DeepEqual(entries[0].Args(), args) || entries[0].File != "/etc/app/config.json" {
+		t.Errorf("Every output should be passed to out: %v", entries[0].Args())
+	}
+}
+
+func TestParseManifestInvalid(t *testing.T) {
+	for _, manifest := range []string{
+		"---\nkey: hosts",
+		"---\nentries:\n  - key: hosts",
+		"---\nentries:\n  - direction: sideways\n    key: hosts\n    file: /tmp/hosts",
+		"---\nentries:\n  - key: app\n    outputs:\n      - file: /tmp/app\n        format: xml",
+		"---\nentries:\n  - key: app\n    file: /tmp/app\n    outputs:\n      - file: /tmp/app.env",
+		"---\nentries:\n  - direction: in\n    key: app\n    outputs:\n      - file: /tmp/app",
+	} {
+		if _, err := ParseManifest([]byte(manifest)); err == nil {
+			t.Errorf("The manifest should not parse: %q", manifest)
+		}
+	}
+}
+
+func TestApplyGlobalArgs(t *testing.T) {
+	var server, token, apiKey, zkAuth string
+	var dirs []string
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.StringVarP(&server, "server", "s", "localhost:8500", "")
+	flags.StringVarP(&zkAuth, "zk-auth", "", "", "")
+	flags.StringSliceVarP(&dirs, "allowed-dir", "", []string{}, "")
+	flags.StringVarP(&ConfigFile, "config", "C", "", "")
+	flags.StringVarP(&token, "token", "t", "anonymous", "")
+	flags.StringVarP(&apiKey, "datadog_api_key", "a", "", "")
+	flags.Parse([]string{"-s", "consul:8500", "--allowed-dir", "/etc,/opt", "-C", "/etc/kvexpress.yaml", "-t", "super-token", "-a", "dd-key", "--zk-auth", "kvexpress:zk-password"})
+	RunID = "abcd"
+	defer func() { RunID = ""; ConfigFile = "" }()
+
+	args := ApplyGlobalArgs(flags)
+	expected := []string{"--allowed-dir=/etc", "--allowed-dir=/opt", "--server=consul:8500", "--run-id=abcd"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("The global args are wrong: %v", args)
+	}
+	env := ApplyGlobalEnv(flags)
+	if !reflect.DeepEqual(env, []string{"KVEXPRESS_DATADOG_API_KEY=dd-key", "KVEXPRESS_TOKEN=super-token", "KVEXPRESS_ZK_AUTH=kvexpress:zk-password"}) {
+		t.Errorf("The secrets should be passed in the environment: %v", env)
+	}
+	if kept := EntryGlobalEnv(env, ApplyEntry{TokenFile: "/etc/kvexpress/team.token"}); !reflect.DeepEqual(kept, []string{"KVEXPRESS_DATADOG_API_KEY=dd-key", "KVEXPRESS_ZK_AUTH=kvexpress:zk-password"}) {
+		t.Errorf("An entry with its own token shouldn't get the global one: %v", kept)
+	}
+}
+
+func TestSecretEnv(t *testing.T) {
+	var token, vaultToken, zkAuth string
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.StringVarP(&token, "token", "t", "anonymous", "")
+	flags.StringVarP(&vaultToken, "vault-token", "", "", "")
+	flags.StringVarP(&zkAuth, "zk-auth", "", "", "")
+	flags.Parse([]string{"--vault-token", "from-the-flag"})
+	os.Setenv("KVEXPRESS_TOKEN", "super-token")
+	os.Setenv("KVEXPRESS_VAULT_TOKEN", "from-apply")
+	os.Setenv("KVEXPRESS_ZK_AUTH", "kvexpress:zk-password")
+	defer os.Unsetenv("KVEXPRESS_TOKEN")
+	defer os.Unsetenv("KVEXPRESS_VAULT_TOKEN")
+	defer os.Unsetenv("KVEXPRESS_ZK_AUTH")
+
+	SecretEnv(flags)
+	if token != "super-token" || vaultToken != "from-the-flag" || zkAuth != "kvexpress:zk-password" {
+		t.Errorf("The environment should only set the flags that weren't passed: %s %s %s", token, vaultToken, zkAuth)
+	}
+	for _, env := range []string{"KVEXPRESS_TOKEN", "KVEXPRESS_ZK_AUTH"} {
+		if _, ok := os.LookupEnv(env); ok {
+			t.Errorf("%s should be taken out of the environment.", env)
+		}
+	}
+}
+
+func TestEntryTokens(t *testing.T) {
+	prefixTokens = map[string]string{"team-a": "/etc/kvexpress/team-a.token"}
+	defer func() { prefixTokens = nil }()
+	PrefixLocation = "kvexpress"
+	entries := []ApplyEntry{
+		{Key: "hosts", File: "/etc/hosts", Prefix: "team-a"},
+		{Key: "hosts", File: "/etc/hosts.b", Prefix: "team-b", TokenFile: "/etc/kvexpress/team-b.token"},
+		{Key: "hosts", File: "/etc/hosts.c"},
+	}
+	EntryTokens(entries)
+	if entries[0].TokenFile != "/etc/kvexpress/team-a.token" || entries[1].TokenFile != "/etc/kvexpress/team-b.token" || entries[2].TokenFile != "" {
+		t.Errorf("The entries should get their prefix's token: %+v", entries)
+	}
+	if args := entries[0].Args(); !reflect.DeepEqual(args[len(args)-4:], []string{"-p", "team-a", "--token-file", "/etc/kvexpress/team-a.token"}) {
+		t.Errorf("The prefix and token file should be passed: %v", args)
+	}
+	globals := []string{"--server=consul:8500", "--token=super-token", "--vault-consul-role=ops"}
+	if args := EntryGlobalArgs(globals, entries[0]); !reflect.DeepEqual(args, []string{"--server=consul:8500"}) {
+		t.Errorf("An entry with its own token shouldn't get the global token: %v", args)
+	}
+	if args := EntryGlobalArgs(globals, entries[2]); !reflect.DeepEqual(args, globals) {
+		t.Errorf("An entry without a token should get the global token: %v", args)
+	}
+}
+
+func TestApplyWorkers(t *testing.T) {
+	var entries []ApplyEntry
+	for i := 0; i < 10; i++ {
+		entries = append(entries, ApplyEntry{Direction: "out", Key: string(rune('a' + i))})
+	}
+	var mu sync.Mutex
+	running, most := 0, 0
+	results := Apply(entries, 3, func(entry ApplyEntry) int {
+		mu.Lock()
+		running++
+		if running > most {
+			most = running
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		if entry.Key == "c" {
+			return 1
+		}
+		return 0
+	})
+	if most > 3 || most < 2 {
+		t.Errorf("There should be up to 3 entries running at once: %d", most)
+	}
+	for i, result := range results {
+		if result.Entry.Key != entries[i].Key {
+			t.Errorf("The results should be in order: %d %s", i, result.Entry.Key)
+		}
+		if (result.Code != 0) != (result.Entry.Key == "c") {
+			t.Errorf("The wrong entry failed: %s %d", result.Entry.Key, result.Code)
+		}
+	}
+}
+
+var testServicesManifest = []byte(`---
+services:
+  - name: nginx
+    exec: "sudo service nginx reload"
+    after:
+      - certs
+  - name: certs
+    exec: "sudo update-ca-certificates"
+entries:
+  - key: nginx/site
+    file: /etc/nginx/sites-enabled/site
+    service: nginx
+  - key: certs/ca
+    file: /usr/local/share/ca-certificates/ca.crt
+    service: certs
+  - key: hosts
+    file: /etc/hosts.consul`)
+
+func TestParseServices(t *testing.T) {
+	entries, err := ParseManifest(testServicesManifest)
+	if err != nil {
+		t.Fatalf("Could not parse the manifest: %v", err)
+	}
+	services, err := ParseServices(testServicesManifest, entries)
+	if err != nil {
+		t.Fatalf("Could not parse the services: %v", err)
+	}
+	if len(services) != 2 || services[0].Name != "certs" || services[1].Name != "nginx" {
+		t.Fatalf("certs should come before nginx: %+v", services)
+	}
+	if entries[0].Service != "nginx" || entries[2].Service != "" {
+		t.Errorf("The entries should have their service: %+v", entries)
+	}
+
+	for _, manifest := range []string{
+		"---\nservices:\n  - exec: true",
+		"---\nservices:\n  - name: a\n  - name: a",
+		"---\nservices:\n  - name: a\n    after: [b]",
+		"---\nservices:\n  - name: a\n    after: [b]\n  - name: b\n    after: [a]",
+		"---\nservices:\n  - name: a\nentries:\n  - key: hosts\n    file: /tmp/hosts\n    service: b",
+	} {
+		entries, _ := ParseManifest([]byte(manifest))
+		if _, err := ParseServices([]byte(manifest), entries); err == nil {
+			t.Errorf("The services should not parse: %q", manifest)
+		}
+	}
+}
+
+func TestApplyServices(t *testing.T) {
+	entries := []ApplyEntry{
+		{Direction: "out", Key: "nginx/site", Service: "nginx"},
+		{Direction: "out", Key: "nginx/upstreams", Service: "nginx"},
+		{Direction: "out", Key: "certs/ca", Service: "certs"},
+		{Direction: "out", Key: "hosts"},
+	}
+	services := []ApplyService{
+		{Name: "certs", Exec: "update-ca-certificates"},
+		{Name: "nginx", Exec: "service nginx reload", After: []string{"certs"}, level: 1},
+	}
+	apply := func(codes map[string]int) ([]string, []ApplyResult, []ServiceResult) {
+		var mu sync.Mutex
+		var order []string
+		results, serviceResults := ApplyServices(entries, services, 2, func(entry ApplyEntry) int {
+			mu.Lock()
+			order = append(order, entry.Key)
+			mu.Unlock()
+			return codes[entry.Key]
+		}, func(exec string) int {
+			mu.Lock()
+			order = append(order, exec)
+			mu.Unlock()
+			return codes[exec]
+		})
+		return order, results, serviceResults
+	}
+
+	// Both nginx files were written - it's reloaded once after the certs.
+	order, _, serviceResults := apply(map[string]int{"certs/ca": ExitNoChange})
+	if len(order) != 5 || order[2] != "nginx/site" && order[2] != "nginx/upstreams" || order[4] != "service nginx reload" {
+		t.Errorf("nginx should reload once after its files: %v", order)
+	}
+	if serviceResults[0].Status != ServiceUnchanged || serviceResults[1].Status != ServiceRan {
+		t.Errorf("Only nginx changed: %+v", serviceResults)
+	}
+
+	// The certs exec failed so nginx isn't touched.
+	order, results, serviceResults := apply(map[string]int{"update-ca-certificates": 1})
+	if len(order) != 3 || results[0].Code != ExitError || results[1].Code != ExitError || results[3].Code != ExitWrote {
+		t.Errorf("The nginx entries should not run: %v %+v", order, results)
+	}
+	if serviceResults[0].Status != ServiceFailed || serviceResults[1].Status != ServiceSkipped || serviceResults[0].Code != 1 {
+		t.Errorf("nginx should be skipped: %+v", serviceResults)
+	}
+}
+
+func TestApplyExitCode(t *testing.T) {
+	for _, test := range []struct{ total, failed, code int }{
+		{50, 0, ExitWrote},
+		{50, 1, ExitSomeFailed},
+		{50, 49, ExitSomeFailed},
+		{50, 50, ExitAllFailed},
+	} {
+		if code := ApplyExitCode(test.total, test.failed); code != test.code {
+			t.Errorf("%d of %d failed should exit %d, got %d", test.failed, test.total, test.code, code)
+		}
+	}
+}
+
+func TestPrintApplyResults(t *testing.T) {
+	results := []ApplyResult{
+		{Entry: ApplyEntry{Direction: "out", Key: "hosts", File: "/etc/hosts.consul"}, Code: ExitWrote},
+		{Entry: ApplyEntry{Direction: "out", Key: "haproxy", File: "/etc/haproxy/haproxy.cfg"}, Code: ExitNoChange},
+		{Entry: ApplyEntry{Direction: "in", Key: "services", File: "/etc/services"}, Code: ExitConsulError},
+		{Entry: ApplyEntry{Direction: "out", Key: "resolv", File: "/etc/resolv.conf"}, Code: ExitLocked},
+	}
+	services := []ServiceResult{{Service: ApplyService{Name: "nginx", Exec: "reload-nginx"}, Status: ServiceSkipped}}
+	var out bytes.Buffer
+	if failed := printApplyResults(&out, results, services); failed != 2 {
+		t.Errorf("The failed entry and the skipped service should count: %d", failed)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 7 || !strings.HasPrefix(lines[0], "TYPE") {
+		t.Fatalf("There should be a header, a line for each result and a summary:\n%s", out.String())
+	}
+	if fields := strings.Fields(lines[3]); len(fields) != 5 || fields[3] != "6" || fields[4] != "failed" {
+		t.Errorf("The failed entry should have its exit code: %q", lines[3])
+	}
+	if fields := strings.Fields(lines[4]); len(fields) != 5 || fields[3] != "4" || fields[4] != "skipped" {
+		t.Errorf("A locked entry should be skipped: %q", lines[4])
+	}
+	if lines[6] != "4 entries: 1 written, 1 unchanged, 0 deferred, 1 skipped, 1 failed - 1 services, 1 failed" {
+		t.Errorf("The summary is wrong: %q", lines[6])
+	}
+}
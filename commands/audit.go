@@ -0,0 +1,249 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// The events in the audit log.
+const (
+	AuditFile   = "file_write"
+	AuditKey    = "key_write"
+	AuditRemove = "remove"
+	AuditExec   = "exec"
+)
+
+// AuditRecord is a line in --audit-log - a file or key that was changed or a
+// command that was run. Prev is the sha256 of the line before it, so a line
+// that's edited or removed breaks the chain. Mac is the HMAC-SHA256 of the
+// record with --audit-key-file - without the key the whole chain could be
+// written again.
+type AuditRecord struct {
+	Time        string `json:"time"`
+	RunID       string `json:"run_id"`
+	Host        string `json:"host"`
+	Command     string `json:"command"`
+	Event       string `json:"event"`
+	Key         string `json:"key,omitempty"`
+	File        string `json:"file,omitempty"`
+	OldChecksum string `json:"old_checksum,omitempty"`
+	NewChecksum string `json:"new_checksum,omitempty"`
+	ByteDelta   int    `json:"byte_delta"`
+	Exec        string `json:"exec,omitempty"`
+	ExitStatus  int    `json:"exit_status"`
+	Error       string `json:"error,omitempty"`
+	Prev        string `json:"prev"`
+	Mac         string `json:"mac,omitempty"`
+}
+
+// auditKey is the key from --audit-key-file or KVEXPRESS_AUDIT_KEY.
+var auditKey []byte
+
+// auditLock keeps the workers of a --parallel run from writing at once -
+// other processes are kept out with a file lock.
+var auditLock sync.Mutex
+
+// Audit appends record to --audit-log. A record that can't be written is
+// logged - the change has already happened.
+func Audit(record AuditRecord) {
+	if AuditLog == "" || DryRun {
+		return
+	}
+	record.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	record.RunID, record.Host, record.Command = RunID, GetHostname(), Direction
+	record.Exec, record.Error = Redact(record.Exec), Redact(record.Error)
+	if err := appendAudit(AuditLog, record); err != nil {
+		Log(fmt.Sprintf("audit='error' file='%s' event='%s' message='%v'", AuditLog, record.Event, err), "info")
+	}
+}
+
+// SetupAudit reads the key the audit log is signed with.
+func SetupAudit() error {
+	auditKey = nil
+	key := os.Getenv("KVEXPRESS_AUDIT_KEY")
+	if AuditKeyFile != "" {
+		value, err := ReadTokenFile(AuditKeyFile)
+		if err != nil {
+			return err
+		}
+		key = value
+	}
+	if key != "" {
+		auditKey = []byte(key)
+	}
+	if AuditLog != "" && auditKey == nil && Direction != "audit" {
+		Log(fmt.Sprintf("audit='unsigned' file='%s' - anyone who can write to it can rewrite the chain, use --audit-key-file.", AuditLog), "warn")
+	}
+	return nil
+}
+
+// auditMac is the HMAC-SHA256 of record without its Mac.
+func auditMac(key []byte, record AuditRecord) (string, error) {
+	record.Mac = ""
+	line, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(line)
+	return fmt.Sprintf("%x", mac.Sum(nil)), nil
+}
+
+// appendAudit adds record to the end of file with the hash of the last line.
+func appendAudit(file string, record AuditRecord) error {
+	auditLock.Lock()
+	defer auditLock.Unlock()
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		return err
+	}
+	defer unlockFile(f)
+	last, err := lastLine(f)
+	if err != nil {
+		return err
+	}
+	if last != nil {
+		record.Prev = fmt.Sprintf("%x", sha256.Sum256(last))
+	}
+	if auditKey != nil {
+		if record.Mac, err = auditMac(auditKey, record); err != nil {
+			return err
+		}
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return filesystemError(fmt.Errorf("could not write the audit log '%s': %w", file, err))
+	}
+	return f.Sync()
+}
+
+// lastLine returns the last line of f without its newline - nil if it's empty.
+func lastLine(f *os.File) ([]byte, error) {
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return nil, err
+	}
+	size := info.Size()
+	for chunk := int64(4096); ; chunk *= 2 {
+		if chunk > size {
+			chunk = size
+		}
+		buf := make([]byte, chunk)
+		if _, err := f.ReadAt(buf, size-chunk); err != nil && err != io.EOF {
+			return nil, err
+		}
+		buf = bytes.TrimSuffix(buf, []byte("\n"))
+		if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+			return buf[i+1:], nil
+		}
+		if chunk == size {
+			return buf, nil
+		}
+	}
+}
+
+// VerifyAuditLog checks the chain of hashes in an audit log - and with key
+// that every record is signed with it. It returns the number of records and
+// an error for the first one that doesn't follow the line before it. Lines
+// taken off the end can't be found this way.
+func VerifyAuditLog(file string, key []byte) (int, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	var prev []byte
+	records := 0
+	for _, line := range bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		records++
+		var record AuditRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return records, fmt.Errorf("line %d isn't a record: %v", records, err)
+		}
+		expected := ""
+		if prev != nil {
+			expected = fmt.Sprintf("%x", sha256.Sum256(prev))
+		}
+		if record.Prev != expected {
+			return records, fmt.Errorf("line %d doesn't follow the line before it", records)
+		}
+		if key != nil {
+			mac, err := auditMac(key, record)
+			if err != nil {
+				return records, err
+			}
+			if record.Mac == "" {
+				return records, fmt.Errorf("line %d isn't signed", records)
+			}
+			if !hmac.Equal([]byte(record.Mac), []byte(mac)) {
+				return records, fmt.Errorf("line %d isn't signed with the key", records)
+			}
+		}
+		prev = line
+	}
+	return records, nil
+}
+
+// auditState is the checksum and size of a file before it's replaced - only
+// read with --audit-log.
+func auditState(file string) (string, int) {
+	if AuditLog == "" {
+		return "", 0
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", 0
+	}
+	return ComputeChecksum(string(data)), len(data)
+}
+
+// AuditFileWrite records a file that was written - err is why it wasn't.
+func AuditFileWrite(key, file, oldChecksum string, oldSize int, data string, err error) {
+	record := AuditRecord{Event: AuditFile, Key: key, File: file, OldChecksum: oldChecksum, NewChecksum: ComputeChecksum(data), ByteDelta: len(data) - oldSize}
+	if err != nil {
+		record.ExitStatus, record.Error = auditStatus(err), err.Error()
+	}
+	Audit(record)
+}
+
+// auditStatus is the exit code a failed write stops kvexpress with.
+func auditStatus(err error) int {
+	if errors.Is(err, ErrFilesystem) {
+		return ExitFilesystem
+	}
+	return ExitError
+}
+
+// auditKeyBytes is the size of the data that's in key before it's replaced -
+// only read with --audit-log.
+func auditKeyBytes(c *consul.Client, key string) int {
+	if AuditLog == "" {
+		return 0
+	}
+	data, err := GetData(c, key)
+	if err != nil {
+		return 0
+	}
+	return len(data)
+}
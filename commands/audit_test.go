@@ -0,0 +1,88 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	file := ensureTestFile(t)
+	ioutil.WriteFile(file, []byte("old\n"), 0640)
+	defer func() { AuditLog = "" }()
+	AuditLog = filepath.Join(t.TempDir(), "audit.log")
+
+	if _, err := WriteTargets([]OutTarget{{File: file, Format: "raw", Output: exampleData}}, exampleDataSHA, ""); err != nil {
+		t.Fatal(err)
+	}
+	if status := RunCommand("true"); status != 0 {
+		t.Fatalf("true should exit 0: %d", status)
+	}
+	Audit(AuditRecord{Event: AuditKey, Key: "hosts", NewChecksum: exampleDataSHA})
+
+	data, _ := ioutil.ReadFile(AuditLog)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("There should be a record for the write, the exec and the key: %q", lines)
+	}
+	var write, exec AuditRecord
+	json.Unmarshal([]byte(lines[0]), &write)
+	json.Unmarshal([]byte(lines[1]), &exec)
+	if write.Event != AuditFile || write.File != file || write.OldChecksum != ComputeChecksum("old\n") || write.NewChecksum != exampleDataSHA || write.ByteDelta != len(exampleData)-4 || write.RunID != RunID || write.Prev != "" {
+		t.Errorf("Got the wrong file record: %+v", write)
+	}
+	if exec.Event != AuditExec || exec.Exec != "true" || exec.ExitStatus != 0 || exec.Prev == "" {
+		t.Errorf("Got the wrong exec record: %+v", exec)
+	}
+	if records, err := VerifyAuditLog(AuditLog, nil); err != nil || records != 3 {
+		t.Errorf("The chain should be whole: %d %v", records, err)
+	}
+
+	lines[1] = strings.Replace(lines[1], `"exit_status":0`, `"exit_status":1`, 1)
+	ioutil.WriteFile(AuditLog, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	if records, err := VerifyAuditLog(AuditLog, nil); err == nil || records != 3 {
+		t.Errorf("A line that was edited should break the chain: %d %v", records, err)
+	}
+}
+
+func TestAuditSigned(t *testing.T) {
+	defer func() { AuditLog, AuditKeyFile, auditKey = "", "", nil }()
+	dir := t.TempDir()
+	AuditLog, AuditKeyFile = filepath.Join(dir, "audit.log"), filepath.Join(dir, "audit.key")
+	ioutil.WriteFile(AuditKeyFile, []byte("secret\n"), 0600)
+	if err := SetupAudit(); err != nil || string(auditKey) != "secret" {
+		t.Fatalf("The key should be read from --audit-key-file: %q %v", auditKey, err)
+	}
+	Audit(AuditRecord{Event: AuditKey, Key: "hosts", NewChecksum: exampleDataSHA})
+	Audit(AuditRecord{Event: AuditKey, Key: "hosts", OldChecksum: exampleDataSHA, NewChecksum: "sha256:other"})
+	if records, err := VerifyAuditLog(AuditLog, []byte("secret")); err != nil || records != 2 {
+		t.Fatalf("Every line should be signed with the key: %d %v", records, err)
+	}
+	if _, err := VerifyAuditLog(AuditLog, []byte("other")); err == nil {
+		t.Error("Another key shouldn't verify the log.")
+	}
+
+	// Writing the whole chain again with good hashes still needs the key.
+	data, _ := ioutil.ReadFile(AuditLog)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	var first, second AuditRecord
+	json.Unmarshal([]byte(lines[0]), &first)
+	json.Unmarshal([]byte(lines[1]), &second)
+	first.Key = "other"
+	line, _ := json.Marshal(first)
+	second.Prev = fmt.Sprintf("%x", sha256.Sum256(line))
+	next, _ := json.Marshal(second)
+	ioutil.WriteFile(AuditLog, []byte(string(line)+"\n"+string(next)+"\n"), 0600)
+	if _, err := VerifyAuditLog(AuditLog, nil); err != nil {
+		t.Fatalf("The chain was written again so the hashes match: %v", err)
+	}
+	if records, err := VerifyAuditLog(AuditLog, []byte("secret")); err == nil || records != 1 {
+		t.Errorf("A line that was edited shouldn't match its mac: %d %v", records, err)
+	}
+}
@@ -0,0 +1,68 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"time"
+)
+
+// AuditVerifyFile is the audit log to check - --audit-log if it's blank.
+var AuditVerifyFile string
+
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Check the audit log.",
+	Long:  `Audit has the commands for the --audit-log file.`,
+}
+
+var auditVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Check that no line in the audit log was edited or taken out.",
+	Long:  `Audit verify checks the chain of hashes in an --audit-log file - and with --audit-key-file that every line is signed with the key.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		checkAuditVerifyFlags()
+		AutoEnable()
+	},
+	Run: auditVerifyRun,
+}
+
+func auditVerifyRun(cmd *cobra.Command, args []string) {
+	start := time.Now()
+	records, err := VerifyAuditLog(AuditVerifyFile, auditKey)
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		fmt.Printf("Could not read the audit log: %v\n", err)
+		exitRun(ExitError, start, AuditVerifyFile, "read_file", err.Error())
+	}
+	if err != nil {
+		Log(fmt.Sprintf("audit file='%s' records='%d' verified='false' message='%v'", AuditVerifyFile, records, err), "info")
+		fmt.Printf("The audit log was changed: %v\n", err)
+		exitRun(ExitChecksumMismatch, start, AuditVerifyFile, "audit_broken", err.Error())
+	}
+	signed := auditKey != nil
+	fmt.Printf("records:  %d\nsigned:   %t\n", records, signed)
+	Log(fmt.Sprintf("audit file='%s' records='%d' signed='%t' verified='true'", AuditVerifyFile, records, signed), "info")
+	RunTime(start, AuditVerifyFile, "complete")
+}
+
+func checkAuditVerifyFlags() {
+	Log("Checking cli flags.", "debug")
+	if AuditVerifyFile == "" {
+		AuditVerifyFile = AuditLog
+	}
+	if AuditVerifyFile == "" {
+		fmt.Println("Need an audit log to check in -f or --audit-log")
+		os.Exit(1)
+	}
+	Log("Required cli flags present.", "debug")
+}
+
+func init() {
+	RootCmd.AddCommand(auditCmd)
+	auditCmd.AddCommand(auditVerifyCmd)
+	auditVerifyCmd.Flags().StringVarP(&AuditVerifyFile, "file", "f", "", "audit log to check - --audit-log if it's not passed")
+}
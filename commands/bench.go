@@ -0,0 +1,194 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/spf13/cobra"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var benchCmd = &cobra.Command{
+	Use:   "bench",
+	Short: "Benchmark Consul read and write latency.",
+	Long:  `Bench is for measuring how long Consul takes to Set and Get a throwaway key.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		checkBenchFlags()
+		AutoEnable()
+	},
+	Run: benchRun,
+}
+
+func benchRun(cmd *cobra.Command, args []string) {
+	start := time.Now()
+
+	c, err := Connect(ConsulServer, Token)
+	if err != nil {
+		LogFatal("Could not connect to Consul.", "bench", "consul_connect")
+	}
+
+	KeyBench := KeyPath(fmt.Sprintf("bench-%s-%d", GetHostname(), start.UnixNano()), "data")
+	Log(fmt.Sprintf("bench key='%s' operations='%d' concurrency='%d' size='%d'", KeyBench, BenchOperations, BenchConcurrency, BenchSize), "info")
+
+	results := RunBench(c, KeyBench, BenchOperations, BenchConcurrency, BenchSize)
+
+	fmt.Printf("%-10s %-4s %6s %12s %12s %12s %12s %10s\n", "phase", "op", "count", "p50", "p90", "p99", "max", "ops/sec")
+	for _, result := range results {
+		fmt.Printf("%-10s %-4s %6d %12s %12s %12s %12s %10.1f\n", result.Phase, result.Operation, result.Count(),
+			result.Percentile(50), result.Percentile(90), result.Percentile(99), result.Percentile(100), result.Throughput())
+		Log(fmt.Sprintf("bench phase='%s' operation='%s' count='%d' p50='%s' p90='%s' p99='%s' throughput='%.1f'", result.Phase, result.Operation,
+			result.Count(), result.Percentile(50), result.Percentile(90), result.Percentile(99), result.Throughput()), "info")
+	}
+
+	RunTime(start, "bench", "complete")
+}
+
+// BenchResult holds the latencies for a single phase and operation of `kvexpress bench`.
+type BenchResult struct {
+	Phase     string
+	Operation string
+	Latencies []time.Duration
+	Elapsed   time.Duration
+}
+
+// Count returns the number of operations that were timed.
+func (r BenchResult) Count() int {
+	return len(r.Latencies)
+}
+
+// Percentile returns the latency at percentile p - 100 is the slowest operation.
+func (r BenchResult) Percentile(p int) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(r.Latencies))
+	copy(sorted, r.Latencies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	index := (len(sorted)*p+99)/100 - 1
+	if index < 0 {
+		index = 0
+	}
+	return sorted[index]
+}
+
+// Throughput returns operations per second for the phase.
+func (r BenchResult) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(len(r.Latencies)) / r.Elapsed.Seconds()
+}
+
+// RunBench performs ops sequential Set and Get operations on key, then the
+// same number spread across concurrency workers - each with its own key.
+// All keys it creates are removed before it returns.
+func RunBench(c *consul.Client, key string, ops, concurrency, size int) []BenchResult {
+	value := strings.Repeat("x", size)
+	keys := []string{key}
+	defer func() {
+		for _, k := range keys {
+			Del(c, k)
+		}
+	}()
+
+	var results []BenchResult
+	results = append(results, benchSequential(c, key, value, ops, "set"))
+	results = append(results, benchSequential(c, key, value, ops, "get"))
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	workerKeys := make([]string, concurrency)
+	for i := range workerKeys {
+		workerKeys[i] = fmt.Sprintf("%s-%d", key, i)
+	}
+	keys = append(keys, workerKeys...)
+	results = append(results, benchConcurrent(c, workerKeys, value, ops, "set"))
+	results = append(results, benchConcurrent(c, workerKeys, value, ops, "get"))
+	return results
+}
+
+// benchOperation times a single Set or Get.
+func benchOperation(c *consul.Client, key, value, operation string) time.Duration {
+	opStart := time.Now()
+	if operation == "set" {
+		Set(c, key, value)
+	} else {
+		Get(c, key)
+	}
+	return time.Since(opStart)
+}
+
+// benchSequential runs ops operations one after the other.
+func benchSequential(c *consul.Client, key, value string, ops int, operation string) BenchResult {
+	result := BenchResult{Phase: "sequential", Operation: operation}
+	phaseStart := time.Now()
+	for i := 0; i < ops; i++ {
+		result.Latencies = append(result.Latencies, benchOperation(c, key, value, operation))
+	}
+	result.Elapsed = time.Since(phaseStart)
+	return result
+}
+
+// benchConcurrent spreads ops operations across one worker per key.
+func benchConcurrent(c *consul.Client, keys []string, value string, ops int, operation string) BenchResult {
+	result := BenchResult{Phase: "concurrent", Operation: operation}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	phaseStart := time.Now()
+	for i, key := range keys {
+		workerOps := ops / len(keys)
+		if i < ops%len(keys) {
+			workerOps++
+		}
+		wg.Add(1)
+		go func(key string, workerOps int) {
+			defer wg.Done()
+			for j := 0; j < workerOps; j++ {
+				latency := benchOperation(c, key, value, operation)
+				mutex.Lock()
+				result.Latencies = append(result.Latencies, latency)
+				mutex.Unlock()
+			}
+		}(key, workerOps)
+	}
+	wg.Wait()
+	result.Elapsed = time.Since(phaseStart)
+	return result
+}
+
+func checkBenchFlags() {
+	Log("Checking cli flags.", "debug")
+	if BenchOperations < 1 {
+		fmt.Println("Need at least 1 operation in -n")
+		os.Exit(1)
+	}
+	if BenchConcurrency < 1 {
+		fmt.Println("Need at least 1 worker in --concurrency")
+		os.Exit(1)
+	}
+	Log("Required cli flags present.", "debug")
+}
+
+var (
+	// BenchOperations is the number of Set and Get operations to time in each phase.
+	BenchOperations int
+
+	// BenchConcurrency is the number of workers used in the concurrent phase.
+	BenchConcurrency int
+
+	// BenchSize is the size in bytes of the value written to the throwaway key.
+	BenchSize int
+)
+
+func init() {
+	RootCmd.AddCommand(benchCmd)
+	benchCmd.Flags().IntVarP(&BenchOperations, "operations", "n", 100, "number of operations per phase")
+	benchCmd.Flags().IntVarP(&BenchConcurrency, "concurrency", "", 10, "number of workers for the concurrent phase")
+	benchCmd.Flags().IntVarP(&BenchSize, "size", "", 1024, "size in bytes of the benchmark value")
+}
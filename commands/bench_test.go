@@ -0,0 +1,46 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRunBench(t *testing.T) {
+	tc, c := newTestConsul(t)
+	results := RunBench(c, "testing/bench/data", 25, 4, 64)
+	if len(results) != 4 {
+		t.Fatalf("Expected 4 phases, got %d", len(results))
+	}
+	for _, result := range results {
+		if result.Count() != 25 {
+			t.Errorf("%s %s ran %d operations, expected 25", result.Phase, result.Operation, result.Count())
+		}
+	}
+	if sets := tc.count("PUT"); sets != 50 {
+		t.Errorf("Expected 50 Set calls, got %d", sets)
+	}
+	if gets := tc.count("GET"); gets != 50 {
+		t.Errorf("Expected 50 Get calls, got %d", gets)
+	}
+	if len(tc.kv) != 0 {
+		t.Errorf("Bench left %d keys behind.", len(tc.kv))
+	}
+}
+
+func TestBenchPercentile(t *testing.T) {
+	result := BenchResult{}
+	for i := 1; i <= 100; i++ {
+		result.Latencies = append(result.Latencies, time.Duration(i)*time.Millisecond)
+	}
+	if p := result.Percentile(50); p != 50*time.Millisecond {
+		t.Errorf("p50 was %s", p)
+	}
+	if p := result.Percentile(99); p != 99*time.Millisecond {
+		t.Errorf("p99 was %s", p)
+	}
+	if p := result.Percentile(100); p != 100*time.Millisecond {
+		t.Errorf("max was %s", p)
+	}
+}
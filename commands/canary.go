@@ -0,0 +1,211 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"hash/fnv"
+	"strings"
+)
+
+var (
+	// InCanary saves the data in the canary key instead of the key.
+	InCanary bool
+
+	// CanaryPercent is the percent of hosts that read the canary key with
+	// out - 0 for none.
+	CanaryPercent int
+)
+
+// CanaryKey is where the canary data for key is saved - <key>/canary.
+func CanaryKey(key string) string {
+	return strings.TrimSuffix(key, "/") + "/canary"
+}
+
+// CanaryBucket puts a host in one of 100 buckets with a hash of its name - so
+// the same hosts are always the canaries.
+func CanaryBucket(hostname string) int {
+	h := fnv.New32a()
+	h.Write([]byte(hostname))
+	return int(h.Sum32() % 100)
+}
+
+// InCanaryPercent is true when this host is one of the percent of hosts that
+// get the canary.
+func InCanaryPercent(percent int) bool {
+	return CanaryBucket(GetHostname()) < percent
+}
+
+// CanaryOutKey is the key this host should read - the canary key if the host
+// is in --canary-percent and there's canary data, or key.
+func CanaryOutKey(c *consul.Client, key string, percent int) (string, error) {
+	if percent <= 0 || !InCanaryPercent(percent) {
+		return key, nil
+	}
+	canary := CanaryKey(key)
+	checksum, err := Get(c, KeyPath(canary, "checksum"))
+	if err != nil {
+		return key, err
+	}
+	if checksum == "" {
+		Log(fmt.Sprintf("canary key='%s' host='%s' data='false' - reading the stable key.", canary, GetHostname()), "debug")
+		return key, nil
+	}
+	Log(fmt.Sprintf("canary key='%s' host='%s' percent='%d' - reading the canary key.", canary, GetHostname(), percent), "info")
+	return canary, nil
+}
+
+// canaryParts are the keys in <key>/canary that in --canary saves.
+var canaryParts = []string{"data", "checksum", "checksums", "updated", "encoding", "signature", "rolling", "manifest", "base", "delta", "meta"}
+
+// canaryDeleteOps remove the canary for key in a transaction - chunks too.
+func canaryDeleteOps(key string) consul.TxnOps {
+	canary := CanaryKey(key)
+	ops := consul.TxnOps{{KV: &consul.KVTxnOp{Verb: consul.KVDeleteTree, Key: KeyPath(canary, "data") + "/"}}}
+	for _, part := range canaryParts {
+		ops = append(ops, &consul.TxnOp{KV: &consul.KVTxnOp{Verb: consul.KVDelete, Key: KeyPath(canary, part)}})
+	}
+	return ops
+}
+
+// DeleteCanary removes the canary for key - every host reads the key again.
+// The checksum goes first so out stops reading the canary before its data is
+// gone.
+func DeleteCanary(c *consul.Client, key string) error {
+	if atomicWrites() {
+		_, err := kvTxn(c, canaryDeleteOps(key))
+		return err
+	}
+	canary := CanaryKey(key)
+	manifest, err := getManifest(c, canary)
+	if err != nil {
+		return err
+	}
+	if err := Del(c, KeyPath(canary, "checksum")); err != nil {
+		return err
+	}
+	if manifest != nil {
+		if err := deleteChunks(c, canary, 0, manifest.Count); err != nil {
+			return err
+		}
+	}
+	for _, part := range canaryParts {
+		if err := Del(c, KeyPath(canary, part)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AbortCanary removes the canary for key. It's false if there wasn't one.
+func AbortCanary(c *consul.Client, key string) (bool, error) {
+	checksum, err := Get(c, KeyPath(CanaryKey(key), "checksum"))
+	if err != nil || checksum == "" {
+		return false, err
+	}
+	if err := DeleteCanary(c, key); err != nil {
+		return false, err
+	}
+	Log(fmt.Sprintf("canary key='%s' checksum='%s' aborted='true'", key, strings.TrimSpace(checksum)), "info")
+	return true, nil
+}
+
+// Promote saves the canary data for key as the key and removes the canary.
+// The canary is checked against its checksum - and its signature with
+// --verify-key - and encoded again with this run's flags. With Consul the key
+// is saved and the canary removed in one transaction. It returns false if the
+// key already had the canary's data.
+func Promote(c *consul.Client, key string) (bool, error) {
+	canary := CanaryKey(key)
+	checksum, err := GetChecksum(c, canary)
+	if err != nil {
+		return false, err
+	}
+	checksum = strings.TrimSpace(checksum)
+	if checksum == "" {
+		return false, fmt.Errorf("there's no canary for '%s'", key)
+	}
+	data, err := GetData(c, canary)
+	if err != nil {
+		return false, err
+	}
+	data, encoding, err := DecodeKeyData(c, canary, data)
+	if err != nil {
+		return false, err
+	}
+	// Binary data stays binary when it's saved again.
+	Binary = Binary || BinaryEncoding(encoding)
+	if !ChecksumCompare(data, checksum) {
+		return false, fmt.Errorf("the canary for '%s' doesn't match its checksum", key)
+	}
+	checksums, err := Get(c, KeyPath(canary, "checksums"))
+	if err != nil {
+		return false, err
+	}
+	signature, err := Get(c, KeyPath(canary, "signature"))
+	if err != nil {
+		return false, err
+	}
+	if verifyPublicKey != nil {
+		if err := verifyKeySignature(c, canary, data); err != nil {
+			return false, fmt.Errorf("the canary for '%s' isn't signed: %v", key, err)
+		}
+	}
+	var rolling string
+	if Rolling {
+		rolling = RollingHash(data)
+	}
+	stored, err := EncodeData(key, data)
+	if err != nil {
+		return false, err
+	}
+	if singleTxn(len(stored)) {
+		// The old signature would stop a --verify-key consumer.
+		extra := []*consul.TxnOp{{KV: &consul.KVTxnOp{Verb: consul.KVDelete, Key: KeyPath(key, "signature")}}}
+		if signature != "" {
+			extra[0] = setOp(KeyPath(key, "signature"), signature)
+		}
+		if Rolling {
+			extra = append(extra, setOp(KeyPath(key, "rolling"), rolling))
+		}
+		saved, err := SaveCAS(c, key, stored, checksum, checksums, append(extra, canaryDeleteOps(key)...)...)
+		if err != nil {
+			return false, err
+		}
+		if !saved {
+			// The key already has it - the canary isn't needed any more.
+			return false, DeleteCanary(c, key)
+		}
+	} else {
+		steps := []func() error{
+			func() error { return SetData(c, key, stored) },
+			func() error { return Set(c, KeyPath(key, "checksum"), checksum) },
+			func() error { return SetChecksums(c, key, checksums) },
+			func() error { return Set(c, KeyPath(key, "updated"), ReturnCurrentUTC()) },
+			func() error { return SetEncoding(c, key) },
+		}
+		if signature != "" {
+			steps = append(steps, func() error { return Set(c, KeyPath(key, "signature"), signature) })
+		} else {
+			steps = append(steps, func() error { return Del(c, KeyPath(key, "signature")) })
+		}
+		if Rolling {
+			steps = append(steps, func() error { return Set(c, KeyPath(key, "rolling"), rolling) })
+		}
+		steps = append(steps, func() error { return DeleteCanary(c, key) })
+		for _, step := range steps {
+			if err := step(); err != nil {
+				return false, err
+			}
+		}
+	}
+	Log(fmt.Sprintf("promote key='%s' checksum='%s' saved='true'", key, checksum), "info")
+	saveMeta(c, key, "promote:"+canary)
+	if HistoryKeep > 0 {
+		if err := SaveHistory(c, key, stored, checksum, signature, "promoted the canary", HistoryKeep); err != nil {
+			Log(fmt.Sprintf("history key='%s' saved='false' message='%v'", key, err), "info")
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,104 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"testing"
+)
+
+func TestCanaryBucket(t *testing.T) {
+	if CanaryBucket("web-1") != CanaryBucket("web-1") {
+		t.Error("A host should always be in the same bucket.")
+	}
+	buckets := make(map[int]bool)
+	for _, host := range []string{"web-1", "web-2", "web-3", "db-1", "db-2", "cache-1"} {
+		bucket := CanaryBucket(host)
+		if bucket < 0 || bucket > 99 {
+			t.Errorf("'%s' should be in a bucket from 0 to 99: %d", host, bucket)
+		}
+		buckets[bucket] = true
+	}
+	if len(buckets) < 2 {
+		t.Error("The hosts should be spread over the buckets.")
+	}
+	if !InCanaryPercent(100) || InCanaryPercent(0) {
+		t.Error("Every host is in 100 percent and none in 0.")
+	}
+}
+
+func TestCanaryOutKey(t *testing.T) {
+	PrefixLocation = "testing"
+	tc, c := newTestConsul(t)
+	if CanaryKey("hosts") != "hosts/canary" {
+		t.Errorf("The canary should be saved next to the key: %s", CanaryKey("hosts"))
+	}
+	if key, err := CanaryOutKey(c, "hosts", 100); err != nil || key != "hosts" {
+		t.Errorf("Without canary data the key should be read: %s %v", key, err)
+	}
+	tc.put("testing/hosts/canary/checksum", exampleDataSHA)
+	if key, err := CanaryOutKey(c, "hosts", 100); err != nil || key != "hosts/canary" {
+		t.Errorf("A host in the canary should read the canary key: %s %v", key, err)
+	}
+	if key, _ := CanaryOutKey(c, "hosts", 0); key != "hosts" {
+		t.Errorf("No host reads the canary with 0 percent: %s", key)
+	}
+}
+
+func TestPromote(t *testing.T) {
+	ensureTestFile(t)
+	tc, c := newTestConsul(t)
+	tc.put("testing/hosts/data", "the old data")
+	tc.put("testing/hosts/checksum", ComputeChecksum("the old data"))
+	tc.put("testing/hosts/signature", "old signature")
+	if _, err := Promote(c, "hosts"); err == nil {
+		t.Error("There's no canary to promote.")
+	}
+	tc.put("testing/hosts/canary/data", exampleData)
+	tc.put("testing/hosts/canary/checksum", exampleDataSHA)
+	saved, err := Promote(c, "hosts")
+	if err != nil || !saved {
+		t.Fatalf("The canary should be promoted: %v %v", saved, err)
+	}
+	if value, _ := tc.value("testing/hosts/data"); value != exampleData {
+		t.Errorf("The canary data should be the key's: %q", value)
+	}
+	if value, _ := tc.value("testing/hosts/checksum"); value != exampleDataSHA {
+		t.Errorf("The canary checksum should be the key's: %q", value)
+	}
+	if _, ok := tc.value("testing/hosts/signature"); ok {
+		t.Error("The old signature doesn't match the canary - it should be removed.")
+	}
+	if _, ok := tc.value("testing/hosts/canary/checksum"); ok {
+		t.Error("The canary should be removed once it's promoted.")
+	}
+
+	tc.put("testing/hosts/canary/data", "changed")
+	tc.put("testing/hosts/canary/checksum", exampleDataSHA)
+	if _, err := Promote(c, "hosts"); err == nil {
+		t.Error("A canary that doesn't match its checksum shouldn't be promoted.")
+	}
+}
+
+func TestAbortCanary(t *testing.T) {
+	ensureTestFile(t)
+	tc, c := newTestConsul(t)
+	if aborted, err := AbortCanary(c, "hosts"); err != nil || aborted {
+		t.Errorf("There's no canary to remove: %v %v", aborted, err)
+	}
+	tc.put("testing/hosts/data", "the old data")
+	tc.put("testing/hosts/canary/data", exampleData)
+	tc.put("testing/hosts/canary/data/0", "chunk")
+	tc.put("testing/hosts/canary/checksum", exampleDataSHA)
+	aborted, err := AbortCanary(c, "hosts")
+	if err != nil || !aborted {
+		t.Fatalf("The canary should be removed: %v %v", aborted, err)
+	}
+	for _, key := range []string{"testing/hosts/canary/data", "testing/hosts/canary/data/0", "testing/hosts/canary/checksum"} {
+		if _, ok := tc.value(key); ok {
+			t.Errorf("'%s' should be removed.", key)
+		}
+	}
+	if value, _ := tc.value("testing/hosts/data"); value != "the old data" {
+		t.Errorf("The key should be left alone: %q", value)
+	}
+}
@@ -0,0 +1,150 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var checkACLCmd = &cobra.Command{
+	Use:   "check-acl",
+	Short: "Check what the token can read and write under the prefix.",
+	Long:  `Check-acl probes the data, checksum, updated, lock and stop keys for -k - and the file locks - to show what the token can read and write. Nothing is written.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		checkCheckACLFlags()
+		AutoEnable()
+	},
+	Run: checkACLRun,
+}
+
+func checkACLRun(cmd *cobra.Command, args []string) {
+	start := time.Now()
+	c, err := Connect(ConsulServer, Token)
+	if err != nil {
+		LogFatal("Could not connect to Consul.", KeyCheckACLLocation, "consul_connect")
+	}
+	capabilities := CheckACL(c, KeyCheckACLLocation)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PART\tKEY\tREAD\tWRITE")
+	for _, capability := range capabilities {
+		write := aclValue(capability.Write, capability.WriteError)
+		if CheckACLReadOnly {
+			write = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", capability.Part, capability.Key, aclValue(capability.Read, capability.ReadError), write)
+	}
+	w.Flush()
+	RecordDetails(capabilities)
+	missing := MissingACL(capabilities, CheckACLReadOnly)
+	Log(fmt.Sprintf("check-acl key='%s' read_only='%t' missing='%d'", KeyCheckACLLocation, CheckACLReadOnly, len(missing)), "info")
+	if len(missing) > 0 {
+		fmt.Printf("The token can't %s.\n", strings.Join(missing, ", "))
+		exitRun(ExitError, start, KeyCheckACLLocation, "acl_missing", strings.Join(missing, ", "))
+	}
+	RunTime(start, KeyCheckACLLocation, "complete")
+}
+
+// ACLCapability is what the token can do with one of the keys kvexpress uses.
+type ACLCapability struct {
+	Part       string `json:"part"`
+	Key        string `json:"key"`
+	Read       bool   `json:"read"`
+	Write      bool   `json:"write"`
+	ReadError  string `json:"read_error,omitempty"`
+	WriteError string `json:"write_error,omitempty"`
+}
+
+// CheckACL checks whether the token can read and write each of the keys that
+// in, out, lock and stop use for key. A write is a check-and-set with an
+// index the key can't have - Consul checks the ACL first, so nothing is
+// written either way. The requests aren't retried so a denied key doesn't
+// wait out --retries.
+func CheckACL(c *consul.Client, key string) []ACLCapability {
+	parts := []struct{ part, key string }{
+		{"data", KeyPath(key, "data")},
+		{"checksum", KeyPath(key, "checksum")},
+		{"updated", KeyPath(key, "updated")},
+		{"lock", KeyPath(key, "lock")},
+		{"stop", KeyPath(key, "stop")},
+		{"locks", FileLockPath("/kvexpress-check-acl")},
+	}
+	capabilities := make([]ACLCapability, len(parts))
+	for i, part := range parts {
+		capability := ACLCapability{Part: part.part, Key: strings.TrimPrefix(part.key, "/")}
+		_, _, err := c.KV().Get(capability.Key, readOptions())
+		capability.Read, capability.ReadError = err == nil, aclError(err)
+		err = checkWriteAccess(c, capability.Key)
+		capability.Write, capability.WriteError = err == nil, aclError(err)
+		Log(fmt.Sprintf("check-acl key='%s' read='%t' write='%t'", capability.Key, capability.Read, capability.Write), "debug")
+		capabilities[i] = capability
+	}
+	return capabilities
+}
+
+// MissingACL are the capabilities the token doesn't have - only the reads
+// with readOnly.
+func MissingACL(capabilities []ACLCapability, readOnly bool) []string {
+	var missing []string
+	for _, capability := range capabilities {
+		if !capability.Read {
+			missing = append(missing, "read "+capability.Part)
+		}
+		if !capability.Write && !readOnly {
+			missing = append(missing, "write "+capability.Part)
+		}
+	}
+	return missing
+}
+
+// aclError is why a probe failed - a 403 is just denied.
+func aclError(err error) string {
+	if err == nil {
+		return ""
+	}
+	if strings.Contains(err.Error(), "403") {
+		return "denied"
+	}
+	return err.Error()
+}
+
+// aclValue is a column in the capability matrix.
+func aclValue(allowed bool, err string) string {
+	if allowed {
+		return "yes"
+	}
+	return "no - " + err
+}
+
+func checkCheckACLFlags() {
+	Log("Checking cli flags.", "debug")
+	if !consulBackend() {
+		fmt.Printf("check-acl checks Consul ACLs and can't be used with --backend %s\n", Backend)
+		os.Exit(1)
+	}
+	if KeyCheckACLLocation == "" {
+		fmt.Println("Need a key to check in -k")
+		os.Exit(1)
+	}
+	Log("Required cli flags present.", "debug")
+}
+
+var (
+	// KeyCheckACLLocation is the key whose ACLs are checked - most policies
+	// are on the prefix so the key doesn't have to exist.
+	KeyCheckACLLocation string
+
+	// CheckACLReadOnly only needs the reads - for an out token.
+	CheckACLReadOnly bool
+)
+
+func init() {
+	RootCmd.AddCommand(checkACLCmd)
+	checkACLCmd.Flags().StringVarP(&KeyCheckACLLocation, "key", "k", "check-acl", "key to check - it doesn't have to exist")
+	checkACLCmd.Flags().BoolVarP(&CheckACLReadOnly, "read-only", "", false, "only check the reads that out needs")
+}
@@ -0,0 +1,41 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckACL(t *testing.T) {
+	PrefixLocation = "testing"
+	tc, c := newTestConsul(t)
+	tc.put("testing/hosts/checksum", exampleDataSHA)
+	// A read only token that can't see the file locks.
+	tc.denied = func(method, key string) bool {
+		return method == "PUT" || strings.HasPrefix(key, "testing/locks/")
+	}
+	capabilities := CheckACL(c, "hosts")
+	if len(capabilities) != 6 || capabilities[1].Key != "testing/hosts/checksum" || !capabilities[1].Read || capabilities[1].Write || capabilities[1].WriteError != "denied" {
+		t.Errorf("The checksum should be readable but not writable: %+v", capabilities)
+	}
+	if capabilities[5].Part != "locks" || capabilities[5].Read {
+		t.Errorf("The file locks shouldn't be readable: %+v", capabilities[5])
+	}
+	if missing := MissingACL(capabilities, true); strings.Join(missing, ",") != "read locks" {
+		t.Errorf("Only the read of the file locks should be missing with --read-only: %v", missing)
+	}
+	if missing := MissingACL(capabilities, false); len(missing) != 7 {
+		t.Errorf("Every write should be missing: %v", missing)
+	}
+	if value, _ := tc.value("testing/hosts/checksum"); value != exampleDataSHA {
+		t.Error("Checking the ACLs shouldn't write anything.")
+	}
+	tc.denied = nil
+	if missing := MissingACL(CheckACL(c, "hosts"), false); len(missing) != 0 {
+		t.Errorf("Nothing should be missing: %v", missing)
+	}
+	if tc.count("PUT") != 12 || len(tc.kv) != 1 {
+		t.Errorf("The writes should be check-and-sets that lose: %d %d", tc.count("PUT"), len(tc.kv))
+	}
+}
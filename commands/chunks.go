@@ -0,0 +1,135 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/DataDog/kvexpress/pkg/kvexpress"
+	consul "github.com/hashicorp/consul/api"
+)
+
+// ChunkManifest describes data that's too large for a single Consul value,
+// content-addressed or saved as a delta - see kvexpress.Manifest.
+type ChunkManifest = kvexpress.Manifest
+
+// SplitChunks splits data into pieces that are at most size bytes.
+func SplitChunks(data string, size int) []string {
+	var chunks []string
+	for len(data) > size {
+		chunks = append(chunks, data[:size])
+		data = data[size:]
+	}
+	return append(chunks, data)
+}
+
+// chunkPath is the location of a single chunk of the data.
+func chunkPath(key string, chunk int) string {
+	return kvexpress.ChunkPath(kvStore{}, key, chunk)
+}
+
+// getManifest returns the manifest for key - or nil if the data isn't chunked.
+func getManifest(c *consul.Client, key string) (*ChunkManifest, error) {
+	return kvexpress.ReadManifest(kvStore{c}, key)
+}
+
+// parseManifest reads a manifest - nil if it's blank.
+func parseManifest(value string) (*ChunkManifest, error) {
+	return kvexpress.ParseManifest(value)
+}
+
+// GetData returns the stored data for key - reassembling and verifying it if
+// it was saved in chunks.
+func GetData(c *consul.Client, key string) (string, error) {
+	data, _, err := GetDataSnapshot(c, key)
+	return data, err
+}
+
+// GetDataSnapshot is GetData that also returns the checksum of content-addressed
+// data - it's read with the data so the two always go together, even while a
+// new version is switched in. It's blank for any other data. It's read with
+// kvexpress.ReadData, the same as the library's Load.
+func GetDataSnapshot(c *consul.Client, key string) (string, string, error) {
+	manifest, err := getManifest(c, key)
+	if err != nil {
+		return "", "", err
+	}
+	data, checksum, err := kvexpress.ReadData(kvStore{c}, key, manifest)
+	if err == nil && manifest != nil && manifest.Count > 0 {
+		Log(fmt.Sprintf("chunks='%d' key='%s' size='%d' reassembled='true'", manifest.Count, key, len(data)), "info")
+	}
+	return data, checksum, err
+}
+
+// SetData saves the data for key. Data that's larger than ChunkSize is split
+// into chunks with a manifest - the manifest is saved after the chunks so the
+// data is never read half written.
+func SetData(c *consul.Client, key, data string) error {
+	old, err := getManifest(c, key)
+	if err != nil {
+		if errors.Is(err, ErrNoMoreRetries) {
+			return err
+		}
+		Log(fmt.Sprintf("chunks='error' key='%s' message='%v'", key, err), "info")
+	}
+	previous, content, delta := 0, false, false
+	if old != nil {
+		previous, content, delta = old.Count, old.Checksum != "", old.Base != ""
+	}
+	if delta {
+		// The manifest is replaced or removed below - the base and delta
+		// aren't needed after that.
+		defer func() {
+			Del(c, KeyPath(key, "base"))
+			Del(c, KeyPath(key, "delta"))
+		}()
+	}
+
+	if ChunkSize <= 0 || len(data) <= ChunkSize {
+		if err := Set(c, KeyPath(key, "data"), data); err != nil {
+			return err
+		}
+		if previous > 0 || content || delta {
+			if err := Del(c, KeyPath(key, "manifest")); err != nil {
+				return err
+			}
+			if content {
+				return pruneContent(c, key)
+			}
+			return deleteChunks(c, key, 0, previous)
+		}
+		return nil
+	}
+
+	chunks := SplitChunks(data, ChunkSize)
+	manifest := ChunkManifest{Count: len(chunks), Size: len(data)}
+	for i, chunk := range chunks {
+		if err := Set(c, chunkPath(key, i), chunk); err != nil {
+			return err
+		}
+		manifest.Checksums = append(manifest.Checksums, ComputeChecksum(chunk))
+	}
+	encoded, _ := json.Marshal(manifest)
+	if err := Set(c, KeyPath(key, "manifest"), string(encoded)); err != nil {
+		return err
+	}
+	if err := Del(c, KeyPath(key, "data")); err != nil {
+		return err
+	}
+	Log(fmt.Sprintf("chunks='%d' key='%s' size='%d' saved='true'", len(chunks), key, len(data)), "info")
+	if content {
+		return pruneContent(c, key, chunkNames(len(chunks))...)
+	}
+	return deleteChunks(c, key, len(chunks), previous)
+}
+
+// deleteChunks removes the chunks from start up to end.
+func deleteChunks(c *consul.Client, key string, start, end int) error {
+	for i := start; i < end; i++ {
+		if err := Del(c, chunkPath(key, i)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"strings"
+	"testing"
+)
+
+func chunkSize(t *testing.T, size int) {
+	t.Cleanup(func() { ChunkSize = 500 * 1024 })
+	ChunkSize = size
+	PrefixLocation = "testing"
+}
+
+func TestSplitChunks(t *testing.T) {
+	chunks := SplitChunks(exampleData, 20)
+	if len(chunks) != 4 || strings.Join(chunks, "") != exampleData {
+		t.Errorf("The data was not split into 4 chunks: %q", chunks)
+	}
+	for _, chunk := range chunks {
+		if len(chunk) > 20 {
+			t.Errorf("The chunk is too large: %q", chunk)
+		}
+	}
+}
+
+func TestSetGetDataChunked(t *testing.T) {
+	tc, c := newTestConsul(t)
+	chunkSize(t, 20)
+	SetData(c, "chunked", exampleData)
+	if _, ok := tc.value("testing/chunked/data/3"); !ok {
+		t.Error("The last chunk was not saved.")
+	}
+	if _, ok := tc.value("testing/chunked/manifest"); !ok {
+		t.Error("The manifest was not saved.")
+	}
+	data, err := GetData(c, "chunked")
+	if err != nil || data != exampleData {
+		t.Errorf("The data was not reassembled: %q %v", data, err)
+	}
+
+	tc.put("testing/chunked/data/2", "corrupted")
+	if _, err := GetData(c, "chunked"); err == nil {
+		t.Error("A corrupted chunk should be an error.")
+	}
+
+	// Going back to a single value removes the chunks and the manifest.
+	ChunkSize = 1024
+	SetData(c, "chunked", exampleData)
+	if _, ok := tc.value("testing/chunked/manifest"); ok {
+		t.Error("The manifest should be removed.")
+	}
+	if _, ok := tc.value("testing/chunked/data/0"); ok {
+		t.Error("The chunks should be removed.")
+	}
+	if data, err := GetData(c, "chunked"); err != nil || data != exampleData {
+		t.Errorf("The data was not saved in a single key: %q %v", data, err)
+	}
+}
+
+func TestSetDataFewerChunks(t *testing.T) {
+	tc, c := newTestConsul(t)
+	chunkSize(t, 20)
+	SetData(c, "chunked", exampleData)
+	SetData(c, "chunked", exampleData[:30])
+	if _, ok := tc.value("testing/chunked/data/2"); ok {
+		t.Error("Chunks that aren't used anymore should be removed.")
+	}
+	if data, err := GetData(c, "chunked"); err != nil || data != exampleData[:30] {
+		t.Errorf("The data was not reassembled: %q %v", data, err)
+	}
+}
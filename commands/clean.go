@@ -1,4 +1,4 @@
-// +build linux darwin freebsd
+// +build linux darwin freebsd windows
 
 package commands
 
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"github.com/spf13/cobra"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -20,28 +22,121 @@ var cleanCmd = &cobra.Command{
 	Run: cleanRun,
 }
 
+// cacheSuffixes are the files kvexpress keeps next to the files it writes.
+var cacheSuffixes = []string{"compare", "last", "locked", fileSuffix}
+
 func cleanRun(cmd *cobra.Command, args []string) {
 	start := time.Now()
 
-	CompareFile := CompareFilename(FiletoClean)
-	LastFile := LastFilename(FiletoClean)
-
-	RemoveFile(FiletoClean)
-	RemoveFile(CompareFile)
-	RemoveFile(LastFile)
+	files, err := CleanTargets(FiletoClean, CleanPattern)
+	ExitOnError(err, CleanPattern, "clean_pattern")
+	olderThan := CleanOlderThan
+	if CleanTemp {
+		files = TempFiles(files)
+		// A younger temporary file may belong to a write that's still going.
+		if olderThan == 0 {
+			olderThan = leftoverTmpAge
+		}
+	}
+	removed, err := CleanFiles(files, olderThan)
+	ExitOnError(err, FiletoClean, "remove_file")
+	if CleanTemp {
+		for _, file := range removed {
+			StatsdTempLeftover(file)
+		}
+	}
+	RecordResult(0, "", removed...)
+	Log(fmt.Sprintf("clean files='%d' removed='%d'", len(files), len(removed)), "info")
+	if len(removed) == 0 {
+		exitRun(ExitNoChange, start, "none", "nothing_removed", "")
+	}
 
 	// Run this command after the files are cleaned.
 	if PostExec != "" {
 		Log(fmt.Sprintf("exec='%s'", PostExec), "debug")
-		RunCommand(PostExec)
+		if status := RunPostExec(PostExec); status != 0 {
+			exitExecFailed(status, "none")
+		}
 	}
 	RunTime(start, "none", "complete")
 }
 
+// CleanTargets returns file and its .compare, .last, .locked and temporary
+// files - along with every cache file that matches pattern. Anything pattern
+// matches that isn't a cache file is left out.
+func CleanTargets(file, pattern string) ([]string, error) {
+	var files []string
+	if file != "" {
+		files = append(files, file, CompareFilename(file), LastFilename(file), LockFilePath(file), TmpFilename(file))
+	}
+	if pattern == "" {
+		return files, nil
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("bad --pattern '%s': %v", pattern, err)
+	}
+	for _, match := range matches {
+		if !isCacheFile(match) {
+			Log(fmt.Sprintf("clean file='%s' cache='false' - skipping.", match), "debug")
+			continue
+		}
+		files = append(files, match)
+	}
+	return files, nil
+}
+
+// TempFiles returns the temporary files WriteFile left behind out of files.
+func TempFiles(files []string) []string {
+	var temp []string
+	for _, file := range files {
+		if strings.HasSuffix(file, "."+fileSuffix) {
+			temp = append(temp, file)
+		}
+	}
+	return temp
+}
+
+// isCacheFile is true if file ends with one of the cacheSuffixes.
+func isCacheFile(file string) bool {
+	for _, suffix := range cacheSuffixes {
+		if strings.HasSuffix(file, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// CleanFiles removes each of files that was last changed more than olderThan
+// ago - 0 removes them no matter how old they are. Files that don't exist are
+// skipped. It returns the files that were removed.
+func CleanFiles(files []string, olderThan time.Duration) ([]string, error) {
+	var removed []string
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if olderThan > 0 && time.Since(info.ModTime()) < olderThan {
+			Log(fmt.Sprintf("clean file='%s' age='%s' - newer than --older-than, keeping.", file, time.Since(info.ModTime()).Round(time.Second)), "info")
+			continue
+		}
+		if err := RemoveFile(file); err != nil {
+			return removed, err
+		}
+		removed = append(removed, file)
+	}
+	return removed, nil
+}
+
 func checkCleanFlags() {
 	Log("Checking cli flags.", "debug")
-	if FiletoClean == "" {
-		fmt.Println("Need a file to clean in -f")
+	if FiletoClean == "" && CleanPattern == "" {
+		fmt.Println("Need a file to clean in -f or a --pattern")
+		os.Exit(1)
+	}
+	if CleanOlderThan < 0 {
+		fmt.Println("Need an --older-than that's 0 or more")
 		os.Exit(1)
 	}
 	Log("Required cli flags present.", "debug")
@@ -50,9 +145,22 @@ func checkCleanFlags() {
 var (
 	// FiletoClean is the file we want to erase.
 	FiletoClean string
+
+	// CleanPattern is a glob of cache files to erase - like /etc/app/*.compare.
+	CleanPattern string
+
+	// CleanOlderThan only erases files that haven't changed for this long - 0 for any age.
+	CleanOlderThan time.Duration
+
+	// CleanTemp only erases the temporary files left behind by a write that
+	// didn't finish.
+	CleanTemp bool
 )
 
 func init() {
 	RootCmd.AddCommand(cleanCmd)
 	cleanCmd.Flags().StringVarP(&FiletoClean, "file", "f", "", "file to clean")
+	cleanCmd.Flags().StringVarP(&CleanPattern, "pattern", "", "", "glob of cache files to clean - like '/etc/app/*.compare'")
+	cleanCmd.Flags().DurationVarP(&CleanOlderThan, "older-than", "", 0, "only clean files that haven't changed for this long")
+	cleanCmd.Flags().BoolVarP(&CleanTemp, "temp", "", false, "only clean leftover temporary files - older than a minute unless there's --older-than")
 }
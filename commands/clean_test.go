@@ -0,0 +1,55 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCleanTargets(t *testing.T) {
+	file := ensureTestFile(t)
+	dir := filepath.Dir(file)
+	for _, name := range []string{"app.compare", "app.last", "app.conf", "other.kvexpress"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(exampleData), 0640)
+	}
+	files, err := CleanTargets("", filepath.Join(dir, "*"))
+	want := []string{filepath.Join(dir, "app.compare"), filepath.Join(dir, "app.last"), filepath.Join(dir, "other.kvexpress")}
+	if err != nil || !reflect.DeepEqual(files, want) {
+		t.Errorf("Only the cache files should match: %v %v", files, err)
+	}
+	files, _ = CleanTargets(file, "")
+	if len(files) != 5 || files[3] != file+".locked" || files[4] != file+".kvexpress" {
+		t.Errorf("The file and all of its cache files should be cleaned: %v", files)
+	}
+	if _, err := CleanTargets("", "["); err == nil {
+		t.Error("A bad pattern should be an error.")
+	}
+}
+
+func TestCleanFilesOlderThan(t *testing.T) {
+	file := ensureTestFile(t)
+	old, recent := file+".compare", file+".last"
+	ioutil.WriteFile(old, []byte(exampleData), 0640)
+	ioutil.WriteFile(recent, []byte(exampleData), 0640)
+	os.Chtimes(old, time.Now().Add(-48*time.Hour), time.Now().Add(-48*time.Hour))
+
+	removed, err := CleanFiles([]string{old, recent, file + ".missing"}, 24*time.Hour)
+	if err != nil || !reflect.DeepEqual(removed, []string{old}) {
+		t.Errorf("Only the old file should be removed: %v %v", removed, err)
+	}
+	if _, err := os.Stat(recent); err != nil {
+		t.Error("The recent file should still be there.")
+	}
+}
+
+func TestTempFiles(t *testing.T) {
+	files := TempFiles([]string{"/etc/app.conf.compare", "/etc/app.conf.kvexpress", "/etc/app.conf.last"})
+	if !reflect.DeepEqual(files, []string{"/etc/app.conf.kvexpress"}) {
+		t.Errorf("Only the temporary files should be left: %v", files)
+	}
+}
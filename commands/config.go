@@ -1,12 +1,16 @@
-// +build linux darwin freebsd
+// +build linux darwin freebsd windows
 
 package commands
 
 import (
 	"fmt"
 	"github.com/smallfish/simpleyaml"
+	"github.com/spf13/pflag"
 	"io/ioutil"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
 // GetStringConfig grabs the string from the config object.
@@ -30,6 +34,17 @@ func ParseConfig(data []byte) *simpleyaml.Yaml {
 	return config
 }
 
+// configAliases are config file names that don't match their flag name.
+var configAliases = map[string]string{
+	"consul_server": "server",
+}
+
+// policyFlags are set from the config even when they were passed on the
+// command line - a run can't widen what the host allows.
+var policyFlags = map[string]bool{
+	"allowed-paths": true,
+}
+
 // LoadConfig opens a file and reads the yaml formatted configuration data.
 // It will set configuration globals and/or ENV variables as required.
 func LoadConfig(filename string) {
@@ -39,43 +54,180 @@ func LoadConfig(filename string) {
 		data = []byte("")
 	}
 	config := ParseConfig(data)
+	if config == nil {
+		return
+	}
 
 	datadogHost := GetStringConfig(config, "datadog_host")
 	if datadogHost != "" {
 		os.Setenv("DATADOG_HOST", datadogHost)
 	}
 
-	datadogAPIKey := GetStringConfig(config, "datadog_api_key")
-	if datadogAPIKey != "" {
-		DatadogAPIKey = datadogAPIKey
-	}
+	loadConfigTargets(config)
+	loadConfigPrefixTokens(config)
+	ConfigFlags(config, RootCmd.PersistentFlags())
+}
 
-	datadogAPPKey := GetStringConfig(config, "datadog_app_key")
-	if datadogAPPKey != "" {
-		DatadogAPPKey = datadogAPPKey
+// ConfigFlags sets any flag that's named in the config - with either dashes
+// or underscores - unless it was passed on the command line.
+func ConfigFlags(config *simpleyaml.Yaml, flags *pflag.FlagSet) {
+	keys, err := config.GetMapKeys()
+	if err != nil {
+		Log("Could not get the keys from the config.", "info")
+		return
+	}
+	for _, key := range keys {
+		if key == "datadog_host" || key == "targets" || key == "prefix_tokens" {
+			continue
+		}
+		flag := configFlag(flags, key)
+		if flag == nil {
+			Log(fmt.Sprintf("config: key='%s' unknown='true'", key), "info")
+			continue
+		}
+		if flag.Changed && !policyFlags[flag.Name] {
+			Log(fmt.Sprintf("config: key='%s' flag='%s' passed='true'", key, flag.Name), "debug")
+			continue
+		}
+		if flag.Changed {
+			Log(fmt.Sprintf("config: key='%s' flag='%s' passed='true' policy='true' - using the config.", key, flag.Name), "info")
+			// A slice that was passed appends to what it has.
+			if slice, ok := flag.Value.(pflag.SliceValue); ok {
+				slice.Replace([]string{})
+			}
+		}
+		value := configValue(config.Get(key))
+		if flag.Value.Type() == "mode" {
+			value = configMode(config.Get(key))
+		}
+		if flag.Name == "compress" {
+			var err error
+			if value, err = CompressValue(value); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		if err := flags.Set(flag.Name, value); err != nil {
+			Log(fmt.Sprintf("config: key='%s' flag='%s' message='%v'", key, flag.Name, err), "info")
+			continue
+		}
+		Log(fmt.Sprintf("config: key='%s' flag='%s' set='true'", key, flag.Name), "debug")
 	}
+}
 
-	token := GetStringConfig(config, "token")
-	if token != "" {
-		Token = token
+// configFlag finds the flag for a config key.
+func configFlag(flags *pflag.FlagSet, key string) *pflag.Flag {
+	if alias, ok := configAliases[key]; ok {
+		key = alias
+	}
+	if flag := flags.Lookup(key); flag != nil {
+		return flag
 	}
+	return flags.Lookup(strings.Replace(key, "_", "-", -1))
+}
 
-	consulServer := GetStringConfig(config, "consul_server")
-	if consulServer != "" {
-		ConsulServer = consulServer
+// configMode is a mode from the config. YAML reads 0640 as a number so it's
+// turned back into octal - a symbolic mode has to be a string.
+func configMode(value *simpleyaml.Yaml) string {
+	if i, err := value.Int(); err == nil {
+		return fmt.Sprintf("%04o", i)
 	}
+	mode, _ := value.String()
+	return mode
+}
 
-	dogstatsd, err := config.Get("dogstatsd").Bool()
-	if err != nil {
-		Log("Could not get 'dogstatsd' from config.", "info")
+// configValue turns a config value into the string a flag expects - lists
+// are joined with commas.
+func configValue(value *simpleyaml.Yaml) string {
+	if list, err := value.Array(); err == nil {
+		var items []string
+		for _, item := range list {
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, ",")
+	}
+	if str, err := value.String(); err == nil {
+		return str
 	}
-	if dogstatsd {
-		DogStatsd = true
+	if b, err := value.Bool(); err == nil {
+		return strconv.FormatBool(b)
 	}
+	if i, err := value.Int(); err == nil {
+		return strconv.Itoa(i)
+	}
+	if f, err := value.Float(); err == nil {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return ""
+}
+
+// envFlags are the flags that can have ${VAR} in them - keys, files,
+// directories and the prefix - so one cron line works in every environment.
+// A --url-header's secret can come from the environment so it isn't in ps.
+var envFlags = map[string]bool{
+	"cache-dir":    true,
+	"dir":          true,
+	"file":         true,
+	"key":          true,
+	"key-fallback": true,
+	"keys":         true,
+	"prefix":       true,
+	"stop-key":     true,
+	"template":     true,
+	"url-header":   true,
+}
 
-	dogstatsdAddress := GetStringConfig(config, "dogstatsd_address")
-	if dogstatsdAddress != "" {
-		DogStatsdAddress = dogstatsdAddress
+// envVar is a ${VAR} in a flag.
+var envVar = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// ExpandEnv replaces each ${VAR} in value with the environment variable. A
+// variable that isn't set is an error - apps/${APP_ENV}/config shouldn't
+// quietly become apps//config. A $ without braces is left alone.
+func ExpandEnv(value string) (string, error) {
+	var missing []string
+	expanded := envVar.ReplaceAllStringFunc(value, func(match string) string {
+		name := envVar.FindStringSubmatch(match)[1]
+		env, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return env
+	})
+	if len(missing) > 0 {
+		return value, fmt.Errorf("'%s': %s isn't set", value, strings.Join(missing, ", "))
 	}
+	return expanded, nil
+}
 
+// ExpandFlags expands the ${VAR}s in the envFlags that were passed or set by
+// the config.
+func ExpandFlags(flags *pflag.FlagSet) error {
+	var err error
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if err != nil || !flag.Changed || !envFlags[flag.Name] {
+			return
+		}
+		if slice, ok := flag.Value.(pflag.SliceValue); ok {
+			values := slice.GetSlice()
+			for i := range values {
+				if values[i], err = ExpandEnv(values[i]); err != nil {
+					err = fmt.Errorf("--%s %v", flag.Name, err)
+					return
+				}
+			}
+			err = slice.Replace(values)
+			return
+		}
+		value := flag.Value.String()
+		if !strings.Contains(value, "${") {
+			return
+		}
+		if value, err = ExpandEnv(value); err != nil {
+			err = fmt.Errorf("--%s %v", flag.Name, err)
+			return
+		}
+		err = flag.Value.Set(value)
+		Log(fmt.Sprintf("env: flag='%s' value='%s'", flag.Name, value), "debug")
+	})
+	return err
 }
@@ -4,7 +4,9 @@ package commands
 
 import (
 	"github.com/smallfish/simpleyaml"
+	"github.com/spf13/pflag"
 	"testing"
+	"time"
 )
 
 var yaml = `---
@@ -35,3 +37,90 @@ func TestConfigValues(t *testing.T) {
 		t.Logf("Value: %s", configValue)
 	}
 }
+
+func TestConfigFlags(t *testing.T) {
+	var server, prefix, owner string
+	var dogstatsd bool
+	var length int
+	var allowed []string
+	var wait time.Duration
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.StringVarP(&server, "server", "s", "localhost:8500", "")
+	flags.StringVarP(&prefix, "prefix", "p", "kvexpress", "")
+	flags.StringVarP(&owner, "owner", "o", "", "")
+	flags.BoolVarP(&dogstatsd, "dogstatsd", "d", false, "")
+	flags.IntVarP(&length, "length", "l", 10, "")
+	flags.StringSliceVarP(&allowed, "allowed-dir", "", []string{}, "")
+	flags.DurationVarP(&wait, "max-staleness", "", 0, "")
+	flags.Parse([]string{"--owner", "root"})
+
+	config := loadTestConfigValues(`---
+  consul_server: 127.0.0.1:8501
+  prefix: configured
+  owner: nobody
+  dogstatsd: true
+  length: 50
+  allowed_dir:
+    - /etc/consul-template
+    - /opt/app
+  max-staleness: 5s
+  not_a_flag: ignored`)
+	ConfigFlags(config, flags)
+
+	if server != "127.0.0.1:8501" {
+		t.Errorf("consul_server should set --server: '%s'", server)
+	}
+	if prefix != "configured" || !dogstatsd || length != 50 || wait != 5*time.Second {
+		t.Errorf("The config was not used: '%s' %t %d %s", prefix, dogstatsd, length, wait)
+	}
+	if len(allowed) != 2 || allowed[1] != "/opt/app" {
+		t.Errorf("A list should set a slice flag: %v", allowed)
+	}
+	if owner != "root" {
+		t.Errorf("A flag passed on the command line should win: '%s'", owner)
+	}
+}
+
+func TestConfigFlagsPolicy(t *testing.T) {
+	var paths []string
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.StringSliceVarP(&paths, "allowed-paths", "", []string{}, "")
+	flags.Parse([]string{"--allowed-paths", "/"})
+
+	ConfigFlags(loadTestConfigValues(`---
+  allowed_paths:
+    - /etc
+    - /opt/app`), flags)
+	if len(paths) != 2 || paths[0] != "/etc" || paths[1] != "/opt/app" {
+		t.Errorf("allowed_paths in the config should win over the flag: %v", paths)
+	}
+}
+
+func TestExpandFlags(t *testing.T) {
+	var key, prefix, exec string
+	var files []string
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.StringVarP(&key, "key", "k", "", "")
+	flags.StringVarP(&prefix, "prefix", "p", "kvexpress", "")
+	flags.StringVarP(&exec, "exec", "e", "", "")
+	flags.StringArrayVarP(&files, "file", "f", []string{}, "")
+	t.Setenv("APP_ENV", "staging")
+	flags.Parse([]string{"-k", "apps/${APP_ENV}/config", "-f", "/etc/${APP_ENV}.conf", "-f", "/etc/app.conf", "-e", "echo ${APP_ENV}"})
+	if err := ExpandFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+	if key != "apps/staging/config" || files[0] != "/etc/staging.conf" || files[1] != "/etc/app.conf" {
+		t.Errorf("The variables weren't expanded: '%s' %v", key, files)
+	}
+	if exec != "echo ${APP_ENV}" || prefix != "kvexpress" {
+		t.Errorf("Only the key, file and prefix flags should be expanded: '%s' '%s'", exec, prefix)
+	}
+
+	flags.Set("prefix", "${KVEXPRESS_MISSING}/kvexpress")
+	if err := ExpandFlags(flags); err == nil {
+		t.Error("A variable that isn't set should be an error.")
+	}
+	if value, _ := ExpandEnv("costs $5"); value != "costs $5" {
+		t.Errorf("A $ without braces should be left alone: '%s'", value)
+	}
+}
@@ -1,21 +1,101 @@
-// +build linux darwin freebsd
+// +build linux darwin freebsd windows
 
 package commands
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"github.com/DataDog/kvexpress/pkg/kvexpress"
 	consul "github.com/hashicorp/consul/api"
+	"github.com/spf13/pflag"
+	"math/rand"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 )
 
 const (
-	consulTries = 5
+	// casTries is how many times SaveCAS tries when another writer gets there first.
+	casTries = 5
+
+	// consulTxnMaxOps is the most operations Consul takes in a transaction.
+	consulTxnMaxOps = 64
+
+	// consulTxnMaxBytes is Consul's default txn_max_req_len - every value is
+	// base64 encoded in the request.
+	consulTxnMaxBytes = 512 * 1024
+
+	// txnReserveBytes is room in a transaction for the keys and the checksum,
+	// updated, encoding, meta, signature and rolling values saved with the data.
+	txnReserveBytes = 16 * 1024
 )
 
-// Connect sets up a connection to Consul.
+// casBackoff is how long SaveCAS waits after a conflict - it's doubled every time.
+var casBackoff = 250 * time.Millisecond
+
+// ErrTooStale is returned when a stale read is older than --max-staleness and
+// there's no falling back to a consistent read.
+var ErrTooStale = errors.New("stale read is older than the maximum staleness")
+
+// ErrCASConflict is returned when SaveCAS keeps losing to another writer.
+var ErrCASConflict = errors.New("another writer kept changing the key")
+
+// ErrTxnTooLarge is returned for a transaction that's over Consul's limits -
+// it isn't sent.
+var ErrTxnTooLarge = errors.New("the transaction is too large for Consul")
+
+// ErrTxnFailed is returned when Consul rolls back a transaction for a reason
+// other than a KVCAS that lost - like an ACL that doesn't allow one of the keys.
+var ErrTxnFailed = errors.New("consul rolled back the transaction")
+
+// ErrNoMoreRetries is returned when Retry gives up on Consul.
+var ErrNoMoreRetries = errors.New("giving up on Consul")
+
+// consulEnvFlags maps the environment variables used by the Consul CLI to
+// the kvexpress flags they provide defaults for.
+var consulEnvFlags = map[string]string{
+	"CONSUL_HTTP_ADDR":       "server",
+	"CONSUL_HTTP_TOKEN":      "token",
+	"CONSUL_HTTP_TOKEN_FILE": "token-file",
+	"CONSUL_HTTP_SSL":        "ssl",
+	"CONSUL_HTTP_SSL_VERIFY": "ssl-verify",
+	"CONSUL_CACERT":          "ssl-ca-cert",
+	"CONSUL_CAPATH":          "ssl-ca-path",
+	"CONSUL_CLIENT_CERT":     "ssl-cert",
+	"CONSUL_CLIENT_KEY":      "ssl-key",
+	"CONSUL_TLS_SERVER_NAME": "tls-server-name",
+	"CONSUL_NAMESPACE":       "namespace",
+	"CONSUL_PARTITION":       "partition",
+}
+
+// ConsulEnv sets flags from the Consul CLI environment variables - but only
+// if the flag wasn't passed on the command line.
+func ConsulEnv(flags *pflag.FlagSet) {
+	for env, name := range consulEnvFlags {
+		value := os.Getenv(env)
+		flag := flags.Lookup(name)
+		if value == "" || flag == nil || flag.Changed {
+			continue
+		}
+		if err := flags.Set(name, value); err != nil {
+			Log(fmt.Sprintf("env='%s' flag='%s' message='%v'", env, name, err), "info")
+			continue
+		}
+		Log(fmt.Sprintf("env='%s' flag='%s' set='true'", env, name), "debug")
+	}
+}
+
+// Connect sets up a connection to Consul in the --dc datacenter.
 func Connect(server string, token string) (*consul.Client, error) {
-	consul, err := consulConnect(server, token)
+	return ConnectDatacenter(server, token, Datacenter)
+}
+
+// ConnectDatacenter sets up a connection to Consul that talks to dc - the
+// local datacenter if it's blank.
+func ConnectDatacenter(server, token, dc string) (*consul.Client, error) {
+	consul, err := consulConnect(server, token, dc)
 	if err != nil {
 		Log("Consul connection is bad.", "info")
 		return nil, err
@@ -24,18 +104,62 @@ func Connect(server string, token string) (*consul.Client, error) {
 }
 
 // consulConnect to the Consul server and hand back a client object.
-func consulConnect(server, token string) (*consul.Client, error) {
+func consulConnect(server, token, dc string) (*consul.Client, error) {
+	servers, err := ConsulServers(server)
+	if err != nil {
+		return nil, err
+	}
 	config := consul.DefaultConfig()
-	config.Address = server
+	config.Address = servers[0]
+	if socket := unixSocket(servers[0]); socket != "" {
+		unixTransport(config, socket)
+	}
+	config.Datacenter = dc
+	// Enterprise only - every request is made in the namespace and partition.
+	config.Namespace = Namespace
+	config.Partition = Partition
+	if ConsulSSL {
+		config.Scheme = "https"
+	}
+	config.TLSConfig = consul.TLSConfig{
+		Address:            TLSServerName,
+		CAFile:             ConsulCACert,
+		CAPath:             ConsulCAPath,
+		CertFile:           ConsulClientCert,
+		KeyFile:            ConsulClientKey,
+		InsecureSkipVerify: !ConsulSSLVerify,
+	}
 	// Let's clean up the token so it doesn't appear in the logs.
 	if token != "" {
 		config.Token = token
 	}
+	if config.Transport != nil && (ConsulProxy != "" || Proxy != "") && unixSocket(servers[0]) == "" {
+		config.Transport.Proxy = proxyFunc(ConsulProxy)
+	}
+	// Every worker keeps its connection open rather than making a new one for
+	// each request.
+	if config.Transport != nil && OutParallel > config.Transport.MaxIdleConnsPerHost {
+		config.Transport.MaxIdleConnsPerHost = OutParallel
+	}
+	client, err := consul.NewHttpClient(config.Transport, config.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	if ConsulTimeout > 0 {
+		client = timeoutClient(client)
+	}
+	if len(servers) > 1 {
+		client = failoverClient(client, servers)
+	}
+	if ConsulRate > 0 {
+		client = limitClient(client)
+	}
+	config.HttpClient = cancelClient(trafficClient(client))
 	consul, err := consul.NewClient(config)
 	if err != nil {
 		return nil, err
 	}
-	Log(fmt.Sprintf("server='%s' token='%s'", server, cleanupToken(token)), "debug")
+	Log(fmt.Sprintf("server='%s' token='%s' dc='%s' namespace='%s' partition='%s'", server, cleanupToken(token), dc, Namespace, Partition), "debug")
 	return consul, nil
 }
 
@@ -47,33 +171,119 @@ func cleanupToken(token string) string {
 	return first
 }
 
-// Get the value from a key in the Consul KV store.
-func Get(c *consul.Client, key string) string {
+// kvStore is c as a kvexpress.Store - so the library reads keys the same way
+// the commands do, with KeyPath's --key-template and Get's retries, stale
+// reads and --backend.
+type kvStore struct {
+	c *consul.Client
+}
+
+// Path is KeyPath.
+func (s kvStore) Path(key, part string) string {
+	return KeyPath(key, part)
+}
+
+// Get is Get with the store's client.
+func (s kvStore) Get(path string) (string, error) {
+	return Get(s.c, path)
+}
+
+// Get the value from a key in the Consul KV store - or the --backend.
+func Get(c *consul.Client, key string) (string, error) {
 	var str string
-	Retry(func() error {
+	span := StartSpan("consul.get", "kvexpress.key", key)
+	err := Retry(func() error {
 		var err error
+		if backend != nil {
+			str, err = backend.Get(key)
+			return err
+		}
 		str, err = consulGet(c, key)
 		return err
-	}, consulTries)
-	return str
+	}, Retries)
+	span.Finish(err)
+	return str, err
 }
 
 // Retry loops through the callback func and tries several times to do the thing.
-func Retry(callback func() error, tries int) {
+// It returns ErrNoMoreRetries if it gives up. ErrTooStale isn't retried - that
+// won't make the replica catch up.
+func Retry(callback func() error, tries int) error {
 	var err error
+	if tries < 1 {
+		tries = 1
+	}
 	for i := 1; i <= tries; i++ {
+		callStart := time.Now()
 		err = callback()
-		if err == nil {
-			return
+		PromObserve("kvexpress.consul", time.Since(callStart), []string{fmt.Sprintf("direction:%s", Direction)})
+		if err == nil || err == ErrTooStale {
+			return err
+		}
+		// A stopped run isn't coming back.
+		if runCtx.Err() != nil {
+			return runStopped(err)
 		}
-		waitTime := time.Duration(tries) * time.Second
-		Log(fmt.Sprintf("Consul Failure (%d) - trying again. Max: %d", i, tries), "info")
-		StatsdReconnect(tries)
-		if i < tries {
-			time.Sleep(waitTime)
+		Log(fmt.Sprintf("Consul Failure (%d) - trying again. Max: %d message='%v'", i, tries, err), "info")
+		StatsdReconnect(i)
+		if i < tries && !sleepRun(RetryBackoff(i)) {
+			return runStopped(err)
 		}
 	}
-	LogFatal("Panic: Giving up on Consul.", "nokey", "no_more_retries")
+	return fmt.Errorf("%w: %v", ErrNoMoreRetries, err)
+}
+
+// RetryBackoff is how long to wait after a failed attempt. It starts at
+// --retry-wait and doubles every attempt up to --retry-max-wait - then it's
+// jittered to somewhere between half and all of that so a fleet of hosts
+// doesn't come back at the same time.
+func RetryBackoff(attempt int) time.Duration {
+	wait := RetryWait
+	for i := 1; i < attempt && wait < RetryMaxWait; i++ {
+		wait *= 2
+	}
+	if wait > RetryMaxWait {
+		wait = RetryMaxWait
+	}
+	if wait <= 0 {
+		return 0
+	}
+	half := wait / 2
+	return half + time.Duration(rand.Int63n(int64(wait-half)+1))
+}
+
+// consistencyModes are the --consistency read modes.
+var consistencyModes = []string{"default", "stale", "consistent"}
+
+// SetupConsistency picks the read mode when --consistency is blank - stale
+// with --stale, consistent for in so it compares against the leader's data
+// and default for everything else.
+func SetupConsistency() error {
+	switch Consistency {
+	case "":
+		switch {
+		case AllowStale:
+			Consistency = "stale"
+		case Direction == "in":
+			Consistency = "consistent"
+		default:
+			Consistency = "default"
+		}
+	case "default", "stale", "consistent":
+	default:
+		return fmt.Errorf("--consistency should be one of %s not '%s'", strings.Join(consistencyModes, ", "), Consistency)
+	}
+	if AllowStale && Consistency != "stale" {
+		return fmt.Errorf("--stale can't be used with --consistency %s", Consistency)
+	}
+	AllowStale = Consistency == "stale"
+	Log(fmt.Sprintf("consistency='%s'", Consistency), "debug")
+	return nil
+}
+
+// readOptions are the query options for a read with the --consistency mode.
+func readOptions() *consul.QueryOptions {
+	return &consul.QueryOptions{AllowStale: AllowStale, RequireConsistent: !AllowStale && Consistency == "consistent"}
 }
 
 // consulGet the value from a key in the Consul KV store.
@@ -81,10 +291,21 @@ func consulGet(c *consul.Client, key string) (string, error) {
 	var value string
 	kv := c.KV()
 	key = strings.TrimPrefix(key, "/")
-	pair, _, err := kv.Get(key, nil)
+	pair, meta, err := kv.Get(key, readOptions())
 	if err != nil {
 		return "", err
 	}
+	if AllowStale && MaxStaleness > 0 && meta.LastContact > MaxStaleness {
+		Log(fmt.Sprintf("action='consulGet' key='%s' last_contact='%s' max_staleness='%s' stale='true'", key, meta.LastContact, MaxStaleness), "info")
+		StatsdStale(key, meta.LastContact)
+		if !StaleFallback {
+			return "", ErrTooStale
+		}
+		pair, _, err = kv.Get(key, &consul.QueryOptions{RequireConsistent: true})
+		if err != nil {
+			return "", err
+		}
+	}
 	if pair != nil {
 		value = string(pair.Value[:])
 	} else {
@@ -94,18 +315,24 @@ func consulGet(c *consul.Client, key string) (string, error) {
 	return value, err
 }
 
-// Set the value for a key in the Consul KV store.
-func Set(c *consul.Client, key string, value string) bool {
+// Set the value for a key in the Consul KV store - or the --backend.
+func Set(c *consul.Client, key string, value string) error {
 	var success bool
-	Retry(func() error {
+	span := StartSpan("consul.set", "kvexpress.key", key, "kvexpress.bytes", strconv.Itoa(len(value)))
+	err := Retry(func() error {
 		var err error
-		success, err = consulSet(c, key, value)
+		if backend != nil {
+			success, err = backend.Set(key, value)
+		} else {
+			success, err = consulSet(c, key, value)
+		}
 		if success != true {
 			StatsdConsul(key, "set")
 		}
 		return err
-	}, consulTries)
-	return true
+	}, Retries)
+	span.Finish(err)
+	return err
 }
 
 // consulSet a value for a key in the Consul KV store.
@@ -121,18 +348,21 @@ func consulSet(c *consul.Client, key string, value string) (bool, error) {
 	return true, err
 }
 
-// Del removes a key from the Consul KV store.
-func Del(c *consul.Client, key string) bool {
+// Del removes a key from the Consul KV store - or the --backend.
+func Del(c *consul.Client, key string) error {
 	var success bool
-	Retry(func() error {
+	return Retry(func() error {
 		var err error
-		success, err = consulDel(c, key)
+		if backend != nil {
+			success, err = backend.Del(key)
+		} else {
+			success, err = consulDel(c, key)
+		}
 		if success != true {
 			StatsdConsul(key, "delete")
 		}
 		return err
-	}, consulTries)
-	return true
+	}, Retries)
 }
 
 // consulDel removes a key from the Consul KV store.
@@ -146,3 +376,251 @@ func consulDel(c *consul.Client, key string) (bool, error) {
 	Log(fmt.Sprintf("action='consulDel' key='%s'", key), "info")
 	return true, err
 }
+
+// Keys lists all of the keys underneath a prefix in the Consul KV store - or the --backend.
+func Keys(c *consul.Client, prefix string) ([]string, error) {
+	var keys []string
+	err := Retry(func() error {
+		var err error
+		if backend != nil {
+			keys, err = backend.Keys(prefix)
+			return err
+		}
+		keys, err = consulKeys(c, prefix)
+		return err
+	}, Retries)
+	return keys, err
+}
+
+// List returns every key underneath prefix with its value - in one request on
+// Consul instead of one for each key.
+func List(c *consul.Client, prefix string) (map[string]string, error) {
+	values := make(map[string]string)
+	err := Retry(func() error {
+		if backend != nil {
+			keys, err := backend.Keys(prefix)
+			if err != nil {
+				return err
+			}
+			for _, key := range keys {
+				value, err := backend.Get(key)
+				if err != nil {
+					return err
+				}
+				values[key] = value
+			}
+			return nil
+		}
+		pairs, _, err := c.KV().List(strings.TrimPrefix(prefix, "/"), readOptions())
+		if err != nil {
+			return err
+		}
+		for _, pair := range pairs {
+			values[pair.Key] = string(pair.Value)
+		}
+		return nil
+	}, Retries)
+	return values, err
+}
+
+// consulKeys lists all of the keys underneath a prefix in the Consul KV store.
+func consulKeys(c *consul.Client, prefix string) ([]string, error) {
+	kv := c.KV()
+	prefix = strings.TrimPrefix(prefix, "/")
+	keys, _, err := kv.Keys(prefix, "", readOptions())
+	if err != nil {
+		return nil, err
+	}
+	Log(fmt.Sprintf("action='consulKeys' prefix='%s' keys='%d'", prefix, len(keys)), "debug")
+	return keys, nil
+}
+
+// Wait blocks until something underneath prefix changes after index - or
+// until wait runs out - and returns the new index.
+func Wait(c *consul.Client, prefix string, index uint64, wait time.Duration) (uint64, error) {
+	var newIndex uint64
+	err := Retry(func() error {
+		var err error
+		if b, ok := backend.(waitBackend); ok {
+			newIndex, err = b.Wait(prefix, index, wait)
+			return err
+		}
+		newIndex, err = consulWait(c, prefix, index, wait)
+		return err
+	}, Retries)
+	return newIndex, err
+}
+
+// consulWait runs a blocking query against everything underneath prefix.
+func consulWait(c *consul.Client, prefix string, index uint64, wait time.Duration) (uint64, error) {
+	kv := c.KV()
+	prefix = strings.TrimPrefix(prefix, "/")
+	options := readOptions()
+	options.WaitIndex, options.WaitTime = index, wait
+	_, meta, err := kv.List(prefix, options)
+	if err != nil {
+		return 0, err
+	}
+	Log(fmt.Sprintf("action='consulWait' prefix='%s' index='%d' newIndex='%d'", prefix, index, meta.LastIndex), "debug")
+	return meta.LastIndex, nil
+}
+
+// SaveCAS saves the data, checksum, updated and encoding keys - and any extra
+// operations like the signature - in a single Consul transaction, but only if
+// the data and checksum keys haven't changed since they were read. On a
+// conflict the keys are read again and if the other writer didn't already save
+// this checksum it tries again with a backoff. It returns false if the checksum
+// was already saved - without making a transaction.
+func SaveCAS(c *consul.Client, key, data, checksum, checksums string, extra ...*consul.TxnOp) (bool, error) {
+	return saveCAS(c, key, data, checksum, checksums, StoredEncoding(), extra...)
+}
+
+// saveCAS is SaveCAS for data that's stored with encoding.
+func saveCAS(c *consul.Client, key, data, checksum, checksums, encoding string, extra ...*consul.TxnOp) (bool, error) {
+	KeyData := KeyPath(key, "data")
+	KeyChecksum := KeyPath(key, "checksum")
+	backoff := casBackoff
+	for i := 1; i <= casTries; i++ {
+		dataIndex, _, err := consulIndex(c, KeyData)
+		if err != nil {
+			return false, err
+		}
+		checksumIndex, storedChecksum, err := consulIndex(c, KeyChecksum)
+		if err != nil {
+			return false, err
+		}
+		if strings.TrimSpace(storedChecksum) == checksum {
+			Log(fmt.Sprintf("action='SaveCAS' key='%s' checksum='match' saved='false'", key), "info")
+			return false, nil
+		}
+		ok, err := saveCASAt(c, key, data, checksum, checksums, encoding, dataIndex, checksumIndex, extra...)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			Log(fmt.Sprintf("action='SaveCAS' key='%s' saved='true' tries='%d'", key, i), "debug")
+			return true, nil
+		}
+		Log(fmt.Sprintf("action='SaveCAS' key='%s' conflict='true' tries='%d'", key, i), "info")
+		StatsdConsul(key, "cas_conflict")
+		if i < casTries {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return false, ErrCASConflict
+}
+
+// saveCASAt saves data in key if its data and checksum keys are still at
+// dataIndex and checksumIndex - it's false if either was changed since they
+// were read. It's tried once.
+func saveCASAt(c *consul.Client, key, data, checksum, checksums, encoding string, dataIndex, checksumIndex uint64, extra ...*consul.TxnOp) (bool, error) {
+	owner, err := ownerOps(c, key)
+	if err != nil {
+		return false, err
+	}
+	ops := casOps(key, data, checksum, checksums, encoding, dataIndex, checksumIndex)
+	return kvTxn(c, append(append(ops, owner...), extra...))
+}
+
+// casOps save data in key with encoding if data and checksum are still at
+// dataIndex and checksumIndex.
+func casOps(key, data, checksum, checksums, encoding string, dataIndex, checksumIndex uint64) consul.TxnOps {
+	return kvexpress.SaveOps(kvStore{}, key, data, checksum, checksums, encoding, ReturnCurrentUTC(), dataIndex, checksumIndex)
+}
+
+// checksumsOp saves the checksums key with the rest of the data - or removes
+// it when there's only the one checksum.
+func checksumsOp(key, checksums string) *consul.TxnOp {
+	if checksums == "" {
+		return &consul.TxnOp{KV: &consul.KVTxnOp{Verb: consul.KVDelete, Key: KeyPath(key, "checksums")}}
+	}
+	return &consul.TxnOp{KV: &consul.KVTxnOp{Verb: consul.KVSet, Key: KeyPath(key, "checksums"), Value: []byte(checksums)}}
+}
+
+// setOp saves value to key as part of a SaveCAS transaction.
+func setOp(key, value string) *consul.TxnOp {
+	return &consul.TxnOp{KV: &consul.KVTxnOp{Verb: consul.KVSet, Key: key, Value: []byte(value)}}
+}
+
+// kvTxn runs ops in a Consul transaction - or the --backend's. It's false when
+// a KVCAS lost, and any other reason Consul rolled it back is an ErrTxnFailed.
+func kvTxn(c *consul.Client, ops consul.TxnOps) (bool, error) {
+	if txn, ok := backend.(txnBackend); ok {
+		return txn.Txn(ops)
+	}
+	if err := checkTxn(ops); err != nil {
+		return false, err
+	}
+	ok, resp, _, err := c.Txn().Txn(ops, nil)
+	if err != nil || ok {
+		return ok, err
+	}
+	Log(fmt.Sprintf("action='kvTxn' ok='false' errors='%d'", len(resp.Errors)), "debug")
+	var failed []string
+	for _, txnErr := range resp.Errors {
+		if txnConflict(txnErr.What) {
+			continue
+		}
+		key := ""
+		if txnErr.OpIndex >= 0 && txnErr.OpIndex < len(ops) && ops[txnErr.OpIndex].KV != nil {
+			key = ops[txnErr.OpIndex].KV.Key
+		}
+		failed = append(failed, fmt.Sprintf("'%s': %s", key, txnErr.What))
+	}
+	if len(failed) > 0 {
+		return false, fmt.Errorf("%w - %s", ErrTxnFailed, strings.Join(failed, ", "))
+	}
+	return false, nil
+}
+
+// txnConflict is true for the errors Consul gives a KVCAS, KVCheckIndex or
+// KVCheckNotExists that lost to another writer.
+func txnConflict(what string) bool {
+	return strings.Contains(what, "index is stale") || strings.Contains(what, "current modify index") || strings.HasSuffix(what, "\" exists")
+}
+
+// checkTxn returns ErrTxnTooLarge for ops that Consul would refuse - before
+// any of it's sent.
+func checkTxn(ops consul.TxnOps) error {
+	if len(ops) > consulTxnMaxOps {
+		return fmt.Errorf("%w - %d operations is more than %d", ErrTxnTooLarge, len(ops), consulTxnMaxOps)
+	}
+	size := 0
+	for _, op := range ops {
+		if op.KV != nil {
+			size += len(op.KV.Key) + base64.StdEncoding.EncodedLen(len(op.KV.Value))
+		}
+	}
+	if size > consulTxnMaxBytes {
+		return fmt.Errorf("%w - %d bytes is more than %d, use --chunk-size", ErrTxnTooLarge, size, consulTxnMaxBytes)
+	}
+	return nil
+}
+
+// singleTxn is true when size bytes of stored data can be saved with SaveCAS -
+// the backend has transactions, it's a single chunk and base64 encoded with
+// the rest of the keys it fits in one Consul transaction. Data that doesn't is
+// saved a key at a time.
+func singleTxn(size int) bool {
+	if !atomicWrites() || (ChunkSize > 0 && size > ChunkSize) {
+		return false
+	}
+	if backend != nil {
+		return true
+	}
+	return base64.StdEncoding.EncodedLen(size)+txnReserveBytes <= consulTxnMaxBytes
+}
+
+// consulIndex returns the ModifyIndex and value for key - or 0 if it doesn't
+// exist. A txnBackend has its own index.
+func consulIndex(c *consul.Client, key string) (uint64, string, error) {
+	if txn, ok := backend.(txnBackend); ok {
+		return txn.Index(key)
+	}
+	pair, _, err := c.KV().Get(strings.TrimPrefix(key, "/"), &consul.QueryOptions{RequireConsistent: true})
+	if err != nil || pair == nil {
+		return 0, "", err
+	}
+	return pair.ModifyIndex, string(pair.Value), nil
+}
@@ -0,0 +1,703 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/spf13/pflag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testConsul is a small in-memory stand-in for the Consul KV HTTP API.
+type testConsul struct {
+	sync.Mutex
+	server   *httptest.Server
+	kv       map[string]*consul.KVPair
+	sessions map[string]bool
+	index    uint64
+	requests map[string]int
+
+	// datacenters counts the requests for each ?dc= - blank is the local datacenter.
+	datacenters map[string]int
+
+	// namespaces counts the requests for each ?ns= and ?partition= as ns/partition.
+	namespaces map[string]int
+
+	// lastContact is sent in X-Consul-LastContact for reads that aren't consistent.
+	lastContact time.Duration
+
+	// denied is true for the KV requests the token can't make - they get a 403.
+	denied func(method, key string) bool
+
+	// services are the registered agent services and checks the status of their TTL checks.
+	services map[string]*consul.AgentServiceRegistration
+	checks   map[string]string
+}
+
+// newTestConsul starts a testConsul and returns a client connected to it.
+func newTestConsul(t *testing.T) (*testConsul, *consul.Client) {
+	tc := &testConsul{kv: make(map[string]*consul.KVPair), sessions: make(map[string]bool), index: 1, requests: make(map[string]int), datacenters: make(map[string]int), namespaces: make(map[string]int), services: make(map[string]*consul.AgentServiceRegistration), checks: make(map[string]string)}
+	tc.server = httptest.NewServer(http.HandlerFunc(tc.handle))
+	t.Cleanup(tc.server.Close)
+	c, err := Connect(strings.TrimPrefix(tc.server.URL, "http://"), "")
+	if err != nil {
+		t.Fatalf("Could not connect to the test Consul: %v", err)
+	}
+	return tc, c
+}
+
+// value returns the value stored at key and whether it exists.
+func (tc *testConsul) value(key string) (string, bool) {
+	tc.Lock()
+	defer tc.Unlock()
+	pair, ok := tc.kv[key]
+	if !ok {
+		return "", false
+	}
+	return string(pair.Value), true
+}
+
+// put stores a value directly without going through the HTTP API.
+func (tc *testConsul) put(key, value string) {
+	tc.Lock()
+	defer tc.Unlock()
+	tc.setLocked(key, []byte(value), 0)
+}
+
+// count returns the number of HTTP requests seen for method.
+func (tc *testConsul) count(method string) int {
+	tc.Lock()
+	defer tc.Unlock()
+	return tc.requests[method]
+}
+
+func (tc *testConsul) setLocked(key string, value []byte, flags uint64) {
+	tc.index++
+	pair, ok := tc.kv[key]
+	if !ok {
+		pair = &consul.KVPair{Key: key, CreateIndex: tc.index}
+		tc.kv[key] = pair
+	}
+	pair.Value = value
+	pair.Flags = flags
+	pair.ModifyIndex = tc.index
+}
+
+func (tc *testConsul) handle(w http.ResponseWriter, r *http.Request) {
+	tc.Lock()
+	defer tc.Unlock()
+	tc.requests[r.Method]++
+	query := r.URL.Query()
+	tc.datacenters[query.Get("dc")]++
+	tc.namespaces[query.Get("ns")+"/"+query.Get("partition")]++
+	w.Header().Set("X-Consul-KnownLeader", "true")
+	if _, consistent := query["consistent"]; consistent {
+		tc.requests["consistent"]++
+		w.Header().Set("X-Consul-LastContact", "0")
+	} else {
+		w.Header().Set("X-Consul-LastContact", strconv.FormatInt(int64(tc.lastContact/time.Millisecond), 10))
+	}
+	if r.URL.Path == "/v1/txn" {
+		tc.handleTxn(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/v1/session/") {
+		tc.handleSession(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/v1/agent/") {
+		tc.handleAgent(w, r)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/v1/kv/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	if tc.denied != nil && tc.denied(r.Method, key) {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "Permission denied")
+		return
+	}
+	switch r.Method {
+	case "GET":
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(tc.index, 10))
+		var pairs []*consul.KVPair
+		var keys []string
+		for k, pair := range tc.kv {
+			_, recurse := query["recurse"]
+			_, list := query["keys"]
+			if (recurse || list) && strings.HasPrefix(k, key) || k == key {
+				pairs = append(pairs, pair)
+				keys = append(keys, k)
+			}
+		}
+		if len(pairs) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		sort.Strings(keys)
+		sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+		if _, list := query["keys"]; list {
+			json.NewEncoder(w).Encode(keys)
+			return
+		}
+		json.NewEncoder(w).Encode(pairs)
+	case "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		if cas := query.Get("cas"); cas != "" {
+			index, _ := strconv.ParseUint(cas, 10, 64)
+			pair, ok := tc.kv[key]
+			if (index == 0 && ok) || (index != 0 && (!ok || pair.ModifyIndex != index)) {
+				fmt.Fprint(w, "false")
+				return
+			}
+		}
+		if session := query.Get("acquire"); session != "" {
+			pair, ok := tc.kv[key]
+			if !tc.sessions[session] || (ok && pair.Session != "" && pair.Session != session) {
+				fmt.Fprint(w, "false")
+				return
+			}
+			tc.setLocked(key, body, 0)
+			tc.kv[key].Session = session
+			fmt.Fprint(w, "true")
+			return
+		}
+		flags, _ := strconv.ParseUint(query.Get("flags"), 10, 64)
+		tc.setLocked(key, body, flags)
+		fmt.Fprint(w, "true")
+	case "DELETE":
+		if cas := query.Get("cas"); cas != "" {
+			index, _ := strconv.ParseUint(cas, 10, 64)
+			if pair, ok := tc.kv[key]; !ok || pair.ModifyIndex != index {
+				fmt.Fprint(w, "false")
+				return
+			}
+		}
+		if _, recurse := query["recurse"]; recurse {
+			for k := range tc.kv {
+				if strings.HasPrefix(k, key) {
+					delete(tc.kv, k)
+				}
+			}
+		} else {
+			delete(tc.kv, key)
+		}
+		tc.index++
+		fmt.Fprint(w, "true")
+	}
+}
+
+// handleTxn checks every cas in the transaction before applying any of it.
+func (tc *testConsul) handleTxn(w http.ResponseWriter, r *http.Request) {
+	var ops consul.TxnOps
+	json.NewDecoder(r.Body).Decode(&ops)
+	var errors consul.TxnErrors
+	for i, op := range ops {
+		if tc.denied != nil && tc.denied("PUT", op.KV.Key) {
+			errors = append(errors, &consul.TxnError{OpIndex: i, What: "Permission denied"})
+			continue
+		}
+		pair, ok := tc.kv[op.KV.Key]
+		switch {
+		case op.KV.Verb == consul.KVCheckNotExists && ok:
+			errors = append(errors, &consul.TxnError{OpIndex: i, What: fmt.Sprintf("key %q exists", op.KV.Key)})
+		case op.KV.Verb == consul.KVCheckIndex && !ok:
+			errors = append(errors, &consul.TxnError{OpIndex: i, What: fmt.Sprintf("key %q doesn't exist", op.KV.Key)})
+		case op.KV.Verb == consul.KVCheckIndex && pair.ModifyIndex != op.KV.Index:
+			errors = append(errors, &consul.TxnError{OpIndex: i, What: fmt.Sprintf("current modify index %d != %d", pair.ModifyIndex, op.KV.Index)})
+		}
+		if op.KV.Verb != consul.KVCAS {
+			continue
+		}
+		if (op.KV.Index == 0 && ok) || (op.KV.Index != 0 && (!ok || pair.ModifyIndex != op.KV.Index)) {
+			errors = append(errors, &consul.TxnError{OpIndex: i, What: "index is stale"})
+		}
+	}
+	if len(errors) > 0 {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(consul.TxnResponse{Errors: errors})
+		return
+	}
+	for _, op := range ops {
+		switch op.KV.Verb {
+		case consul.KVSet, consul.KVCAS:
+			tc.setLocked(op.KV.Key, op.KV.Value, op.KV.Flags)
+		case consul.KVDelete:
+			delete(tc.kv, op.KV.Key)
+		case consul.KVDeleteTree:
+			for k := range tc.kv {
+				if strings.HasPrefix(k, op.KV.Key) {
+					delete(tc.kv, k)
+				}
+			}
+		}
+	}
+	json.NewEncoder(w).Encode(consul.TxnResponse{})
+}
+
+// handleSession creates, renews and destroys sessions. Destroying a session
+// deletes the keys it holds.
+func (tc *testConsul) handleSession(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/session/"), "/")
+	switch parts[0] {
+	case "create":
+		tc.index++
+		id := fmt.Sprintf("session-%d", tc.index)
+		tc.sessions[id] = true
+		json.NewEncoder(w).Encode(map[string]string{"ID": id})
+	case "renew", "info":
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(tc.index, 10))
+		if len(parts) < 2 || !tc.sessions[parts[1]] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode([]*consul.SessionEntry{{ID: parts[1]}})
+	case "destroy":
+		if len(parts) == 2 {
+			delete(tc.sessions, parts[1])
+			for k, pair := range tc.kv {
+				if pair.Session == parts[1] {
+					delete(tc.kv, k)
+				}
+			}
+		}
+		fmt.Fprint(w, "true")
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (tc *testConsul) handleAgent(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/agent/")
+	switch {
+	case path == "service/register":
+		var service consul.AgentServiceRegistration
+		if err := json.NewDecoder(r.Body).Decode(&service); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		tc.services[service.ID] = &service
+		if service.Check != nil {
+			tc.checks[service.Check.CheckID] = service.Check.Status
+		}
+	case strings.HasPrefix(path, "service/deregister/"):
+		id := strings.TrimPrefix(path, "service/deregister/")
+		if service, ok := tc.services[id]; ok && service.Check != nil {
+			delete(tc.checks, service.Check.CheckID)
+		}
+		delete(tc.services, id)
+	case path == "checks":
+		checks := make(map[string]*consul.AgentCheck)
+		for id, status := range tc.checks {
+			checks[id] = &consul.AgentCheck{CheckID: id, Status: status}
+		}
+		json.NewEncoder(w).Encode(checks)
+	case strings.HasPrefix(path, "check/update/"):
+		id := strings.TrimPrefix(path, "check/update/")
+		if _, ok := tc.checks[id]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var update struct{ Status string }
+		json.NewDecoder(r.Body).Decode(&update)
+		tc.checks[id] = update.Status
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestSetGetDel(t *testing.T) {
+	tc, c := newTestConsul(t)
+	if err := Set(c, "/testing/keyname/data", exampleData); err != nil {
+		t.Fatalf("Set returned an error: %v", err)
+	}
+	if value, ok := tc.value("testing/keyname/data"); !ok || value != exampleData {
+		t.Errorf("Set did not store the data: '%s'", value)
+	}
+	if value, err := Get(c, "testing/keyname/data"); err != nil || value != exampleData {
+		t.Error("Get did not return the stored data.")
+	}
+	if value, err := Get(c, "testing/missing/data"); err != nil || value != "" {
+		t.Error("Get of a missing key should be blank.")
+	}
+	if err := Del(c, "testing/keyname/data"); err != nil {
+		t.Errorf("Del returned an error: %v", err)
+	}
+	if _, ok := tc.value("testing/keyname/data"); ok {
+		t.Error("Del did not remove the key.")
+	}
+}
+
+// staleReads turns on stale reads with a maximum staleness for a test.
+func staleReads(t *testing.T, max time.Duration, fallback bool) {
+	t.Cleanup(func() { AllowStale, MaxStaleness, StaleFallback = false, 0, true })
+	AllowStale, MaxStaleness, StaleFallback = true, max, fallback
+}
+
+func TestGetStaleUnderMaxStaleness(t *testing.T) {
+	tc, c := newTestConsul(t)
+	staleReads(t, 5*time.Second, true)
+	tc.put("testing/keyname/data", exampleData)
+	tc.lastContact = 2 * time.Second
+	value, err := consulGet(c, "testing/keyname/data")
+	if err != nil || value != exampleData {
+		t.Errorf("A stale read under the SLA should work: '%s' %v", value, err)
+	}
+	if tc.count("consistent") != 0 {
+		t.Error("A stale read under the SLA should not fall back to a consistent read.")
+	}
+}
+
+func TestGetStaleOverMaxStaleness(t *testing.T) {
+	tc, c := newTestConsul(t)
+	staleReads(t, 5*time.Second, true)
+	tc.put("testing/keyname/data", exampleData)
+	tc.lastContact = 10 * time.Second
+	value, err := consulGet(c, "testing/keyname/data")
+	if err != nil || value != exampleData {
+		t.Errorf("A stale read over the SLA should fall back: '%s' %v", value, err)
+	}
+	if tc.count("consistent") != 1 {
+		t.Errorf("A stale read over the SLA should do 1 consistent read: %d", tc.count("consistent"))
+	}
+}
+
+func TestGetStaleOverMaxStalenessNoFallback(t *testing.T) {
+	tc, c := newTestConsul(t)
+	staleReads(t, 5*time.Second, false)
+	tc.put("testing/keyname/data", exampleData)
+	tc.lastContact = 10 * time.Second
+	value, err := consulGet(c, "testing/keyname/data")
+	if err != ErrTooStale || value != "" {
+		t.Errorf("A stale read over the SLA should fail: '%s' %v", value, err)
+	}
+	if tc.count("consistent") != 0 {
+		t.Error("There shouldn't be a consistent read without the fallback.")
+	}
+}
+
+func TestSetupConsistency(t *testing.T) {
+	direction := Direction
+	defer func() { Consistency, AllowStale, Direction = "", false, direction }()
+	tests := []struct {
+		consistency, direction string
+		stale                  bool
+		mode                   string
+	}{
+		{"", "out", false, "default"},
+		{"", "in", false, "consistent"},
+		{"", "in", true, "stale"},
+		{"stale", "out", false, "stale"},
+		{"consistent", "out", false, "consistent"},
+	}
+	for _, test := range tests {
+		Consistency, AllowStale, Direction = test.consistency, test.stale, test.direction
+		if err := SetupConsistency(); err != nil || Consistency != test.mode || AllowStale != (test.mode == "stale") {
+			t.Errorf("%+v should read with '%s': '%s' %v", test, test.mode, Consistency, err)
+		}
+	}
+	Consistency, AllowStale = "consistent", true
+	if err := SetupConsistency(); err == nil {
+		t.Error("--stale and --consistency consistent can't both be used.")
+	}
+	Consistency, AllowStale = "eventual", false
+	if err := SetupConsistency(); err == nil {
+		t.Error("An unknown mode should be an error.")
+	}
+
+	tc, c := newTestConsul(t)
+	tc.put("testing/keyname/data", exampleData)
+	Consistency = "consistent"
+	if value, err := consulGet(c, "testing/keyname/data"); err != nil || value != exampleData || tc.count("consistent") != 1 {
+		t.Errorf("A consistent read should ask the leader: '%s' %v", value, err)
+	}
+}
+
+func TestSaveCAS(t *testing.T) {
+	tc, c := newTestConsul(t)
+	PrefixLocation = "testing"
+	tc.put("testing/cas/data/0", "an old chunk")
+	tc.put("testing/cas/manifest", "{}")
+	saved, err := SaveCAS(c, "cas", exampleData, exampleDataSHA, "")
+	if err != nil || !saved {
+		t.Fatalf("The data should be saved: %v", err)
+	}
+	if checksum, _ := tc.value("testing/cas/checksum"); checksum != exampleDataSHA {
+		t.Error("The checksum was not saved.")
+	}
+	if _, ok := tc.value("testing/cas/updated"); !ok {
+		t.Error("The updated key was not saved.")
+	}
+	if encoding, _ := tc.value("testing/cas/encoding"); encoding != EncodingNone {
+		t.Errorf("The encoding was not saved: %q", encoding)
+	}
+	if _, ok := tc.value("testing/cas/manifest"); ok {
+		t.Error("The old manifest should be removed.")
+	}
+	if _, ok := tc.value("testing/cas/data/0"); ok {
+		t.Error("The old chunks should be removed.")
+	}
+	if saved, err := SaveCAS(c, "cas", exampleData, exampleDataSHA, ""); saved || err != nil {
+		t.Errorf("The same checksum should not be saved again: %v", err)
+	}
+}
+
+func TestSaveCASExtra(t *testing.T) {
+	tc, c := newTestConsul(t)
+	PrefixLocation = "testing"
+	saved, err := SaveCAS(c, "cas", exampleData, exampleDataSHA, "", setOp(KeyPath("cas", "signature"), "signed"))
+	if err != nil || !saved {
+		t.Fatalf("The data should be saved: %v", err)
+	}
+	if signature, _ := tc.value("testing/cas/signature"); signature != "signed" {
+		t.Errorf("The signature should be saved with the data: %q", signature)
+	}
+	puts := tc.count("PUT")
+	if saved, err := SaveCAS(c, "cas", exampleData, exampleDataSHA, ""); saved || err != nil || tc.count("PUT") != puts {
+		t.Errorf("There shouldn't be a transaction when the checksum matches: %v", err)
+	}
+}
+
+func TestSaveCASTxnErrors(t *testing.T) {
+	tc, c := newTestConsul(t)
+	PrefixLocation = "testing"
+	var extra []*consul.TxnOp
+	for i := 0; i < consulTxnMaxOps; i++ {
+		extra = append(extra, setOp(KeyPath("cas", fmt.Sprintf("extra/%d", i)), "x"))
+	}
+	if _, err := SaveCAS(c, "cas", exampleData, exampleDataSHA, "", extra...); !errors.Is(err, ErrTxnTooLarge) {
+		t.Errorf("More than %d operations should be refused before it's sent: %v", consulTxnMaxOps, err)
+	}
+	if _, err := SaveCAS(c, "cas", strings.Repeat("a", consulTxnMaxBytes), exampleDataSHA, ""); !errors.Is(err, ErrTxnTooLarge) {
+		t.Errorf("More than %d bytes should be refused before it's sent: %v", consulTxnMaxBytes, err)
+	}
+	if tc.count("PUT") != 0 {
+		t.Errorf("A transaction that's too large shouldn't be sent: %d", tc.count("PUT"))
+	}
+
+	tc.denied = func(method, key string) bool { return key == "testing/cas/updated" }
+	_, err := SaveCAS(c, "cas", exampleData, exampleDataSHA, "")
+	if !errors.Is(err, ErrTxnFailed) || !strings.Contains(err.Error(), "testing/cas/updated") {
+		t.Errorf("A denied key should be an error naming it - not a conflict: %v", err)
+	}
+	if tc.count("PUT") != 1 {
+		t.Errorf("A transaction that was refused shouldn't be tried again: %d", tc.count("PUT"))
+	}
+}
+
+func TestSingleTxnDefaultChunkSize(t *testing.T) {
+	tc, c := newTestConsul(t)
+	PrefixLocation = "testing"
+	if ChunkSize != 500*1024 {
+		t.Fatalf("The test expects the default --chunk-size: %d", ChunkSize)
+	}
+	// The largest data singleTxn allows fits with the keys saved next to it.
+	largest := (consulTxnMaxBytes - txnReserveBytes) / 4 * 3
+	if !singleTxn(largest) || singleTxn(largest+1) {
+		t.Errorf("%d bytes should be the most that's saved in a transaction", largest)
+	}
+	data := strings.Repeat("a", largest)
+	if saved, err := saveCopy(c, "cas", data, ComputeChecksum(data), "", "file:/etc/hosts"); err != nil || !saved {
+		t.Errorf("The largest data for a transaction should be saved in one: %v %v", saved, err)
+	}
+
+	// Data that fits in a chunk but not a transaction is saved a key at a time.
+	data = strings.Repeat("b", 400*1024)
+	if saved, err := saveCopy(c, "big", data, ComputeChecksum(data), "", "file:/etc/hosts"); err != nil || !saved {
+		t.Fatalf("Data under --chunk-size should be saved: %v %v", saved, err)
+	}
+	if stored, _ := tc.value("testing/big/data"); stored != data {
+		t.Errorf("The data should be saved in the data key: %d bytes", len(stored))
+	}
+}
+
+func TestSaveCASConflict(t *testing.T) {
+	tc, c := newTestConsul(t)
+	PrefixLocation = "testing"
+	defer func(backoff time.Duration) { casBackoff = backoff }(casBackoff)
+	casBackoff = time.Millisecond
+	// Every time the data is read another writer changes it.
+	tc.server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/kv/testing/cas/data" && r.Method == "GET" {
+			tc.handle(w, r)
+			tc.put("testing/cas/data", "another writer")
+			return
+		}
+		tc.handle(w, r)
+	})
+	saved, err := SaveCAS(c, "cas", exampleData, exampleDataSHA, "")
+	if saved || err != ErrCASConflict {
+		t.Errorf("Losing every race should be a conflict: %v", err)
+	}
+	if data, _ := tc.value("testing/cas/data"); data != "another writer" {
+		t.Error("Nothing should be written on a conflict.")
+	}
+	if tc.count("PUT") != casTries {
+		t.Errorf("There should be %d transactions: %d", casTries, tc.count("PUT"))
+	}
+}
+
+func TestConnectDatacenter(t *testing.T) {
+	tc, _ := newTestConsul(t)
+	c, err := ConnectDatacenter(strings.TrimPrefix(tc.server.URL, "http://"), "", "dc2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Get(c, "testing/keyname/data")
+	Set(c, "testing/keyname/data", exampleData)
+	tc.Lock()
+	defer tc.Unlock()
+	if tc.datacenters["dc2"] != 2 || tc.datacenters[""] != 0 {
+		t.Errorf("Every request should be for dc2: %v", tc.datacenters)
+	}
+}
+
+func TestConnectNamespace(t *testing.T) {
+	defer func() { Namespace, Partition = "", "" }()
+	Namespace, Partition = "team-a", "edge"
+	tc, c := newTestConsul(t)
+	Get(c, "testing/keyname/data")
+	Set(c, "testing/keyname/data", exampleData)
+	Del(c, "testing/keyname/data")
+	tc.Lock()
+	defer tc.Unlock()
+	if tc.namespaces["team-a/edge"] != 3 {
+		t.Errorf("Every request should be for the namespace and partition: %v", tc.namespaces)
+	}
+}
+
+func TestConnectDefaultDatacenter(t *testing.T) {
+	defer func() { Datacenter = "" }()
+	Datacenter = "dc3"
+	tc, c := newTestConsul(t)
+	Get(c, "testing/keyname/data")
+	if orDatacenter("") != "dc3" || orDatacenter("dc1") != "dc1" {
+		t.Error("A blank datacenter should default to --dc.")
+	}
+	tc.Lock()
+	defer tc.Unlock()
+	if tc.datacenters["dc3"] != 1 {
+		t.Errorf("Connect should use --dc: %v", tc.datacenters)
+	}
+}
+
+func TestConsulEnv(t *testing.T) {
+	defer func() {
+		ConsulServer, Token, ConsulSSL, ConsulSSLVerify = "localhost:8500", "anonymous", false, true
+		ConsulCACert, ConsulCAPath, TLSServerName = "", "", ""
+		ConsulClientCert, ConsulClientKey = "", ""
+	}()
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.StringVarP(&ConsulServer, "server", "s", "localhost:8500", "")
+	flags.StringVarP(&Token, "token", "t", "anonymous", "")
+	flags.BoolVarP(&ConsulSSL, "ssl", "", false, "")
+	flags.BoolVarP(&ConsulSSLVerify, "ssl-verify", "", true, "")
+	flags.StringVarP(&ConsulCACert, "ssl-ca-cert", "", "", "")
+	flags.StringVarP(&ConsulCAPath, "ssl-ca-path", "", "", "")
+	flags.StringVarP(&TLSServerName, "tls-server-name", "", "", "")
+	flags.StringVarP(&ConsulClientCert, "ssl-cert", "", "", "")
+	flags.StringVarP(&ConsulClientKey, "ssl-key", "", "", "")
+	env := map[string]string{
+		"CONSUL_HTTP_ADDR":       "consul.example.com:8501",
+		"CONSUL_HTTP_TOKEN":      "abcd-efgh",
+		"CONSUL_HTTP_SSL":        "true",
+		"CONSUL_HTTP_SSL_VERIFY": "false",
+		"CONSUL_CACERT":          "/etc/consul/ca.pem",
+		"CONSUL_CAPATH":          "/etc/consul/ca.d",
+		"CONSUL_TLS_SERVER_NAME": "server.dc1.consul",
+		"CONSUL_CLIENT_CERT":     "/etc/consul/client.pem",
+		"CONSUL_CLIENT_KEY":      "/etc/consul/client-key.pem",
+	}
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	ConsulEnv(flags)
+	if ConsulServer != "consul.example.com:8501" {
+		t.Errorf("CONSUL_HTTP_ADDR was not used: '%s'", ConsulServer)
+	}
+	if Token != "abcd-efgh" {
+		t.Errorf("CONSUL_HTTP_TOKEN was not used: '%s'", Token)
+	}
+	if !ConsulSSL {
+		t.Error("CONSUL_HTTP_SSL was not used.")
+	}
+	if ConsulSSLVerify {
+		t.Error("CONSUL_HTTP_SSL_VERIFY was not used.")
+	}
+	if ConsulCACert != "/etc/consul/ca.pem" {
+		t.Errorf("CONSUL_CACERT was not used: '%s'", ConsulCACert)
+	}
+	if ConsulCAPath != "/etc/consul/ca.d" {
+		t.Errorf("CONSUL_CAPATH was not used: '%s'", ConsulCAPath)
+	}
+	if TLSServerName != "server.dc1.consul" {
+		t.Errorf("CONSUL_TLS_SERVER_NAME was not used: '%s'", TLSServerName)
+	}
+	if ConsulClientCert != "/etc/consul/client.pem" || ConsulClientKey != "/etc/consul/client-key.pem" {
+		t.Errorf("CONSUL_CLIENT_CERT and CONSUL_CLIENT_KEY were not used: '%s' '%s'", ConsulClientCert, ConsulClientKey)
+	}
+}
+
+func TestConsulEnvFlagOverrides(t *testing.T) {
+	defer func() { ConsulServer = "localhost:8500" }()
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.StringVarP(&ConsulServer, "server", "s", "localhost:8500", "")
+	flags.Parse([]string{"--server", "127.0.0.1:8500"})
+	t.Setenv("CONSUL_HTTP_ADDR", "consul.example.com:8501")
+	ConsulEnv(flags)
+	if ConsulServer != "127.0.0.1:8500" {
+		t.Errorf("The flag should win over the environment: '%s'", ConsulServer)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	tries := 0
+	err := Retry(func() error {
+		tries++
+		return errors.New("connection refused")
+	}, 1)
+	if !errors.Is(err, ErrNoMoreRetries) || tries != 1 {
+		t.Errorf("Retry should give up with ErrNoMoreRetries: %v %d", err, tries)
+	}
+	tries = 0
+	if err := Retry(func() error { tries++; return ErrTooStale }, 3); err != ErrTooStale || tries != 1 {
+		t.Errorf("A stale read shouldn't be retried: %v %d", err, tries)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	defer func(wait, max time.Duration) { RetryWait, RetryMaxWait = wait, max }(RetryWait, RetryMaxWait)
+	RetryWait, RetryMaxWait = time.Second, 5*time.Second
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+		wait := RetryBackoff(attempt + 1)
+		if wait < max/2 || wait > max {
+			t.Errorf("Attempt %d should wait between %s and %s, got %s", attempt+1, max/2, max, wait)
+		}
+	}
+
+	RetryWait = 0
+	tries := 0
+	err := Retry(func() error {
+		tries++
+		if tries < 3 {
+			return errors.New("500 Internal Server Error")
+		}
+		return nil
+	}, 3)
+	if err != nil || tries != 3 {
+		t.Errorf("Retry should keep trying until it works: %v %d", err, tries)
+	}
+}
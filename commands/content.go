@@ -0,0 +1,131 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/DataDog/kvexpress/pkg/kvexpress"
+	consul "github.com/hashicorp/consul/api"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ContentAddressed saves the data with in at <key>/data/<checksum> and points
+// the manifest at it - see SaveContent.
+var ContentAddressed bool
+
+// contentName is the key the data with checksum is saved at - a checksum
+// with an algorithm has its colon swapped so it's one path segment.
+func contentName(checksum string) string {
+	return kvexpress.ContentName(checksum)
+}
+
+// contentPath is where the data with checksum is saved for key.
+func contentPath(key, checksum string) string {
+	return kvexpress.ContentPath(kvStore{}, key, checksum)
+}
+
+// SaveContent saves data at <key>/data/<checksum> and switches the manifest to
+// it with a check-and-set - the checksum, updated and encoding keys and any
+// extra operations go in the same transaction. Producers that save the same
+// data write the same key, so it doesn't matter which of them wins. On a
+// conflict the manifest is read again and it stops if another producer already
+// switched to checksum. Once it's switched everything but this version and the
+// one it replaced is removed - a reader that's reading that one still finds
+// it. It returns false if checksum was already active.
+func SaveContent(c *consul.Client, key, data, checksum, checksums string, extra ...*consul.TxnOp) (bool, error) {
+	KeyManifest := KeyPath(key, "manifest")
+	encoded, _ := json.Marshal(ChunkManifest{Size: len(data), Checksum: checksum})
+	backoff := casBackoff
+	for i := 1; i <= casTries; i++ {
+		index, value, err := consulIndex(c, KeyManifest)
+		if err != nil {
+			return false, err
+		}
+		current, err := parseManifest(value)
+		if err != nil {
+			Log(fmt.Sprintf("action='SaveContent' key='%s' message='%v' - replacing it.", key, err), "info")
+			current = nil
+		}
+		var previous string
+		if current != nil {
+			previous = current.Checksum
+		}
+		if previous == checksum {
+			Log(fmt.Sprintf("action='SaveContent' key='%s' checksum='match' saved='false'", key), "info")
+			return false, nil
+		}
+		ops := consul.TxnOps{
+			setOp(contentPath(key, checksum), data),
+			{KV: &consul.KVTxnOp{Verb: consul.KVCAS, Key: KeyManifest, Value: encoded, Index: index}},
+			setOp(KeyPath(key, "checksum"), checksum),
+			setOp(KeyPath(key, "updated"), ReturnCurrentUTC()),
+			setOp(KeyPath(key, "encoding"), StoredEncoding()),
+			checksumsOp(key, checksums),
+			// The data that was saved before there was a manifest.
+			{KV: &consul.KVTxnOp{Verb: consul.KVDelete, Key: KeyPath(key, "data")}},
+		}
+		owner, err := ownerOps(c, key)
+		if err != nil {
+			return false, err
+		}
+		ops = append(ops, deltaDeleteOps(key)...)
+		ops = append(append(ops, owner...), extra...)
+		ok, err := kvTxn(c, ops)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			Log(fmt.Sprintf("action='SaveContent' key='%s' checksum='%s' previous='%s' saved='true' tries='%d'", key, checksum, previous, i), "debug")
+			keep := []string{contentName(checksum)}
+			if previous != "" {
+				keep = append(keep, contentName(previous))
+			}
+			// The switch already happened - old versions are only clutter.
+			if err := pruneContent(c, key, keep...); err != nil {
+				Log(fmt.Sprintf("action='SaveContent' key='%s' pruned='false' message='%v'", key, err), "info")
+			}
+			return true, nil
+		}
+		Log(fmt.Sprintf("action='SaveContent' key='%s' conflict='true' tries='%d'", key, i), "info")
+		StatsdConsul(key, "cas_conflict")
+		if i < casTries {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return false, ErrCASConflict
+}
+
+// pruneContent removes everything under <key>/data/ but the names in keep.
+func pruneContent(c *consul.Client, key string, keep ...string) error {
+	prefix := strings.TrimPrefix(KeyPath(key, "data"), "/") + "/"
+	keys, err := Keys(c, prefix)
+	if err != nil {
+		return err
+	}
+	kept := make(map[string]bool)
+	for _, name := range keep {
+		kept[name] = true
+	}
+	for _, k := range keys {
+		if kept[strings.TrimPrefix(k, prefix)] {
+			continue
+		}
+		if err := Del(c, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkNames are the names of count chunks - for pruneContent.
+func chunkNames(count int) []string {
+	names := make([]string, count)
+	for i := range names {
+		names[i] = strconv.Itoa(i)
+	}
+	return names
+}
@@ -0,0 +1,73 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"testing"
+)
+
+func TestSaveContent(t *testing.T) {
+	tc, c := newTestConsul(t)
+	PrefixLocation = "testing"
+	tc.put("testing/hosts/data", "old data")
+	saved, err := SaveContent(c, "hosts", exampleData, exampleDataSHA, "")
+	if err != nil || !saved {
+		t.Fatalf("The data should be saved: %t %v", saved, err)
+	}
+	if value, _ := tc.value("testing/hosts/data/" + exampleDataSHA); value != exampleData {
+		t.Errorf("The data should be saved at its checksum: '%s'", value)
+	}
+	if _, ok := tc.value("testing/hosts/data"); ok {
+		t.Error("The data saved before the manifest should be removed.")
+	}
+	data, checksum, err := GetDataSnapshot(c, "hosts")
+	if err != nil || data != exampleData || checksum != exampleDataSHA {
+		t.Errorf("The manifest should point at the data: '%s' '%s' %v", data, checksum, err)
+	}
+
+	// Another producer with the same data doesn't change anything.
+	if saved, err := SaveContent(c, "hosts", exampleData, exampleDataSHA, ""); err != nil || saved {
+		t.Errorf("The same data shouldn't be saved again: %t %v", saved, err)
+	}
+
+	// Only the active version and the one it replaced are kept.
+	for _, data := range []string{"second\n", "third\n"} {
+		if _, err := SaveContent(c, "hosts", data, ComputeChecksum(data), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := tc.value("testing/hosts/data/" + exampleDataSHA); ok {
+		t.Error("The oldest version should be removed.")
+	}
+	if _, ok := tc.value("testing/hosts/data/" + ComputeChecksum("second\n")); !ok {
+		t.Error("The version that was replaced should be kept for readers that are still reading it.")
+	}
+	if checksum, _ := tc.value("testing/hosts/checksum"); checksum != ComputeChecksum("third\n") {
+		t.Errorf("The checksum should be switched with the manifest: '%s'", checksum)
+	}
+
+	// Saving it the old way removes the manifest and the versions.
+	SetData(c, "hosts", exampleData)
+	if _, ok := tc.value("testing/hosts/manifest"); ok {
+		t.Error("The manifest should be removed.")
+	}
+	if _, ok := tc.value("testing/hosts/data/" + ComputeChecksum("third\n")); ok {
+		t.Error("The versions should be removed.")
+	}
+	if data, checksum, _ := GetDataSnapshot(c, "hosts"); data != exampleData || checksum != "" {
+		t.Errorf("The data should be read from the data key: '%s' '%s'", data, checksum)
+	}
+}
+
+func TestGetContentMissing(t *testing.T) {
+	tc, c := newTestConsul(t)
+	PrefixLocation = "testing"
+	tc.put("testing/hosts/manifest", `{"count":0,"size":5,"checksums":null,"checksum":"sha512:abcd"}`)
+	if _, _, err := GetDataSnapshot(c, "hosts"); err == nil {
+		t.Error("A manifest pointing at data that isn't there should be an error.")
+	}
+	tc.put("testing/hosts/data/sha512-abcd", "data\n")
+	if data, checksum, err := GetDataSnapshot(c, "hosts"); err != nil || data != "data\n" || checksum != "sha512:abcd" {
+		t.Errorf("A checksum with an algorithm should be one path segment: '%s' '%s' %v", data, checksum, err)
+	}
+}
@@ -0,0 +1,199 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ErrRunStopped is returned by a request that was cancelled because the run
+// was stopped - by SIGTERM, SIGINT or --deadline.
+var ErrRunStopped = errors.New("the run was stopped")
+
+// stopGrace is how long a stopped run has to finish what it's doing before
+// it's stopped anyway.
+const stopGrace = 5 * time.Second
+
+var (
+	// runCtx is cancelled when the run is stopped - every Consul request, URL
+	// fetch and command that runs is made with it so they give up right away.
+	runCtx, cancelRun = context.WithCancel(context.Background())
+
+	// stopSignal is the signal that stopped the run - blank for --deadline.
+	stopSignal string
+
+	// stopSignals is so the signals are only handled once.
+	stopSignals sync.Once
+
+	// stopHolds is the work a stopped run has to finish before it exits -
+	// like a debounced exec other runs left to this one.
+	stopHolds sync.WaitGroup
+
+	// stopExit is so a stopped run only runs its hooks and exits once - the
+	// run and the stopGrace timer can both get there.
+	stopExit sync.Once
+
+	// deadlineHit is set when --deadline stopped the run - so it exits
+	// ExitTimeout however it gets there.
+	deadlineHit int32
+)
+
+// RunContext is the context the run's requests and commands are made with.
+func RunContext() context.Context {
+	return runCtx
+}
+
+// StopRun cancels everything that's in flight.
+func StopRun(reason string) {
+	Log(fmt.Sprintf("stop='%s' command='%s' cancel='true'", reason, Direction), "info")
+	cancelRun()
+}
+
+// runStopped wraps err in ErrRunStopped if the run was stopped - the request
+// failed because it was cancelled, not because of what it was doing.
+func runStopped(err error) error {
+	if err == nil || runCtx.Err() == nil || errors.Is(err, ErrRunStopped) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrRunStopped, err)
+}
+
+// HandleStopSignals stops the run on SIGTERM and SIGINT. The requests that
+// are in flight are cancelled so a file is never replaced with half of the
+// data - if the run hasn't finished after stopGrace it exits ExitStopped.
+func HandleStopSignals() {
+	stopSignals.Do(handleStopSignals)
+}
+
+func handleStopSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		stopSignal = sig.String()
+		StopRun(stopSignal)
+		afterStopGrace(func() {
+			exitRunStopped(Direction, fmt.Sprintf("Stopped by %s.", stopSignal))
+		})
+	}()
+}
+
+// holdStop keeps a stopped run from exiting until the func it returns is
+// called - for up to stopGrace after the run's own stopGrace.
+func holdStop() func() {
+	stopHolds.Add(1)
+	return stopHolds.Done
+}
+
+// afterStopGrace calls exit once the run has had stopGrace to finish what it
+// was doing - and the work that's held has had another stopGrace.
+func afterStopGrace(exit func()) {
+	time.AfterFunc(stopGrace, func() {
+		held := make(chan struct{})
+		go func() {
+			stopHolds.Wait()
+			close(held)
+		}()
+		select {
+		case <-held:
+		case <-time.After(stopGrace):
+		}
+		exit()
+	})
+}
+
+// exitRunStopped stops a run that was cancelled with ExitStopped - or
+// ExitTimeout when it was --deadline.
+func exitRunStopped(id, message string) {
+	if atomic.LoadInt32(&deadlineHit) == 1 {
+		exitTimeout(id, "deadline", message)
+	}
+	stopExit.Do(func() {
+		Log(fmt.Sprintf("id='%s' message='%s' - stopping.", id, message), "error")
+		fmt.Println(message)
+		runStopHooks(Hook{Event: HookError, Key: id, Message: message})
+		exitRun(ExitStopped, processStart, id, "run_stopped", message)
+	})
+}
+
+// sleepRun sleeps for d - it's false if the run was stopped first.
+func sleepRun(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-runCtx.Done():
+		return false
+	}
+}
+
+// withRunContext is ctx - cancelled when the run is stopped as well. The
+// goroutine is gone once cancel is called.
+func withRunContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-runCtx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// cancelTransport cancels a request when the run is stopped.
+type cancelTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip sends req with the run's context - it's kept until the body is closed.
+func (t *cancelTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := withRunContext(req.Context())
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, runStopped(err)
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody is the body of a request that's stopped with the run.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = runStopped(err)
+	}
+	return n, err
+}
+
+func (b *cancelBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// cancelClient makes client's requests stop with the run.
+func cancelClient(client *http.Client) *http.Client {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.Transport = &cancelTransport{base: base}
+	return client
+}
@@ -0,0 +1,80 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// stoppableRun gives the test its own run context and puts the real one back.
+func stoppableRun(t *testing.T) {
+	ctx, cancel := runCtx, cancelRun
+	runCtx, cancelRun = context.WithCancel(context.Background())
+	t.Cleanup(func() { runCtx, cancelRun = ctx, cancel })
+}
+
+func TestCancelTransport(t *testing.T) {
+	stoppableRun(t)
+	started := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	client := cancelClient(&http.Client{})
+
+	result := make(chan error)
+	go func() {
+		_, err := client.Get(server.URL + "/v1/kv/testing/hosts/data?index=10&wait=10m")
+		result <- err
+	}()
+	<-started
+	StopRun("testing")
+	select {
+	case err := <-result:
+		if !errors.Is(err, ErrRunStopped) {
+			t.Errorf("A stopped run should cancel the request: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The request should be cancelled as soon as the run is stopped.")
+	}
+
+	// Nothing is retried once the run is stopped.
+	tries := 0
+	err := Retry(func() error {
+		tries++
+		return errors.New("connection refused")
+	}, 5)
+	if !errors.Is(err, ErrRunStopped) || tries != 1 {
+		t.Errorf("A stopped run shouldn't be retried: %d %v", tries, err)
+	}
+}
+
+func TestWriteFileStopped(t *testing.T) {
+	stoppableRun(t)
+	dir, err := ioutil.TempDir("", "kvexpress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "hosts")
+	ioutil.WriteFile(file, []byte("old\n"), 0644)
+	StopRun("testing")
+	if err := WriteFile("new\n", file, 0644, ""); !errors.Is(err, ErrRunStopped) {
+		t.Errorf("A stopped run shouldn't replace the file: %v", err)
+	}
+	if data, _ := ioutil.ReadFile(file); string(data) != "old\n" {
+		t.Errorf("The file should be left the way it was: '%s'", data)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("The temp file should be removed: %d files", len(files))
+	}
+}
@@ -1,12 +1,16 @@
-// +build linux darwin freebsd
+// +build linux darwin freebsd windows
 
 package commands
 
 import (
+	"errors"
 	"fmt"
+	consul "github.com/hashicorp/consul/api"
 	"github.com/spf13/cobra"
 	"github.com/zorkian/go-datadog-api"
 	"os"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -23,73 +27,155 @@ var copyCmd = &cobra.Command{
 
 func copyRun(cmd *cobra.Command, args []string) {
 	start := time.Now()
+	if Recurse {
+		copyRecurseRun(start)
+		return
+	}
 	var dog = new(datadog.Client)
 
 	// Set the source key locations.
-	KeyData := KeyPath(KeyFrom, "data")
 	KeyChecksum := KeyPath(KeyFrom, "checksum")
 
-	c, err := Connect(ConsulServer, Token)
+	// The keys can be in different datacenters or clusters - they default to
+	// --dc, --server and --token.
+	c, err := ConnectDatacenter(orServer(SrcServer), orToken(SrcToken), orDatacenter(DatacenterFrom))
 	if err != nil {
 		LogFatal("Could not connect to Consul.", KeyFrom, "consul_connect")
 	}
+	cTo, err := ConnectDatacenter(orServer(DestServer), orToken(DestToken), orDatacenter(DatacenterTo))
+	if err != nil {
+		LogFatal("Could not connect to Consul.", KeyTo, "consul_connect")
+	}
 
 	if DatadogAPIKey != "" && DatadogAPPKey != "" {
 		dog = DDAPIConnect(DatadogAPIKey, DatadogAPPKey)
 	}
 
 	// Get the KV data out of Consul.
-	KVData := Get(c, KeyData)
+	KVData, err := GetData(c, KeyFrom)
+	if errors.Is(err, ErrNoMoreRetries) {
+		ExitOnError(err, KeyFrom, "consul_get")
+	}
+	if err != nil {
+		Log(fmt.Sprintf("copy='false' keyFrom='%s' message='%v'", KeyFrom, err), "info")
+		StatsdChecksum(KeyFrom)
+		exitRun(ExitChecksumMismatch, start, KeyFrom, "consul_get", err.Error())
+	}
 
 	// Decompress here if necessary.
-	if Compress {
-		KVData = DecompressData(KVData)
-	}
+	KVData, encoding, err := DecodeKeyData(c, KeyFrom, KVData)
+	ExitOnError(err, KeyFrom, "DecodeData")
+	// Binary data stays binary in the new key.
+	Binary = Binary || BinaryEncoding(encoding)
 
 	// Get the Checksum data out of Consul.
-	Checksum := Get(c, KeyChecksum)
+	Checksum, err := Get(c, KeyChecksum)
+	ExitOnError(err, KeyChecksum, "consul_get")
+	Checksums, err := Get(c, KeyPath(KeyFrom, "checksums"))
+	ExitOnError(err, KeyPath(KeyFrom, "checksums"), "consul_get")
 
 	// Is the data long enough?
-	longEnough := LengthCheck(KVData, MinFileLength)
+	minLength, _ := lineLimits(false)
+	longEnough := LengthCheck(KVData, minLength)
 	Log(fmt.Sprintf("longEnough='%t'", longEnough), "debug")
 
 	// Does the checksum match?
 	checksumMatch := ChecksumCompare(KVData, Checksum)
 	Log(fmt.Sprintf("checksumMatch='%t'", checksumMatch), "debug")
+	RecordResult(len(KVData), strings.TrimSpace(Checksum))
 
 	// If the data is long enough and the checksum matches, save to the new key location.
 	if longEnough && checksumMatch {
 		Log(fmt.Sprintf("copy='true' keyFrom='%s' keyTo='%s'", KeyFrom, KeyTo), "info")
-		if Compress {
-			KVData = CompressData(KVData)
-		}
+		decoded := KVData
+		KVData, err = EncodeData(KeyTo, KVData)
+		ExitOnError(err, KeyTo, "EncodeData")
 		// New destination key Locations
-		KeyData = KeyPath(KeyTo, "data")
-		KeyChecksum = KeyPath(KeyTo, "checksum")
-		// Save it.
-		saved := Set(c, KeyData, KVData)
-		if saved {
-			KVDataBytes := len(KVData)
-			Log(fmt.Sprintf("consul KeyData='%s' saved='true' size='%d'", KeyData, KVDataBytes), "info")
-			Set(c, KeyChecksum, Checksum)
-			if DatadogAPIKey != "" && DatadogAPPKey != "" {
-				DDCopyDataEvent(dog, KeyFrom, KeyTo)
+		KeyData := KeyPath(KeyTo, "data")
+		// The checksum is computed again so the destination's matches the
+		// algorithms in --hash - even if the source was saved with others.
+		Checksum, Checksums = StoreChecksum(decoded), StoreChecksums(decoded)
+		RecordResult(len(decoded), Checksum)
+		if DryRunSkip(fmt.Sprintf("save '%s' size='%d' checksum='%s'", KeyData, len(KVData), Checksum)) {
+			exitRun(0, start, KeyTo, "dry_run", "")
+		}
+		// Save it - keeping what was there in case it doesn't read back.
+		snapshot, err := SnapshotKey(cTo, KeyTo)
+		ExitOnError(err, KeyTo, "consul_get")
+		saved, err := saveCopy(cTo, KeyTo, KVData, Checksum, Checksums, "copy:"+KeyFrom)
+		ExitOnError(err, KeyData, "consul_set")
+		if !saved {
+			Log(fmt.Sprintf("copy keyTo='%s' checksum='match' saved='false'", KeyTo), "info")
+			exitRun(ExitNoChange, start, KeyTo, "consul_checksums_match", "")
+		}
+		KVDataBytes := len(KVData)
+		Log(fmt.Sprintf("consul KeyData='%s' saved='true' size='%d'", KeyData, KVDataBytes), "info")
+		// Read it back to make sure the destination has what was copied.
+		if err := VerifyCopy(cTo, KeyTo, decoded); err != nil {
+			Log(fmt.Sprintf("copy='false' keyTo='%s' verified='false' message='%v'", KeyTo, err), "info")
+			restoreCopy(cTo, KeyTo, snapshot)
+			if errors.Is(err, ErrNoMoreRetries) {
+				ExitOnError(err, KeyTo, "consul_get")
 			}
-			StatsdIn(KeyTo, KVDataBytes, KVData)
-		} else {
-			Log(fmt.Sprintf("consul KeyData='%s' saved='false'", KeyData), "info")
-			RunTime(start, KeyTo, "consul_checksums_match")
-			os.Exit(0)
+			exitRun(ExitChecksumMismatch, start, KeyTo, "verify_failed", "")
+		}
+		Log(fmt.Sprintf("copy='true' keyTo='%s' verified='true'", KeyTo), "debug")
+		if DatadogAPIKey != "" && DatadogAPPKey != "" {
+			DDCopyDataEvent(dog, KeyFrom, KeyTo)
 		}
+		StatsdIn(KeyTo, KVDataBytes, KVData)
 	} else {
 		Log(fmt.Sprintf("longEnough='%t' checksumMatch='%t'", longEnough, checksumMatch), "info")
-		os.Exit(0)
+		if !checksumMatch {
+			exitRun(ExitChecksumMismatch, start, KeyTo, "checksum_mismatch", "")
+		}
+		exitRun(ExitRejected, start, KeyTo, "too_short", "")
 	}
 
 	// Run this command after the file is written.
 	if PostExec != "" {
 		Log(fmt.Sprintf("exec='%s'", PostExec), "debug")
-		RunCommand(PostExec)
+		if status := RunPostExec(PostExec); status != 0 {
+			exitExecFailed(status, KeyTo)
+		}
+	}
+	if status := RunHooks(Hook{Event: HookChange, Key: KeyTo}); status != 0 {
+		exitExecFailed(status, KeyTo)
+	}
+	RunTime(start, KeyTo, "complete")
+}
+
+// copyRecurseRun copies every key underneath KeyFrom to KeyTo.
+func copyRecurseRun(start time.Time) {
+	c, err := ConnectDatacenter(orServer(SrcServer), orToken(SrcToken), orDatacenter(DatacenterFrom))
+	if err != nil {
+		LogFatal("Could not connect to Consul.", KeyFrom, "consul_connect")
+	}
+	cTo, err := ConnectDatacenter(orServer(DestServer), orToken(DestToken), orDatacenter(DatacenterTo))
+	if err != nil {
+		LogFatal("Could not connect to Consul.", KeyTo, "consul_connect")
+	}
+
+	summary, err := CopyTree(c, cTo, KeyFrom, KeyTo, CopyConcurrency)
+	ExitOnError(err, KeyFrom, "consul_keys")
+	Log(fmt.Sprintf("copy keyFrom='%s' keyTo='%s' copied='%d' unchanged='%d' skipped='%d' failed='%d'", KeyFrom, KeyTo, summary.Copied, summary.Unchanged, summary.Skipped, summary.Failed), "info")
+	fmt.Printf("copied: %d unchanged: %d skipped: %d failed: %d\n", summary.Copied, summary.Unchanged, summary.Skipped, summary.Failed)
+	StatsdCopyTree(KeyTo, summary)
+	RecordDetails(summary)
+	if summary.Failed > 0 {
+		exitRun(ExitError, start, KeyTo, "copy_failed", "")
+	}
+	if summary.Copied == 0 {
+		exitRun(ExitNoChange, start, KeyTo, "consul_checksums_match", "")
+	}
+	if PostExec != "" {
+		Log(fmt.Sprintf("exec='%s'", PostExec), "debug")
+		if status := RunPostExec(PostExec); status != 0 {
+			exitExecFailed(status, KeyTo)
+		}
+	}
+	if status := RunHooks(Hook{Event: HookChange, Key: KeyTo}); status != 0 {
+		exitExecFailed(status, KeyTo)
 	}
 	RunTime(start, KeyTo, "complete")
 }
@@ -104,6 +190,23 @@ func checkCopyFlags() {
 		fmt.Println("Need a key destination in --keyto")
 		os.Exit(1)
 	}
+	if KeyFrom == KeyTo && orDatacenter(DatacenterFrom) == orDatacenter(DatacenterTo) && orServer(SrcServer) == orServer(DestServer) {
+		fmt.Println("Need a different --keyto, --dcto or --dest-server")
+		os.Exit(1)
+	}
+	var err error
+	if SrcToken, err = copyToken(SrcToken, SrcTokenFile, "KVEXPRESS_SRC_TOKEN"); err != nil {
+		fmt.Printf("Could not read --src-token-file: %v\n", err)
+		os.Exit(1)
+	}
+	if DestToken, err = copyToken(DestToken, DestTokenFile, "KVEXPRESS_DEST_TOKEN"); err != nil {
+		fmt.Printf("Could not read --dest-token-file: %v\n", err)
+		os.Exit(1)
+	}
+	if Recurse && CopyConcurrency < 1 {
+		fmt.Println("Need at least 1 worker in --concurrency")
+		os.Exit(1)
+	}
 	Log("Required cli flags present.", "debug")
 }
 
@@ -119,10 +222,185 @@ var (
 	//  /PrefixLocation/KeyTo/data
 	//  /PrefixLocation/KeyTo/checksum
 	KeyTo string
+
+	// DatacenterFrom is the Consul datacenter to pull data from.
+	DatacenterFrom string
+
+	// DatacenterTo is the Consul datacenter to write the data to.
+	DatacenterTo string
+
+	// SrcServer is the Consul server to pull data from - for a copy between clusters.
+	SrcServer string
+
+	// SrcToken is the token for SrcServer.
+	SrcToken string
+
+	// DestServer is the Consul server to write the data to.
+	DestServer string
+
+	// DestToken is the token for DestServer.
+	DestToken string
+
+	// SrcTokenFile holds the SrcToken - so it isn't in `ps` or the cron logs.
+	SrcTokenFile string
+
+	// DestTokenFile holds the DestToken.
+	DestTokenFile string
 )
 
+// copyParts are the parts of a key a copy saves or removes - SnapshotKey
+// keeps them so a copy that doesn't read back can be put back.
+var copyParts = []string{"data", "checksum", "checksums", "updated", "encoding", "meta", "manifest", "base", "delta", "rolling", "signature"}
+
+// KeySnapshot is the value of every part of a key that was there - and its
+// chunks - by the full path.
+type KeySnapshot map[string]string
+
+// SnapshotKey reads the copyParts and the chunks of key before they're saved.
+func SnapshotKey(c *consul.Client, key string) (KeySnapshot, error) {
+	chunks, err := List(c, KeyPath(key, "data")+"/")
+	if err != nil {
+		return nil, err
+	}
+	snapshot := KeySnapshot(chunks)
+	for _, part := range copyParts {
+		value, err := Get(c, KeyPath(key, part))
+		if err != nil {
+			return nil, err
+		}
+		if value != "" {
+			snapshot[KeyPath(key, part)] = value
+		}
+	}
+	return snapshot, nil
+}
+
+// RestoreKey puts key back the way it was in snapshot in a single
+// transaction - the parts that weren't there are removed.
+func RestoreKey(c *consul.Client, key string, snapshot KeySnapshot) error {
+	ops := consul.TxnOps{{KV: &consul.KVTxnOp{Verb: consul.KVDeleteTree, Key: KeyPath(key, "data") + "/"}}}
+	for _, part := range copyParts {
+		if _, ok := snapshot[KeyPath(key, part)]; !ok {
+			ops = append(ops, &consul.TxnOp{KV: &consul.KVTxnOp{Verb: consul.KVDelete, Key: KeyPath(key, part)}})
+		}
+	}
+	paths := make([]string, 0, len(snapshot))
+	for path := range snapshot {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		ops = append(ops, setOp(path, snapshot[path]))
+	}
+	ok, err := kvTxn(c, ops)
+	if err == nil && !ok {
+		err = ErrTxnFailed
+	}
+	return err
+}
+
+// restoreCopy puts key back after a copy that didn't read back the same.
+func restoreCopy(c *consul.Client, key string, snapshot KeySnapshot) {
+	if DryRun {
+		return
+	}
+	if err := RestoreKey(c, key, snapshot); err != nil {
+		Log(fmt.Sprintf("copy keyTo='%s' restored='false' message='%v'", key, err), "info")
+		return
+	}
+	Log(fmt.Sprintf("copy keyTo='%s' restored='true'", key), "info")
+}
+
+// saveCopy saves the data copied to key with its checksum, updated, encoding
+// and meta keys - in one transaction when the backend can. It's false when
+// key already has the checksum.
+func saveCopy(c *consul.Client, key, data, checksum, checksums, source string) (bool, error) {
+	if singleTxn(len(data)) {
+		return SaveCAS(c, key, data, checksum, checksums, metaOp(key, source))
+	}
+	if err := SetData(c, key, data); err != nil {
+		return false, err
+	}
+	if err := Set(c, KeyPath(key, "checksum"), checksum); err != nil {
+		return false, err
+	}
+	if err := SetChecksums(c, key, checksums); err != nil {
+		return false, err
+	}
+	if err := Set(c, KeyPath(key, "updated"), ReturnCurrentUTC()); err != nil {
+		return false, err
+	}
+	if err := SetEncoding(c, key); err != nil {
+		return false, err
+	}
+	saveMeta(c, key, source)
+	return true, nil
+}
+
+// copyToken is the token for one side of a copy - from file if there is one,
+// then token, then the env variable. The variable is taken out of the
+// environment so --exec and the hooks don't get it.
+func copyToken(token, file, env string) (string, error) {
+	value := os.Getenv(env)
+	os.Unsetenv(env)
+	switch {
+	case file != "":
+		return ReadTokenFile(file)
+	case token != "":
+		return token, nil
+	}
+	return value, nil
+}
+
+// VerifyCopy reads key back and checks that it's long enough, matches its
+// checksum and is the same as data.
+func VerifyCopy(c *consul.Client, key, data string) error {
+	copied, err := GetVerifiedData(c, key)
+	if err != nil {
+		return err
+	}
+	if ComputeChecksum(copied) != ComputeChecksum(data) {
+		return fmt.Errorf("the data in '%s' is not what was copied", key)
+	}
+	return nil
+}
+
+// orServer returns server - or --server if it's blank.
+func orServer(server string) string {
+	if server == "" {
+		return ConsulServer
+	}
+	return server
+}
+
+// orToken returns token - or --token if it's blank.
+func orToken(token string) string {
+	if token == "" {
+		return Token
+	}
+	return token
+}
+
+// orDatacenter returns dc - or --dc if it's blank.
+func orDatacenter(dc string) string {
+	if dc == "" {
+		return Datacenter
+	}
+	return dc
+}
+
 func init() {
 	RootCmd.AddCommand(copyCmd)
 	copyCmd.Flags().StringVarP(&KeyFrom, "keyfrom", "", "", "key to pull data from")
 	copyCmd.Flags().StringVarP(&KeyTo, "keyto", "", "", "key to write the data to")
+	copyCmd.Flags().StringVarP(&DatacenterFrom, "dcfrom", "", "", "datacenter to pull data from (default --dc)")
+	copyCmd.Flags().StringVarP(&DatacenterTo, "dcto", "", "", "datacenter to write the data to (default --dc)")
+	copyCmd.Flags().BoolVarP(&Recurse, "recurse", "", false, "copy every key underneath --keyfrom to --keyto")
+	copyCmd.Flags().IntVarP(&CopyConcurrency, "concurrency", "", 4, "number of keys to copy at once with --recurse")
+	copyCmd.Flags().StringVarP(&SrcServer, "src-server", "", "", "Consul server to pull data from (default --server)")
+	copyCmd.Flags().StringVarP(&SrcToken, "src-token", "", "", "token for --src-server - or KVEXPRESS_SRC_TOKEN (default --token)")
+	copyCmd.Flags().StringVarP(&SrcTokenFile, "src-token-file", "", "", "file with the token for --src-server")
+	copyCmd.Flags().StringVarP(&DestServer, "dest-server", "", "", "Consul server to write the data to (default --server)")
+	copyCmd.Flags().StringVarP(&DestToken, "dest-token", "", "", "token for --dest-server - or KVEXPRESS_DEST_TOKEN (default --token)")
+	copyCmd.Flags().StringVarP(&DestTokenFile, "dest-token-file", "", "", "file with the token for --dest-server")
 }
@@ -0,0 +1,135 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyCopy(t *testing.T) {
+	ensureTestFile(t)
+	MinFileLength = 1
+	tc, c := newTestConsul(t)
+	tc.put("testing/hosts/data", exampleData)
+	tc.put("testing/hosts/checksum", exampleDataSHA)
+	if err := VerifyCopy(c, "hosts", exampleData); err != nil {
+		t.Errorf("The copy should be verified: %v", err)
+	}
+	if err := VerifyCopy(c, "hosts", "other"); err == nil {
+		t.Error("Different data should not be verified.")
+	}
+	tc.put("testing/hosts/checksum", "bad")
+	if err := VerifyCopy(c, "hosts", exampleData); err == nil {
+		t.Error("A bad checksum should not be verified.")
+	}
+}
+
+func TestOrServer(t *testing.T) {
+	defer func(server, token string) { ConsulServer, Token = server, token }(ConsulServer, Token)
+	ConsulServer, Token = "localhost:8500", "local"
+	if orServer("") != "localhost:8500" || orServer("dr:8500") != "dr:8500" {
+		t.Error("The server should default to --server.")
+	}
+	if orToken("") != "local" || orToken("dr") != "dr" {
+		t.Error("The token should default to --token.")
+	}
+}
+
+func TestCopyTree(t *testing.T) {
+	ensureTestFile(t)
+	tc, c := newTestConsul(t)
+	tc.put("testing/conf.d/a.conf/data", exampleData)
+	tc.put("testing/conf.d/a.conf/checksum", exampleDataSHA)
+	tc.put("testing/conf.d/nested/b.conf/data", exampleData)
+	tc.put("testing/conf.d/nested/b.conf/checksum", exampleDataSHA)
+	tc.put("testing/conf.d/bad.conf/data", exampleData)
+	tc.put("testing/conf.d/bad.conf/checksum", "not-the-checksum")
+
+	summary, err := CopyTree(c, c, "conf.d", "backup", 3)
+	if err != nil || summary != (CopySummary{Copied: 2, Skipped: 1}) {
+		t.Fatalf("Both good keys should be copied: %+v %v", summary, err)
+	}
+	if data, _ := tc.value("testing/backup/nested/b.conf/data"); data != exampleData {
+		t.Errorf("A nested key should be copied to the same name: %q", data)
+	}
+	if checksum, _ := tc.value("testing/backup/a.conf/checksum"); checksum != exampleDataSHA {
+		t.Errorf("The checksum should be saved with the copy: %q", checksum)
+	}
+	if _, ok := tc.value("testing/backup/bad.conf/data"); ok {
+		t.Error("A key that doesn't match its checksum should not be copied.")
+	}
+	if summary, _ := CopyTree(c, c, "conf.d", "backup", 1); summary != (CopySummary{Unchanged: 2, Skipped: 1}) {
+		t.Errorf("Nothing changed the second time: %+v", summary)
+	}
+}
+
+func TestCopyTreeBinary(t *testing.T) {
+	ensureTestFile(t)
+	tc, c := newTestConsul(t)
+	binary := "\x00\x01\x02binary"
+	tc.put("testing/certs/a.der/data", base64.StdEncoding.EncodeToString([]byte(binary)))
+	tc.put("testing/certs/a.der/checksum", ComputeChecksum(binary))
+	tc.put("testing/certs/a.der/encoding", EncodingBase64)
+
+	if summary, err := CopyTree(c, c, "certs", "backup", 1); err != nil || summary.Copied != 1 {
+		t.Fatalf("The binary key should be copied: %+v %v", summary, err)
+	}
+	if encoding, _ := tc.value("testing/backup/a.der/encoding"); encoding != EncodingBase64 {
+		t.Errorf("The copy should stay base64 without --binary: %q", encoding)
+	}
+	if data, err := GetVerifiedData(c, "backup/a.der"); err != nil || data != binary {
+		t.Errorf("The copy should decode to the same bytes: %q %v", data, err)
+	}
+}
+
+func TestRestoreKey(t *testing.T) {
+	tc, c := newTestConsul(t)
+	tc.put("testing/hosts/data", exampleData)
+	tc.put("testing/hosts/checksum", exampleDataSHA)
+	snapshot, err := SnapshotKey(c, "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.put("testing/hosts/data", "bad")
+	tc.put("testing/hosts/checksum", ComputeChecksum("bad"))
+	tc.put("testing/hosts/encoding", EncodingGzip)
+	tc.put("testing/hosts/data/0", "chunk")
+
+	if err := RestoreKey(c, "hosts", snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := tc.value("testing/hosts/data"); data != exampleData {
+		t.Errorf("The data should be put back: %q", data)
+	}
+	if checksum, _ := tc.value("testing/hosts/checksum"); checksum != exampleDataSHA {
+		t.Errorf("The checksum should be put back: %q", checksum)
+	}
+	if _, ok := tc.value("testing/hosts/encoding"); ok {
+		t.Error("A part that wasn't there should be removed.")
+	}
+	if _, ok := tc.value("testing/hosts/data/0"); ok {
+		t.Error("Chunks that weren't there should be removed.")
+	}
+}
+
+func TestCopyToken(t *testing.T) {
+	file := filepath.Join(TmpDir, "dest.token")
+	if err := ioutil.WriteFile(file, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file)
+	os.Setenv("KVEXPRESS_DEST_TOKEN", "from-env")
+	if token, _ := copyToken("", "", "KVEXPRESS_DEST_TOKEN"); token != "from-env" {
+		t.Errorf("The token should come from the environment: %q", token)
+	}
+	if _, ok := os.LookupEnv("KVEXPRESS_DEST_TOKEN"); ok {
+		t.Error("The token should be taken out of the environment.")
+	}
+	if token, _ := copyToken("from-flag", file, "KVEXPRESS_DEST_TOKEN"); token != "from-file" {
+		t.Errorf("The token file should win: %q", token)
+	}
+}
@@ -0,0 +1,99 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"strings"
+	"sync"
+)
+
+// CopyConcurrency is how many keys copy --recurse copies at once.
+var CopyConcurrency int
+
+// CopySummary counts what CopyTree did with each key.
+type CopySummary struct {
+	Copied    int `json:"copied"`
+	Unchanged int `json:"unchanged"`
+	Skipped   int `json:"skipped"`
+	Failed    int `json:"failed"`
+}
+
+// CopyTree copies every kvexpress key underneath from in c to the key with the
+// same relative name underneath to in cTo - workers keys at a time. Keys that
+// aren't long enough or don't match their checksum are skipped. Keys that
+// can't be saved or don't read back the same are failed, and the rest of the
+// keys are still copied.
+func CopyTree(c, cTo *consul.Client, from, to string, workers int) (CopySummary, error) {
+	var summary CopySummary
+	names, err := TreeKeys(c, from)
+	if err != nil {
+		return summary, err
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	queue := make(chan string)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range queue {
+				keyFrom := strings.TrimSuffix(from, "/") + "/" + name
+				keyTo := strings.TrimSuffix(to, "/") + "/" + name
+				copied, skipped, err := copyTreeKey(c, cTo, keyFrom, keyTo)
+				mutex.Lock()
+				switch {
+				case skipped:
+					Log(fmt.Sprintf("copy keyFrom='%s' message='%v' - skipping.", keyFrom, err), "info")
+					summary.Skipped++
+				case err != nil:
+					Log(fmt.Sprintf("copy keyFrom='%s' keyTo='%s' failed='true' message='%v'", keyFrom, keyTo, err), "info")
+					summary.Failed++
+				case copied:
+					summary.Copied++
+				default:
+					summary.Unchanged++
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, name := range names {
+		queue <- name
+	}
+	close(queue)
+	wg.Wait()
+	return summary, nil
+}
+
+// copyTreeKey copies a single key if the destination's checksum is different.
+// skipped is true when the source's data didn't pass the checks. Binary data
+// stays binary, and a copy that doesn't read back the same is put back.
+func copyTreeKey(c, cTo *consul.Client, from, to string) (copied bool, skipped bool, err error) {
+	data, err := GetVerifiedData(c, from)
+	if err != nil {
+		return false, !errors.Is(err, ErrNoMoreRetries), err
+	}
+	encoding, err := Get(c, KeyPath(from, "encoding"))
+	if err != nil {
+		return false, false, err
+	}
+	snapshot, err := SnapshotKey(cTo, to)
+	if err != nil {
+		return false, false, err
+	}
+	saved, err := pushKey(cTo, to, data, "copy:"+from, Binary || BinaryEncoding(encoding))
+	if err != nil || !saved || DryRun {
+		return saved, false, err
+	}
+	if err := VerifyCopy(cTo, to, data); err != nil {
+		restoreCopy(cTo, to, snapshot)
+		return true, false, err
+	}
+	return true, false, nil
+}
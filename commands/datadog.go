@@ -1,4 +1,4 @@
-// +build linux darwin freebsd
+// +build linux darwin freebsd windows
 
 package commands
 
@@ -6,203 +6,613 @@ import (
 	"fmt"
 	"github.com/PagerDuty/godspeed"
 	"github.com/zorkian/go-datadog-api"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-// StatsdSetup sets up the connection to dogstatsd.
+var (
+	// knownMetrics are all of the metrics kvexpress sends - without the `kvexpress.` namespace.
+	knownMetrics = []string{"in", "bytes", "lines", "out", "locked", "not_long_enough", "checksum_mismatch",
+		"lock", "unlock", "raw", "exec_not_found", "consul_reconnect", "time", "panic", "consul_error", "stale", "validate_failed", "signature_invalid", "exec_failed", "lock_expired", "change_too_large", "verify", "sync", "temp_leftover", "copy", "serving_stale", "too_large", "owner_not_found", "consul_failover", "not_leader", "file_drift", "filesystem_error", "timeout", "age", "too_old", "since_render", "file_bytes", "delta_bytes", "delta_compact", "run_in_progress", "self_update", "version_mismatch", "deferred", "consul_bytes_read", "consul_bytes_written", "exec_debounced", "webhook_failed", "apply_entry"}
+)
+
+// StatsdSetup sets up the connection to dogstatsd with --statsd-namespace and
+// --statsd-tags. If it can't be set up no more metrics are sent to dogstatsd.
 func StatsdSetup() *godspeed.Godspeed {
-	statsd, err := godspeed.NewDefault()
+	host, portString, err := net.SplitHostPort(DogStatsdAddress)
+	port, portErr := strconv.Atoi(portString)
+	if err != nil || portErr != nil {
+		Log(fmt.Sprintf("StatsdSetup(): Could not parse '%s' - using the default.", DogStatsdAddress), "info")
+		host, port = godspeed.DefaultHost, godspeed.DefaultPort
+	}
+	statsd, err := godspeed.New(host, port, false)
 	if err != nil {
-		Log("StatsdSetup(): Problem setting up connection.", "info")
+		Log(fmt.Sprintf("StatsdSetup(): Problem setting up connection to '%s' - not sending metrics: %v", DogStatsdAddress, err), "info")
+		DogStatsd = false
 		return nil
 	}
+	statsd.Namespace = StatsdNamespace
+	statsd.Tags = StatsdTags
 	return statsd
 }
 
+// statsd is the dogstatsd client every metric is sent with - it's set up
+// again if --statsd-address, --statsd-namespace or --statsd-tags change.
+var statsd struct {
+	sync.Mutex
+	client *godspeed.Godspeed
+	setup  string
+}
+
+// statsdClient returns the dogstatsd client - nil if it couldn't be set up.
+func statsdClient() *godspeed.Godspeed {
+	statsd.Lock()
+	defer statsd.Unlock()
+	setup := strings.Join(append([]string{DogStatsdAddress, StatsdNamespace}, StatsdTags...), " ")
+	if statsd.client != nil && statsd.setup == setup {
+		return statsd.client
+	}
+	if statsd.client != nil {
+		statsd.client.Conn.Close()
+	}
+	statsd.client, statsd.setup = StatsdSetup(), setup
+	return statsd.client
+}
+
+// statsdName takes the kvexpress namespace off a metric name - the client adds
+// --statsd-namespace instead.
+func statsdName(name string) string {
+	return strings.TrimPrefix(name, "kvexpress.")
+}
+
+// MetricEnabled returns false if the metric was turned off with --metrics-disable
+// or if --metrics-enable was passed and the metric isn't in it.
+func MetricEnabled(name string) bool {
+	name = strings.TrimPrefix(name, "kvexpress.")
+	if len(MetricsEnable) > 0 && !metricListed(name, MetricsEnable) {
+		return false
+	}
+	return !metricListed(name, MetricsDisable)
+}
+
+// metricListed returns true if name is in the list - with or without the namespace.
+func metricListed(name string, list []string) bool {
+	for _, metric := range list {
+		if strings.TrimPrefix(metric, "kvexpress.") == name {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckMetricNames warns about any metric names passed that kvexpress doesn't send.
+func CheckMetricNames() {
+	for _, metric := range append(append([]string{}, MetricsEnable...), MetricsDisable...) {
+		if !metricListed(strings.TrimPrefix(metric, "kvexpress."), knownMetrics) {
+			Log(fmt.Sprintf("metric='%s' known='false'", metric), "info")
+			fmt.Printf("Warning: unknown metric '%s' - known metrics: %s\n", metric, strings.Join(knownMetrics, ", "))
+		}
+	}
+}
+
+// statsdIncr increments a counter unless the metric has been turned off.
+// It's sent to dogstatsd and kept for Prometheus.
+func statsdIncr(name string, tags []string) {
+	if !MetricEnabled(name) {
+		return
+	}
+	PromIncr(name, tags)
+	if DogStatsd {
+		if statsd := statsdClient(); statsd != nil {
+			statsd.Incr(statsdName(name), tags)
+		}
+	}
+}
+
+// statsdCount adds value to a counter unless the metric has been turned off.
+// It's sent to dogstatsd and kept for Prometheus.
+func statsdCount(name string, value float64, tags []string) {
+	if !MetricEnabled(name) {
+		return
+	}
+	PromAdd(name, tags, value)
+	if DogStatsd {
+		if statsd := statsdClient(); statsd != nil {
+			statsd.Count(statsdName(name), value, tags)
+		}
+	}
+}
+
+// statsdGauge sends a gauge unless the metric has been turned off.
+// It's sent to dogstatsd and kept for Prometheus.
+func statsdGauge(name string, value float64, tags []string) {
+	if !MetricEnabled(name) {
+		return
+	}
+	PromGauge(name, value, tags)
+	if DogStatsd {
+		if statsd := statsdClient(); statsd != nil {
+			statsd.Gauge(statsdName(name), value, tags)
+		}
+	}
+}
+
+// statsdEvent sends a dogstatsd event for key. An event is one run, so it's
+// tagged with the run_id - a metric tag would be a new series every run.
+func statsdEvent(title, text, alertType, key string, tags []string) {
+	if !DogStatsd {
+		return
+	}
+	statsd := statsdClient()
+	if statsd == nil {
+		return
+	}
+	tags = append(append([]string{}, tags...), fmt.Sprintf("command:%s", Direction))
+	if RunID != "" {
+		tags = append(tags, fmt.Sprintf("run_id:%s", RunID))
+	}
+	fields := map[string]string{"alert_type": alertType, "aggregation_key": key, "source_type_name": "kvexpress"}
+	if err := statsd.Event(Redact(title), Redact(text), fields, tags); err != nil {
+		Log(fmt.Sprintf("dogstatsd event='%s' message='%v'", title, err), "info")
+	}
+}
+
+// StatsdRunEvent sends a dogstatsd event for a run that stopped at location
+// with message.
+func StatsdRunEvent(key, location, message string) {
+	statsdEvent(fmt.Sprintf("kvexpress %s stopped: %s", Direction, key), message, "error", key, makeTags(key, location))
+}
+
+// StatsdWatchEvent sends a dogstatsd event when watch rewrote file for key.
+func StatsdWatchEvent(key, file string) {
+	statsdEvent(fmt.Sprintf("kvexpress watch wrote %s", file), fmt.Sprintf("'%s' changed and '%s' was written.", key, file), "info", key, makeTags(key, "watch_write"))
+}
+
 // StatsdIn sends metrics to Dogstatsd on a `kvexpress in` operation.
 func StatsdIn(key string, dataLength int, data string) {
 	Log(fmt.Sprintf("dogstatsd='%t' key='%s' stats='in'", DogStatsd, key), "debug")
-	if DogStatsd {
-		statsd := StatsdSetup()
-		if statsd != nil {
-			defer statsd.Conn.Close()
-			tags := makeTags(key, "complete")
-			statsd.Incr("kvexpress.in", tags)
-			statsd.Gauge("kvexpress.bytes", float64(dataLength), tags)
-			// If the data is compressed - then LineCount will always return 1.
-			// That's not useful or accurate, so let's decompress and count that.
-			if Compress {
-				data = DecompressData(data)
-			}
-			statsd.Gauge("kvexpress.lines", float64(LineCount(data)), tags)
+	tags := makeTags(key, "complete")
+	statsdIncr("kvexpress.in", tags)
+	statsdGauge("kvexpress.bytes", float64(dataLength), tags)
+	// Binary data doesn't have lines.
+	if Binary {
+		return
+	}
+	// If the data is compressed - then LineCount will always return 1.
+	// That's not useful or accurate, so let's decompress and count that.
+	if Compress {
+		// Skip the line count if it can't be decompressed.
+		var err error
+		if data, err = DecompressData(data); err != nil {
+			return
 		}
 	}
+	statsdGauge("kvexpress.lines", float64(LineCount(data)), tags)
 }
 
 // StatsdOut sends metrics to Dogstatsd on a `kvexpress out` operation.
 func StatsdOut(key string) {
 	Log(fmt.Sprintf("dogstatsd='%t' key='%s' stats='out'", DogStatsd, key), "debug")
-	if DogStatsd {
-		statsd := StatsdSetup()
-		if statsd != nil {
-			defer statsd.Conn.Close()
-			tags := makeTags(key, "complete")
-			statsd.Incr("kvexpress.out", tags)
-		}
-	}
+	tags := makeTags(key, "complete")
+	statsdIncr("kvexpress.out", tags)
 }
 
 // StatsdLocked sends metrics to Dogstatsd on a `kvexpress out` operation
 // that is blocked by a locked file.
 func StatsdLocked(file string) {
 	Log(fmt.Sprintf("dogstatsd='%t' file='%s' stats='locked'", DogStatsd, file), "debug")
-	if DogStatsd {
-		statsd := StatsdSetup()
-		if statsd != nil {
-			defer statsd.Conn.Close()
-			tags := makeTags(file, "complete")
-			statsd.Incr("kvexpress.locked", tags)
-		}
-	}
+	tags := makeTags(file, "complete")
+	statsdIncr("kvexpress.locked", tags)
+}
+
+// StatsdNotLeader sends metrics when `kvexpress in --leader-election` doesn't
+// save the data because another host is the leader.
+func StatsdNotLeader(key string) {
+	Log(fmt.Sprintf("dogstatsd='%t' key='%s' stats='not_leader'", DogStatsd, key), "debug")
+	tags := makeTags(key, "not_leader")
+	statsdIncr("kvexpress.not_leader", tags)
 }
 
 // StatsdLength sends metrics to Dogstatsd on a `kvexpress out` operation
 // where the file isn't long enough.
 func StatsdLength(key string) {
 	Log(fmt.Sprintf("dogstatsd='%t' key='%s' stats='not_long_enough'", DogStatsd, key), "debug")
-	if DogStatsd {
-		statsd := StatsdSetup()
-		if statsd != nil {
-			defer statsd.Conn.Close()
-			tags := makeTags(key, "not_long_enough")
-			statsd.Incr("kvexpress.not_long_enough", tags)
-		}
-	}
+	tags := makeTags(key, "not_long_enough")
+	statsdIncr("kvexpress.not_long_enough", tags)
+}
+
+// StatsdTooLarge sends metrics to Dogstatsd when the data has more lines or
+// bytes than --max-length or --max-bytes.
+func StatsdTooLarge(key string) {
+	Log(fmt.Sprintf("dogstatsd='%t' key='%s' stats='too_large'", DogStatsd, key), "debug")
+	tags := makeTags(key, "too_large")
+	statsdIncr("kvexpress.too_large", tags)
 }
 
 // StatsdChecksum sends metrics to Dogstatsd on a `kvexpress out` operation
 // where the checksum doesn't match.
 func StatsdChecksum(key string) {
 	Log(fmt.Sprintf("dogstatsd='%t' key='%s' stats='checksum_mismatch'", DogStatsd, key), "debug")
-	if DogStatsd {
-		statsd := StatsdSetup()
-		if statsd != nil {
-			defer statsd.Conn.Close()
-			tags := makeTags(key, "checksum_mismatch")
-			statsd.Incr("kvexpress.checksum_mismatch", tags)
-		}
-	}
+	tags := makeTags(key, "checksum_mismatch")
+	statsdIncr("kvexpress.checksum_mismatch", tags)
 }
 
 // StatsdLock sends metrics to Dogstatsd on a `kvexpress lock` operation.
 func StatsdLock(key string) {
 	Log(fmt.Sprintf("dogstatsd='%t' key='%s' stats='lock'", DogStatsd, key), "debug")
-	if DogStatsd {
-		statsd := StatsdSetup()
-		if statsd != nil {
-			defer statsd.Conn.Close()
-			tags := makeTags(key, "complete")
-			statsd.Incr("kvexpress.lock", tags)
-		}
-	}
+	tags := makeTags(key, "complete")
+	statsdIncr("kvexpress.lock", tags)
+}
+
+// StatsdLockExpired sends metrics to Dogstatsd when a lock's --ttl has passed.
+func StatsdLockExpired(file string) {
+	Log(fmt.Sprintf("dogstatsd='%t' file='%s' stats='lock_expired'", DogStatsd, file), "debug")
+	tags := makeTags(file, "lock_expired")
+	statsdIncr("kvexpress.lock_expired", tags)
+}
+
+// StatsdTempLeftover sends metrics to Dogstatsd when a temporary file was left
+// behind by a kvexpress that didn't finish writing file.
+func StatsdTempLeftover(file string) {
+	Log(fmt.Sprintf("dogstatsd='%t' file='%s' stats='temp_leftover'", DogStatsd, file), "debug")
+	tags := makeTags(file, "temp_leftover")
+	statsdIncr("kvexpress.temp_leftover", tags)
+}
+
+// StatsdOwnerNotFound sends metrics to Dogstatsd when the owner for the files
+// doesn't exist and they're written as the current user.
+func StatsdOwnerNotFound(owner string) {
+	Log(fmt.Sprintf("dogstatsd='%t' owner='%s' stats='owner_not_found'", DogStatsd, owner), "debug")
+	tags := makeTags(owner, "owner_not_found")
+	statsdIncr("kvexpress.owner_not_found", tags)
 }
 
 // StatsdUnlock sends metrics to Dogstatsd on a `kvexpress unlock` operation.
 func StatsdUnlock(key string) {
 	Log(fmt.Sprintf("dogstatsd='%t' key='%s' stats='unlock'", DogStatsd, key), "debug")
-	if DogStatsd {
-		statsd := StatsdSetup()
-		if statsd != nil {
-			defer statsd.Conn.Close()
-			tags := makeTags(key, "complete")
-			statsd.Incr("kvexpress.unlock", tags)
-		}
-	}
+	tags := makeTags(key, "complete")
+	statsdIncr("kvexpress.unlock", tags)
 }
 
 // StatsdRaw sends metrics to Dogstatsd on a `kvexpress raw` operation.
 func StatsdRaw(key string) {
 	Log(fmt.Sprintf("dogstatsd='%t' key='%s' stats='raw'", DogStatsd, key), "debug")
-	if DogStatsd {
-		statsd := StatsdSetup()
-		if statsd != nil {
-			defer statsd.Conn.Close()
-			tags := makeTags(key, "complete")
-			statsd.Incr("kvexpress.raw", tags)
-		}
+	tags := makeTags(key, "complete")
+	statsdIncr("kvexpress.raw", tags)
+}
+
+// StatsdExecNotFound sends metrics to Dogstatsd when the command to run after
+// a kvexpress operation doesn't exist or can't be executed.
+func StatsdExecNotFound(command string) {
+	Log(fmt.Sprintf("dogstatsd='%t' command='%s' stats='exec_not_found'", DogStatsd, command), "debug")
+	tags := makeTags(command, "exec_not_found")
+	statsdIncr("kvexpress.exec_not_found", tags)
+}
+
+// StatsdExecFailed sends metrics to Dogstatsd when a command fails or times out.
+func StatsdExecFailed(command string, status int) {
+	Log(fmt.Sprintf("dogstatsd='%t' command='%s' status='%d' stats='exec_failed'", DogStatsd, command, status), "debug")
+	tags := makeTags(command, "exec_failed")
+	tags = append(tags, fmt.Sprintf("status:%d", status))
+	statsdIncr("kvexpress.exec_failed", tags)
+}
+
+// StatsdExecDebounced sends a metric when --exec-debounce held back or skipped
+// a run of the command.
+func StatsdExecDebounced(command string) {
+	Log(fmt.Sprintf("dogstatsd='%t' command='%s' stats='exec_debounced'", DogStatsd, command), "debug")
+	statsdIncr("kvexpress.exec_debounced", makeTags(command, "exec_debounced"))
+}
+
+// StatsdWebhookFailed sends a metric when watch couldn't send the webhook for
+// a change to key.
+func StatsdWebhookFailed(key string) {
+	Log(fmt.Sprintf("dogstatsd='%t' key='%s' stats='webhook_failed'", DogStatsd, key), "debug")
+	statsdIncr("kvexpress.webhook_failed", makeTags(key, "webhook_failed"))
+}
+
+// StatsdApplyEntry sends a metric for every apply entry with what happened
+// to it.
+func StatsdApplyEntry(key, direction, result string, code int) {
+	Log(fmt.Sprintf("dogstatsd='%t' key='%s' result='%s' stats='apply_entry'", DogStatsd, key, result), "debug")
+	tags := append(makeTags(key, "apply_entry"), "command:"+direction, "result:"+result, fmt.Sprintf("exit:%d", code))
+	statsdIncr("kvexpress.apply_entry", tags)
+}
+
+// StatsdValidateFailed sends metrics to Dogstatsd when --validate or --validate-exec rejects a file.
+func StatsdValidateFailed(key string) {
+	Log(fmt.Sprintf("dogstatsd='%t' key='%s' stats='validate_failed'", DogStatsd, key), "debug")
+	tags := makeTags(key, "validate_failed")
+	statsdIncr("kvexpress.validate_failed", tags)
+}
+
+// StatsdChangeTooLarge sends metrics to Dogstatsd when --max-change-ratio stops an update.
+func StatsdChangeTooLarge(key string) {
+	Log(fmt.Sprintf("dogstatsd='%t' key='%s' stats='change_too_large'", DogStatsd, key), "debug")
+	tags := makeTags(key, "change_too_large")
+	statsdIncr("kvexpress.change_too_large", tags)
+}
+
+// StatsdVerify sends the verify exit status to Dogstatsd - 0 when the key and
+// the file match their checksum.
+func StatsdVerify(key string, status int) {
+	Log(fmt.Sprintf("dogstatsd='%t' key='%s' stats='verify' status='%d'", DogStatsd, key, status), "debug")
+	tags := makeTags(key, "verify")
+	statsdGauge("kvexpress.verify", float64(status), tags)
+}
+
+// StatsdFileDrift sends a metric when guard finds a file that was changed by
+// hand.
+func StatsdFileDrift(key, file string, restored bool) {
+	Log(fmt.Sprintf("dogstatsd='%t' key='%s' file='%s' stats='file_drift'", DogStatsd, key, file), "debug")
+	tags := append(makeTags(key, "file_drift"), fmt.Sprintf("file:%s", file), fmt.Sprintf("restored:%t", restored))
+	statsdIncr("kvexpress.file_drift", tags)
+}
+
+// StatsdFreshness sends watch's gauges for key and file - how long since the
+// file was last rendered, how old the data is and how big the file is. The
+// ones that aren't known yet are left out.
+func StatsdFreshness(key, file string, freshness WatchFreshness) {
+	Log(fmt.Sprintf("dogstatsd='%t' key='%s' file='%s' stats='freshness'", DogStatsd, key, file), "debug")
+	tags := append(makeTags(key, "watch"), fmt.Sprintf("file:%s", file))
+	if freshness.SinceRender >= 0 {
+		statsdGauge("kvexpress.since_render", freshness.SinceRender.Seconds(), tags)
+	}
+	if freshness.Age >= 0 {
+		statsdGauge("kvexpress.age", freshness.Age.Seconds(), tags)
+	}
+	if freshness.Bytes >= 0 {
+		statsdGauge("kvexpress.file_bytes", float64(freshness.Bytes), tags)
+	}
+}
+
+// StatsdFilesystem sends a metric when a file can't be written because the
+// disk is full or the filesystem is read-only.
+func StatsdFilesystem(key, reason string) {
+	Log(fmt.Sprintf("dogstatsd='%t' key='%s' stats='filesystem_error' reason='%s'", DogStatsd, key, reason), "debug")
+	tags := append(makeTags(key, "filesystem_error"), fmt.Sprintf("reason:%s", reason))
+	statsdIncr("kvexpress.filesystem_error", tags)
+}
+
+// StatsdTimeout sends a metric when kvexpress gives up on a Consul that didn't
+// answer in --consul-timeout or on a run that took longer than --deadline.
+func StatsdTimeout(key, timeout string) {
+	Log(fmt.Sprintf("dogstatsd='%t' key='%s' stats='timeout' timeout='%s'", DogStatsd, key, timeout), "info")
+	tags := append(makeTags(key, "timeout"), fmt.Sprintf("timeout:%s", timeout))
+	statsdIncr("kvexpress.timeout", tags)
+}
+
+// StatsdRunInProgress sends metrics to DogStatsd when a run stopped because
+// the last one for the key was still going.
+func StatsdRunInProgress(key string) {
+	Log(fmt.Sprintf("dogstatsd='%t' key='%s' stats='run_in_progress'", DogStatsd, key), "debug")
+	statsdIncr("kvexpress.run_in_progress", makeTags(key, "run_in_progress"))
+}
+
+// StatsdSelfUpdate sends metrics to DogStatsd when self-update replaced
+// kvexpress - or the download didn't match its checksum.
+func StatsdSelfUpdate(key, result string) {
+	Log(fmt.Sprintf("dogstatsd='%t' key='%s' stats='self_update' result='%s'", DogStatsd, key, result), "debug")
+	tags := append(makeTags(key, "self_update"), fmt.Sprintf("result:%s", result))
+	statsdIncr("kvexpress.self_update", tags)
+}
+
+// StatsdVersionMismatch sends metrics to DogStatsd when a run stopped because
+// kvexpress isn't --required-version.
+func StatsdVersionMismatch(key string) {
+	Log(fmt.Sprintf("dogstatsd='%t' key='%s' stats='version_mismatch' version='%s'", DogStatsd, key, Version), "debug")
+	tags := append(makeTags(key, "version_mismatch"), fmt.Sprintf("version:%s", Version))
+	statsdIncr("kvexpress.version_mismatch", tags)
+}
+
+// StatsdDeferred sends a metric when a maintenance window held back a change.
+func StatsdDeferred(key string) {
+	Log(fmt.Sprintf("dogstatsd='%t' key='%s' stats='deferred'", DogStatsd, key), "debug")
+	statsdIncr("kvexpress.deferred", makeTags(key, "deferred"))
+}
+
+// StatsdTraffic sends the bytes a run for key read from and wrote to Consul.
+func StatsdTraffic(key string, read, written int64) {
+	Log(fmt.Sprintf("dogstatsd='%t' key='%s' stats='traffic' read='%d' written='%d'", DogStatsd, key, read, written), "debug")
+	statsdCount("kvexpress.consul_bytes_read", float64(read), makeTags(key, "traffic"))
+	statsdCount("kvexpress.consul_bytes_written", float64(written), makeTags(key, "traffic"))
+}
+
+// StatsdDataAge sends how old the data in key is with --max-age - and a
+// too_old metric when it's older than that.
+func StatsdDataAge(key string, age time.Duration, tooOld bool) {
+	Log(fmt.Sprintf("dogstatsd='%t' key='%s' stats='age' age='%s' too_old='%t'", DogStatsd, key, age.Round(time.Second), tooOld), "debug")
+	statsdGauge("kvexpress.age", age.Seconds(), makeTags(key, "age"))
+	if tooOld {
+		statsdIncr("kvexpress.too_old", makeTags(key, "too_old"))
 	}
 }
 
+// StatsdDelta sends the size of the delta `in --delta` saved - and counts the
+// times it saved a new base.
+func StatsdDelta(key string, compact bool, bytes int) {
+	Log(fmt.Sprintf("dogstatsd='%t' key='%s' stats='delta' compact='%t' bytes='%d'", DogStatsd, key, compact, bytes), "debug")
+	statsdGauge("kvexpress.delta_bytes", float64(bytes), makeTags(key, "delta"))
+	if compact {
+		statsdIncr("kvexpress.delta_compact", makeTags(key, "delta"))
+	}
+}
+
+// StatsdSync sends what `out --recurse` did with the keys to Dogstatsd.
+func StatsdSync(key string, summary SyncSummary) {
+	Log(fmt.Sprintf("dogstatsd='%t' key='%s' stats='sync'", DogStatsd, key), "debug")
+	counts := map[string]int{"written": summary.Written, "unchanged": summary.Unchanged, "removed": summary.Removed, "skipped": summary.Skipped}
+	for result, count := range counts {
+		tags := append(makeTags(key, "sync"), fmt.Sprintf("result:%s", result))
+		statsdGauge("kvexpress.sync", float64(count), tags)
+	}
+}
+
+// StatsdCopyTree sends the summary of a `copy --recurse` as gauges.
+func StatsdCopyTree(key string, summary CopySummary) {
+	Log(fmt.Sprintf("dogstatsd='%t' key='%s' stats='copy'", DogStatsd, key), "debug")
+	counts := map[string]int{"copied": summary.Copied, "unchanged": summary.Unchanged, "skipped": summary.Skipped, "failed": summary.Failed}
+	for result, count := range counts {
+		tags := append(makeTags(key, "copy"), fmt.Sprintf("result:%s", result))
+		statsdGauge("kvexpress.copy", float64(count), tags)
+	}
+}
+
+// StatsdSignatureInvalid sends metrics to Dogstatsd when the data doesn't
+// match its signature.
+func StatsdSignatureInvalid(key string) {
+	Log(fmt.Sprintf("dogstatsd='%t' key='%s' stats='signature_invalid'", DogStatsd, key), "debug")
+	tags := makeTags(key, "signature_invalid")
+	statsdIncr("kvexpress.signature_invalid", tags)
+}
+
+// StatsdServingStale sends metrics to Dogstatsd when out couldn't reach
+// Consul and used the data in --cache-dir instead.
+func StatsdServingStale(key string) {
+	Log(fmt.Sprintf("dogstatsd='%t' key='%s' stats='serving_stale'", DogStatsd, key), "debug")
+	tags := makeTags(key, "serving_stale")
+	statsdIncr("kvexpress.serving_stale", tags)
+}
+
+// StatsdStale sends metrics to Dogstatsd when a stale read is older than --max-staleness.
+func StatsdStale(key string, lastContact time.Duration) {
+	Log(fmt.Sprintf("dogstatsd='%t' key='%s' last_contact='%s' stats='stale'", DogStatsd, key, lastContact), "debug")
+	tags := makeTags(key, "stale")
+	statsdIncr("kvexpress.stale", tags)
+}
+
 // StatsdReconnect sends metrics when we have Consul connection retries.
 func StatsdReconnect(times int) {
 	Log(fmt.Sprintf("dogstatsd='%t' reconnect='%d'", DogStatsd, times), "debug")
-	if DogStatsd {
-		statsd := StatsdSetup()
-		if statsd != nil {
-			defer statsd.Conn.Close()
-			tags := make([]string, 2)
-			hostname := GetHostname()
-			hostTag := fmt.Sprintf("host:%s", hostname)
-			directionTag := fmt.Sprintf("direction:%s", Direction)
-			tags = append(tags, hostTag)
-			tags = append(tags, directionTag)
-			statsd.Incr("kvexpress.consul_reconnect", tags)
-		}
-	}
+	tags := make([]string, 2)
+	hostname := GetHostname()
+	hostTag := fmt.Sprintf("host:%s", hostname)
+	directionTag := fmt.Sprintf("direction:%s", Direction)
+	tags = append(tags, hostTag)
+	tags = append(tags, directionTag)
+	statsdIncr("kvexpress.consul_reconnect", tags)
+}
+
+// StatsdFailover sends metrics when a Consul server can't be reached and the
+// next one is tried.
+func StatsdFailover(server string) {
+	Log(fmt.Sprintf("dogstatsd='%t' failover='%s'", DogStatsd, server), "debug")
+	tags := []string{fmt.Sprintf("host:%s", GetHostname()), fmt.Sprintf("direction:%s", Direction), fmt.Sprintf("server:%s", server)}
+	statsdIncr("kvexpress.consul_failover", tags)
 }
 
 // StatsdRunTime sends metrics to Dogstatsd on various operations.
 func StatsdRunTime(key string, location string, msec int64) {
 	Log(fmt.Sprintf("dogstatsd='%t' key='%s' location='%s' msec='%d'", DogStatsd, key, location, msec), "debug")
-	if DogStatsd {
-		statsd := StatsdSetup()
-		if statsd != nil {
-			defer statsd.Conn.Close()
-			tags := makeTags(key, location)
-			locationTag := fmt.Sprintf("location:%s", location)
-			tags = append(tags, locationTag)
-			statsd.Gauge("kvexpress.time", float64(msec), tags)
-		}
-	}
+	tags := makeTags(key, location)
+	locationTag := fmt.Sprintf("location:%s", location)
+	tags = append(tags, locationTag)
+	statsdGauge("kvexpress.time", float64(msec), tags)
 }
 
 // StatsdPanic sends metrics to Dogstatsd when something really bad happens.
-// It also stops the execution of kvexpress.
 func StatsdPanic(key, location string) {
 	Log(fmt.Sprintf("dogstatsd='%t' key='%s' location='%s' stats='panic'", DogStatsd, key, location), "debug")
-	if DogStatsd {
-		statsd := StatsdSetup()
-		if statsd != nil {
-			defer statsd.Conn.Close()
-			tags := makeTags(key, location)
-			statsd.Incr("kvexpress.panic", tags)
-		}
-	}
-	// If we're going to panic, we might as well stop right here.
-	// Means we can't connect to Consul, download a URL or
-	// write and/or chown files.
-	os.Exit(0)
+	tags := makeTags(key, location)
+	statsdIncr("kvexpress.panic", tags)
 }
 
 // StatsdConsul sends metrics to DogStatsd when Consul has a KV write or delete error.
 func StatsdConsul(key, location string) {
 	Log(fmt.Sprintf("dogstatsd='%t' key='%s' location='%s' stats='consul_error'", DogStatsd, key, location), "info")
-	if DogStatsd {
-		statsd := StatsdSetup()
-		if statsd != nil {
-			defer statsd.Conn.Close()
-			tags := makeTags(key, location)
-			statsd.Incr("kvexpress.consul_error", tags)
-		}
-	}
+	tags := makeTags(key, location)
+	statsdIncr("kvexpress.consul_error", tags)
 }
 
-// DDAPIConnect connects to the Datadog API and returns a client object.
+// DDAPIConnect connects to the Datadog API and returns a client object. The
+// requests go to --datadog-site - through --datadog-proxy or --proxy if there
+// is one.
 func DDAPIConnect(api, app string) *datadog.Client {
 	client := datadog.NewClient(api, app)
+	if DatadogSite != "" {
+		client.SetBaseUrl(datadogURL(DatadogSite))
+	}
+	client.HttpClient = &http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{Proxy: proxyFunc(DatadogProxy)}}
 	return client
 }
 
+// datadogURL is the API address for a Datadog site - datadoghq.eu is
+// https://api.datadoghq.eu. A full URL is used as it is.
+func datadogURL(site string) string {
+	if strings.HasPrefix(site, "http://") || strings.HasPrefix(site, "https://") {
+		return strings.TrimSuffix(site, "/")
+	}
+	return "https://api." + strings.TrimPrefix(site, "api.")
+}
+
+// SetupDatadog reads the Datadog API and app keys from --datadog-api-key-file
+// and --datadog-app-key-file - or DD_API_KEY and DD_APP_KEY if they weren't
+// passed at all - and checks --datadog-proxy.
+func SetupDatadog() error {
+	keys := []struct {
+		value *string
+		file  string
+		env   string
+	}{
+		{&DatadogAPIKey, DatadogAPIKeyFile, "DD_API_KEY"},
+		{&DatadogAPPKey, DatadogAPPKeyFile, "DD_APP_KEY"},
+	}
+	for _, key := range keys {
+		switch {
+		case key.file != "":
+			value, err := ReadTokenFile(key.file)
+			if err != nil {
+				return err
+			}
+			*key.value = value
+		case *key.value == "":
+			*key.value = os.Getenv(key.env)
+		}
+	}
+	if DatadogProxy != "" && DatadogProxy != proxyDirect {
+		if _, err := parseProxy(DatadogProxy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EventStatePath is the file with the last state out sent a Datadog event for
+// name in --prefix - it's next to the run lock.
+func EventStatePath(name string) string {
+	name = runLockName.ReplaceAllString(strings.Trim(PrefixLocation+"/"+name, "/"), "-")
+	return filepath.Join(StateDir(), fmt.Sprintf("kvexpress-out-%s.event", name))
+}
+
+// ddOutEvent is true if out should send the Datadog event for name's state -
+// there's an API key and the last run sent a different one. out runs from
+// cron, so a lock, a stop key or bad data would otherwise send the same event
+// every run. A run that gets past them saves "ok", so the next one is sent.
+func ddOutEvent(name, state string) bool {
+	if DatadogAPIKey == "" || DatadogAPPKey == "" {
+		return false
+	}
+	path := EventStatePath(name)
+	if last, err := ioutil.ReadFile(path); err == nil && strings.TrimSpace(string(last)) == state {
+		Log(fmt.Sprintf("datadog='skipped' name='%s' state='%s' - it was already sent.", name, state), "debug")
+		return false
+	}
+	if DryRun {
+		return state != "ok"
+	}
+	if err := writeStateFile(path, []byte(state+"\n")); err != nil {
+		Log(fmt.Sprintf("datadog event_state='%s' message='%v'", path, err), "info")
+	}
+	return state != "ok"
+}
+
 // makeTags creates some standard tags for use with Dogstatsd and the Datadog API.
 func makeTags(key, location string) []string {
 	tags := make([]string, 4)
@@ -218,71 +628,133 @@ func makeTags(key, location string) []string {
 	return tags
 }
 
-// TODO: These three functions are ripe for refactoring to be more Golang like.
+// postDDEvent fills in the host, the source and the aggregation key for event,
+// adds the command and key tags and sends it - errors are only logged.
+func postDDEvent(dd *datadog.Client, name, key string, event datadog.Event) {
+	Log(fmt.Sprintf("datadog='true' %s='true' key='%s'", name, key), "debug")
+	event.Title, event.Text = Redact(event.Title), Redact(event.Text)
+	event.Host = GetHostname()
+	event.SourceType = "kvexpress"
+	event.Aggregation = key
+	event.Tags = append(event.Tags, fmt.Sprintf("command:%s", Direction))
+	// An event is one run, so it can have the run_id - a metric tag would be
+	// a new series every run.
+	if RunID != "" {
+		event.Tags = append(event.Tags, fmt.Sprintf("run_id:%s", RunID))
+	}
+	post, err := dd.PostEvent(&event)
+	if (post == nil) || (err != nil) {
+		Log(fmt.Sprintf("%s(): Error posting to Datadog: %v", name, err), "info")
+	}
+}
 
 // DDStopEvent sends a Datadog event to the API when there's a stop key present.
 func DDStopEvent(dd *datadog.Client, key, value string) {
-	Log(fmt.Sprintf("datadog='true' DDStopEvent='true' key='%s'", key), "debug")
-	tags := makeTags(key, "stop_key_present")
-	tags = append(tags, "kvexpress:stop")
+	tags := append(makeTags(key, "stop_key_present"), "kvexpress:stop")
 	title := fmt.Sprintf("Stop key is present: %s. Stopping.", key)
-	event := datadog.Event{Title: title, Text: value, AlertType: "error", Tags: tags}
-	post, err := dd.PostEvent(&event)
-	if (post == nil) || (err != nil) {
-		Log("DDStopEvent(): Error posting to Datadog.", "info")
-	}
+	postDDEvent(dd, "DDStopEvent", key, datadog.Event{Title: title, Text: value, AlertType: "error", Tags: tags})
 }
 
 // DDLengthEvent sends a Datadog event to the API when the file/url is too short.
 func DDLengthEvent(dd *datadog.Client, key, value string) {
-	Log(fmt.Sprintf("datadog='true' DDLengthEvent='true' key='%s'", key), "debug")
-	tags := makeTags(key, "not_long_enough")
-	tags = append(tags, "kvexpress:length")
+	tags := append(makeTags(key, "not_long_enough"), "kvexpress:length")
 	title := fmt.Sprintf("Not long enough: %s. Stopping.", key)
-	event := datadog.Event{Title: title, Text: value, AlertType: "error", Tags: tags}
-	post, err := dd.PostEvent(&event)
-	if (post == nil) || (err != nil) {
-		Log("DDLengthEvent(): Error posting to Datadog.", "info")
-	}
+	postDDEvent(dd, "DDLengthEvent", key, datadog.Event{Title: title, Text: value, AlertType: "error", Tags: tags})
+}
+
+// DDTooLargeEvent sends a Datadog event to the API when the data is larger
+// than --max-length or --max-bytes.
+func DDTooLargeEvent(dd *datadog.Client, key, value string) {
+	tags := append(makeTags(key, "too_large"), "kvexpress:length")
+	title := fmt.Sprintf("Too large: %s. Stopping.", key)
+	postDDEvent(dd, "DDTooLargeEvent", key, datadog.Event{Title: title, Text: value, AlertType: "error", Tags: tags})
+}
+
+// DDChangeEvent sends a Datadog event when --max-change-ratio stops an update.
+func DDChangeEvent(dd *datadog.Client, key string, ratio, max float64, value string) {
+	tags := append(makeTags(key, "change_too_large"), "kvexpress:change")
+	title := fmt.Sprintf("Too much changed: %s (%.2f > %.2f). Stopping.", key, ratio, max)
+	postDDEvent(dd, "DDChangeEvent", key, datadog.Event{Title: title, Text: value, AlertType: "error", Tags: tags})
 }
 
 // DDSaveDataEvent sends a Datadog event to the API when we have updated a Consul key.
 func DDSaveDataEvent(dd *datadog.Client, key, value string) {
-	Log(fmt.Sprintf("datadog='true' DDSaveDataEvent='true' key='%s'", key), "debug")
-	tags := makeTags(key, "complete")
-	tags = append(tags, "kvexpress:success")
+	tags := append(makeTags(key, "complete"), "kvexpress:success")
 	title := fmt.Sprintf("Updated: %s", key)
-	event := datadog.Event{Title: title, Text: value, AlertType: "info", Tags: tags}
-	post, err := dd.PostEvent(&event)
-	if (post == nil) || (err != nil) {
-		Log("DDSaveDataEvent(): Error posting to Datadog.", "info")
-	}
+	postDDEvent(dd, "DDSaveDataEvent", key, datadog.Event{Title: title, Text: value, AlertType: "info", Tags: tags})
 }
 
 // DDCopyDataEvent sends a Datadog event to the API when we have used `kvexpress copy`
 // to copy a Consul key.
 func DDCopyDataEvent(dd *datadog.Client, keyFrom, keyTo string) {
-	Log(fmt.Sprintf("datadog='true' DDCopyDataEvent='true' keyFrom='%s' keyTo='%s'", keyFrom, keyTo), "debug")
-	tags := makeTags(keyTo, "complete")
-	tags = append(tags, "kvexpress:success")
-	tags = append(tags, fmt.Sprintf("keyFrom:%s", keyFrom))
+	tags := append(makeTags(keyTo, "complete"), "kvexpress:success", fmt.Sprintf("keyFrom:%s", keyFrom))
 	title := fmt.Sprintf("Copy: %s to %s", keyFrom, keyTo)
-	event := datadog.Event{Title: title, Text: title, AlertType: "info", Tags: tags}
-	post, err := dd.PostEvent(&event)
-	if (post == nil) || (err != nil) {
-		Log("DDCopyDataEvent(): Error posting to Datadog.", "info")
-	}
+	postDDEvent(dd, "DDCopyDataEvent", keyTo, datadog.Event{Title: title, Text: title, AlertType: "info", Tags: tags})
+}
+
+// DDExecFailedEvent sends a Datadog event to the API when a command fails or times out.
+func DDExecFailedEvent(dd *datadog.Client, command string, status int, output string) {
+	tags := append(makeTags(command, "exec_failed"), "kvexpress:exec")
+	title := fmt.Sprintf("Exec failed with %d: %s", status, command)
+	postDDEvent(dd, "DDExecFailedEvent", command, datadog.Event{Title: title, Text: output, AlertType: "error", Tags: tags})
+}
+
+// DDLockExpiredEvent sends a Datadog event to the API when a lock's --ttl has passed.
+func DDLockExpiredEvent(dd *datadog.Client, file, reason string) {
+	tags := append(makeTags(file, "lock_expired"), "kvexpress:lock")
+	title := fmt.Sprintf("Lock expired: %s", file)
+	postDDEvent(dd, "DDLockExpiredEvent", file, datadog.Event{Title: title, Text: reason, AlertType: "info", Tags: tags})
 }
 
 // DDSaveStopEvent sends a Datadog event when we have added a stop key to Consul.
 func DDSaveStopEvent(dd *datadog.Client, key, value string) {
-	Log(fmt.Sprintf("datadog='true' DDSaveStopEvent='true' key='%s'", key), "debug")
-	tags := makeTags(key, "stop_key_save")
-	tags = append(tags, "kvexpress:stop_set")
+	tags := append(makeTags(key, "stop_key_save"), "kvexpress:stop_set")
 	title := fmt.Sprintf("Set Stop Key: %s", key)
-	event := datadog.Event{Title: title, Text: value, AlertType: "warning", Tags: tags}
-	post, err := dd.PostEvent(&event)
-	if (post == nil) || (err != nil) {
-		Log("DDSaveStopEvent(): Error posting to Datadog.", "info")
-	}
+	postDDEvent(dd, "DDSaveStopEvent", key, datadog.Event{Title: title, Text: value, AlertType: "warning", Tags: tags})
+}
+
+// DDCanaryEvent sends a Datadog event when a key's canary is promoted or aborted.
+func DDCanaryEvent(dd *datadog.Client, key, action string) {
+	tags := append(makeTags(key, "canary_"+action), "kvexpress:canary")
+	title := fmt.Sprintf("Canary %s: %s", action, key)
+	postDDEvent(dd, "DDCanaryEvent", key, datadog.Event{Title: title, Text: CanaryKey(key), AlertType: "info", Tags: tags})
+}
+
+// DDWriteEvent sends a Datadog event when out has written files for a key.
+func DDWriteEvent(dd *datadog.Client, key string, files []string) {
+	tags := append(makeTags(key, "complete"), "kvexpress:write")
+	title := fmt.Sprintf("Wrote: %s", key)
+	postDDEvent(dd, "DDWriteEvent", key, datadog.Event{Title: title, Text: strings.Join(files, "\n"), AlertType: "success", Tags: tags})
+}
+
+// DDChecksumEvent sends a Datadog event when the data doesn't match the checksum.
+func DDChecksumEvent(dd *datadog.Client, key, checksum string) {
+	tags := append(makeTags(key, "checksum_mismatch"), "kvexpress:checksum")
+	title := fmt.Sprintf("Checksum mismatch: %s. Stopping.", key)
+	postDDEvent(dd, "DDChecksumEvent", key, datadog.Event{Title: title, Text: fmt.Sprintf("checksum: %s", checksum), AlertType: "error", Tags: tags})
+}
+
+// DDFileDriftEvent sends a Datadog event when guard finds a file that was
+// changed by hand.
+func DDFileDriftEvent(dd *datadog.Client, key, file string, result GuardResult) {
+	tags := append(makeTags(key, "file_drift"), "kvexpress:file_drift")
+	title := fmt.Sprintf("Changed by hand: %s", file)
+	text := fmt.Sprintf("file: %s\nchecksum: %s\nrestored: %t", result.File, result.Stored, result.Restored)
+	postDDEvent(dd, "DDFileDriftEvent", key, datadog.Event{Title: title, Text: text, AlertType: "warning", Tags: tags})
+}
+
+// DDFilesystemEvent sends a Datadog event when a file can't be written
+// because the disk is full or the filesystem is read-only.
+func DDFilesystemEvent(dd *datadog.Client, key, message string) {
+	tags := append(makeTags(key, "filesystem_error"), "kvexpress:filesystem")
+	title := fmt.Sprintf("Can't write the filesystem: %s", key)
+	postDDEvent(dd, "DDFilesystemEvent", key, datadog.Event{Title: title, Text: message, AlertType: "error", Tags: tags})
+}
+
+// DDLockedEvent sends a Datadog event when a lock stops a file - or with a
+// global lock every file - from being written.
+func DDLockedEvent(dd *datadog.Client, name, reason string) {
+	tags := append(makeTags(name, "locked"), "kvexpress:locked")
+	title := fmt.Sprintf("Locked: %s", name)
+	postDDEvent(dd, "DDLockedEvent", name, datadog.Event{Title: title, Text: reason, AlertType: "warning", Tags: tags})
 }
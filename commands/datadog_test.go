@@ -0,0 +1,179 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listenStatsd starts a UDP listener and points the statsd address at it.
+func listenStatsd(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	address, dogstatsd := DogStatsdAddress, DogStatsd
+	t.Cleanup(func() {
+		conn.Close()
+		DogStatsdAddress, DogStatsd = address, dogstatsd
+	})
+	DogStatsdAddress = conn.LocalAddr().String()
+	DogStatsd = true
+	return conn
+}
+
+// readStatsd returns all of the metric lines that arrive before the timeout.
+func readStatsd(conn *net.UDPConn) []string {
+	var lines []string
+	buffer := make([]byte, 2048)
+	for {
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return lines
+		}
+		lines = append(lines, string(buffer[:n]))
+	}
+}
+
+func TestMetricsDisable(t *testing.T) {
+	conn := listenStatsd(t)
+	MetricsDisable = []string{"out"}
+	defer func() { MetricsDisable = []string{} }()
+	StatsdOut("testing")
+	StatsdChecksum("testing")
+	names := strings.Join(readStatsd(conn), " ")
+	if strings.Contains(names, "kvexpress.out:") {
+		t.Error("kvexpress.out was disabled and should not have been sent.")
+	}
+	if !strings.Contains(names, "kvexpress.checksum_mismatch") {
+		t.Errorf("kvexpress.checksum_mismatch should have been sent: '%s'", names)
+	}
+}
+
+func TestStatsdNamespace(t *testing.T) {
+	conn := listenStatsd(t)
+	defer func() { StatsdNamespace, StatsdTags = "kvexpress", []string{} }()
+	StatsdNamespace, StatsdTags = "consul.kv", []string{"team:sre"}
+	StatsdOut("testing")
+	metrics := strings.Join(readStatsd(conn), " ")
+	if !strings.HasPrefix(metrics, "consul.kv.out:") || !strings.Contains(metrics, "team:sre") {
+		t.Errorf("The metric should have the namespace and the tags: '%s'", metrics)
+	}
+
+	DogStatsdAddress = "does-not-exist.invalid:8125"
+	StatsdOut("testing")
+	if DogStatsd {
+		t.Error("Dogstatsd should be turned off when it can't be set up.")
+	}
+}
+
+func TestStatsdClientReused(t *testing.T) {
+	conn := listenStatsd(t)
+	client := statsdClient()
+	StatsdOut("testing")
+	StatsdChecksum("testing")
+	if statsdClient() != client || len(readStatsd(conn)) == 0 {
+		t.Error("Every metric should be sent with the same client.")
+	}
+	defer func() { StatsdTags = []string{} }()
+	StatsdTags = []string{"team:sre"}
+	if statsdClient() == client {
+		t.Error("The client should be set up again when the tags change.")
+	}
+}
+
+func TestMetricsEnable(t *testing.T) {
+	MetricsEnable = []string{"kvexpress.checksum_mismatch", "panic"}
+	defer func() { MetricsEnable = []string{} }()
+	if MetricEnabled("kvexpress.out") {
+		t.Error("Only the enabled metrics should be sent.")
+	}
+	if !MetricEnabled("kvexpress.checksum_mismatch") || !MetricEnabled("kvexpress.panic") {
+		t.Error("The enabled metrics should be sent.")
+	}
+	MetricsDisable = []string{"does_not_exist"}
+	defer func() { MetricsDisable = []string{} }()
+	CheckMetricNames()
+	if !MetricEnabled("kvexpress.panic") {
+		t.Error("An unknown metric name shouldn't change anything.")
+	}
+}
+
+func TestDatadogURL(t *testing.T) {
+	for site, want := range map[string]string{
+		"datadoghq.eu":           "https://api.datadoghq.eu",
+		"api.us5.datadoghq.com":  "https://api.us5.datadoghq.com",
+		"http://localhost:8080/": "http://localhost:8080",
+	} {
+		if got := datadogURL(site); got != want {
+			t.Errorf("'%s' should be '%s' not '%s'", site, want, got)
+		}
+	}
+	defer func() { DatadogSite = "" }()
+	DatadogSite = "datadoghq.eu"
+	if url := DDAPIConnect("api", "app").GetBaseUrl(); url != "https://api.datadoghq.eu" {
+		t.Errorf("The client should use the EU site: '%s'", url)
+	}
+}
+
+func TestSetupDatadog(t *testing.T) {
+	file := ensureTestFile(t)
+	ioutil.WriteFile(file, []byte("from-file\n"), 0600)
+	defer func() {
+		DatadogAPIKey, DatadogAPPKey, DatadogAPIKeyFile, DatadogProxy = "", "", "", ""
+		os.Unsetenv("DD_APP_KEY")
+	}()
+	os.Setenv("DD_APP_KEY", "from-env")
+	DatadogAPIKey, DatadogAPIKeyFile = "from-flag", file
+	if err := SetupDatadog(); err != nil || DatadogAPIKey != "from-file" || DatadogAPPKey != "from-env" {
+		t.Errorf("The keys should come from the file and the environment: '%s' '%s' %v", DatadogAPIKey, DatadogAPPKey, err)
+	}
+	DatadogAPPKey = "from-flag"
+	if err := SetupDatadog(); err != nil || DatadogAPPKey != "from-flag" {
+		t.Errorf("A key that was passed should win over the environment: '%s' %v", DatadogAPPKey, err)
+	}
+	DatadogProxy = "not a proxy"
+	if err := SetupDatadog(); err == nil {
+		t.Error("A bad proxy should be an error.")
+	}
+}
+
+func TestDDOutEvent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvexpress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	TmpDir = dir
+	PrefixLocation = "testing"
+	defer func() { TmpDir, DatadogAPIKey, DatadogAPPKey = "", "", "" }()
+
+	if ddOutEvent("hosts", "stop") {
+		t.Error("There's no event without the API keys.")
+	}
+	DatadogAPIKey, DatadogAPPKey = "api", "app"
+	if !ddOutEvent("hosts", "stop") {
+		t.Error("The first stop should send an event.")
+	}
+	if ddOutEvent("hosts", "stop") {
+		t.Error("The same stop on the next run isn't a change.")
+	}
+	if !ddOutEvent("hosts", "checksum_mismatch") {
+		t.Error("A different problem should send its event.")
+	}
+	if ddOutEvent("hosts", "ok") {
+		t.Error("Getting past it doesn't send an event.")
+	}
+	if !ddOutEvent("hosts", "checksum_mismatch") {
+		t.Error("The problem coming back should send its event again.")
+	}
+	if !ddOutEvent("/etc/hosts", "locked") {
+		t.Error("Each file has a state of its own.")
+	}
+}
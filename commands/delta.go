@@ -0,0 +1,224 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/DataDog/kvexpress/pkg/kvexpress"
+	consul "github.com/hashicorp/consul/api"
+	"strings"
+	"time"
+)
+
+var (
+	// Delta saves large data with in as a base version and a delta from it -
+	// see SaveDelta.
+	Delta bool
+
+	// DeltaCompact is how much of the base can change before a new base is
+	// saved - 0.1 is once the delta touches a tenth of its lines.
+	DeltaCompact float64
+)
+
+// DeltaHunk replaces Delete lines of the base from line At with Insert.
+type DeltaHunk = kvexpress.DeltaHunk
+
+// splitDeltaLines splits data into lines that keep their newlines - so
+// putting them back together is the same data.
+func splitDeltaLines(data string) []string {
+	return kvexpress.SplitLines(data)
+}
+
+// DiffLines is the smallest set of hunks that turns a into b - with Myers'
+// algorithm, so it's quick when only a few lines changed. It's false if it
+// takes more than maxEdits lines.
+func DiffLines(a, b []string, maxEdits int) ([]DeltaHunk, bool) {
+	n, m := len(a), len(b)
+	limit := n + m
+	if maxEdits < limit {
+		limit = maxEdits
+	}
+	// v is the furthest x on each diagonal k - offset so -limit-1 fits.
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+	var trace [][]int
+	done := false
+	for d := 0; d <= limit && !done; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				done = true
+				break
+			}
+		}
+		// Only the diagonals this step could reach are kept.
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+	}
+	if !done {
+		return nil, false
+	}
+
+	// Walk back from the end - the edits come out last first.
+	type edit struct {
+		insert bool
+		x, y   int
+	}
+	var edits []edit
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		previous := trace[d-1]
+		k := x - y
+		previousK := k - 1
+		if k == -d || (k != d && previous[k-1+d] < previous[k+1+d]) {
+			previousK = k + 1
+		}
+		previousX := previous[previousK+d]
+		previousY := previousX - previousK
+		for x > previousX && y > previousY {
+			x--
+			y--
+		}
+		if x == previousX {
+			edits = append(edits, edit{insert: true, x: x, y: y - 1})
+		} else {
+			edits = append(edits, edit{x: x - 1})
+		}
+		x, y = previousX, previousY
+	}
+
+	var hunks []DeltaHunk
+	for i := len(edits) - 1; i >= 0; i-- {
+		e := edits[i]
+		if len(hunks) == 0 || e.x != hunks[len(hunks)-1].At+hunks[len(hunks)-1].Delete {
+			hunks = append(hunks, DeltaHunk{At: e.x})
+		}
+		hunk := &hunks[len(hunks)-1]
+		if e.insert {
+			hunk.Insert = append(hunk.Insert, b[e.y])
+		} else {
+			hunk.Delete++
+		}
+	}
+	return hunks, true
+}
+
+// ApplyDelta puts the hunks into base.
+func ApplyDelta(base string, hunks []DeltaHunk) (string, error) {
+	return kvexpress.ApplyDelta(base, hunks)
+}
+
+// deltaEdits is how many lines a delta adds and removes.
+func deltaEdits(hunks []DeltaHunk) int {
+	edits := 0
+	for _, hunk := range hunks {
+		edits += hunk.Delete + len(hunk.Insert)
+	}
+	return edits
+}
+
+// deltaDeleteOps remove the base and delta when key is saved another way.
+func deltaDeleteOps(key string) []*consul.TxnOp {
+	return []*consul.TxnOp{
+		{KV: &consul.KVTxnOp{Verb: consul.KVDelete, Key: KeyPath(key, "base")}},
+		{KV: &consul.KVTxnOp{Verb: consul.KVDelete, Key: KeyPath(key, "delta")}},
+	}
+}
+
+// SaveDelta saves data as a delta from the base that's in Consul - only the
+// small delta key changes, instead of all of the data. A new base is saved
+// when there isn't one or once the delta changes more than DeltaCompact of
+// its lines. The manifest has the checksums of the base and delta and is
+// switched with a check-and-set in the same transaction as them and the
+// checksum, updated and encoding keys. On a conflict it reads them again and
+// tries again with a backoff. It returns false if checksum was already saved.
+func SaveDelta(c *consul.Client, key, data, checksum, checksums string, extra ...*consul.TxnOp) (bool, error) {
+	KeyManifest := KeyPath(key, "manifest")
+	lines := splitDeltaLines(data)
+	backoff := casBackoff
+	for i := 1; i <= casTries; i++ {
+		_, storedChecksum, err := consulIndex(c, KeyPath(key, "checksum"))
+		if err != nil {
+			return false, err
+		}
+		if strings.TrimSpace(storedChecksum) == checksum {
+			Log(fmt.Sprintf("action='SaveDelta' key='%s' checksum='match' saved='false'", key), "info")
+			return false, nil
+		}
+		index, value, err := consulIndex(c, KeyManifest)
+		if err != nil {
+			return false, err
+		}
+		var base string
+		if current, err := parseManifest(value); err == nil && current != nil && current.Base != "" {
+			base, err = Get(c, KeyPath(key, "base"))
+			if err != nil {
+				return false, err
+			}
+			if ComputeChecksum(base) != current.Base {
+				base = ""
+			}
+		}
+		var hunks []DeltaHunk
+		compact := base == ""
+		if !compact {
+			baseLines := splitDeltaLines(base)
+			hunks, compact = DiffLines(baseLines, lines, int(DeltaCompact*float64(len(baseLines))))
+			compact = !compact
+		}
+		if compact {
+			base, hunks = data, []DeltaHunk{}
+		}
+		delta, _ := json.Marshal(hunks)
+		encoded, _ := json.Marshal(ChunkManifest{Size: len(data), Base: ComputeChecksum(base), Delta: ComputeChecksum(string(delta))})
+		ops := consul.TxnOps{
+			setOp(KeyPath(key, "delta"), string(delta)),
+			{KV: &consul.KVTxnOp{Verb: consul.KVCAS, Key: KeyManifest, Value: encoded, Index: index}},
+			setOp(KeyPath(key, "checksum"), checksum),
+			setOp(KeyPath(key, "updated"), ReturnCurrentUTC()),
+			setOp(KeyPath(key, "encoding"), StoredEncoding()),
+			checksumsOp(key, checksums),
+		}
+		owner, err := ownerOps(c, key)
+		if err != nil {
+			return false, err
+		}
+		ops = append(ops, owner...)
+		if compact {
+			// Whatever was saved before there was a base goes with it.
+			ops = append(ops,
+				setOp(KeyPath(key, "base"), base),
+				&consul.TxnOp{KV: &consul.KVTxnOp{Verb: consul.KVDelete, Key: KeyPath(key, "data")}},
+				&consul.TxnOp{KV: &consul.KVTxnOp{Verb: consul.KVDeleteTree, Key: KeyPath(key, "data") + "/"}},
+			)
+		}
+		ops = append(ops, extra...)
+		ok, err := kvTxn(c, ops)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			Log(fmt.Sprintf("action='SaveDelta' key='%s' compact='%t' hunks='%d' edits='%d' delta_bytes='%d' saved='true' tries='%d'", key, compact, len(hunks), deltaEdits(hunks), len(delta), i), "info")
+			StatsdDelta(key, compact, len(delta))
+			return true, nil
+		}
+		Log(fmt.Sprintf("action='SaveDelta' key='%s' conflict='true' tries='%d'", key, i), "info")
+		StatsdConsul(key, "cas_conflict")
+		if i < casTries {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return false, ErrCASConflict
+}
@@ -0,0 +1,95 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	cases := [][2]string{
+		{exampleData, exampleData},
+		{exampleData, strings.Replace(exampleData, "Multi", "Single", 1)},
+		{exampleData, "First\n" + exampleData + "Last"},
+		{exampleData, ""},
+		{"", exampleData},
+		{"a\nb\nc\nd\n", "d\nc\nb\na\n"},
+	}
+	for _, c := range cases {
+		hunks, ok := DiffLines(splitDeltaLines(c[0]), splitDeltaLines(c[1]), 100)
+		if !ok {
+			t.Fatalf("The delta from %q to %q should fit in 100 edits.", c[0], c[1])
+		}
+		if data, err := ApplyDelta(c[0], hunks); err != nil || data != c[1] {
+			t.Errorf("The delta from %q didn't make %q: %q %v", c[0], c[1], data, err)
+		}
+	}
+	hunks, _ := DiffLines(splitDeltaLines(exampleData), splitDeltaLines(strings.Replace(exampleData, "Multi", "Single", 1)), 100)
+	if len(hunks) != 1 || hunks[0].Delete != 1 || len(hunks[0].Insert) != 1 {
+		t.Errorf("One line changing should be a single hunk: %+v", hunks)
+	}
+	if _, ok := DiffLines(splitDeltaLines("a\nb\n"), splitDeltaLines("c\nd\n"), 3); ok {
+		t.Error("A delta with more than maxEdits lines should be false.")
+	}
+}
+
+func TestSaveDelta(t *testing.T) {
+	tc, c := newTestConsul(t)
+	PrefixLocation = "testing"
+	DeltaCompact = 0.5
+	defer func() { DeltaCompact = 0.1 }()
+	tc.put("testing/hosts/data", "old data")
+	if saved, err := SaveDelta(c, "hosts", exampleData, exampleDataSHA, ""); err != nil || !saved {
+		t.Fatalf("The data should be saved: %t %v", saved, err)
+	}
+	if base, _ := tc.value("testing/hosts/base"); base != exampleData {
+		t.Errorf("The first save should be the base: '%s'", base)
+	}
+	if _, ok := tc.value("testing/hosts/data"); ok {
+		t.Error("The data key should be removed with the first base.")
+	}
+
+	changed := strings.Replace(exampleData, "Multi", "Single", 1)
+	if _, err := SaveDelta(c, "hosts", changed, ComputeChecksum(changed), ""); err != nil {
+		t.Fatal(err)
+	}
+	if base, _ := tc.value("testing/hosts/base"); base != exampleData {
+		t.Errorf("A small change shouldn't save a new base: '%s'", base)
+	}
+	if delta, _ := tc.value("testing/hosts/delta"); !strings.Contains(delta, "Single") || strings.Contains(delta, "This") {
+		t.Errorf("The delta should only have the line that changed: '%s'", delta)
+	}
+	if data, err := GetData(c, "hosts"); err != nil || data != changed {
+		t.Errorf("The data should be put back together: '%s' %v", data, err)
+	}
+	if saved, _ := SaveDelta(c, "hosts", changed, ComputeChecksum(changed), ""); saved {
+		t.Error("The same checksum shouldn't be saved again.")
+	}
+
+	// Enough changes and the data is the new base.
+	if _, err := SaveDelta(c, "hosts", "All\nNew\nLines\n", ComputeChecksum("All\nNew\nLines\n"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if base, _ := tc.value("testing/hosts/base"); base != "All\nNew\nLines\n" {
+		t.Errorf("A large change should save a new base: '%s'", base)
+	}
+	if delta, _ := tc.value("testing/hosts/delta"); delta != "[]" {
+		t.Errorf("A new base has an empty delta: '%s'", delta)
+	}
+
+	// A delta that doesn't go with the manifest is never used.
+	tc.put("testing/hosts/delta", `[{"at":0,"delete":1}]`)
+	if _, err := GetData(c, "hosts"); err == nil {
+		t.Error("A delta that doesn't match the manifest should be an error.")
+	}
+
+	// Saving it the old way removes the base and delta.
+	SaveCAS(c, "hosts", exampleData, exampleDataSHA, "")
+	if _, ok := tc.value("testing/hosts/base"); ok {
+		t.Error("The base should be removed.")
+	}
+	if data, _ := GetData(c, "hosts"); data != exampleData {
+		t.Errorf("The data should be read from the data key: '%s'", data)
+	}
+}
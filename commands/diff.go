@@ -0,0 +1,116 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"time"
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff",
+	Short: "Show what out would change in a file.",
+	Long:  `Diff is for comparing the data in a kvexpress key with a file - it exits with 1 if they're different.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		checkDiffFlags()
+		AutoEnable()
+	},
+	Run: diffRun,
+}
+
+func diffRun(cmd *cobra.Command, args []string) {
+	start := time.Now()
+
+	c, err := Connect(ConsulServer, Token)
+	if err != nil {
+		LogFatal("Could not connect to Consul.", KeyDiffLocation, "consul_connect")
+	}
+
+	KVData, err := GetData(c, KeyDiffLocation)
+	if err != nil {
+		fmt.Printf("Could not get the data: %v\n", err)
+		os.Exit(2)
+	}
+	if KVData, err = DecodeData(c, KeyDiffLocation, KVData); err != nil {
+		fmt.Printf("Could not decompress the data: %v\n", err)
+		os.Exit(2)
+	}
+	Checksum, err := GetChecksum(c, KeyDiffLocation)
+	if err != nil {
+		fmt.Printf("Could not get the checksum: %v\n", err)
+		os.Exit(2)
+	}
+	if !ChecksumCompare(KVData, Checksum) {
+		fmt.Println("Warning: the data does not match its checksum - out would not write it.")
+	}
+
+	diff, different, err := DiffData(FiletoDiff, KVData, KeyPath(KeyDiffLocation, "data"))
+	if err != nil {
+		fmt.Printf("Could not diff '%s': %v\n", FiletoDiff, err)
+		os.Exit(2)
+	}
+	// The file and the key can both have secrets in them.
+	fmt.Print(Redact(diff))
+	Log(fmt.Sprintf("diff key='%s' file='%s' different='%t'", KeyDiffLocation, FiletoDiff, different), "info")
+	RunTime(start, KeyDiffLocation, "diff")
+	if different {
+		os.Exit(1)
+	}
+}
+
+// DiffData returns a unified diff from file to data and whether they're
+// different. A file that doesn't exist is diffed as if it were empty.
+func DiffData(file, data, label string) (string, bool, error) {
+	tmp, err := ioutil.TempFile(ScratchDir(), "kvexpress-diff")
+	if err != nil {
+		return "", false, err
+	}
+	defer os.Remove(tmp.Name())
+	tmp.WriteString(data)
+	tmp.Close()
+
+	old := file
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		old = os.DevNull
+	}
+	output, err := exec.CommandContext(RunContext(), "diff", "-u", "--label", file, "--label", label, old, tmp.Name()).Output()
+	// diff exits with 1 when the files are different and 2 when there's trouble.
+	switch ExecStatus(err) {
+	case 0:
+		return "", false, nil
+	case 1:
+		return string(output), true, nil
+	}
+	return "", false, err
+}
+
+func checkDiffFlags() {
+	Log("Checking cli flags.", "debug")
+	if KeyDiffLocation == "" {
+		fmt.Println("Need a key location in -k")
+		os.Exit(2)
+	}
+	if FiletoDiff == "" {
+		fmt.Println("Need a file to compare in -f")
+		os.Exit(2)
+	}
+	Log("Required cli flags present.", "debug")
+}
+
+var (
+	// KeyDiffLocation is the key to compare with the file.
+	KeyDiffLocation string
+
+	// FiletoDiff is the file to compare with the key.
+	FiletoDiff string
+)
+
+func init() {
+	RootCmd.AddCommand(diffCmd)
+	diffCmd.Flags().StringVarP(&KeyDiffLocation, "key", "k", "", "key to compare")
+	diffCmd.Flags().StringVarP(&FiletoDiff, "file", "f", "", "file to compare")
+}
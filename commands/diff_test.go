@@ -0,0 +1,35 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestDiffData(t *testing.T) {
+	file := ensureTestFile(t)
+	ioutil.WriteFile(file, []byte(exampleData), 0640)
+
+	diff, different, err := DiffData(file, exampleData, "testing/diff/data")
+	if err != nil || different || diff != "" {
+		t.Errorf("The same data should not be different: '%s' %v", diff, err)
+	}
+
+	diff, different, err = DiffData(file, strings.Replace(exampleData, "Multi\n", "Many\n", 1), "testing/diff/data")
+	if err != nil || !different {
+		t.Fatalf("Changed data should be different: %v", err)
+	}
+	if !strings.Contains(diff, "-Multi\n+Many\n") || !strings.Contains(diff, "+++ testing/diff/data") {
+		t.Errorf("The diff is wrong: '%s'", diff)
+	}
+}
+
+func TestDiffDataMissingFile(t *testing.T) {
+	file := ensureTestFile(t)
+	diff, different, err := DiffData(file, exampleData, "testing/diff/data")
+	if err != nil || !different || !strings.Contains(diff, "+Testing.") {
+		t.Errorf("A missing file should show all of the data as added: '%s' %v", diff, err)
+	}
+}
@@ -0,0 +1,277 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+var editCmd = &cobra.Command{
+	Use:   "edit",
+	Short: "Edit a key's data in $EDITOR.",
+	Long:  `Edit opens the key's data in $VISUAL or $EDITOR, checks the result the way in would and saves it back with its checksum and meta key in a single transaction.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		checkEditFlags()
+		AutoEnable()
+	},
+	Run: editRun,
+}
+
+var (
+	// errEditRejected is an edit that isn't saved - the edited file is kept so
+	// it isn't lost.
+	errEditRejected = errors.New("the edit wasn't saved")
+
+	// errEditStopped is a key with a stop key - it isn't edited, or the edit
+	// isn't saved if the stop key was set while it was being edited.
+	errEditStopped = errors.New("the stop key is present")
+)
+
+func editRun(cmd *cobra.Command, args []string) {
+	start := time.Now()
+	c, err := Connect(ConsulServer, Token)
+	if err != nil {
+		LogFatal("Could not connect to Consul.", KeyEditLocation, "consul_connect")
+	}
+	saved, err := EditKey(c, KeyEditLocation, runEditor)
+	if errors.Is(err, errEditStopped) {
+		Log(fmt.Sprintf("edit key='%s' message='%v' - stopping.", KeyEditLocation, err), "info")
+		fmt.Println(err)
+		exitRun(ExitStopped, start, KeyEditLocation, "stop_key", err.Error())
+	}
+	if errors.Is(err, errEditRejected) {
+		fmt.Println(err)
+		exitRun(ExitRejected, start, KeyEditLocation, "edit_rejected", "")
+	}
+	ExitOnError(err, KeyEditLocation, "edit")
+	if !saved && DryRun {
+		RunTime(start, KeyEditLocation, "dry_run")
+		return
+	}
+	if !saved {
+		fmt.Printf("Nothing changed in '%s'.\n", KeyEditLocation)
+		exitRun(ExitNoChange, start, KeyEditLocation, "consul_checksums_match", "")
+	}
+	fmt.Printf("Saved '%s'.\n", KeyEditLocation)
+	if status := RunHooks(Hook{Event: HookChange, Key: KeyEditLocation}); status != 0 {
+		exitExecFailed(status, KeyEditLocation)
+	}
+	RunTime(start, KeyEditLocation, "complete")
+}
+
+// EditKey writes key's data to a file, runs edit on it and saves what it
+// left there. The edit is checked like in checks a file and only saved if the
+// key wasn't changed while it was being edited - it's saved with a CAS on the
+// indexes the data was read at. A stop key stops it before the editor is
+// opened or before it's saved. It returns false if the data is the same.
+func EditKey(c *consul.Client, key string, edit func(file string) error) (bool, error) {
+	if !atomicWrites() {
+		return false, fmt.Errorf("edit needs a backend with transactions - not --backend %s", Backend)
+	}
+	if err := checkEditStop(c, key); err != nil {
+		return false, err
+	}
+	dataIndex, _, err := consulIndex(c, KeyPath(key, "data"))
+	if err != nil {
+		return false, err
+	}
+	checksumIndex, _, err := consulIndex(c, KeyPath(key, "checksum"))
+	if err != nil {
+		return false, err
+	}
+	data, err := GetData(c, key)
+	if err != nil {
+		return false, err
+	}
+	data, encoding, err := DecodeKeyData(c, key, data)
+	if err != nil {
+		return false, err
+	}
+	if BinaryEncoding(encoding) {
+		return false, fmt.Errorf("'%s' has binary data - it can't be edited", key)
+	}
+	checksum, err := GetChecksum(c, key)
+	if err != nil {
+		return false, err
+	}
+	checksum = strings.TrimSpace(checksum)
+	if checksum != "" && !ChecksumCompare(data, checksum) {
+		return false, fmt.Errorf("the data in '%s' does not match the checksum - see repair", key)
+	}
+
+	// The data can have secrets in it so the files are only readable by us.
+	old, file := RandomTmpFile(), RandomTmpFile()
+	keep := false
+	defer func() {
+		os.Remove(old)
+		if !keep {
+			os.Remove(file)
+		}
+	}()
+	if err := ioutil.WriteFile(old, []byte(data), 0600); err != nil {
+		return false, err
+	}
+	if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+		return false, err
+	}
+	if err := edit(file); err != nil {
+		return false, fmt.Errorf("the editor failed: %v", err)
+	}
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false, err
+	}
+	// rejected keeps the file and says where it is.
+	rejected := func(format string, args ...interface{}) (bool, error) {
+		keep = true
+		return false, fmt.Errorf("%w: %s - the edit is in '%s'", errEditRejected, fmt.Sprintf(format, args...), file)
+	}
+	edited, err := normalizeInData(string(raw))
+	if err != nil {
+		return rejected("%v", err)
+	}
+	edited = sortInLines(edited)
+	if ComputeChecksum(edited) == ComputeChecksum(data) {
+		Log(fmt.Sprintf("edit key='%s' checksum='match' saved='false'", key), "info")
+		return false, nil
+	}
+	// The file has what would be saved - for --validate-exec and the diff.
+	if err := ioutil.WriteFile(file, []byte(edited), 0600); err != nil {
+		return false, err
+	}
+	minLength, maxLength := lineLimits(false)
+	if !LengthCheck(edited, minLength) {
+		return rejected("it has %d lines - need %d", LineCount(edited), minLength)
+	}
+	if err := SizeCheck(edited, maxLength, MaxFileBytes); err != nil {
+		return rejected("it's %v", err)
+	}
+	if ValidateType != "" {
+		if err := ValidateContent(edited, ValidateType); err != nil {
+			return rejected("it isn't valid %s: %v", ValidateType, err)
+		}
+	}
+	if ValidateExec != "" {
+		if err := ValidateFile(ValidateExec, file); err != nil {
+			return rejected("%v", err)
+		}
+	}
+	stored, err := EncodeData(key, edited)
+	if err != nil {
+		return false, err
+	}
+	if !singleTxn(len(stored)) {
+		return rejected("it's %d bytes and has to fit in a single key and transaction - --chunk-size is %d", len(stored), ChunkSize)
+	}
+	current, err := GetChecksum(c, key)
+	if err != nil {
+		return false, err
+	}
+	if strings.TrimSpace(current) != checksum {
+		return rejected("'%s' was changed while it was being edited", key)
+	}
+	if err := checkEditStop(c, key); err != nil {
+		keep = true
+		return false, fmt.Errorf("%w - the edit is in '%s'", err, file)
+	}
+	diff := UnixDiff(old, file)
+	newChecksum := StoreChecksum(edited)
+	if DryRunSkip(fmt.Sprintf("save '%s' size='%d' checksum='%s'", KeyPath(key, "data"), len(stored), newChecksum)) {
+		fmt.Print(Redact(diff))
+		return false, nil
+	}
+	extra := []*consul.TxnOp{metaOp(key, "edit:"+GetCurrentUsername())}
+	var signature string
+	if signingKey != nil {
+		signature = SignKeyData(signingKey, key, newChecksum, edited)
+		extra = append(extra, setOp(KeyPath(key, "signature"), signature))
+	} else {
+		// A signature for the old data would stop a --verify-key consumer.
+		extra = append(extra, &consul.TxnOp{KV: &consul.KVTxnOp{Verb: consul.KVDelete, Key: KeyPath(key, "signature")}})
+	}
+	if Rolling {
+		extra = append(extra, setOp(KeyPath(key, "rolling"), RollingHash(edited)))
+	}
+	oldSize := auditKeyBytes(c, key)
+	saved, err := saveCASAt(c, key, stored, newChecksum, StoreChecksums(edited), StoredEncoding(), dataIndex, checksumIndex, extra...)
+	if err != nil {
+		return false, err
+	}
+	if !saved {
+		return rejected("'%s' was changed while it was being edited", key)
+	}
+	Log(fmt.Sprintf("edit key='%s' checksum='%s' saved='true'", key, newChecksum), "info")
+	Audit(AuditRecord{Event: AuditKey, Key: key, OldChecksum: checksum, NewChecksum: newChecksum, ByteDelta: len(stored) - oldSize})
+	StatsdIn(key, len(stored), stored)
+	if HistoryKeep > 0 {
+		if err := SaveHistory(c, key, stored, newChecksum, signature, diff, HistoryKeep); err != nil {
+			Log(fmt.Sprintf("history key='%s' saved='false' message='%v'", key, err), "info")
+		}
+	}
+	return true, nil
+}
+
+// checkEditStop returns errEditStopped if key has a stop key.
+func checkEditStop(c *consul.Client, key string) error {
+	reason, err := Get(c, KeyPath(key, "stop"))
+	if err != nil {
+		return err
+	}
+	if reason != "" {
+		return fmt.Errorf("%w for '%s': %s", errEditStopped, key, reason)
+	}
+	return nil
+}
+
+// runEditor opens file in $VISUAL or $EDITOR - vi if neither is set.
+func runEditor(file string) error {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	parts := strings.Fields(editor)
+	// It isn't stopped by --timeout - someone's typing.
+	cmd := exec.Command(parts[0], append(parts[1:], file)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+func checkEditFlags() {
+	Log("Checking cli flags.", "debug")
+	if KeyEditLocation == "" {
+		fmt.Println("Need a key location in -k")
+		os.Exit(1)
+	}
+	loadSignKey()
+	checkSortFlags()
+	checkValidateFlag()
+	Log("Required cli flags present.", "debug")
+}
+
+var (
+	// KeyEditLocation is the key to edit.
+	KeyEditLocation string
+)
+
+func init() {
+	RootCmd.AddCommand(editCmd)
+	editCmd.Flags().StringVarP(&KeyEditLocation, "key", "k", "", "key to edit")
+	editCmd.Flags().BoolVarP(&Sorted, "sorted", "S", false, "sort the edited file")
+	editCmd.Flags().StringVarP(&SortMode, "sort", "", "", "how to sort the lines - none, lexical, numeric or version")
+	editCmd.Flags().BoolVarP(&Unique, "unique", "", false, "remove duplicate lines")
+	editCmd.Flags().StringVarP(&ValidateExec, "validate-exec", "", "", "command to check the file - gets the file as $1 and on stdin")
+	editCmd.Flags().StringVarP(&ValidateType, "validate", "", "", "check that the data is valid json, yaml or csv")
+	editCmd.Flags().StringVarP(&SignKey, "sign-key", "", "", "ed25519 private key to sign the data with")
+	editCmd.Flags().IntVarP(&HistoryKeep, "history", "", 10, "versions of the key to keep - 0 keeps none")
+}
@@ -0,0 +1,101 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestEditKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvexpress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tc, c := newTestConsul(t)
+	PrefixLocation = "testing"
+	TmpDir = dir
+	MinFileLength = 1
+	defer func() { TmpDir, MinFileLength = "", 10 }()
+	tc.put("testing/hosts/data", "10.0.0.1 web1\n")
+	tc.put("testing/hosts/checksum", ComputeChecksum("10.0.0.1 web1\n"))
+	tc.put("testing/hosts/signature", "old signature")
+
+	edit := func(text string) func(string) error {
+		return func(file string) error { return ioutil.WriteFile(file, []byte(text), 0600) }
+	}
+	saved, err := EditKey(c, "hosts", edit("10.0.0.1 web1\n10.0.0.2 web2\n"))
+	if err != nil || !saved {
+		t.Fatalf("The edit should be saved: %v %v", saved, err)
+	}
+	if data, _ := tc.value("testing/hosts/data"); data != "10.0.0.1 web1\n10.0.0.2 web2\n" {
+		t.Errorf("The edited data should be saved: %q", data)
+	}
+	if checksum, _ := tc.value("testing/hosts/checksum"); checksum != ComputeChecksum("10.0.0.1 web1\n10.0.0.2 web2\n") {
+		t.Errorf("The checksum should be the edited data's: %q", checksum)
+	}
+	if meta, ok := tc.value("testing/hosts/meta"); !ok || meta == "" {
+		t.Error("The meta key should be saved with the data.")
+	}
+	if _, ok := tc.value("testing/hosts/signature"); ok {
+		t.Error("The old signature doesn't match the edited data - it should be removed.")
+	}
+
+	// Quitting without changing anything doesn't save it.
+	if saved, err := EditKey(c, "hosts", func(string) error { return nil }); err != nil || saved {
+		t.Errorf("Nothing should be saved when nothing changed: %v %v", saved, err)
+	}
+
+	// A bad edit is kept so it isn't lost.
+	ValidateType = "json"
+	defer func() { ValidateType = "" }()
+	_, err = EditKey(c, "hosts", edit("{not json\n"))
+	if !errors.Is(err, errEditRejected) {
+		t.Fatalf("An edit that isn't valid shouldn't be saved: %v", err)
+	}
+	if data, _ := tc.value("testing/hosts/data"); data != "10.0.0.1 web1\n10.0.0.2 web2\n" {
+		t.Errorf("The data shouldn't change: %q", data)
+	}
+	ValidateType = ""
+
+	// Someone else saved the key in the meantime.
+	_, err = EditKey(c, "hosts", func(file string) error {
+		tc.put("testing/hosts/checksum", "sha256:someone-else")
+		return ioutil.WriteFile(file, []byte("10.0.0.3 web3\n"), 0600)
+	})
+	if !errors.Is(err, errEditRejected) {
+		t.Errorf("An edit of a key that changed shouldn't be saved: %v", err)
+	}
+	tc.put("testing/hosts/checksum", ComputeChecksum("10.0.0.1 web1\n10.0.0.2 web2\n"))
+
+	// The data changed without its checksum - the CAS on the indexes read stops it.
+	_, err = EditKey(c, "hosts", func(file string) error {
+		tc.put("testing/hosts/data", "10.0.0.1 web1\n10.0.0.2 web2\n")
+		return ioutil.WriteFile(file, []byte("10.0.0.4 web4\n"), 0600)
+	})
+	if !errors.Is(err, errEditRejected) {
+		t.Errorf("An edit of a key that changed after it was read shouldn't be saved: %v", err)
+	}
+	if data, _ := tc.value("testing/hosts/data"); data != "10.0.0.1 web1\n10.0.0.2 web2\n" {
+		t.Errorf("The data shouldn't change: %q", data)
+	}
+
+	// A stop key set while it's being edited stops the save.
+	_, err = EditKey(c, "hosts", func(file string) error {
+		tc.put("testing/hosts/stop", "maintenance")
+		return ioutil.WriteFile(file, []byte("10.0.0.5 web5\n"), 0600)
+	})
+	if !errors.Is(err, errEditStopped) {
+		t.Errorf("An edit shouldn't be saved after a stop key is set: %v", err)
+	}
+
+	// And a stop key that's there stops it before the editor is opened.
+	opened := false
+	_, err = EditKey(c, "hosts", func(string) error { opened = true; return nil })
+	if !errors.Is(err, errEditStopped) || opened {
+		t.Errorf("A key with a stop key shouldn't be edited: %v %v", err, opened)
+	}
+}
@@ -0,0 +1,136 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/DataDog/kvexpress/pkg/kvexpress"
+	consul "github.com/hashicorp/consul/api"
+	"strings"
+)
+
+const (
+	// EncodingGzip is data that's been gzipped and base64 encoded with CompressData.
+	EncodingGzip = kvexpress.EncodingGzip
+
+	// EncodingNone is data that's stored as is.
+	EncodingNone = kvexpress.EncodingNone
+
+	// EncodingBase64 is binary data that's been base64 encoded with --binary.
+	EncodingBase64 = kvexpress.EncodingBase64
+
+	// EncodingBinaryGzip is binary data that's been gzipped and base64 encoded
+	// with --binary and --compress.
+	EncodingBinaryGzip = kvexpress.EncodingBinaryGzip
+)
+
+// CompressValue is the --compress for a config value - gzip and none, or true
+// and false. gzip is the only compression there is, so zstd or anything else
+// is an error rather than data that's quietly saved uncompressed.
+func CompressValue(value string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case EncodingGzip, "true":
+		return "true", nil
+	case EncodingNone, "false", "":
+		return "false", nil
+	}
+	return "", fmt.Errorf("--compress '%s' isn't supported - only gzip is", value)
+}
+
+// DataEncoding is how this run stores data - it's saved in
+// KeyPath(key, "encoding") so out can decode it without being told.
+func DataEncoding() string {
+	return dataEncoding(Binary)
+}
+
+// dataEncoding is DataEncoding for data that's binary or not - copy keeps the
+// source key's.
+func dataEncoding(binary bool) string {
+	switch {
+	case binary && Compress:
+		return EncodingBinaryGzip
+	case binary:
+		return EncodingBase64
+	case Compress:
+		return EncodingGzip
+	}
+	return EncodingNone
+}
+
+// StoredEncoding is what's saved in KeyPath(key, "encoding") - DataEncoding
+// and the encryption scheme after a + if the data is encrypted, like
+// gzip+aes-gcm.
+func StoredEncoding() string {
+	return storedEncoding(Binary)
+}
+
+// storedEncoding is StoredEncoding for data that's binary or not.
+func storedEncoding(binary bool) string {
+	if encryption == nil {
+		return dataEncoding(binary)
+	}
+	return dataEncoding(binary) + "+" + encryption.Scheme()
+}
+
+// BinaryEncoding is true for the encodings that --binary saves data with.
+func BinaryEncoding(encoding string) bool {
+	return kvexpress.BinaryEncoding(encoding)
+}
+
+// EncodeData compresses or base64 encodes and then encrypts data for key if
+// this run stores it that way.
+func EncodeData(key, data string) (string, error) {
+	return encodeData(key, data, Binary)
+}
+
+// encodeData is EncodeData for data that's binary or not.
+func encodeData(key, data string, binary bool) (string, error) {
+	switch {
+	case Compress:
+		data = CompressData(data)
+	case binary:
+		data = base64.StdEncoding.EncodeToString([]byte(data))
+	}
+	return EncryptData(key, data)
+}
+
+// SetEncoding saves the encoding for key.
+func SetEncoding(c *consul.Client, key string) error {
+	return Set(c, KeyPath(key, "encoding"), StoredEncoding())
+}
+
+// DecodeData decrypts and decodes the stored data for key using the encoding
+// that was saved with it. Data saved before there was an encoding key falls
+// back to --compress.
+func DecodeData(c *consul.Client, key, data string) (string, error) {
+	data, _, err := DecodeKeyData(c, key, data)
+	return data, err
+}
+
+// DecodeKeyData is DecodeData that also returns the encoding as it's saved -
+// so the data can be checked as binary when it was saved with --binary, and
+// saved somewhere else the same way. It's decoded with kvexpress.Decode, the
+// same as the library's Load.
+func DecodeKeyData(c *consul.Client, key, data string) (string, string, error) {
+	stored, err := Get(c, KeyPath(key, "encoding"))
+	if err != nil {
+		return "", "", err
+	}
+	stored = strings.TrimSpace(stored)
+	if stored == "" {
+		stored = DataEncoding()
+	}
+	Log(fmt.Sprintf("action='DecodeData' key='%s' encoding='%s'", key, stored), "debug")
+	data, err = kvexpress.Decode(key, data, stored, DecryptData)
+	return data, stored, err
+}
+
+// lineLimits are the -l and --max-length to check data with - binary data
+// doesn't have lines so only --max-bytes applies to it.
+func lineLimits(binary bool) (int, int) {
+	if binary || Binary {
+		return 0, 0
+	}
+	return MinFileLength, MaxFileLength
+}
@@ -0,0 +1,92 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"testing"
+)
+
+func TestDecodeData(t *testing.T) {
+	tc, c := newTestConsul(t)
+	PrefixLocation = "testing"
+	t.Cleanup(func() { Compress = false })
+
+	// The encoding key wins over --compress.
+	tc.put("testing/gzipped/encoding", EncodingGzip)
+	if data, err := DecodeData(c, "gzipped", CompressData(exampleData)); err != nil || data != exampleData {
+		t.Errorf("The gzipped data was not decoded: %q %v", data, err)
+	}
+	tc.put("testing/plain/encoding", EncodingNone)
+	Compress = true
+	if data, err := DecodeData(c, "plain", exampleData); err != nil || data != exampleData {
+		t.Errorf("The plain data should not be decoded: %q %v", data, err)
+	}
+
+	// Without an encoding key it falls back to --compress.
+	if data, err := DecodeData(c, "old", CompressData(exampleData)); err != nil || data != exampleData {
+		t.Errorf("The data was not decoded with --compress: %q %v", data, err)
+	}
+
+	tc.put("testing/zstd/encoding", "zstd")
+	if _, err := DecodeData(c, "zstd", exampleData); err == nil {
+		t.Error("An unknown encoding should be an error.")
+	}
+}
+
+func TestSetEncoding(t *testing.T) {
+	tc, c := newTestConsul(t)
+	PrefixLocation = "testing"
+	t.Cleanup(func() { Compress = false })
+	Compress = true
+	if err := SetEncoding(c, "gzipped"); err != nil {
+		t.Fatal(err)
+	}
+	if encoding, _ := tc.value("testing/gzipped/encoding"); encoding != EncodingGzip {
+		t.Errorf("The encoding should be gzip: %q", encoding)
+	}
+	if data, _ := EncodeData("gzipped", exampleData); data == exampleData {
+		t.Error("The data should be compressed.")
+	}
+}
+
+func TestCompressValue(t *testing.T) {
+	for value, expected := range map[string]string{"gzip": "true", "true": "true", "none": "false", "false": "false"} {
+		if compress, err := CompressValue(value); err != nil || compress != expected {
+			t.Errorf("compress: %s should be %s: %s %v", value, expected, compress, err)
+		}
+	}
+	if _, err := CompressValue("zstd"); err == nil {
+		t.Error("zstd isn't supported - it should be an error, not uncompressed data.")
+	}
+}
+
+func TestBinaryData(t *testing.T) {
+	tc, c := newTestConsul(t)
+	PrefixLocation = "testing"
+	t.Cleanup(func() { Binary, Compress = false, false })
+	binary := "\x00\x01\xff\r\n\x00tar"
+	for _, compress := range []bool{false, true} {
+		Binary, Compress = true, compress
+		encoded, err := EncodeData("cert", binary)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := SetEncoding(c, "cert"); err != nil {
+			t.Fatal(err)
+		}
+		Binary, Compress = false, false
+		data, encoding, err := DecodeKeyData(c, "cert", encoded)
+		if err != nil || data != binary {
+			t.Errorf("The binary data didn't survive compress=%t: %q %v", compress, data, err)
+		}
+		if !BinaryEncoding(encoding) {
+			t.Errorf("The encoding should be binary: %q", encoding)
+		}
+		if stored, _ := tc.value("testing/cert/encoding"); stored != encoding {
+			t.Errorf("The saved encoding is wrong: %q", stored)
+		}
+	}
+	if min, max := lineLimits(true); min != 0 || max != 0 {
+		t.Errorf("Binary data shouldn't have line checks: %d %d", min, max)
+	}
+}
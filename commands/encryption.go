@@ -0,0 +1,295 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrNotEncrypted is returned when encryption is on but the stored data isn't
+// encrypted - it wasn't saved by a producer with the same key.
+var ErrNotEncrypted = errors.New("the data is not encrypted")
+
+// aesPrefix marks data encrypted with --encrypt-key. Vault's transit
+// ciphertext already starts with vault:.
+const (
+	aesPrefix   = "kvexpress:aes-gcm:"
+	vaultPrefix = "vault:"
+)
+
+// The encryption schemes - saved after a + in <key>/encoding.
+const (
+	SchemeAES   = "aes-gcm"
+	SchemeVault = "vault"
+)
+
+// dataCipher encrypts data before it's saved and decrypts it when it's read.
+// The aad is the key the data is for - data moved to another key doesn't
+// decrypt.
+type dataCipher interface {
+	Scheme() string
+	Encrypt(plaintext, aad string) (string, error)
+	Decrypt(ciphertext, aad string) (string, error)
+}
+
+// encryption is nil when the data isn't encrypted.
+var encryption dataCipher
+
+// SetupEncryption picks the cipher from --encrypt-key or --encrypt-vault.
+func SetupEncryption() error {
+	switch {
+	case EncryptKey != "" && EncryptVault != "":
+		return errors.New("use --encrypt-key or --encrypt-vault - not both")
+	case EncryptKey != "":
+		aead, err := LoadEncryptionKey(EncryptKey)
+		if err != nil {
+			return err
+		}
+		encryption = aesCipher{aead: aead}
+		Log(fmt.Sprintf("encryption='aes-gcm' key='%s'", EncryptKey), "debug")
+	case EncryptVault != "":
+		encryption = newVaultTransit(EncryptVault)
+		Log(fmt.Sprintf("encryption='vault' key='%s'", EncryptVault), "debug")
+	default:
+		encryption = nil
+	}
+	return nil
+}
+
+// encryptedKey is the key data in key is encrypted for - its canary, staged
+// data and saved versions are the key's data too, so they can be switched in
+// as they are.
+func encryptedKey(key string) string {
+	key = strings.Trim(key, "/")
+	if i := strings.LastIndex(key, "/history/"); i >= 0 {
+		key = key[:i]
+	}
+	return signedKey(key)
+}
+
+// encryptionAAD binds the data to the key it's saved in - the full path with
+// the prefix.
+func encryptionAAD(key string) string {
+	return KeyPath(encryptedKey(key), "data")
+}
+
+// EncryptData encrypts the data for key if encryption is on.
+func EncryptData(key, data string) (string, error) {
+	if encryption == nil {
+		return data, nil
+	}
+	return encryption.Encrypt(data, encryptionAAD(key))
+}
+
+// DecryptData decrypts the data in key with scheme - the one saved in its
+// encoding. Encrypted data without a key, plain data with one and data that
+// was encrypted another way are all errors - none of them should end up in a
+// file. The scheme picks how it's decrypted, not what the data looks like.
+func DecryptData(key, data, scheme string) (string, error) {
+	encrypted := strings.HasPrefix(data, aesPrefix) || strings.HasPrefix(data, vaultPrefix)
+	switch {
+	case encryption == nil && scheme == "" && !encrypted:
+		return data, nil
+	case encryption == nil:
+		return "", errors.New("the data is encrypted - pass --encrypt-key or --encrypt-vault")
+	case scheme == "" && encrypted:
+		return "", fmt.Errorf("the data in '%s' was encrypted without its key - save it again with this version of in", key)
+	case scheme == "":
+		return "", ErrNotEncrypted
+	case scheme != encryption.Scheme():
+		return "", fmt.Errorf("the data in '%s' is encrypted with %s - not %s", key, scheme, encryption.Scheme())
+	}
+	return encryption.Decrypt(data, encryptionAAD(key))
+}
+
+// LoadEncryptionKey reads a base64 encoded AES key - 32 bytes for AES-256, the
+// kind made by `openssl rand -base64 32`.
+func LoadEncryptionKey(file string) (cipher.AEAD, error) {
+	encoded, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return nil, fmt.Errorf("could not decode '%s': %v", file, err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("'%s' is not an AES key: %v", file, err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// aesCipher is AES-GCM with a key from --encrypt-key.
+type aesCipher struct {
+	aead cipher.AEAD
+}
+
+// Scheme is aes-gcm.
+func (a aesCipher) Scheme() string {
+	return SchemeAES
+}
+
+// Encrypt seals the data with a random nonce that's saved in front of it.
+func (a aesCipher) Encrypt(plaintext, aad string) (string, error) {
+	nonce := make([]byte, a.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := a.aead.Seal(nonce, nonce, []byte(plaintext), []byte(aad))
+	return aesPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens data sealed by Encrypt.
+func (a aesCipher) Decrypt(ciphertext, aad string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(ciphertext, aesPrefix))
+	if err != nil {
+		return "", fmt.Errorf("could not decode the encrypted data: %v", err)
+	}
+	size := a.aead.NonceSize()
+	if len(sealed) < size {
+		return "", errors.New("the encrypted data is too short")
+	}
+	plaintext, err := a.aead.Open(nil, sealed[:size], sealed[size:], []byte(aad))
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt the data: %v", err)
+	}
+	return string(plaintext), nil
+}
+
+// vaultTransit encrypts with a key in Vault's transit secrets engine.
+type vaultTransit struct {
+	addr   string
+	token  string
+	key    string
+	client *http.Client
+}
+
+// newVaultTransit uses --vault-addr and --vault-token - or VAULT_ADDR and
+// VAULT_TOKEN if they weren't passed.
+func newVaultTransit(key string) vaultTransit {
+	addr, token := vaultConfig()
+	return vaultTransit{
+		addr:   addr,
+		token:  token,
+		key:    key,
+		client: cancelClient(&http.Client{Timeout: 10 * time.Second}),
+	}
+}
+
+// vaultConfig returns the Vault server and token from --vault-addr and
+// --vault-token - or VAULT_ADDR and VAULT_TOKEN if they weren't passed.
+func vaultConfig() (string, string) {
+	addr := VaultAddr
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	if addr == "" {
+		addr = "https://127.0.0.1:8200"
+	}
+	token := VaultToken
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	return strings.TrimSuffix(addr, "/"), token
+}
+
+// Scheme is vault.
+func (v vaultTransit) Scheme() string {
+	return SchemeVault
+}
+
+// Encrypt sends the data to transit/encrypt - the aad goes in its
+// associated_data.
+func (v vaultTransit) Encrypt(plaintext, aad string) (string, error) {
+	var resp struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	body := map[string]string{"plaintext": base64.StdEncoding.EncodeToString([]byte(plaintext)), "associated_data": base64.StdEncoding.EncodeToString([]byte(aad))}
+	if err := v.post("encrypt", body, &resp); err != nil {
+		return "", err
+	}
+	return resp.Data.Ciphertext, nil
+}
+
+// Decrypt sends the data to transit/decrypt.
+func (v vaultTransit) Decrypt(ciphertext, aad string) (string, error) {
+	var resp struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	if err := v.post("decrypt", map[string]string{"ciphertext": ciphertext, "associated_data": base64.StdEncoding.EncodeToString([]byte(aad))}, &resp); err != nil {
+		return "", err
+	}
+	plaintext, err := base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+	if err != nil {
+		return "", fmt.Errorf("could not decode the Vault plaintext: %v", err)
+	}
+	return string(plaintext), nil
+}
+
+// post calls transit/<action>/<key> and decodes the response into out.
+func (v vaultTransit) post(action string, body map[string]string, out interface{}) error {
+	return vaultCall(v.client, v.addr, v.token, "POST", fmt.Sprintf("transit/%s/%s", action, v.key), body, out)
+}
+
+// vaultCall sends a request to the Vault API at /v1/<path> and decodes the
+// response into out. There's no request body if body is nil and nothing to
+// decode for 204 No Content.
+func vaultCall(client *http.Client, addr, token, method, path string, body map[string]string, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	url := fmt.Sprintf("%s/v1/%s", addr, path)
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return err
+	}
+	// Without a token a Vault agent can add its own.
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		Log(fmt.Sprintf("action='vault' method='%s' path='%s'", method, path), "debug")
+		return nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		var vaultErr struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&vaultErr)
+		return fmt.Errorf("vault %s: %s %s", path, resp.Status, strings.Join(vaultErr.Errors, ", "))
+	}
+	Log(fmt.Sprintf("action='vault' method='%s' path='%s'", method, path), "debug")
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
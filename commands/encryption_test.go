@@ -0,0 +1,182 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testEncryptKey writes a new AES-256 key file and turns on --encrypt-key.
+func testEncryptKey(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "kvexpress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := make([]byte, 32)
+	rand.Read(key)
+	file := filepath.Join(dir, "encrypt.key")
+	ioutil.WriteFile(file, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600)
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+		EncryptKey = ""
+		SetupEncryption()
+	})
+	EncryptKey = file
+	if err := SetupEncryption(); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestEncryptDecryptData(t *testing.T) {
+	PrefixLocation = "testing"
+	testEncryptKey(t)
+	encrypted, err := EncryptData("hosts", exampleData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(encrypted, aesPrefix) || strings.Contains(encrypted, "localhost") {
+		t.Errorf("The data was not encrypted: %q", encrypted)
+	}
+	if data, err := DecryptData("hosts", encrypted, SchemeAES); err != nil || data != exampleData {
+		t.Errorf("The data was not decrypted: %q %v", data, err)
+	}
+	if _, err := DecryptData("hosts", encrypted[:len(encrypted)-4]+"AAAA", SchemeAES); err == nil {
+		t.Error("Changed data should not decrypt.")
+	}
+	if _, err := DecryptData("hosts", exampleData, ""); err != ErrNotEncrypted {
+		t.Errorf("Plain data should be ErrNotEncrypted: %v", err)
+	}
+	if _, err := DecryptData("hosts", encrypted, ""); err == nil {
+		t.Error("Encrypted data without a scheme in its encoding should be an error.")
+	}
+	if _, err := DecryptData("hosts", encrypted, SchemeVault); err == nil {
+		t.Error("The scheme in the encoding picks how it's decrypted.")
+	}
+
+	// The data is bound to its key - the canary, staged and saved versions
+	// are the same key.
+	if _, err := DecryptData("passwords", encrypted, SchemeAES); err == nil {
+		t.Error("Data moved to another key shouldn't decrypt.")
+	}
+	for _, key := range []string{"hosts/canary", "hosts/staged", "hosts/history/20240601T000000Z"} {
+		if data, err := DecryptData(key, encrypted, SchemeAES); err != nil || data != exampleData {
+			t.Errorf("The data should decrypt in '%s': %q %v", key, data, err)
+		}
+	}
+	PrefixLocation = "other"
+	if _, err := DecryptData("hosts", encrypted, SchemeAES); err == nil {
+		t.Error("Data moved to another prefix shouldn't decrypt.")
+	}
+	PrefixLocation = "testing"
+
+	EncryptKey = ""
+	SetupEncryption()
+	if _, err := DecryptData("hosts", encrypted, SchemeAES); err == nil {
+		t.Error("Encrypted data without a key should be an error.")
+	}
+}
+
+func TestLoadEncryptionKeyBad(t *testing.T) {
+	file := testEncryptKey(t)
+	ioutil.WriteFile(file, []byte(base64.StdEncoding.EncodeToString([]byte("too short"))), 0600)
+	if _, err := LoadEncryptionKey(file); err == nil {
+		t.Error("A short key should be an error.")
+	}
+	ioutil.WriteFile(file, []byte("not base64!"), 0600)
+	if _, err := LoadEncryptionKey(file); err == nil {
+		t.Error("A key that's not base64 should be an error.")
+	}
+}
+
+func TestDecodeDataEncrypted(t *testing.T) {
+	tc, c := newTestConsul(t)
+	PrefixLocation = "testing"
+	testEncryptKey(t)
+	t.Cleanup(func() { Compress = false })
+	Compress = true
+	stored, err := EncodeData("secret", exampleData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SetEncoding(c, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if encoding, _ := tc.value("testing/secret/encoding"); encoding != EncodingGzip+"+"+SchemeAES {
+		t.Errorf("The encryption scheme should be saved with the encoding: %q", encoding)
+	}
+	if data, err := DecodeData(c, "secret", stored); err != nil || data != exampleData {
+		t.Errorf("The data was not decrypted and decompressed: %q %v", data, err)
+	}
+	tc.put("testing/secret/encoding", EncodingGzip)
+	if _, err := DecodeData(c, "secret", stored); err == nil {
+		t.Error("Encrypted data saved without its scheme should be an error.")
+	}
+}
+
+func TestVaultTransit(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vault-token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		switch r.URL.Path {
+		case "/v1/transit/encrypt/hosts":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{"ciphertext": "vault:v1:" + body["associated_data"] + ":" + body["plaintext"]}})
+		case "/v1/transit/decrypt/hosts":
+			parts := strings.SplitN(strings.TrimPrefix(body["ciphertext"], "vault:v1:"), ":", 2)
+			if len(parts) != 2 || parts[0] != body["associated_data"] {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"errors":["cipher: message authentication failed"]}`))
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{"plaintext": parts[1]}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	t.Cleanup(func() {
+		EncryptVault, VaultAddr, VaultToken = "", "", ""
+		SetupEncryption()
+	})
+	EncryptVault, VaultAddr, VaultToken = "hosts", server.URL, "vault-token"
+	SetupEncryption()
+
+	encrypted, err := EncryptData("hosts", exampleData)
+	if err != nil || !strings.HasPrefix(encrypted, vaultPrefix) {
+		t.Fatalf("The data was not encrypted by Vault: %q %v", encrypted, err)
+	}
+	if data, err := DecryptData("hosts", encrypted, SchemeVault); err != nil || data != exampleData {
+		t.Errorf("The data was not decrypted by Vault: %q %v", data, err)
+	}
+	if _, err := DecryptData("passwords", encrypted, SchemeVault); err == nil {
+		t.Error("The key should be sent to Vault as the associated data.")
+	}
+
+	VaultToken = "bad-token"
+	SetupEncryption()
+	if _, err := EncryptData("hosts", exampleData); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("A bad token should be an error: %v", err)
+	}
+}
+
+func TestSetupEncryptionBoth(t *testing.T) {
+	t.Cleanup(func() { EncryptKey, EncryptVault = "", "" })
+	EncryptKey, EncryptVault = "encrypt.key", "hosts"
+	if err := SetupEncryption(); err == nil {
+		t.Error("Both --encrypt-key and --encrypt-vault should be an error.")
+	}
+}
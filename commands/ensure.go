@@ -0,0 +1,267 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"time"
+)
+
+var ensureCmd = &cobra.Command{
+	Use:   "ensure",
+	Short: "Push a file into Consul or pull it out depending on the role.",
+	Long:  `Ensure is for hosts that are both producers and consumers - the producer pushes its file to Consul and every other host writes it.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		checkEnsureFlags()
+		AutoEnable()
+	},
+	Run: ensureRun,
+}
+
+func ensureRun(cmd *cobra.Command, args []string) {
+	start := time.Now()
+
+	c, err := Connect(ConsulServer, Token)
+	if err != nil {
+		LogFatal("Could not connect to Consul.", KeyEnsureLocation, "consul_connect")
+	}
+
+	StopKeyData, err := Get(c, KeyPath(KeyEnsureLocation, "stop"))
+	ExitOnError(err, KeyEnsureLocation, "consul_get")
+	if StopKeyData != "" {
+		Log(fmt.Sprintf("Stop Key is present - stopping. Reason: %s", StopKeyData), "info")
+		exitRun(ExitStopped, start, KeyEnsureLocation, "stop_key", "")
+	}
+
+	role := EnsureRole
+	if role == "auto" {
+		role = "consumer"
+		if AcquireLeadership(c, KeyPath(KeyEnsureLocation, "leader"), EnsureLeaderTTL) {
+			role = "producer"
+		}
+	}
+	Log(fmt.Sprintf("ensure role='%s' key='%s' file='%s'", role, KeyEnsureLocation, FiletoEnsure), "info")
+
+	var changed bool
+	if role == "producer" {
+		changed, err = EnsureProducer(c, KeyEnsureLocation, FiletoEnsure)
+	} else {
+		changed, err = EnsureConsumer(c, KeyEnsureLocation, FiletoEnsure)
+	}
+	if errors.Is(err, ErrNoMoreRetries) {
+		ExitOnError(err, KeyEnsureLocation, "ensure")
+	}
+	if err != nil {
+		Log(fmt.Sprintf("ensure role='%s' error='%v'", role, err), "info")
+		exitRun(1, start, KeyEnsureLocation, "ensure_error", "")
+	}
+	if !changed {
+		Log(fmt.Sprintf("ensure role='%s' changed='false'", role), "info")
+		exitRun(ExitNoChange, start, KeyEnsureLocation, "checksums_match", "")
+	}
+
+	// Run this command after the data is pushed or the file is written.
+	if PostExec != "" {
+		Log(fmt.Sprintf("exec='%s'", PostExec), "debug")
+		if status := RunPostExec(PostExec); status != 0 {
+			exitExecFailed(status, KeyEnsureLocation)
+		}
+	}
+	if status := RunHooks(Hook{Event: HookChange, Key: KeyEnsureLocation, File: FiletoEnsure}); status != 0 {
+		exitExecFailed(status, KeyEnsureLocation)
+	}
+	RunTime(start, KeyEnsureLocation, "complete")
+}
+
+// EnsureProducer pushes the local file to Consul if the stored checksum is
+// different - or if the stored data no longer matches the stored checksum.
+func EnsureProducer(c *consul.Client, key, file string) (bool, error) {
+	data := sortInLines(ReadFile(file))
+	minLength, maxLength := lineLimits(false)
+	if !LengthCheck(data, minLength) {
+		StatsdLength(key)
+		return false, errors.New("the file is not long enough")
+	}
+	if err := SizeCheck(data, maxLength, MaxFileBytes); err != nil {
+		StatsdTooLarge(key)
+		return false, fmt.Errorf("the file is %v", err)
+	}
+	checksum := StoreChecksum(data)
+
+	KeyChecksum := KeyPath(key, "checksum")
+	storedChecksum, err := Get(c, KeyChecksum)
+	if err != nil {
+		return false, err
+	}
+	if strings.TrimSpace(storedChecksum) == checksum {
+		// A chunk that doesn't match the manifest is drift too.
+		storedData, err := GetData(c, key)
+		if err == nil {
+			storedData, err = DecodeData(c, key, storedData)
+		}
+		if errors.Is(err, ErrNoMoreRetries) {
+			return false, err
+		}
+		if err == nil && ChecksumCompare(storedData, storedChecksum) {
+			return false, nil
+		}
+		Log("consul checksum='match' data='drifted' update='true'", "info")
+	}
+
+	stored, err := EncodeData(key, data)
+	if err != nil {
+		return false, err
+	}
+	if err := SetData(c, key, stored); err != nil {
+		return false, err
+	}
+	if err := Set(c, KeyChecksum, checksum); err != nil {
+		return false, err
+	}
+	if err := SetChecksums(c, key, StoreChecksums(data)); err != nil {
+		return false, err
+	}
+	if err := Set(c, KeyPath(key, "updated"), ReturnCurrentUTC()); err != nil {
+		return false, err
+	}
+	if err := SetEncoding(c, key); err != nil {
+		return false, err
+	}
+	Log(fmt.Sprintf("consul KeyData='%s' saved='true' size='%d'", KeyPath(key, "data"), len(stored)), "info")
+	saveMeta(c, key, "file:"+file)
+	StatsdIn(key, len(stored), stored)
+	return true, nil
+}
+
+// EnsureConsumer writes the data from Consul to the file if it's valid and
+// the file has a different checksum.
+func EnsureConsumer(c *consul.Client, key, file string) (bool, error) {
+	GlobalLockData, err := CheckGlobalLock(c, key)
+	if err != nil {
+		return false, err
+	}
+	if GlobalLockData != "" {
+		Log(fmt.Sprintf("Global Lock Key is present - will not update file. Reason: %s", GlobalLockData), "info")
+		StatsdLocked(key)
+		return false, nil
+	}
+	LockKeyData, err := CheckLock(c, file)
+	if err != nil {
+		return false, err
+	}
+	if LockKeyData != "" {
+		Log(fmt.Sprintf("Lock Key is present - will not update file. Reason: %s", LockKeyData), "info")
+		StatsdLocked(file)
+		return false, nil
+	}
+	// Staged data is read once its time has passed - the global lock is still
+	// the key's.
+	key, err = StagedOutKey(c, key)
+	if err != nil {
+		return false, err
+	}
+	data, err := GetData(c, key)
+	if err != nil {
+		StatsdChecksum(key)
+		return false, err
+	}
+	data, encoding, err := DecodeKeyData(c, key, data)
+	if err != nil {
+		return false, err
+	}
+	checksum, err := GetChecksum(c, key)
+	if err != nil {
+		return false, err
+	}
+	minLength, maxLength := lineLimits(BinaryEncoding(encoding))
+	if !LengthCheck(data, minLength) {
+		StatsdLength(key)
+		return false, errors.New("the data is not long enough")
+	}
+	if err := SizeCheck(data, maxLength, MaxFileBytes); err != nil {
+		StatsdTooLarge(key)
+		return false, fmt.Errorf("the data is %v", err)
+	}
+	if !ChecksumCompare(data, checksum) {
+		StatsdChecksum(key)
+		return false, errors.New("the data does not match the checksum")
+	}
+	if matches, err := FileChecksumMatches(file, strings.TrimSpace(checksum)); err != nil || matches {
+		return false, err
+	}
+	if err := WriteFile(data, file, FilePermissions, Owner); err != nil {
+		return false, err
+	}
+	StatsdOut(key)
+	return true, nil
+}
+
+// AcquireLeadership returns true if this host holds the leader key. The key is
+// held with a Consul session that has a TTL - the leader renews it every run,
+// so if the leader stops running another host takes over after the TTL.
+func AcquireLeadership(c *consul.Client, key string, ttl time.Duration) bool {
+	holder, err := AcquireSessionKey(c, key, ttl)
+	switch {
+	case err != nil:
+		Log(fmt.Sprintf("leader='error' key='%s' message='%v'", key, err), "info")
+		return false
+	case holder != "":
+		Log(fmt.Sprintf("leader='false' key='%s' holder='%s'", key, holder), "info")
+		return false
+	}
+	Log(fmt.Sprintf("leader='true' key='%s'", key), "debug")
+	return true
+}
+
+func checkEnsureFlags() {
+	Log("Checking cli flags.", "debug")
+	if KeyEnsureLocation == "" {
+		fmt.Println("Need a key location in -k")
+		os.Exit(1)
+	}
+	if FiletoEnsure == "" {
+		fmt.Println("Need a file in -f")
+		os.Exit(1)
+	}
+	if EnsureRole != "producer" && EnsureRole != "consumer" && EnsureRole != "auto" {
+		fmt.Println("Need a role of producer, consumer or auto in --role")
+		os.Exit(1)
+	}
+	if EnsureRole == "auto" && !consulBackend() {
+		fmt.Printf("--role auto uses Consul sessions and can't be used with --backend %s\n", Backend)
+		os.Exit(1)
+	}
+	ExitOnError(CheckAllowedDir(FiletoEnsure), FiletoEnsure, "check_flags")
+	checkSortFlags()
+	Log("Required cli flags present.", "debug")
+}
+
+var (
+	// KeyEnsureLocation is the key that's either pushed to or pulled from.
+	KeyEnsureLocation string
+
+	// FiletoEnsure is the file that's either read from or written to.
+	FiletoEnsure string
+
+	// EnsureRole is producer, consumer or auto - auto uses a leader key in Consul.
+	EnsureRole string
+
+	// EnsureLeaderTTL is how long leadership lasts without being renewed.
+	EnsureLeaderTTL time.Duration
+)
+
+func init() {
+	RootCmd.AddCommand(ensureCmd)
+	ensureCmd.Flags().StringVarP(&KeyEnsureLocation, "key", "k", "", "key to push to or pull from")
+	ensureCmd.Flags().StringVarP(&FiletoEnsure, "file", "f", "", "file to read from or write to")
+	ensureCmd.Flags().StringVarP(&EnsureRole, "role", "", "auto", "producer, consumer or auto")
+	ensureCmd.Flags().DurationVarP(&EnsureLeaderTTL, "leader-ttl", "", 60*time.Second, "how long leadership lasts without a run")
+	ensureCmd.Flags().BoolVarP(&Sorted, "sorted", "S", false, "sort the file before pushing")
+	ensureCmd.Flags().StringVarP(&SortMode, "sort", "", "", "how to sort the lines before pushing - none, lexical, numeric or version")
+	ensureCmd.Flags().BoolVarP(&Unique, "unique", "", false, "remove duplicate lines before pushing")
+}
@@ -0,0 +1,122 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func ensureTestFile(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "kvexpress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	MinFileLength = 10
+	FilePermissions = 0640
+	Owner = GetCurrentUsername()
+	PrefixLocation = "testing"
+	return filepath.Join(dir, "ensure")
+}
+
+func TestEnsureProducer(t *testing.T) {
+	tc, c := newTestConsul(t)
+	file := ensureTestFile(t)
+	ioutil.WriteFile(file, []byte(exampleData), 0640)
+
+	changed, err := EnsureProducer(c, "ensure", file)
+	if err != nil || !changed {
+		t.Fatalf("The producer should have pushed the file: %v", err)
+	}
+	if data, _ := tc.value("testing/ensure/data"); data != exampleData {
+		t.Error("The producer did not push the data.")
+	}
+	if checksum, _ := tc.value("testing/ensure/checksum"); checksum != exampleDataSHA {
+		t.Error("The producer did not push the checksum.")
+	}
+	if changed, _ := EnsureProducer(c, "ensure", file); changed {
+		t.Error("Nothing changed - the producer should not push again.")
+	}
+
+	// If the data drifted from its checksum the producer reconciles it.
+	tc.put("testing/ensure/data", "drifted\n")
+	if changed, _ := EnsureProducer(c, "ensure", file); !changed {
+		t.Error("The producer should have repaired the drifted data.")
+	}
+	if data, _ := tc.value("testing/ensure/data"); data != exampleData {
+		t.Error("The drifted data was not replaced.")
+	}
+}
+
+func TestEnsureConsumer(t *testing.T) {
+	tc, c := newTestConsul(t)
+	file := ensureTestFile(t)
+	tc.put("testing/ensure/data", exampleData)
+	tc.put("testing/ensure/checksum", exampleDataSHA)
+
+	changed, err := EnsureConsumer(c, "ensure", file)
+	if err != nil || !changed {
+		t.Fatalf("The consumer should have written the file: %v", err)
+	}
+	if ReadFile(file) != exampleData {
+		t.Error("The consumer did not pull the data.")
+	}
+	if changed, _ := EnsureConsumer(c, "ensure", file); changed {
+		t.Error("Nothing changed - the consumer should not write again.")
+	}
+	if _, ok := tc.value("testing/ensure/updated"); ok {
+		t.Error("The consumer should never write to Consul.")
+	}
+
+	tc.put("testing/ensure/checksum", "bad-checksum")
+	if _, err := EnsureConsumer(c, "ensure", file); err == nil {
+		t.Error("A checksum mismatch should be an error.")
+	}
+}
+
+func TestEnsureConsumerGlobalLock(t *testing.T) {
+	tc, c := newTestConsul(t)
+	file := ensureTestFile(t)
+	tc.put("testing/ensure/data", exampleData)
+	tc.put("testing/ensure/checksum", exampleDataSHA)
+	tc.put("testing/ensure/lock", "Frozen everywhere.")
+
+	if changed, err := EnsureConsumer(c, "ensure", file); err != nil || changed {
+		t.Fatalf("A global lock should stop the consumer: %v", err)
+	}
+	if ReadFile(file) != "" {
+		t.Error("The file should not be written with a global lock.")
+	}
+	if reason, _ := CheckGlobalLock(c, "ensure"); reason != "Frozen everywhere." {
+		t.Errorf("The global lock reason is wrong: %q", reason)
+	}
+
+	tc.put("testing/ensure/lock", `{"reason":"Expired.","expires":"2016-05-01T12:00:00Z"}`)
+	if changed, err := EnsureConsumer(c, "ensure", file); err != nil || !changed {
+		t.Fatalf("An expired global lock should not stop the consumer: %v", err)
+	}
+	if _, ok := tc.value("testing/ensure/lock"); ok {
+		t.Error("The expired global lock should be deleted.")
+	}
+}
+
+func TestAcquireLeadership(t *testing.T) {
+	tc, c := newTestConsul(t)
+	if !AcquireLeadership(c, "testing/ensure/leader", 30*time.Second) {
+		t.Fatal("The first host should become the leader.")
+	}
+	if !AcquireLeadership(c, "testing/ensure/leader", 30*time.Second) {
+		t.Error("The leader should keep leadership on the next run.")
+	}
+	tc.put("testing/ensure/leader", "another-host")
+	tc.Lock()
+	tc.kv["testing/ensure/leader"].Session = "session-other"
+	tc.Unlock()
+	if AcquireLeadership(c, "testing/ensure/leader", 30*time.Second) {
+		t.Error("Another host holds the leader key.")
+	}
+}
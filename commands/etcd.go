@@ -0,0 +1,257 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// kvBackend is a key value store that isn't Consul. When it's set, Get, Set,
+// Del and Keys use it instead of the Consul client they're passed.
+type kvBackend interface {
+	Get(key string) (string, error)
+	Set(key, value string) (bool, error)
+	Del(key string) (bool, error)
+	Keys(prefix string) ([]string, error)
+}
+
+// txnBackend is a backend that can save several keys at once like a Consul
+// transaction - so SaveCAS keeps the data and its checksum together.
+type txnBackend interface {
+	kvBackend
+	// Index is the version of key for a KVCAS - 0 if it doesn't exist.
+	Index(key string) (uint64, string, error)
+	// Txn runs the KVSet, KVCAS, KVDelete and KVDeleteTree operations all at
+	// once. It's false if a KVCAS lost.
+	Txn(ops consul.TxnOps) (bool, error)
+}
+
+// backend is nil when kvexpress is talking to Consul.
+var backend kvBackend
+
+// atomicWrites is true when the data and checksum can be saved together -
+// with Consul or a txnBackend.
+func atomicWrites() bool {
+	_, ok := backend.(txnBackend)
+	return backend == nil || ok
+}
+
+// consulBackend is true when --backend is Consul - sessions and blocking
+// queries only work there.
+func consulBackend() bool {
+	return Backend == "" || Backend == "consul"
+}
+
+// waitBackend is a backend that can tell when a key changes - like a Consul
+// blocking query.
+type waitBackend interface {
+	kvBackend
+	Wait(prefix string, index uint64, wait time.Duration) (uint64, error)
+}
+
+// canWait is true when Wait blocks until something changes - with Consul or
+// a waitBackend.
+func canWait() bool {
+	_, ok := backend.(waitBackend)
+	return backend == nil || ok
+}
+
+// closeBackend is a backend with a session that should be ended before
+// kvexpress exits.
+type closeBackend interface {
+	kvBackend
+	Close() error
+}
+
+// CloseBackend ends the backend's session. A backend that's used again
+// starts a new one.
+func CloseBackend() {
+	if closer, ok := backend.(closeBackend); ok {
+		if err := closer.Close(); err != nil {
+			Log(fmt.Sprintf("backend='%s' close='false' message='%v'", Backend, err), "debug")
+		}
+	}
+}
+
+// SetupBackend picks the backend from --backend.
+func SetupBackend() error {
+	switch Backend {
+	case "", "consul":
+		backend = nil
+	case "etcd", "zookeeper", "redis":
+		if Namespace != "" || Partition != "" {
+			return errors.New("--namespace and --partition are only for Consul Enterprise")
+		}
+		var err error
+		switch Backend {
+		case "etcd":
+			backend, err = newEtcdBackend(EtcdEndpoints)
+		case "zookeeper":
+			backend, err = newZookeeperBackend(ZookeeperServers, ZookeeperAuth, ZookeeperAuthFile, ZookeeperACL)
+		default:
+			backend, err = newRedisBackend(RedisServer)
+		}
+		if err != nil {
+			backend = nil
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown backend '%s' - use consul, etcd, zookeeper or redis", Backend)
+	}
+	Log(fmt.Sprintf("backend='%s'", Backend), "debug")
+	return nil
+}
+
+// etcdBackend talks to etcd v3 using its JSON gateway.
+type etcdBackend struct {
+	endpoints []string
+	client    *http.Client
+}
+
+// etcdKV is a single key value pair from the etcd JSON gateway - keys and
+// values are base64 encoded.
+type etcdKV struct {
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+type etcdRange struct {
+	Kvs []etcdKV `json:"kvs"`
+}
+
+func newEtcdBackend(endpoints []string) (*etcdBackend, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("need at least one --etcd-endpoint")
+	}
+	config := &tls.Config{}
+	if EtcdCACert != "" {
+		ca, err := ioutil.ReadFile(EtcdCACert)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		config.RootCAs.AppendCertsFromPEM(ca)
+	}
+	if EtcdCert != "" && EtcdKey != "" {
+		cert, err := tls.LoadX509KeyPair(EtcdCert, EtcdKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	var clean []string
+	for _, endpoint := range endpoints {
+		endpoint = strings.TrimSuffix(endpoint, "/")
+		if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+			endpoint = "http://" + endpoint
+		}
+		clean = append(clean, endpoint)
+	}
+	client := cancelClient(&http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{TLSClientConfig: config}})
+	return &etcdBackend{endpoints: clean, client: client}, nil
+}
+
+// call posts a request to each endpoint in turn until one of them answers.
+func (e *etcdBackend) call(path string, request interface{}, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	for _, endpoint := range e.endpoints {
+		var resp *http.Response
+		resp, err = e.client.Post(endpoint+path, "application/json", bytes.NewReader(body))
+		if err != nil {
+			Log(fmt.Sprintf("etcd endpoint='%s' error='%v'", endpoint, err), "info")
+			continue
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("etcd returned %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+			continue
+		}
+		if response == nil {
+			return nil
+		}
+		return json.Unmarshal(data, response)
+	}
+	return err
+}
+
+func etcdEncode(value string) string {
+	return base64.StdEncoding.EncodeToString([]byte(value))
+}
+
+// etcdRangeEnd returns the range_end that matches every key starting with prefix.
+func etcdRangeEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return "\x00"
+}
+
+func (e *etcdBackend) Get(key string) (string, error) {
+	key = strings.TrimPrefix(key, "/")
+	var result etcdRange
+	if err := e.call("/v3/kv/range", map[string]string{"key": etcdEncode(key)}, &result); err != nil {
+		return "", err
+	}
+	Log(fmt.Sprintf("action='etcdGet' key='%s'", key), "debug")
+	if len(result.Kvs) == 0 {
+		return "", nil
+	}
+	value, err := base64.StdEncoding.DecodeString(result.Kvs[0].Value)
+	return string(value), err
+}
+
+func (e *etcdBackend) Set(key, value string) (bool, error) {
+	key = strings.TrimPrefix(key, "/")
+	if err := e.call("/v3/kv/put", map[string]string{"key": etcdEncode(key), "value": etcdEncode(value)}, nil); err != nil {
+		return false, err
+	}
+	Log(fmt.Sprintf("action='etcdSet' key='%s'", key), "debug")
+	return true, nil
+}
+
+func (e *etcdBackend) Del(key string) (bool, error) {
+	key = strings.TrimPrefix(key, "/")
+	if err := e.call("/v3/kv/deleterange", map[string]string{"key": etcdEncode(key)}, nil); err != nil {
+		return false, err
+	}
+	Log(fmt.Sprintf("action='etcdDel' key='%s'", key), "info")
+	return true, nil
+}
+
+func (e *etcdBackend) Keys(prefix string) ([]string, error) {
+	prefix = strings.TrimPrefix(prefix, "/")
+	request := map[string]interface{}{"key": etcdEncode(prefix), "range_end": etcdEncode(etcdRangeEnd(prefix)), "keys_only": true}
+	var result etcdRange
+	if err := e.call("/v3/kv/range", request, &result); err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, kv := range result.Kvs {
+		key, err := base64.StdEncoding.DecodeString(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, string(key))
+	}
+	Log(fmt.Sprintf("action='etcdKeys' prefix='%s' keys='%d'", prefix, len(keys)), "debug")
+	return keys, nil
+}
@@ -0,0 +1,116 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testEtcd is a small in-memory stand-in for the etcd v3 JSON gateway.
+type testEtcd struct {
+	sync.Mutex
+	kv map[string]string
+}
+
+func newTestEtcd(t *testing.T) *testEtcd {
+	te := &testEtcd{kv: make(map[string]string)}
+	server := httptest.NewServer(http.HandlerFunc(te.handle))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { backend = nil })
+	etcd, err := newEtcdBackend([]string{server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend = etcd
+	return te
+}
+
+func (te *testEtcd) handle(w http.ResponseWriter, r *http.Request) {
+	te.Lock()
+	defer te.Unlock()
+	var request map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&request)
+	decode := func(name string) string {
+		value, _ := request[name].(string)
+		decoded, _ := base64.StdEncoding.DecodeString(value)
+		return string(decoded)
+	}
+	key := decode("key")
+	switch r.URL.Path {
+	case "/v3/kv/put":
+		te.kv[key] = decode("value")
+	case "/v3/kv/deleterange":
+		delete(te.kv, key)
+	case "/v3/kv/range":
+		end := decode("range_end")
+		var keys []string
+		for k := range te.kv {
+			if k == key || (end != "" && k >= key && k < end) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		var kvs []map[string]string
+		for _, k := range keys {
+			kvs = append(kvs, map[string]string{"key": etcdEncode(k), "value": etcdEncode(te.kv[k])})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"kvs": kvs})
+		return
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+	w.Write([]byte("{}"))
+}
+
+func TestEtcdBackend(t *testing.T) {
+	te := newTestEtcd(t)
+	tc, c := newTestConsul(t)
+	Set(c, "/testing/keyname/data", exampleData)
+	Set(c, "testing/keyname/checksum", exampleDataSHA)
+	if te.kv["testing/keyname/data"] != exampleData {
+		t.Error("Set did not store the data in etcd.")
+	}
+	if tc.count("PUT") != 0 {
+		t.Error("Consul should not be used with the etcd backend.")
+	}
+	if value, err := Get(c, "testing/keyname/data"); err != nil || value != exampleData {
+		t.Error("Get did not return the data from etcd.")
+	}
+	if value, err := Get(c, "testing/missing/data"); err != nil || value != "" {
+		t.Error("Get of a missing key should be blank.")
+	}
+	keys, err := Keys(c, "testing/keyname/")
+	if err != nil || strings.Join(keys, ",") != "testing/keyname/checksum,testing/keyname/data" {
+		t.Errorf("Keys did not list the keys: %v", keys)
+	}
+	Del(c, "testing/keyname/data")
+	if _, ok := te.kv["testing/keyname/data"]; ok {
+		t.Error("Del did not remove the key from etcd.")
+	}
+}
+
+func TestEtcdRangeEnd(t *testing.T) {
+	if end := etcdRangeEnd("kvexpress/"); end != "kvexpress0" {
+		t.Errorf("The range end is wrong: '%s'", end)
+	}
+}
+
+func TestSetupBackend(t *testing.T) {
+	defer func() { Backend, backend = "consul", nil }()
+	Backend = "memcached"
+	if err := SetupBackend(); err == nil {
+		t.Error("An unknown backend should be an error.")
+	}
+	Backend = "etcd"
+	EtcdEndpoints = []string{"localhost:2379"}
+	if err := SetupBackend(); err != nil || backend == nil {
+		t.Errorf("The etcd backend should be setup: %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ExecDebounce is the least time between two runs of the same --exec command
+// on a host - every kvexpress process that runs it shares the window, so a
+// bulk update to many keys that all reload nginx only reloads it once or twice.
+var ExecDebounce time.Duration
+
+// ExecDebouncePath is the file the processes that run command share its last
+// run in - it's in StateDir.
+func ExecDebouncePath(command string) string {
+	return filepath.Join(StateDir(), fmt.Sprintf("kvexpress-exec-%s.state", ComputeChecksum(strings.Join(strings.Fields(command), " "))[:16]))
+}
+
+// debounceGrace is how long after the window a waiting process has to run
+// the command before the other processes stop waiting for it.
+const debounceGrace = time.Minute
+
+// execDebounceState is what's in the state file: when the command last
+// started and whether a process is waiting to run it - which one, and when
+// it should have run it by.
+type execDebounceState struct {
+	last     time.Time
+	pending  bool
+	pid      int
+	deadline time.Time
+}
+
+// waiting is true if a process is still waiting to run the command - one
+// that's gone or is past its deadline owes nothing.
+func (s execDebounceState) waiting(now time.Time) bool {
+	if !s.pending {
+		return false
+	}
+	if !s.deadline.IsZero() && now.After(s.deadline) {
+		return false
+	}
+	return s.pid <= 0 || processAlive(s.pid)
+}
+
+// readDebounce reads the state from f - a blank or broken file has never run.
+func readDebounce(f *os.File) execDebounceState {
+	f.Seek(0, 0)
+	data, _ := ioutil.ReadAll(f)
+	fields := strings.Fields(string(data))
+	var state execDebounceState
+	if len(fields) != 2 && len(fields) != 4 {
+		return state
+	}
+	if nsec, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+		state.last = time.Unix(0, nsec)
+	}
+	state.pending = fields[1] == "pending"
+	if len(fields) == 4 {
+		state.pid, _ = strconv.Atoi(fields[2])
+		if nsec, err := strconv.ParseInt(fields[3], 10, 64); err == nil && nsec > 0 {
+			state.deadline = time.Unix(0, nsec)
+		}
+	}
+	return state
+}
+
+// writeDebounce saves state in f.
+func writeDebounce(f *os.File, state execDebounceState) {
+	line := fmt.Sprintf("%d idle\n", state.last.UnixNano())
+	if state.pending {
+		line = fmt.Sprintf("%d pending %d %d\n", state.last.UnixNano(), state.pid, state.deadline.UnixNano())
+	}
+	f.Truncate(0)
+	f.WriteAt([]byte(line), 0)
+}
+
+// RunPostExec runs the --exec command after a change. With --exec-debounce a
+// command that ran less than the window ago waits for the window to end and
+// then runs once for every change it was asked to run for. If another process
+// is already waiting it returns 0 straight away - that run starts after the
+// files this one wrote and picks them up. A waiting run that's stopped still
+// runs the command it owes before it goes.
+func RunPostExec(command string) int {
+	if ExecDebounce <= 0 || DryRun {
+		return RunCommand(command)
+	}
+	path := ExecDebouncePath(command)
+	f, err := openStateFile(path)
+	if err != nil {
+		Log(fmt.Sprintf("exec_debounce='%s' message='%v' - running it now.", path, err), "info")
+		return RunCommand(command)
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		Log(fmt.Sprintf("exec_debounce='%s' message='%v' - running it now.", path, err), "info")
+		return RunCommand(command)
+	}
+	state := readDebounce(f)
+	now := time.Now()
+	if state.waiting(now) {
+		unlockFile(f)
+		Log(fmt.Sprintf("exec='%s' debounced='true' - another run is waiting to run it.", command), "info")
+		StatsdExecDebounced(command)
+		return 0
+	}
+	wait := state.last.Add(ExecDebounce).Sub(now)
+	if wait <= 0 {
+		writeDebounce(f, execDebounceState{last: now})
+		unlockFile(f)
+		return RunCommand(command)
+	}
+	writeDebounce(f, execDebounceState{last: state.last, pending: true, pid: os.Getpid(), deadline: state.last.Add(ExecDebounce + debounceGrace)})
+	unlockFile(f)
+	Log(fmt.Sprintf("exec='%s' exec_debounce='%s' wait='%s' - waiting for the window to end.", command, ExecDebounce, wait.Round(time.Millisecond)), "info")
+	StatsdExecDebounced(command)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	stopped := false
+	select {
+	case <-timer.C:
+	case <-RunContext().Done():
+		stopped = true
+	}
+	// Anything written after this is seen by a later run - it has to wait a
+	// whole window from now.
+	if err := lockFile(f); err == nil {
+		writeDebounce(f, execDebounceState{last: time.Now()})
+		unlockFile(f)
+	}
+	if stopped {
+		// The runs that left it to this one already wrote their files.
+		Log(fmt.Sprintf("exec='%s' debounced='true' message='the run was stopped while it waited' - running it now.", command), "info")
+		defer holdStop()()
+		return runCommandContext(context.Background(), command, nil, stopGrace)
+	}
+	return RunCommand(command)
+}
@@ -0,0 +1,84 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunPostExecDebounce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvexpress-debounce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	TmpDir = dir
+	ExecDebounce = time.Hour
+	defer func() { TmpDir, ExecDebounce = "", 0 }()
+	file := filepath.Join(dir, "reloaded")
+	command := "touch " + file
+
+	if status := RunPostExec(command); status != 0 {
+		t.Fatalf("The first run should run the command: %d", status)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatal("The first run shouldn't wait for the window.")
+	}
+
+	// Another process is already waiting for the window to end.
+	os.Remove(file)
+	f, _ := os.OpenFile(ExecDebouncePath(command), os.O_RDWR, 0644)
+	writeDebounce(f, execDebounceState{last: time.Now(), pending: true, pid: os.Getpid(), deadline: time.Now().Add(time.Hour)})
+	f.Close()
+	if status := RunPostExec(command); status != 0 {
+		t.Errorf("A run that's left to the waiting one should be 0: %d", status)
+	}
+	if _, err := os.Stat(file); err == nil {
+		t.Error("The command shouldn't run while another run is waiting.")
+	}
+
+	// A waiting run that's past its deadline or gone doesn't owe the command.
+	now := time.Now()
+	for _, stale := range []execDebounceState{
+		{last: now.Add(-2 * time.Hour), pending: true, pid: os.Getpid(), deadline: now.Add(-time.Minute)},
+		{last: now, pending: true, pid: 1 << 30, deadline: now.Add(time.Hour)},
+	} {
+		if stale.waiting(now) {
+			t.Errorf("A stale pending run shouldn't be waited for: %+v", stale)
+		}
+	}
+	if info, _ := os.Lstat(ExecDebouncePath(command)); info.Mode().Perm() != 0600 {
+		t.Errorf("The state file should only be readable by its owner: %s", info.Mode())
+	}
+	link := ExecDebouncePath("touch " + file + ".link")
+	os.Symlink(filepath.Join(dir, "elsewhere"), link)
+	if _, err := openStateFile(link); err == nil {
+		t.Error("A symlink shouldn't be followed to the state file.")
+	}
+
+	// The last run was a moment ago so this one waits for the rest of the window.
+	ExecDebounce = 300 * time.Millisecond
+	f, _ = os.OpenFile(ExecDebouncePath(command), os.O_RDWR, 0644)
+	writeDebounce(f, execDebounceState{last: time.Now()})
+	f.Close()
+	start := time.Now()
+	if status := RunPostExec(command); status != 0 {
+		t.Errorf("The run that waited should run the command: %d", status)
+	}
+	if waited := time.Since(start); waited < 200*time.Millisecond {
+		t.Errorf("The run should wait for the window to end: %s", waited)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Error("The command should run once the window ends.")
+	}
+	f, _ = os.Open(ExecDebouncePath(command))
+	state := readDebounce(f)
+	f.Close()
+	if state.pending || time.Since(state.last) > time.Second {
+		t.Errorf("The run that waited should save when it ran: %+v", state)
+	}
+}
@@ -0,0 +1,195 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The exit codes for the commands that write a file or a key - so a wrapper
+// can tell what happened without reading the logs. diff and verify answer a
+// question and have their own.
+const (
+	// ExitWrote is when the file or key was written - or there was nothing that
+	// needed to be done for a command like lock.
+	ExitWrote = 0
+
+	// ExitError is for bad flags and anything that doesn't have its own code.
+	ExitError = 1
+
+	// ExitNoChange is when the file or key already had the data.
+	ExitNoChange = 3
+
+	// ExitLocked is when a lock stopped the file - or with a global lock every
+	// file - from being written.
+	ExitLocked = 4
+
+	// ExitChecksumMismatch is when the data doesn't match its checksum or signature.
+	ExitChecksumMismatch = 5
+
+	// ExitConsulError is when Consul couldn't be reached or a Consul call failed.
+	ExitConsulError = 6
+
+	// ExitStopped is when there's a stop key - or the run was stopped with
+	// SIGTERM or SIGINT.
+	ExitStopped = 7
+
+	// ExitRejected is when the data didn't pass a check - it was too short,
+	// changed too much or --validate-exec failed.
+	ExitRejected = 8
+
+	// ExitFilesystem is when the disk is full or the filesystem is read-only -
+	// the host has a problem rather than the data.
+	ExitFilesystem = 9
+
+	// ExitTimeout is when Consul didn't answer in --consul-timeout or the run
+	// took longer than --deadline.
+	ExitTimeout = 10
+
+	// ExitInProgress is when the last run for the same key is still going.
+	ExitInProgress = 11
+
+	// ExitWrongVersion is when kvexpress isn't --required-version.
+	ExitWrongVersion = 12
+
+	// ExitDeferred is when the files would have changed during a maintenance
+	// window or before --apply-after - they're written on a later run.
+	ExitDeferred = 13
+
+	// ExitSomeFailed is when apply ran every entry and some of them failed.
+	ExitSomeFailed = 14
+
+	// ExitAllFailed is when every apply entry failed.
+	ExitAllFailed = 15
+
+	// ExitExecFailed is when --exec or an --exec-on-change hook ran and failed
+	// after the file or key was written. The command's own exit code is
+	// logged - it could be any of the others.
+	ExitExecFailed = 16
+
+	// ExitExecNotFound is when the --exec command or a hook doesn't exist or
+	// isn't in the PATH - or exited 127 like a shell does for one.
+	ExitExecNotFound = 17
+
+	// ExitExecNotExecutable is when the --exec command or a hook couldn't be
+	// run because it isn't executable.
+	ExitExecNotExecutable = 18
+
+	// ExitExecTimedOut is when the --exec command or a hook was killed after
+	// --exec-timeout.
+	ExitExecTimedOut = 19
+)
+
+// execExitCode is the exit code for a command that exited with status.
+func execExitCode(status int) int {
+	switch status {
+	case ExecNotFound:
+		return ExitExecNotFound
+	case ExecNotExecutable:
+		return ExitExecNotExecutable
+	case ExecTimedOut:
+		return ExitExecTimedOut
+	}
+	return ExitExecFailed
+}
+
+// exitExecFailed stops with the execExitCode once a command exited with status.
+func exitExecFailed(status int, key string) {
+	code := execExitCode(status)
+	Log(fmt.Sprintf("exec_status='%d' exit='%d' - the command failed.", status, code), "info")
+	exitRun(code, processStart, key, "exec_failed", fmt.Sprintf("the command exited %d", status))
+}
+
+// exitRun is how a run stops once it's started - the metrics, the JSON
+// result with --output json and the trace are finished the same way for
+// every exit code. message is the error the run stopped with - blank if it
+// didn't fail.
+func exitRun(code int, start time.Time, key, location, message string) {
+	finishRun(start, key, location, message)
+	os.Exit(code)
+}
+
+// quietStdout is the real stdout once --quiet has thrown the rest away - or
+// once the rest has gone to stderr because the data is on stdout.
+var quietStdout *os.File
+
+// stdoutData is set when -f - writes the data to stdout - the messages and
+// the --verbose logs go to stderr so they aren't mixed in with it.
+var stdoutData bool
+
+// Succeeded is true for the exit codes that mean everything is as it should
+// be - the data was written, was already there or is waiting for a
+// maintenance window to end or for --apply-after.
+func Succeeded(code int) bool {
+	return code == ExitWrote || code == ExitNoChange || code == ExitDeferred
+}
+
+// Skipped is true for the exit codes that mean someone asked for nothing to
+// be written - a lock or a stop key - or another run was already doing it.
+// They haven't failed.
+func Skipped(code int) bool {
+	return code == ExitLocked || code == ExitStopped || code == ExitInProgress
+}
+
+// ProcessExitCode is the exit code of a command that was run - 1 if it
+// didn't run at all.
+func ProcessExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+	return 1
+}
+
+// dataStdout is where the data goes with -f - - it's still written with --quiet.
+func dataStdout() *os.File {
+	if quietStdout != nil {
+		return quietStdout
+	}
+	return os.Stdout
+}
+
+// fatalExitCode is the exit code for a LogFatal at location - giving up on a
+// Consul that didn't answer in time is a timeout.
+func fatalExitCode(location string) int {
+	if strings.HasPrefix(location, "consul") || location == "no_more_retries" {
+		if atomic.LoadInt32(&consulTimedOut) == 1 {
+			return ExitTimeout
+		}
+		return ExitConsulError
+	}
+	return ExitError
+}
+
+// SetupOutput throws away everything that's printed for people with --quiet
+// or --output json - the exit code or the JSON result says what happened.
+// Data written to stdout with -f - is still written. Without them it's
+// printed on stderr when the data is on stdout.
+func SetupOutput() error {
+	if OutputFormat != "text" && OutputFormat != "json" {
+		return fmt.Errorf("--output should be text or json not '%s'", OutputFormat)
+	}
+	if !Quiet && OutputFormat != "json" {
+		if stdoutData {
+			quietStdout, os.Stdout = os.Stdout, os.Stderr
+		}
+		return nil
+	}
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	quietStdout, os.Stdout = os.Stdout, null
+	Verbose = false
+	return nil
+}
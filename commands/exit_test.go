@@ -0,0 +1,45 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"os"
+	"testing"
+)
+
+func TestExitCodes(t *testing.T) {
+	if !Succeeded(ExitWrote) || !Succeeded(ExitNoChange) || Succeeded(ExitLocked) {
+		t.Error("Only a write or no change should count as success.")
+	}
+	if !Skipped(ExitLocked) || !Skipped(ExitStopped) || !Skipped(ExitInProgress) || Skipped(ExitConsulError) {
+		t.Error("A lock, a stop key or a run in progress should be skipped.")
+	}
+	for location, want := range map[string]int{"consul_connect": ExitConsulError, "no_more_retries": ExitConsulError, "write_file": ExitError} {
+		if code := fatalExitCode(location); code != want {
+			t.Errorf("'%s' should exit %d not %d", location, want, code)
+		}
+	}
+	for status, want := range map[int]int{ExecNotFound: ExitExecNotFound, ExecNotExecutable: ExitExecNotExecutable, ExecTimedOut: ExitExecTimedOut, 3: ExitExecFailed} {
+		if code := execExitCode(status); code != want {
+			t.Errorf("A command that exited %d should exit %d not %d", status, want, code)
+		}
+	}
+}
+
+func TestSetupOutput(t *testing.T) {
+	defer func(out *os.File) { os.Stdout, quietStdout, Quiet, Verbose = out, nil, false, false }(os.Stdout)
+	out := os.Stdout
+	Quiet, Verbose = true, true
+	if err := SetupOutput(); err != nil || os.Stdout == out || dataStdout() != out || Verbose {
+		t.Errorf("--quiet should throw away stdout but keep the data writer: %v", err)
+	}
+}
+
+func TestSetupOutputStdoutData(t *testing.T) {
+	defer func(out *os.File) { os.Stdout, quietStdout, stdoutData = out, nil, false }(os.Stdout)
+	out := os.Stdout
+	stdoutData = true
+	if err := SetupOutput(); err != nil || os.Stdout != os.Stderr || dataStdout() != out {
+		t.Errorf("With -f - everything but the data should go to stderr: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export every key underneath a prefix to a JSON file.",
+	Long:  `Export is for backing up a KV subtree - the file is in the same format as 'consul kv export' and can be restored with 'kvexpress import' or 'consul kv import'.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		checkExportFlags()
+		AutoEnable()
+	},
+	Run: exportRun,
+}
+
+func exportRun(cmd *cobra.Command, args []string) {
+	start := time.Now()
+
+	c, err := Connect(ConsulServer, Token)
+	if err != nil {
+		LogFatal("Could not connect to Consul.", "export", "consul_connect")
+	}
+
+	prefix := strings.Trim(PrefixLocation, "/") + "/"
+	entries, err := ExportTree(c, prefix)
+	ExitOnError(err, prefix, "export")
+
+	data, err := json.MarshalIndent(entries, "", "\t")
+	ExitOnError(err, prefix, "export")
+	if ExportFile == "-" {
+		fmt.Fprintln(dataStdout(), string(data))
+	} else if err := ioutil.WriteFile(ExportFile, append(data, '\n'), 0600); err != nil {
+		fmt.Printf("Could not write the export: %v\n", err)
+		os.Exit(1)
+	}
+	Log(fmt.Sprintf("export prefix='%s' file='%s' keys='%d'", prefix, ExportFile, len(entries)), "info")
+	RunTime(start, "export", "complete")
+}
+
+// ExportEntry is a single key in the format used by `consul kv export`.
+type ExportEntry struct {
+	Key   string `json:"key"`
+	Flags uint64 `json:"flags"`
+	Value string `json:"value"`
+}
+
+// ExportTree reads every key underneath prefix - the values are base64
+// encoded so binary data survives the trip.
+func ExportTree(c *consul.Client, prefix string) ([]ExportEntry, error) {
+	keys, err := Keys(c, prefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	entries := []ExportEntry{}
+	for _, key := range keys {
+		value, err := Get(c, key)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, ExportEntry{Key: key, Value: base64.StdEncoding.EncodeToString([]byte(value))})
+	}
+	return entries, nil
+}
+
+func checkExportFlags() {
+	Log("Checking cli flags.", "debug")
+	if ExportFile == "" {
+		fmt.Println("Need a file to export to with -f - or - for stdout")
+		os.Exit(1)
+	}
+	Log("Required cli flags present.", "debug")
+}
+
+var (
+	// ExportFile is where the exported keys are written.
+	ExportFile string
+)
+
+func init() {
+	RootCmd.AddCommand(exportCmd)
+	exportCmd.Flags().StringVarP(&ExportFile, "file", "f", "", "file to export to - or - for stdout")
+}
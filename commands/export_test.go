@@ -0,0 +1,52 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+)
+
+func TestExportImportTree(t *testing.T) {
+	tc, c := newTestConsul(t)
+	tc.put("testing/hosts/data", exampleData)
+	tc.put("testing/hosts/checksum", exampleDataSHA)
+	tc.put("other/key", "not exported")
+
+	entries, err := ExportTree(c, "testing/")
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("Both keys underneath testing/ should be exported: %v %v", entries, err)
+	}
+	if entries[0].Key != "testing/hosts/checksum" || entries[1].Key != "testing/hosts/data" {
+		t.Errorf("The keys should be sorted: %v", entries)
+	}
+
+	// The export is the same format as `consul kv export`.
+	data, _ := json.Marshal(entries[:1])
+	if string(data) != `[{"key":"testing/hosts/checksum","flags":0,"value":"`+base64.StdEncoding.EncodeToString([]byte(exampleDataSHA))+`"}]` {
+		t.Errorf("The export is not in the consul kv export format: %s", data)
+	}
+
+	tc2, c2 := newTestConsul(t)
+	if imported, err := ImportTree(c2, entries); err != nil || imported != 2 {
+		t.Fatalf("Both keys should be imported: %d %v", imported, err)
+	}
+	if value, _ := tc2.value("testing/hosts/data"); value != exampleData {
+		t.Errorf("The data was not imported: %q", value)
+	}
+}
+
+func TestImportTreeBadValue(t *testing.T) {
+	tc, c := newTestConsul(t)
+	entries := []ExportEntry{
+		{Key: "testing/good", Value: base64.StdEncoding.EncodeToString([]byte("good"))},
+		{Key: "testing/bad", Value: "not base64!"},
+	}
+	if _, err := ImportTree(c, entries); err == nil {
+		t.Error("A value that isn't base64 should be an error.")
+	}
+	if _, ok := tc.value("testing/good"); ok {
+		t.Error("Nothing should be imported from a bad file.")
+	}
+}
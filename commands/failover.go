@@ -0,0 +1,147 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// lookupSRV is net.LookupSRV - it's replaced in the tests.
+var lookupSRV = net.LookupSRV
+
+// ConsulServers splits --server into the servers to try in order. It's a
+// comma separated list and a name that starts with an underscore - like
+// _consul._tcp.example.com - is a DNS SRV record that's looked up.
+func ConsulServers(server string) ([]string, error) {
+	var servers []string
+	for _, entry := range strings.Split(server, ",") {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+			continue
+		case strings.HasPrefix(entry, "_"):
+			_, records, err := lookupSRV("", "", entry)
+			if err != nil {
+				return nil, fmt.Errorf("could not look up the Consul servers in '%s': %v", entry, err)
+			}
+			// They're sorted by priority and shuffled by weight.
+			for _, record := range records {
+				servers = append(servers, net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port))))
+			}
+		default:
+			servers = append(servers, entry)
+		}
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("there aren't any Consul servers in '%s'", server)
+	}
+	for _, entry := range servers {
+		if unixSocket(entry) != "" && len(servers) > 1 {
+			return nil, fmt.Errorf("'%s' is a socket on this host - it can't fail over to other servers", entry)
+		}
+	}
+	Log(fmt.Sprintf("server='%s' servers='%s'", server, strings.Join(servers, ",")), "debug")
+	return servers, nil
+}
+
+// unixSocket is the path of a unix:///var/run/consul/http.sock server - blank
+// if it's a host:port.
+func unixSocket(server string) string {
+	if strings.HasPrefix(server, "unix://") {
+		return strings.TrimPrefix(server, "unix://")
+	}
+	return ""
+}
+
+// unixTransport makes config talk to the local agent on socket - for agents
+// that don't listen for HTTP on TCP. It's never sent through a proxy.
+func unixTransport(config *consul.Config, socket string) {
+	config.Address = "localhost"
+	config.Transport.Proxy = nil
+	config.Transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "unix", socket)
+	}
+}
+
+// serverHost is the host:port of a server without the scheme.
+func serverHost(server string) string {
+	if parts := strings.SplitN(server, "://", 2); len(parts) == 2 {
+		server = parts[1]
+	}
+	return strings.SplitN(server, "/", 2)[0]
+}
+
+// failoverTransport sends every request to the server that last answered and
+// moves on to the next one when it can't connect.
+type failoverTransport struct {
+	sync.Mutex
+	base    http.RoundTripper
+	servers []string
+	current int
+}
+
+// RoundTrip tries each server once, starting with the one that last answered.
+func (t *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.Lock()
+	start := t.current
+	t.Unlock()
+	var err error
+	for i := 0; i < len(t.servers); i++ {
+		index := (start + i) % len(t.servers)
+		attempt := req.Clone(req.Context())
+		attempt.URL.Host, attempt.Host = t.servers[index], t.servers[index]
+		if i > 0 && req.Body != nil && req.Body != http.NoBody {
+			// A body that can't be read again can't be sent to another server.
+			if req.GetBody == nil {
+				return nil, err
+			}
+			if attempt.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		var resp *http.Response
+		resp, err = t.base.RoundTrip(attempt)
+		if err == nil {
+			t.Lock()
+			t.current = index
+			t.Unlock()
+			return resp, nil
+		}
+		if !connectionError(err) || req.Context().Err() != nil {
+			return nil, err
+		}
+		Log(fmt.Sprintf("server='%s' failover='true' message='%v'", t.servers[index], err), "info")
+		StatsdFailover(t.servers[index])
+	}
+	return nil, err
+}
+
+// connectionError is true when the request never got to the server - so it's
+// safe to send it to another one.
+func connectionError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// failoverClient makes client fail over between servers.
+func failoverClient(client *http.Client, servers []string) *http.Client {
+	hosts := make([]string, len(servers))
+	for i, server := range servers {
+		hosts[i] = serverHost(server)
+	}
+	client.Transport = &failoverTransport{base: client.Transport, servers: hosts}
+	return client
+}
@@ -0,0 +1,92 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConsulServers(t *testing.T) {
+	defer func() { lookupSRV = net.LookupSRV }()
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		if name != "_consul._tcp.example.com" {
+			return "", nil, errors.New("no such host")
+		}
+		return "", []*net.SRV{{Target: "consul-1.example.com.", Port: 8500}, {Target: "consul-2.example.com.", Port: 8501}}, nil
+	}
+
+	servers, err := ConsulServers("consul-0:8500, _consul._tcp.example.com")
+	if err != nil || strings.Join(servers, ",") != "consul-0:8500,consul-1.example.com:8500,consul-2.example.com:8501" {
+		t.Errorf("The list and the SRV record should be the servers in order: %v %v", servers, err)
+	}
+	if _, err := ConsulServers("_consul._tcp.missing.com"); err == nil {
+		t.Error("An SRV record that can't be looked up should be an error.")
+	}
+	if _, err := ConsulServers(" , "); err == nil {
+		t.Error("There should be at least one server.")
+	}
+	if host := serverHost("https://consul.example.com:8501"); host != "consul.example.com:8501" {
+		t.Errorf("The scheme should be taken off: %s", host)
+	}
+}
+
+func TestConnectFailover(t *testing.T) {
+	tc, _ := newTestConsul(t)
+	// Nothing is listening on a port that was just closed.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := listener.Addr().String()
+	listener.Close()
+
+	c, err := Connect(down+","+strings.TrimPrefix(tc.server.URL, "http://"), "")
+	if err != nil {
+		t.Fatalf("The client should be setup: %v", err)
+	}
+	if err := Set(c, "testing/failover/data", exampleData); err != nil {
+		t.Fatalf("The write should go to the next server: %v", err)
+	}
+	if value, _ := tc.value("testing/failover/data"); value != exampleData {
+		t.Errorf("The body should be sent to the next server: '%s'", value)
+	}
+	if value, err := Get(c, "testing/failover/data"); err != nil || value != exampleData {
+		t.Errorf("The read should use the server that answered: '%s' %v", value, err)
+	}
+}
+
+func TestConnectUnixSocket(t *testing.T) {
+	tc, _ := newTestConsul(t)
+	socket := filepath.Join(t.TempDir(), "http.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(tc.handle))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+	defer func() { Proxy = "" }()
+	// The socket is never sent through a proxy.
+	Proxy = "proxy.example.com:3128"
+
+	c, err := Connect("unix://"+socket, "")
+	if err != nil {
+		t.Fatalf("The client should be setup: %v", err)
+	}
+	if err := Set(c, "testing/socket/data", exampleData); err != nil {
+		t.Fatalf("The write should go to the socket: %v", err)
+	}
+	if value, err := Get(c, "testing/socket/data"); err != nil || value != exampleData {
+		t.Errorf("The read should go to the socket: '%s' %v", value, err)
+	}
+	if _, err := ConsulServers("unix://" + socket + ",consul-1:8500"); err == nil {
+		t.Error("A socket can't fail over to another server.")
+	}
+}
@@ -0,0 +1,160 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// fetchAsCmd is run by kvexpress itself - as the --run-as user - so the
+// in --url and --s3 requests aren't made as root. It reads a fetchRequest on
+// stdin and writes a fetchResponse to stdout.
+var fetchAsCmd = &cobra.Command{
+	Use:    "fetch-as",
+	Short:  "Fetch a URL or S3 object as the --run-as user.",
+	Hidden: true,
+	Run:    fetchAsRun,
+}
+
+// fetchEnv are the variables the fetch needs from kvexpress's environment -
+// the proxies and the AWS credentials. They're passed in the child's
+// environment rather than its arguments.
+var fetchEnv = []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy", "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_REGION", "AWS_DEFAULT_REGION"}
+
+// fetchRequest is what fetch-as fetches and the flags it's fetched with. The
+// --url-ca-cert is read by kvexpress and passed along - the --run-as user
+// might not be able to read it.
+type fetchRequest struct {
+	URL        string        `json:"url,omitempty"`
+	S3         string        `json:"s3,omitempty"`
+	Last       URLValidators `json:"last"`
+	Headers    []string      `json:"headers,omitempty"`
+	CACert     []byte        `json:"ca_cert,omitempty"`
+	CACertFile string        `json:"ca_cert_file,omitempty"`
+	Insecure   bool          `json:"insecure,omitempty"`
+	Timeout    time.Duration `json:"timeout"`
+	Retries    int           `json:"retries"`
+	Proxy      string        `json:"proxy,omitempty"`
+	URLProxy   string        `json:"url_proxy,omitempty"`
+	S3Region   string        `json:"s3_region,omitempty"`
+	S3Endpoint string        `json:"s3_endpoint,omitempty"`
+}
+
+// fetchResponse is what fetch-as got - a 304 is NotModified.
+type fetchResponse struct {
+	Body        string        `json:"body"`
+	Validators  URLValidators `json:"validators"`
+	NotModified bool          `json:"not_modified,omitempty"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// fetchAsArgs is the command that runs fetch-as.
+var fetchAsArgs = func() (string, []string) {
+	self, err := os.Executable()
+	if err != nil {
+		self = os.Args[0]
+	}
+	return self, []string{"fetch-as"}
+}
+
+// fetchAsUser is true when the fetches are made by fetch-as - kvexpress runs
+// as root with --run-as. Someone who isn't root is already the --run-as user.
+func fetchAsUser() bool {
+	return runAsUser != nil && os.Geteuid() == 0
+}
+
+// fetchAs runs req in fetch-as as the --run-as user with the clean
+// environment and the fetchEnv variables.
+func fetchAs(req fetchRequest) (string, URLValidators, error) {
+	if URLCACert != "" {
+		ca, err := ioutil.ReadFile(URLCACert)
+		if err != nil {
+			return "", URLValidators{}, err
+		}
+		req.CACert, req.CACertFile = ca, URLCACert
+	}
+	req.Insecure, req.Timeout, req.Retries = URLInsecure, URLTimeout, URLRetries
+	req.Proxy, req.URLProxy, req.S3Region, req.S3Endpoint = Proxy, URLProxy, S3Region, S3Endpoint
+	input, err := json.Marshal(req)
+	if err != nil {
+		return "", URLValidators{}, err
+	}
+	self, args := fetchAsArgs()
+	cmd := exec.CommandContext(RunContext(), self, args...)
+	var env []string
+	for _, name := range fetchEnv {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	runAsCommand(cmd, env...)
+	var stderr bytes.Buffer
+	cmd.Stdin, cmd.Stderr = bytes.NewReader(input), &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", URLValidators{}, runStopped(fmt.Errorf("could not fetch as --run-as %s: %v %s", RunAs, err, strings.TrimSpace(stderr.String())))
+	}
+	var resp fetchResponse
+	if err := json.Unmarshal(output, &resp); err != nil {
+		return "", URLValidators{}, fmt.Errorf("could not read what --run-as %s fetched: %v", RunAs, err)
+	}
+	switch {
+	case resp.NotModified:
+		return "", resp.Validators, ErrNotModified
+	case resp.Error != "":
+		return "", resp.Validators, errors.New(resp.Error)
+	}
+	Log(fmt.Sprintf("function='fetchAs' run_as='%s' size='%d'", RunAs, len(resp.Body)), "debug")
+	return resp.Body, resp.Validators, nil
+}
+
+func fetchAsRun(cmd *cobra.Command, args []string) {
+	var req fetchRequest
+	var resp fetchResponse
+	if err := json.NewDecoder(os.Stdin).Decode(&req); err != nil {
+		resp.Error = fmt.Sprintf("could not read the fetch: %v", err)
+	} else {
+		resp = fetch(req)
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(resp); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// fetch is what fetch-as does with req - with the flags it was sent.
+func fetch(req fetchRequest) fetchResponse {
+	URLInsecure, URLTimeout, URLRetries = req.Insecure, req.Timeout, req.Retries
+	Proxy, URLProxy, S3Region, S3Endpoint = req.Proxy, req.URLProxy, req.S3Region, req.S3Endpoint
+	var resp fetchResponse
+	var err error
+	if req.S3 != "" {
+		resp.Body, err = ReadS3(req.S3)
+	} else {
+		var client *http.Client
+		if client, err = urlClientCA(req.CACert, req.CACertFile); err == nil {
+			resp.Body, resp.Validators, err = readURLRetries(client, req.URL, req.Last, req.Headers)
+		}
+	}
+	switch {
+	case errors.Is(err, ErrNotModified):
+		resp.NotModified, resp.Validators = true, req.Last
+	case err != nil:
+		resp.Error = err.Error()
+	}
+	return resp
+}
+
+func init() {
+	RootCmd.AddCommand(fetchAsCmd)
+}
@@ -0,0 +1,70 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFetchAs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Header.Get("Authorization") != "Bearer secret":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.Header.Get("If-None-Match") == `"v1"`:
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.Header().Set("ETag", `"v1"`)
+			w.Write([]byte("10.0.0.1 web1\n"))
+		}
+	}))
+	defer server.Close()
+	defer func(timeout time.Duration, retries int) {
+		RunAs, runAsUser, URLHeaders, URLTimeout, URLRetries = "", nil, nil, timeout, retries
+	}(URLTimeout, URLRetries)
+	RunAs = GetCurrentUsername()
+	URLHeaders, URLTimeout, URLRetries = []string{"Authorization: Bearer secret"}, 5*time.Second, 1
+	if err := SetupRunAs(); err != nil {
+		t.Fatal(err)
+	}
+	// fetch-as is this test binary running TestFetchAsHelper.
+	runAsUser.env = append(runAsUser.env, "KVEXPRESS_TEST_FETCH_AS=1")
+	runs := 0
+	defer func(args func() (string, []string)) { fetchAsArgs = args }(fetchAsArgs)
+	fetchAsArgs = func() (string, []string) {
+		runs++
+		return os.Args[0], []string{"-test.run=^TestFetchAsHelper$"}
+	}
+
+	body, validators, err := fetchAs(fetchRequest{URL: server.URL, Headers: URLHeaders})
+	if err != nil || body != "10.0.0.1 web1\n" || validators.ETag != `"v1"` || runs != 1 {
+		t.Fatalf("fetch-as should read the URL: %q %v %v", body, validators, err)
+	}
+	if _, _, err := fetchAs(fetchRequest{URL: server.URL, Headers: URLHeaders, Last: validators}); !errors.Is(err, ErrNotModified) {
+		t.Errorf("A 304 should be ErrNotModified: %v", err)
+	}
+	if _, _, err := fetchAs(fetchRequest{URL: server.URL}); err == nil {
+		t.Error("A URL that fails should be an error.")
+	}
+	// As root the URL is only read by fetch-as.
+	if os.Geteuid() == 0 {
+		runs = 0
+		if body, err := ReadURL(server.URL); err != nil || body != "10.0.0.1 web1\n" || runs != 1 {
+			t.Errorf("--run-as should read the URL as that user: %q %v %d", body, err, runs)
+		}
+	}
+}
+
+// TestFetchAsHelper is the fetch-as TestFetchAs runs.
+func TestFetchAsHelper(t *testing.T) {
+	if os.Getenv("KVEXPRESS_TEST_FETCH_AS") != "1" {
+		return
+	}
+	fetchAsRun(nil, nil)
+	os.Exit(0)
+}
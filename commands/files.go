@@ -1,19 +1,47 @@
-// +build linux darwin freebsd
+// +build linux darwin freebsd windows
 
 package commands
 
 import (
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"path"
+	"os/exec"
+	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 var (
 	fileSuffix = "kvexpress"
+
+	// ErrDirectory is returned when there's a directory where a file should be.
+	ErrDirectory = errors.New("is a directory")
+
+	// ErrNotRegular is returned when there's a pipe, socket or device where a
+	// file should be - opening a pipe would block until something writes to it.
+	ErrNotRegular = errors.New("is not a regular file")
+
+	// ErrFilesystem is returned when a file can't be written because the disk
+	// is full or the filesystem is read-only - it's the host, not the data.
+	ErrFilesystem = errors.New("the filesystem can't be written")
+
+	// ErrNotAllowed is returned for files that kvexpress shouldn't touch.
+	ErrNotAllowed = errors.New("file is not allowed")
+
+	// ErrChecksumMatch is returned by CheckFiletoWrite when the file is already
+	// the same - there's nothing to write.
+	ErrChecksumMatch = errors.New("the file has the same checksum")
+
+	// ErrCheckFailed is returned when --check-exec didn't pass the new file -
+	// the old one is left in place.
+	ErrCheckFailed = errors.New("the check failed")
 )
 
 // ReadFile reads a file in the filesystem and returns a string.
@@ -25,16 +53,148 @@ func ReadFile(filepath string) string {
 	return string(dat)
 }
 
+// Stdio is passed to -f to read the data from stdin or write it to stdout.
+const Stdio = "-"
+
+// ReadStdin reads all of the data piped into kvexpress.
+func ReadStdin() (string, error) {
+	dat, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return "", err
+	}
+	Log(fmt.Sprintf("stdin='true' size='%d'", len(dat)), "debug")
+	return string(dat), nil
+}
+
 // SortFile takes a string, splits it into lines, removes all blank lines using
 // BlankLineStrip() and then sorts the remaining lines.
 func SortFile(file string) string {
-	Log("sorting='true'", "debug")
-	lines := strings.Split(file, "\n")
-	lines = BlankLineStrip(lines)
-	sort.Strings(lines)
+	return SortLines(file, "lexical", false)
+}
+
+// sortModes are the ways --sort can order the lines.
+var sortModes = []string{"none", "lexical", "numeric", "version"}
+
+// SortLines removes the blank lines from data and orders the rest by mode.
+// numeric sorts by the number at the start of each line and version compares
+// the runs of digits as numbers - so 10.0.0.9 comes before 10.0.0.10. With
+// none the order is kept and the data is only changed if unique is set -
+// unique keeps the first of any lines that are the same.
+func SortLines(data, mode string, unique bool) string {
+	Log(fmt.Sprintf("sorting='%s' unique='%t'", mode, unique), "debug")
+	if mode == "none" && !unique {
+		return data
+	}
+	lines := BlankLineStrip(strings.Split(data, "\n"))
+	if unique {
+		seen := make(map[string]bool)
+		var kept []string
+		for _, line := range lines {
+			if !seen[line] {
+				seen[line] = true
+				kept = append(kept, line)
+			}
+		}
+		lines = kept
+	}
+	switch mode {
+	case "lexical":
+		sort.Strings(lines)
+	case "numeric":
+		sort.SliceStable(lines, func(i, j int) bool {
+			a, b := leadingNumber(lines[i]), leadingNumber(lines[j])
+			if a != b {
+				return a < b
+			}
+			return lines[i] < lines[j]
+		})
+	case "version":
+		sort.SliceStable(lines, func(i, j int) bool {
+			return compareVersions(lines[i], lines[j]) < 0
+		})
+	}
 	return strings.Join(lines, "\n")
 }
 
+// leadingNumber is the number at the start of line - 0 if there isn't one,
+// the way sort -n does it.
+func leadingNumber(line string) float64 {
+	line = strings.TrimSpace(line)
+	end := 0
+	for end < len(line) && (line[end] >= '0' && line[end] <= '9' || line[end] == '.' || end == 0 && line[end] == '-') {
+		end++
+	}
+	for ; end > 0; end-- {
+		if n, err := strconv.ParseFloat(line[:end], 64); err == nil {
+			return n
+		}
+	}
+	return 0
+}
+
+// compareVersions compares a and b a run at a time - runs of digits are
+// compared as numbers and everything else as text.
+func compareVersions(a, b string) int {
+	for a != "" && b != "" {
+		ra, rb := versionRun(a), versionRun(b)
+		a, b = a[len(ra):], b[len(rb):]
+		if isDigit(ra[0]) && isDigit(rb[0]) {
+			na, nb := strings.TrimLeft(ra, "0"), strings.TrimLeft(rb, "0")
+			if len(na) != len(nb) {
+				return len(na) - len(nb)
+			}
+			if c := strings.Compare(na, nb); c != 0 {
+				return c
+			}
+			continue
+		}
+		if c := strings.Compare(ra, rb); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+// versionRun is the run of digits or of anything else at the start of s.
+func versionRun(s string) string {
+	end := 1
+	for end < len(s) && isDigit(s[end]) == isDigit(s[0]) {
+		end++
+	}
+	return s[:end]
+}
+
+// isDigit is true for the ASCII digits.
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// FilterLines keeps the lines in data that match include and don't match
+// exclude - either can be nil - and removes the lines that start with comment
+// once they're trimmed. A trailing newline is kept.
+func FilterLines(data string, include, exclude *regexp.Regexp, comment string) string {
+	trailing := strings.HasSuffix(data, "\n")
+	var kept []string
+	for _, line := range strings.Split(strings.TrimSuffix(data, "\n"), "\n") {
+		if comment != "" && strings.HasPrefix(strings.TrimSpace(line), comment) {
+			continue
+		}
+		if include != nil && !include.MatchString(line) {
+			continue
+		}
+		if exclude != nil && exclude.MatchString(line) {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	Log(fmt.Sprintf("in: filter_lines='true' kept='%d'", len(kept)), "debug")
+	filtered := strings.Join(kept, "\n")
+	if trailing && filtered != "" {
+		filtered += "\n"
+	}
+	return filtered
+}
+
 // BlankLineStrip takes a slice of strings, ranges over them and only returns
 // a slice of strings where the lines weren't blank.
 func BlankLineStrip(data []string) []string {
@@ -50,92 +210,358 @@ func BlankLineStrip(data []string) []string {
 
 // CheckFullPath will check the path and recursively create directories if they don't
 // exist.
-func CheckFullPath(file string) {
-	targetDirectory := path.Dir(file)
+func CheckFullPath(file string) error {
+	targetDirectory := filepath.Dir(file)
 	// If there is a file with the same name in the targetDirectory path - it will error.
 	// It will not overwrite it.
 	err := os.MkdirAll(targetDirectory, os.FileMode(0755))
 	if err != nil {
 		Log(fmt.Sprintf("function='CheckFullPath' panic='true' file='%s'", targetDirectory), "info")
-		fmt.Printf("Panic: Could not create directories: '%s'\n", targetDirectory)
-		StatsdPanic(targetDirectory, "create_directory")
+		return filesystemError(fmt.Errorf("could not create directories '%s': %w", targetDirectory, err))
 	}
+	return nil
 }
 
 // WriteFile writes a string to a filepath. It also chowns the file to the owner and group
 // of the user running the program if it's not set as a different user.
-func WriteFile(data string, filepath string, perms int, owner string) {
+func WriteFile(data string, filepath string, perms int, owner string) error {
+	return WriteCheckedFile(data, filepath, perms, owner, "")
+}
+
+// WriteCheckedFile is WriteFile that runs check against the temp file before
+// it's renamed into place - %f is the temp file's path. The file isn't
+// replaced if the check fails.
+func WriteCheckedFile(data string, filepath string, perms int, owner string, check string) error {
+	span := StartSpan("file.write", "kvexpress.file", filepath, "kvexpress.bytes", strconv.Itoa(len(data)))
+	err := writeFile(data, filepath, perms, owner, check)
+	span.Finish(err)
+	return err
+}
+
+// writeFile is WriteCheckedFile without the span.
+func writeFile(data string, filepath string, perms int, owner string, check string) error {
+	staged, err := stageFile(data, filepath, perms, owner, check)
+	if err != nil {
+		return err
+	}
+	return staged.commit()
+}
+
+// stagedFile is a file that's been written to its temp file and checked but
+// hasn't been renamed into place.
+type stagedFile struct {
+	file  string
+	tmp   string
+	perms int
+	oid   int
+	gid   int
+}
+
+// stageFile writes data to the file's temp file with its owner, mode and
+// labels and runs check against it. The file itself isn't touched.
+func stageFile(data string, filepath string, perms int, owner string, check string) (stagedFile, error) {
+	filepath, err := ResolveWriteFile(filepath)
+	if err != nil {
+		return stagedFile{}, err
+	}
 	// If a directory doesn't exist then that's a bad thing.
 	// Caused some problems with Consul and file descriptors after a long weekend erroring.
-	CheckFullPath(filepath)
+	if err := CheckFullPath(filepath); err != nil {
+		return stagedFile{}, err
+	}
 	// Write the file to the tmpFilepath.
-	tmpFilepath := fmt.Sprintf("%s.%s", filepath, fileSuffix)
-	err := ioutil.WriteFile(tmpFilepath, []byte(data), os.FileMode(perms))
+	tmpFilepath := TmpFilename(filepath)
+	if err := checkTmpDir(filepath); err != nil {
+		return stagedFile{}, err
+	}
+	if err := removeLeftoverTmp(tmpFilepath); err != nil {
+		return stagedFile{}, err
+	}
+	err = writeTmpFile(tmpFilepath, data, perms)
 	if err != nil {
 		Log(fmt.Sprintf("function='WriteFile' panic='true' file='%s'", filepath), "info")
-		fmt.Printf("Panic: Could not write file: '%s'\n", filepath)
-		StatsdPanic(filepath, "write_file")
+		// A disk that's full has part of the data in the temp file.
+		os.Remove(tmpFilepath)
+		return stagedFile{}, filesystemError(fmt.Errorf("could not write file '%s': %w", filepath, err))
 	}
 	// Chown the file.
-	fileChown, oid, gid := ChownFile(tmpFilepath, owner)
+	oid, gid, err := ChownFile(tmpFilepath, owner)
+	if err != nil {
+		os.Remove(tmpFilepath)
+		return stagedFile{}, err
+	}
+	// The umask changed the mode it was created with - and a chown clears the
+	// setuid and setgid bits - so it's set again.
+	if err := os.Chmod(tmpFilepath, osFileMode(perms)); err != nil {
+		os.Remove(tmpFilepath)
+		return stagedFile{}, fmt.Errorf("could not chmod '%s': %v", filepath, err)
+	}
+	// The new file gets the labels of the one it replaces before it's in place.
+	if err := copyFileAttrs(filepath, tmpFilepath); err != nil {
+		os.Remove(tmpFilepath)
+		return stagedFile{}, err
+	}
+	if check != "" {
+		if err := CheckFile(check, tmpFilepath); err != nil {
+			os.Remove(tmpFilepath)
+			return stagedFile{}, fmt.Errorf("'%s' wasn't replaced: %w", filepath, err)
+		}
+	}
+	return stagedFile{file: filepath, tmp: tmpFilepath, perms: perms, oid: oid, gid: gid}, nil
+}
+
+// discard removes the temp file so the file stays the way it was.
+func (staged stagedFile) discard() {
+	os.Remove(staged.tmp)
+}
+
+// commit renames the temp file into place.
+func (staged stagedFile) commit() error {
+	filepath, tmpFilepath, perms := staged.file, staged.tmp, staged.perms
+	// A stopped run leaves the file the way it was.
+	if runCtx.Err() != nil {
+		os.Remove(tmpFilepath)
+		return fmt.Errorf("%w: '%s' wasn't replaced", ErrRunStopped, filepath)
+	}
 	// Rename the file so it's not truncated for 1 microsecond
 	// which is actually important at high velocities.
-	err = os.Rename(tmpFilepath, filepath)
+	err := os.Rename(tmpFilepath, filepath)
 	if err != nil {
 		Log(fmt.Sprintf("function='Rename' panic='true' file='%s'", filepath), "info")
-		fmt.Printf("Panic: Could not rename file: '%s'\n", filepath)
-		StatsdPanic(filepath, "rename_file")
+		os.Remove(tmpFilepath)
+		return filesystemError(fmt.Errorf("could not rename file '%s': %w", filepath, err))
+	}
+	if SELinuxContext == "restore" {
+		if err := restoreContext(filepath); err != nil {
+			return err
+		}
+	}
+	if err := checkFileMode(filepath, perms); err != nil {
+		return err
+	}
+	// The rename isn't safe from a crash until the directory is on disk too.
+	if !NoFsync {
+		if err := syncParentDir(filepath); err != nil {
+			return fmt.Errorf("could not sync the directory for '%s': %v", filepath, err)
+		}
 	}
 	Log(fmt.Sprintf("file_wrote='true' location='%s' permissions='%s'", filepath, strconv.FormatInt(int64(perms), 8)), "debug")
-	Log(fmt.Sprintf("file_chown='%t' location='%s' owner='%d' group='%d'", fileChown, filepath, oid, gid), "debug")
+	Log(fmt.Sprintf("file_chown='true' location='%s' owner='%d' group='%d'", filepath, staged.oid, staged.gid), "debug")
+	return nil
+}
+
+// ResolveWriteFile is the file that's replaced when file is written. A
+// symlink is replaced by the new file - unless there's --follow-symlinks and
+// then it's the file the link points to, which has to be in an allowed
+// directory too. It's ErrDirectory or ErrNotRegular for anything that isn't a
+// file.
+func ResolveWriteFile(file string) (string, error) {
+	info, err := os.Lstat(file)
+	if err != nil {
+		return file, nil
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		if !FollowSymlinks {
+			Log(fmt.Sprintf("file='%s' symlink='true' - replacing the link.", file), "debug")
+			return file, nil
+		}
+		target, err := filepath.EvalSymlinks(file)
+		if err != nil {
+			return file, fmt.Errorf("could not follow the link '%s': %v", file, err)
+		}
+		if err := CheckAllowedDir(target); err != nil {
+			return file, err
+		}
+		Log(fmt.Sprintf("file='%s' symlink='true' target='%s'", file, target), "debug")
+		file = target
+		if info, err = os.Lstat(file); err != nil {
+			return file, nil
+		}
+	}
+	return file, checkRegularFile(file, info)
+}
+
+// checkRegularFile is ErrDirectory or ErrNotRegular if info isn't a file.
+func checkRegularFile(file string, info os.FileInfo) error {
+	switch {
+	case info.IsDir():
+		return fmt.Errorf("can not write '%s': %w", file, ErrDirectory)
+	case !info.Mode().IsRegular():
+		return fmt.Errorf("can not write '%s' - it's a %s: %w", file, fileType(info.Mode()), ErrNotRegular)
+	}
+	return nil
+}
+
+// fileType is what kind of file mode is - for an error.
+func fileType(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		return "named pipe"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeDevice != 0:
+		return "device"
+	}
+	return "special file"
+}
+
+// FilesystemReason is full or read_only for an error from a disk that's full
+// or a filesystem that's read-only - and blank for anything else.
+func FilesystemReason(err error) string {
+	switch {
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return "full"
+	case errors.Is(err, syscall.EROFS):
+		return "read_only"
+	}
+	return ""
+}
+
+// filesystemError marks err as an ErrFilesystem if the disk is full or the
+// filesystem is read-only.
+func filesystemError(err error) error {
+	if reason := FilesystemReason(err); reason != "" {
+		return fsError{reason: reason, err: err}
+	}
+	return err
+}
+
+// fsError is an ErrFilesystem for err - errors.Is sees both.
+type fsError struct {
+	reason string
+	err    error
+}
+
+func (e fsError) Error() string {
+	return fmt.Sprintf("%v (%s): %v", ErrFilesystem, e.reason, e.err)
+}
+
+func (e fsError) Is(target error) bool {
+	return target == ErrFilesystem
+}
+
+func (e fsError) Unwrap() error {
+	return e.err
+}
+
+// selinuxXattr is the extended attribute that holds a file's SELinux context.
+const selinuxXattr = "security.selinux"
+
+// copyFileAttrs gives tmp the extended attributes of the file it replaces -
+// all of them, POSIX ACLs too, with --keep-xattrs or just the SELinux context
+// with --selinux-context keep. Any other --selinux-context but restore is set
+// as the context.
+func copyFileAttrs(file, tmp string) error {
+	switch {
+	case KeepXattrs:
+		if err := copyXattrs(file, tmp, ""); err != nil {
+			return err
+		}
+	case SELinuxContext == "keep":
+		if err := copyXattrs(file, tmp, selinuxXattr); err != nil {
+			return err
+		}
+	}
+	if SELinuxContext != "" && SELinuxContext != "keep" && SELinuxContext != "restore" {
+		return setXattr(tmp, selinuxXattr, SELinuxContext)
+	}
+	return nil
 }
 
-// ChownFile does what it sounds like.
-func ChownFile(filepath string, owner string) (bool, int, int) {
-	var fileChown = false
-	oid := GetOwnerID(owner)
-	gid := GetGroupID(owner)
-	err := os.Chown(filepath, oid, gid)
+// restoreContext runs restorecon so file gets the SELinux context the policy
+// has for its path.
+func restoreContext(file string) error {
+	output, err := exec.CommandContext(RunContext(), "restorecon", file).CombinedOutput()
+	Log(fmt.Sprintf("function='restoreContext' file='%s' status='%d'", file, ExecStatus(err)), "debug")
 	if err != nil {
-		fileChown = false
-		fmt.Printf("Panic: Could not chown file: '%s'\n", filepath)
-		StatsdPanic(filepath, "chown_file")
-	} else {
-		fileChown = true
+		return fmt.Errorf("could not restorecon '%s': %v %s", file, err, strings.TrimSpace(string(output)))
 	}
-	return fileChown, oid, gid
+	return nil
 }
 
-// CheckFiletoWrite takes a filename and checksum and stops execution if
+// leftoverTmpAge is how old a temporary file has to be before it's treated as
+// left behind - a younger one may belong to a write that's still going.
+const leftoverTmpAge = time.Minute
+
+// removeLeftoverTmp removes a temporary file that a kvexpress that was killed
+// before its rename left behind. It's never renamed into place because there's
+// no way to know that it was finished - the data is written again instead.
+func removeLeftoverTmp(file string) error {
+	info, err := os.Lstat(file)
+	if err != nil || time.Since(info.ModTime()) < leftoverTmpAge {
+		return nil
+	}
+	Log(fmt.Sprintf("function='WriteFile' leftover='true' file='%s' - removing.", file), "info")
+	StatsdTempLeftover(file)
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove leftover '%s': %v", file, err)
+	}
+	return nil
+}
+
+// writeTmpFile writes data to file and makes sure it's on disk before it's
+// renamed - unless there's --no-fsync.
+func writeTmpFile(file, data string, perms int) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, osFileMode(perms))
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(data); err == nil && !NoFsync {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// CheckFiletoWrite takes a filename and checksum and returns an error if
 // there is a directory OR the file has the same checksum.
-func CheckFiletoWrite(filename, checksum string) {
-	// Try to open the file.
-	file, err := os.Open(filename)
-	f, err := file.Stat()
+func CheckFiletoWrite(filename, checksum string) error {
+	matches, err := FileChecksumMatches(filename, checksum)
+	if err != nil {
+		return err
+	}
+	if matches {
+		Log(fmt.Sprintf("'%s' has the same checksum. Stopping.", filename), "info")
+		return ErrChecksumMatch
+	}
+	return nil
+}
+
+// FileChecksumMatches takes a filename and checksum and returns true if the
+// file has the same checksum. It returns ErrDirectory if there is a directory
+// and ErrNotRegular for a pipe, socket or device - they aren't opened.
+func FileChecksumMatches(filename, checksum string) (bool, error) {
+	resolved, err := ResolveWriteFile(filename)
+	if err != nil {
+		Log(fmt.Sprintf("Can NOT write %s: %v", filename, err), "info")
+		return false, err
+	}
+	f, err := os.Stat(resolved)
 	switch {
 	case err != nil:
 		Log(fmt.Sprintf("there is NO file at %s", filename), "debug")
 		break
-	case f.IsDir():
-		Log(fmt.Sprintf("Can NOT write a directory %s", filename), "info")
-		os.Exit(1)
+	case !f.Mode().IsRegular():
+		// A link to something that isn't a file - the link is replaced.
+		Log(fmt.Sprintf("'%s' doesn't link to a file", filename), "debug")
 	default:
 		data, err := ioutil.ReadFile(filename)
 		if err != nil {
-			Log(fmt.Sprintf("CheckFiletoWrite(): Error reading file: '%s'", filename), "info")
+			Log(fmt.Sprintf("FileChecksumMatches(): Error reading file: '%s'", filename), "info")
 		}
-		computedChecksum := ComputeChecksum(string(data))
-		if computedChecksum == checksum {
-			Log(fmt.Sprintf("'%s' has the same checksum. Stopping.", filename), "info")
-			os.Exit(0)
+		if ChecksumCompare(string(data), checksum) {
+			return true, nil
 		}
 	}
 	// If there's no file - then great - there's nothing to check
+	return false, nil
 }
 
-// RemoveFile takes a filename and stops if it's a directory. It will log success
-// or failure of removal.
-func RemoveFile(filename string) {
+// RemoveFile takes a filename and returns ErrDirectory if it's a directory. It
+// will log success or failure of removal.
+func RemoveFile(filename string) error {
 	file, err := os.Open(filename)
 	f, err := file.Stat()
 	switch {
@@ -143,7 +569,9 @@ func RemoveFile(filename string) {
 		Log(fmt.Sprintf("Could NOT stat %s", filename), "debug")
 	case f.IsDir():
 		Log(fmt.Sprintf("Would NOT remove a directory %s", filename), "info")
-		os.Exit(1)
+		return fmt.Errorf("would not remove '%s': %w", filename, ErrDirectory)
+	case DryRunSkip(fmt.Sprintf("remove '%s'", filename)):
+		// Nothing is removed.
 	default:
 		err = os.Remove(filename)
 		if err != nil {
@@ -152,14 +580,53 @@ func RemoveFile(filename string) {
 			Log(fmt.Sprintf("Removed %s", filename), "info")
 		}
 	}
+	return nil
+}
+
+// BackupFile copies file to file.1 before it's replaced - the older copies
+// move to file.2, file.3 and so on and anything past keep is removed. There's
+// nothing to back up if the file doesn't exist yet.
+func BackupFile(file string, keep int) error {
+	info, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for i := keep + 1; ; i++ {
+		if err := os.Remove(backupName(file, i)); err != nil {
+			break
+		}
+	}
+	for i := keep - 1; i >= 1; i-- {
+		if err := os.Rename(backupName(file, i), backupName(file, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if err := writeTmpFile(backupName(file, 1), string(data), int(info.Mode().Perm())); err != nil {
+		return fmt.Errorf("could not back up '%s': %v", file, err)
+	}
+	Log(fmt.Sprintf("file_backup='true' location='%s' keep='%d'", file, keep), "debug")
+	return nil
+}
+
+// backupName is the name of the nth backup of file.
+func backupName(file string, n int) string {
+	return fmt.Sprintf("%s.%d", file, n)
 }
 
 // RandomTmpFile is used to create a .compare or .last file for UrltoRead()
 func RandomTmpFile() string {
-	file, err := ioutil.TempFile(os.TempDir(), "kvexpress")
+	file, err := ioutil.TempFile(ScratchDir(), "kvexpress")
 	if err != nil {
-		Log("function='RandomTmpFile' panic='true'", "info")
+		LogFatal(fmt.Sprintf("Could not create a file in '%s': %v", ScratchDir(), err), "RandomTmpFile", "write_file")
 	}
+	file.Close()
 	fileName := file.Name()
 	Log(fmt.Sprintf("tempfile='%s'", fileName), "debug")
 	return fileName
@@ -167,26 +634,112 @@ func RandomTmpFile() string {
 
 // CompareFilename returns a .compare filename based on the passed file.
 func CompareFilename(file string) string {
-	compare := fmt.Sprintf("%s.compare", path.Base(file))
-	fullPath := path.Join(path.Dir(file), compare)
+	compare := fmt.Sprintf("%s.compare", filepath.Base(file))
+	fullPath := filepath.Join(filepath.Dir(file), compare)
 	Log(fmt.Sprintf("file='compare' fullPath='%s'", fullPath), "debug")
 	return fullPath
 }
 
+// TmpFilename is where WriteFile writes the data before it's renamed into
+// place - next to file, or in --tmp-dir with a name that's made from the
+// whole path so two files with the same name don't share one.
+func TmpFilename(file string) string {
+	if TmpDir == "" {
+		return fmt.Sprintf("%s.%s", file, fileSuffix)
+	}
+	full, err := filepath.Abs(file)
+	if err != nil {
+		full = file
+	}
+	sum := sha256.Sum256([]byte(full))
+	return filepath.Join(TmpDir, fmt.Sprintf(".%s.%x.%s", filepath.Base(file), sum[:6], fileSuffix))
+}
+
+// ScratchDir is where the files that aren't renamed into place - like the
+// .compare file for a url - are written. It's --tmp-dir if it was passed.
+func ScratchDir() string {
+	if TmpDir != "" {
+		return TmpDir
+	}
+	return os.TempDir()
+}
+
+// StateDir is where the run locks, the pending and traffic files and the
+// --exec-debounce state are kept. It's --tmp-dir if it was passed - the
+// shared temp directory would let another user put a symlink where one of
+// them goes, so it's userStateDir otherwise.
+func StateDir() string {
+	if TmpDir != "" {
+		return TmpDir
+	}
+	return userStateDir()
+}
+
+// stateDirError is why StateDir can't be used - --tmp-dir is the user's
+// choice and isn't checked.
+func stateDirError() error {
+	if TmpDir != "" {
+		return nil
+	}
+	return checkStateDir(userStateDir())
+}
+
+// writeStateFile replaces the state file at path with data - it's written
+// to a .tmp file that's opened with openStateFile and renamed over path.
+func writeStateFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := openStateFile(tmp)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(0)
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// checkTmpDir makes sure the temporary file for file can be renamed over it -
+// a rename can't move a file to another filesystem, so --tmp-dir has to be on
+// the same one as every file that's written.
+func checkTmpDir(file string) error {
+	if TmpDir == "" {
+		return nil
+	}
+	same, err := sameFilesystem(TmpDir, filepath.Dir(file))
+	if err != nil {
+		return fmt.Errorf("could not check --tmp-dir '%s': %v", TmpDir, err)
+	}
+	if !same {
+		return fmt.Errorf("--tmp-dir '%s' is not on the same filesystem as '%s' - the file can't be renamed into place", TmpDir, file)
+	}
+	return nil
+}
+
 // LastFilename returns a .last filename based on the passed file.
 func LastFilename(file string) string {
-	last := fmt.Sprintf("%s.last", path.Base(file))
-	fullPath := path.Join(path.Dir(file), last)
+	last := fmt.Sprintf("%s.last", filepath.Base(file))
+	fullPath := filepath.Join(filepath.Dir(file), last)
 	Log(fmt.Sprintf("file='last' fullPath='%s'", fullPath), "debug")
 	return fullPath
 }
 
 // CheckLastFile creates a .last file if it doesn't exist.
-func CheckLastFile(file string, perms int, owner string) {
+func CheckLastFile(file string, perms int, owner string) error {
 	if _, err := os.Stat(file); err != nil {
 		Log(fmt.Sprintf("file='last' file='%s' does_not_exist='true'", file), "debug")
-		WriteFile("This is a blank file.\n", file, perms, owner)
+		return WriteFile("This is a blank file.\n", file, perms, owner)
 	}
+	return nil
 }
 
 // LockFilePath generates a filename for the `$filename.locked` files used
@@ -197,27 +750,101 @@ func LockFilePath(file string) string {
 }
 
 // LockFileWrite writes a `$filename.locked` file with instructions for how to unlock.
-func LockFileWrite(file string) {
+func LockFileWrite(file string) error {
 	lockedFile := LockFilePath(file)
 	if _, err := os.Stat(lockedFile); err != nil {
 		Log(fmt.Sprintf("file='locked' file='%s' does_not_exist='true'", lockedFile), "debug")
 		lockedFileText := fmt.Sprintf("To unlock '%s' and allow kvexpress to write again:\n\nsudo kvexpress unlock -f %s\n\nReason Locked: %s\n\n", FiletoLock, FiletoLock, LockReason)
-		WriteFile(lockedFileText, lockedFile, FilePermissions, Owner)
-	} else {
-		Log(fmt.Sprintf("file='locked' file='%s' does_not_exist='false'", lockedFile), "info")
+		if LockTTL > 0 {
+			lockedFileText += fmt.Sprintf("Lock Expires: %s\n\n", time.Now().UTC().Add(LockTTL).Format(time.RFC3339))
+		}
+		return WriteFile(lockedFileText, lockedFile, FilePermissions, Owner)
 	}
+	Log(fmt.Sprintf("file='locked' file='%s' does_not_exist='false'", lockedFile), "info")
+	return nil
 }
 
 // LockFileRemove removes a `$filename.locked` when running `kvexpress unlock`.
-func LockFileRemove(file string) {
+func LockFileRemove(file string) error {
 	lockedFile := LockFilePath(file)
-	RemoveFile(lockedFile)
+	return RemoveFile(lockedFile)
+}
+
+// CheckFullFilename makes sure that the filename is a complete path and
+// that it's in an allowed directory.
+func CheckFullFilename(file string) error {
+	if !filepath.IsAbs(file) {
+		return fmt.Errorf("%w: please supply a complete file path", ErrNotAllowed)
+	}
+	return CheckAllowedDir(file)
+}
+
+// CheckAllowedDir returns ErrNotAllowed if the file is outside of the
+// --allowed-dir directories, --allowed-paths or the policy, or inside one of
+// the denied roots. The account files in deniedFiles are checked against
+// --allowed-paths and the policy only.
+func CheckAllowedDir(file string) error {
+	allowed, reason := PathAllowed(file, AllowedDirs)
+	for _, paths := range [][]string{AllowedPaths, policyPaths} {
+		if allowed && len(paths) > 0 {
+			allowed, reason = PathAllowed(file, paths)
+		}
+	}
+	if allowed && !accountFileAllowed(file) {
+		allowed, reason = false, "an account file that --allowed-paths doesn't name"
+	}
+	if !allowed {
+		Log(fmt.Sprintf("file='%s' allowed='false' reason='%s'", file, reason), "info")
+		return fmt.Errorf("%w: will not write '%s' - %s", ErrNotAllowed, file, reason)
+	}
+	return nil
 }
 
-// CheckFullFilename makes sure that the filename begins with a slash.
-func CheckFullFilename(file string) {
-	if !strings.HasPrefix(file, "/") {
-		fmt.Println("Please supply a complete file path.")
-		os.Exit(1)
+// accountFileAllowed is false for a file in deniedFiles unless --allowed-paths
+// or the policy has it or a path inside it.
+func accountFileAllowed(file string) bool {
+	absolute, err := filepath.Abs(file)
+	if err != nil {
+		return false
+	}
+	denied := longestDirMatch(absolute, deniedFiles)
+	if denied < 0 {
+		return true
+	}
+	paths := append(append([]string{}, AllowedPaths...), policyPaths...)
+	return longestDirMatch(absolute, paths) >= denied
+}
+
+// PathAllowed checks a file against the allowed directories and the denied roots.
+// The most specific match wins - so an allowed directory inside a denied root is fine.
+// If no allowed directories are passed, anything outside the denied roots is allowed.
+func PathAllowed(file string, allowedDirs []string) (bool, string) {
+	absolute, err := filepath.Abs(file)
+	if err != nil {
+		return false, "could not determine the absolute path"
+	}
+	allowedMatch := longestDirMatch(absolute, allowedDirs)
+	deniedMatch := longestDirMatch(absolute, deniedRoots)
+	if len(allowedDirs) > 0 && allowedMatch < 0 {
+		return false, "outside of the allowed directories"
+	}
+	if deniedMatch >= 0 && allowedMatch < deniedMatch {
+		return false, "inside a sensitive directory"
+	}
+	return true, ""
+}
+
+// longestDirMatch returns the length of the longest directory in dirs that
+// contains file - or -1 if none of them do.
+func longestDirMatch(file string, dirs []string) int {
+	longest := -1
+	for _, dir := range dirs {
+		dir = filepath.Clean(dir)
+		if file == dir || strings.HasPrefix(file, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator)) {
+			if len(dir) > longest {
+				longest = len(dir)
+			}
+		}
 	}
+	return longest
 }
@@ -0,0 +1,432 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPathAllowed(t *testing.T) {
+	allowed := []string{"/etc/consul-template", "/opt/app/"}
+	permitted := []string{"/etc/consul-template/hosts.consul", "/opt/app/conf/app.json"}
+	for _, file := range permitted {
+		if ok, reason := PathAllowed(file, allowed); !ok {
+			t.Errorf("'%s' should be allowed: %s", file, reason)
+		}
+	}
+	rejected := []string{"/etc/passwd", "/etc/consul-template-other/hosts", "/opt/application/app.json"}
+	for _, file := range rejected {
+		if ok, _ := PathAllowed(file, allowed); ok {
+			t.Errorf("'%s' should NOT be allowed.", file)
+		}
+	}
+}
+
+func TestPathAllowedDeniedRoots(t *testing.T) {
+	if ok, _ := PathAllowed("/sys/kernel/something", []string{}); ok {
+		t.Error("Sensitive directories should be denied by default.")
+	}
+	if ok, _ := PathAllowed("/etc/hosts.consul", []string{}); !ok {
+		t.Error("Without an allowlist, non-sensitive paths should be allowed.")
+	}
+	if ok, _ := PathAllowed("/usr/lib/app/config", []string{"/usr/lib/app"}); !ok {
+		t.Error("A more specific allowed directory should win over a denied root.")
+	}
+}
+
+func TestCheckAllowedPaths(t *testing.T) {
+	AllowedPaths = []string{"/etc", "/opt/app"}
+	defer func() { AllowedPaths = []string{} }()
+	for _, file := range []string{"/etc/hosts.consul", "/opt/app/conf/app.json"} {
+		if err := CheckAllowedDir(file); err != nil {
+			t.Errorf("'%s' should be allowed: %v", file, err)
+		}
+	}
+	for _, file := range []string{"/etc/passwd", "/etc/../root/.ssh/authorized_keys", "/var/tmp/hosts"} {
+		if err := CheckAllowedDir(file); !errors.Is(err, ErrNotAllowed) {
+			t.Errorf("'%s' should be ErrNotAllowed: %v", file, err)
+		}
+	}
+	// --allowed-dir can't get around the policy.
+	AllowedDirs = []string{"/var/tmp"}
+	defer func() { AllowedDirs = []string{} }()
+	if err := CheckAllowedDir("/var/tmp/hosts"); !errors.Is(err, ErrNotAllowed) {
+		t.Errorf("--allowed-dir shouldn't widen --allowed-paths: %v", err)
+	}
+}
+
+func TestCheckAllowedAccountFiles(t *testing.T) {
+	AllowedDirs = []string{"/etc/passwd"}
+	defer func() { AllowedDirs, AllowedPaths, policyPaths = []string{}, []string{}, nil }()
+	if err := CheckAllowedDir("/etc/passwd"); !errors.Is(err, ErrNotAllowed) {
+		t.Errorf("--allowed-dir shouldn't allow an account file: %v", err)
+	}
+	AllowedDirs, policyPaths = []string{}, []string{"/etc/passwd"}
+	if err := CheckAllowedDir("/etc/passwd"); err != nil {
+		t.Errorf("A policy that names the account file allows it: %v", err)
+	}
+	if err := CheckAllowedDir("/etc/hosts"); !errors.Is(err, ErrNotAllowed) {
+		t.Errorf("Nothing outside the policy should be allowed: %v", err)
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvexpress-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if paths, err := LoadPolicy(filepath.Join(dir, "policy.yaml")); err != nil || paths != nil {
+		t.Errorf("A host without a policy doesn't have one: %v %v", paths, err)
+	}
+	policy := filepath.Join(dir, "policy.yaml")
+	ioutil.WriteFile(policy, []byte("allowed_paths:\n  - /etc/haproxy\n  - /opt/app/\n"), 0644)
+	os.Chmod(policy, 0666)
+	if _, err := LoadPolicy(policy); err == nil {
+		t.Error("A policy anyone can write to shouldn't be trusted.")
+	}
+	os.Chmod(policy, 0644)
+	paths, err := LoadPolicy(policy)
+	if os.Getuid() != 0 {
+		if err == nil {
+			t.Error("A policy that isn't owned by root shouldn't be trusted.")
+		}
+		return
+	}
+	if err != nil || len(paths) != 2 || paths[1] != "/opt/app" {
+		t.Errorf("The policy's allowed_paths should be read: %v %v", paths, err)
+	}
+	ioutil.WriteFile(policy, []byte("allowed_paths:\n  - etc\n"), 0644)
+	if _, err := LoadPolicy(policy); err == nil {
+		t.Error("A relative path in the policy should be an error.")
+	}
+}
+
+func TestRemoveFileDryRun(t *testing.T) {
+	file := ensureTestFile(t)
+	ioutil.WriteFile(file, []byte(exampleData), 0640)
+	DryRun = true
+	defer func() { DryRun = false }()
+	RemoveFile(file)
+	if _, err := os.Stat(file); err != nil {
+		t.Error("Nothing should be removed with --dry-run.")
+	}
+}
+
+func TestCheckAllowedDir(t *testing.T) {
+	if err := CheckAllowedDir("/sys/kernel/something"); !errors.Is(err, ErrNotAllowed) {
+		t.Errorf("A sensitive directory should be ErrNotAllowed: %v", err)
+	}
+	if err := CheckFullFilename("etc/hosts"); !errors.Is(err, ErrNotAllowed) {
+		t.Errorf("A relative path should be ErrNotAllowed: %v", err)
+	}
+	if err := CheckFullFilename("/etc/hosts.consul"); err != nil {
+		t.Errorf("A complete path should be fine: %v", err)
+	}
+}
+
+func TestCheckFiletoWrite(t *testing.T) {
+	file := ensureTestFile(t)
+	if err := CheckFiletoWrite(file, exampleDataSHA); err != nil {
+		t.Errorf("A missing file is fine to write: %v", err)
+	}
+	ioutil.WriteFile(file, []byte(exampleData), 0640)
+	if err := CheckFiletoWrite(file, exampleDataSHA); err != ErrChecksumMatch {
+		t.Errorf("A file with the same checksum should be ErrChecksumMatch: %v", err)
+	}
+	if err := CheckFiletoWrite(filepath.Dir(file), ""); !errors.Is(err, ErrDirectory) {
+		t.Errorf("A directory should be ErrDirectory: %v", err)
+	}
+}
+
+func TestWriteFileSpecial(t *testing.T) {
+	file := ensureTestFile(t)
+	if err := syscall.Mkfifo(file, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Opening the pipe would block - it shouldn't be read or replaced.
+	if err := CheckFiletoWrite(file, exampleDataSHA); !errors.Is(err, ErrNotRegular) || !strings.Contains(err.Error(), "named pipe") {
+		t.Errorf("A pipe should be ErrNotRegular: %v", err)
+	}
+	if err := WriteFile(exampleData, file, 0644, ""); !errors.Is(err, ErrNotRegular) {
+		t.Errorf("A pipe shouldn't be replaced: %v", err)
+	}
+}
+
+func TestWriteFileSymlink(t *testing.T) {
+	file := ensureTestFile(t)
+	target := file + ".target"
+	defer os.Remove(target)
+	ioutil.WriteFile(target, []byte("old\n"), 0644)
+	os.Symlink(filepath.Base(target), file)
+
+	FollowSymlinks = true
+	err := WriteFile(exampleData, file, 0644, "")
+	FollowSymlinks = false
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Lstat(file); info.Mode()&os.ModeSymlink == 0 {
+		t.Error("--follow-symlinks should leave the link in place.")
+	}
+	if data, _ := ioutil.ReadFile(target); string(data) != exampleData {
+		t.Errorf("--follow-symlinks should write the target: '%s'", data)
+	}
+	if err := CheckFiletoWrite(file, exampleDataSHA); err != ErrChecksumMatch {
+		t.Errorf("The target has the same checksum: %v", err)
+	}
+
+	if err := WriteFile("new\n", file, 0644, ""); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Lstat(file); info.Mode()&os.ModeSymlink != 0 {
+		t.Error("Without --follow-symlinks the link should be replaced.")
+	}
+	if data, _ := ioutil.ReadFile(target); string(data) != exampleData {
+		t.Errorf("Without --follow-symlinks the target shouldn't change: '%s'", data)
+	}
+}
+
+func TestRemoveFileDirectory(t *testing.T) {
+	file := ensureTestFile(t)
+	if err := RemoveFile(filepath.Dir(file)); !errors.Is(err, ErrDirectory) {
+		t.Errorf("A directory should be ErrDirectory: %v", err)
+	}
+	ioutil.WriteFile(file, []byte(exampleData), 0640)
+	if err := RemoveFile(file); err != nil {
+		t.Errorf("The file should be removed: %v", err)
+	}
+	if _, err := os.Stat(file); err == nil {
+		t.Error("The file is still there.")
+	}
+}
+
+func TestWriteFileError(t *testing.T) {
+	file := ensureTestFile(t)
+	ioutil.WriteFile(file, []byte(exampleData), 0640)
+	// A file where a directory should be can't be created.
+	if err := WriteFile(exampleData, filepath.Join(file, "hosts"), 0640, Owner); err == nil {
+		t.Error("Writing underneath a file should return an error.")
+	}
+}
+
+func TestWriteCheckedFile(t *testing.T) {
+	file := ensureTestFile(t)
+	ioutil.WriteFile(file, []byte("the good file\n"), 0640)
+	err := WriteCheckedFile(exampleData, file, 0640, Owner, "grep -q Missing %f")
+	if !errors.Is(err, ErrCheckFailed) {
+		t.Errorf("A check that fails should be ErrCheckFailed: %v", err)
+	}
+	if ReadFile(file) != "the good file\n" {
+		t.Error("The old file should be left in place when the check fails.")
+	}
+	if _, err := os.Stat(TmpFilename(file)); err == nil {
+		t.Error("The temp file should be removed when the check fails.")
+	}
+	// The temp file is checked - not the file it replaces.
+	if err := WriteCheckedFile(exampleData, file, 0640, Owner, "grep -q Multi"); err != nil || ReadFile(file) != exampleData {
+		t.Errorf("A check that passes should write the file: %v", err)
+	}
+}
+
+func TestFilesystemError(t *testing.T) {
+	for errno, reason := range map[syscall.Errno]string{syscall.ENOSPC: "full", syscall.EDQUOT: "full", syscall.EROFS: "read_only"} {
+		err := filesystemError(fmt.Errorf("could not write file '/etc/hosts': %w", &os.PathError{Op: "write", Path: "/etc/hosts.kvexpress", Err: errno}))
+		if !errors.Is(err, ErrFilesystem) || FilesystemReason(err) != reason || !strings.Contains(err.Error(), "/etc/hosts") {
+			t.Errorf("%v should be a filesystem error: %v", errno, err)
+		}
+	}
+	if err := filesystemError(&os.PathError{Op: "open", Path: "/etc/hosts", Err: syscall.EACCES}); errors.Is(err, ErrFilesystem) {
+		t.Errorf("A permission error is a problem with kvexpress, not the host: %v", err)
+	}
+}
+
+func TestWriteFileFsync(t *testing.T) {
+	file := ensureTestFile(t)
+	defer func() { NoFsync = false }()
+	for _, noFsync := range []bool{false, true} {
+		NoFsync = noFsync
+		if err := WriteFile(exampleData, file, 0640, Owner); err != nil || ReadFile(file) != exampleData {
+			t.Errorf("The file should be written with NoFsync=%t: %v", noFsync, err)
+		}
+		if _, err := os.Stat(file + "." + fileSuffix); err == nil {
+			t.Error("The temp file should be renamed into place.")
+		}
+	}
+}
+
+func TestRemoveLeftoverTmp(t *testing.T) {
+	file := ensureTestFile(t)
+	tmp := TmpFilename(file)
+	ioutil.WriteFile(tmp, []byte("half"), 0640)
+	if err := removeLeftoverTmp(tmp); err != nil || ReadFile(tmp) != "half" {
+		t.Errorf("A new temp file may still be written and should be kept: %v", err)
+	}
+	old := time.Now().Add(-2 * leftoverTmpAge)
+	os.Chtimes(tmp, old, old)
+	if err := removeLeftoverTmp(tmp); err != nil {
+		t.Errorf("The leftover should be removed: %v", err)
+	}
+	if _, err := os.Stat(tmp); err == nil {
+		t.Error("The leftover temp file is still there.")
+	}
+}
+
+func TestBackupFile(t *testing.T) {
+	file := ensureTestFile(t)
+	if err := BackupFile(file, 2); err != nil {
+		t.Errorf("A file that doesn't exist yet has nothing to back up: %v", err)
+	}
+	for _, version := range []string{"one", "two", "three"} {
+		ioutil.WriteFile(file, []byte(version), 0640)
+		if err := BackupFile(file, 2); err != nil {
+			t.Fatalf("The file should be backed up: %v", err)
+		}
+	}
+	if ReadFile(file+".1") != "three" || ReadFile(file+".2") != "two" {
+		t.Errorf("The newest backup should be .1: %q %q", ReadFile(file+".1"), ReadFile(file+".2"))
+	}
+	if _, err := os.Stat(file + ".3"); err == nil {
+		t.Error("Only 2 backups should be kept.")
+	}
+	BackupFile(file, 1)
+	if _, err := os.Stat(file + ".2"); err == nil {
+		t.Error("Backups past keep should be pruned.")
+	}
+}
+
+func TestReadStdin(t *testing.T) {
+	r, w, _ := os.Pipe()
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+
+	w.WriteString(exampleData)
+	w.Close()
+	if data, err := ReadStdin(); err != nil || data != exampleData {
+		t.Errorf("The data should be read from stdin: %q %v", data, err)
+	}
+}
+
+func TestFilterLines(t *testing.T) {
+	data := "# generated - do not edit\nweb01 10.0.0.1\n  # web02 10.0.0.2\ndb01 10.0.1.1\nweb03 10.0.0.3\n"
+	if filtered := FilterLines(data, nil, nil, "#"); filtered != "web01 10.0.0.1\ndb01 10.0.1.1\nweb03 10.0.0.3\n" {
+		t.Errorf("The comments should be removed: %q", filtered)
+	}
+	include, exclude := regexp.MustCompile(`^web`), regexp.MustCompile(`03`)
+	if filtered := FilterLines(data, include, exclude, "#"); filtered != "web01 10.0.0.1\n" {
+		t.Errorf("Only the included lines that aren't excluded should be kept: %q", filtered)
+	}
+	if filtered := FilterLines("db01\n", include, nil, ""); filtered != "" {
+		t.Errorf("Nothing matches so nothing is left: %q", filtered)
+	}
+}
+
+func TestSortLines(t *testing.T) {
+	ips := "10.0.0.10\n10.0.0.9\n\n10.0.0.100\n10.0.0.9\n"
+	if sorted := SortLines(ips, "lexical", false); sorted != "10.0.0.10\n10.0.0.100\n10.0.0.9\n10.0.0.9" {
+		t.Errorf("The lines should be sorted as text: %q", sorted)
+	}
+	if sorted := SortLines(ips, "version", true); sorted != "10.0.0.9\n10.0.0.10\n10.0.0.100" {
+		t.Errorf("The addresses should be sorted by each number: %q", sorted)
+	}
+	if sorted := SortLines("10 ten\n9 nine\nnone\n-1 minus one\n", "numeric", false); sorted != "-1 minus one\nnone\n9 nine\n10 ten" {
+		t.Errorf("The lines should be sorted by their numbers: %q", sorted)
+	}
+	if sorted := SortLines(ips, "none", false); sorted != ips {
+		t.Errorf("Nothing should change: %q", sorted)
+	}
+	if sorted := SortLines("b\na\nb\n", "none", true); sorted != "b\na" {
+		t.Errorf("Only the duplicate should be removed: %q", sorted)
+	}
+}
+
+func TestTmpDir(t *testing.T) {
+	file := ensureTestFile(t)
+	TmpDir = filepath.Join(filepath.Dir(file), "tmp")
+	t.Cleanup(func() { TmpDir = "" })
+	if err := os.Mkdir(TmpDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if TmpFilename("/etc/a/hosts") == TmpFilename("/etc/b/hosts") {
+		t.Error("Files with the same name should have their own temporary file.")
+	}
+	if tmp := TmpFilename(file); filepath.Dir(tmp) != TmpDir {
+		t.Errorf("The temporary file should be in --tmp-dir: %s", tmp)
+	}
+	if err := WriteFile(exampleData, file, 0640, Owner); err != nil {
+		t.Fatal(err)
+	}
+	if ReadFile(file) != exampleData {
+		t.Error("The file wasn't written.")
+	}
+	if _, err := os.Stat(TmpFilename(file)); !os.IsNotExist(err) {
+		t.Errorf("The temporary file should be renamed: %v", err)
+	}
+	// /proc is never on the same filesystem.
+	TmpDir = "/proc"
+	if err := WriteFile(exampleData, file, 0640, Owner); err == nil || !strings.Contains(err.Error(), "same filesystem") {
+		t.Errorf("A --tmp-dir on another filesystem should be an error: %v", err)
+	}
+}
+
+func TestChownFileGroupOnly(t *testing.T) {
+	file, _ := ioutil.TempFile("", "kvexpress-chown")
+	file.Close()
+	defer os.Remove(file.Name())
+	gid := os.Getgid()
+	// Only a group - the file keeps the user that wrote it.
+	if uid, got, err := ChownFile(file.Name(), fmt.Sprintf(":%d", gid)); err != nil || uid != os.Getuid() || got != gid {
+		t.Errorf("A group on its own should only change the group: %d %d %v", uid, got, err)
+	}
+	if _, _, err := ChownFile(file.Name(), ":kvexpress-no-such-group"); err == nil {
+		t.Error("A group that doesn't exist should be an error.")
+	}
+	NoChown = true
+	defer func() { NoChown = false }()
+	if uid, got, err := ChownFile(file.Name(), "0:0"); err != nil || uid != os.Getuid() || got != os.Getgid() {
+		t.Errorf("--no-chown shouldn't chown the file: %d %d %v", uid, got, err)
+	}
+}
+
+func TestCheckStateDir(t *testing.T) {
+	dir := t.TempDir()
+	state := filepath.Join(dir, "state")
+	if err := checkStateDir(state); err != nil {
+		t.Fatalf("A new directory should be made and used: %v", err)
+	}
+	if info, _ := os.Stat(state); info.Mode().Perm() != 0700 {
+		t.Errorf("Only its owner should be able to use it: %04o", info.Mode().Perm())
+	}
+	os.Chmod(state, 0777)
+	if err := checkStateDir(state); err == nil {
+		t.Error("A directory anyone can write to shouldn't be used.")
+	}
+	link := filepath.Join(dir, "link")
+	os.Symlink(t.TempDir(), link)
+	if err := checkStateDir(link); err == nil {
+		t.Error("A symlink shouldn't be used.")
+	}
+
+	TmpDir = t.TempDir()
+	defer func() { TmpDir = "" }()
+	path := filepath.Join(TmpDir, "kvexpress-traffic-hosts.json")
+	target := filepath.Join(dir, "target")
+	ioutil.WriteFile(target, []byte("keep"), 0644)
+	os.Symlink(target, path+".tmp")
+	if err := writeStateFile(path, []byte("{}")); err == nil {
+		t.Error("A symlink where the .tmp file goes shouldn't be followed.")
+	}
+	if data, _ := ioutil.ReadFile(target); string(data) != "keep" {
+		t.Errorf("The symlink's target shouldn't be written: %q", data)
+	}
+}
@@ -0,0 +1,234 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+// deniedRoots are never written to unless a more specific --allowed-dir
+// has been given underneath them.
+var deniedRoots = []string{"/bin", "/boot", "/dev", "/lib", "/lib64", "/proc", "/sbin", "/sys", "/usr/bin", "/usr/lib", "/usr/sbin"}
+
+// deniedFiles are the account files - --allowed-dir can't allow them, only
+// --allowed-paths or the policy naming them can.
+var deniedFiles = []string{"/etc/group", "/etc/gshadow", "/etc/passwd", "/etc/shadow", "/etc/sudoers"}
+
+// defaultPolicyFile is where the host's policy is.
+const defaultPolicyFile = "/etc/kvexpress/policy.yaml"
+
+// rootOwned is an error unless info is owned by root and only root can
+// write to it.
+func rootOwned(info os.FileInfo) error {
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || stat.Uid != 0 {
+		return fmt.Errorf("isn't owned by root")
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("can be written by someone other than root - mode %04o", info.Mode().Perm())
+	}
+	return nil
+}
+
+// processAlive is true if there's a process with pid.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// userStateDir is where the state files are kept without --tmp-dir -
+// kvexpress in /run for root, and a directory of the user's own in the temp
+// directory for anyone else.
+func userStateDir() string {
+	if os.Geteuid() != 0 {
+		return filepath.Join(os.TempDir(), fmt.Sprintf("kvexpress-%d", os.Geteuid()))
+	}
+	if _, err := os.Stat("/run"); err != nil {
+		return "/var/run/kvexpress"
+	}
+	return "/run/kvexpress"
+}
+
+// checkStateDir makes dir if it isn't there - it has to be a directory, not a
+// symlink, that's owned by the user running kvexpress and that nobody else
+// can use.
+func checkStateDir(dir string) error {
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("'%s' isn't a directory", dir)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Geteuid() {
+		return fmt.Errorf("'%s' is owned by uid %d", dir, stat.Uid)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("'%s' can be used by other users - mode %04o", dir, info.Mode().Perm())
+	}
+	return nil
+}
+
+// openStateFile opens or creates one of kvexpress's own state files - it's
+// only readable by its owner, a symlink isn't followed and a file someone
+// else owns is an error.
+func openStateFile(path string) (*os.File, error) {
+	if err := stateDirError(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err == nil && !info.Mode().IsRegular() {
+		err = fmt.Errorf("'%s' isn't a regular file", path)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); err == nil && ok && int(stat.Uid) != os.Geteuid() {
+		err = fmt.Errorf("'%s' is owned by uid %d", path, stat.Uid)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// ChownFile does what it sounds like. The owner can be "user", "user:group"
+// or ":group" - a blank user leaves the file owned by whoever is running
+// kvexpress. The group is --group if it was passed, then the one in owner and
+// then the user's group. With --no-chown it doesn't do anything.
+func ChownFile(filepath string, owner string) (int, int, error) {
+	if NoChown {
+		Log(fmt.Sprintf("function='ChownFile' file='%s' skipped='no_chown'", filepath), "debug")
+		return os.Getuid(), os.Getgid(), nil
+	}
+	name, group := SplitOwner(owner)
+	if Group != "" {
+		group = Group
+	}
+	// -1 leaves the owner or group alone.
+	oid, gid := -1, -1
+	if name != "" {
+		oid = GetOwnerID(name)
+		gid = GetGroupID(name)
+	}
+	if group != "" {
+		var err error
+		if gid, err = LookupGroupID(group); err != nil {
+			return oid, gid, err
+		}
+	}
+	if oid == -1 && gid == -1 {
+		return os.Getuid(), os.Getgid(), nil
+	}
+	err := os.Chown(filepath, oid, gid)
+	if err != nil {
+		Log(fmt.Sprintf("function='ChownFile' panic='true' file='%s'", filepath), "info")
+		return oid, gid, fmt.Errorf("could not chown file '%s': %v", filepath, err)
+	}
+	if oid == -1 {
+		oid = os.Getuid()
+	}
+	return oid, gid, nil
+}
+
+// sameFilesystem is true if a and b are on the same device.
+func sameFilesystem(a, b string) (bool, error) {
+	infoA, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	infoB, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	statA, okA := infoA.Sys().(*syscall.Stat_t)
+	statB, okB := infoB.Sys().(*syscall.Stat_t)
+	if !okA || !okB {
+		return false, fmt.Errorf("could not get the devices of '%s' and '%s'", a, b)
+	}
+	return statA.Dev == statB.Dev, nil
+}
+
+// syncParentDir flushes the directory that file is in so a rename in it
+// survives a crash.
+func syncParentDir(file string) error {
+	dir, err := os.Open(filepath.Dir(file))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// checkFileMode makes sure file ended up with the mode that was asked for -
+// a filesystem that doesn't keep the setgid or sticky bits won't.
+func checkFileMode(file string, perms int) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if mode := info.Mode() & fileModeBits; mode != osFileMode(perms) {
+		return fmt.Errorf("'%s' is %04o but --chmod is %04o", file, unixMode(mode), perms)
+	}
+	return nil
+}
+
+// lockFile waits for an exclusive lock on f - other kvexpress processes that
+// append to it take the same lock.
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
+
+// unlockFile lets the next process have f.
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
+
+// tryLockFile takes an exclusive lock on f without waiting - it's
+// errWouldBlock if another process has it.
+func tryLockFile(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return errWouldBlock
+	}
+	return err
+}
+
+// runAsSupported is true where commands can be run as another user.
+const runAsSupported = true
+
+// setCredential runs cmd with the uid, gid and groups in ids.
+func setCredential(cmd *exec.Cmd, ids *runAsIDs) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: ids.uid, Gid: ids.gid, Groups: ids.groups}
+}
+
+// setProcessGroup starts cmd in a process group of its own and makes
+// cancelling it kill the group.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// fileOwnerIDs are the uid and gid that own the file in info.
+func fileOwnerIDs(info os.FileInfo) (int, int) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int(stat.Uid), int(stat.Gid)
+	}
+	return -1, -1
+}
@@ -0,0 +1,200 @@
+// +build windows
+
+package commands
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// deniedRoots are never written to unless a more specific --allowed-dir
+// has been given underneath them - Windows and the program directories,
+// wherever the host has them.
+var deniedRoots = windowsRoots()
+
+// deniedFiles are the account files - Windows keeps them in deniedRoots.
+var deniedFiles = []string{}
+
+// defaultPolicyFile is where the host's policy is - in ProgramData.
+var defaultPolicyFile = filepath.Join(windowsDir("ProgramData", "ProgramData"), "kvexpress", "policy.yaml")
+
+// windowsDir is the directory in the environment variable name - or dir on
+// the system drive if it isn't set.
+func windowsDir(name, dir string) string {
+	if value := os.Getenv(name); value != "" {
+		return filepath.Clean(value)
+	}
+	drive := os.Getenv("SystemDrive")
+	if drive == "" {
+		drive = "C:"
+	}
+	return filepath.Join(drive+`\`, dir)
+}
+
+// windowsRoots are the Windows and program directories - ProgramFiles(x86)
+// is only there on 64-bit Windows.
+func windowsRoots() []string {
+	roots := []string{windowsDir("SystemRoot", "Windows"), windowsDir("ProgramFiles", "Program Files")}
+	if x86 := os.Getenv("ProgramFiles(x86)"); x86 != "" {
+		roots = append(roots, filepath.Clean(x86))
+	}
+	return roots
+}
+
+// processAlive is true if there's a process with pid.
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
+
+// openStateFile opens or creates one of kvexpress's own state files - it gets
+// the ACLs of the directory it's in.
+func openStateFile(path string) (*os.File, error) {
+	if err := stateDirError(); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+}
+
+// userStateDir is where the state files are kept without --tmp-dir - the
+// user's own temp directory.
+func userStateDir() string {
+	return filepath.Join(os.TempDir(), "kvexpress")
+}
+
+// checkStateDir makes dir if it isn't there - it has to be a directory, not a
+// symlink or a junction.
+func checkStateDir(dir string) error {
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() || info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("'%s' isn't a directory", dir)
+	}
+	return nil
+}
+
+// rootOwned doesn't check anything on Windows - the policy gets the ACLs of
+// the directory it's in.
+func rootOwned(info os.FileInfo) error {
+	return nil
+}
+
+// ChownFile doesn't do anything on Windows - files get the ACLs of the
+// directory they're written to. It returns -1 for the owner and group.
+func ChownFile(filepath string, owner string) (int, int, error) {
+	Log(fmt.Sprintf("function='ChownFile' file='%s' skipped='windows'", filepath), "debug")
+	return -1, -1, nil
+}
+
+// sameFilesystem is true if a and b are on the same volume.
+func sameFilesystem(a, b string) (bool, error) {
+	for _, dir := range []string{a, b} {
+		if _, err := os.Stat(dir); err != nil {
+			return false, err
+		}
+	}
+	absA, err := filepath.Abs(a)
+	if err != nil {
+		return false, err
+	}
+	absB, err := filepath.Abs(b)
+	if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(filepath.VolumeName(absA), filepath.VolumeName(absB)), nil
+}
+
+// syncParentDir doesn't do anything on Windows - directories can't be synced
+// and renames are written through by NTFS.
+func syncParentDir(file string) error {
+	return nil
+}
+
+// checkFileMode doesn't do anything on Windows - a file's mode is only
+// whether it's read-only.
+func checkFileMode(file string, perms int) error {
+	return nil
+}
+
+// The LockFileEx flags and the error it fails with when another process has
+// the lock.
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+	errorLockViolation      = syscall.Errno(33)
+)
+
+var (
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+// lockFileEx locks all of f with LockFileEx - the same lock every kvexpress
+// process takes.
+func lockFileEx(f *os.File, flags uint32) error {
+	overlapped := new(syscall.Overlapped)
+	r, _, err := procLockFileEx.Call(f.Fd(), uintptr(flags), 0, ^uintptr(0), ^uintptr(0), uintptr(unsafe.Pointer(overlapped)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// lockFile waits for an exclusive lock on f - other kvexpress processes that
+// append to it take the same lock.
+func lockFile(f *os.File) error {
+	return lockFileEx(f, lockfileExclusiveLock)
+}
+
+// unlockFile lets the next process have f.
+func unlockFile(f *os.File) error {
+	overlapped := new(syscall.Overlapped)
+	r, _, err := procUnlockFileEx.Call(f.Fd(), 0, ^uintptr(0), ^uintptr(0), uintptr(unsafe.Pointer(overlapped)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// tryLockFile takes an exclusive lock on f without waiting - it's
+// errWouldBlock if another process has it.
+func tryLockFile(f *os.File) error {
+	err := lockFileEx(f, lockfileExclusiveLock|lockfileFailImmediately)
+	if err == errorLockViolation {
+		return errWouldBlock
+	}
+	return err
+}
+
+// runAsSupported is false on Windows - there's no uid to switch to.
+const runAsSupported = false
+
+// setCredential doesn't do anything on Windows - SetupRunAs won't allow
+// --run-as.
+func setCredential(cmd *exec.Cmd, ids *runAsIDs) {
+}
+
+// setProcessGroup doesn't do anything on Windows - there are no process
+// groups to kill, only the command is.
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// fileOwnerIDs are -1 on Windows - files don't have a uid and gid.
+func fileOwnerIDs(info os.FileInfo) (int, int) {
+	return -1, -1
+}
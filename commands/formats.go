@@ -0,0 +1,189 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/smallfish/simpleyaml"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// outputFormats are the formats that `out` can write with --format.
+	outputFormats = []string{"raw", "json", "env-file", "dotenv", "systemd-dropin"}
+
+	// contentTypes are the kinds of data that --validate can check.
+	contentTypes = []string{"json", "yaml", "csv"}
+)
+
+// OutTarget is a single file that `out` writes with the format to write it in.
+type OutTarget struct {
+	File   string
+	Format string
+	Output string
+}
+
+// ValidFormat returns true if the format is one that FormatData knows about.
+func ValidFormat(format string) bool {
+	for _, known := range outputFormats {
+		if format == known {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidContentType returns true if ValidateContent can check kind.
+func ValidContentType(kind string) bool {
+	for _, known := range contentTypes {
+		if kind == known {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateContent parses data as json, yaml or csv and returns the syntax
+// error if it isn't well formed.
+func ValidateContent(data, kind string) error {
+	switch kind {
+	case "json":
+		var value interface{}
+		decoder := json.NewDecoder(strings.NewReader(data))
+		if err := decoder.Decode(&value); err != nil {
+			return fmt.Errorf("data is not valid JSON: %v", err)
+		}
+		if _, err := decoder.Token(); err != io.EOF {
+			return fmt.Errorf("data is not valid JSON: there's more after the first value")
+		}
+	case "yaml":
+		if _, err := simpleyaml.NewYaml([]byte(data)); err != nil {
+			return fmt.Errorf("data is not valid YAML: %v", err)
+		}
+	case "csv":
+		if _, err := csv.NewReader(strings.NewReader(data)).ReadAll(); err != nil {
+			return fmt.Errorf("data is not valid CSV: %v", err)
+		}
+	default:
+		return fmt.Errorf("unknown content type '%s'", kind)
+	}
+	return nil
+}
+
+// FormatData transforms the data from Consul into the requested format.
+// The json, env-file and systemd-dropin formats expect the data to be a JSON
+// object - dotenv is another name for env-file.
+func FormatData(data string, format string) (string, error) {
+	switch format {
+	case "", "raw":
+		return data, nil
+	case "json":
+		var pretty bytes.Buffer
+		if err := json.Indent(&pretty, []byte(data), "", "  "); err != nil {
+			return "", fmt.Errorf("data is not valid JSON: %v", err)
+		}
+		pretty.WriteString("\n")
+		return pretty.String(), nil
+	case "env-file", "dotenv":
+		return formatEnvFile(data)
+	case "systemd-dropin":
+		return formatSystemdDropin(data)
+	}
+	return "", fmt.Errorf("unknown format '%s'", format)
+}
+
+// formatEnvFile renders a JSON object as sorted KEY=VALUE lines.
+// Nested objects and arrays are written as compact JSON.
+func formatEnvFile(data string) (string, error) {
+	vars, err := envVars(data)
+	if err != nil {
+		return "", err
+	}
+	var lines bytes.Buffer
+	for _, v := range vars {
+		value := v[1]
+		if strings.ContainsAny(value, " \t\n\"'#$\\") {
+			value = strconv.Quote(value)
+		}
+		lines.WriteString(fmt.Sprintf("%s=%s\n", v[0], value))
+	}
+	return lines.String(), nil
+}
+
+// envName is a variable name systemd will set - it ignores an Environment=
+// assignment with any other name.
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// formatSystemdDropin renders a JSON object as a systemd drop-in with an
+// Environment= line for each key - so a unit's environment comes from the
+// same key as its config.
+func formatSystemdDropin(data string) (string, error) {
+	vars, err := envVars(data)
+	if err != nil {
+		return "", err
+	}
+	// systemd reads % as a specifier and unquotes the value itself.
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "%", "%%")
+	var lines bytes.Buffer
+	lines.WriteString("[Service]\n")
+	for _, v := range vars {
+		if !envName.MatchString(v[0]) {
+			return "", fmt.Errorf("'%s' isn't a variable name systemd can set - it has to be letters, numbers and _", v[0])
+		}
+		lines.WriteString(fmt.Sprintf("Environment=\"%s=%s\"\n", escape.Replace(v[0]), escape.Replace(v[1])))
+	}
+	return lines.String(), nil
+}
+
+// envVars reads a JSON object as name and value pairs sorted by name. Nested
+// objects and arrays are compact JSON.
+func envVars(data string) ([][2]string, error) {
+	var object map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&object); err != nil {
+		return nil, fmt.Errorf("data is not a JSON object: %v", err)
+	}
+	var keys []string
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var vars [][2]string
+	for _, key := range keys {
+		var value string
+		switch v := object[key].(type) {
+		case string:
+			value = v
+		case nil:
+			value = ""
+		default:
+			encoded, _ := json.Marshal(v)
+			value = string(encoded)
+		}
+		vars = append(vars, [2]string{key, value})
+	}
+	return vars, nil
+}
+
+// FormatTargets transforms data for every target. If the data can't be
+// transformed for any of them then nothing should be written.
+func FormatTargets(targets []OutTarget, data string) ([]OutTarget, error) {
+	var formatted []OutTarget
+	for _, target := range targets {
+		output, err := FormatData(data, target.Format)
+		if err != nil {
+			return nil, fmt.Errorf("'%s': %v", target.File, err)
+		}
+		target.Output = output
+		formatted = append(formatted, target)
+	}
+	return formatted, nil
+}
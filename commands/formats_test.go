@@ -0,0 +1,173 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var formatData = `{"name":"kvexpress","port":8500,"debug":false,"motd":"hello there"}`
+
+func TestFormatDataEnvFile(t *testing.T) {
+	env, err := FormatData(formatData, "env-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "debug=false\nmotd=\"hello there\"\nname=kvexpress\nport=8500\n"
+	if env != expected {
+		t.Errorf("Got the wrong env-file:\n%s", env)
+	}
+}
+
+func TestFormatDataDotenv(t *testing.T) {
+	dotenv, err := FormatData(formatData, "dotenv")
+	env, _ := FormatData(formatData, "env-file")
+	if err != nil || dotenv != env {
+		t.Errorf("dotenv should be the same as env-file: %q %v", dotenv, err)
+	}
+}
+
+func TestFormatDataSystemdDropin(t *testing.T) {
+	dropin, err := FormatData(`{"PORT":8500,"MOTD":"50% \"off\""}`, "systemd-dropin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "[Service]\nEnvironment=\"MOTD=50%% \\\"off\\\"\"\nEnvironment=\"PORT=8500\"\n"
+	if dropin != expected {
+		t.Errorf("Got the wrong drop-in:\n%s", dropin)
+	}
+	for _, name := range []string{"A=B", "PATH\n[Service]", "1ST", ""} {
+		if _, err := FormatData(`{"`+strings.Replace(name, "\n", `\n`, -1)+`":"x"}`, "systemd-dropin"); err == nil {
+			t.Errorf("'%s' isn't a variable name.", name)
+		}
+	}
+}
+
+func TestFormatDataInvalidJSON(t *testing.T) {
+	if _, err := FormatData("not: json", "json"); err == nil {
+		t.Error("Invalid JSON should not format.")
+	}
+	if _, err := FormatData("[1, 2]", "env-file"); err == nil {
+		t.Error("A JSON array can't be an env-file.")
+	}
+}
+
+func TestValidateContent(t *testing.T) {
+	for _, test := range []struct {
+		kind, data string
+		valid      bool
+	}{
+		{"json", `{"flags": {"beta": true}}`, true},
+		{"json", `{"flags": {"beta": tr`, false},
+		{"json", `{"a": 1} {"b": 2}`, false},
+		{"json", "", false},
+		{"yaml", "flags:\n  beta: true\n", true},
+		{"yaml", "flags: [beta\n", false},
+		{"csv", "host,ip\nweb01,10.0.0.1\n", true},
+		{"csv", "host,ip\nweb01\n", false},
+		{"csv", "host,ip\n\"web01,10.0.0.1\n", false},
+	} {
+		if err := ValidateContent(test.data, test.kind); (err == nil) != test.valid {
+			t.Errorf("%s %q should be valid=%t: %v", test.kind, test.data, test.valid, err)
+		}
+	}
+	if err := ValidateContent("{}", "xml"); err == nil {
+		t.Error("xml isn't a type that can be checked.")
+	}
+}
+
+func TestWriteTargetsMultipleFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvexpress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	FilePermissions = 0640
+	Owner = GetCurrentUsername()
+	jsonFile := filepath.Join(dir, "x.json")
+	envFile := filepath.Join(dir, "x.env")
+	targets, err := FormatTargets([]OutTarget{{File: jsonFile, Format: "json"}, {File: envFile, Format: "env-file"}}, formatData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written, err := WriteTargets(targets, ComputeChecksum(formatData), ""); err != nil || written != 2 {
+		t.Errorf("Expected 2 files to be written, got %d", written)
+	}
+	if ReadFile(jsonFile) != targets[0].Output || ReadFile(envFile) != targets[1].Output {
+		t.Error("The files don't contain the formatted data.")
+	}
+	if ReadFile(jsonFile) == ReadFile(envFile) {
+		t.Error("The formats should be different.")
+	}
+	if written, err := WriteTargets(targets, ComputeChecksum(formatData), ""); err != nil || written != 0 {
+		t.Errorf("Unchanged files should not be written again, got %d", written)
+	}
+}
+
+func TestWriteTargetsGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvexpress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	FilePermissions = 0640
+	Owner = GetCurrentUsername()
+	jsonFile := filepath.Join(dir, "x.json")
+	envFile := filepath.Join(dir, "x.env")
+	ioutil.WriteFile(jsonFile, []byte("old"), 0640)
+	ioutil.WriteFile(envFile, []byte("old"), 0640)
+	targets, err := FormatTargets([]OutTarget{{File: jsonFile, Format: "json"}, {File: envFile, Format: "env-file"}}, formatData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The json file passes the check and the env file fails it - so neither is replaced.
+	CheckExec = `grep -q name": %f`
+	defer func() { CheckExec = "" }()
+	if written, err := WriteTargets(targets, ComputeChecksum(formatData), ""); err == nil || written != 0 {
+		t.Errorf("A file that fails its check should stop the group: %d %v", written, err)
+	}
+	if ReadFile(jsonFile) != "old" || ReadFile(envFile) != "old" {
+		t.Error("Neither file should be replaced when one of them can't be.")
+	}
+	if _, err := os.Stat(TmpFilename(jsonFile)); !os.IsNotExist(err) {
+		t.Error("The staged file should be removed.")
+	}
+}
+
+func TestWritePendingRollback(t *testing.T) {
+	dir := t.TempDir()
+	FilePermissions = 0640
+	Owner = GetCurrentUsername()
+	first := filepath.Join(dir, "first")
+	created := filepath.Join(dir, "created")
+	ioutil.WriteFile(first, []byte("old"), 0640)
+	var pending []pendingTarget
+	for _, file := range []string{first, created} {
+		p, err := stageTarget(OutTarget{File: file, Output: "new"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pending = append(pending, p)
+	}
+	// The last one's temp file is gone so its rename fails.
+	broken, err := stageTarget(OutTarget{File: filepath.Join(dir, "broken"), Output: "new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken.discard()
+	pending = append(pending, broken)
+
+	if written, err := writePending(pending); err == nil || written != 0 {
+		t.Errorf("A file that can't be renamed should fail the group: %d %v", written, err)
+	}
+	if data, _ := ioutil.ReadFile(first); string(data) != "old" {
+		t.Errorf("The file that was replaced should be put back: %q", data)
+	}
+	if _, err := os.Stat(created); !os.IsNotExist(err) {
+		t.Error("The file that didn't exist should be removed again.")
+	}
+}
@@ -0,0 +1,171 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/spf13/cobra"
+	"os"
+	"time"
+)
+
+var guardCmd = &cobra.Command{
+	Use:   "guard",
+	Short: "Alert when a file is changed by hand.",
+	Long:  `Guard checks a file against its key's checksum and sends an event when it's been changed on the host - with --restore it's written from Consul again. It runs once or with --interval it keeps checking.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		checkGuardFlags()
+		AutoEnable()
+	},
+	Run: guardRun,
+}
+
+func guardRun(cmd *cobra.Command, args []string) {
+	start := time.Now()
+	c, err := Connect(ConsulServer, Token)
+	if err != nil {
+		LogFatal("Could not connect to Consul.", KeyGuardLocation, "consul_connect")
+	}
+	if GuardInterval == 0 {
+		result, err := Guard(c, KeyGuardLocation, FiletoGuard, GuardRestore)
+		if err != nil {
+			Log(fmt.Sprintf("guard key='%s' message='%v'", KeyGuardLocation, err), "info")
+			fmt.Printf("Could not check '%s': %v\n", FiletoGuard, err)
+			exitRun(VerifyError, start, KeyGuardLocation, "guard_error", err.Error())
+		}
+		guardReport(result, true)
+		RecordResult(0, result.Stored, FiletoGuard)
+		RecordDetails(result)
+		exitRun(result.Status(), start, KeyGuardLocation, "guard", "")
+	}
+
+	Log(fmt.Sprintf("guard key='%s' file='%s' interval='%s' restore='%t'", KeyGuardLocation, FiletoGuard, GuardInterval, GuardRestore), "info")
+	drifted := false
+	for {
+		result, err := Guard(c, KeyGuardLocation, FiletoGuard, GuardRestore)
+		if err != nil {
+			Log(fmt.Sprintf("guard key='%s' message='%v'", KeyGuardLocation, err), "info")
+		} else {
+			// Only a new change is reported - not every check until it's fixed.
+			guardReport(result, !drifted)
+			drifted = result.Drifted && !result.Restored
+		}
+		time.Sleep(GuardInterval)
+	}
+}
+
+// GuardResult is what guard found - Drifted is when the data is good and the
+// file doesn't match it.
+type GuardResult struct {
+	VerifyResult
+	Drifted  bool   `json:"drifted"`
+	Restored bool   `json:"restored"`
+	Lock     string `json:"lock,omitempty"`
+}
+
+// Status is the verify exit status - a file that was restored matches.
+func (r GuardResult) Status() int {
+	if r.Restored || r.Lock != "" {
+		return r.VerifyResult.Status() &^ VerifyFileDrift
+	}
+	return r.VerifyResult.Status()
+}
+
+// Guard checks file against the checksum for key. A locked file is expected
+// to be changed by hand so it isn't a drift. With restore a drifted file is
+// written from the data again - the locks and the data checks are the same
+// as out's.
+func Guard(c *consul.Client, key, file string, restore bool) (GuardResult, error) {
+	var result GuardResult
+	verified, err := Verify(c, key, file)
+	if err != nil {
+		return result, err
+	}
+	result.VerifyResult = verified
+	if verified.FileMatches || !verified.DataMatches {
+		return result, nil
+	}
+	if result.Lock, err = CheckLock(c, file); err != nil || result.Lock != "" {
+		return result, err
+	}
+	result.Drifted = true
+	if !restore || DryRunSkip(fmt.Sprintf("restore '%s' from '%s'", file, key)) {
+		return result, nil
+	}
+	if result.Restored, err = EnsureConsumer(c, key, file); err != nil {
+		return result, fmt.Errorf("could not restore '%s': %v", file, err)
+	}
+	return result, nil
+}
+
+// guardReport logs what guard found - alert sends the metric and the
+// Datadog event for a drift and runs PostExec after a restore.
+func guardReport(result GuardResult, alert bool) {
+	Log(fmt.Sprintf("guard key='%s' file='%s' file_matches='%t' data_matches='%t' drifted='%t' restored='%t'", KeyGuardLocation, FiletoGuard, result.FileMatches, result.DataMatches, result.Drifted, result.Restored), "info")
+	switch {
+	case result.Lock != "":
+		fmt.Printf("'%s' is locked - it doesn't match '%s': %s\n", FiletoGuard, KeyGuardLocation, result.Lock)
+	case !result.DataMatches:
+		fmt.Printf("The data in '%s' doesn't match its checksum - '%s' can't be checked.\n", KeyGuardLocation, FiletoGuard)
+	case result.Drifted:
+		fmt.Printf("'%s' was changed on this host - it's %s and '%s' is %s.\n", FiletoGuard, result.File, KeyGuardLocation, result.Stored)
+	}
+	if !result.Drifted {
+		return
+	}
+	if result.Restored {
+		fmt.Printf("'%s' was restored from '%s'.\n", FiletoGuard, KeyGuardLocation)
+	}
+	if !alert {
+		return
+	}
+	StatsdFileDrift(KeyGuardLocation, FiletoGuard, result.Restored)
+	if DatadogAPIKey != "" && DatadogAPPKey != "" {
+		DDFileDriftEvent(DDAPIConnect(DatadogAPIKey, DatadogAPPKey), KeyGuardLocation, FiletoGuard, result)
+	}
+	if result.Restored && PostExec != "" {
+		Log(fmt.Sprintf("exec='%s'", PostExec), "debug")
+		RunPostExec(PostExec)
+	}
+}
+
+func checkGuardFlags() {
+	Log("Checking cli flags.", "debug")
+	if KeyGuardLocation == "" {
+		fmt.Println("Need a key location in -k")
+		os.Exit(1)
+	}
+	if FiletoGuard == "" {
+		fmt.Println("Need a file to check in -f")
+		os.Exit(1)
+	}
+	if GuardInterval < 0 {
+		fmt.Println("Need an --interval that's 0 or more")
+		os.Exit(1)
+	}
+	ExitOnError(CheckAllowedDir(FiletoGuard), FiletoGuard, "check_flags")
+	Log("Required cli flags present.", "debug")
+}
+
+var (
+	// KeyGuardLocation is the key the file is checked against.
+	KeyGuardLocation string
+
+	// FiletoGuard is the file that shouldn't be changed by hand.
+	FiletoGuard string
+
+	// GuardInterval is how often to check - 0 checks once.
+	GuardInterval time.Duration
+
+	// GuardRestore writes a changed file from Consul again.
+	GuardRestore bool
+)
+
+func init() {
+	RootCmd.AddCommand(guardCmd)
+	guardCmd.Flags().StringVarP(&KeyGuardLocation, "key", "k", "", "key the file is written from")
+	guardCmd.Flags().StringVarP(&FiletoGuard, "file", "f", "", "file to check")
+	guardCmd.Flags().DurationVarP(&GuardInterval, "interval", "", 0, "keep checking this often - 0 checks once")
+	guardCmd.Flags().BoolVarP(&GuardRestore, "restore", "", false, "write a changed file from Consul again")
+}
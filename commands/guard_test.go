@@ -0,0 +1,49 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestGuard(t *testing.T) {
+	file := ensureTestFile(t)
+	tc, c := newTestConsul(t)
+	tc.put("testing/guard/data", exampleData)
+	tc.put("testing/guard/checksum", exampleDataSHA)
+	ioutil.WriteFile(file, []byte(exampleData), 0640)
+
+	if result, err := Guard(c, "guard", file, true); err != nil || result.Drifted || result.Status() != 0 {
+		t.Errorf("The file hasn't been changed: %+v %v", result, err)
+	}
+
+	ioutil.WriteFile(file, []byte("edited by hand\n"), 0640)
+	result, err := Guard(c, "guard", file, false)
+	if err != nil || !result.Drifted || result.Restored || result.Status() != VerifyFileDrift {
+		t.Errorf("The edit should be found: %+v %v", result, err)
+	}
+	if ReadFile(file) != "edited by hand\n" {
+		t.Error("The file shouldn't be restored without --restore.")
+	}
+
+	tc.put(FileLockPath(file), "Fixing it by hand.")
+	if result, err := Guard(c, "guard", file, true); err != nil || result.Drifted || result.Lock == "" || result.Status() != 0 {
+		t.Errorf("A locked file is meant to be edited: %+v %v", result, err)
+	}
+	tc.put(FileLockPath(file), "")
+
+	result, err = Guard(c, "guard", file, true)
+	if err != nil || !result.Drifted || !result.Restored || result.Status() != 0 {
+		t.Errorf("The file should be restored: %+v %v", result, err)
+	}
+	if ReadFile(file) != exampleData {
+		t.Error("The file should have the data again.")
+	}
+
+	tc.put("testing/guard/data", "changed")
+	ioutil.WriteFile(file, []byte("edited by hand\n"), 0640)
+	if result, err := Guard(c, "guard", file, true); err != nil || result.Drifted || result.Restored || result.Status() != VerifyFileDrift|VerifyDataMismatch {
+		t.Errorf("Bad data isn't a local edit and can't be restored: %+v %v", result, err)
+	}
+}
@@ -0,0 +1,86 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"fmt"
+	"github.com/DataDog/kvexpress/pkg/kvexpress"
+	consul "github.com/hashicorp/consul/api"
+)
+
+var (
+	// hashAlgorithms are the checksums that --hash knows about.
+	hashAlgorithms = []string{"sha256", "sha512", "blake2b"}
+)
+
+// ValidateHashes makes sure every --hash is one that HashData knows about.
+func ValidateHashes() error {
+	if len(HashAlgorithms) == 0 {
+		return fmt.Errorf("need at least one --hash - use one of: %v", hashAlgorithms)
+	}
+	for _, alg := range HashAlgorithms {
+		if !validHash(alg) {
+			return fmt.Errorf("unknown hash '%s' - use one of: %v", alg, hashAlgorithms)
+		}
+	}
+	return nil
+}
+
+func validHash(alg string) bool {
+	for _, known := range hashAlgorithms {
+		if alg == known {
+			return true
+		}
+	}
+	return false
+}
+
+// HashData returns the hex checksum of data with alg - blank if it's not an
+// algorithm that kvexpress knows.
+func HashData(data, alg string) string {
+	return kvexpress.HashData(data, alg)
+}
+
+// ParseChecksum splits a stored checksum into its algorithm and hex value. A
+// plain hex value is sha256 - that's what every checksum was before --hash.
+func ParseChecksum(checksum string) (string, string, bool) {
+	return kvexpress.ParseChecksum(checksum)
+}
+
+// ChecksumAs computes the checksum of data in the same algorithm and format
+// as checksum so the two can be compared.
+func ChecksumAs(data, checksum string) string {
+	return kvexpress.ChecksumAs(data, checksum)
+}
+
+// StoreChecksum is the checksum key for data - with the first --hash. A
+// sha256 checksum is saved as plain hex so older versions can still read it.
+func StoreChecksum(data string) string {
+	if HashAlgorithms[0] == "sha256" {
+		return ComputeChecksum(data)
+	}
+	return kvexpress.StoreChecksum(data, HashAlgorithms)
+}
+
+// StoreChecksums is the checksums key for data - a line for every --hash.
+// It's blank when there's only one as the checksum key has that.
+func StoreChecksums(data string) string {
+	return kvexpress.StoreChecksums(data, HashAlgorithms)
+}
+
+// SetChecksums saves the checksums key for key - or removes it if it's blank
+// so it can't go stale.
+func SetChecksums(c *consul.Client, key, checksums string) error {
+	if checksums == "" {
+		return Del(c, KeyPath(key, "checksums"))
+	}
+	return Set(c, KeyPath(key, "checksums"), checksums)
+}
+
+// GetChecksum returns the checksum to verify key with. If there's a checksums
+// key the first --hash that's in it is used - otherwise it's the checksum key.
+// That way readers can move to a new algorithm before the writers stop saving
+// the old one.
+func GetChecksum(c *consul.Client, key string) (string, error) {
+	return kvexpress.ReadChecksum(kvStore{c}, key, HashAlgorithms)
+}
@@ -0,0 +1,55 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"testing"
+)
+
+func TestChecksumCompareHashes(t *testing.T) {
+	defer func() { HashAlgorithms = []string{"sha256"} }()
+	if !ChecksumCompare(exampleData, exampleDataSHA) {
+		t.Error("A plain checksum should still be sha256.")
+	}
+	for _, alg := range hashAlgorithms {
+		HashAlgorithms = []string{alg}
+		checksum := StoreChecksum(exampleData)
+		if !ChecksumCompare(exampleData, checksum) || ChecksumCompare(exampleData+"\n", checksum) {
+			t.Errorf("The %s checksum '%s' should only match its data.", alg, checksum)
+		}
+	}
+	if HashData("abc", "blake2b") != "ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d17d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923" {
+		t.Error("The blake2b checksum is wrong.")
+	}
+	if ChecksumCompare(exampleData, "md5:"+exampleDataSHA) {
+		t.Error("An unknown algorithm should never match.")
+	}
+	HashAlgorithms = []string{"sha1"}
+	if err := ValidateHashes(); err == nil {
+		t.Error("An unknown --hash should be an error.")
+	}
+}
+
+func TestGetChecksum(t *testing.T) {
+	ensureTestFile(t)
+	defer func() { HashAlgorithms = []string{"sha256"} }()
+	tc, c := newTestConsul(t)
+
+	// The writer is moving from sha256 to blake2b.
+	HashAlgorithms = []string{"sha256", "blake2b"}
+	if StoreChecksum(exampleData) != exampleDataSHA {
+		t.Error("The checksum key should stay sha256 for the readers that haven't moved.")
+	}
+	tc.put("testing/hashes/checksum", StoreChecksum(exampleData))
+	tc.put("testing/hashes/checksums", StoreChecksums(exampleData))
+
+	HashAlgorithms = []string{"blake2b"}
+	checksum, err := GetChecksum(c, "hashes")
+	if err != nil || checksum != "blake2b:"+HashData(exampleData, "blake2b") {
+		t.Errorf("A reader that moved should verify with blake2b: '%s' %v", checksum, err)
+	}
+	HashAlgorithms = []string{"sha512"}
+	if checksum, _ := GetChecksum(c, "hashes"); checksum != exampleDataSHA {
+		t.Errorf("Without a matching hash the checksum key is used: '%s'", checksum)
+	}
+}
@@ -0,0 +1,177 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/spf13/cobra"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "List the saved versions of a key.",
+	Long:  `History lists the versions that in has saved for a key - any of them can be restored with rollback.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		checkHistoryFlags()
+		AutoEnable()
+	},
+	Run: historyRun,
+}
+
+func historyRun(cmd *cobra.Command, args []string) {
+	c, err := Connect(ConsulServer, Token)
+	if err != nil {
+		LogFatal("Could not connect to Consul.", KeyHistoryLocation, "consul_connect")
+	}
+	versions, err := ListHistory(c, KeyHistoryLocation)
+	ExitOnError(err, KeyHistoryLocation, "history")
+	for _, version := range versions {
+		fmt.Printf("%-20s %s %-20s %8d %s\n", version.Version, version.Checksum, version.Host, version.Size, version.RunID)
+	}
+	Log(fmt.Sprintf("history key='%s' versions='%d'", KeyHistoryLocation, len(versions)), "info")
+}
+
+// historyFormat is the version of a history entry - it sorts by time.
+const historyFormat = "20060102T150405.000Z"
+
+// historyDiffMax is the largest diff that's saved with a version.
+const historyDiffMax = 16 * 1024
+
+// HistoryVersion describes a single saved version of a key.
+type HistoryVersion struct {
+	Version   string `json:"version"`
+	Checksum  string `json:"checksum"`
+	Host      string `json:"host"`
+	Size      int    `json:"size"`
+	RunID     string `json:"run_id,omitempty"`
+	Signature string `json:"signature,omitempty"`
+	Diff      string `json:"diff,omitempty"`
+}
+
+// historyKey is where a version is saved - its data, checksum and encoding
+// keys are underneath it so GetData and DecodeData work on it like any other key.
+func historyKey(key, version string) string {
+	return fmt.Sprintf("%s/history/%s", key, version)
+}
+
+// SaveHistory saves the stored data for key as a new version and removes the
+// oldest versions so only keep are left.
+func SaveHistory(c *consul.Client, key, stored, checksum, signature, diff string, keep int) error {
+	if len(diff) > historyDiffMax {
+		diff = diff[:historyDiffMax]
+	}
+	version := HistoryVersion{
+		Version:   time.Now().UTC().Format(historyFormat),
+		Checksum:  checksum,
+		Host:      GetHostname(),
+		Size:      len(stored),
+		RunID:     RunID,
+		Signature: signature,
+		Diff:      diff,
+	}
+	hkey := historyKey(key, version.Version)
+	if err := SetData(c, hkey, stored); err != nil {
+		return err
+	}
+	if err := Set(c, KeyPath(hkey, "checksum"), checksum); err != nil {
+		return err
+	}
+	if err := SetEncoding(c, hkey); err != nil {
+		return err
+	}
+	encoded, _ := json.Marshal(version)
+	if err := Set(c, KeyPath(hkey, "version"), string(encoded)); err != nil {
+		return err
+	}
+	Log(fmt.Sprintf("history key='%s' version='%s' saved='true'", key, version.Version), "info")
+	return pruneHistory(c, key, keep)
+}
+
+// ListHistory returns every saved version of key - oldest first.
+func ListHistory(c *consul.Client, key string) ([]HistoryVersion, error) {
+	keys, err := Keys(c, KeyPath(key, "history/"))
+	if err != nil {
+		return nil, err
+	}
+	var versions []HistoryVersion
+	for _, k := range keys {
+		if !strings.HasSuffix(k, "/version") {
+			continue
+		}
+		value, err := Get(c, k)
+		if err != nil {
+			return nil, err
+		}
+		var version HistoryVersion
+		if err := json.Unmarshal([]byte(value), &version); err != nil {
+			Log(fmt.Sprintf("history key='%s' message='%v' - skipping.", k, err), "info")
+			continue
+		}
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	return versions, nil
+}
+
+// GetHistory returns a single saved version of key.
+func GetHistory(c *consul.Client, key, version string) (HistoryVersion, error) {
+	var saved HistoryVersion
+	value, err := Get(c, KeyPath(historyKey(key, version), "version"))
+	if err != nil {
+		return saved, err
+	}
+	if value == "" {
+		return saved, fmt.Errorf("there's no version '%s' of '%s'", version, key)
+	}
+	if err := json.Unmarshal([]byte(value), &saved); err != nil {
+		return saved, fmt.Errorf("could not parse version '%s': %v", version, err)
+	}
+	return saved, nil
+}
+
+// pruneHistory removes the oldest versions of key until only keep are left.
+func pruneHistory(c *consul.Client, key string, keep int) error {
+	versions, err := ListHistory(c, key)
+	if err != nil || len(versions) <= keep {
+		return err
+	}
+	for _, version := range versions[:len(versions)-keep] {
+		if err := removeKey(c, historyKey(key, version.Version)); err != nil {
+			return err
+		}
+		Log(fmt.Sprintf("history key='%s' version='%s' removed='true'", key, version.Version), "debug")
+	}
+	return nil
+}
+
+func checkHistoryFlags() {
+	Log("Checking cli flags.", "debug")
+	if KeyHistoryLocation == "" {
+		fmt.Println("Need a key location in -k")
+		os.Exit(1)
+	}
+	Log("Required cli flags present.", "debug")
+}
+
+var (
+	// KeyHistoryLocation is the key to list the versions of.
+	KeyHistoryLocation string
+
+	// HistoryKeep is how many versions of a key are kept - 0 doesn't save any.
+	HistoryKeep int
+
+	// historySet is true when --history was passed rather than left at its
+	// default.
+	historySet bool
+)
+
+func init() {
+	RootCmd.AddCommand(historyCmd)
+	historyCmd.Flags().StringVarP(&KeyHistoryLocation, "key", "k", "", "key to list the versions of")
+}
@@ -0,0 +1,104 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSaveHistory(t *testing.T) {
+	ensureTestFile(t)
+	tc, c := newTestConsul(t)
+	for _, data := range []string{"first version", "second version", "third version"} {
+		if err := SaveHistory(c, "hosts", data, ComputeChecksum(data), "", "", 2); err != nil {
+			t.Fatalf("The version should be saved: %v", err)
+		}
+		// Versions are named to the millisecond.
+		time.Sleep(2 * time.Millisecond)
+	}
+	versions, err := ListHistory(c, "hosts")
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("Only the newest 2 versions should be kept: %v %v", versions, err)
+	}
+	if versions[0].Checksum != ComputeChecksum("second version") || versions[1].Checksum != ComputeChecksum("third version") {
+		t.Errorf("The versions should be oldest first: %v", versions)
+	}
+	if versions[1].Size != len("third version") || versions[1].Host == "" {
+		t.Errorf("The version should have the size and host: %v", versions[1])
+	}
+	if value, _ := tc.value("testing/hosts/history/" + versions[1].Version + "/data"); value != "third version" {
+		t.Errorf("The version's data should be saved: %q", value)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	ensureTestFile(t)
+	tc, c := newTestConsul(t)
+	tc.put("testing/hosts/data", "the new data")
+	tc.put("testing/hosts/checksum", ComputeChecksum("the new data"))
+	tc.put("testing/hosts/signature", "new signature")
+	tc.put("testing/hosts/rolling", "new rolling")
+	if err := SaveHistory(c, "hosts", exampleData, exampleDataSHA, "", "", 10); err != nil {
+		t.Fatalf("The version should be saved: %v", err)
+	}
+	versions, _ := ListHistory(c, "hosts")
+
+	saved, err := Rollback(c, "hosts", versions[0].Version)
+	if err != nil || !saved {
+		t.Fatalf("The key should be rolled back: %v %v", saved, err)
+	}
+	if value, _ := tc.value("testing/hosts/data"); value != exampleData {
+		t.Errorf("The old data should be restored: %q", value)
+	}
+	if value, _ := tc.value("testing/hosts/checksum"); value != exampleDataSHA {
+		t.Errorf("The old checksum should be restored: %q", value)
+	}
+	if _, ok := tc.value("testing/hosts/signature"); ok {
+		t.Error("The new signature doesn't match the old data - it should be removed.")
+	}
+	if _, ok := tc.value("testing/hosts/rolling"); ok {
+		t.Error("The new rolling hash doesn't match the old data - it should be removed.")
+	}
+	if meta, _ := GetMeta(c, "hosts"); meta == nil || meta.Source != "rollback:"+versions[0].Version {
+		t.Errorf("The meta key should say it was a rollback: %+v", meta)
+	}
+
+	// It's already at that version.
+	if saved, err := Rollback(c, "hosts", versions[0].Version); err != nil || saved {
+		t.Errorf("Nothing should be saved the second time: %v %v", saved, err)
+	}
+	if _, err := Rollback(c, "hosts", "20010101T000000.000Z"); err == nil {
+		t.Error("A version that doesn't exist should be an error.")
+	}
+}
+
+func TestRollbackSigned(t *testing.T) {
+	ensureTestFile(t)
+	tc, c := newTestConsul(t)
+	tc.put("testing/hosts/data", "the new data")
+	tc.put("testing/hosts/checksum", ComputeChecksum("the new data"))
+	if err := SaveHistory(c, "hosts", exampleData, exampleDataSHA, "old signature", "", 10); err != nil {
+		t.Fatalf("The version should be saved: %v", err)
+	}
+	versions, _ := ListHistory(c, "hosts")
+	if saved, err := Rollback(c, "hosts", versions[0].Version); err != nil || !saved {
+		t.Fatalf("The key should be rolled back: %v %v", saved, err)
+	}
+	if value, _ := tc.value("testing/hosts/signature"); value != "old signature" {
+		t.Errorf("The version's signature should be restored with it: %q", value)
+	}
+}
+
+func TestRollbackBadChecksum(t *testing.T) {
+	ensureTestFile(t)
+	tc, c := newTestConsul(t)
+	if err := SaveHistory(c, "hosts", exampleData, exampleDataSHA, "", "", 10); err != nil {
+		t.Fatalf("The version should be saved: %v", err)
+	}
+	versions, _ := ListHistory(c, "hosts")
+	tc.put("testing/hosts/history/"+versions[0].Version+"/data", "changed")
+	if _, err := Rollback(c, "hosts", versions[0].Version); err == nil {
+		t.Error("A version that doesn't match its checksum should not be restored.")
+	}
+}
@@ -0,0 +1,97 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"context"
+	"fmt"
+)
+
+// The events the --exec-on-* hooks run on.
+const (
+	// HookChange is when a file or key was written.
+	HookChange = "change"
+
+	// HookError is when the command stopped with an error.
+	HookError = "error"
+
+	// HookLock is when a lock stopped a file from being written.
+	HookLock = "lock"
+)
+
+var (
+	// ExecOnChange are run in order after a file or key is written.
+	ExecOnChange []string
+
+	// ExecOnError are run in order when the command stops with an error.
+	ExecOnError []string
+
+	// ExecOnLock are run in order when a lock stops a file from being written.
+	ExecOnLock []string
+)
+
+// Hook is what happened - it's passed to the hook commands in their
+// environment so they don't have to be told on the command line.
+type Hook struct {
+	Event    string
+	Key      string
+	File     string
+	Checksum string
+	Message  string
+}
+
+// Env is the hook as KVEXPRESS_* environment variables.
+func (h Hook) Env() []string {
+	return []string{
+		"KVEXPRESS_EVENT=" + h.Event,
+		"KVEXPRESS_COMMAND=" + Direction,
+		"KVEXPRESS_KEY=" + h.Key,
+		"KVEXPRESS_FILE=" + h.File,
+		"KVEXPRESS_CHECKSUM=" + h.Checksum,
+		"KVEXPRESS_MESSAGE=" + h.Message,
+		"KVEXPRESS_RUN_ID=" + RunID,
+	}
+}
+
+// hookCommands are the commands for an event.
+func hookCommands(event string) []string {
+	switch event {
+	case HookChange:
+		return ExecOnChange
+	case HookError:
+		return ExecOnError
+	case HookLock:
+		return ExecOnLock
+	}
+	return nil
+}
+
+// RunHooks runs every command for the hook's event - even if one of them
+// fails - and returns the exit code of the first one that failed. A blank
+// Checksum is the one the command recorded for its result.
+func RunHooks(h Hook) int {
+	return runHooksContext(RunContext(), h)
+}
+
+// runStopHooks runs the hooks of a run that was stopped - the run's context
+// is already cancelled, so they get stopGrace of their own.
+func runStopHooks(h Hook) int {
+	ctx, cancel := context.WithTimeout(context.Background(), stopGrace)
+	defer cancel()
+	return runHooksContext(ctx, h)
+}
+
+// runHooksContext is RunHooks with the commands killed when ctx is done.
+func runHooksContext(ctx context.Context, h Hook) int {
+	if h.Checksum == "" {
+		h.Checksum = cmdResult.Checksum
+	}
+	failed := 0
+	for _, command := range hookCommands(h.Event) {
+		Log(fmt.Sprintf("hook='%s' exec='%s'", h.Event, command), "debug")
+		if status := runCommandContext(ctx, command, h.Env(), ExecTimeout); status != 0 && failed == 0 {
+			failed = status
+		}
+	}
+	return failed
+}
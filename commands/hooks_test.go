@@ -0,0 +1,47 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRunHooks(t *testing.T) {
+	file := ensureTestFile(t)
+	script := file + ".sh"
+	ioutil.WriteFile(script, []byte("#!/bin/sh\nenv | grep ^KVEXPRESS_ > "+file+"\n"), 0755)
+	defer os.Remove(script)
+	defer func() { ExecOnChange = nil }()
+	RecordResult(10, exampleDataSHA)
+
+	ExecOnChange = []string{"false", script}
+	if status := RunHooks(Hook{Event: HookChange, Key: "hosts", File: "/etc/hosts"}); status != 1 {
+		t.Errorf("The first failure should be returned: %d", status)
+	}
+	env := ReadFile(file)
+	for _, want := range []string{"KVEXPRESS_EVENT=change", "KVEXPRESS_KEY=hosts", "KVEXPRESS_FILE=/etc/hosts", "KVEXPRESS_CHECKSUM=" + exampleDataSHA} {
+		if !strings.Contains(env, want) {
+			t.Errorf("The hook should still run and get %s: %q", want, env)
+		}
+	}
+	if status := RunHooks(Hook{Event: HookLock, Key: "hosts"}); status != 0 {
+		t.Errorf("There are no lock hooks: %d", status)
+	}
+}
+
+func TestRunStopHooks(t *testing.T) {
+	defer func() { ExecOnError = nil }()
+	ExecOnError = []string{"true"}
+	stopped, cancel := context.WithCancel(context.Background())
+	cancel()
+	if status := runHooksContext(stopped, Hook{Event: HookError, Key: "hosts"}); status == 0 {
+		t.Error("A hook can't run with a context that's done.")
+	}
+	if status := runStopHooks(Hook{Event: HookError, Key: "hosts"}); status != 0 {
+		t.Errorf("The hooks of a stopped run should get a context of their own: %d", status)
+	}
+}
@@ -0,0 +1,97 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+var importCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Import the keys from a JSON export.",
+	Long:  `Import is for restoring a backup or seeding another cluster - it reads files from 'kvexpress export' or 'consul kv export'.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		checkImportFlags()
+		AutoEnable()
+	},
+	Run: importRun,
+}
+
+func importRun(cmd *cobra.Command, args []string) {
+	start := time.Now()
+
+	data, err := ioutil.ReadFile(ImportFile)
+	if err != nil {
+		fmt.Printf("Could not read the import: %v\n", err)
+		os.Exit(1)
+	}
+	var entries []ExportEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		fmt.Printf("Could not parse the import: %v\n", err)
+		os.Exit(1)
+	}
+
+	c, err := Connect(ConsulServer, Token)
+	if err != nil {
+		LogFatal("Could not connect to Consul.", "import", "consul_connect")
+	}
+
+	imported, err := ImportTree(c, entries)
+	ExitOnError(err, ImportFile, "import")
+	Log(fmt.Sprintf("import file='%s' keys='%d'", ImportFile, imported), "info")
+	RunTime(start, "import", "complete")
+}
+
+// ImportTree saves every entry and returns how many were saved. All of the
+// values are decoded before anything is saved so a bad file changes nothing.
+// Flags can't be set through Set so they're not restored.
+func ImportTree(c *consul.Client, entries []ExportEntry) (int, error) {
+	values := make([]string, len(entries))
+	for i, entry := range entries {
+		if entry.Key == "" {
+			return 0, fmt.Errorf("entry %d doesn't have a key", i)
+		}
+		value, err := base64.StdEncoding.DecodeString(entry.Value)
+		if err != nil {
+			return 0, fmt.Errorf("could not decode '%s': %v", entry.Key, err)
+		}
+		values[i] = string(value)
+	}
+	imported := 0
+	for i, entry := range entries {
+		if DryRunSkip(fmt.Sprintf("save '%s' size='%d'", entry.Key, len(values[i]))) {
+			continue
+		}
+		if err := Set(c, entry.Key, values[i]); err != nil {
+			return imported, err
+		}
+		imported++
+	}
+	return imported, nil
+}
+
+func checkImportFlags() {
+	Log("Checking cli flags.", "debug")
+	if ImportFile == "" {
+		fmt.Println("Need a file to import with -f")
+		os.Exit(1)
+	}
+	Log("Required cli flags present.", "debug")
+}
+
+var (
+	// ImportFile is the JSON export to read the keys from.
+	ImportFile string
+)
+
+func init() {
+	RootCmd.AddCommand(importCmd)
+	importCmd.Flags().StringVarP(&ImportFile, "file", "f", "", "JSON export to import")
+}
@@ -1,12 +1,17 @@
-// +build linux darwin freebsd
+// +build linux darwin freebsd windows
 
 package commands
 
 import (
+	"crypto/ed25519"
+	"errors"
 	"fmt"
+	consul "github.com/hashicorp/consul/api"
 	"github.com/spf13/cobra"
 	"github.com/zorkian/go-datadog-api"
 	"os"
+	"regexp"
+	"strings"
 	"time"
 )
 
@@ -15,6 +20,7 @@ var inCmd = &cobra.Command{
 	Short: "Put configuration into Consul.",
 	Long:  `In is for putting data into a Consul key so that you can write it on another networked node.`,
 	PreRun: func(cmd *cobra.Command, args []string) {
+		historySet = cmd.Flags().Changed("history")
 		checkInFlags()
 		AutoEnable()
 	},
@@ -23,26 +29,50 @@ var inCmd = &cobra.Command{
 
 func inRun(cmd *cobra.Command, args []string) {
 	start := time.Now()
+	checkRunLock(start, "in", KeyInLocation)
+	targets := loadInTargets()
+	if Recurse {
+		inRecurseRun(start)
+		return
+	}
 	var dog = new(datadog.Client)
 	var CompareFile = ""
 	var LastFile = ""
 	var FileString = ""
+	var validators URLValidators
+	var validatorsFile = ""
 
 	KeyStop := KeyPath(KeyInLocation, "stop")
+	// The canary is saved next to the key - the key's stop key still stops it.
+	if InCanary {
+		KeyInLocation = CanaryKey(KeyInLocation)
+		// The version is saved in the key's history when it's promoted.
+		HistoryKeep = 0
+	}
+	// So is the staged data - out reads it once --activate-at has passed.
+	stagedFor := ""
+	if ActivateAt != "" {
+		stagedFor = KeyInLocation
+		KeyInLocation = StagedKey(KeyInLocation)
+		HistoryKeep = 0
+	}
 	KeyData := KeyPath(KeyInLocation, "data")
 	KeyChecksum := KeyPath(KeyInLocation, "checksum")
+	KeyRolling := KeyPath(KeyInLocation, "rolling")
+	KeyUpdated := KeyPath(KeyInLocation, "updated")
+	KeySignature := KeyPath(KeyInLocation, "signature")
 
-	if FiletoRead != "" {
-		CompareFile = CompareFilename(FiletoRead)
-		LastFile = LastFilename(FiletoRead)
+	if FiletoRead != "" && FiletoRead != Stdio {
+		CompareFile = CompareFilename(inFilesBase(FiletoRead))
+		LastFile = LastFilename(inFilesBase(FiletoRead))
 	} else {
 		CompareFile = RandomTmpFile()
 		LastFile = LastFilename(CompareFile)
 	}
 
 	// Let's double check those files are safe to write.
-	CheckFiletoWrite(CompareFile, "")
-	CheckFiletoWrite(LastFile, "")
+	ExitOnError(CheckFiletoWrite(CompareFile, ""), CompareFile, "check_file")
+	ExitOnError(CheckFiletoWrite(LastFile, ""), LastFile, "check_file")
 
 	c, err := Connect(ConsulServer, Token)
 	if err != nil {
@@ -53,48 +83,67 @@ func inRun(cmd *cobra.Command, args []string) {
 		dog = DDAPIConnect(DatadogAPIKey, DatadogAPPKey)
 	}
 
-	StopKeyData := Get(c, KeyStop)
+	StopKeyData, err := Get(c, KeyStop)
+	ExitOnError(err, KeyStop, "consul_get")
 
 	if StopKeyData != "" {
 		Log(fmt.Sprintf("Stop Key is present - stopping. Reason: %s", StopKeyData), "info")
 		if DatadogAPIKey != "" && DatadogAPPKey != "" {
 			DDStopEvent(dog, KeyStop, StopKeyData)
 		}
-		RunTime(start, KeyInLocation, "stop_key")
-		os.Exit(1)
+		exitRun(ExitStopped, start, KeyInLocation, "stop_key", "")
 	} else {
 		Log("Stop Key is NOT present - continuing.", "info")
 	}
+	electInLeader(c, start)
+	acquireInSession(c, start)
 
 	// Read the file - if it's to be sorted - then make sure to sort.
-	if FiletoRead != "" {
+	switch {
+	case FiletoRead == Stdio:
+		FileString, err = ReadStdin()
+		ExitOnError(err, FiletoRead, "read_file")
+	case FiletoRead != "":
 		FileString = ReadFile(FiletoRead)
-	} else {
-		FileString = ReadURL(UrltoRead)
+	case S3toRead != "":
+		FileString, err = ReadS3(S3toRead)
+		ExitOnError(err, S3toRead, "read_s3")
+	case SourceExec != "":
+		FileString, err = ReadExec(SourceExec)
+		if err != nil {
+			Log(fmt.Sprintf("source='failed' message='%v' - stopping.", err), "info")
+			fmt.Printf("The source command failed - not updating Consul: %v\n", err)
+			exitRun(1, start, KeyInLocation, "source_failed", "")
+		}
+	case UrltoRead != "" && URLCache:
+		validatorsFile = URLValidatorsFile(KeyInLocation, UrltoRead)
+		FileString, validators, err = ReadURLIfModified(UrltoRead, LoadURLValidators(validatorsFile))
+		if errors.Is(err, ErrNotModified) {
+			Log(fmt.Sprintf("url='%s' modified='false' update='false'", UrltoRead), "info")
+			exitRun(ExitNoChange, start, KeyInLocation, "url_not_modified", "")
+		}
+		ExitOnError(err, UrltoRead, "read_url")
+	default:
+		FileString, err = ReadURL(UrltoRead)
+		ExitOnError(err, UrltoRead, "read_url")
 	}
 
-	// Sorting also removes any blank lines.
-	if Sorted {
-		FileString = SortFile(FileString)
+	// The .compare file is the candidate --validate-exec checks.
+	FileString, err = prepareInData(FileString, func(data string) (string, error) {
+		return CompareFile, WriteFile(data, CompareFile, FilePermissions, Owner)
+	})
+	if err != nil {
+		stopInData(start, dog, CompareFile, FileString, err)
 	}
 
-	// Is it long enough?
-	longEnough := LengthCheck(FileString, MinFileLength)
-
-	if !longEnough {
-		Log("File is NOT long enough. Stopping.", "info")
-		if DatadogAPIKey != "" && DatadogAPPKey != "" {
-			DDLengthEvent(dog, KeyInLocation, FileString)
-		}
-		RunTime(start, KeyInLocation, "not_long_enough")
-		os.Exit(1)
+	// Every host saves its own part and the parts are merged into the key.
+	if InAppend {
+		finishIn(start, inAppendRun(c, dog, start, FileString), validatorsFile, validators)
+		return
 	}
 
-	// Write the .compare file.
-	WriteFile(FileString, CompareFile, FilePermissions, Owner)
-
 	// Check for the .last file - touch if it doesn't exist.
-	CheckLastFile(LastFile, FilePermissions, Owner)
+	ExitOnError(CheckLastFile(LastFile, FilePermissions, Owner), LastFile, "write_file")
 
 	// Read compare and last files into string.
 	CompareData := ReadFile(CompareFile)
@@ -104,44 +153,172 @@ func inRun(cmd *cobra.Command, args []string) {
 		Log("We have data - let's do the thing.", "info")
 	} else {
 		Log("We do NOT have data. This should never happen.", "info")
-		RunTime(start, KeyInLocation, "error_no_data")
-		os.Exit(1)
+		exitRun(1, start, KeyInLocation, "error_no_data", "")
 	}
 
 	// Get SHA256 values for each string.
 	CompareChecksum := ComputeChecksum(CompareData)
 	LastChecksum := ComputeChecksum(LastData)
+	RecordResult(len(CompareData), CompareChecksum)
 
 	// If they're different - let's update things.
 	if CompareChecksum != LastChecksum {
 		Log("file checksum='different' update='true'", "info")
 	} else {
 		Log("file checksum='match' update='false'", "info")
-		RunTime(start, KeyInLocation, "file_checksums_match")
-		os.Exit(0)
+		exitRun(ExitNoChange, start, KeyInLocation, "file_checksums_match", "")
 	}
 
 	// Diff the files.
 	diff := UnixDiff(LastFile, CompareFile)
 
+	// Stop before the .last file is written so the next run checks again.
+	if MaxChangeRatio > 0 {
+		CurrentData, err := GetData(c, KeyInLocation)
+		ExitOnError(err, KeyData, "consul_get")
+		CurrentData, err = DecodeData(c, KeyInLocation, CurrentData)
+		ExitOnError(err, KeyData, "DecodeData")
+		if ratio := ChangeRatio(CurrentData, CompareData); ratio > MaxChangeRatio {
+			Log(fmt.Sprintf("change ratio='%.3f' max='%.3f' - stopping.", ratio, MaxChangeRatio), "info")
+			fmt.Printf("Too much changed - %.0f%% of the lines - not updating Consul.\n", ratio*100)
+			if DatadogAPIKey != "" && DatadogAPPKey != "" {
+				DDChangeEvent(dog, KeyInLocation, ratio, MaxChangeRatio, diff)
+			}
+			StatsdChangeTooLarge(KeyInLocation)
+			exitRun(ExitRejected, start, KeyInLocation, "change_too_large", "")
+		}
+	}
+
 	// If we get this far - copy the CompareData to the .last file.
 	// This handles the case detailed in https://github.com/darron/kvexpress/issues/33
-	WriteFile(CompareData, LastFile, FilePermissions, Owner)
+	if !DryRunSkip(fmt.Sprintf("write '%s'", LastFile)) {
+		ExitOnError(WriteFile(CompareData, LastFile, FilePermissions, Owner), LastFile, "write_file")
+	}
+
+	// Consul gets the checksum with --hash - the local files are always sha256.
+	CompareChecksum = StoreChecksum(CompareData)
+	RecordResult(len(CompareData), CompareChecksum)
+	CompareChecksums := StoreChecksums(CompareData)
+
+	if len(targets) > 0 {
+		changed := inTargetsRun(dog, start, targets, CompareData, CompareChecksum, CompareChecksums, diff)
+		finishIn(start, changed, validatorsFile, validators)
+		return
+	}
+
+	// Staged data that's already active is saved as the key before the next
+	// version replaces it - or every host would go back to the key's old data.
+	if ActivateAt != "" {
+		if !atomicWrites() {
+			fmt.Printf("--activate-at needs a backend with transactions - not --backend %s\n", Backend)
+			exitRun(1, start, KeyInLocation, "no_transactions", "")
+		}
+		if !DryRunSkip(fmt.Sprintf("promote '%s' if it's active", KeyInLocation)) {
+			_, err := PromoteStaged(c, stagedFor)
+			ExitOnError(err, KeyInLocation, "promote_staged")
+		}
+	}
 
 	// Get the checksum from Consul.
-	CurrentChecksum := Get(c, KeyChecksum)
+	CurrentChecksum, err := Get(c, KeyChecksum)
+	ExitOnError(err, KeyChecksum, "consul_get")
 
 	if CurrentChecksum != CompareChecksum {
 		Log("consul checksum='different' update='true'", "info")
+		// The rolling hash is always computed on the uncompressed data.
+		var rolling string
+		if Rolling {
+			rolling = RollingHash(CompareData)
+		}
+		// The signature is always over the uncompressed data too.
+		var signature string
+		if signingKey != nil {
+			signature = SignKeyData(signingKey, KeyInLocation, CompareChecksum, CompareData)
+		}
 		// Compress data here.
-		if Compress {
-			CompareData = CompressData(CompareData)
+		CompareData, err = EncodeData(KeyInLocation, CompareData)
+		ExitOnError(err, KeyInLocation, "EncodeData")
+		if DryRunSkip(fmt.Sprintf("save '%s' size='%d' checksum='%s'", KeyData, len(CompareData), CompareChecksum)) {
+			exitRun(0, start, KeyInLocation, "dry_run", "")
+		}
+		oldSize := auditKeyBytes(c, KeyInLocation)
+		var saved, atomic bool
+		if (ContentAddressed || Delta) && !atomicWrites() {
+			fmt.Printf("--content-addressed and --delta need a backend with transactions - not --backend %s\n", Backend)
+			exitRun(1, start, KeyInLocation, "no_transactions", "")
+		}
+		// The config file is loaded after the flags are checked.
+		if Delta && (encryption != nil || DataEncoding() != EncodingNone) {
+			fmt.Println("--delta works on lines of plain text - it can't be used with --compress, --binary or encryption.")
+			exitRun(1, start, KeyInLocation, "delta_encrypted", "")
+		}
+		if (ContentAddressed || Delta || ActivateAt != "") && !singleTxn(len(CompareData)) {
+			Log(fmt.Sprintf("content_addressed='%t' delta='%t' staged='%t' size='%d' chunk_size='%d' - stopping.", ContentAddressed, Delta, ActivateAt != "", len(CompareData), ChunkSize), "info")
+			fmt.Printf("Content-addressed, delta and staged data has to fit in a single key and transaction - it's %d bytes and --chunk-size is %d.\n", len(CompareData), ChunkSize)
+			exitRun(ExitRejected, start, KeyInLocation, "too_large", "")
+		}
+		if singleTxn(len(CompareData)) {
+			// Data, checksum, updated, rolling and signature are saved together - so
+			// a reader never sees data with another version's checksum - unless
+			// another writer got there first.
+			var extra []*consul.TxnOp
+			if Rolling {
+				extra = append(extra, setOp(KeyRolling, rolling))
+			}
+			if signingKey != nil {
+				extra = append(extra, setOp(KeySignature, signature))
+			}
+			if ActivateAt != "" {
+				extra = append(extra, activateAtOp(KeyInLocation))
+			}
+			switch {
+			case ContentAddressed:
+				saved, err = SaveContent(c, KeyInLocation, CompareData, CompareChecksum, CompareChecksums, extra...)
+			case Delta:
+				saved, err = SaveDelta(c, KeyInLocation, CompareData, CompareChecksum, CompareChecksums, extra...)
+			default:
+				saved, err = SaveCAS(c, KeyInLocation, CompareData, CompareChecksum, CompareChecksums, extra...)
+			}
+			atomic = true
+			if errors.Is(err, ErrKeyOwned) {
+				ExitOnError(err, KeyInLocation, "key_owned")
+			}
+			if err != nil {
+				Log(fmt.Sprintf("consul KeyData='%s' saved='false' message='%v'", KeyData, err), "info")
+				switch {
+				case errors.Is(err, ErrTxnTooLarge):
+					exitRun(ExitRejected, start, KeyInLocation, "too_large", err.Error())
+				case errors.Is(err, ErrCASConflict):
+					exitRun(ExitConsulError, start, KeyInLocation, "cas_conflict", err.Error())
+				default:
+					exitRun(ExitConsulError, start, KeyInLocation, "consul_error", err.Error())
+				}
+			}
+		} else {
+			ExitOnError(SetData(c, KeyInLocation, CompareData), KeyData, "consul_set")
+			ExitOnError(Set(c, KeyChecksum, CompareChecksum), KeyChecksum, "consul_set")
+			ExitOnError(SetChecksums(c, KeyInLocation, CompareChecksums), KeyInLocation, "consul_set")
+			ExitOnError(Set(c, KeyUpdated, ReturnCurrentUTC()), KeyUpdated, "consul_set")
+			ExitOnError(SetEncoding(c, KeyInLocation), KeyInLocation, "consul_set")
+			saved = true
 		}
-		saved := Set(c, KeyData, CompareData)
 		if saved {
 			CompareDataBytes := len(CompareData)
 			Log(fmt.Sprintf("consul KeyData='%s' saved='true' size='%d'", KeyData, CompareDataBytes), "info")
-			Set(c, KeyChecksum, CompareChecksum)
+			Audit(AuditRecord{Event: AuditKey, Key: KeyInLocation, File: FiletoRead, OldChecksum: strings.TrimSpace(CurrentChecksum), NewChecksum: CompareChecksum, ByteDelta: CompareDataBytes - oldSize})
+			if Rolling && !atomic {
+				ExitOnError(Set(c, KeyRolling, rolling), KeyRolling, "consul_set")
+			}
+			if signingKey != nil && !atomic {
+				ExitOnError(Set(c, KeySignature, signature), KeySignature, "consul_set")
+			}
+			saveMeta(c, KeyInLocation, inSource())
+			// A version that isn't saved shouldn't stop the update that already happened.
+			if HistoryKeep > 0 {
+				if err := SaveHistory(c, KeyInLocation, CompareData, CompareChecksum, signature, diff, HistoryKeep); err != nil {
+					Log(fmt.Sprintf("history key='%s' saved='false' message='%v'", KeyInLocation, err), "info")
+				}
+			}
 			if DatadogAPIKey != "" && DatadogAPPKey != "" {
 				DDSaveDataEvent(dog, KeyData, diff)
 			}
@@ -149,48 +326,559 @@ func inRun(cmd *cobra.Command, args []string) {
 
 			if UrltoRead != "" {
 				urlOutput := fmt.Sprintf("\nURL: %s\n\nWhat was inserted into: '%s'\n===================\n%s\n===================\n", UrltoRead, KeyData, CompareData)
-				fmt.Println(urlOutput)
+				fmt.Println(Redact(urlOutput))
 			}
 
 		} else {
 			Log(fmt.Sprintf("consul KeyData='%s' saved='false'", KeyData), "info")
-			RunTime(start, KeyInLocation, "consul_checksums_match")
-			os.Exit(0)
+			if ActivateAt != "" {
+				ExitOnError(saveActivateAt(c, KeyInLocation), KeyPath(KeyInLocation, "activate_at"), "consul_set")
+			}
+			saveInURLValidators(validatorsFile, validators)
+			exitRun(ExitNoChange, start, KeyInLocation, "consul_checksums_match", "")
 		}
 	} else {
 		Log("consul checksum='match' update='false'", "info")
+		if ActivateAt != "" {
+			ExitOnError(saveActivateAt(c, KeyInLocation), KeyPath(KeyInLocation, "activate_at"), "consul_set")
+		}
+	}
+	finishIn(start, CurrentChecksum != CompareChecksum, validatorsFile, validators)
+}
+
+// finishIn runs --exec and the hooks once new data is in Consul - it exits
+// ExitNoChange without running them if nothing changed.
+func finishIn(start time.Time, changed bool, validatorsFile string, validators URLValidators) {
+	saveInURLValidators(validatorsFile, validators)
+	if !changed {
+		Log(fmt.Sprintf("key='%s' changed='false' - not running the exec or hooks.", KeyInLocation), "debug")
+		exitRun(ExitNoChange, start, KeyInLocation, "complete", "")
 	}
 	// Run this command after the data is input.
 	if PostExec != "" {
 		Log(fmt.Sprintf("exec='%s'", PostExec), "debug")
-		RunCommand(PostExec)
+		if status := RunPostExec(PostExec); status != 0 {
+			exitExecFailed(status, KeyInLocation)
+		}
+	}
+	if status := RunHooks(Hook{Event: HookChange, Key: KeyInLocation, File: FiletoRead}); status != 0 {
+		exitExecFailed(status, KeyInLocation)
+	}
+	RunTime(start, KeyInLocation, "complete")
+}
+
+// loadInTargets reads --target and the targets in the config - it's run once
+// the config is loaded.
+func loadInTargets() []Target {
+	targets, err := ParseTargets(InTargets, configTargets)
+	if err == nil && len(targets) > 0 && (Recurse || !consulBackend()) {
+		err = errors.New("--target only works with a single key on Consul - not with --recurse or --backend")
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return targets
+}
+
+// inTargetsRun saves the data on every target instead of --server - it's only
+// written if every target answered first. It's true if any of them changed.
+func inTargetsRun(dog *datadog.Client, start time.Time, targets []Target, data, checksum, checksums, diff string) bool {
+	clients, results, err := PrepareTargets(targets, KeyInLocation)
+	if err != nil {
+		reportTargets(results)
+		fmt.Printf("Not updating any target: %v\n", err)
+		if errors.Is(err, errTargetStopped) {
+			exitRun(ExitStopped, start, KeyInLocation, "stop_key", "")
+		}
+		exitRun(ExitConsulError, start, KeyInLocation, "target_failed", "")
+	}
+	changed := false
+	for i, client := range clients {
+		if strings.TrimSpace(client.checksum) == checksum {
+			results[i].Action = TargetUnchanged
+		} else {
+			changed = true
+		}
+	}
+	if !changed {
+		Log(fmt.Sprintf("consul checksum='match' update='false' targets='%d'", len(targets)), "info")
+		reportTargets(results)
+		return false
+	}
+	var rolling, signature string
+	if Rolling {
+		rolling = RollingHash(data)
+	}
+	if signingKey != nil {
+		signature = SignKeyData(signingKey, KeyInLocation, checksum, data)
+	}
+	data, err = EncodeData(KeyInLocation, data)
+	ExitOnError(err, KeyInLocation, "EncodeData")
+	if DryRunSkip(fmt.Sprintf("save '%s' size='%d' checksum='%s' targets='%d'", KeyPath(KeyInLocation, "data"), len(data), checksum, len(targets))) {
+		exitRun(0, start, KeyInLocation, "dry_run", "")
+	}
+	oldSizes := make([]int, len(clients))
+	for i, client := range clients {
+		oldSizes[i] = auditKeyBytes(client.client, KeyInLocation)
+	}
+	results, err = SaveTargets(clients, KeyInLocation, data, checksum, checksums, rolling, signature)
+	reportTargets(results)
+	saved := false
+	for i, result := range results {
+		if result.Action != TargetSaved {
+			continue
+		}
+		saved = true
+		c := clients[i].client
+		Audit(AuditRecord{Event: AuditKey, Key: KeyInLocation, File: FiletoRead, OldChecksum: strings.TrimSpace(clients[i].checksum), NewChecksum: checksum, ByteDelta: len(data) - oldSizes[i]})
+		saveMeta(c, KeyInLocation, inSource())
+		if HistoryKeep > 0 {
+			if err := SaveHistory(c, KeyInLocation, data, checksum, signature, diff, HistoryKeep); err != nil {
+				Log(fmt.Sprintf("history key='%s' target='%s' saved='false' message='%v'", KeyInLocation, result.Name, err), "info")
+			}
+		}
+	}
+	if saved {
+		if DatadogAPIKey != "" && DatadogAPPKey != "" {
+			DDSaveDataEvent(dog, KeyPath(KeyInLocation, "data"), diff)
+		}
+		StatsdIn(KeyInLocation, len(data), data)
+	}
+	if err != nil {
+		fmt.Printf("Not every target was updated: %v\n", err)
+		exitRun(ExitConsulError, start, KeyInLocation, "target_failed", "")
+	}
+	return saved
+}
+
+// reportTargets prints what happened on each target - and adds it to the
+// JSON result.
+func reportTargets(results []TargetResult) {
+	RecordDetails(results)
+	for _, result := range results {
+		action := result.Action
+		if action == "" {
+			action = "not written"
+		}
+		if result.Error != "" {
+			action += ": " + result.Error
+		}
+		fmt.Printf("%s (%s): %s\n", result.Name, result.Server, action)
+	}
+}
+
+// inFilesBase is the name the .compare and .last files are made from - the
+// canary and the staged data have their own so saving the stable key
+// afterwards isn't skipped.
+func inFilesBase(file string) string {
+	if InCanary {
+		return file + ".canary"
+	}
+	if ActivateAt != "" {
+		return file + ".staged"
+	}
+	return file
+}
+
+// saveInURLValidators keeps the URL's validators once its data is in Consul -
+// a run that failed reads the URL in full the next time.
+func saveInURLValidators(file string, validators URLValidators) {
+	if file == "" || DryRunSkip(fmt.Sprintf("save the validators for '%s'", validators.URL)) {
+		return
+	}
+	if err := SaveURLValidators(file, validators); err != nil {
+		Log(fmt.Sprintf("url='%s' file='%s' validators='not_saved' message='%v'", validators.URL, file, err), "info")
+	}
+}
+
+// inSource is where the data came from for the meta key.
+func inSource() string {
+	switch {
+	case FiletoRead == Stdio:
+		return "stdin"
+	case FiletoRead != "":
+		return "file:" + FiletoRead
+	case S3toRead != "":
+		return S3toRead
+	case SourceExec != "":
+		return "exec:" + SourceExec
+	}
+	return "url:" + UrltoRead
+}
+
+// electInLeader stops in on every host but the leader with --leader-election.
+// Followers exit 0 - there's nothing wrong with them.
+func electInLeader(c *consul.Client, start time.Time) {
+	if !LeaderElection || DryRunSkip(fmt.Sprintf("run the leader election for '%s'", KeyInLocation)) {
+		return
+	}
+	if AcquireLeadership(c, KeyPath(KeyInLocation, "leader"), LeaderTTL) {
+		return
+	}
+	Log(fmt.Sprintf("in key='%s' leader='false' message='not leader - not updating Consul'", KeyInLocation), "info")
+	fmt.Printf("Not the leader for '%s' - not updating Consul.\n", KeyInLocation)
+	StatsdNotLeader(KeyInLocation)
+	exitRun(ExitWrote, start, KeyInLocation, "not_leader", "")
+}
+
+// acquireInSession stops in when another host owns the key with
+// --acquire-session - or makes this host the owner.
+func acquireInSession(c *consul.Client, start time.Time) {
+	if !AcquireSession || DryRunSkip(fmt.Sprintf("acquire the session for '%s'", KeyInLocation)) {
+		return
+	}
+	err := AcquireOwnership(c, KeyInLocation, SessionTTL)
+	if errors.Is(err, ErrKeyOwned) {
+		fmt.Printf("Not updating '%s' - %v.\n", KeyInLocation, err)
+		RunHooks(Hook{Event: HookLock, Key: KeyInLocation, Message: err.Error()})
+		exitRun(ExitLocked, start, KeyInLocation, "key_owned", "")
+	}
+	ExitOnError(err, KeyInLocation, "consul_session")
+}
+
+// inRecurseRun saves every file in RecurseDir underneath KeyInLocation.
+func inRecurseRun(start time.Time) {
+	KeyStop := KeyPath(KeyInLocation, "stop")
+
+	c, err := Connect(ConsulServer, Token)
+	if err != nil {
+		LogFatal("Could not connect to Consul.", KeyInLocation, "consul_connect")
+	}
+
+	StopKeyData, err := Get(c, KeyStop)
+	ExitOnError(err, KeyStop, "consul_get")
+	if StopKeyData != "" {
+		Log(fmt.Sprintf("Stop Key is present - stopping. Reason: %s", StopKeyData), "info")
+		if DatadogAPIKey != "" && DatadogAPPKey != "" {
+			DDStopEvent(DDAPIConnect(DatadogAPIKey, DatadogAPPKey), KeyStop, StopKeyData)
+		}
+		exitRun(ExitStopped, start, KeyInLocation, "stop_key", "")
+	}
+	electInLeader(c, start)
+	acquireInSession(c, start)
+
+	summary, err := PushDir(c, KeyInLocation, RecurseDir)
+	ExitOnError(err, KeyInLocation, "push_dir")
+	Log(fmt.Sprintf("sync key='%s' dir='%s' written='%d' unchanged='%d' removed='%d'", KeyInLocation, RecurseDir, summary.Written, summary.Unchanged, summary.Removed), "info")
+	StatsdSync(KeyInLocation, summary)
+	if !summary.Changed() {
+		exitRun(ExitNoChange, start, KeyInLocation, "consul_checksums_match", "")
+	}
+	if PostExec != "" {
+		Log(fmt.Sprintf("exec='%s'", PostExec), "debug")
+		if status := RunPostExec(PostExec); status != 0 {
+			exitExecFailed(status, KeyInLocation)
+		}
+	}
+	if status := RunHooks(Hook{Event: HookChange, Key: KeyInLocation, File: RecurseDir}); status != 0 {
+		exitExecFailed(status, KeyInLocation)
 	}
 	RunTime(start, KeyInLocation, "complete")
 }
 
+// checkSessionFlags checks --acquire-session and --leader-election - Consul
+// sessions last from 10 seconds up to a day.
+func checkSessionFlags() {
+	for _, session := range []struct {
+		on        bool
+		flag, ttl string
+		value     time.Duration
+	}{
+		{AcquireSession, "--acquire-session", "--session-ttl", SessionTTL},
+		{LeaderElection, "--leader-election", "--leader-ttl", LeaderTTL},
+	} {
+		if !session.on {
+			continue
+		}
+		if !consulBackend() {
+			fmt.Printf("%s uses Consul sessions and can't be used with --backend %s\n", session.flag, Backend)
+			os.Exit(1)
+		}
+		if session.value < 10*time.Second || session.value > 24*time.Hour {
+			fmt.Printf("Need a %s from 10s to 24h\n", session.ttl)
+			os.Exit(1)
+		}
+	}
+}
+
 func checkInFlags() {
 	Log("Checking cli flags.", "debug")
 	if KeyInLocation == "" {
 		fmt.Println("Need a key location in -k")
 		os.Exit(1)
 	}
-	if FiletoRead == "" && UrltoRead == "" {
-		fmt.Println("Need a file -f or url -u to read from.")
+	checkSessionFlags()
+	checkAppendFlags()
+	if InCanary && (Recurse || len(InTargets) > 0) {
+		fmt.Println("--canary can't be used with --recurse or --target")
+		os.Exit(1)
+	}
+	if (ContentAddressed || Delta) && (Recurse || len(InTargets) > 0) {
+		fmt.Println("--content-addressed and --delta can't be used with --recurse or --target")
+		os.Exit(1)
+	}
+	if Delta && ContentAddressed {
+		fmt.Println("You can only use one of --delta and --content-addressed.")
+		os.Exit(1)
+	}
+	if DeltaCompact <= 0 || DeltaCompact > 1 {
+		fmt.Println("Need a --delta-compact greater than 0 and no more than 1")
+		os.Exit(1)
+	}
+	// Every version in the history is the whole data - with --delta that's
+	// what it was meant to stop saving.
+	if Delta && HistoryKeep > 0 {
+		if historySet {
+			fmt.Println("--history saves the whole data every time - it can't be used with --delta. Use --history 0.")
+			os.Exit(1)
+		}
+		Log(fmt.Sprintf("delta='true' history='%d' - not saving the history, every version would be the whole data.", HistoryKeep), "info")
+		HistoryKeep = 0
+	}
+	checkActivateFlags()
+	if Recurse {
+		checkInRecurseFlags()
+		return
+	}
+	sources := 0
+	for _, source := range []string{FiletoRead, UrltoRead, S3toRead, SourceExec} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources == 0 {
+		fmt.Println("Need a file -f, url -u, --s3 object or --source-exec command to read from.")
+		os.Exit(1)
+	}
+	if sources > 1 {
+		fmt.Println("You can only use one of -f, -u, --s3 and --source-exec.")
 		os.Exit(1)
 	}
-	if FiletoRead != "" {
+	if S3toRead != "" {
+		if _, _, err := ParseS3URL(S3toRead); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if URLHeaderFile != "" {
+		headers, err := ReadHeaderFile(URLHeaderFile)
+		if err != nil {
+			fmt.Printf("Could not read --url-header-file: %v\n", err)
+			os.Exit(1)
+		}
+		URLHeaders = append(URLHeaders, headers...)
+	}
+	RedactHeaders(URLHeaders)
+	if FiletoRead != "" && FiletoRead != Stdio {
 		if _, err := os.Stat(FiletoRead); err != nil {
 			fmt.Println("File ", FiletoRead, " does not exist.")
 			os.Exit(1)
 		}
 	}
-	if FiletoRead != "" && UrltoRead != "" {
-		fmt.Println("You cannot use both -f and -u.")
+	loadSignKey()
+	loadLineFilters()
+	checkSortFlags()
+	checkNormalizeFlags()
+	checkValidateFlag()
+	checkBinaryFlags()
+	Log("Required cli flags present.", "debug")
+}
+
+func checkInRecurseFlags() {
+	if RecurseDir == "" {
+		fmt.Println("Need a directory to read from in --dir")
+		os.Exit(1)
+	}
+	if FiletoRead != "" || UrltoRead != "" || S3toRead != "" || SourceExec != "" {
+		fmt.Println("You cannot use -f, -u, --s3 or --source-exec with --recurse.")
+		os.Exit(1)
+	}
+	if info, err := os.Stat(RecurseDir); err != nil || !info.IsDir() {
+		fmt.Printf("'%s' is not a directory.\n", RecurseDir)
 		os.Exit(1)
 	}
+	loadSignKey()
+	loadLineFilters()
+	checkSortFlags()
+	checkNormalizeFlags()
+	checkValidateFlag()
+	checkBinaryFlags()
 	Log("Required cli flags present.", "debug")
 }
 
+// loadLineFilters compiles --include-re and --exclude-re.
+func loadLineFilters() {
+	includeRegexp = compileFlag("--include-re", IncludeRe)
+	excludeRegexp = compileFlag("--exclude-re", ExcludeRe)
+}
+
+// compileFlag compiles a regular expression flag - nil if it's blank.
+func compileFlag(flag, expr string) *regexp.Regexp {
+	if expr == "" {
+		return nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		fmt.Printf("Could not use %s: %v\n", flag, err)
+		os.Exit(1)
+	}
+	return re
+}
+
+// inDataError is the step of prepareInData that stopped the data - Result is
+// what the run ends with.
+type inDataError struct {
+	Result string
+	Err    error
+}
+
+func (e *inDataError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *inDataError) Unwrap() error {
+	return e.Err
+}
+
+// prepareInData puts data through in's steps in order - line endings and
+// Unicode, the filters and sorting, then the length, size and --validate
+// checks - and returns what would be saved. write saves the candidate for
+// --validate-exec and returns its path. The data is returned with the
+// inDataError of the first step that stops it. in and lint both use it, so
+// lint passes what in saves.
+func prepareInData(data string, write func(string) (string, error)) (string, error) {
+	// Line endings and Unicode are normalized before anything is compared.
+	data, err := normalizeInData(data)
+	if err != nil {
+		return data, &inDataError{"not_utf8", err}
+	}
+	data = filterInLines(data)
+	// Sorting also removes any blank lines.
+	data = sortInLines(data)
+	minLength, maxLength := lineLimits(false)
+	if !LengthCheck(data, minLength) {
+		return data, &inDataError{"not_long_enough", fmt.Errorf("%d lines is fewer than --length %d", LineCount(data), minLength)}
+	}
+	if err := SizeCheck(data, maxLength, MaxFileBytes); err != nil {
+		return data, &inDataError{"too_large", err}
+	}
+	file, err := write(data)
+	if err != nil {
+		return data, &inDataError{"write_file", err}
+	}
+	// Check the candidate before it goes anywhere near Consul.
+	if ValidateType != "" {
+		if err := ValidateContent(data, ValidateType); err != nil {
+			return data, &inDataError{"validate_failed", err}
+		}
+	}
+	if ValidateExec != "" {
+		if err := ValidateFile(ValidateExec, file); err != nil {
+			return data, &inDataError{"validate_failed", err}
+		}
+	}
+	return data, nil
+}
+
+// stopInData stops in with the step of prepareInData that didn't pass data -
+// compare is where it was writing the candidate.
+func stopInData(start time.Time, dog *datadog.Client, compare, data string, err error) {
+	var stopped *inDataError
+	if !errors.As(err, &stopped) {
+		ExitOnError(err, KeyInLocation, "prepare_data")
+	}
+	switch stopped.Result {
+	case "write_file":
+		ExitOnError(stopped.Err, compare, "write_file")
+	case "not_utf8":
+		Log(fmt.Sprintf("normalize='failed' message='%v' - stopping.", err), "info")
+		fmt.Printf("Not updating Consul: %v\n", err)
+	case "not_long_enough":
+		Log("File is NOT long enough. Stopping.", "info")
+		if DatadogAPIKey != "" && DatadogAPPKey != "" {
+			DDLengthEvent(dog, KeyInLocation, data)
+		}
+	case "too_large":
+		Log(fmt.Sprintf("File is too large: %v. Stopping.", err), "info")
+		StatsdTooLarge(KeyInLocation)
+		if DatadogAPIKey != "" && DatadogAPPKey != "" {
+			DDTooLargeEvent(dog, KeyInLocation, err.Error())
+		}
+	case "validate_failed":
+		Log(fmt.Sprintf("validate='failed' message='%v' - stopping.", err), "info")
+		fmt.Printf("Validation failed - not updating Consul: %v\n", err)
+		StatsdValidateFailed(KeyInLocation)
+	}
+	exitRun(ExitRejected, start, KeyInLocation, stopped.Result, "")
+}
+
+// filterInLines applies --include-re, --exclude-re and --strip-comments - if
+// none of them were passed the data is left as it is.
+func filterInLines(data string) string {
+	if includeRegexp == nil && excludeRegexp == nil && StripComments == "" {
+		return data
+	}
+	return FilterLines(data, includeRegexp, excludeRegexp, StripComments)
+}
+
+// sortInLines applies --sort or --sorted and --unique.
+func sortInLines(data string) string {
+	mode := SortMode
+	if mode == "" {
+		mode = "none"
+		if Sorted {
+			mode = "lexical"
+		}
+	}
+	return SortLines(data, mode, Unique)
+}
+
+// checkSortFlags makes sure --sort is one of the modes.
+func checkSortFlags() {
+	if SortMode == "" {
+		return
+	}
+	for _, mode := range sortModes {
+		if SortMode == mode {
+			return
+		}
+	}
+	fmt.Printf("--sort should be one of %s not '%s'\n", strings.Join(sortModes, ", "), SortMode)
+	os.Exit(1)
+}
+
+// checkValidateFlag makes sure --validate is a type ValidateContent knows.
+func checkValidateFlag() {
+	if ValidateType != "" && !ValidContentType(ValidateType) {
+		fmt.Printf("--validate should be one of %s not '%s'\n", strings.Join(contentTypes, ", "), ValidateType)
+		os.Exit(1)
+	}
+}
+
+// checkBinaryFlags makes sure nothing that works on lines is used with --binary.
+func checkBinaryFlags() {
+	if !Binary {
+		return
+	}
+	if Sorted || SortMode != "" || Unique || IncludeRe != "" || ExcludeRe != "" || StripComments != "" || ValidateType != "" || MaxChangeRatio > 0 || NormalizeEOL != "" || RequireUTF8 || NormalizeNFC {
+		fmt.Println("You cannot use --sorted, --sort, --unique, --include-re, --exclude-re, --strip-comments, --validate, --max-change-ratio, --normalize-eol, --utf8 or --nfc with --binary.")
+		os.Exit(1)
+	}
+}
+
+// loadSignKey loads --sign-key if it was passed.
+func loadSignKey() {
+	if SignKey != "" {
+		key, err := LoadSigningKey(SignKey)
+		if err != nil {
+			fmt.Printf("Could not load --sign-key: %v\n", err)
+			os.Exit(1)
+		}
+		signingKey = key
+	}
+}
+
 var (
 	// KeyInLocation is the key in the Consul KV data store where we want to store the data.
 	// This configuration variable will save data into:
@@ -207,12 +895,138 @@ var (
 
 	// UrltoRead is an HTTP URL to read data from using ReadURL().
 	UrltoRead string
+
+	// S3toRead is an s3://bucket/key object to read data from using ReadS3().
+	S3toRead string
+
+	// S3Region is the object's region - AWS_REGION if blank.
+	S3Region string
+
+	// S3Endpoint is an S3 compatible server to use instead of AWS.
+	S3Endpoint string
+
+	// SourceExec is a command whose stdout is the data.
+	SourceExec string
+
+	// URLHeaders are sent with the request to UrltoRead - "Name: value".
+	URLHeaders []string
+
+	// URLHeaderFile has more URLHeaders - one on each line - so a token
+	// isn't in `ps` or the cron logs.
+	URLHeaderFile string
+
+	// URLTimeout is how long to wait for UrltoRead - 0 for no limit.
+	URLTimeout time.Duration
+
+	// URLCACert is a CA file to verify UrltoRead's certificate.
+	URLCACert string
+
+	// URLInsecure doesn't verify UrltoRead's certificate.
+	URLInsecure bool
+
+	// URLProxy is the HTTP proxy for UrltoRead and S3 - --proxy if it's blank.
+	URLProxy string
+
+	// URLRetries is how many times to try UrltoRead.
+	URLRetries int
+
+	// URLCache sends UrltoRead's ETag and Last-Modified from the last run - a 304
+	// doesn't touch Consul.
+	URLCache bool
+
+	// ValidateExec is run against the candidate file before it's saved - if it
+	// exits non-zero nothing is written to Consul.
+	ValidateExec string
+
+	// ValidateType is json, yaml or csv - the data has to parse as it.
+	ValidateType string
+
+	// SignKey is an ed25519 private key used to sign the data.
+	SignKey string
+
+	// MaxChangeRatio stops the update if more than this fraction of the lines
+	// in the current data would be added or removed - 0 turns it off.
+	MaxChangeRatio float64
+
+	// signingKey is SignKey once it's been loaded.
+	signingKey ed25519.PrivateKey
+
+	// IncludeRe only keeps the lines that match it.
+	IncludeRe string
+
+	// ExcludeRe removes the lines that match it.
+	ExcludeRe string
+
+	// StripComments removes the lines that start with it - like '#'.
+	StripComments string
+
+	// includeRegexp and excludeRegexp are IncludeRe and ExcludeRe compiled.
+	includeRegexp, excludeRegexp *regexp.Regexp
+
+	// SortMode is none, lexical, numeric or version - blank uses Sorted.
+	SortMode string
+
+	// Unique removes the lines that are the same as one before them.
+	Unique bool
+
+	// AcquireSession makes this host the only one that can save the key - it
+	// owns it with a Consul session until it stops running in for SessionTTL.
+	AcquireSession bool
+
+	// SessionTTL is how long the --acquire-session ownership lasts without a run.
+	SessionTTL time.Duration
+
+	// LeaderElection only lets the host that holds the leader key save the
+	// data - the rest exit 0.
+	LeaderElection bool
+
+	// LeaderTTL is how long --leader-election leadership lasts without a run.
+	LeaderTTL time.Duration
 )
 
 func init() {
 	RootCmd.AddCommand(inCmd)
 	inCmd.Flags().StringVarP(&KeyInLocation, "key", "k", "", "key to push data to")
-	inCmd.Flags().StringVarP(&FiletoRead, "file", "f", "", "filename to read data from")
+	inCmd.Flags().StringVarP(&FiletoRead, "file", "f", "", "filename to read data from - or - for stdin")
 	inCmd.Flags().StringVarP(&UrltoRead, "url", "u", "", "url to read data from")
+	inCmd.Flags().StringVarP(&S3toRead, "s3", "", "", "s3://bucket/key to read data from")
+	inCmd.Flags().StringVarP(&S3Region, "s3-region", "", "", "region of the s3 bucket - AWS_REGION if blank")
+	inCmd.Flags().StringVarP(&S3Endpoint, "s3-endpoint", "", "", "S3 compatible server to use instead of AWS")
+	inCmd.Flags().BoolVarP(&Recurse, "recurse", "", false, "save every file in --dir to a key underneath -k")
+	inCmd.Flags().StringVarP(&RecurseDir, "dir", "", "", "directory to read the files from with --recurse")
+	inCmd.Flags().StringVarP(&SourceExec, "source-exec", "", "", "command whose stdout is the data")
+	inCmd.Flags().StringArrayVarP(&URLHeaders, "url-header", "", []string{}, "header to send with the url - 'Name: value' (repeatable)")
+	inCmd.Flags().StringVarP(&URLHeaderFile, "url-header-file", "", "", "file with a 'Name: value' header to send with the url on each line")
+	inCmd.Flags().DurationVarP(&URLTimeout, "url-timeout", "", 30*time.Second, "how long to wait for the url - 0 for no limit")
+	inCmd.Flags().StringVarP(&URLCACert, "url-ca-cert", "", "", "CA file to verify the url's certificate")
+	inCmd.Flags().BoolVarP(&URLInsecure, "url-insecure", "", false, "don't verify the url's certificate")
+	inCmd.Flags().StringVarP(&URLProxy, "url-proxy", "", "", "HTTP proxy for the url and S3 - --proxy if blank or direct for none")
+	inCmd.Flags().IntVarP(&URLRetries, "url-retries", "", 3, "times to try the url - 5xx and network errors are retried")
+	inCmd.Flags().BoolVarP(&URLCache, "url-cache", "", true, "send the url's ETag and Last-Modified from the last run - a 304 changes nothing")
 	inCmd.Flags().BoolVarP(&Sorted, "sorted", "S", false, "sort the input file")
+	inCmd.Flags().StringVarP(&SortMode, "sort", "", "", "how to sort the lines - none, lexical, numeric or version")
+	inCmd.Flags().BoolVarP(&Unique, "unique", "", false, "remove duplicate lines")
+	inCmd.Flags().StringVarP(&IncludeRe, "include-re", "", "", "only keep the lines that match this regular expression")
+	inCmd.Flags().StringVarP(&ExcludeRe, "exclude-re", "", "", "remove the lines that match this regular expression")
+	inCmd.Flags().StringVarP(&NormalizeEOL, "normalize-eol", "", "", "change every line ending to lf or crlf before the checksum")
+	inCmd.Flags().BoolVarP(&RequireUTF8, "utf8", "", false, "stop if the data isn't valid UTF-8")
+	inCmd.Flags().BoolVarP(&NormalizeNFC, "nfc", "", false, "normalize the data to Unicode NFC before the checksum - it has to be UTF-8")
+	inCmd.Flags().StringVarP(&StripComments, "strip-comments", "", "", "remove the lines that start with this - like '#'")
+	inCmd.Flags().StringVarP(&ValidateExec, "validate-exec", "", "", "command to check the file - gets the file as $1 and on stdin")
+	inCmd.Flags().StringVarP(&ValidateType, "validate", "", "", "check that the data is valid json, yaml or csv")
+	inCmd.Flags().StringVarP(&SignKey, "sign-key", "", "", "ed25519 private key to sign the data with")
+	inCmd.Flags().Float64VarP(&MaxChangeRatio, "max-change-ratio", "", 0, "stop if more than this fraction of the lines change - 0 is off")
+	inCmd.Flags().IntVarP(&HistoryKeep, "history", "", 10, "versions of the key to keep - 0 keeps none")
+	inCmd.Flags().BoolVarP(&AcquireSession, "acquire-session", "", false, "own the key with a Consul session so no other host can save it")
+	inCmd.Flags().DurationVarP(&SessionTTL, "session-ttl", "", time.Hour, "how long --acquire-session ownership lasts without a run")
+	inCmd.Flags().BoolVarP(&LeaderElection, "leader-election", "", false, "only save the data on the host that's the leader for the key")
+	inCmd.Flags().DurationVarP(&LeaderTTL, "leader-ttl", "", 60*time.Second, "how long --leader-election leadership lasts without a run")
+	inCmd.Flags().BoolVarP(&ContentAddressed, "content-addressed", "", false, "save the data at <key>/data/<checksum> and switch to it with a check-and-set")
+	inCmd.Flags().BoolVarP(&Delta, "delta", "", false, "save a base and a delta from it so only the lines that changed are written")
+	inCmd.Flags().Float64VarP(&DeltaCompact, "delta-compact", "", 0.1, "save a new base once the delta changes this fraction of its lines")
+	inCmd.Flags().StringVarP(&ActivateAt, "activate-at", "", "", "save the data in <key>/staged for out and watch to switch to at this RFC3339 time")
+	inCmd.Flags().BoolVarP(&InCanary, "canary", "", false, "save the data in <key>/canary for the hosts in out --canary-percent")
+	inCmd.Flags().BoolVarP(&InAppend, "append", "", false, "save the lines in <prefix>/_parts/<key>/<hostname> and merge every host's part into the key")
+	inCmd.Flags().DurationVarP(&PartTTL, "part-ttl", "", 0, "drop this host's lines from the merge if it doesn't run --append for this long - 0 keeps them")
+	inCmd.Flags().StringArrayVarP(&InTargets, "target", "", []string{}, "Consul cluster to save the data on instead of --server - name=server (repeatable)")
 }
@@ -0,0 +1,354 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/spf13/cobra"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+	"time"
+)
+
+var initCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Set up a new key with a manifest entry, cron line or systemd timer.",
+	Long:  `Init asks for the key, file, owner, mode and exec - then checks them against Consul with a dry run and prints a manifest entry, cron line or systemd timer to install.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		checkInitFlags()
+		AutoEnable()
+	},
+	Run: initRun,
+}
+
+func initRun(cmd *cobra.Command, args []string) {
+	start := time.Now()
+	answers, err := AskInit(bufio.NewReader(os.Stdin), os.Stderr, InitFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exitRun(1, start, "init", "bad_answer", "")
+	}
+	snippet, err := InitSnippet(InitFormat, answers, kvexpressPath())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exitRun(1, start, "init", "bad_snippet", "")
+	}
+
+	c, err := Connect(ConsulServer, Token)
+	if err != nil {
+		LogFatal("Could not connect to Consul.", answers.Entry.Key, "consul_connect")
+	}
+	problems := CheckInitAccess(c, answers.Entry, runInitDryRun)
+	for _, problem := range problems {
+		fmt.Fprintf(os.Stderr, "Problem: %s\n", problem)
+	}
+
+	if InitWrite != "" {
+		err = writeNewFile(InitWrite, snippet)
+		ExitOnError(err, InitWrite, "write_file")
+		fmt.Fprintf(os.Stderr, "Wrote '%s'.\n", InitWrite)
+	} else {
+		fmt.Print(snippet)
+	}
+	if len(problems) > 0 {
+		exitRun(ExitError, start, answers.Entry.Key, "init_problems", "")
+	}
+	RunTime(start, answers.Entry.Key, "complete")
+}
+
+// InitAnswers are what init asked for.
+type InitAnswers struct {
+	Entry ApplyEntry
+
+	// Schedule is the cron schedule or the systemd timer's interval.
+	Schedule string
+}
+
+// AskInit asks each question on in and out until it gets a good answer - a
+// blank answer takes the default in brackets.
+func AskInit(in *bufio.Reader, out io.Writer, format string) (InitAnswers, error) {
+	answers := InitAnswers{}
+	entry := &answers.Entry
+	questions := []initQuestion{
+		{"Direction - out writes a file, in saves one", "out", &entry.Direction, checkInitDirection},
+		{"Key", "", &entry.Key, checkInitRequired},
+		{"File", "", &entry.File, checkInitFile},
+		{"Owner", defaultInitOwner(), &entry.Owner, nil},
+		{"Mode", fmt.Sprintf("%04o", FilePermissions), &entry.Chmod, checkInitMode},
+		{"Command to run after the file changes", "", &entry.Exec, nil},
+	}
+	switch format {
+	case "cron":
+		questions = append(questions, initQuestion{"Cron schedule", "*/5 * * * *", &answers.Schedule, checkInitCron})
+	case "systemd":
+		questions = append(questions, initQuestion{"How often the timer runs", "5min", &answers.Schedule, checkInitRequired})
+	}
+	for _, question := range questions {
+		answer, err := askInit(in, out, question.prompt, question.def, question.check)
+		if err != nil {
+			return answers, err
+		}
+		*question.answer = answer
+	}
+	if name, _ := SplitOwner(entry.Owner); name != "" {
+		if _, err := user.Lookup(name); err != nil {
+			fmt.Fprintf(out, "'%s' isn't a user on this host - the file is owned by whoever runs kvexpress until it is.\n", name)
+		}
+	}
+	return answers, nil
+}
+
+// initQuestion is one of the questions init asks - check is nil when any
+// answer will do.
+type initQuestion struct {
+	prompt string
+	def    string
+	answer *string
+	check  func(string) error
+}
+
+// askInit asks a single question. It stops asking when in runs out.
+func askInit(in *bufio.Reader, out io.Writer, prompt, def string, check func(string) error) (string, error) {
+	for {
+		if def != "" {
+			fmt.Fprintf(out, "%s [%s]: ", prompt, def)
+		} else {
+			fmt.Fprintf(out, "%s: ", prompt)
+		}
+		line, readErr := in.ReadString('\n')
+		answer := strings.TrimSpace(line)
+		if answer == "" {
+			answer = def
+		}
+		var err error
+		if check != nil {
+			err = check(answer)
+		}
+		if err == nil {
+			return answer, nil
+		}
+		fmt.Fprintf(out, "  %v\n", err)
+		if readErr != nil {
+			return "", fmt.Errorf("%s: %v", prompt, err)
+		}
+	}
+}
+
+func checkInitRequired(answer string) error {
+	if answer == "" {
+		return errors.New("this can't be blank")
+	}
+	return nil
+}
+
+func checkInitDirection(answer string) error {
+	if answer != "out" && answer != "in" {
+		return errors.New("it needs to be out or in")
+	}
+	return nil
+}
+
+func checkInitFile(answer string) error {
+	if err := checkInitRequired(answer); err != nil {
+		return err
+	}
+	return CheckAllowedDir(answer)
+}
+
+func checkInitMode(answer string) error {
+	_, err := ParseFileMode(answer)
+	return err
+}
+
+func checkInitCron(answer string) error {
+	if len(strings.Fields(answer)) != 5 {
+		return errors.New("a cron schedule has 5 fields - like */5 * * * *")
+	}
+	return nil
+}
+
+// defaultInitOwner is --owner - or the user running init.
+func defaultInitOwner() string {
+	if Owner != "" {
+		return Owner
+	}
+	if current, err := user.Current(); err == nil {
+		return current.Username
+	}
+	return ""
+}
+
+// InitSnippet is the manifest entry, cron line or systemd units for answers.
+// A manifest entry is checked by parsing it the same way apply does.
+func InitSnippet(format string, answers InitAnswers, kvexpress string) (string, error) {
+	entry := answers.Entry
+	args := []string{kvexpress, entry.Direction}
+	if ConfigFile != "" {
+		args = append(args, "--config", ConfigFile)
+	}
+	command := shellJoin(append(args, entry.Args()...))
+	name := "kvexpress-" + strings.Replace(strings.Trim(entry.Key, "/"), "/", "-", -1)
+	switch format {
+	case "cron":
+		// A % ends the command in a crontab.
+		command = strings.Replace(command, "%", `\%`, -1)
+		return fmt.Sprintf("# /etc/cron.d/%s\n%s root %s\n", name, answers.Schedule, command), nil
+	case "systemd":
+		// A % is a specifier in a unit file.
+		command = strings.Replace(command, "%", "%%", -1)
+		return fmt.Sprintf(initSystemdUnits, name, entry.Direction, entry.Key, entry.File, command, name, answers.Schedule, answers.Schedule), nil
+	}
+	snippet := "---\nentries:\n"
+	fields := [][2]string{{"direction", entry.Direction}, {"key", entry.Key}, {"file", entry.File}, {"owner", entry.Owner}, {"chmod", entry.Chmod}, {"exec", entry.Exec}}
+	for i, field := range fields {
+		if field[1] == "" {
+			continue
+		}
+		indent := "    "
+		if i == 0 {
+			indent = "  - "
+		}
+		snippet += fmt.Sprintf("%s%s: %q\n", indent, field[0], field[1])
+	}
+	if _, err := ParseManifest([]byte(snippet)); err != nil {
+		return "", fmt.Errorf("the manifest entry isn't valid: %v", err)
+	}
+	return snippet, nil
+}
+
+// initSystemdUnits are the service and timer - SuccessExitStatus=3 because
+// nothing changing isn't a failure.
+const initSystemdUnits = `# /etc/systemd/system/%s.service
+[Unit]
+Description=kvexpress %s -k %s -f %s
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=oneshot
+ExecStart=%s
+SuccessExitStatus=3
+
+# /etc/systemd/system/%s.timer
+[Unit]
+Description=Run kvexpress every %s
+
+[Timer]
+OnBootSec=1min
+OnUnitActiveSec=%s
+RandomizedDelaySec=30s
+
+[Install]
+WantedBy=timers.target
+`
+
+// shellJoin quotes the arguments that need it for a shell.
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = arg
+		if arg == "" || strings.ContainsAny(arg, " \t\n'\"\\$`&|;<>()*?[]#~!{}") {
+			quoted[i] = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// CheckInitAccess makes sure the entry will work - it runs it with --dry-run
+// and, for an in, checks the token can write the key without writing it. The
+// problems it found are returned.
+func CheckInitAccess(c *consul.Client, entry ApplyEntry, dryRun func([]string) int) []string {
+	var problems []string
+	checksumKey := KeyPath(entry.Key, "checksum")
+	checksum, err := Get(c, checksumKey)
+	switch {
+	case err != nil:
+		problems = append(problems, fmt.Sprintf("could not read '%s': %v", checksumKey, err))
+	case checksum == "" && entry.Direction == "out":
+		problems = append(problems, fmt.Sprintf("there's no data in '%s' yet - out exits 1 until it's saved", entry.Key))
+	}
+	if entry.Direction == "in" {
+		if err := checkWriteAccess(c, checksumKey); err != nil {
+			problems = append(problems, fmt.Sprintf("could not write '%s': %v", checksumKey, err))
+		}
+	}
+	args := append([]string{entry.Direction, "--dry-run"}, ApplyGlobalArgs(RootCmd.PersistentFlags())...)
+	if code := dryRun(append(args, entry.Args()...)); !Succeeded(code) {
+		problems = append(problems, fmt.Sprintf("the dry run exited %d", code))
+	}
+	return problems
+}
+
+// checkWriteAccess is a check-and-set of key with an index it can't have - so
+// nothing is written but Consul still checks the token can write it.
+func checkWriteAccess(c *consul.Client, key string) error {
+	if !consulBackend() {
+		return nil
+	}
+	_, _, err := c.KV().CAS(&consul.KVPair{Key: strings.TrimPrefix(key, "/"), ModifyIndex: math.MaxUint64}, nil)
+	return err
+}
+
+// runInitDryRun runs kvexpress again with args - its output goes to stderr
+// with the questions.
+func runInitDryRun(args []string) int {
+	fmt.Fprintf(os.Stderr, "Dry run: %s\n", shellJoin(args))
+	command := exec.CommandContext(RunContext(), kvexpressPath(), args...)
+	// The secrets aren't in args - so they aren't printed either.
+	command.Env = append(os.Environ(), ApplyGlobalEnv(RootCmd.PersistentFlags())...)
+	command.Stdout, command.Stderr = os.Stderr, os.Stderr
+	return ProcessExitCode(command.Run())
+}
+
+// kvexpressPath is the kvexpress that's running.
+func kvexpressPath() string {
+	self, err := os.Executable()
+	if err != nil {
+		return os.Args[0]
+	}
+	return self
+}
+
+// writeNewFile writes data to file - but never over a file that's already
+// there.
+func writeNewFile(file, data string) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func checkInitFlags() {
+	Log("Checking cli flags.", "debug")
+	if InitFormat != "manifest" && InitFormat != "cron" && InitFormat != "systemd" {
+		fmt.Println("Need a --format of manifest, cron or systemd")
+		os.Exit(1)
+	}
+	Log("Required cli flags present.", "debug")
+}
+
+var (
+	// InitFormat is what init writes - a manifest entry, a cron line or systemd units.
+	InitFormat string
+
+	// InitWrite is the file init writes to - stdout if it's blank.
+	InitWrite string
+)
+
+func init() {
+	RootCmd.AddCommand(initCmd)
+	initCmd.Flags().StringVarP(&InitFormat, "format", "", "manifest", "what to write: manifest, cron or systemd")
+	initCmd.Flags().StringVarP(&InitWrite, "write", "w", "", "new file to write it to - stdout if blank")
+}
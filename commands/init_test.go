@@ -0,0 +1,80 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestAskInit(t *testing.T) {
+	Owner = "root"
+	defer func() { Owner = "" }()
+	FilePermissions = 0640
+	var out bytes.Buffer
+	in := bufio.NewReader(strings.NewReader("\nhosts\n/etc/hosts.consul\n\nrwx\n0644\nsudo pkill -HUP dnsmasq\n\n"))
+	answers, err := AskInit(in, &out, "cron")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := answers.Entry
+	if entry.Direction != "out" || entry.Key != "hosts" || entry.File != "/etc/hosts.consul" || entry.Owner != "root" || entry.Chmod != "0644" || entry.Exec != "sudo pkill -HUP dnsmasq" || answers.Schedule != "*/5 * * * *" {
+		t.Errorf("The answers weren't saved: %+v", answers)
+	}
+	if strings.Count(out.String(), "Mode [0640]") != 2 {
+		t.Errorf("A bad mode should be asked again: %s", out.String())
+	}
+	if _, err := AskInit(bufio.NewReader(strings.NewReader("out\n\n")), &out, "manifest"); err == nil {
+		t.Error("Running out of answers without a key should be an error.")
+	}
+}
+
+func TestInitSnippet(t *testing.T) {
+	answers := InitAnswers{Entry: ApplyEntry{Direction: "out", Key: "apps/web", File: "/etc/web.conf", Chmod: "0644", Exec: "echo 'it's 100% done'"}, Schedule: "*/5 * * * *"}
+	manifest, err := InitSnippet("manifest", answers, "/usr/local/bin/kvexpress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ParseManifest([]byte(manifest))
+	if err != nil || len(entries) != 1 || entries[0].Exec != answers.Entry.Exec || entries[0].Chmod != "0644" {
+		t.Errorf("The manifest entry should be read back the same: %+v %v\n%s", entries, err, manifest)
+	}
+	cron, _ := InitSnippet("cron", answers, "/usr/local/bin/kvexpress")
+	if !strings.Contains(cron, "/etc/cron.d/kvexpress-apps-web") || !strings.Contains(cron, `*/5 * * * * root /usr/local/bin/kvexpress out -k apps/web -f /etc/web.conf -c 0644 -e 'echo '\''it'\''s 100\% done'\''`) {
+		t.Errorf("The cron line is wrong:\n%s", cron)
+	}
+	systemd, _ := InitSnippet("systemd", InitAnswers{Entry: answers.Entry, Schedule: "10min"}, "/usr/local/bin/kvexpress")
+	if !strings.Contains(systemd, "100%% done") || !strings.Contains(systemd, "OnUnitActiveSec=10min") || !strings.Contains(systemd, "SuccessExitStatus=3") {
+		t.Errorf("The systemd units are wrong:\n%s", systemd)
+	}
+}
+
+func TestCheckInitAccess(t *testing.T) {
+	PrefixLocation = "testing"
+	tc, c := newTestConsul(t)
+	var ran []string
+	dryRun := func(args []string) int {
+		ran = args
+		return ExitWrote
+	}
+	entry := ApplyEntry{Direction: "out", Key: "hosts", File: "/etc/hosts.consul"}
+	if problems := CheckInitAccess(c, entry, dryRun); len(problems) != 1 || !strings.Contains(problems[0], "no data") {
+		t.Errorf("A key without data should be a problem for out: %v", problems)
+	}
+	if ran[0] != "out" || ran[1] != "--dry-run" {
+		t.Errorf("The entry should be run with --dry-run: %v", ran)
+	}
+	tc.put("testing/hosts/checksum", exampleDataSHA)
+	if problems := CheckInitAccess(c, entry, dryRun); len(problems) != 0 {
+		t.Errorf("There shouldn't be any problems: %v", problems)
+	}
+	entry.Direction = "in"
+	if problems := CheckInitAccess(c, entry, func([]string) int { return ExitRejected }); len(problems) != 1 || !strings.Contains(problems[0], "exited 8") {
+		t.Errorf("A dry run that failed should be a problem: %v", problems)
+	}
+	if value, _ := tc.value("testing/hosts/checksum"); value != exampleDataSHA {
+		t.Error("Checking the token can write shouldn't write anything.")
+	}
+}
@@ -0,0 +1,68 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"strings"
+)
+
+var (
+	// KeyFallback are the keys out tries in order - the first one with good
+	// data is written. %h is the hostname and %r is HostRole.
+	KeyFallback string
+
+	// HostRole is this host's role for %r in KeyFallback.
+	HostRole string
+
+	// keyFallback is KeyFallback once it's been split and expanded.
+	keyFallback []string
+)
+
+// ExpandKeyFallback splits the comma separated keys and replaces %h with the
+// hostname and %r with role.
+func ExpandKeyFallback(fallback, hostname, role string) ([]string, error) {
+	var keys []string
+	for _, key := range strings.Split(fallback, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		if strings.Contains(key, "%r") && role == "" {
+			return nil, fmt.Errorf("'%s' needs a --role for %%r", key)
+		}
+		keys = append(keys, strings.NewReplacer("%h", hostname, "%r", role).Replace(key))
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("there aren't any keys in '%s'", fallback)
+	}
+	return keys, nil
+}
+
+// ResolveKeyFallback returns the first key that has data that's long enough,
+// matches its checksum, is signed with --verify-key and passes --validate. A
+// key that's missing or bad is skipped - but Consul giving up isn't, so a
+// host never falls back to the default because Consul was down. If none of
+// them are good the error is returned with the last key.
+func ResolveKeyFallback(c *consul.Client, keys []string) (string, error) {
+	for _, key := range keys {
+		data, err := ComposeKeys(c, []string{key}, "")
+		if errors.Is(err, ErrNoMoreRetries) {
+			return key, err
+		}
+		if err == nil && data == "" {
+			err = fmt.Errorf("there's no data in '%s'", key)
+		}
+		if err == nil && ValidateType != "" {
+			err = ValidateContent(data, ValidateType)
+		}
+		if err == nil {
+			Log(fmt.Sprintf("fallback key='%s' resolved='true'", key), "info")
+			return key, nil
+		}
+		Log(fmt.Sprintf("fallback key='%s' resolved='false' message='%v'", key, err), "info")
+	}
+	return keys[len(keys)-1], fmt.Errorf("none of the keys in --key-fallback have good data: %s", strings.Join(keys, ", "))
+}
@@ -0,0 +1,43 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandKeyFallback(t *testing.T) {
+	keys, err := ExpandKeyFallback("apps/%h/config, apps/%r/config,apps/default/config", "web-1", "web")
+	if err != nil || strings.Join(keys, ",") != "apps/web-1/config,apps/web/config,apps/default/config" {
+		t.Errorf("The hostname and role should be put in the keys: %v %v", keys, err)
+	}
+	if _, err := ExpandKeyFallback("apps/%r/config,apps/default/config", "web-1", ""); err == nil {
+		t.Error("%r without a role should be an error.")
+	}
+	if _, err := ExpandKeyFallback(" , ", "web-1", ""); err == nil {
+		t.Error("A fallback without any keys should be an error.")
+	}
+}
+
+func TestResolveKeyFallback(t *testing.T) {
+	PrefixLocation = "testing"
+	tc, c := newTestConsul(t)
+	keys := []string{"apps/web-1/config", "apps/web/config", "apps/default/config"}
+	// The host's key is bad and there's nothing for the role.
+	tc.put("testing/apps/web-1/config/data", exampleData)
+	tc.put("testing/apps/web-1/config/checksum", "not-the-checksum")
+	tc.put("testing/apps/default/config/data", exampleData)
+	tc.put("testing/apps/default/config/checksum", exampleDataSHA)
+	if key, err := ResolveKeyFallback(c, keys); err != nil || key != "apps/default/config" {
+		t.Errorf("The first key with good data should be used: '%s' %v", key, err)
+	}
+	tc.put("testing/apps/web/config/data", exampleData)
+	tc.put("testing/apps/web/config/checksum", exampleDataSHA)
+	if key, _ := ResolveKeyFallback(c, keys); key != "apps/web/config" {
+		t.Errorf("The role's key comes before the default: '%s'", key)
+	}
+	if key, err := ResolveKeyFallback(c, keys[:1]); err == nil || key != "apps/web-1/config" {
+		t.Errorf("It's an error when none of the keys are good: '%s' %v", key, err)
+	}
+}
@@ -1,26 +1,167 @@
-// +build linux darwin freebsd
+// +build linux darwin freebsd windows
 
 package commands
 
 import (
-	"crypto/sha256"
+	"bytes"
 	"fmt"
+	"github.com/DataDog/kvexpress/pkg/kvexpress"
 	"strings"
+	"text/template"
 )
 
-// KeyPath returns the standard kvexpress paths for data, checksum and stop.
+// DefaultKeyTemplate is the standard layout - prefix/key/data.
+const DefaultKeyTemplate = "{{.Prefix}}/{{.Key}}/{{.Part}}"
+
+// keyTemplate is --key-template once it's parsed - nil is the standard layout.
+var keyTemplate *template.Template
+
+// keyMarker and partMarker stand in for the key and the part when a layout
+// is worked out backwards.
+const (
+	keyMarker  = "\x00"
+	partMarker = "\x01"
+)
+
+// KeyParts are what --key-template is given - Prefix doesn't have a leading slash.
+type KeyParts struct {
+	Prefix string
+	Key    string
+	Part   string
+}
+
+// SetupKeyTemplate parses --key-template. Every key has to have its own
+// paths for each part and the key can only be in the path once - otherwise
+// the keys underneath a key can't be found.
+func SetupKeyTemplate() error {
+	keyTemplate = nil
+	if KeyTemplate == "" || KeyTemplate == DefaultKeyTemplate {
+		return nil
+	}
+	tmpl, err := template.New("key").Option("missingkey=error").Parse(KeyTemplate)
+	if err != nil {
+		return fmt.Errorf("could not parse --key-template: %v", err)
+	}
+	keyTemplate = tmpl
+	path, err := keyPath(keyMarker, partMarker)
+	if err != nil {
+		keyTemplate = nil
+		return fmt.Errorf("could not use --key-template: %v", err)
+	}
+	if strings.Count(path, keyMarker) != 1 || strings.Count(path, partMarker) != 1 {
+		keyTemplate = nil
+		return fmt.Errorf("--key-template '%s' needs {{.Key}} and {{.Part}} once each", KeyTemplate)
+	}
+	return nil
+}
+
+// KeyPath returns the kvexpress paths for data, checksum and stop - with
+// --key-template if there is one.
 func KeyPath(key string, suffix string) string {
-	fullPath := fmt.Sprintf("%s/%s/%s", strings.TrimPrefix(PrefixLocation, "/"), key, suffix)
+	fullPath, err := keyPath(key, suffix)
+	if err != nil {
+		// SetupKeyTemplate already ran it - this is only a template that
+		// fails for some keys.
+		Log(fmt.Sprintf("path='%s' key='%s' message='%v'", suffix, key, err), "info")
+	}
 	Log(fmt.Sprintf("path='%s' fullPath='%s'", suffix, fullPath), "debug")
 	return fullPath
 }
 
+// keyPath runs the key template.
+func keyPath(key, part string) (string, error) {
+	prefix := strings.TrimPrefix(PrefixLocation, "/")
+	if keyTemplate == nil {
+		return fmt.Sprintf("%s/%s/%s", prefix, key, part), nil
+	}
+	var path bytes.Buffer
+	err := keyTemplate.Execute(&path, KeyParts{Prefix: prefix, Key: key, Part: part})
+	return strings.TrimPrefix(path.String(), "/"), err
+}
+
+// KeyRoot is the path every part of key is underneath - prefix/key/ with the
+// standard layout. It's what's watched for a change to the key.
+func KeyRoot(key string) string {
+	before := partBounds(key).before
+	return before[:strings.LastIndex(before, "/")+1]
+}
+
+// partBounds is what's before and after the part in the paths of key.
+func partBounds(key string) keyBounds {
+	bounds := strings.SplitN(KeyPath(key, partMarker), partMarker, 2)
+	if len(bounds) != 2 {
+		return keyBounds{before: bounds[0]}
+	}
+	return keyBounds{bounds[0], bounds[1]}
+}
+
+// keyBounds is what's before and after a key's name in the path of one part.
+type keyBounds struct {
+	before, after string
+}
+
+// keyLayout is where the names are in the paths of parts for the keys
+// underneath key - blank key is every key under the prefix.
+func keyLayout(key string, parts ...string) []keyBounds {
+	name := keyMarker
+	if key = strings.Trim(key, "/"); key != "" {
+		name = key + "/" + keyMarker
+	}
+	var layout []keyBounds
+	for _, part := range parts {
+		bounds := strings.SplitN(KeyPath(name, part), keyMarker, 2)
+		if len(bounds) == 2 {
+			layout = append(layout, keyBounds{bounds[0], bounds[1]})
+		}
+	}
+	return layout
+}
+
+// keyName returns the name of the key that path is one of the parts of.
+func keyName(layout []keyBounds, path string) (string, bool) {
+	for _, bounds := range layout {
+		if len(path) > len(bounds.before)+len(bounds.after) && strings.HasPrefix(path, bounds.before) && strings.HasSuffix(path, bounds.after) {
+			return path[len(bounds.before) : len(path)-len(bounds.after)], true
+		}
+	}
+	return "", false
+}
+
+// keyRoot is the prefix to list to find every key in layout - what the paths
+// of the parts have in common up to a slash.
+func keyRoot(layout []keyBounds) string {
+	if len(layout) == 0 {
+		return ""
+	}
+	root := layout[0].before
+	for _, bounds := range layout[1:] {
+		i := 0
+		for i < len(root) && i < len(bounds.before) && root[i] == bounds.before[i] {
+			i++
+		}
+		root = root[:i]
+	}
+	return root[:strings.LastIndex(root, "/")+1]
+}
+
+// hostKeyRoot is where every host saves what it has for key under kind -
+// <prefix>/_<kind>/<key>/. It's outside KeyRoot, so a host saving one doesn't
+// wake every out and watch of the key.
+func hostKeyRoot(kind, key string) string {
+	return strings.TrimPrefix(fmt.Sprintf("%s/_%s/%s/", strings.Trim(PrefixLocation, "/"), kind, strings.Trim(key, "/")), "/")
+}
+
 // FileLockPath generates the path for the KV store for a particular file.
 func FileLockPath(file string) string {
-	hostname := GetHostname()
-	fileSHA := sha256.Sum256([]byte(file))
-	fileSHAs := fmt.Sprintf("%x", fileSHA)
-	path := fmt.Sprintf("%s/locks/%s/%s", strings.TrimPrefix(PrefixLocation, "/"), fileSHAs, hostname)
+	path := kvexpress.FileLockPath(PrefixLocation, GetHostname(), file)
 	Log(fmt.Sprintf("path='%s'", path), "debug")
 	return path
 }
+
+// StopKeyPath returns the stop key for key - or stopKey if one was passed.
+func StopKeyPath(key, stopKey string) string {
+	if stopKey != "" {
+		return strings.TrimPrefix(stopKey, "/")
+	}
+	return KeyPath(key, "stop")
+}
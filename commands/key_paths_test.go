@@ -26,3 +26,85 @@ func TestFileLockPath(t *testing.T) {
 		t.Error("Got the wrong lock path.")
 	}
 }
+
+func TestStopKeyPath(t *testing.T) {
+	PrefixLocation = "testing"
+	if path := StopKeyPath("keyname", ""); path != "testing/keyname/stop" {
+		t.Errorf("Got the wrong default stop key: '%s'", path)
+	}
+	if path := StopKeyPath("keyname", "/testing/fleet/stop"); path != "testing/fleet/stop" {
+		t.Errorf("Got the wrong stop key: '%s'", path)
+	}
+}
+
+func TestKeyTemplate(t *testing.T) {
+	PrefixLocation = "testing"
+	defer func() { KeyTemplate = DefaultKeyTemplate; SetupKeyTemplate() }()
+
+	for _, bad := range []string{"{{.Prefix}}/{{.Key}}", "{{.Prefix}}/{{.Key}}/{{.Part}}/{{.Key}}", "{{.Nope}}", "{{.Key"} {
+		KeyTemplate = bad
+		if err := SetupKeyTemplate(); err == nil {
+			t.Errorf("'%s' shouldn't be a key template.", bad)
+		}
+	}
+	KeyTemplate = `{{.Prefix}}/{{if eq .Part "data"}}value{{else}}{{.Part}}{{end}}/{{.Key}}`
+	if err := SetupKeyTemplate(); err != nil {
+		t.Fatal(err)
+	}
+	if path := KeyPath("apps/hosts", "data"); path != "testing/value/apps/hosts" {
+		t.Errorf("Got the wrong data path: '%s'", path)
+	}
+	if path := KeyPath("apps/hosts", "checksum"); path != "testing/checksum/apps/hosts" {
+		t.Errorf("Got the wrong checksum path: '%s'", path)
+	}
+	if root := KeyRoot("apps/hosts"); root != "testing/" {
+		t.Errorf("Every part is underneath the prefix: '%s'", root)
+	}
+
+	tc, c := newTestConsul(t)
+	tc.put("testing/value/apps/hosts", exampleData)
+	tc.put("testing/value/apps/web/nginx", exampleData)
+	tc.put("testing/checksum/apps/hosts", exampleDataSHA)
+	tc.put("testing/value/other", exampleData)
+	names, err := TreeKeys(c, "apps")
+	if err != nil || fmt.Sprint(names) != "[hosts web/nginx]" {
+		t.Errorf("The keys should be found with the template: %v %v", names, err)
+	}
+	if err := removeKey(c, "apps/hosts"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tc.value("testing/checksum/apps/hosts"); ok {
+		t.Error("Every part of the key should be removed.")
+	}
+	if _, ok := tc.value("testing/value/apps/web/nginx"); !ok {
+		t.Error("A key underneath it should be kept.")
+	}
+}
+
+func TestRemoveKeySiblings(t *testing.T) {
+	PrefixLocation = "testing"
+	defer func() { KeyTemplate = DefaultKeyTemplate; SetupKeyTemplate() }()
+	KeyTemplate = "{{.Prefix}}/{{.Key}}.{{.Part}}"
+	if err := SetupKeyTemplate(); err != nil {
+		t.Fatal(err)
+	}
+	tc, c := newTestConsul(t)
+	tc.put("testing/hosts.data", exampleData)
+	tc.put("testing/hosts.data/0", exampleData)
+	tc.put("testing/hosts.checksum", exampleDataSHA)
+	tc.put("testing/hosts.d.data", exampleData)
+	tc.put("testing/hosts.d.checksum", exampleDataSHA)
+	if err := removeKey(c, "hosts"); err != nil {
+		t.Fatal(err)
+	}
+	for _, gone := range []string{"testing/hosts.data", "testing/hosts.data/0", "testing/hosts.checksum"} {
+		if _, ok := tc.value(gone); ok {
+			t.Errorf("'%s' should be removed.", gone)
+		}
+	}
+	for _, kept := range []string{"testing/hosts.d.data", "testing/hosts.d.checksum"} {
+		if _, ok := tc.value(kept); !ok {
+			t.Errorf("'%s' belongs to hosts.d and should be kept.", kept)
+		}
+	}
+}
@@ -1,15 +1,20 @@
-// +build linux darwin freebsd
+// +build linux darwin freebsd windows
 
 package commands
 
 import (
 	"bytes"
-	"crypto/sha256"
+	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"net/http"
+	"github.com/DataDog/kvexpress/pkg/kvexpress"
+	consul "github.com/hashicorp/consul/api"
+	"os"
 	"os/exec"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 func init() {
@@ -26,21 +31,51 @@ func LengthCheck(data string, minLength int) bool {
 	return false
 }
 
-// ReadURL grabs a URL and returns the string from the body.
-func ReadURL(url string) string {
-	resp, err := http.Get(url)
-	if err != nil {
-		Log(fmt.Sprintf("function='ReadURL' panic='true' url='%s'", url), "info")
-		fmt.Printf("Panic: Could not open URL: '%s'\n", url)
-		StatsdPanic(url, "read_url")
+// ErrTooLarge is returned when the data has more lines or bytes than
+// --max-length or --max-bytes.
+var ErrTooLarge = errors.New("too large")
+
+// SizeCheck makes sure data has at most maxLength lines and maxBytes bytes -
+// 0 turns either check off.
+func SizeCheck(data string, maxLength, maxBytes int) error {
+	length := LineCount(data)
+	Log(fmt.Sprintf("length='%d' maxLength='%d' bytes='%d' maxBytes='%d'", length, maxLength, len(data), maxBytes), "debug")
+	if maxLength > 0 && length > maxLength {
+		return fmt.Errorf("%w - %d lines is more than %d", ErrTooLarge, length, maxLength)
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		Log(fmt.Sprintf("ReadURL(): Error reading '%s'", url), "info")
-		return fmt.Sprintf("There was an error reading the body of the url: %s", url)
+	if maxBytes > 0 && len(data) > maxBytes {
+		return fmt.Errorf("%w - %d bytes is more than %d", ErrTooLarge, len(data), maxBytes)
 	}
-	return string(body)
+	return nil
+}
+
+// ChangeRatio returns how many lines were added and removed going from old to
+// new - as a fraction of the lines in old. Moved lines aren't counted. There's
+// nothing to compare against when old is empty, so that's 0.
+func ChangeRatio(old, new string) float64 {
+	if old == "" {
+		return 0
+	}
+	counts := make(map[string]int)
+	oldLines := strings.Split(strings.TrimSuffix(old, "\n"), "\n")
+	for _, line := range oldLines {
+		counts[line]++
+	}
+	var added int
+	for _, line := range strings.Split(strings.TrimSuffix(new, "\n"), "\n") {
+		if counts[line] > 0 {
+			counts[line]--
+		} else {
+			added++
+		}
+	}
+	var removed int
+	for _, count := range counts {
+		removed += count
+	}
+	ratio := float64(added+removed) / float64(len(oldLines))
+	Log(fmt.Sprintf("added='%d' removed='%d' ratio='%.3f'", added, removed, ratio), "debug")
+	return ratio
 }
 
 // LineCount splits a string by linebreak and returns the number of lines.
@@ -56,9 +91,7 @@ func LineCount(data string) int {
 
 // ComputeChecksum takes a string and computes a SHA256 checksum.
 func ComputeChecksum(data string) string {
-	dataBytes := []byte(data)
-	computedChecksum := sha256.Sum256(dataBytes)
-	finalChecksum := fmt.Sprintf("%x", computedChecksum)
+	finalChecksum := kvexpress.Checksum(data)
 	Log(fmt.Sprintf("computedChecksum='%s'", finalChecksum), "debug")
 	if finalChecksum == "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
 		Log("WARNING: That checksum means the data/key is blank. WARNING", "info")
@@ -66,20 +99,21 @@ func ComputeChecksum(data string) string {
 	return finalChecksum
 }
 
-// ChecksumCompare takes a string, generates a SHA256 checksum and compares
-// against the passed checksum to see if they match.
+// ChecksumCompare takes a string, generates a checksum with the same algorithm
+// as the passed checksum and compares them to see if they match.
 func ChecksumCompare(data string, checksum string) bool {
-	computedChecksum := ComputeChecksum(data)
+	span := StartSpan("checksum.compare", "kvexpress.bytes", strconv.Itoa(len(data)))
+	computedChecksum := ChecksumAs(data, checksum)
 	Log(fmt.Sprintf("checksum='%s' computedChecksum='%s'", checksum, computedChecksum), "debug")
-	if strings.TrimSpace(computedChecksum) == strings.TrimSpace(checksum) {
-		return true
-	}
-	return false
+	matches := strings.TrimSpace(computedChecksum) == strings.TrimSpace(checksum)
+	span.SetAttribute("kvexpress.matches", strconv.FormatBool(matches))
+	span.Finish(nil)
+	return matches
 }
 
 // UnixDiff runs diff to generate text for the Datadog events.
 func UnixDiff(old, new string) string {
-	diff, _ := exec.Command("diff", "-u", old, new).Output()
+	diff, _ := exec.CommandContext(RunContext(), "diff", "-u", old, new).Output()
 	text := string(diff)
 	finalText := removeLines(text, 3)
 	return finalText
@@ -94,20 +128,239 @@ func removeLines(text string, number int) string {
 	return finalText
 }
 
-// RunCommand runs a cli command with arguments.
-func RunCommand(command string) bool {
+const (
+	// ExecNotFound is the exit code when the command to run doesn't exist.
+	ExecNotFound = 127
+
+	// ExecNotExecutable is the exit code when the command can't be executed.
+	ExecNotExecutable = 126
+
+	// ExecTimedOut is the exit code when the command ran longer than
+	// --exec-timeout - the same one timeout(1) uses.
+	ExecTimedOut = 124
+
+	// execOutputMax is how much of the command's output is logged and sent to Datadog.
+	execOutputMax = 4096
+
+	// execWaitDelay is how long a command that was killed - or that exited -
+	// can keep its output open. A child it started that still has stdout
+	// would block Wait forever.
+	execWaitDelay = 5 * time.Second
+)
+
+// RunCommand runs a cli command with arguments. It returns 0 on success,
+// ExecNotFound or ExecNotExecutable if the command couldn't be started,
+// ExecTimedOut if it took longer than --exec-timeout and the command's own
+// exit code if it ran but failed. The output of a failed command is logged and
+// sent as a Datadog event.
+func RunCommand(command string) int {
+	return RunCommandEnv(command, nil)
+}
+
+// RunCommandEnv is RunCommand with env added to the command's environment.
+func RunCommandEnv(command string, env []string) int {
+	return runCommandContext(RunContext(), command, env, ExecTimeout)
+}
+
+// runCommandContext is RunCommandEnv with the command killed when ctx is done
+// or after timeout.
+func runCommandContext(ctx context.Context, command string, env []string, timeout time.Duration) int {
 	parts := strings.Fields(command)
+	if len(parts) == 0 {
+		Log("exec='error' message='blank command'", "info")
+		return ExecNotFound
+	}
+	if DryRunSkip(fmt.Sprintf("exec '%s'", command)) {
+		return 0
+	}
 	cli := parts[0]
-	args := parts[1:len(parts)]
-	cmd := exec.Command(cli, args...)
+	span := StartSpan("exec", "kvexpress.command", cli)
+	status, output := execCommandContext(ctx, parts, timeout, true, env...)
+	Audit(AuditRecord{Event: AuditExec, Exec: command, ExitStatus: status})
+	span.SetAttribute("kvexpress.exit_code", strconv.Itoa(status))
+	if status != 0 {
+		span.Finish(fmt.Errorf("'%s' exited %d", cli, status))
+	} else {
+		span.Finish(nil)
+	}
+	// Keep each log entry on a single line.
+	logged := strings.Replace(output, "\n", `\n`, -1)
+	switch status {
+	case 0:
+		return 0
+	case ExecNotFound:
+		Log(fmt.Sprintf("exec='not_found' command='%s' message='The command does not exist or is not in the PATH.'", cli), "info")
+		StatsdExecNotFound(cli)
+	case ExecNotExecutable:
+		Log(fmt.Sprintf("exec='not_executable' command='%s' message='%s'", cli, logged), "info")
+		StatsdExecNotFound(cli)
+	case ExecTimedOut:
+		Log(fmt.Sprintf("exec='timed_out' command='%s' timeout='%s' output='%s'", cli, timeout, logged), "info")
+		StatsdExecFailed(cli, status)
+	default:
+		Log(fmt.Sprintf("exec='error' command='%s' status='%d' output='%s'", cli, status, logged), "info")
+		StatsdExecFailed(cli, status)
+	}
+	if DatadogAPIKey != "" && DatadogAPPKey != "" {
+		DDExecFailedEvent(DDAPIConnect(DatadogAPIKey, DatadogAPPKey), command, status, output)
+	}
+	return status
+}
+
+// execCommand runs the command and returns its exit code and combined output.
+// It's killed after timeout - unless timeout is 0. env is added to
+// kvexpress's own environment, or the clean one with --run-as.
+func execCommand(parts []string, timeout time.Duration, env ...string) (int, string) {
+	return execCommandAs(parts, timeout, false, env...)
+}
+
+// execCommandAs is execCommand that runs the command as --run-as if runAs is
+// true. A check has to read the temp file so it runs as kvexpress.
+func execCommandAs(parts []string, timeout time.Duration, runAs bool, env ...string) (int, string) {
+	return execCommandContext(RunContext(), parts, timeout, runAs, env...)
+}
+
+// execCommandContext is execCommandAs with the command killed when ctx is
+// done.
+func execCommandContext(ctx context.Context, parts []string, timeout time.Duration, runAs bool, env ...string) (int, string) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, parts[0], parts[1:]...)
+	if runAs {
+		runAsCommand(cmd, env...)
+	} else {
+		cleanEnvCommand(cmd, env...)
+	}
+	killGroup(cmd)
 	var out bytes.Buffer
 	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	output := strings.TrimSpace(out.String())
+	if len(output) > execOutputMax {
+		output = output[len(output)-execOutputMax:]
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return ExecTimedOut, output
+	}
+	status := ExecStatus(err)
+	if status != 0 && output == "" {
+		output = err.Error()
+	}
+	return status, output
+}
+
+// killGroup runs cmd in its own process group and kills the whole group when
+// its context is done - a shell's children are killed with it instead of
+// being left running after a timeout.
+func killGroup(cmd *exec.Cmd) {
+	setProcessGroup(cmd)
+	cmd.WaitDelay = execWaitDelay
+}
+
+// ValidateFile runs command with file as the last argument and the contents of
+// file on stdin. It returns an error with the command's output if it fails.
+func ValidateFile(command, file string) error {
+	parts := strings.Fields(command)
+	if len(parts) == 0 {
+		return errors.New("blank validate command")
+	}
+	input, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	cmd := exec.CommandContext(RunContext(), parts[0], append(parts[1:], file)...)
+	killGroup(cmd)
+	cleanEnvCommand(cmd)
+	cmd.Stdin = input
+	output, err := cmd.CombinedOutput()
+	status := ExecStatus(err)
+	Log(fmt.Sprintf("validate='%s' file='%s' status='%d'", parts[0], file, status), "info")
+	if err != nil {
+		return fmt.Errorf("'%s' exited with %d: %s", command, status, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// CheckFile runs command against file - every %f is replaced with its path,
+// or it's added as the last argument if there isn't one. It's killed after
+// --exec-timeout and an error wraps ErrCheckFailed with the command's output.
+func CheckFile(command, file string) error {
+	parts := strings.Fields(command)
+	if len(parts) == 0 {
+		return errors.New("blank check command")
+	}
+	replaced := false
+	for i, part := range parts {
+		if strings.Contains(part, "%f") {
+			parts[i] = strings.Replace(part, "%f", file, -1)
+			replaced = true
+		}
+	}
+	if !replaced {
+		parts = append(parts, file)
+	}
+	status, output := execCommand(parts, ExecTimeout)
+	Log(fmt.Sprintf("check='%s' file='%s' status='%d'", parts[0], file, status), "info")
+	if status != 0 {
+		return fmt.Errorf("%w: '%s' exited with %d: %s", ErrCheckFailed, command, status, output)
+	}
+	return nil
+}
+
+// ReadExec runs the command and returns its stdout as the data. It's killed
+// after --exec-timeout and a non-zero exit is an error with its stderr.
+func ReadExec(command string) (string, error) {
+	parts := strings.Fields(command)
+	if len(parts) == 0 {
+		return "", errors.New("blank source command")
+	}
+	ctx := RunContext()
+	if ExecTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ExecTimeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, parts[0], parts[1:]...)
+	killGroup(cmd)
+	runAsCommand(cmd)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
 	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("'%s' timed out after %s", command, ExecTimeout)
+	}
+	status := ExecStatus(err)
+	Log(fmt.Sprintf("source='%s' status='%d' size='%d'", parts[0], status, stdout.Len()), "info")
 	if err != nil {
-		Log(fmt.Sprintf("exec='error' message='%v'", err), "info")
-		return false
+		return "", fmt.Errorf("'%s' exited with %d: %s", command, status, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// ExecStatus turns the error from running a command into an exit code.
+func ExecStatus(err error) int {
+	if err == nil {
+		return 0
 	}
-	return true
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+		return 1
+	}
+	if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+		return ExecNotFound
+	}
+	if errors.Is(err, os.ErrPermission) {
+		return ExecNotExecutable
+	}
+	return 1
 }
 
 // GenerateLockReason creates a reason with filename, username and date.
@@ -117,26 +370,112 @@ func GenerateLockReason() string {
 }
 
 // LockFile sets a key in Consul so that a particular file won't be updated. See commands/lock.go
-func LockFile(key string) bool {
+func LockFile(key string) error {
 	c, err := Connect(ConsulServer, Token)
 	if err != nil {
-		LogFatal("Could not connect to Consul.", key, "consul_connect")
+		return err
 	}
-	saved := Set(c, key, LockReason)
-	if saved {
-		StatsdLock(key)
-		return true
+	if err := Set(c, key, LockValue(LockReason, LockTTL)); err != nil {
+		return err
 	}
-	return false
+	StatsdLock(key)
+	return nil
+}
+
+// lockExpiry is the value of a lock key with a --ttl - as
+// kvexpress.LockValue saves it.
+type lockExpiry struct {
+	Reason  string    `json:"reason"`
+	Locked  time.Time `json:"locked,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// LockValue is what's saved in the lock key. Without a ttl it's just the
+// reason - the same as older versions of kvexpress.
+func LockValue(reason string, ttl time.Duration) string {
+	return kvexpress.LockValue(reason, ttl)
+}
+
+// ParseLock returns the reason and expiry from a lock key - the expiry is zero
+// if the lock doesn't expire.
+func ParseLock(value string) (string, time.Time) {
+	return kvexpress.ParseLock(value)
+}
+
+// CheckLock returns the reason file is locked on this host - or "" if it isn't.
+// An expired lock is removed, along with the `$filename.locked` file, and the
+// file can be written again.
+func CheckLock(c *consul.Client, file string) (string, error) {
+	return checkLockKey(c, FileLockPath(file), file, func() error { return LockFileRemove(file) })
+}
+
+// CheckGlobalLock returns the reason key is locked on every host with
+// `kvexpress lock --global` - or "" if it isn't.
+func CheckGlobalLock(c *consul.Client, key string) (string, error) {
+	return checkLockKey(c, KeyPath(key, "lock"), key, nil)
+}
+
+// checkLockKey returns the reason from a lock key. An expired lock is deleted
+// and cleanup is run if there is one - if it was locked again in between, the
+// new lock is checked instead.
+func checkLockKey(c *consul.Client, lockKey, name string, cleanup func() error) (string, error) {
+	value, err := Get(c, lockKey)
+	if err != nil || value == "" {
+		return "", err
+	}
+	reason, expires := ParseLock(value)
+	if expires.IsZero() || time.Now().Before(expires) {
+		return reason, nil
+	}
+	Log(fmt.Sprintf("lock='expired' name='%s' expires='%s' reason='%s'", name, expires.Format(time.RFC3339), reason), "info")
+	if DryRunSkip(fmt.Sprintf("remove the expired lock '%s'", lockKey)) {
+		return "", nil
+	}
+	removed, err := delLockCAS(c, lockKey, value)
+	if err != nil {
+		return "", err
+	}
+	if !removed {
+		Log(fmt.Sprintf("lock='changed' name='%s' - checking it again.", name), "info")
+		return checkLockKey(c, lockKey, name, cleanup)
+	}
+	if cleanup != nil {
+		if err := cleanup(); err != nil {
+			return "", err
+		}
+	}
+	StatsdLockExpired(name)
+	if DatadogAPIKey != "" && DatadogAPPKey != "" {
+		DDLockExpiredEvent(DDAPIConnect(DatadogAPIKey, DatadogAPPKey), name, reason)
+	}
+	return "", nil
+}
+
+// delLockCAS removes the lock in key only if it's still value - with a CAS on
+// its index, so a lock that's taken again after it was read isn't removed.
+// It's false if the lock changed. A --backend other than Consul doesn't have
+// the index and the lock is removed.
+func delLockCAS(c *consul.Client, key, value string) (bool, error) {
+	if backend != nil {
+		return true, Del(c, key)
+	}
+	index, current, err := consulIndex(c, key)
+	if err != nil || index == 0 || current != value {
+		return false, err
+	}
+	removed, _, err := c.KV().DeleteCAS(&consul.KVPair{Key: strings.TrimPrefix(key, "/"), ModifyIndex: index}, nil)
+	return removed, err
 }
 
 // UnlockFile removes a key in Consul so that a particular file can be updated. See commands/unlock.go
-func UnlockFile(key string) bool {
+func UnlockFile(key string) error {
 	c, err := Connect(ConsulServer, Token)
 	if err != nil {
-		LogFatal("copy: Could not connect to Consul.", key, "consul_connect")
+		return err
+	}
+	if err := Del(c, key); err != nil {
+		return err
 	}
-	value := Del(c, key)
 	StatsdUnlock(key)
-	return value
+	return nil
 }
@@ -3,7 +3,12 @@
 package commands
 
 import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 var exampleData = "This\nIs\nA\nMulti\nLine\nFile\nThat\nContains\nMultiple\nLines\nFor\nTesting.\n"
@@ -26,6 +31,21 @@ func TestLengthCheck(t *testing.T) {
 	}
 }
 
+func TestSizeCheck(t *testing.T) {
+	if err := SizeCheck(exampleData, 0, 0); err != nil {
+		t.Errorf("0 should turn the checks off: %v", err)
+	}
+	if err := SizeCheck(exampleData, LineCount(exampleData), len(exampleData)); err != nil {
+		t.Errorf("The data is exactly at the limits: %v", err)
+	}
+	if err := SizeCheck(exampleData, LineCount(exampleData)-1, 0); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("There should be too many lines: %v", err)
+	}
+	if err := SizeCheck(exampleData, 0, len(exampleData)-1); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("There should be too many bytes: %v", err)
+	}
+}
+
 func TestComputeChecksum(t *testing.T) {
 	t.Log("Expecting the checksum to match.")
 	testSHA := ComputeChecksum(exampleData)
@@ -57,3 +77,209 @@ func TestRemoveLines(t *testing.T) {
 		t.Errorf("We didn't trim the right lines.")
 	}
 }
+
+func TestRunCommandMissingBinary(t *testing.T) {
+	if status := RunCommand("/this/binary/does-not-exist --flag"); status != ExecNotFound {
+		t.Errorf("An absolute path that doesn't exist should be ExecNotFound, got %d", status)
+	}
+	if status := RunCommand("kvexpress-no-such-command-in-path"); status != ExecNotFound {
+		t.Errorf("A command not in the PATH should be ExecNotFound, got %d", status)
+	}
+}
+
+func TestRunCommandFailing(t *testing.T) {
+	if status := RunCommand("ls /this/path/does-not-exist"); status == ExecNotFound || status == 0 {
+		t.Errorf("A command that ran and failed is not ExecNotFound, got %d", status)
+	}
+	if status := RunCommand("false"); status != 1 {
+		t.Errorf("false should exit 1, got %d", status)
+	}
+	if status := RunCommand("true"); status != 0 {
+		t.Errorf("true should exit 0, got %d", status)
+	}
+}
+
+func TestValidateFile(t *testing.T) {
+	file := ensureTestFile(t)
+	ioutil.WriteFile(file, []byte(exampleData), 0640)
+	if err := ValidateFile("test -s", file); err != nil {
+		t.Errorf("The file is passed as $1 and should validate: %v", err)
+	}
+	if err := ValidateFile("grep -q Testing.", file); err != nil {
+		t.Errorf("The file should validate: %v", err)
+	}
+	if err := ValidateFile("grep -q Missing", file); err == nil {
+		t.Error("A command that exits non-zero should fail validation.")
+	}
+	if err := ValidateFile("/this/binary/does-not-exist", file); err == nil {
+		t.Error("A missing command should fail validation.")
+	}
+}
+
+func TestValidateFileStdin(t *testing.T) {
+	file := ensureTestFile(t)
+	ioutil.WriteFile(file, []byte(exampleData), 0640)
+	// cmp compares stdin with $1 - they should be the same.
+	if err := ValidateFile("cmp -", file); err != nil {
+		t.Errorf("The file should be on stdin: %v", err)
+	}
+}
+
+func TestRunCommandDryRun(t *testing.T) {
+	file := ensureTestFile(t)
+	DryRun = true
+	defer func() { DryRun = false }()
+	if status := RunCommand("touch " + file); status != 0 {
+		t.Errorf("A dry run should return 0, got %d", status)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Error("Nothing should be run with --dry-run.")
+	}
+}
+
+func TestRunCommandTimeout(t *testing.T) {
+	ExecTimeout = 50 * time.Millisecond
+	defer func() { ExecTimeout = 0 }()
+	start := time.Now()
+	if status := RunCommand("sleep 5"); status != ExecTimedOut {
+		t.Errorf("A command that runs too long should be ExecTimedOut, got %d", status)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("The command should have been killed.")
+	}
+}
+
+func TestExecCommandKillsGroup(t *testing.T) {
+	start := time.Now()
+	// The shell's child has the shell's stdout - it has to be killed too.
+	if status, _ := execCommand([]string{"sh", "-c", "sleep 5 & sleep 5"}, 50*time.Millisecond); status != ExecTimedOut {
+		t.Errorf("A command that runs too long should be ExecTimedOut, got %d", status)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("Every process the command started should have been killed.")
+	}
+}
+
+func TestExecCommandOutput(t *testing.T) {
+	status, output := execCommand([]string{"ls", "/this/path/does-not-exist"}, 0)
+	if status == 0 || !strings.Contains(output, "does-not-exist") {
+		t.Errorf("The output should be captured: %d %q", status, output)
+	}
+}
+
+func TestCheckLock(t *testing.T) {
+	tc, c := newTestConsul(t)
+	file := ensureTestFile(t)
+	if reason, err := CheckLock(c, file); err != nil || reason != "" {
+		t.Errorf("The file should not be locked: %q %v", reason, err)
+	}
+
+	// Locks from older versions are just the reason.
+	tc.put(FileLockPath(file), "Testing.")
+	if reason, _ := CheckLock(c, file); reason != "Testing." {
+		t.Errorf("The file should be locked: %q", reason)
+	}
+
+	tc.put(FileLockPath(file), LockValue("Testing a ttl.", time.Hour))
+	if reason, _ := CheckLock(c, file); reason != "Testing a ttl." {
+		t.Errorf("The lock should not have expired: %q", reason)
+	}
+
+	tc.put(FileLockPath(file), LockValue("Testing an expired ttl.", -time.Hour))
+	if reason, _ := CheckLock(c, file); reason != "Testing an expired ttl." {
+		t.Errorf("A negative ttl is the same as no ttl: %q", reason)
+	}
+	tc.put(FileLockPath(file), `{"reason":"Expired.","expires":"2016-05-01T12:00:00Z"}`)
+	ioutil.WriteFile(LockFilePath(file), []byte("locked"), 0640)
+	if reason, err := CheckLock(c, file); err != nil || reason != "" {
+		t.Errorf("The expired lock should be removed: %q %v", reason, err)
+	}
+	if _, ok := tc.value(FileLockPath(file)); ok {
+		t.Error("The expired lock key should be deleted.")
+	}
+	if _, err := os.Stat(LockFilePath(file)); !os.IsNotExist(err) {
+		t.Error("The expired lock file should be removed.")
+	}
+
+	// A lock taken again after the expired one was read stays.
+	expired := `{"reason":"Expired.","expires":"2016-05-01T12:00:00Z"}`
+	tc.put(FileLockPath(file), LockValue("Locked again.", time.Hour))
+	if removed, err := delLockCAS(c, FileLockPath(file), expired); err != nil || removed {
+		t.Errorf("The new lock should not be removed: %t %v", removed, err)
+	}
+	if reason, _ := CheckLock(c, file); reason != "Locked again." {
+		t.Errorf("The new lock should still be there: %q", reason)
+	}
+}
+
+func TestParseLock(t *testing.T) {
+	reason, expires := ParseLock(LockValue("Testing.", 2*time.Hour))
+	if reason != "Testing." || time.Until(expires) < time.Hour {
+		t.Errorf("The lock should expire in 2 hours: %q %s", reason, expires)
+	}
+	if reason, expires := ParseLock(`{"not":"a lock"}`); reason != `{"not":"a lock"}` || !expires.IsZero() {
+		t.Errorf("JSON without an expiry is just a reason: %q %s", reason, expires)
+	}
+}
+
+func TestChangeRatio(t *testing.T) {
+	old := "one\ntwo\nthree\nfour\n"
+	if ratio := ChangeRatio(old, "four\nthree\ntwo\none\n"); ratio != 0 {
+		t.Errorf("Moving lines isn't a change, got %v", ratio)
+	}
+	if ratio := ChangeRatio(old, "one\ntwo\n"); ratio != 0.5 {
+		t.Errorf("Removing half the lines should be 0.5, got %v", ratio)
+	}
+	if ratio := ChangeRatio(old, "one\ntwo\nthree\nFOUR\n"); ratio != 0.5 {
+		t.Errorf("A changed line is a removed and an added line, got %v", ratio)
+	}
+	if ratio := ChangeRatio("", exampleData); ratio != 0 {
+		t.Errorf("There's nothing to compare a new key against, got %v", ratio)
+	}
+}
+
+func TestReadExec(t *testing.T) {
+	if data, err := ReadExec("printf one\\ntwo\\n"); err != nil || data != "one\ntwo\n" {
+		t.Errorf("The command's stdout should be the data: %q %v", data, err)
+	}
+	if _, err := ReadExec("ls /this/path/does-not-exist"); err == nil || !strings.Contains(err.Error(), "does-not-exist") {
+		t.Errorf("A failing command should be an error with its stderr: %v", err)
+	}
+	defer func() { ExecTimeout = 0 }()
+	ExecTimeout = 100 * time.Millisecond
+	if _, err := ReadExec("sleep 5"); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("A slow command should time out: %v", err)
+	}
+}
+
+func TestRunCommandRunAs(t *testing.T) {
+	RunAs = GetCurrentUsername()
+	defer func() { RunAs = ""; runAsUser = nil }()
+	t.Setenv("CONSUL_HTTP_TOKEN", "secret")
+	if err := SetupRunAs(); err != nil {
+		t.Fatal(err)
+	}
+	status, output := execCommandAs([]string{"env"}, 0, true, "KVEXPRESS_KEY=hosts")
+	if status != 0 {
+		t.Fatalf("env should run: %d %s", status, output)
+	}
+	if strings.Contains(output, "CONSUL_HTTP_TOKEN") {
+		t.Error("--run-as shouldn't pass on kvexpress's environment.")
+	}
+	if !strings.Contains(output, "KVEXPRESS_KEY=hosts") || !strings.Contains(output, "USER="+RunAs) {
+		t.Errorf("The command should get its own variables and the user's: %s", output)
+	}
+	// A check runs as kvexpress - but it doesn't get the tokens either.
+	if _, output := execCommand([]string{"env"}, 0); strings.Contains(output, "CONSUL_HTTP_TOKEN") || !strings.Contains(output, "PATH=") {
+		t.Errorf("A check should get the clean environment with --run-as: %s", output)
+	}
+	runAsUser = nil
+	if _, output := execCommand([]string{"env"}, 0); !strings.Contains(output, "CONSUL_HTTP_TOKEN") {
+		t.Error("Without --run-as a check should keep the environment.")
+	}
+
+	RunAs = "kvexpress-no-such-user"
+	if err := SetupRunAs(); err == nil {
+		t.Error("A --run-as user that doesn't exist should be an error.")
+	}
+}
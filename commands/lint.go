@@ -0,0 +1,123 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+var lintCmd = &cobra.Command{
+	Use:   "lint",
+	Short: "Check data the way in would without saving it.",
+	Long:  `Lint runs the same normalizing, filtering, sorting, length and validation checks as in and prints what would be stored - it never talks to Consul, so a producer can check its data in CI.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		checkLintFlags()
+		AutoEnable()
+	},
+	Run: lintRun,
+}
+
+func lintRun(cmd *cobra.Command, args []string) {
+	start := time.Now()
+	data := ReadFile(FiletoRead)
+	if FiletoRead == Stdio {
+		var err error
+		data, err = ReadStdin()
+		ExitOnError(err, FiletoRead, "read_file")
+	}
+	result, err := LintData(data)
+	RecordResult(result.Bytes, result.Checksum, FiletoRead)
+	RecordDetails(result)
+	if err != nil {
+		Log(fmt.Sprintf("lint file='%s' passed='false' message='%v'", FiletoRead, err), "info")
+		fmt.Printf("Lint failed - in wouldn't save this: %v\n", err)
+		exitRun(ExitRejected, start, FiletoRead, "lint_failed", err.Error())
+	}
+	fmt.Printf("lines:    %d\nbytes:    %d\nstored:   %d\nchecksum: %s\n", result.Lines, result.Bytes, result.StoredBytes, result.Checksum)
+	Log(fmt.Sprintf("lint file='%s' passed='true' lines='%d' size='%d' checksum='%s'", FiletoRead, result.Lines, result.Bytes, result.Checksum), "info")
+	RunTime(start, FiletoRead, "complete")
+}
+
+// LintResult is what in would save - Bytes is the data and StoredBytes is
+// what goes in the key once it's compressed, encoded and encrypted.
+type LintResult struct {
+	Lines       int    `json:"lines"`
+	Bytes       int    `json:"bytes"`
+	StoredBytes int    `json:"stored_bytes"`
+	Checksum    string `json:"checksum"`
+}
+
+// LintData puts data through in's prepareInData and returns the first step
+// that would stop it.
+func LintData(data string) (LintResult, error) {
+	var result LintResult
+	var file string
+	defer func() {
+		if file != "" {
+			os.Remove(file)
+		}
+	}()
+	data, err := prepareInData(data, func(data string) (string, error) {
+		if ValidateExec == "" {
+			return "", nil
+		}
+		file = RandomTmpFile()
+		return file, ioutil.WriteFile(file, []byte(data), 0600)
+	})
+	if err != nil {
+		var stopped *inDataError
+		if errors.As(err, &stopped) && stopped.Result != "not_utf8" {
+			result.Lines, result.Bytes = LineCount(data), len(data)
+		}
+		return result, err
+	}
+	result.Lines, result.Bytes = LineCount(data), len(data)
+	result.Checksum = StoreChecksum(data)
+	stored, err := EncodeData("", data)
+	if err != nil {
+		return result, err
+	}
+	result.StoredBytes = len(stored)
+	return result, nil
+}
+
+func checkLintFlags() {
+	Log("Checking cli flags.", "debug")
+	if FiletoRead == "" {
+		fmt.Println("Need a file to check in -f - or - for stdin")
+		os.Exit(1)
+	}
+	if FiletoRead != Stdio {
+		if _, err := os.Stat(FiletoRead); err != nil {
+			fmt.Println("File ", FiletoRead, " does not exist.")
+			os.Exit(1)
+		}
+	}
+	loadLineFilters()
+	checkSortFlags()
+	checkNormalizeFlags()
+	checkValidateFlag()
+	checkBinaryFlags()
+	Log("Required cli flags present.", "debug")
+}
+
+func init() {
+	RootCmd.AddCommand(lintCmd)
+	lintCmd.Flags().StringVarP(&FiletoRead, "file", "f", "", "filename to check - or - for stdin")
+	lintCmd.Flags().BoolVarP(&Sorted, "sorted", "S", false, "sort the input file")
+	lintCmd.Flags().StringVarP(&SortMode, "sort", "", "", "how to sort the lines - none, lexical, numeric or version")
+	lintCmd.Flags().BoolVarP(&Unique, "unique", "", false, "remove duplicate lines")
+	lintCmd.Flags().StringVarP(&IncludeRe, "include-re", "", "", "only keep the lines that match this regular expression")
+	lintCmd.Flags().StringVarP(&ExcludeRe, "exclude-re", "", "", "remove the lines that match this regular expression")
+	lintCmd.Flags().StringVarP(&NormalizeEOL, "normalize-eol", "", "", "change every line ending to lf or crlf before the checksum")
+	lintCmd.Flags().BoolVarP(&RequireUTF8, "utf8", "", false, "stop if the data isn't valid UTF-8")
+	lintCmd.Flags().BoolVarP(&NormalizeNFC, "nfc", "", false, "normalize the data to Unicode NFC before the checksum - it has to be UTF-8")
+	lintCmd.Flags().StringVarP(&StripComments, "strip-comments", "", "", "remove the lines that start with this - like '#'")
+	lintCmd.Flags().StringVarP(&ValidateExec, "validate-exec", "", "", "command to check the file - gets the file as $1 and on stdin")
+	lintCmd.Flags().StringVarP(&ValidateType, "validate", "", "", "check that the data is valid json, yaml or csv")
+}
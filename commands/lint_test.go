@@ -0,0 +1,45 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLintData(t *testing.T) {
+	MinFileLength, Sorted, ValidateType = 2, true, ""
+	defer func() { MinFileLength, Sorted, ValidateType = 10, false, "" }()
+
+	result, err := LintData("b\n\na\nc\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sorted := SortLines("b\n\na\nc\n", "lexical", false)
+	if result.Lines != LineCount(sorted) || result.Bytes != len(sorted) || result.StoredBytes != len(sorted) || result.Checksum != StoreChecksum(sorted) {
+		t.Errorf("Lint should report the sorted data in would save: %+v", result)
+	}
+
+	if _, err := LintData("a\n"); err == nil {
+		t.Error("One line should be fewer than --length 2.")
+	}
+
+	ValidateType = "json"
+	if _, err := LintData("{\"a\":\n1,\n"); err == nil {
+		t.Error("Broken json should fail --validate json.")
+	}
+}
+
+func TestLintDataSteps(t *testing.T) {
+	MinFileLength, ValidateType = 1, ""
+	defer func() { MinFileLength, MaxFileBytes = 10, 0 }()
+	MaxFileBytes = 4
+	result, err := LintData("abcdef\n")
+	var stopped *inDataError
+	if !errors.As(err, &stopped) || stopped.Result != "too_large" {
+		t.Fatalf("The data should stop at the size check like in: %v", err)
+	}
+	if result.Bytes != 7 || result.Lines != 1 {
+		t.Errorf("A failed lint should still count the data: %+v", result)
+	}
+}
@@ -1,4 +1,4 @@
-// +build linux darwin freebsd
+// +build linux darwin freebsd windows
 
 package commands
 
@@ -6,12 +6,13 @@ import (
 	"fmt"
 	"github.com/spf13/cobra"
 	"os"
+	"time"
 )
 
 var lockCmd = &cobra.Command{
 	Use:   "lock",
 	Short: "Lock a file on a single node so it stays the way it is.",
-	Long:  `Lock is a convenient way to stop a file from being updated on a single node.`,
+	Long:  `Lock is a convenient way to stop a file from being updated on a single node - or on every node with --global.`,
 	PreRun: func(cmd *cobra.Command, args []string) {
 		checkLockFlags()
 		AutoEnable()
@@ -20,19 +21,38 @@ var lockCmd = &cobra.Command{
 }
 
 func lockRun(cmd *cobra.Command, args []string) {
+	if LockGlobal {
+		KeyLockLocation := KeyPath(KeyLock, "lock")
+		if err := LockFile(KeyLockLocation); err != nil {
+			Log(fmt.Sprintf("'%s' was NOT locked - something went wrong.", KeyLock), "info")
+			ExitOnError(err, KeyLockLocation, "lock")
+		}
+		Log(fmt.Sprintf("'%s' was locked on every host.", KeyLock), "info")
+		return
+	}
 	KeyLockLocation := FileLockPath(FiletoLock)
 
-	result := LockFile(KeyLockLocation)
-	if result {
-		LockFileWrite(FiletoLock)
-		Log(fmt.Sprintf("'%s' was locked.", FiletoLock), "info")
-	} else {
+	if err := LockFile(KeyLockLocation); err != nil {
 		Log(fmt.Sprintf("'%s' was NOT locked - something went wrong.", FiletoLock), "info")
+		ExitOnError(err, KeyLockLocation, "lock")
 	}
+	ExitOnError(LockFileWrite(FiletoLock), FiletoLock, "write_file")
+	Log(fmt.Sprintf("'%s' was locked.", FiletoLock), "info")
 }
 
 func checkLockFlags() {
 	Log("Checking cli flags.", "debug")
+	if LockGlobal {
+		if KeyLock == "" {
+			fmt.Println("Need a key to lock with -k")
+			os.Exit(1)
+		}
+		if LockReason == "" {
+			LockReason = fmt.Sprintf("No reason given for '%s' by '%s' at '%s'.", KeyLock, GetCurrentUsername(), ReturnCurrentUTC())
+		}
+		Log("Required cli flags present.", "debug")
+		return
+	}
 	if FiletoLock == "" {
 		fmt.Println("Need a file to lock with -f")
 		os.Exit(1)
@@ -40,7 +60,7 @@ func checkLockFlags() {
 	if LockReason == "" {
 		LockReason = GenerateLockReason()
 	}
-	CheckFullFilename(FiletoLock)
+	ExitOnError(CheckFullFilename(FiletoLock), FiletoLock, "check_flags")
 	Log("Required cli flags present.", "debug")
 }
 
@@ -50,10 +70,22 @@ var (
 
 	// LockReason is the reason why you are locking the file.
 	LockReason string
+
+	// LockTTL is how long the lock lasts - 0 until it's unlocked.
+	LockTTL time.Duration
+
+	// LockGlobal locks KeyLock on every host instead of a file on this one.
+	LockGlobal bool
+
+	// KeyLock is the key that's locked with --global.
+	KeyLock string
 )
 
 func init() {
 	RootCmd.AddCommand(lockCmd)
 	lockCmd.Flags().StringVarP(&FiletoLock, "file", "f", "", "file to lock")
 	lockCmd.Flags().StringVarP(&LockReason, "reason", "r", "", "reason to lock")
+	lockCmd.Flags().BoolVarP(&LockGlobal, "global", "", false, "lock the key on every host")
+	lockCmd.Flags().StringVarP(&KeyLock, "key", "k", "", "key to lock with --global")
+	lockCmd.Flags().DurationVarP(&LockTTL, "ttl", "", 0, "unlock automatically after this long - 0 to stay locked")
 }
@@ -0,0 +1,234 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var locksCmd = &cobra.Command{
+	Use:   "locks",
+	Short: "List the files locked on this host and the global locks.",
+	Long:  `Locks is for after an incident - it lists every file that's locked on this host and every key that's locked on every host with its reason and how long it's been locked. unlock --all clears them.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		AutoEnable()
+	},
+	Run: locksRun,
+}
+
+func locksRun(cmd *cobra.Command, args []string) {
+	start := time.Now()
+	c, err := Connect(ConsulServer, Token)
+	if err != nil {
+		LogFatal("Could not connect to Consul.", "locks", "consul_connect")
+	}
+	entries, err := ListLocks(c, lockDirs())
+	ExitOnError(err, "locks", "locks")
+	printLocks(entries)
+	Log(fmt.Sprintf("locks host='%s' locks='%d'", GetHostname(), len(entries)), "info")
+	RecordDetails(entries)
+	PrintResult("locks", "locks", time.Since(start), "")
+}
+
+// LockEntry is a lock that locks found. A file lock has the file if its
+// `.locked` file was found - a `.locked` file without a lock key was left
+// behind and doesn't stop anything. Since is blank if it isn't known.
+type LockEntry struct {
+	Key     string `json:"key,omitempty"`
+	File    string `json:"file,omitempty"`
+	Global  bool   `json:"global"`
+	LockKey string `json:"lock_key,omitempty"`
+	Reason  string `json:"reason"`
+	Since   string `json:"since,omitempty"`
+	Expires string `json:"expires,omitempty"`
+}
+
+// ListLocks returns the file locks for this host and the global locks. The
+// file locks are keyed on a checksum of the path, so the `.locked` files in
+// dirs are what say which file is locked.
+func ListLocks(c *consul.Client, dirs []string) ([]LockEntry, error) {
+	files := make(map[string]string)
+	for _, file := range LockedFiles(dirs) {
+		files[fmt.Sprintf("%x", sha256.Sum256([]byte(file)))] = file
+	}
+	var entries []LockEntry
+	root := strings.TrimPrefix(PrefixLocation, "/") + "/locks/"
+	keys, err := Keys(c, root)
+	if err != nil {
+		return nil, err
+	}
+	host := GetHostname()
+	found := make(map[string]bool)
+	for _, key := range keys {
+		parts := strings.Split(strings.TrimPrefix(key, root), "/")
+		if len(parts) != 2 || parts[1] != host {
+			continue
+		}
+		entry, err := lockEntry(c, key)
+		if err != nil || entry.Reason == "" {
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if file, ok := files[parts[0]]; ok {
+			entry.File, found[parts[0]] = file, true
+			if info, err := os.Stat(LockFilePath(file)); err == nil {
+				entry.Since = info.ModTime().UTC().Format(time.RFC3339)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	for sum, file := range files {
+		if found[sum] {
+			continue
+		}
+		entry := LockEntry{File: file, Reason: lockFileReason(file)}
+		if info, err := os.Stat(LockFilePath(file)); err == nil {
+			entry.Since = info.ModTime().UTC().Format(time.RFC3339)
+		}
+		entries = append(entries, entry)
+	}
+
+	layout := keyLayout("", "lock")
+	keys, err = Keys(c, keyRoot(layout))
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		name, ok := keyName(layout, key)
+		if !ok || strings.HasPrefix(key, root) {
+			continue
+		}
+		entry, err := lockEntry(c, key)
+		if err != nil {
+			return nil, err
+		}
+		if entry.Reason != "" {
+			entry.Key, entry.Global = name, true
+			entries = append(entries, entry)
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Global != entries[j].Global {
+			return !entries[i].Global
+		}
+		return entries[i].File+entries[i].Key+entries[i].LockKey < entries[j].File+entries[j].Key+entries[j].LockKey
+	})
+	return entries, nil
+}
+
+// lockEntry reads the reason and the times from a lock key.
+func lockEntry(c *consul.Client, key string) (LockEntry, error) {
+	entry := LockEntry{LockKey: key}
+	value, err := Get(c, key)
+	if err != nil || value == "" {
+		return entry, err
+	}
+	var expires time.Time
+	entry.Reason, expires = ParseLock(value)
+	if !expires.IsZero() {
+		entry.Expires = expires.Format(time.RFC3339)
+		var lock lockExpiry
+		if json.Unmarshal([]byte(value), &lock) == nil && !lock.Locked.IsZero() {
+			entry.Since = lock.Locked.Format(time.RFC3339)
+		}
+	}
+	return entry, nil
+}
+
+// LockedFiles finds the files in dirs that have a `.locked` file. Directories
+// that can't be read are skipped.
+func LockedFiles(dirs []string) []string {
+	var files []string
+	for _, dir := range dirs {
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if info != nil && info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.Mode().IsRegular() && strings.HasSuffix(path, ".locked") {
+				files = append(files, strings.TrimSuffix(path, ".locked"))
+			}
+			return nil
+		})
+	}
+	return files
+}
+
+// lockFileReason is the reason in a `.locked` file.
+func lockFileReason(file string) string {
+	data, err := ioutil.ReadFile(LockFilePath(file))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "Reason Locked: ") {
+			return strings.TrimPrefix(line, "Reason Locked: ")
+		}
+	}
+	return ""
+}
+
+// lockDirs are where the `.locked` files are looked for - --dir, or the
+// --allowed-dir directories, or /etc.
+func lockDirs() []string {
+	switch {
+	case len(LockDirs) > 0:
+		return LockDirs
+	case len(AllowedDirs) > 0:
+		return AllowedDirs
+	}
+	return []string{"/etc"}
+}
+
+// printLocks prints the locks as a table.
+func printLocks(entries []LockEntry) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "LOCKED\tAGE\tEXPIRES\tREASON")
+	for _, entry := range entries {
+		name := entry.File
+		switch {
+		case entry.Global:
+			name = entry.Key + " (global)"
+		case entry.File == "":
+			name = entry.LockKey + " (no .locked file)"
+		case entry.LockKey == "":
+			name += " (left over)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", name, lockAge(entry.Since), lsValue(entry.Expires), lsValue(entry.Reason))
+	}
+	w.Flush()
+}
+
+// lockAge is how long ago since was - to the second.
+func lockAge(since string) string {
+	t, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		return "-"
+	}
+	return time.Since(t).Truncate(time.Second).String()
+}
+
+var (
+	// LockDirs are the directories searched for `.locked` files.
+	LockDirs []string
+)
+
+func init() {
+	RootCmd.AddCommand(locksCmd)
+	locksCmd.Flags().StringSliceVarP(&LockDirs, "dir", "", []string{}, "directories to look for .locked files in - --allowed-dir or /etc if blank")
+}
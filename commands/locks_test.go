@@ -0,0 +1,55 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListLocks(t *testing.T) {
+	PrefixLocation = "testing"
+	tc, c := newTestConsul(t)
+	dir := t.TempDir()
+	locked, leftOver := filepath.Join(dir, "hosts"), filepath.Join(dir, "sub", "resolv.conf")
+	os.MkdirAll(filepath.Dir(leftOver), 0755)
+	ioutil.WriteFile(LockFilePath(locked), []byte("Reason Locked: Fixing DNS.\n"), 0640)
+	ioutil.WriteFile(LockFilePath(leftOver), []byte("Reason Locked: Old.\n"), 0640)
+	tc.put(FileLockPath(locked), "Fixing DNS.")
+	tc.put(FileLockPath("/etc/unknown"), "Somewhere else.")
+	tc.put("testing/locks/0000/another-host", "Not this host.")
+	tc.put("testing/hosts/lock", LockValue("Freeze.", time.Hour))
+
+	entries, err := ListLocks(c, []string{dir})
+	if err != nil || len(entries) != 4 {
+		t.Fatalf("There should be 3 file locks and a global lock: %+v %v", entries, err)
+	}
+	if entries[0].File != locked || entries[0].Reason != "Fixing DNS." || entries[0].Since == "" {
+		t.Errorf("The locked file should have its reason and age: %+v", entries[0])
+	}
+	if entries[1].File != leftOver || entries[1].LockKey != "" || entries[1].Reason != "Old." {
+		t.Errorf("A .locked file without a lock key is left over: %+v", entries[1])
+	}
+	if entries[2].File != "" || entries[2].LockKey != FileLockPath("/etc/unknown") {
+		t.Errorf("A lock without a .locked file should still be listed: %+v", entries[2])
+	}
+	if !entries[3].Global || entries[3].Key != "hosts" || entries[3].Since == "" || entries[3].Expires == "" {
+		t.Errorf("The global lock should have when it was locked and expires: %+v", entries[3])
+	}
+
+	if err := UnlockLocks(c, entries[:3]); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tc.value(FileLockPath(locked)); ok {
+		t.Error("The lock key should be removed.")
+	}
+	if _, err := os.Stat(LockFilePath(leftOver)); !os.IsNotExist(err) {
+		t.Errorf("The .locked file should be removed: %v", err)
+	}
+	if _, ok := tc.value("testing/hosts/lock"); !ok {
+		t.Error("The global lock wasn't asked to be unlocked.")
+	}
+}
@@ -0,0 +1,84 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// logLevels orders the priorities that can be passed to Log.
+var logLevels = map[string]int{"debug": 0, "info": 1, "warn": 2, "error": 3}
+
+// logPair matches the key='value' pairs in a log message.
+var logPair = regexp.MustCompile(`([A-Za-z_]+)='([^']*)'`)
+
+// SetupLogging checks --log-format and --log-level and sends the logs to
+// --log-file instead of syslog if it was passed.
+func SetupLogging() error {
+	if LogFormat != "text" && LogFormat != "json" {
+		return fmt.Errorf("unknown --log-format '%s' - use text or json", LogFormat)
+	}
+	if _, ok := logLevels[LogLevel]; !ok {
+		return fmt.Errorf("unknown --log-level '%s' - use debug, info, warn or error", LogLevel)
+	}
+	if LogFile != "" {
+		file, err := os.OpenFile(LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+		if err != nil {
+			return err
+		}
+		log.SetOutput(file)
+		log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+	}
+	// JSON lines have their own time.
+	if LogFormat == "json" {
+		log.SetFlags(0)
+	}
+	return nil
+}
+
+// logEnabled returns true if the priority is at or above --log-level.
+// KVEXPRESS_DEBUG still turns on the debug logs.
+func logEnabled(priority string) bool {
+	if priority == "debug" && os.Getenv("KVEXPRESS_DEBUG") != "" {
+		return true
+	}
+	level, ok := logLevels[priority]
+	if !ok {
+		level = logLevels["info"]
+	}
+	return level >= logLevels[LogLevel]
+}
+
+// formatLog formats a message for --log-format. JSON lines have the key='value'
+// pairs from the message as fields and whatever's left over as msg.
+func formatLog(message, priority string) string {
+	if LogFormat != "json" {
+		if RunID != "" {
+			message = fmt.Sprintf("run_id='%s' %s", RunID, message)
+		}
+		return fmt.Sprintf("%s: %s", Direction, message)
+	}
+	fields := make(map[string]string)
+	for _, pair := range logPair.FindAllStringSubmatch(message, -1) {
+		if _, ok := fields[pair[1]]; !ok {
+			fields[pair[1]] = pair[2]
+		}
+	}
+	text := strings.Join(strings.Fields(logPair.ReplaceAllString(message, "")), " ")
+	if text != "" {
+		fields["msg"] = text
+	}
+	fields["time"] = ReturnCurrentUTC()
+	fields["level"] = priority
+	fields["direction"] = Direction
+	if RunID != "" {
+		fields["run_id"] = RunID
+	}
+	line, _ := json.Marshal(fields)
+	return string(line)
+}
@@ -0,0 +1,69 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLogJSON(t *testing.T) {
+	defer func() { LogFormat, RunID = "text", "" }()
+	LogFormat, RunID = "json", "abcd1234"
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	defer log.SetFlags(log.LstdFlags)
+	if err := SetupLogging(); err != nil {
+		t.Fatalf("JSON logs should be setup: %v", err)
+	}
+
+	Log("consul KeyData='testing/hosts/data' saved='true' size='12'", "info")
+	var fields map[string]string
+	if err := json.Unmarshal(logs.Bytes(), &fields); err != nil {
+		t.Fatalf("The log should be a JSON object: %q %v", logs.String(), err)
+	}
+	if fields["KeyData"] != "testing/hosts/data" || fields["saved"] != "true" || fields["size"] != "12" {
+		t.Errorf("The key='value' pairs should be fields: %v", fields)
+	}
+	if fields["msg"] != "consul" || fields["level"] != "info" || fields["run_id"] != "abcd1234" || fields["time"] == "" {
+		t.Errorf("The free text, level, run ID and time should be fields: %v", fields)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	defer func() { LogLevel = "info" }()
+	LogLevel = "warn"
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	Log("below='true'", "info")
+	Log("above='true'", "error")
+	if strings.Contains(logs.String(), "below") || !strings.Contains(logs.String(), "above") {
+		t.Errorf("Only warn and above should be logged: %q", logs.String())
+	}
+
+	LogLevel = "loud"
+	if err := SetupLogging(); err == nil {
+		t.Error("An unknown --log-level should be an error.")
+	}
+}
+
+func TestSetupLoggingFile(t *testing.T) {
+	defer log.SetOutput(os.Stderr)
+	defer log.SetFlags(log.LstdFlags)
+	defer func() { LogFile = "" }()
+	LogFile = ensureTestFile(t)
+	if err := SetupLogging(); err != nil {
+		t.Fatalf("The log file should be opened: %v", err)
+	}
+	Log("file='true'", "info")
+	if data := ReadFile(LogFile); !strings.Contains(data, "file='true'") {
+		t.Errorf("The log should be in --log-file: %q", data)
+	}
+}
@@ -0,0 +1,105 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var lsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List the kvexpress keys under the prefix.",
+	Long:  `Ls lists every kvexpress key under the prefix - or underneath -k - with its size, checksum, when it was last updated and whether it's locked.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		AutoEnable()
+	},
+	Run: lsRun,
+}
+
+func lsRun(cmd *cobra.Command, args []string) {
+	start := time.Now()
+	c, err := Connect(ConsulServer, Token)
+	if err != nil {
+		LogFatal("Could not connect to Consul.", KeyLsLocation, "consul_connect")
+	}
+	entries, err := ListKeys(c, KeyLsLocation)
+	ExitOnError(err, KeyLsLocation, "ls")
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tSIZE\tCHECKSUM\tUPDATED\tLOCK")
+	for _, entry := range entries {
+		if entry.Error != "" {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t%s\n", entry.Key, entry.Error)
+			continue
+		}
+		checksum := entry.Checksum
+		if len(checksum) > 12 {
+			checksum = checksum[:12]
+		}
+		if !entry.ChecksumMatches {
+			checksum += " MISMATCH"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", entry.Key, entry.Size, checksum, lsValue(entry.Updated), lsValue(entry.Lock))
+	}
+	w.Flush()
+	Log(fmt.Sprintf("ls key='%s' keys='%d'", KeyLsLocation, len(entries)), "info")
+	RecordDetails(entries)
+	PrintResult(KeyLsLocation, "ls", time.Since(start), "")
+}
+
+// LsEntry is a key that ls found - a key that couldn't be read has the error
+// instead of the status.
+type LsEntry struct {
+	Key string `json:"key"`
+	KeyStatus
+	Error string `json:"error,omitempty"`
+}
+
+// ListKeys returns the status of every kvexpress key underneath key - or the
+// whole prefix if key is empty. The names are relative to the prefix so they
+// can be used with -k.
+func ListKeys(c *consul.Client, key string) ([]LsEntry, error) {
+	key = strings.Trim(key, "/")
+	names, err := TreeKeys(c, key)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]LsEntry, 0, len(names))
+	for _, name := range names {
+		if key != "" {
+			name = key + "/" + name
+		}
+		entry := LsEntry{Key: name}
+		status, err := GetStatus(c, name)
+		if err != nil {
+			entry.Error = err.Error()
+		} else {
+			entry.KeyStatus = status
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// lsValue is a dash for an empty column.
+func lsValue(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+var (
+	// KeyLsLocation is the key to list underneath - the whole prefix if it's empty.
+	KeyLsLocation string
+)
+
+func init() {
+	RootCmd.AddCommand(lsCmd)
+	lsCmd.Flags().StringVarP(&KeyLsLocation, "key", "k", "", "only list the keys underneath this key")
+}
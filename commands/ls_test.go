@@ -0,0 +1,34 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"testing"
+)
+
+func TestListKeys(t *testing.T) {
+	ensureTestFile(t)
+	tc, c := newTestConsul(t)
+	tc.put("testing/hosts/data", exampleData)
+	tc.put("testing/hosts/checksum", exampleDataSHA)
+	tc.put("testing/app/web/data", exampleData)
+	tc.put("testing/app/web/checksum", "not-the-checksum")
+	tc.put("testing/app/web/lock", LockValue("Deploying.", 0))
+	tc.put("testing/app/web/history/1/data", exampleData)
+
+	entries, err := ListKeys(c, "")
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("Both keys should be listed without their history: %+v %v", entries, err)
+	}
+	if entries[0].Key != "app/web" || entries[0].ChecksumMatches || entries[0].Lock != "Deploying." {
+		t.Errorf("The mismatched checksum and the lock should be listed: %+v", entries[0])
+	}
+	if entries[1].Key != "hosts" || !entries[1].ChecksumMatches || entries[1].Size != len(exampleData) {
+		t.Errorf("The size and checksum should be listed: %+v", entries[1])
+	}
+
+	entries, err = ListKeys(c, "app")
+	if err != nil || len(entries) != 1 || entries[0].Key != "app/web" {
+		t.Errorf("Only the keys underneath -k should be listed: %+v %v", entries, err)
+	}
+}
@@ -0,0 +1,218 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	// MaintenanceWindows are the times of day when out doesn't replace files -
+	// like '02:00-04:00 UTC'.
+	MaintenanceWindows []string
+
+	// NodeMaintenance holds back changes while the Consul agent's node is in
+	// maintenance mode.
+	NodeMaintenance bool
+
+	// maintenanceWindows are MaintenanceWindows once they're parsed.
+	maintenanceWindows []MaintenanceWindow
+)
+
+// nodeMaintenanceCheck is the check Consul adds to a node in maintenance mode.
+const nodeMaintenanceCheck = "_node_maintenance"
+
+// MaintenanceWindow is a time of day - it ends the next day if End is before
+// Start.
+type MaintenanceWindow struct {
+	Start    time.Duration
+	End      time.Duration
+	Location *time.Location
+}
+
+// ParseMaintenanceWindow reads 'HH:MM-HH:MM' with an optional time zone -
+// the local time if there isn't one.
+func ParseMaintenanceWindow(spec string) (MaintenanceWindow, error) {
+	window := MaintenanceWindow{Location: time.Local}
+	fields := strings.Fields(spec)
+	if len(fields) == 0 || len(fields) > 2 {
+		return window, fmt.Errorf("'%s' isn't HH:MM-HH:MM and a time zone", spec)
+	}
+	if len(fields) == 2 {
+		location, err := time.LoadLocation(fields[1])
+		if err != nil {
+			return window, fmt.Errorf("'%s' has an unknown time zone: %v", spec, err)
+		}
+		window.Location = location
+	}
+	times := strings.Split(fields[0], "-")
+	if len(times) != 2 {
+		return window, fmt.Errorf("'%s' isn't HH:MM-HH:MM", spec)
+	}
+	for i, value := range times {
+		clock, err := time.Parse("15:04", value)
+		if err != nil {
+			return window, fmt.Errorf("'%s' isn't HH:MM-HH:MM: %v", spec, err)
+		}
+		offset := time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute
+		if i == 0 {
+			window.Start = offset
+		} else {
+			window.End = offset
+		}
+	}
+	if window.Start == window.End {
+		return window, fmt.Errorf("'%s' doesn't have any time in it", spec)
+	}
+	return window, nil
+}
+
+// Contains is true if t is in the window.
+func (window MaintenanceWindow) Contains(t time.Time) bool {
+	t = t.In(window.Location)
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if window.Start < window.End {
+		return offset >= window.Start && offset < window.End
+	}
+	return offset >= window.Start || offset < window.End
+}
+
+// InMaintenance says why the host is in maintenance at now - blank if it
+// isn't. The node's maintenance mode is only checked with --node-maintenance.
+func InMaintenance(c *consul.Client, now time.Time) (string, error) {
+	for i, window := range maintenanceWindows {
+		if window.Contains(now) {
+			return fmt.Sprintf("maintenance window '%s'", MaintenanceWindows[i]), nil
+		}
+	}
+	if !NodeMaintenance {
+		return "", nil
+	}
+	var checks map[string]*consul.AgentCheck
+	err := Retry(func() error {
+		var err error
+		checks, err = c.Agent().Checks()
+		return err
+	}, Retries)
+	if err != nil {
+		return "", err
+	}
+	if check, ok := checks[nodeMaintenanceCheck]; ok {
+		if check.Notes != "" {
+			return fmt.Sprintf("node maintenance mode: %s", check.Notes), nil
+		}
+		return "node maintenance mode", nil
+	}
+	return "", nil
+}
+
+// PendingPath is the file that says a change to key in --prefix was held
+// back - it's next to the run lock.
+func PendingPath(key string) string {
+	name := runLockName.ReplaceAllString(strings.Trim(PrefixLocation+"/"+key, "/"), "-")
+	return filepath.Join(StateDir(), fmt.Sprintf("kvexpress-out-%s.pending", name))
+}
+
+// targetsPending is true if WriteTargets would change one of the files.
+// Stdout doesn't count.
+func targetsPending(targets []OutTarget, checksum string) bool {
+	for _, target := range targets {
+		if target.File == Stdio {
+			continue
+		}
+		targetChecksum := checksum
+		if target.Format != "" && target.Format != "raw" {
+			targetChecksum = ComputeChecksum(target.Output)
+		}
+		if matches, err := FileChecksumMatches(target.File, targetChecksum); err != nil || !matches {
+			return true
+		}
+	}
+	return false
+}
+
+// deferOut stops with ExitDeferred if the host is in maintenance and the
+// files would change - the pending file has the checksum that's waiting. The
+// first run after the maintenance ends writes the files and runs PostExec.
+func deferOut(c *consul.Client, key string, targets []OutTarget, checksum string, start time.Time) {
+	if len(maintenanceWindows) == 0 && !NodeMaintenance {
+		return
+	}
+	if !targetsPending(targets, checksum) {
+		return
+	}
+	reason, err := InMaintenance(c, time.Now())
+	ExitOnError(err, key, "consul_agent")
+	if reason == "" {
+		return
+	}
+	checksum = strings.TrimSpace(checksum)
+	Log(fmt.Sprintf("maintenance='true' key='%s' checksum='%s' reason='%s' - not writing until it's over.", key, checksum, reason), "info")
+	savePending(key, checksum)
+	StatsdDeferred(key)
+	exitRun(ExitDeferred, start, key, "maintenance", "")
+}
+
+// PendingSince is when the change to checksum was first held back - false if
+// it wasn't or a different checksum is waiting.
+func PendingSince(key, checksum string) (time.Time, bool) {
+	data, err := ioutil.ReadFile(PendingPath(key))
+	if err != nil {
+		return time.Time{}, false
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 || fields[1] != strings.TrimSpace(checksum) {
+		return time.Time{}, false
+	}
+	since, err := time.Parse(time.RFC3339, fields[0])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return since, true
+}
+
+// savePending saves the checksum that's waiting in the pending file - a
+// checksum that's already waiting keeps the time it was first held back.
+func savePending(key, checksum string) {
+	checksum = strings.TrimSpace(checksum)
+	if _, ok := PendingSince(key, checksum); ok {
+		return
+	}
+	if DryRunSkip(fmt.Sprintf("save pending checksum '%s' in '%s'", checksum, PendingPath(key))) {
+		return
+	}
+	if err := writeStateFile(PendingPath(key), []byte(fmt.Sprintf("%s %s\n", ReturnCurrentUTC(), checksum))); err != nil {
+		Log(fmt.Sprintf("pending='%s' message='%v'", PendingPath(key), err), "error")
+	}
+}
+
+// clearPending removes the pending file once the files have the data.
+func clearPending(key string) {
+	data, err := ioutil.ReadFile(PendingPath(key))
+	if err != nil {
+		return
+	}
+	Log(fmt.Sprintf("key='%s' pending='%s' - the change that was held back is applied.", key, strings.TrimSpace(string(data))), "info")
+	if !DryRun {
+		os.Remove(PendingPath(key))
+	}
+}
+
+// checkMaintenanceFlags parses --maintenance-window.
+func checkMaintenanceFlags() {
+	maintenanceWindows = nil
+	for _, spec := range MaintenanceWindows {
+		window, err := ParseMaintenanceWindow(spec)
+		if err != nil {
+			fmt.Printf("Bad --maintenance-window: %v\n", err)
+			os.Exit(1)
+		}
+		maintenanceWindows = append(maintenanceWindows, window)
+	}
+}
@@ -0,0 +1,96 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseMaintenanceWindow(t *testing.T) {
+	window, err := ParseMaintenanceWindow("02:00-04:00 UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		at       string
+		contains bool
+	}{
+		{"2026-10-14T01:59:59Z", false},
+		{"2026-10-14T02:00:00Z", true},
+		{"2026-10-14T03:59:00Z", true},
+		{"2026-10-14T04:00:00Z", false},
+		{"2026-10-14T00:30:00-02:00", true},
+	} {
+		at, _ := time.Parse(time.RFC3339, test.at)
+		if window.Contains(at) != test.contains {
+			t.Errorf("'%s' in the window should be %t", test.at, test.contains)
+		}
+	}
+	overnight, err := ParseMaintenanceWindow("22:00-02:00 UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	late, _ := time.Parse(time.RFC3339, "2026-10-14T23:00:00Z")
+	early, _ := time.Parse(time.RFC3339, "2026-10-14T01:00:00Z")
+	noon, _ := time.Parse(time.RFC3339, "2026-10-14T12:00:00Z")
+	if !overnight.Contains(late) || !overnight.Contains(early) || overnight.Contains(noon) {
+		t.Error("A window that ends the next day should go past midnight.")
+	}
+	for _, spec := range []string{"", "02:00", "02:00-25:00 UTC", "02:00-04:00 Mars/Olympus", "02:00-02:00", "02:00-04:00 UTC extra"} {
+		if _, err := ParseMaintenanceWindow(spec); err == nil {
+			t.Errorf("'%s' shouldn't parse.", spec)
+		}
+	}
+}
+
+func TestInMaintenance(t *testing.T) {
+	tc, c := newTestConsul(t)
+	MaintenanceWindows = []string{"02:00-04:00 UTC"}
+	maintenanceWindows = []MaintenanceWindow{{Start: 2 * time.Hour, End: 4 * time.Hour, Location: time.UTC}}
+	defer func() { MaintenanceWindows, maintenanceWindows, NodeMaintenance = nil, nil, false }()
+	at, _ := time.Parse(time.RFC3339, "2026-10-14T03:00:00Z")
+	if reason, err := InMaintenance(c, at); err != nil || reason == "" {
+		t.Errorf("03:00 is in the window: '%s' %v", reason, err)
+	}
+	after := at.Add(2 * time.Hour)
+	if reason, _ := InMaintenance(c, after); reason != "" {
+		t.Errorf("05:00 isn't in the window: '%s'", reason)
+	}
+	NodeMaintenance = true
+	if reason, err := InMaintenance(c, after); err != nil || reason != "" {
+		t.Errorf("The node isn't in maintenance mode: '%s' %v", reason, err)
+	}
+	tc.checks[nodeMaintenanceCheck] = "critical"
+	if reason, err := InMaintenance(c, after); err != nil || reason != "node maintenance mode" {
+		t.Errorf("The node is in maintenance mode: '%s' %v", reason, err)
+	}
+}
+
+func TestTargetsPending(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvexpress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "hosts")
+	targets := []OutTarget{{File: Stdio, Output: exampleData}, {File: file, Format: "raw", Output: exampleData}}
+	if !targetsPending(targets, exampleDataSHA) {
+		t.Error("A file that isn't there would change.")
+	}
+	ioutil.WriteFile(file, []byte(exampleData), 0644)
+	if targetsPending(targets, exampleDataSHA) {
+		t.Error("Nothing would change - stdout doesn't count.")
+	}
+
+	TmpDir = dir
+	defer func() { TmpDir = "" }()
+	ioutil.WriteFile(PendingPath("hosts"), []byte("pending"), 0644)
+	clearPending("hosts")
+	if _, err := os.Stat(PendingPath("hosts")); !os.IsNotExist(err) {
+		t.Error("The pending file should be removed once the files are written.")
+	}
+}
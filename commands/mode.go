@@ -0,0 +1,128 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// modeValue is --chmod - octal like 0640 or 2750, or symbolic like u=rw,g=r.
+type modeValue int
+
+func newModeValue(value int, p *int) *modeValue {
+	*p = value
+	return (*modeValue)(p)
+}
+
+func (m *modeValue) String() string { return fmt.Sprintf("%04o", int(*m)) }
+
+func (m *modeValue) Type() string { return "mode" }
+
+func (m *modeValue) Set(s string) error {
+	mode, err := ParseFileMode(s)
+	if err != nil {
+		return err
+	}
+	*m = modeValue(mode)
+	return nil
+}
+
+// ParseFileMode reads a mode the way chmod does. A number is always octal -
+// 644 is 0644 - and can have the setuid, setgid and sticky bits. A symbolic
+// mode like u=rw,g=r,o= or a=r,u+w,g+s starts from nothing rather than the
+// umask.
+func ParseFileMode(mode string) (int, error) {
+	mode = strings.TrimSpace(mode)
+	if mode == "" {
+		return 0, fmt.Errorf("there's no mode")
+	}
+	if strings.Trim(strings.TrimPrefix(mode, "0o"), "01234567") == "" {
+		value, err := strconv.ParseUint(strings.TrimPrefix(mode, "0o"), 8, 32)
+		if err != nil || value > 07777 {
+			return 0, fmt.Errorf("'%s' isn't an octal mode from 0 to 7777", mode)
+		}
+		return int(value), nil
+	}
+	result := 0
+	for _, clause := range strings.Split(mode, ",") {
+		who := 0
+		i := 0
+		for ; i < len(clause) && strings.IndexByte("ugoa", clause[i]) >= 0; i++ {
+			who |= modeWho[clause[i]]
+		}
+		if who == 0 {
+			who = modeWho['a']
+		}
+		if i == len(clause) {
+			return 0, fmt.Errorf("'%s' isn't a mode - '%s' needs =, + or -", mode, clause)
+		}
+		for i < len(clause) {
+			op := clause[i]
+			if op != '=' && op != '+' && op != '-' {
+				return 0, fmt.Errorf("'%s' isn't a mode - '%c' isn't =, + or -", mode, op)
+			}
+			bits := 0
+			for i++; i < len(clause) && strings.IndexByte("=+-", clause[i]) < 0; i++ {
+				bit, ok := modePerms[clause[i]]
+				if !ok {
+					return 0, fmt.Errorf("'%s' isn't a mode - '%c' isn't r, w, x, s or t", mode, clause[i])
+				}
+				bits |= bit
+			}
+			bits &= who
+			switch op {
+			case '=':
+				result = result&^who | bits
+			case '+':
+				result |= bits
+			case '-':
+				result &^= bits
+			}
+		}
+	}
+	return result, nil
+}
+
+// modeWho are the bits each of u, g, o and a can change - o includes the
+// sticky bit.
+var modeWho = map[byte]int{'u': 04700, 'g': 02070, 'o': 01007, 'a': 07777}
+
+// modePerms are the bits for each permission - they're masked by who.
+var modePerms = map[byte]int{'r': 0444, 'w': 0222, 'x': 0111, 's': 06000, 't': 01000}
+
+// osFileMode turns a mode like 02750 into an os.FileMode - Go keeps the
+// setuid, setgid and sticky bits apart from the permissions.
+func osFileMode(perms int) os.FileMode {
+	mode := os.FileMode(perms) & os.ModePerm
+	if perms&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if perms&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if perms&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+// unixMode is an os.FileMode as the number chmod uses.
+func unixMode(mode os.FileMode) int {
+	perms := int(mode & os.ModePerm)
+	if mode&os.ModeSetuid != 0 {
+		perms |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		perms |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		perms |= 01000
+	}
+	return perms
+}
+
+// fileModeBits are the parts of a file's mode that --chmod sets.
+const fileModeBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
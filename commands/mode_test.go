@@ -0,0 +1,69 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"github.com/spf13/pflag"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestParseFileMode(t *testing.T) {
+	for mode, expected := range map[string]int{
+		"0640":        0640,
+		"644":         0644,
+		"0o600":       0600,
+		"2750":        02750,
+		"1777":        01777,
+		"u=rw,g=r":    0640,
+		"u=rwx,g=rxs": 02750,
+		"a=r,u+w":     0644,
+		"a=rwx,o-rwx": 0770,
+		"+x":          0111,
+		"o=rwxt":      01007,
+		"u=rw,go=":    0600,
+	} {
+		if value, err := ParseFileMode(mode); err != nil || value != expected {
+			t.Errorf("'%s' should be %04o: %04o %v", mode, expected, value, err)
+		}
+	}
+	for _, mode := range []string{"", "0999", "17777", "u", "u=rwz", "u*rw"} {
+		if _, err := ParseFileMode(mode); err == nil {
+			t.Errorf("'%s' shouldn't be a mode.", mode)
+		}
+	}
+
+	var perms int
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.VarP(newModeValue(0640, &perms), "chmod", "c", "")
+	if err := flags.Parse([]string{"-c", "u=rw,g=rs"}); err != nil || perms != 02640 || flags.Lookup("chmod").Value.String() != "2640" {
+		t.Errorf("--chmod should take a symbolic mode: %04o %v", perms, err)
+	}
+	config := loadTestConfigValues("---\n  chmod: 0600")
+	ConfigFlags(config, flags)
+	if perms != 02640 {
+		t.Errorf("--chmod was passed so the config shouldn't change it: %04o", perms)
+	}
+	flags.Lookup("chmod").Changed = false
+	if ConfigFlags(config, flags); perms != 0600 {
+		t.Errorf("A YAML number should be read as octal: %04o", perms)
+	}
+}
+
+func TestWriteFileMode(t *testing.T) {
+	file := ensureTestFile(t)
+	umask := syscall.Umask(077)
+	defer syscall.Umask(umask)
+
+	if err := WriteFile(exampleData, file, 02754, Owner); err != nil {
+		t.Fatalf("The file should be written: %v", err)
+	}
+	info, err := os.Stat(file)
+	if err != nil || info.Mode()&fileModeBits != 0754|os.ModeSetgid {
+		t.Errorf("The mode shouldn't depend on the umask: %v %v", info.Mode(), err)
+	}
+	if err := checkFileMode(file, 0640); err == nil {
+		t.Error("A mode that doesn't match should be an error.")
+	}
+}
@@ -0,0 +1,86 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/text/unicode/norm"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	// NormalizeEOL is lf or crlf - every line ending is changed to it before
+	// the checksum is computed. Blank leaves them alone.
+	NormalizeEOL string
+
+	// RequireUTF8 stops in when the data isn't valid UTF-8.
+	RequireUTF8 bool
+
+	// NormalizeNFC puts the data in Unicode normalization form C - so the
+	// same text from different editors has the same checksum.
+	NormalizeNFC bool
+)
+
+// ErrNotUTF8 is returned by NormalizeText for data that isn't valid UTF-8.
+var ErrNotUTF8 = errors.New("the data isn't valid UTF-8")
+
+// NormalizeLineEndings changes every CRLF, LF and lone CR in data to eol -
+// lf or crlf.
+func NormalizeLineEndings(data, eol string) string {
+	data = strings.Replace(data, "\r\n", "\n", -1)
+	data = strings.Replace(data, "\r", "\n", -1)
+	if eol == "crlf" {
+		data = strings.Replace(data, "\n", "\r\n", -1)
+	}
+	return data
+}
+
+// NormalizeText checks the data is valid UTF-8 and normalizes it - as
+// requested by --utf8, --nfc and --normalize-eol. NFC needs valid UTF-8 too.
+func NormalizeText(data string, eol string, utf8Only, nfc bool) (string, error) {
+	if utf8Only || nfc {
+		if !utf8.ValidString(data) {
+			line := strings.Count(data[:invalidUTF8(data)], "\n") + 1
+			return "", fmt.Errorf("%w - the first bad byte is on line %d", ErrNotUTF8, line)
+		}
+	}
+	if nfc {
+		data = norm.NFC.String(data)
+	}
+	if eol != "" {
+		data = NormalizeLineEndings(data, eol)
+	}
+	return data, nil
+}
+
+// invalidUTF8 is the offset of the first byte in data that isn't UTF-8.
+func invalidUTF8(data string) int {
+	for i, r := range data {
+		if r == utf8.RuneError {
+			if _, size := utf8.DecodeRuneInString(data[i:]); size == 1 {
+				return i
+			}
+		}
+	}
+	return len(data)
+}
+
+// normalizeInData applies --utf8, --nfc and --normalize-eol - if none of them
+// were passed the data is left as it is.
+func normalizeInData(data string) (string, error) {
+	if NormalizeEOL == "" && !RequireUTF8 && !NormalizeNFC {
+		return data, nil
+	}
+	return NormalizeText(data, NormalizeEOL, RequireUTF8, NormalizeNFC)
+}
+
+// checkNormalizeFlags makes sure --normalize-eol is lf or crlf.
+func checkNormalizeFlags() {
+	if NormalizeEOL != "" && NormalizeEOL != "lf" && NormalizeEOL != "crlf" {
+		fmt.Printf("--normalize-eol should be lf or crlf not '%s'\n", NormalizeEOL)
+		os.Exit(1)
+	}
+}
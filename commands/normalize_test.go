@@ -0,0 +1,40 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeLineEndings(t *testing.T) {
+	mixed := "one\r\ntwo\nthree\rfour\r\n"
+	if data := NormalizeLineEndings(mixed, "lf"); data != "one\ntwo\nthree\nfour\n" {
+		t.Errorf("Every line ending should be LF: %q", data)
+	}
+	if data := NormalizeLineEndings(mixed, "crlf"); data != "one\r\ntwo\r\nthree\r\nfour\r\n" {
+		t.Errorf("Every line ending should be CRLF: %q", data)
+	}
+	if ComputeChecksum(NormalizeLineEndings(strings.Replace(exampleData, "\n", "\r\n", -1), "lf")) != exampleDataSHA {
+		t.Error("A file saved on Windows should have the same checksum once it's normalized.")
+	}
+}
+
+func TestNormalizeText(t *testing.T) {
+	// An e with a combining accent is a single character once it's NFC.
+	data, err := NormalizeText("cafe\u0301\r\n", "lf", false, true)
+	if err != nil || data != "caf\u00e9\n" {
+		t.Errorf("The data should be NFC with LF line endings: %q %v", data, err)
+	}
+	if data, _ := NormalizeText("cafe\u0301\n", "", false, false); data != "cafe\u0301\n" {
+		t.Errorf("Nothing should change without --nfc: %q", data)
+	}
+	_, err = NormalizeText("one\ntwo\xff\n", "", true, false)
+	if !errors.Is(err, ErrNotUTF8) || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Invalid UTF-8 should say which line it's on: %v", err)
+	}
+	if _, err := NormalizeText("two\xff\n", "", false, false); err != nil {
+		t.Errorf("Invalid UTF-8 is fine without --utf8 or --nfc: %v", err)
+	}
+}
@@ -1,11 +1,20 @@
-// +build linux darwin freebsd
+// +build linux darwin freebsd windows
 
 package commands
 
 import (
+	"crypto/ed25519"
+	"errors"
 	"fmt"
+	"github.com/DataDog/kvexpress/pkg/kvexpress"
+	consul "github.com/hashicorp/consul/api"
 	"github.com/spf13/cobra"
+	"io/ioutil"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
 	"time"
 )
 
@@ -22,32 +31,100 @@ var outCmd = &cobra.Command{
 
 func outRun(cmd *cobra.Command, args []string) {
 	start := time.Now()
-
-	KeyData := KeyPath(KeyOutLocation, "data")
-	KeyChecksum := KeyPath(KeyOutLocation, "checksum")
-	KeyStop := KeyPath(KeyOutLocation, "stop")
-	KeyLock := FileLockPath(FiletoWrite)
+	checkRunLock(start, "out", KeyOutLocation)
+	if Recurse {
+		outRecurseRun(start)
+		return
+	}
 
 	c, err := Connect(ConsulServer, Token)
 	if err != nil {
 		LogFatal("Could not connect to Consul.", KeyOutLocation, "consul_connect")
 	}
 
-	LockKeyData := Get(c, KeyLock)
+	// The first key in --key-fallback with good data is used - with
+	// --wait-for-key it waits for the last one.
+	if len(keyFallback) > 0 {
+		KeyOutLocation, err = ResolveKeyFallback(c, keyFallback)
+		if errors.Is(err, ErrNoMoreRetries) {
+			outExitOnError(err, KeyOutLocation, "consul_get", start)
+		}
+		if err != nil && WaitForKeyTimeout == 0 {
+			Log(fmt.Sprintf("fallback='%s' message='%v' - not writing.", KeyFallback, err), "info")
+			fmt.Println(err)
+			exitRun(ExitError, start, KeyOutLocation, "no_fallback_key", "")
+		}
+	}
+
+	KeyStop := StopKeyPath(KeyOutLocation, OutStopKey)
 
-	if LockKeyData != "" {
-		Log(fmt.Sprintf("Lock Key is present - will not update file. Reason: %s", LockKeyData), "info")
-		StatsdLocked(FiletoWrite)
-		RunTime(start, FiletoWrite, "lock_key")
-		os.Exit(0)
+	// On a new host the key might not have been saved yet.
+	if WaitForKeyTimeout > 0 {
+		for _, key := range outKeys() {
+			err := WaitForKey(c, key, WaitForKeyTimeout-time.Since(start))
+			if errors.Is(err, ErrNoMoreRetries) {
+				outExitOnError(err, key, "consul_get", start)
+			}
+			if err != nil {
+				Log(fmt.Sprintf("wait key='%s' message='%v' - not writing.", key, err), "info")
+				fmt.Println(err)
+				exitRun(ExitError, start, key, "wait_timeout", "")
+			}
+		}
+	}
+
+	// A global lock freezes the files on every host.
+	for _, key := range outKeys() {
+		GlobalLockData, err := CheckGlobalLock(c, key)
+		outExitOnError(err, KeyPath(key, "lock"), "consul_get", start)
+		if GlobalLockData != "" {
+			Log(fmt.Sprintf("Global Lock Key is present - will not update any files. Reason: %s", GlobalLockData), "info")
+			StatsdLocked(key)
+			if ddOutEvent(key, "global_lock") {
+				DDLockedEvent(DDAPIConnect(DatadogAPIKey, DatadogAPPKey), key, GlobalLockData)
+			}
+			RunHooks(Hook{Event: HookLock, Key: key, File: strings.Join(FilestoWrite, " "), Message: GlobalLockData})
+			exitRun(ExitLocked, start, key, "global_lock", "")
+		}
+		if key != KeyOutLocation {
+			ddOutEvent(key, "ok")
+		}
+	}
+
+	// Locked files are left alone - if they're all locked there's nothing to do.
+	var targets []OutTarget
+	for i, file := range FilestoWrite {
+		if file == Stdio {
+			targets = append(targets, OutTarget{File: file, Format: FileFormats[i]})
+			continue
+		}
+		LockKeyData, err := CheckLock(c, file)
+		outExitOnError(err, FileLockPath(file), "consul_get", start)
+		if LockKeyData != "" {
+			Log(fmt.Sprintf("Lock Key is present - will not update file '%s'. Reason: %s", file, LockKeyData), "info")
+			StatsdLocked(file)
+			if ddOutEvent(file, "locked") {
+				DDLockedEvent(DDAPIConnect(DatadogAPIKey, DatadogAPPKey), file, LockKeyData)
+			}
+			RunHooks(Hook{Event: HookLock, Key: KeyOutLocation, File: file, Message: LockKeyData})
+			continue
+		}
+		ddOutEvent(file, "ok")
+		targets = append(targets, OutTarget{File: file, Format: FileFormats[i]})
+	}
+	if len(targets) == 0 {
+		exitRun(ExitLocked, start, FiletoWrite, "lock_key", "")
 	}
 
-	StopKeyData := Get(c, KeyStop)
+	StopKeyData, err := Get(c, KeyStop)
+	outExitOnError(err, KeyStop, "consul_get", start)
 
 	if StopKeyData != "" && IgnoreStop == false {
 		Log(fmt.Sprintf("Stop Key is present - stopping. Reason: %s", StopKeyData), "info")
-		RunTime(start, KeyOutLocation, "stop_key")
-		os.Exit(0)
+		if ddOutEvent(KeyOutLocation, "stop") {
+			DDStopEvent(DDAPIConnect(DatadogAPIKey, DatadogAPPKey), KeyStop, StopKeyData)
+		}
+		exitRun(ExitStopped, start, KeyOutLocation, "stop_key", "")
 	} else {
 		if IgnoreStop {
 			Log("Ignoring any stop key.", "info")
@@ -56,67 +133,764 @@ func outRun(cmd *cobra.Command, args []string) {
 		}
 	}
 
-	// Get the KV data out of Consul.
-	KVData := Get(c, KeyData)
+	// A key another tool wrote gets its checksum before it's read.
+	adoptOut(c, start)
 
-	// Decompress here if necessary.
-	if Compress {
-		KVData = DecompressData(KVData)
+	// The hosts in --canary-percent read the canary key while there's one - the
+	// stop key and locks are still the key's - and so is --report-written.
+	reportKey := KeyOutLocation
+	KeyOutLocation, err = CanaryOutKey(c, KeyOutLocation, CanaryPercent)
+	outExitOnError(err, KeyPath(CanaryKey(KeyOutLocation), "checksum"), "consul_get", start)
+	// Data staged with in --activate-at is read once its time has passed.
+	if KeyOutLocation == reportKey && len(OutKeys) == 0 {
+		KeyOutLocation, err = StagedOutKey(c, KeyOutLocation)
+		outExitOnError(err, KeyPath(StagedKey(reportKey), "activate_at"), "consul_get", start)
+	}
+	KeyChecksum := KeyPath(KeyOutLocation, "checksum")
+	KeyRolling := KeyPath(KeyOutLocation, "rolling")
+	KeySignature := KeyPath(KeyOutLocation, "signature")
+
+	// Ignore changes that were made before the cutoff - a change to any of
+	// the keys counts.
+	if OnlyIfChangedSince != "" {
+		changed := false
+		for _, key := range outKeys() {
+			KeyUpdated := KeyPath(key, "updated")
+			Updated, err := Get(c, KeyUpdated)
+			outExitOnError(err, KeyUpdated, "consul_get", start)
+			keyChanged, err := ChangedSince(Updated, changedSinceCutoff)
+			if err != nil {
+				Log(fmt.Sprintf("key='%s' updated='%s' cutoff='%s' message='%v' - not writing.", key, Updated, OnlyIfChangedSince, err), "info")
+				exitRun(ExitError, start, KeyOutLocation, "updated_unknown", "")
+			}
+			changed = changed || keyChanged
+		}
+		if !changed {
+			Log(fmt.Sprintf("cutoff='%s' - change predates the cutoff, not writing.", OnlyIfChangedSince), "info")
+			exitRun(ExitNoChange, start, KeyOutLocation, "changed_before_cutoff", "")
+		}
+	}
+
+	// Data that hasn't been saved in --max-age means the pipeline that saves it
+	// has stopped.
+	if MaxAge > 0 {
+		for _, key := range outKeys() {
+			KeyUpdated := KeyPath(key, "updated")
+			Updated, err := Get(c, KeyUpdated)
+			outExitOnError(err, KeyUpdated, "consul_get", start)
+			age, err := DataAge(Updated, time.Now())
+			tooOld := err != nil || age > MaxAge
+			if err == nil {
+				StatsdDataAge(key, age, tooOld)
+			}
+			if !tooOld {
+				continue
+			}
+			message := fmt.Sprintf("the data in '%s' is %s old - more than --max-age %s", key, age.Round(time.Second), MaxAge)
+			if err != nil {
+				message = fmt.Sprintf("the age of '%s' isn't known: %v", key, err)
+			}
+			if MaxAgeWarn {
+				Log(fmt.Sprintf("max_age='%s' message='%s' - writing it anyway.", MaxAge, message), "warn")
+				continue
+			}
+			Log(fmt.Sprintf("max_age='%s' message='%s' - not writing.", MaxAge, message), "info")
+			fmt.Printf("Not writing - %s\n", message)
+			exitRun(ExitRejected, start, key, "too_old", "")
+		}
+	}
+
+	// The checksum key is small - if every file already has it there's no
+	// reason to download the data.
+	if outShortCircuit() {
+		Checksum, err := GetChecksum(c, KeyOutLocation)
+		outExitOnError(err, KeyChecksum, "consul_get", start)
+		unchanged, err := TargetsUnchanged(targets, Checksum)
+		ExitOnError(err, KeyOutLocation, "write_file")
+		if unchanged {
+			Log(fmt.Sprintf("checksum='%s' short_circuit='true' - not downloading the data.", strings.TrimSpace(Checksum)), "info")
+			RecordResult(0, strings.TrimSpace(Checksum), FilestoWrite...)
+			clearPending(KeyOutLocation)
+			announceOut(c, KeyOutLocation, Checksum, false)
+			reportWrittenOut(c, reportKey, KeyOutLocation, Checksum, targets, false)
+			exitRun(ExitNoChange, start, KeyOutLocation, "checksums_match", "")
+		}
 	}
 
-	// Get the Checksum data out of Consul.
-	Checksum := Get(c, KeyChecksum)
+	// Get the KV data out of Consul - reassembled if it was saved in chunks.
+	KVData, Checksum, err := GetDataSnapshot(c, KeyOutLocation)
+	if errors.Is(err, ErrNoMoreRetries) {
+		outExitOnError(err, KeyOutLocation, "consul_get", start)
+	}
+	if err != nil {
+		Log(fmt.Sprintf("chunks='error' message='%v' - not writing.", err), "info")
+		StatsdChecksum(KeyOutLocation)
+		exitRun(ExitChecksumMismatch, start, KeyOutLocation, "chunk_error", "")
+	}
+
+	// The signature is made with the checksum key - content-addressed data
+	// came with the checksum it was saved with.
+	ContentChecksum := Checksum
+
+	// Decompress here if necessary.
+	KVData, encoding, err := DecodeKeyData(c, KeyOutLocation, KVData)
+	ExitOnError(err, KeyOutLocation, "DecodeData")
+
+	// Get the Checksum data out of Consul - content-addressed data came with
+	// its checksum.
+	if Checksum == "" {
+		Checksum, err = GetChecksum(c, KeyOutLocation)
+		outExitOnError(err, KeyChecksum, "consul_get", start)
+	}
 
 	// Is the data long enough?
-	longEnough := LengthCheck(KVData, MinFileLength)
+	// Binary data doesn't have lines to count.
+	minLength, maxLength := lineLimits(BinaryEncoding(encoding))
+	longEnough := LengthCheck(KVData, minLength)
 	Log(fmt.Sprintf("longEnough='%t'", longEnough), "debug")
 
+	// Is it too large?
+	sizeErr := SizeCheck(KVData, maxLength, MaxFileBytes)
+
 	// Does the checksum match?
 	checksumMatch := ChecksumCompare(KVData, Checksum)
 	Log(fmt.Sprintf("checksumMatch='%t'", checksumMatch), "debug")
+	RecordResult(len(KVData), strings.TrimSpace(Checksum), FilestoWrite...)
+	// A template or --keys changes Checksum to the file's - the key's is announced.
+	AppliedChecksum := Checksum
 
-	// If the data is long enough and the checksum matches, write the file.
-	if longEnough && checksumMatch {
-		// Does the file already present in FiletoWrite have the same checksum?
-		// Is it directory? Does it exist?
-		CheckFiletoWrite(FiletoWrite, Checksum)
+	// If the data is long enough and the checksum matches, write the files.
+	if longEnough && sizeErr == nil && checksumMatch {
+		// The checksum doesn't help if whoever wrote it could have changed the data too.
+		if verifyPublicKey != nil {
+			signed, err := kvexpress.VerifyKey(kvStore{c}, verifyPublicKey, KeyOutLocation, ContentChecksum, KVData)
+			if err != nil && !errors.Is(err, ErrBadSignature) {
+				outExitOnError(err, KeySignature, "consul_get", start)
+			}
+			if err != nil {
+				Log(fmt.Sprintf("signature='invalid' key='%s' message='%v' - not writing.", KeySignature, err), "info")
+				StatsdSignatureInvalid(KeyOutLocation)
+				exitRun(ExitChecksumMismatch, start, KeyOutLocation, "signature_invalid", "")
+			}
+			Log(fmt.Sprintf("signature='valid' signed='%s'", signed.Format(time.RFC3339)), "debug")
+			// The updated key isn't signed - the time in the signature is.
+			if MaxAge > 0 && time.Since(signed) > MaxAge && !MaxAgeWarn {
+				Log(fmt.Sprintf("max_age='%s' signed='%s' - the signature is older than --max-age, not writing.", MaxAge, signed.Format(time.RFC3339)), "info")
+				fmt.Printf("Not writing - the data in '%s' was signed %s ago - more than --max-age %s\n", KeyOutLocation, time.Since(signed).Round(time.Second), MaxAge)
+				exitRun(ExitRejected, start, KeyOutLocation, "too_old", "")
+			}
+		}
+
+		// Every key is checked on its own before they're put together.
+		if len(OutKeys) > 1 {
+			KVData, err = ComposeKeys(c, OutKeys, KeySeparator)
+			if errors.Is(err, ErrNoMoreRetries) {
+				outExitOnError(err, KeyOutLocation, "consul_get", start)
+			}
+			if err != nil {
+				Log(fmt.Sprintf("compose='error' message='%v' - not writing.", err), "info")
+				exitRun(ExitRejected, start, KeyOutLocation, "compose_error", "")
+			}
+			Checksum = ComputeChecksum(KVData)
+		}
+
+		// A truncated upload can have enough lines and still not parse.
+		if ValidateType != "" {
+			if err := ValidateContent(KVData, ValidateType); err != nil {
+				Log(fmt.Sprintf("validate='failed' type='%s' message='%v' - not writing.", ValidateType, err), "info")
+				fmt.Printf("Validation failed - not writing: %v\n", err)
+				StatsdValidateFailed(KeyOutLocation)
+				exitRun(ExitRejected, start, KeyOutLocation, "validate_failed", "")
+			}
+		}
 
-		// Acually write the file.
-		WriteFile(KVData, FiletoWrite, FilePermissions, Owner)
+		// The file is made from the template - not the data - so that's what's compared.
+		var rolling string
+		if outTemplate != nil {
+			// The secrets are read for every render so a rotated one is picked up.
+			if len(VaultPaths) > 0 {
+				if outSecrets, err = VaultSecrets(VaultPaths); err != nil {
+					Log(fmt.Sprintf("vault='error' message='%v'", err), "info")
+					fmt.Printf("Could not read the secrets from Vault: %v\n", err)
+					exitRun(1, start, KeyOutLocation, "vault_error", "")
+				}
+				// They're in the file - but not in the logs.
+				for _, secret := range outSecrets {
+					RedactValues(secret)
+				}
+			}
+			KVData, err = RenderTemplate(c, outTemplate, KeyOutLocation, KVData)
+			if err != nil {
+				Log(fmt.Sprintf("template='error' message='%v'", err), "info")
+				fmt.Printf("Could not render the template: %v\n", err)
+				exitRun(1, start, KeyOutLocation, "template_error", "")
+			}
+			Checksum = ComputeChecksum(KVData)
+		} else if Rolling && len(OutKeys) <= 1 {
+			rolling, err = Get(c, KeyRolling)
+			outExitOnError(err, KeyRolling, "consul_get", start)
+		}
+
+		// Transform the data for every file before writing any of them.
+		targets, err = FormatTargets(targets, KVData)
+		if err != nil {
+			Log(fmt.Sprintf("format='error' message='%v'", err), "info")
+			fmt.Printf("Could not format the data: %v\n", err)
+			exitRun(1, start, KeyOutLocation, "format_error", "")
+		}
+
+		// A new checksum waits for --apply-after and a host in maintenance keeps
+		// its files until it's over.
+		holdOut(c, KeyOutLocation, targets, Checksum, start)
+		deferOut(c, KeyOutLocation, targets, Checksum, start)
+		written, err := WriteTargets(targets, Checksum, rolling)
+		ExitOnError(err, KeyOutLocation, "write_file")
+		// The files have the data - keep it for when Consul can't be reached. Data
+		// that's held back isn't cached, so the cache never gets ahead of the files.
+		if OutCacheDir != "" && !DryRun {
+			if err := SaveCache(OutCacheDir, outCacheName(), KeyOutLocation, KVData); err != nil {
+				Log(fmt.Sprintf("cache='error' message='%v'", err), "info")
+			}
+		}
+		clearPending(KeyOutLocation)
+		// Nothing changed - so there's nothing for PostExec to reload.
+		if written == 0 {
+			Log("All files have the same checksum. Stopping.", "info")
+			ddOutEvent(KeyOutLocation, "ok")
+			announceOut(c, KeyOutLocation, AppliedChecksum, false)
+			reportWrittenOut(c, reportKey, KeyOutLocation, AppliedChecksum, targets, false)
+			exitRun(ExitNoChange, start, KeyOutLocation, "checksums_match", "")
+		}
 		StatsdOut(KeyOutLocation)
+		// Writing the files is a change every time.
+		ddOutEvent(KeyOutLocation, "ok")
+		if DatadogAPIKey != "" && DatadogAPPKey != "" {
+			DDWriteEvent(DDAPIConnect(DatadogAPIKey, DatadogAPPKey), KeyOutLocation, FilestoWrite)
+		}
 	} else {
+		// Every check that failed is one state - so the events for them are
+		// sent together once.
+		var failed []string
+		for check, ok := range map[string]bool{"not_long_enough": longEnough, "too_large": sizeErr == nil, "checksum_mismatch": checksumMatch} {
+			if !ok {
+				failed = append(failed, check)
+			}
+		}
+		sort.Strings(failed)
+		send := ddOutEvent(KeyOutLocation, strings.Join(failed, ","))
 		if !longEnough {
 			Log("longEnough='no'", "info")
 			StatsdLength(KeyOutLocation)
+			if send {
+				DDLengthEvent(DDAPIConnect(DatadogAPIKey, DatadogAPPKey), KeyOutLocation, fmt.Sprintf("%d lines - need %d", LineCount(KVData), MinFileLength))
+			}
+		}
+		if sizeErr != nil {
+			Log(fmt.Sprintf("tooLarge='yes' message='%v'", sizeErr), "info")
+			StatsdTooLarge(KeyOutLocation)
+			if send {
+				DDTooLargeEvent(DDAPIConnect(DatadogAPIKey, DatadogAPPKey), KeyOutLocation, sizeErr.Error())
+			}
 		}
 		if !checksumMatch {
 			Log("checksumMismatch='yes'", "info")
 			StatsdChecksum(KeyOutLocation)
+			if send {
+				DDChecksumEvent(DDAPIConnect(DatadogAPIKey, DatadogAPPKey), KeyOutLocation, Checksum)
+			}
+			exitRun(ExitChecksumMismatch, start, KeyOutLocation, "checks_failed", strings.Join(failed, ","))
 		}
-		os.Exit(0)
+		exitRun(ExitRejected, start, KeyOutLocation, "checks_failed", strings.Join(failed, ","))
 	}
 
-	// Run this command after the file is written.
+	// Run this command after the files are written.
 	if PostExec != "" {
 		Log(fmt.Sprintf("exec='%s'", PostExec), "debug")
-		RunCommand(PostExec)
+		if status := RunPostExec(PostExec); status != 0 {
+			exitExecFailed(status, KeyOutLocation)
+		}
 	}
+	if status := RunHooks(Hook{Event: HookChange, Key: KeyOutLocation, File: strings.Join(FilestoWrite, " ")}); status != 0 {
+		exitExecFailed(status, KeyOutLocation)
+	}
+	announceOut(c, KeyOutLocation, AppliedChecksum, true)
+	reportWrittenOut(c, reportKey, KeyOutLocation, AppliedChecksum, targets, true)
 	RunTime(start, KeyOutLocation, "complete")
 }
 
+// outRecurseRun mirrors every key underneath KeyOutLocation into RecurseDir.
+func outRecurseRun(start time.Time) {
+	KeyStop := StopKeyPath(KeyOutLocation, OutStopKey)
+
+	c, err := Connect(ConsulServer, Token)
+	if err != nil {
+		LogFatal("Could not connect to Consul.", KeyOutLocation, "consul_connect")
+	}
+
+	StopKeyData, err := Get(c, KeyStop)
+	ExitOnError(err, KeyStop, "consul_get")
+	if StopKeyData != "" && !IgnoreStop {
+		Log(fmt.Sprintf("Stop Key is present - stopping. Reason: %s", StopKeyData), "info")
+		if ddOutEvent(KeyOutLocation, "stop") {
+			DDStopEvent(DDAPIConnect(DatadogAPIKey, DatadogAPPKey), KeyStop, StopKeyData)
+		}
+		exitRun(ExitStopped, start, KeyOutLocation, "stop_key", "")
+	}
+
+	summary, err := SyncDir(c, KeyOutLocation, RecurseDir)
+	if errors.Is(err, ErrTooManyRemoved) {
+		fmt.Printf("Not syncing '%s': %v\n", RecurseDir, err)
+		StatsdChangeTooLarge(KeyOutLocation)
+		exitRun(ExitRejected, start, KeyOutLocation, "change_too_large", "")
+	}
+	ExitOnError(err, KeyOutLocation, "sync_dir")
+	Log(fmt.Sprintf("sync key='%s' dir='%s' written='%d' unchanged='%d' removed='%d' skipped='%d'", KeyOutLocation, RecurseDir, summary.Written, summary.Unchanged, summary.Removed, summary.Skipped), "info")
+	StatsdSync(KeyOutLocation, summary)
+	if !summary.Changed() {
+		ddOutEvent(KeyOutLocation, "ok")
+		exitRun(ExitNoChange, start, KeyOutLocation, "checksums_match", "")
+	}
+	StatsdOut(KeyOutLocation)
+	ddOutEvent(KeyOutLocation, "ok")
+	if DatadogAPIKey != "" && DatadogAPPKey != "" {
+		DDWriteEvent(DDAPIConnect(DatadogAPIKey, DatadogAPPKey), KeyOutLocation, []string{RecurseDir})
+	}
+	if PostExec != "" {
+		Log(fmt.Sprintf("exec='%s'", PostExec), "debug")
+		if status := RunPostExec(PostExec); status != 0 {
+			exitExecFailed(status, KeyOutLocation)
+		}
+	}
+	if status := RunHooks(Hook{Event: HookChange, Key: KeyOutLocation, File: RecurseDir}); status != 0 {
+		exitExecFailed(status, KeyOutLocation)
+	}
+	RunTime(start, KeyOutLocation, "complete")
+}
+
+// WriteTargets writes each formatted target that has changed and returns how
+// many were written. Raw targets are checked against the Consul checksum and
+// can be appended to when there's a rolling hash. Every file that changed is
+// written to its temp file and checked before any of them are renamed into
+// place - so the files are updated as a group and one that can't be written
+// leaves them all the way they were.
+func WriteTargets(targets []OutTarget, checksum, rolling string) (int, error) {
+	var pending []pendingTarget
+	discard := func(pending []pendingTarget) {
+		for _, p := range pending {
+			p.discard()
+		}
+	}
+	for _, target := range targets {
+		// There's nothing to compare stdout with - it always gets the data.
+		if target.File == Stdio {
+			pending = append(pending, pendingTarget{target: target})
+			continue
+		}
+		raw := target.Format == "" || target.Format == "raw"
+
+		// If the data only grew - append the new part rather than rewriting the file.
+		// It's only read once it's known to be a regular file - a FIFO would
+		// block - and a symlink that isn't followed is replaced, not appended to.
+		if raw && rolling != "" {
+			file, err := ResolveWriteFile(target.File)
+			if err != nil {
+				discard(pending)
+				return 0, err
+			}
+			if info, err := os.Lstat(file); err == nil && info.Mode().IsRegular() {
+				local := ReadFile(file)
+				if AppendOnlyChange(local, target.Output, rolling) {
+					Log(fmt.Sprintf("rolling='append_only' rewrite='false' file='%s'", file), "info")
+					if err := checkAppend(target.Output, file); err != nil {
+						discard(pending)
+						return 0, err
+					}
+					pending = append(pending, pendingTarget{target: target, local: local, appendOnly: true, appendFile: file, rolling: rolling})
+					continue
+				}
+			}
+		}
+
+		targetChecksum := checksum
+		if !raw {
+			targetChecksum = ComputeChecksum(target.Output)
+		}
+		// Does the file already present have the same checksum?
+		// Is it directory? Does it exist?
+		matches, err := FileChecksumMatches(target.File, targetChecksum)
+		if err != nil {
+			discard(pending)
+			return 0, err
+		}
+		if matches {
+			Log(fmt.Sprintf("'%s' has the same checksum.", target.File), "info")
+			continue
+		}
+		p, err := stageTarget(target)
+		if err != nil {
+			discard(pending)
+			return 0, err
+		}
+		pending = append(pending, p)
+	}
+
+	return writePending(pending)
+}
+
+// writePending puts every pending target in place. If one of them can't be,
+// the ones that were already written are put back the way they were - stdout
+// can't be taken back, so it's written once every file is.
+func writePending(pending []pendingTarget) (int, error) {
+	var ordered []pendingTarget
+	for _, p := range pending {
+		if p.target.File != Stdio {
+			ordered = append(ordered, p)
+		}
+	}
+	for _, p := range pending {
+		if p.target.File == Stdio {
+			ordered = append(ordered, p)
+		}
+	}
+	var done []pendingTarget
+	for i := range ordered {
+		p := &ordered[i]
+		if err := p.write(); err != nil {
+			for _, rest := range ordered[i+1:] {
+				rest.discard()
+			}
+			for j := len(done) - 1; j >= 0; j-- {
+				if rollbackErr := done[j].rollback(); rollbackErr != nil {
+					Log(fmt.Sprintf("file='%s' rollback='failed' message='%v'", done[j].path(), rollbackErr), "error")
+				}
+			}
+			return 0, err
+		}
+		done = append(done, *p)
+	}
+	return len(done), nil
+}
+
+// pendingTarget is a target WriteTargets is going to write - a file that's
+// been staged, an append or stdout.
+type pendingTarget struct {
+	target     OutTarget
+	local      string
+	appendOnly bool
+	appendFile string
+	rolling    string
+	staged     stagedFile
+	skip       bool
+
+	// previous is the file this replaced - so it can be put back if another
+	// target can't be written. wrote is false until it's on disk.
+	previous     []byte
+	previousMode os.FileMode
+	existed      bool
+	wrote        bool
+
+	oldChecksum string
+	oldSize     int
+	span        *Span
+}
+
+// stageTarget writes the target's temp file - with --dry-run it only says
+// what would be written.
+func stageTarget(target OutTarget) (pendingTarget, error) {
+	p := pendingTarget{target: target}
+	if p.skip = DryRunSkip(fmt.Sprintf("write %d bytes to '%s'", len(target.Output), target.File)); p.skip {
+		return p, nil
+	}
+	p.oldChecksum, p.oldSize = auditState(target.File)
+	p.span = StartSpan("file.write", "kvexpress.file", target.File, "kvexpress.bytes", strconv.Itoa(len(target.Output)))
+	staged, err := stageFile(target.Output, target.File, FilePermissions, Owner, CheckExec)
+	if err != nil {
+		p.span.Finish(err)
+		AuditFileWrite(KeyOutLocation, target.File, p.oldChecksum, p.oldSize, target.Output, err)
+		return p, err
+	}
+	p.staged = staged
+	return p, nil
+}
+
+// write puts the target in place.
+func (p *pendingTarget) write() error {
+	target := p.target
+	switch {
+	case target.File == Stdio:
+		if !DryRunSkip(fmt.Sprintf("write %d bytes to stdout", len(target.Output))) {
+			if _, err := dataStdout().WriteString(target.Output); err != nil {
+				return err
+			}
+		}
+	case p.appendOnly:
+		if !DryRunSkip(fmt.Sprintf("append %d bytes to '%s'", len(target.Output)-len(p.local), target.File)) {
+			if err := backupTarget(p.appendFile); err != nil {
+				return err
+			}
+			if err := p.keepPrevious(); err != nil {
+				return err
+			}
+			err := AppendFile(target.Output, p.appendFile, len(p.local), p.rolling, FilePermissions, Owner)
+			AuditFileWrite(KeyOutLocation, target.File, ComputeChecksum(p.local), len(p.local), target.Output, err)
+			if err != nil {
+				return err
+			}
+			p.wrote = true
+		}
+	case !p.skip:
+		if err := backupTarget(target.File); err != nil {
+			p.discard()
+			return err
+		}
+		if err := p.keepPrevious(); err != nil {
+			p.discard()
+			return err
+		}
+		err := p.staged.commit()
+		p.span.Finish(err)
+		AuditFileWrite(KeyOutLocation, target.File, p.oldChecksum, p.oldSize, target.Output, err)
+		if err != nil {
+			return err
+		}
+		p.wrote = true
+	}
+	return nil
+}
+
+// path is the file the target writes - blank for stdout.
+func (p pendingTarget) path() string {
+	if p.appendOnly {
+		return p.appendFile
+	}
+	return p.staged.file
+}
+
+// keepPrevious reads the file the target is about to replace. An append
+// already has it in local.
+func (p *pendingTarget) keepPrevious() error {
+	if p.appendOnly {
+		p.existed = true
+		return nil
+	}
+	info, err := os.Stat(p.path())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	previous, err := ioutil.ReadFile(p.path())
+	if err != nil {
+		return err
+	}
+	p.previous, p.previousMode, p.existed = previous, info.Mode().Perm(), true
+	return nil
+}
+
+// rollback puts back the file the target replaced - or removes it if there
+// wasn't one. An append is truncated back to where it started.
+func (p pendingTarget) rollback() error {
+	if !p.wrote {
+		return nil
+	}
+	file := p.path()
+	Log(fmt.Sprintf("file='%s' rollback='true' existed='%t'", file, p.existed), "info")
+	if !p.existed {
+		return os.Remove(file)
+	}
+	if p.appendOnly {
+		return os.Truncate(file, int64(len(p.local)))
+	}
+	staged, err := stageFile(string(p.previous), file, int(p.previousMode), Owner, "")
+	if err != nil {
+		return err
+	}
+	return staged.commit()
+}
+
+// discard removes the target's temp file.
+func (p pendingTarget) discard() {
+	if p.staged.tmp != "" {
+		p.staged.discard()
+		p.span.Finish(errors.New("not written"))
+	}
+}
+
+// outShortCircuit is true when the files are the data as it is - so a file
+// with the same checksum as the checksum key won't be written. A template,
+// --keys, a rolling hash, --verify-key and --cache-dir all need the data.
+func outShortCircuit() bool {
+	return outTemplate == nil && len(OutKeys) <= 1 && !Rolling && verifyPublicKey == nil && OutCacheDir == ""
+}
+
+// TargetsUnchanged is true if every target is a raw file that already matches
+// checksum. Stdout and the other formats always need the data.
+func TargetsUnchanged(targets []OutTarget, checksum string) (bool, error) {
+	if strings.TrimSpace(checksum) == "" {
+		return false, nil
+	}
+	for _, target := range targets {
+		if target.File == Stdio || (target.Format != "" && target.Format != "raw") {
+			return false, nil
+		}
+		matches, err := FileChecksumMatches(target.File, checksum)
+		if err != nil || !matches {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// backupTarget keeps --backups copies of a file before it's changed.
+func backupTarget(file string) error {
+	if Backups <= 0 {
+		return nil
+	}
+	return BackupFile(file, Backups)
+}
+
 func checkOutFlags() {
 	Log("Checking cli flags.", "debug")
+	if len(OutKeys) > 0 {
+		if KeyOutLocation != "" || Recurse {
+			fmt.Println("You can only use one of -k, --keys and --recurse.")
+			os.Exit(1)
+		}
+		KeyOutLocation = OutKeys[0]
+	}
+	if KeyFallback != "" {
+		if KeyOutLocation != "" || Recurse {
+			fmt.Println("You can only use one of -k, --keys, --recurse and --key-fallback.")
+			os.Exit(1)
+		}
+		keys, err := ExpandKeyFallback(KeyFallback, GetHostname(), HostRole)
+		if err != nil {
+			fmt.Printf("Bad --key-fallback: %v\n", err)
+			os.Exit(1)
+		}
+		keyFallback = keys
+		// It's replaced with the key that's used once Consul has been checked.
+		KeyOutLocation = keys[0]
+	}
+	// Let --separator '\n' mean a newline.
+	if separator, err := strconv.Unquote(`"` + KeySeparator + `"`); err == nil {
+		KeySeparator = separator
+	}
 	if KeyOutLocation == "" {
 		fmt.Println("Need a key location in -k")
 		os.Exit(1)
 	}
-	if FiletoWrite == "" {
+	if CanaryPercent < 0 || CanaryPercent > 100 {
+		fmt.Println("Need a --canary-percent from 0 to 100")
+		os.Exit(1)
+	}
+	if CanaryPercent > 0 && (len(OutKeys) > 0 || Recurse) {
+		fmt.Println("--canary-percent only works with a single key in -k")
+		os.Exit(1)
+	}
+	if MaxAgeWarn && MaxAge <= 0 {
+		fmt.Println("--max-age-warn needs a --max-age")
+		os.Exit(1)
+	}
+	if OutCacheMaxAge != 0 && (OutCacheDir == "" || OutCacheMaxAge < 0) {
+		fmt.Println("--cache-max-age needs a --cache-dir and a duration that's more than 0")
+		os.Exit(1)
+	}
+	checkValidateFlag()
+	checkMaintenanceFlags()
+	if ApplyAfter < 0 {
+		fmt.Println("Need an --apply-after that's 0 or more")
+		os.Exit(1)
+	}
+	if Recurse {
+		checkOutRecurseFlags()
+	} else if len(FilestoWrite) == 0 {
 		fmt.Println("Need a file to write in -f")
 		os.Exit(1)
+	} else if OutParallel != 1 {
+		fmt.Println("--parallel only works with --recurse")
+		os.Exit(1)
+	}
+	if len(FileFormats) == 0 {
+		FileFormats = make([]string, len(FilestoWrite))
+	}
+	if len(FileFormats) != len(FilestoWrite) {
+		fmt.Println("Need a --format for every -f")
+		os.Exit(1)
+	}
+	for i, file := range FilestoWrite {
+		if file != Stdio {
+			ExitOnError(CheckAllowedDir(file), file, "check_flags")
+		} else if OutputFormat == "json" {
+			// The data and the result would both be on stdout.
+			fmt.Println("Can't write to stdout with -f - and --output json.")
+			os.Exit(1)
+		} else {
+			stdoutData = true
+		}
+		if FileFormats[i] == "" {
+			FileFormats[i] = "raw"
+		}
+		if !ValidFormat(FileFormats[i]) {
+			fmt.Printf("Unknown format '%s' - use one of: %v\n", FileFormats[i], outputFormats)
+			os.Exit(1)
+		}
+	}
+	if OnlyIfChangedSince != "" {
+		cutoff, err := time.Parse(time.RFC3339, OnlyIfChangedSince)
+		if err != nil {
+			fmt.Println("Need an RFC3339 time in --only-if-changed-since")
+			os.Exit(1)
+		}
+		changedSinceCutoff = cutoff
+	}
+	if VerifyKey != "" {
+		key, err := LoadVerifyKey(VerifyKey)
+		if err != nil {
+			fmt.Printf("Could not load --verify-key: %v\n", err)
+			os.Exit(1)
+		}
+		verifyPublicKey = key
+	}
+	if TemplateFile != "" {
+		tmpl, err := ParseTemplate(TemplateFile)
+		if err != nil {
+			fmt.Printf("Could not load --template: %v\n", err)
+			os.Exit(1)
+		}
+		outTemplate = tmpl
+	}
+	if len(VaultPaths) > 0 && TemplateFile == "" {
+		fmt.Println("Need a --template to put the --vault-path secrets in.")
+		os.Exit(1)
+	}
+	if len(FilestoWrite) > 0 {
+		FiletoWrite = FilestoWrite[0]
 	}
 	Log("Required cli flags present.", "debug")
 }
 
+func checkOutRecurseFlags() {
+	if RecurseDir == "" {
+		fmt.Println("Need a directory to write to in --dir")
+		os.Exit(1)
+	}
+	if len(FilestoWrite) > 0 || len(FileFormats) > 0 || TemplateFile != "" || WaitForKeyTimeout > 0 || OutCacheDir != "" || MaxAge > 0 || AnnounceKey != "" || ReportWritten || len(MaintenanceWindows) > 0 || NodeMaintenance || ApplyAfter != 0 || Adopt {
+		fmt.Println("You cannot use -f, --format, --template, --wait-for-key, --cache-dir, --max-age, --announce-key, --report-written, --maintenance-window, --node-maintenance, --apply-after or --adopt with --recurse.")
+		os.Exit(1)
+	}
+	if OutParallel < 1 {
+		fmt.Println("Need a --parallel that's 1 or more")
+		os.Exit(1)
+	}
+	if info, err := os.Stat(RecurseDir); err != nil || !info.IsDir() {
+		fmt.Printf("'%s' is not a directory.\n", RecurseDir)
+		os.Exit(1)
+	}
+	ExitOnError(CheckAllowedDir(RecurseDir), RecurseDir, "check_flags")
+}
+
 var (
 	// KeyOutLocation This Consul key is the location we want to pull data from.
 	// This data MUST be in the standard kvexpress structure of:
@@ -125,15 +899,195 @@ var (
 	KeyOutLocation string
 
 	// FiletoWrite is the location we want to write the data to.
+	// When more than one file is passed it's the first one.
 	FiletoWrite string
 
+	// FilestoWrite are all of the locations we want to write the data to.
+	FilestoWrite []string
+
+	// FileFormats are the formats for each of FilestoWrite - raw if not passed.
+	FileFormats []string
+
+	// Backups is how many old copies of each file are kept as file.1, file.2
+	// and so on - 0 keeps none.
+	Backups int
+
 	// IgnoreStop is a special command to pull data EVEN if there's a stop key present.
 	IgnoreStop bool
+
+	// OutStopKey is the full path of the stop key to check before writing.
+	// Defaults to /PrefixLocation/KeyOutLocation/stop - one key can stop many files.
+	OutStopKey string
+
+	// WaitForKeyTimeout is how long out waits for the key to be saved and pass
+	// the checks before it gives up - 0 doesn't wait.
+	WaitForKeyTimeout time.Duration
+
+	// OnlyIfChangedSince is an RFC3339 time - changes made before it are not written.
+	OnlyIfChangedSince string
+
+	// changedSinceCutoff is OnlyIfChangedSince once it's been parsed.
+	changedSinceCutoff time.Time
+
+	// MaxAge is how old the updated key can be before out won't write the
+	// data - 0 doesn't check.
+	MaxAge time.Duration
+
+	// MaxAgeWarn writes data that's older than MaxAge anyway - with a warning
+	// and the too_old metric.
+	MaxAgeWarn bool
+
+	// VerifyKey is an ed25519 public key - the data is only written if it was
+	// signed with the matching --sign-key.
+	VerifyKey string
+
+	// CheckExec checks each new file before it replaces the old one - %f is
+	// the temp file.
+	CheckExec string
+
+	// verifyPublicKey is VerifyKey once it's been loaded.
+	verifyPublicKey ed25519.PublicKey
+
+	// OutKeys are the keys that are put together into each file - the first one
+	// is KeyOutLocation.
+	OutKeys []string
+
+	// KeySeparator goes between each of OutKeys.
+	KeySeparator string
+
+	// TemplateFile is a text/template the data is rendered with before it's
+	// written.
+	TemplateFile string
+
+	// outTemplate is TemplateFile once it's been parsed.
+	outTemplate *template.Template
+
+	// VaultPaths are the Vault KV secrets a template can use.
+	VaultPaths []string
+
+	// outSecrets are the secrets in VaultPaths.
+	outSecrets map[string]string
 )
 
+// outKeys are all of the keys that are written - just KeyOutLocation without
+// --keys.
+func outKeys() []string {
+	if len(OutKeys) > 0 {
+		return OutKeys
+	}
+	return []string{KeyOutLocation}
+}
+
+// ComposeKeys returns the data from every key joined with separator. Each key
+// is checked on its own with GetVerifiedData.
+func ComposeKeys(c *consul.Client, keys []string, separator string) (string, error) {
+	var parts []string
+	for _, key := range keys {
+		data, err := GetVerifiedData(c, key)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, data)
+	}
+	return strings.Join(parts, separator), nil
+}
+
+// WaitForKey blocks until the data in key passes the length and checksum
+// checks - or timeout runs out. Consul blocking queries are used so it returns
+// as soon as the key is saved.
+func WaitForKey(c *consul.Client, key string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	var index uint64
+	for {
+		data, err := GetVerifiedData(c, key)
+		if err == nil && data == "" {
+			err = fmt.Errorf("there's no data in '%s'", key)
+		}
+		if err == nil || errors.Is(err, ErrNoMoreRetries) {
+			return err
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("gave up waiting for '%s': %v", key, err)
+		}
+		Log(fmt.Sprintf("wait key='%s' message='%v' remaining='%s'", key, err, remaining.Round(time.Second)), "info")
+		// etcd and ZooKeeper don't have blocking queries - check again every second.
+		if !canWait() {
+			if remaining > time.Second {
+				remaining = time.Second
+			}
+			time.Sleep(remaining)
+			continue
+		}
+		newIndex, err := Wait(c, KeyRoot(key), index, remaining)
+		if err != nil {
+			return err
+		}
+		// The index can go backwards if Consul's state is restored - start over.
+		if newIndex < index {
+			newIndex = 0
+		}
+		index = newIndex
+	}
+}
+
+// DataAge is how long ago the RFC3339 time from the `updated` key was.
+func DataAge(updated string, now time.Time) (time.Duration, error) {
+	if strings.TrimSpace(updated) == "" {
+		return 0, fmt.Errorf("there is no updated time for the key")
+	}
+	updatedTime, err := time.Parse(time.RFC3339, strings.TrimSpace(updated))
+	if err != nil {
+		return 0, fmt.Errorf("could not parse the updated time: %v", err)
+	}
+	return now.Sub(updatedTime), nil
+}
+
+// ChangedSince compares the RFC3339 time from the `updated` key with the cutoff
+// and returns true if the change was made at or after the cutoff.
+func ChangedSince(updated string, cutoff time.Time) (bool, error) {
+	if updated == "" {
+		return false, fmt.Errorf("there is no updated time for the key")
+	}
+	updatedTime, err := time.Parse(time.RFC3339, strings.TrimSpace(updated))
+	if err != nil {
+		return false, fmt.Errorf("could not parse the updated time: %v", err)
+	}
+	return !updatedTime.Before(cutoff), nil
+}
+
 func init() {
 	RootCmd.AddCommand(outCmd)
 	outCmd.Flags().StringVarP(&KeyOutLocation, "key", "k", "", "key to pull data from")
-	outCmd.Flags().StringVarP(&FiletoWrite, "file", "f", "", "where to write the data")
+	outCmd.Flags().StringSliceVarP(&OutKeys, "keys", "", []string{}, "keys to put together into one file - key1,key2,key3")
+	outCmd.Flags().StringVarP(&KeySeparator, "separator", "", "", "what goes between each of --keys")
+	outCmd.Flags().StringArrayVarP(&FilestoWrite, "file", "f", []string{}, "where to write the data - or - for stdout (repeatable)")
+	outCmd.Flags().StringVarP(&ValidateType, "validate", "", "", "check that the data is valid json, yaml or csv before writing")
+	outCmd.Flags().StringArrayVarP(&FileFormats, "format", "", []string{}, "format for each file: raw, json, env-file, dotenv or systemd-dropin (repeatable)")
+	outCmd.Flags().BoolVarP(&Recurse, "recurse", "", false, "write every key underneath -k to a file in --dir")
+	outCmd.Flags().StringVarP(&RecurseDir, "dir", "", "", "directory to mirror the keys into with --recurse")
+	outCmd.Flags().Float64VarP(&MaxRemoveRatio, "max-remove-ratio", "", 0.5, "stop --recurse if it would remove more than this fraction of the files it wrote - 0 is off")
+	outCmd.Flags().IntVarP(&OutParallel, "parallel", "", 1, "keys to write at once with --recurse")
+	outCmd.Flags().StringVarP(&OutCacheDir, "cache-dir", "", "", "save the last good data here and use it when Consul can't be reached")
+	outCmd.Flags().DurationVarP(&OutCacheMaxAge, "cache-max-age", "", 0, "don't use a --cache-dir cache that was saved longer ago than this - 0 for no limit")
+	outCmd.Flags().IntVarP(&Backups, "backups", "", 0, "old copies of each file to keep as <file>.1, <file>.2...")
 	outCmd.Flags().BoolVarP(&IgnoreStop, "ignore_stop", "", false, "ignore stop key")
+	outCmd.Flags().StringVarP(&OutStopKey, "stop-key", "", "", "stop key to check (default <prefix>/<key>/stop)")
+	outCmd.Flags().DurationVarP(&WaitForKeyTimeout, "wait-for-key", "", 0, "wait this long for the key to be saved and pass the checks")
+	outCmd.Flags().DurationVarP(&MaxAge, "max-age", "", 0, "don't write data that was saved longer ago than this")
+	outCmd.Flags().BoolVarP(&MaxAgeWarn, "max-age-warn", "", false, "write data older than --max-age anyway - with a warning and a metric")
+	outCmd.Flags().StringVarP(&OnlyIfChangedSince, "only-if-changed-since", "", "", "only write changes made after this RFC3339 time")
+	outCmd.Flags().StringVarP(&TemplateFile, "template", "", "", "text/template file to render the data with")
+	outCmd.Flags().StringArrayVarP(&VaultPaths, "vault-path", "", []string{}, "Vault KV secret for the template's vault function (repeatable)")
+	outCmd.Flags().StringVarP(&VerifyKey, "verify-key", "", "", "ed25519 public key the data has to be signed with")
+	outCmd.Flags().StringVarP(&CheckExec, "check-exec", "", "", "command to check the new file before it replaces the old one - %f is its path")
+	outCmd.Flags().StringVarP(&KeyFallback, "key-fallback", "", "", "keys to try in order - the first with good data is written - %h is the hostname and %r is --role")
+	outCmd.Flags().StringVarP(&HostRole, "role", "", "", "this host's role for %r in --key-fallback")
+	outCmd.Flags().IntVarP(&CanaryPercent, "canary-percent", "", 0, "percent of hosts that read <key>/canary while it has data")
+	outCmd.Flags().BoolVarP(&Adopt, "adopt", "", false, "save the checksum and meta keys for a key another tool wrote if it doesn't have them")
+	outCmd.Flags().StringVarP(&AnnounceKey, "announce-key", "", "", "save the checksum this host applied in <prefix>/_applied/<key>/<hostname>")
+	outCmd.Flags().BoolVarP(&ReportWritten, "report-written", "", false, "save the checksum and mtime of each file written in <prefix>/_written/<key>/<hostname>")
+	outCmd.Flags().StringArrayVarP(&MaintenanceWindows, "maintenance-window", "", []string{}, "don't replace files during this time of day - like '02:00-04:00 UTC' (repeatable)")
+	outCmd.Flags().BoolVarP(&NodeMaintenance, "node-maintenance", "", false, "don't replace files while the Consul node is in maintenance mode")
+	outCmd.Flags().DurationVarP(&ApplyAfter, "apply-after", "", 0, "only write a new checksum once it's been the same for this long")
 }
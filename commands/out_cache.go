@@ -0,0 +1,131 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	// OutCacheDir is where out saves the last data it wrote - it's used when
+	// Consul can't be reached.
+	OutCacheDir string
+
+	// OutCacheMaxAge is how old a cache can be and still be used - 0 for no
+	// limit.
+	OutCacheMaxAge time.Duration
+)
+
+// CachedData is the last good data for a file - the data is what was written
+// after keys were put together and templates rendered.
+type CachedData struct {
+	Key      string `json:"key"`
+	Checksum string `json:"checksum"`
+	Data     string `json:"data"`
+	Saved    string `json:"saved"`
+}
+
+// CachePath is where the data for name is cached in dir.
+func CachePath(dir, name string) string {
+	return filepath.Join(dir, url.PathEscape(name)+".json")
+}
+
+// SaveCache saves the data that's about to be written for name.
+func SaveCache(dir, name, key, data string) error {
+	cached := CachedData{Key: key, Checksum: ComputeChecksum(data), Data: data, Saved: time.Now().UTC().Format(time.RFC3339)}
+	encoded, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// The data can be secret - only the owner can read it.
+	return WriteFile(string(encoded), CachePath(dir, name), 0600, Owner)
+}
+
+// LoadCache returns the cached data for name if it still matches its checksum
+// and was saved less than maxAge ago - 0 for any age.
+func LoadCache(dir, name string, maxAge time.Duration) (CachedData, error) {
+	var cached CachedData
+	content, err := ioutil.ReadFile(CachePath(dir, name))
+	if err != nil {
+		return cached, err
+	}
+	if err := json.Unmarshal(content, &cached); err != nil {
+		return cached, fmt.Errorf("could not read the cache for '%s': %v", name, err)
+	}
+	if ComputeChecksum(cached.Data) != cached.Checksum {
+		return cached, fmt.Errorf("the cache for '%s' does not match its checksum", name)
+	}
+	if maxAge > 0 {
+		saved, err := time.Parse(time.RFC3339, cached.Saved)
+		if err != nil {
+			return cached, fmt.Errorf("the cache for '%s' doesn't say when it was saved", name)
+		}
+		if age := time.Since(saved); age > maxAge {
+			return cached, fmt.Errorf("the cache for '%s' was saved %s ago - more than --cache-max-age %s", name, age.Round(time.Second), maxAge)
+		}
+	}
+	return cached, nil
+}
+
+// outCacheName is what out's data is cached as - the first file, or the key
+// when it's written to stdout.
+func outCacheName() string {
+	if FiletoWrite == Stdio {
+		return KeyOutLocation
+	}
+	return FiletoWrite
+}
+
+// outExitOnError is ExitOnError for out's Consul reads - if Consul couldn't be
+// reached and there's a --cache-dir it serves the cached data instead.
+func outExitOnError(err error, id, location string, start time.Time) {
+	if OutCacheDir != "" && errors.Is(err, ErrNoMoreRetries) {
+		serveCache(start, err)
+	}
+	ExitOnError(err, id, location)
+}
+
+// serveCache leaves the files that are already there alone and writes the ones
+// that are missing - like on a new host - from the cache. It exits
+// ExitConsulError either way. If there's no good cache it returns.
+func serveCache(start time.Time, consulErr error) {
+	cached, err := LoadCache(OutCacheDir, outCacheName(), OutCacheMaxAge)
+	if err != nil {
+		Log(fmt.Sprintf("cache='error' message='%v'", err), "info")
+		return
+	}
+	Log(fmt.Sprintf("consul='unreachable' message='%v' cache='%s' saved='%s' - serving stale data.", consulErr, CachePath(OutCacheDir, outCacheName()), cached.Saved), "info")
+	StatsdServingStale(KeyOutLocation)
+	var missing []OutTarget
+	for i, file := range FilestoWrite {
+		if _, err := os.Stat(file); err == nil && file != Stdio {
+			Log(fmt.Sprintf("file='%s' stale='true' - leaving it alone.", file), "info")
+			continue
+		}
+		missing = append(missing, OutTarget{File: file, Format: FileFormats[i]})
+	}
+	missing, err = FormatTargets(missing, cached.Data)
+	ExitOnError(err, KeyOutLocation, "format_cache")
+	written, err := WriteTargets(missing, cached.Checksum, "")
+	ExitOnError(err, KeyOutLocation, "write_cache")
+	RecordResult(len(cached.Data), cached.Checksum, FilestoWrite...)
+	if written > 0 {
+		if PostExec != "" {
+			Log(fmt.Sprintf("exec='%s'", PostExec), "debug")
+			RunPostExec(PostExec)
+		}
+		RunHooks(Hook{Event: HookChange, Key: KeyOutLocation, File: strings.Join(FilestoWrite, " ")})
+	}
+	exitRun(ExitConsulError, start, KeyOutLocation, "serving_stale", "")
+}
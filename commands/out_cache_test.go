@@ -0,0 +1,45 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	dir := filepath.Join(filepath.Dir(ensureTestFile(t)), "cache")
+	defer os.RemoveAll(dir)
+	if _, err := LoadCache(dir, "/etc/hosts.consul", 0); err == nil {
+		t.Error("There's nothing cached yet.")
+	}
+	if err := SaveCache(dir, "/etc/hosts.consul", "hosts", exampleData); err != nil {
+		t.Fatalf("The data should be cached: %v", err)
+	}
+	cached, err := LoadCache(dir, "/etc/hosts.consul", 0)
+	if err != nil || cached.Data != exampleData || cached.Checksum != exampleDataSHA || cached.Key != "hosts" {
+		t.Errorf("The cached data should be loaded: %+v %v", cached, err)
+	}
+	if _, err := LoadCache(dir, "/etc/hosts.consul", time.Hour); err != nil {
+		t.Errorf("A cache that was just saved is young enough: %v", err)
+	}
+	ioutil.WriteFile(CachePath(dir, "/etc/hosts.consul"), []byte(`{"checksum":"`+exampleDataSHA+`","data":`+strconv.Quote(exampleData)+`,"saved":"2020-01-01T00:00:00Z"}`), 0600)
+	if _, err := LoadCache(dir, "/etc/hosts.consul", time.Hour); err == nil {
+		t.Error("A cache older than --cache-max-age should not be used.")
+	}
+	if _, err := LoadCache(dir, "/etc/hosts.consul", 0); err != nil {
+		t.Errorf("Without --cache-max-age any age is fine: %v", err)
+	}
+	if info, _ := os.Stat(CachePath(dir, "/etc/hosts.consul")); info.Mode().Perm() != 0600 {
+		t.Errorf("Only the owner should read the cache: %s", info.Mode())
+	}
+
+	ioutil.WriteFile(CachePath(dir, "/etc/hosts.consul"), []byte(`{"checksum":"bad","data":"changed"}`), 0600)
+	if _, err := LoadCache(dir, "/etc/hosts.consul", 0); err == nil {
+		t.Error("A cache that doesn't match its checksum should not be used.")
+	}
+}
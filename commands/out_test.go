@@ -0,0 +1,145 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestChangedSince(t *testing.T) {
+	cutoff, _ := time.Parse(time.RFC3339, "2016-05-01T12:00:00Z")
+	if changed, err := ChangedSince("2016-05-01T13:00:00Z", cutoff); err != nil || !changed {
+		t.Error("A change after the cutoff should be written.")
+	}
+	if changed, err := ChangedSince("2016-05-01T11:00:00Z", cutoff); err != nil || changed {
+		t.Error("A change before the cutoff should NOT be written.")
+	}
+	if _, err := ChangedSince("", cutoff); err == nil {
+		t.Error("A missing updated time should be an error.")
+	}
+	if _, err := ChangedSince("yesterday", cutoff); err == nil {
+		t.Error("A bad updated time should be an error.")
+	}
+}
+
+func TestDataAge(t *testing.T) {
+	now, _ := time.Parse(time.RFC3339, "2016-05-01T12:00:00Z")
+	if age, err := DataAge("2016-05-01T10:30:00Z\n", now); err != nil || age != 90*time.Minute {
+		t.Errorf("The data should be 90 minutes old: %s %v", age, err)
+	}
+	if _, err := DataAge("", now); err == nil {
+		t.Error("A missing updated time should be an error.")
+	}
+	if _, err := DataAge("yesterday", now); err == nil {
+		t.Error("A bad updated time should be an error.")
+	}
+}
+
+func TestWriteTargetsDryRun(t *testing.T) {
+	file := ensureTestFile(t)
+	DryRun = true
+	defer func() { DryRun = false }()
+	if written, err := WriteTargets([]OutTarget{{File: file, Format: "raw", Output: exampleData}}, exampleDataSHA, ""); err != nil || written != 1 {
+		t.Errorf("The file should be counted as written, got %d", written)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Error("Nothing should be written with --dry-run.")
+	}
+}
+
+func TestWriteTargetsUnchanged(t *testing.T) {
+	file := ensureTestFile(t)
+	targets := []OutTarget{{File: file, Format: "raw", Output: exampleData}}
+	if written, err := WriteTargets(targets, exampleDataSHA, ""); err != nil || written != 1 {
+		t.Fatalf("The file should be written, got %d %v", written, err)
+	}
+	// The same data again writes nothing - so out doesn't run PostExec.
+	if written, err := WriteTargets(targets, exampleDataSHA, ""); err != nil || written != 0 {
+		t.Errorf("An unchanged file should not be written, got %d %v", written, err)
+	}
+}
+
+func TestTargetsUnchanged(t *testing.T) {
+	file := ensureTestFile(t)
+	targets := []OutTarget{{File: file, Format: "raw"}}
+	if unchanged, err := TargetsUnchanged(targets, exampleDataSHA); err != nil || unchanged {
+		t.Errorf("A missing file needs the data: %t %v", unchanged, err)
+	}
+	if err := WriteFile(exampleData, file, 0640, ""); err != nil {
+		t.Fatal(err)
+	}
+	if unchanged, err := TargetsUnchanged(targets, exampleDataSHA+"\n"); err != nil || !unchanged {
+		t.Errorf("The file already has the data: %t %v", unchanged, err)
+	}
+	if unchanged, _ := TargetsUnchanged(targets, ComputeChecksum("new data")); unchanged {
+		t.Error("A new checksum needs the data.")
+	}
+	if unchanged, _ := TargetsUnchanged(targets, ""); unchanged {
+		t.Error("A missing checksum key needs the data.")
+	}
+	for _, target := range []OutTarget{{File: file, Format: "json"}, {File: Stdio, Format: "raw"}} {
+		if unchanged, _ := TargetsUnchanged(append(targets, target), exampleDataSHA); unchanged {
+			t.Errorf("Stdout and the other formats always need the data: %+v", target)
+		}
+	}
+}
+
+func TestWriteTargetsStdout(t *testing.T) {
+	r, w, _ := os.Pipe()
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	targets := []OutTarget{{File: Stdio, Format: "raw", Output: exampleData}}
+	// Stdout is written every time - there's no file to compare with.
+	for i := 0; i < 2; i++ {
+		if written, err := WriteTargets(targets, exampleDataSHA, ""); err != nil || written != 1 {
+			t.Fatalf("The data should be written to stdout, got %d %v", written, err)
+		}
+	}
+	w.Close()
+	if output, _ := ioutil.ReadAll(r); string(output) != exampleData+exampleData {
+		t.Errorf("Stdout should have the data: %q", output)
+	}
+}
+
+func TestWaitForKey(t *testing.T) {
+	ensureTestFile(t)
+	tc, c := newTestConsul(t)
+	MinFileLength = 1
+	if err := WaitForKey(c, "bootstrap", 100*time.Millisecond); err == nil {
+		t.Error("A key that's never saved should time out.")
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		tc.put("testing/bootstrap/data", exampleData)
+		tc.put("testing/bootstrap/checksum", exampleDataSHA)
+	}()
+	if err := WaitForKey(c, "bootstrap", 5*time.Second); err != nil {
+		t.Errorf("The key should be found once it's saved: %v", err)
+	}
+}
+
+func TestComposeKeys(t *testing.T) {
+	ensureTestFile(t)
+	tc, c := newTestConsul(t)
+	MinFileLength = 1
+	tc.put("testing/base/data", "global\n")
+	tc.put("testing/base/checksum", ComputeChecksum("global\n"))
+	tc.put("testing/web/data", "backend web\n")
+	tc.put("testing/web/checksum", ComputeChecksum("backend web\n"))
+
+	composed, err := ComposeKeys(c, []string{"base", "web"}, "\n")
+	if err != nil || composed != "global\n\nbackend web\n" {
+		t.Errorf("The keys should be joined in order: %q %v", composed, err)
+	}
+
+	tc.put("testing/web/checksum", "not-the-checksum")
+	if _, err := ComposeKeys(c, []string{"base", "web"}, "\n"); err == nil {
+		t.Error("Every key has to match its own checksum.")
+	}
+}
@@ -0,0 +1,60 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Result is what a command did - it's printed as a single line of JSON with
+// --output json so automation doesn't have to read the logs.
+type Result struct {
+	Command    string      `json:"command"`
+	Key        string      `json:"key,omitempty"`
+	Action     string      `json:"action"`
+	Bytes      int         `json:"bytes,omitempty"`
+	Checksum   string      `json:"checksum,omitempty"`
+	Files      []string    `json:"files,omitempty"`
+	DurationMS int64       `json:"duration_ms"`
+	Error      string      `json:"error,omitempty"`
+	RunID      string      `json:"run_id,omitempty"`
+	Details    interface{} `json:"details,omitempty"`
+}
+
+var (
+	// processStart is when kvexpress started - for the duration of a LogFatal.
+	processStart = time.Now()
+
+	// cmdResult is filled in as the command runs and printed by PrintResult.
+	cmdResult Result
+)
+
+// RecordResult saves the size and checksum of the data and the files a
+// command works with for the JSON result.
+func RecordResult(bytes int, checksum string, files ...string) {
+	cmdResult.Bytes, cmdResult.Checksum, cmdResult.Files = bytes, checksum, files
+}
+
+// RecordDetails adds a command's own report - like verify's - to the JSON result.
+func RecordDetails(details interface{}) {
+	cmdResult.Details = details
+}
+
+// PrintResult prints the result as JSON with --output json. action is where
+// the command stopped - the same location RunTime sends to statsd.
+func PrintResult(key, action string, elapsed time.Duration, message string) {
+	if OutputFormat != "json" {
+		return
+	}
+	cmdResult.Command, cmdResult.Key, cmdResult.Action = Direction, key, action
+	cmdResult.DurationMS = int64(elapsed / time.Millisecond)
+	cmdResult.Error, cmdResult.RunID = message, RunID
+	data, err := json.Marshal(cmdResult)
+	if err != nil {
+		Log(fmt.Sprintf("output='json' message='%v'", err), "info")
+		return
+	}
+	fmt.Fprintln(dataStdout(), string(data))
+}
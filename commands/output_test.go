@@ -0,0 +1,38 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPrintResult(t *testing.T) {
+	r, w, _ := os.Pipe()
+	defer func(out *os.File) { os.Stdout, OutputFormat, cmdResult = out, "text", Result{} }(os.Stdout)
+	os.Stdout, OutputFormat = w, "json"
+	RecordResult(42, exampleDataSHA, "/etc/hosts")
+	PrintResult("hosts", "complete", 1500*time.Millisecond, "")
+	w.Close()
+	var printed Result
+	output, _ := ioutil.ReadAll(r)
+	if err := json.Unmarshal(output, &printed); err != nil || printed.Action != "complete" || printed.Bytes != 42 || printed.DurationMS != 1500 || printed.Files[0] != "/etc/hosts" {
+		t.Errorf("The result should be printed as JSON: %s %v", output, err)
+	}
+}
+
+func TestFinishRunResult(t *testing.T) {
+	r, w, _ := os.Pipe()
+	defer func(out *os.File) { os.Stdout, OutputFormat, cmdResult = out, "text", Result{} }(os.Stdout)
+	os.Stdout, OutputFormat = w, "json"
+	finishRun(time.Now(), "hosts", "filesystem_error", "'/etc/hosts' is a directory")
+	w.Close()
+	output, _ := ioutil.ReadAll(r)
+	var printed Result
+	if err := json.Unmarshal(output, &printed); err != nil || printed.Action != "filesystem_error" || printed.Error != "'/etc/hosts' is a directory" {
+		t.Errorf("A run that stops should print a single result with its error: %s %v", output, err)
+	}
+}
@@ -0,0 +1,276 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/zorkian/go-datadog-api"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// InAppend saves this host's lines in <prefix>/_parts/<key>/<hostname> and
+	// merges every host's part into the key - so many hosts can build one file.
+	InAppend bool
+
+	// PartTTL is how long this host's part stays in the merge without a run -
+	// 0 keeps it until it's removed.
+	PartTTL time.Duration
+)
+
+// KeyPart is what a host saves in <prefix>/_parts/<key>/<hostname> with in
+// --append. Updated is the last run that saved it - with a TTL it's the
+// heartbeat.
+type KeyPart struct {
+	Host     string `json:"host"`
+	Updated  string `json:"updated"`
+	TTL      string `json:"ttl,omitempty"`
+	Checksum string `json:"checksum"`
+	Data     string `json:"data"`
+}
+
+// Expired is true once a part with a TTL hasn't been saved for that long. A
+// part whose TTL or time can't be read doesn't expire - its lines aren't
+// dropped by mistake.
+func (part KeyPart) Expired(now time.Time) bool {
+	if part.TTL == "" {
+		return false
+	}
+	ttl, err := time.ParseDuration(part.TTL)
+	if err != nil || ttl <= 0 {
+		return false
+	}
+	updated, err := time.Parse(time.RFC3339, part.Updated)
+	if err != nil {
+		return false
+	}
+	return now.Sub(updated) > ttl
+}
+
+// PartPath is where host saves its part of key.
+func PartPath(key, host string) string {
+	return hostKeyRoot("parts", key) + host
+}
+
+// ParsePart reads a part saved by SavePart.
+func ParsePart(value string) (KeyPart, error) {
+	var part KeyPart
+	err := json.Unmarshal([]byte(value), &part)
+	return part, err
+}
+
+// SavePart saves data as this host's part of key with ttl. It's false if the
+// part already had the same data - but with a ttl it's saved again once half
+// of it has gone so the part doesn't expire while the host is still running.
+func SavePart(c *consul.Client, key, data string, ttl time.Duration) (bool, error) {
+	host := GetHostname()
+	part := KeyPart{Host: host, Updated: ReturnCurrentUTC(), Checksum: ComputeChecksum(data), Data: data}
+	if ttl > 0 {
+		part.TTL = ttl.String()
+	}
+	current, err := Get(c, PartPath(key, host))
+	if err != nil {
+		return false, err
+	}
+	if saved, err := ParsePart(current); err == nil && saved.Checksum == part.Checksum && saved.TTL == part.TTL {
+		updated, err := time.Parse(time.RFC3339, saved.Updated)
+		if ttl <= 0 || (err == nil && time.Since(updated) < ttl/2) {
+			Log(fmt.Sprintf("part key='%s' host='%s' checksum='match' saved='false'", key, host), "debug")
+			return false, nil
+		}
+	}
+	value, _ := json.Marshal(part)
+	return true, Set(c, PartPath(key, host), string(value))
+}
+
+// GetParts returns every host's part of key sorted by host. A part that isn't
+// JSON is skipped.
+func GetParts(c *consul.Client, key string) ([]KeyPart, error) {
+	prefix := hostKeyRoot("parts", key)
+	values, err := List(c, prefix)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(values))
+	for path := range values {
+		keys = append(keys, path)
+	}
+	sort.Strings(keys)
+	var parts []KeyPart
+	for _, path := range keys {
+		part, err := ParsePart(values[path])
+		if err != nil {
+			Log(fmt.Sprintf("part path='%s' message='%v' - skipping.", path, err), "info")
+			continue
+		}
+		if part.Host == "" {
+			part.Host = strings.TrimPrefix(path, prefix)
+		}
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+// expireParts removes the parts that expired at now from Consul and returns
+// the rest. A part that can't be removed is still left out of the merge.
+func expireParts(c *consul.Client, key string, parts []KeyPart, now time.Time) []KeyPart {
+	var live []KeyPart
+	for _, part := range parts {
+		if !part.Expired(now) {
+			live = append(live, part)
+			continue
+		}
+		Log(fmt.Sprintf("part key='%s' host='%s' updated='%s' ttl='%s' expired='true'", key, part.Host, part.Updated, part.TTL), "info")
+		if err := Del(c, PartPath(key, part.Host)); err != nil {
+			Log(fmt.Sprintf("part key='%s' host='%s' deleted='false' message='%v'", key, part.Host, err), "info")
+		}
+	}
+	return live
+}
+
+// MergeParts joins the lines of every part, removes the ones that are the same
+// and sorts them with mode.
+func MergeParts(parts []KeyPart, mode string) string {
+	var lines []string
+	for _, part := range parts {
+		lines = append(lines, part.Data)
+	}
+	return SortLines(strings.Join(lines, "\n"), mode, true)
+}
+
+// mergeSortMode is --sort for the merged data - it's always sorted so every
+// host merges the parts the same way.
+func mergeSortMode() string {
+	if SortMode == "" || SortMode == "none" {
+		return "lexical"
+	}
+	return SortMode
+}
+
+// inAppendRun saves data as this host's part and saves the merged parts as the
+// key's data - out reads it like any other key. It's true if the key changed.
+func inAppendRun(c *consul.Client, dog *datadog.Client, start time.Time, data string) bool {
+	if !atomicWrites() {
+		fmt.Printf("--append needs a backend with transactions - not --backend %s\n", Backend)
+		exitRun(1, start, KeyInLocation, "no_transactions", "")
+	}
+	// The config file is loaded after the flags are checked.
+	if encryption != nil || DataEncoding() != EncodingNone {
+		fmt.Println("--append merges lines of plain text - it can't be used with --compress, --binary or encryption.")
+		exitRun(1, start, KeyInLocation, "append_encrypted", "")
+	}
+	// The part is sorted too so the same lines in another order don't change it.
+	data = SortLines(data, mergeSortMode(), true)
+	if DryRunSkip(fmt.Sprintf("save part '%s' size='%d'", PartPath(KeyInLocation, GetHostname()), len(data))) {
+		exitRun(0, start, KeyInLocation, "dry_run", "")
+	}
+	changed, err := SavePart(c, KeyInLocation, data, PartTTL)
+	ExitOnError(err, PartPath(KeyInLocation, GetHostname()), "consul_set")
+	Log(fmt.Sprintf("part key='%s' host='%s' saved='%t'", KeyInLocation, GetHostname(), changed), "info")
+
+	// Another host that merged at the same time might not have seen this part -
+	// so it's merged again until the merge doesn't change the key. The indexes
+	// are read before the parts so a merge that saved since loses the CAS.
+	merged := false
+	for i := 1; i <= casTries; i++ {
+		dataIndex, _, err := consulIndex(c, KeyPath(KeyInLocation, "data"))
+		ExitOnError(err, KeyInLocation, "consul_get")
+		checksumIndex, current, err := consulIndex(c, KeyPath(KeyInLocation, "checksum"))
+		ExitOnError(err, KeyInLocation, "consul_get")
+		parts, err := GetParts(c, KeyInLocation)
+		ExitOnError(err, KeyInLocation, "consul_get")
+		parts = expireParts(c, KeyInLocation, parts, time.Now())
+		all := MergeParts(parts, mergeSortMode())
+		checksum := StoreChecksum(all)
+		RecordResult(len(all), checksum)
+		if checksum == strings.TrimSpace(current) {
+			Log(fmt.Sprintf("consul key='%s' parts='%d' merged='%t'", KeyInLocation, len(parts), merged), "info")
+			return merged
+		}
+		checkMerge(c, dog, start, all)
+		oldSize := auditKeyBytes(c, KeyInLocation)
+		ok, err := kvTxn(c, casOps(KeyInLocation, all, checksum, StoreChecksums(all), StoredEncoding(), dataIndex, checksumIndex))
+		if err != nil {
+			Log(fmt.Sprintf("consul key='%s' saved='false' message='%v'", KeyInLocation, err), "info")
+			exitRun(ExitConsulError, start, KeyInLocation, "consul_error", "")
+		}
+		if !ok {
+			Log(fmt.Sprintf("consul key='%s' conflict='true' tries='%d' - merging again.", KeyInLocation, i), "info")
+			StatsdConsul(KeyInLocation, "cas_conflict")
+			continue
+		}
+		merged = true
+		Log(fmt.Sprintf("consul key='%s' parts='%d' size='%d' merged='true'", KeyInLocation, len(parts), len(all)), "info")
+		Audit(AuditRecord{Event: AuditKey, Key: KeyInLocation, File: FiletoRead, OldChecksum: strings.TrimSpace(current), NewChecksum: checksum, ByteDelta: len(all) - oldSize})
+		saveMeta(c, KeyInLocation, "parts")
+		StatsdIn(KeyInLocation, len(all), all)
+	}
+	if !merged {
+		Log(fmt.Sprintf("consul key='%s' saved='false' message='%v'", KeyInLocation, ErrCASConflict), "info")
+		exitRun(ExitConsulError, start, KeyInLocation, "cas_conflict", "")
+	}
+	return merged
+}
+
+// checkMerge stops before the merged data is saved if it's too short, too
+// large or changes too much of the key - every host's lines together are
+// what out writes, so they get the same checks as the data in saves.
+func checkMerge(c *consul.Client, dog *datadog.Client, start time.Time, all string) {
+	minLength, maxLength := lineLimits(false)
+	if !LengthCheck(all, minLength) {
+		Log(fmt.Sprintf("merge key='%s' lines='%d' - NOT long enough. Stopping.", KeyInLocation, LineCount(all)), "info")
+		if DatadogAPIKey != "" && DatadogAPPKey != "" {
+			DDLengthEvent(dog, KeyInLocation, all)
+		}
+		exitRun(ExitRejected, start, KeyInLocation, "not_long_enough", "")
+	}
+	if err := SizeCheck(all, maxLength, MaxFileBytes); err != nil {
+		Log(fmt.Sprintf("merge key='%s' is too large: %v. Stopping.", KeyInLocation, err), "info")
+		StatsdTooLarge(KeyInLocation)
+		if DatadogAPIKey != "" && DatadogAPPKey != "" {
+			DDTooLargeEvent(dog, KeyInLocation, err.Error())
+		}
+		exitRun(ExitRejected, start, KeyInLocation, "too_large", "")
+	}
+	if MaxChangeRatio <= 0 {
+		return
+	}
+	currentData, err := GetData(c, KeyInLocation)
+	ExitOnError(err, KeyInLocation, "consul_get")
+	currentData, err = DecodeData(c, KeyInLocation, currentData)
+	ExitOnError(err, KeyInLocation, "DecodeData")
+	if ratio := ChangeRatio(currentData, all); ratio > MaxChangeRatio {
+		Log(fmt.Sprintf("merge change ratio='%.3f' max='%.3f' - stopping.", ratio, MaxChangeRatio), "info")
+		fmt.Printf("Too much changed - %.0f%% of the lines - not updating Consul.\n", ratio*100)
+		if DatadogAPIKey != "" && DatadogAPPKey != "" {
+			DDChangeEvent(dog, KeyInLocation, ratio, MaxChangeRatio, "")
+		}
+		StatsdChangeTooLarge(KeyInLocation)
+		exitRun(ExitRejected, start, KeyInLocation, "change_too_large", "")
+	}
+}
+
+// checkAppendFlags checks --part-ttl and makes sure --append isn't used with anything that saves the
+// key some other way.
+func checkAppendFlags() {
+	if PartTTL < 0 || (PartTTL > 0 && !InAppend) {
+		fmt.Println("--part-ttl needs --append and can't be less than 0")
+		os.Exit(1)
+	}
+	if !InAppend {
+		return
+	}
+	if Recurse || len(InTargets) > 0 || InCanary || ContentAddressed || Delta {
+		fmt.Println("--append can't be used with --recurse, --target, --canary, --content-addressed or --delta")
+		os.Exit(1)
+	}
+	if Rolling || SignKey != "" || AcquireSession || LeaderElection {
+		fmt.Println("--append can't be used with --rolling, --sign-key, --acquire-session or --leader-election")
+		os.Exit(1)
+	}
+}
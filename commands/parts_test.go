@@ -0,0 +1,95 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInAppendRun(t *testing.T) {
+	tc, c := newTestConsul(t)
+	PrefixLocation = "testing"
+	KeyInLocation, MinFileLength = "allowlist", 1
+	defer func() { KeyInLocation, MinFileLength = "", 10 }()
+	tc.put("testing/_parts/allowlist/web2", `{"host":"web2","data":"10.0.0.2\n10.0.0.1\n"}`)
+	tc.put("testing/_parts/allowlist/web3", `not json`)
+
+	if !inAppendRun(c, nil, time.Now(), "10.0.0.1\n10.0.0.3\n") {
+		t.Fatal("The merged parts should be saved.")
+	}
+	if part, ok := tc.value(PartPath("allowlist", GetHostname())); !ok {
+		t.Error("This host's part should be saved.")
+	} else if parsed, err := ParsePart(part); err != nil || parsed.Host != GetHostname() || parsed.Data != "10.0.0.1\n10.0.0.3" {
+		t.Errorf("The part should have the host and its lines: %+v %v", parsed, err)
+	}
+	merged := "10.0.0.1\n10.0.0.2\n10.0.0.3"
+	if data, _ := tc.value("testing/allowlist/data"); data != merged {
+		t.Errorf("Every part should be merged, deduped and sorted: %q", data)
+	}
+	if checksum, _ := tc.value("testing/allowlist/checksum"); checksum != ComputeChecksum(merged) {
+		t.Errorf("The checksum should be the merged data's: %q", checksum)
+	}
+
+	// Nothing changed so nothing is written.
+	puts := tc.count("PUT")
+	if inAppendRun(c, nil, time.Now(), "10.0.0.3\n10.0.0.1\n") {
+		t.Error("The same lines shouldn't change the key.")
+	}
+	if tc.count("PUT") != puts {
+		t.Error("A part with the same lines shouldn't be saved again.")
+	}
+}
+
+func TestKeyPartExpired(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		part    KeyPart
+		expired bool
+	}{
+		{KeyPart{Updated: "2020-01-01T11:00:00Z"}, false},
+		{KeyPart{Updated: "2020-01-01T11:00:00Z", TTL: "2h0m0s"}, false},
+		{KeyPart{Updated: "2020-01-01T11:00:00Z", TTL: "30m0s"}, true},
+		{KeyPart{Updated: "yesterday", TTL: "30m0s"}, false},
+		{KeyPart{Updated: "2020-01-01T11:00:00Z", TTL: "soon"}, false},
+	} {
+		if expired := test.part.Expired(now); expired != test.expired {
+			t.Errorf("%+v expired should be %t", test.part, test.expired)
+		}
+	}
+}
+
+func TestInAppendRunExpired(t *testing.T) {
+	tc, c := newTestConsul(t)
+	PrefixLocation = "testing"
+	KeyInLocation = "peers"
+	PartTTL, MinFileLength = time.Hour, 1
+	defer func() { KeyInLocation, PartTTL, MinFileLength = "", 0, 10 }()
+	tc.put("testing/_parts/peers/dead", `{"host":"dead","updated":"2020-01-01T00:00:00Z","ttl":"1h0m0s","data":"10.0.0.9"}`)
+	tc.put("testing/_parts/peers/old", `{"host":"old","updated":"2020-01-01T00:00:00Z","data":"10.0.0.8"}`)
+
+	if !inAppendRun(c, nil, time.Now(), "10.0.0.1") {
+		t.Fatal("The merged parts should be saved.")
+	}
+	if data, _ := tc.value("testing/peers/data"); data != "10.0.0.1\n10.0.0.8" {
+		t.Errorf("An expired part should be left out of the merge: %q", data)
+	}
+	if _, ok := tc.value("testing/_parts/peers/dead"); ok {
+		t.Error("An expired part should be removed.")
+	}
+	value, _ := tc.value(PartPath("peers", GetHostname()))
+	if part, err := ParsePart(value); err != nil || part.TTL != "1h0m0s" || part.Expired(time.Now()) {
+		t.Errorf("This host's part should have its TTL: %+v %v", part, err)
+	}
+
+	// An old heartbeat is saved again even though the lines are the same.
+	part, _ := ParsePart(value)
+	part.Updated = time.Now().Add(-40 * time.Minute).UTC().Format(time.RFC3339)
+	tc.put(PartPath("peers", GetHostname()), `{"host":"`+part.Host+`","updated":"`+part.Updated+`","ttl":"1h0m0s","checksum":"`+part.Checksum+`","data":"10.0.0.1"}`)
+	if saved, err := SavePart(c, "peers", "10.0.0.1", time.Hour); err != nil || !saved {
+		t.Errorf("The heartbeat should be saved again after half the TTL: %v", err)
+	}
+	if saved, _ := SavePart(c, "peers", "10.0.0.1", time.Hour); saved {
+		t.Error("A fresh heartbeat shouldn't be saved again.")
+	}
+}
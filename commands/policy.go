@@ -0,0 +1,76 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var (
+	// PolicyFile is the host's policy - allowed_paths in it applies to every
+	// run, whatever --config and --allowed-paths say. It has to be owned by
+	// root and not writable by anyone else.
+	PolicyFile = defaultPolicyFile
+
+	// policyPaths are allowed_paths in PolicyFile - empty without a policy.
+	policyPaths []string
+)
+
+// LoadPolicy reads allowed_paths from file - nothing if there isn't one. A
+// policy that someone other than root could have changed is an error.
+func LoadPolicy(file string) ([]string, error) {
+	info, err := os.Lstat(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("the policy '%s' isn't a regular file", file)
+	}
+	if err := rootOwned(info); err != nil {
+		return nil, fmt.Errorf("the policy '%s' %v", file, err)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	config := ParseConfig(data)
+	if config == nil {
+		return nil, fmt.Errorf("could not parse the policy '%s'", file)
+	}
+	list, err := config.Get("allowed_paths").Array()
+	if err != nil {
+		return nil, fmt.Errorf("the policy '%s' needs a list of allowed_paths", file)
+	}
+	var paths []string
+	for _, item := range list {
+		path, ok := item.(string)
+		if !ok || !filepath.IsAbs(path) {
+			return nil, fmt.Errorf("'%v' in the policy '%s' isn't an absolute path", item, file)
+		}
+		paths = append(paths, filepath.Clean(path))
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("the policy '%s' doesn't allow any paths", file)
+	}
+	return paths, nil
+}
+
+// loadPolicy loads PolicyFile for the run - it stops the run if the policy
+// can't be trusted.
+func loadPolicy() {
+	paths, err := LoadPolicy(PolicyFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if len(paths) > 0 {
+		Log(fmt.Sprintf("policy file='%s' allowed_paths='%v'", PolicyFile, paths), "debug")
+	}
+	policyPaths = paths
+}
@@ -0,0 +1,186 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// promLabels are the statsd tags that become Prometheus labels. Host is left
+// off - Prometheus adds the instance.
+var promLabels = []string{"key", "file", "direction", "location"}
+
+// promMetric is a single Prometheus series.
+type promMetric struct {
+	name   string
+	kind   string
+	labels string
+	value  float64
+}
+
+// promRegistry holds every metric sent during this run.
+var promRegistry = struct {
+	sync.Mutex
+	metrics map[string]*promMetric
+}{metrics: map[string]*promMetric{}}
+
+// PrometheusEnabled returns true if there's somewhere to put Prometheus metrics.
+func PrometheusEnabled() bool {
+	return MetricsTextfile != "" || MetricsListen != ""
+}
+
+// PromIncr adds 1 to a Prometheus counter.
+func PromIncr(name string, tags []string) {
+	promAdd(promName(name)+"_total", "counter", tags, 1)
+}
+
+// PromAdd adds value to a Prometheus counter.
+func PromAdd(name string, tags []string, value float64) {
+	promAdd(promName(name)+"_total", "counter", tags, value)
+}
+
+// PromGauge sets a Prometheus gauge.
+func PromGauge(name string, value float64, tags []string) {
+	if !PrometheusEnabled() {
+		return
+	}
+	metric := promSeries(promName(name), "gauge", tags)
+	promRegistry.Lock()
+	metric.value = value
+	promRegistry.Unlock()
+}
+
+// PromObserve adds a duration to a Prometheus summary.
+func PromObserve(name string, elapsed time.Duration, tags []string) {
+	promAdd(promName(name)+"_seconds_sum", "summary", tags, elapsed.Seconds())
+	promAdd(promName(name)+"_seconds_count", "summary", tags, 1)
+}
+
+// promAdd adds value to a series.
+func promAdd(name, kind string, tags []string, value float64) {
+	if !PrometheusEnabled() {
+		return
+	}
+	metric := promSeries(name, kind, tags)
+	promRegistry.Lock()
+	metric.value += value
+	promRegistry.Unlock()
+}
+
+// promSeries finds - or creates - the series for a name and its tags.
+func promSeries(name, kind string, tags []string) *promMetric {
+	labels := promLabelString(tags)
+	promRegistry.Lock()
+	defer promRegistry.Unlock()
+	id := name + labels
+	metric, ok := promRegistry.metrics[id]
+	if !ok {
+		metric = &promMetric{name: name, kind: kind, labels: labels}
+		promRegistry.metrics[id] = metric
+	}
+	return metric
+}
+
+// promName turns `kvexpress.consul_error` into `kvexpress_consul_error`.
+func promName(name string) string {
+	return strings.NewReplacer(".", "_", "-", "_").Replace(name)
+}
+
+// promLabelString turns statsd `name:value` tags into Prometheus labels.
+func promLabelString(tags []string) string {
+	values := map[string]string{}
+	for _, tag := range tags {
+		parts := strings.SplitN(tag, ":", 2)
+		if len(parts) == 2 {
+			values[parts[0]] = parts[1]
+		}
+	}
+	var labels []string
+	for _, label := range promLabels {
+		if value, ok := values[label]; ok {
+			value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+			labels = append(labels, fmt.Sprintf(`%s="%s"`, label, value))
+		}
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// WriteProm writes every metric in the Prometheus text format.
+func WriteProm(w io.Writer) {
+	promRegistry.Lock()
+	defer promRegistry.Unlock()
+	var ids []string
+	for id := range promRegistry.metrics {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	typed := map[string]bool{}
+	for _, id := range ids {
+		metric := promRegistry.metrics[id]
+		family := strings.TrimSuffix(strings.TrimSuffix(metric.name, "_sum"), "_count")
+		if !typed[family] {
+			fmt.Fprintf(w, "# TYPE %s %s\n", family, metric.kind)
+			typed[family] = true
+		}
+		fmt.Fprintf(w, "%s%s %g\n", metric.name, metric.labels, metric.value)
+	}
+}
+
+// WritePromTextfile writes the metrics for the node_exporter textfile collector.
+// It's written to a temporary file and renamed so it's never read half written.
+func WritePromTextfile(file string) error {
+	var buf bytes.Buffer
+	WriteProm(&buf)
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".kvexpress-prom")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	os.Chmod(tmp.Name(), 0644)
+	return os.Rename(tmp.Name(), file)
+}
+
+// PromFlush writes the --metrics-textfile if there is one.
+func PromFlush() {
+	if MetricsTextfile == "" {
+		return
+	}
+	if err := WritePromTextfile(MetricsTextfile); err != nil {
+		Log(fmt.Sprintf("prometheus textfile='%s' message='%v'", MetricsTextfile, err), "info")
+	}
+}
+
+// PromListen serves the metrics on /metrics - it's used by watch.
+func PromListen(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteProm(w)
+	})
+	go func() {
+		if err := http.ListenAndServe(address, mux); err != nil {
+			Log(fmt.Sprintf("prometheus listen='%s' message='%v'", address, err), "info")
+		}
+	}()
+	Log(fmt.Sprintf("prometheus listen='%s'", address), "info")
+}
@@ -0,0 +1,75 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// promTextfile points --metrics-textfile at a temp file and clears the registry.
+func promTextfile(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "kvexpress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	MetricsTextfile = filepath.Join(dir, "kvexpress.prom")
+	promRegistry.metrics = map[string]*promMetric{}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+		MetricsTextfile = ""
+		promRegistry.metrics = map[string]*promMetric{}
+	})
+	return MetricsTextfile
+}
+
+func TestPromTextfile(t *testing.T) {
+	file := promTextfile(t)
+	Direction = "out"
+	StatsdOut("hosts")
+	StatsdOut("hosts")
+	StatsdChecksum("services")
+	RunTime(time.Now(), "hosts", "complete")
+
+	metrics := ReadFile(file)
+	for _, line := range []string{
+		"# TYPE kvexpress_out_total counter\n",
+		`kvexpress_out_total{key="hosts",direction="out",location="complete"} 2` + "\n",
+		`kvexpress_checksum_mismatch_total{key="services",direction="out",location="checksum_mismatch"} 1` + "\n",
+		"# TYPE kvexpress_time gauge\n",
+	} {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("The textfile is missing %q:\n%s", line, metrics)
+		}
+	}
+	if strings.Contains(metrics, "run_id") || strings.Contains(metrics, "host=") {
+		t.Errorf("The host and run_id tags should not be labels:\n%s", metrics)
+	}
+}
+
+func TestPromConsulLatency(t *testing.T) {
+	file := promTextfile(t)
+	Retry(func() error { return nil }, 1)
+	Retry(func() error { return nil }, 1)
+	PromFlush()
+	metrics := ReadFile(file)
+	if !strings.Contains(metrics, "# TYPE kvexpress_consul_seconds summary\n") || !strings.Contains(metrics, "kvexpress_consul_seconds_count{direction=\"out\"} 2\n") {
+		t.Errorf("The Consul latency is missing:\n%s", metrics)
+	}
+}
+
+func TestPromDisabled(t *testing.T) {
+	promTextfile(t)
+	MetricsDisable = []string{"out"}
+	defer func() { MetricsDisable = []string{} }()
+	StatsdOut("hosts")
+	MetricsTextfile = ""
+	StatsdLocked("/etc/hosts")
+	if len(promRegistry.metrics) != 0 {
+		t.Errorf("Nothing should be kept without a textfile or with the metric disabled: %d", len(promRegistry.metrics))
+	}
+}
@@ -0,0 +1,75 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"time"
+)
+
+var promoteCmd = &cobra.Command{
+	Use:   "promote",
+	Short: "Make a key's canary data the data for every host.",
+	Long:  `Promote saves the data that in --canary put in <key>/canary as the key and removes the canary - every node picks it up on the next out.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		checkPromoteFlags()
+		AutoEnable()
+	},
+	Run: promoteRun,
+}
+
+func promoteRun(cmd *cobra.Command, args []string) {
+	start := time.Now()
+	c, err := Connect(ConsulServer, Token)
+	if err != nil {
+		LogFatal("Could not connect to Consul.", KeyPromoteLocation, "consul_connect")
+	}
+	if DryRunSkip(fmt.Sprintf("promote '%s'", CanaryKey(KeyPromoteLocation))) {
+		RunTime(start, KeyPromoteLocation, "dry_run")
+		return
+	}
+	saved, err := Promote(c, KeyPromoteLocation)
+	ExitOnError(err, KeyPromoteLocation, "promote")
+	if !saved {
+		Log(fmt.Sprintf("promote key='%s' checksum='match' saved='false'", KeyPromoteLocation), "info")
+		fmt.Printf("'%s' already had the canary's data - removed the canary.\n", KeyPromoteLocation)
+		exitRun(ExitNoChange, start, KeyPromoteLocation, "consul_checksums_match", "")
+	}
+	if DatadogAPIKey != "" && DatadogAPPKey != "" {
+		DDCanaryEvent(DDAPIConnect(DatadogAPIKey, DatadogAPPKey), KeyPromoteLocation, "promoted")
+	}
+	RunHooks(Hook{Event: HookChange, Key: KeyPromoteLocation})
+	fmt.Printf("Promoted the canary for '%s'.\n", KeyPromoteLocation)
+	RunTime(start, KeyPromoteLocation, "complete")
+}
+
+func checkPromoteFlags() {
+	Log("Checking cli flags.", "debug")
+	if KeyPromoteLocation == "" {
+		fmt.Println("Need a key location in -k")
+		os.Exit(1)
+	}
+	if VerifyKey != "" {
+		key, err := LoadVerifyKey(VerifyKey)
+		if err != nil {
+			fmt.Printf("Could not load --verify-key: %v\n", err)
+			os.Exit(1)
+		}
+		verifyPublicKey = key
+	}
+	Log("Required cli flags present.", "debug")
+}
+
+var (
+	// KeyPromoteLocation is the key whose canary is promoted.
+	KeyPromoteLocation string
+)
+
+func init() {
+	RootCmd.AddCommand(promoteCmd)
+	promoteCmd.Flags().StringVarP(&KeyPromoteLocation, "key", "k", "", "key whose canary to promote")
+	promoteCmd.Flags().IntVarP(&HistoryKeep, "history", "", 10, "versions of the key to keep - 0 keeps none")
+	promoteCmd.Flags().StringVarP(&VerifyKey, "verify-key", "", "", "ed25519 public key the canary has to be signed with")
+}
@@ -0,0 +1,122 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+var (
+	// Proxy is the HTTP proxy for everything kvexpress talks to - HTTP_PROXY,
+	// HTTPS_PROXY and NO_PROXY are used if it's blank.
+	Proxy string
+
+	// ConsulProxy is the HTTP proxy for Consul - --proxy if it's blank.
+	ConsulProxy string
+)
+
+// proxyDirect is a proxy flag that doesn't use a proxy - even if --proxy or
+// the environment has one.
+const proxyDirect = "direct"
+
+// proxyFunc is the Proxy for an http.Transport. proxy is the flag for where
+// the request is going - --proxy is used if it's blank and the environment if
+// that's blank too. NO_PROXY is honored with a proxy from a flag as well.
+func proxyFunc(proxy string) func(*http.Request) (*url.URL, error) {
+	if proxy == "" {
+		proxy = Proxy
+	}
+	switch proxy {
+	case "":
+		return http.ProxyFromEnvironment
+	case proxyDirect:
+		return nil
+	}
+	proxyURL, err := parseProxy(proxy)
+	if err != nil {
+		// SetupProxy and SetupDatadog have already checked it.
+		return http.ProxyFromEnvironment
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		if noProxy(req.URL.Host, noProxyEnv()) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}
+}
+
+// parseProxy reads a proxy address - a host:port without a scheme is http.
+func parseProxy(proxy string) (*url.URL, error) {
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	proxyURL, err := url.Parse(proxy)
+	if err != nil || proxyURL.Host == "" {
+		return nil, fmt.Errorf("'%s' isn't a proxy address", strings.TrimPrefix(proxy, "http://"))
+	}
+	return proxyURL, nil
+}
+
+// noProxyEnv is NO_PROXY - or no_proxy.
+func noProxyEnv() string {
+	if value := os.Getenv("NO_PROXY"); value != "" {
+		return value
+	}
+	return os.Getenv("no_proxy")
+}
+
+// noProxy is true when host is in the NO_PROXY list - * is every host,
+// example.com and .example.com are it and everything underneath it and an
+// address can be in a CIDR like 10.0.0.0/8. The local agent on localhost is
+// never sent through a proxy - the same as HTTP_PROXY.
+func noProxy(host, list string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	ip := net.ParseIP(host)
+	if host == "localhost" || ip != nil && ip.IsLoopback() {
+		return true
+	}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		switch {
+		case entry == "":
+			continue
+		case entry == "*":
+			return true
+		case strings.Contains(entry, "/"):
+			if _, cidr, err := net.ParseCIDR(entry); err == nil && ip != nil && cidr.Contains(ip) {
+				return true
+			}
+		default:
+			entry = strings.TrimPrefix(entry, ".")
+			if host == entry || strings.HasSuffix(host, "."+entry) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetupProxy checks the proxy flags before anything is sent through them -
+// SetupDatadog checks --datadog-proxy.
+func SetupProxy() error {
+	for _, proxy := range []string{Proxy, ConsulProxy, URLProxy} {
+		if proxy == "" || proxy == proxyDirect {
+			continue
+		}
+		if _, err := parseProxy(proxy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestNoProxy(t *testing.T) {
+	list := "consul, .internal,example.com:8500,10.0.0.0/8"
+	tests := map[string]bool{
+		"localhost:8500":        true,
+		"127.0.0.1:8500":        true,
+		"consul:8500":           true,
+		"consul.internal:8500":  true,
+		"internal":              true,
+		"api.example.com":       true,
+		"notexample.com":        false,
+		"10.1.2.3:8500":         true,
+		"11.1.2.3:8500":         false,
+		"api.datadoghq.com:443": false,
+	}
+	for host, expected := range tests {
+		if noProxy(host, list) != expected {
+			t.Errorf("'%s' should be %t for NO_PROXY", host, expected)
+		}
+	}
+	if !noProxy("anything:80", "*") {
+		t.Error("* should match every host.")
+	}
+}
+
+func TestProxyFunc(t *testing.T) {
+	defer func() { Proxy = "" }()
+	t.Setenv("NO_PROXY", "consul")
+	Proxy = "proxy.example.com:3128"
+	req, _ := http.NewRequest("GET", "https://api.datadoghq.com/api/v1/events", nil)
+	proxy, err := proxyFunc("")(req)
+	if err != nil || proxy == nil || proxy.String() != "http://proxy.example.com:3128" {
+		t.Errorf("--proxy should be used: %v %v", proxy, err)
+	}
+	proxy, _ = proxyFunc("http://consul-proxy:8080")(req)
+	if proxy == nil || proxy.Host != "consul-proxy:8080" {
+		t.Errorf("The proxy for the request should win over --proxy: %v", proxy)
+	}
+	local, _ := http.NewRequest("GET", "http://consul:8500/v1/kv/hosts", nil)
+	if proxy, _ = proxyFunc("")(local); proxy != nil {
+		t.Errorf("NO_PROXY should be honored with --proxy: %v", proxy)
+	}
+	if proxyFunc(proxyDirect) != nil {
+		t.Error("direct shouldn't use a proxy.")
+	}
+	Proxy = "not a proxy"
+	if err := SetupProxy(); err == nil {
+		t.Error("A bad proxy should be an error.")
+	}
+}
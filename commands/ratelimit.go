@@ -0,0 +1,87 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// Splay is the most time to sleep before contacting Consul - so a fleet
+	// that's started by cron at the same time doesn't hit it all at once.
+	Splay time.Duration
+
+	// ConsulRate is the most requests a second kvexpress makes to Consul - 0
+	// for no limit.
+	ConsulRate float64
+)
+
+// SplaySleep sleeps a random time up to Splay.
+func SplaySleep() {
+	if Splay <= 0 {
+		return
+	}
+	sleep := time.Duration(rand.New(rand.NewSource(time.Now().UnixNano())).Int63n(int64(Splay)))
+	Log(fmt.Sprintf("splay='%s' sleep='%s'", Splay, sleep.Round(time.Millisecond)), "info")
+	if !sleepRun(sleep) {
+		exitRunStopped(Direction, fmt.Sprintf("Stopped by %s before the run started.", stopSignal))
+	}
+}
+
+// rateLimiter spaces requests out so there are never more than one every
+// interval.
+type rateLimiter struct {
+	sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// newRateLimiter allows perSecond requests a second.
+func newRateLimiter(perSecond float64) *rateLimiter {
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / perSecond)}
+}
+
+// Wait blocks until the next request is allowed.
+func (r *rateLimiter) Wait() {
+	r.Lock()
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	wait := r.next.Sub(now)
+	r.next = r.next.Add(r.interval)
+	r.Unlock()
+	time.Sleep(wait)
+}
+
+// limitedTransport waits for the rateLimiter before every request.
+type limitedTransport struct {
+	base    http.RoundTripper
+	limiter *rateLimiter
+}
+
+// RoundTrip makes the request once it's allowed.
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.limiter.Wait()
+	return t.base.RoundTrip(req)
+}
+
+// consulLimiter is shared by every Consul client so --consul-rate covers all
+// of them together.
+var (
+	consulLimiter     *rateLimiter
+	consulLimiterOnce sync.Once
+)
+
+// limitClient makes client wait for --consul-rate before each request.
+func limitClient(client *http.Client) *http.Client {
+	consulLimiterOnce.Do(func() {
+		consulLimiter = newRateLimiter(ConsulRate)
+	})
+	client.Transport = &limitedTransport{base: client.Transport, limiter: consulLimiter}
+	return client
+}
@@ -0,0 +1,45 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(100)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		limiter.Wait()
+	}
+	// The first request doesn't wait - the other 4 are 10ms apart.
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("The requests should be spread out: %s", elapsed)
+	}
+}
+
+func TestSplaySleep(t *testing.T) {
+	defer func() { Splay = 0 }()
+	Splay = 20 * time.Millisecond
+	start := time.Now()
+	SplaySleep()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("The splay should be at most 20ms: %s", elapsed)
+	}
+}
+
+func TestConnectRate(t *testing.T) {
+	tc, _ := newTestConsul(t)
+	defer func() { ConsulRate = 0 }()
+	ConsulRate = 1000
+	c, err := Connect(strings.TrimPrefix(tc.server.URL, "http://"), "")
+	if err != nil {
+		t.Fatalf("Could not connect: %v", err)
+	}
+	tc.put("testing/hosts/data", exampleData)
+	if data, err := Get(c, "testing/hosts/data"); err != nil || data != exampleData {
+		t.Errorf("A rate limited client should still make requests: %q %v", data, err)
+	}
+}
@@ -1,12 +1,14 @@
-// +build linux darwin freebsd
+// +build linux darwin freebsd windows
 
 package commands
 
 import (
 	"fmt"
 	"github.com/spf13/cobra"
+	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -21,7 +23,39 @@ var rawCmd = &cobra.Command{
 	Run: rawRun,
 }
 
+var rawOutCmd = &cobra.Command{
+	Use:   "out",
+	Short: "Write a file from any Consul key as it is.",
+	Long:  `Raw out is for writing a file from any Consul key - there's no checksum key and no minimum length.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		checkRawFlags()
+		AutoEnable()
+	},
+	Run: rawOutRun,
+}
+
+var rawInCmd = &cobra.Command{
+	Use:   "in",
+	Short: "Save a file to any Consul key as it is.",
+	Long:  `Raw in is for saving a file to any Consul key - without the data and checksum keys that in uses.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		checkRawInFlags()
+		AutoEnable()
+	},
+	Run: rawInRun,
+}
+
 func rawRun(cmd *cobra.Command, args []string) {
+	rawOut(MinFileLength)
+}
+
+func rawOutRun(cmd *cobra.Command, args []string) {
+	rawOut(0)
+}
+
+// rawOut writes the key to the file if it has at least minLength lines - and
+// matches --checksum if it was passed.
+func rawOut(minLength int) {
 	start := time.Now()
 
 	c, err := Connect(ConsulServer, Token)
@@ -30,30 +64,110 @@ func rawRun(cmd *cobra.Command, args []string) {
 	}
 
 	// Get the KV data out of Consul.
-	KVData := Get(c, RawKeyOutLocation)
+	KVData, err := Get(c, RawKeyOutLocation)
+	ExitOnError(err, RawKeyOutLocation, "consul_get")
 
 	// Is the data long enough?
-	longEnough := LengthCheck(KVData, MinFileLength)
+	longEnough := LengthCheck(KVData, minLength)
 	Log(fmt.Sprintf("longEnough='%s'", strconv.FormatBool(longEnough)), "debug")
 
+	if !rawChecksumMatches(KVData) {
+		Log(fmt.Sprintf("checksumMismatch='yes' key='%s' - not writing.", RawKeyOutLocation), "info")
+		StatsdChecksum(RawKeyOutLocation)
+		exitRun(ExitChecksumMismatch, start, RawKeyOutLocation, "checksum_mismatch", "")
+	}
+
 	// If the data is long enough, write the file.
 	if longEnough {
+		// Don't rewrite the file - or run PostExec - if it hasn't changed.
+		err := CheckFiletoWrite(RawFiletoWrite, ComputeChecksum(KVData))
+		if err == ErrChecksumMatch {
+			exitRun(ExitNoChange, start, RawKeyOutLocation, "checksums_match", "")
+		}
+		ExitOnError(err, RawFiletoWrite, "check_file")
 		// Acually write the file.
-		WriteFile(KVData, RawFiletoWrite, FilePermissions, Owner)
+		ExitOnError(WriteFile(KVData, RawFiletoWrite, FilePermissions, Owner), RawFiletoWrite, "write_file")
 		StatsdRaw(RawKeyOutLocation)
 	} else {
 		Log("longEnough='no'", "info")
-		os.Exit(0)
+		exitRun(ExitRejected, start, RawKeyOutLocation, "too_short", "")
 	}
 
 	// Run this command after the file is written.
 	if PostExec != "" {
 		Log(fmt.Sprintf("exec='%s'", PostExec), "debug")
-		RunCommand(PostExec)
+		if status := RunPostExec(PostExec); status != 0 {
+			exitExecFailed(status, RawKeyOutLocation)
+		}
+	}
+	if status := RunHooks(Hook{Event: HookChange, Key: RawKeyOutLocation, File: RawFiletoWrite}); status != 0 {
+		exitExecFailed(status, RawKeyOutLocation)
 	}
 	RunTime(start, RawKeyOutLocation, "complete")
 }
 
+func rawInRun(cmd *cobra.Command, args []string) {
+	start := time.Now()
+
+	var data string
+	var err error
+	if RawFiletoRead == Stdio {
+		data, err = ReadStdin()
+	} else {
+		var raw []byte
+		raw, err = ioutil.ReadFile(RawFiletoRead)
+		data = string(raw)
+	}
+	ExitOnError(err, RawFiletoRead, "read_file")
+	RecordResult(len(data), ComputeChecksum(data), RawFiletoRead)
+	if !rawChecksumMatches(data) {
+		Log(fmt.Sprintf("checksumMismatch='yes' file='%s' - not saving.", RawFiletoRead), "info")
+		exitRun(ExitChecksumMismatch, start, RawKeyInLocation, "checksum_mismatch", "")
+	}
+
+	c, err := Connect(ConsulServer, Token)
+	if err != nil {
+		LogFatal("Could not connect to Consul.", RawKeyInLocation, "consul_connect")
+	}
+	current, err := Get(c, RawKeyInLocation)
+	ExitOnError(err, RawKeyInLocation, "consul_get")
+	if current == data {
+		Log(fmt.Sprintf("key='%s' unchanged='true'", RawKeyInLocation), "info")
+		exitRun(ExitNoChange, start, RawKeyInLocation, "checksums_match", "")
+	}
+	if DryRunSkip(fmt.Sprintf("save '%s' size='%d'", RawKeyInLocation, len(data))) {
+		exitRun(0, start, RawKeyInLocation, "dry_run", "")
+	}
+	ExitOnError(Set(c, RawKeyInLocation, data), RawKeyInLocation, "consul_set")
+	Log(fmt.Sprintf("consul key='%s' saved='true' size='%d'", RawKeyInLocation, len(data)), "info")
+	StatsdRaw(RawKeyInLocation)
+	if status := RunHooks(Hook{Event: HookChange, Key: RawKeyInLocation, File: RawFiletoRead}); status != 0 {
+		exitExecFailed(status, RawKeyInLocation)
+	}
+	RunTime(start, RawKeyInLocation, "complete")
+}
+
+// rawChecksumMatches is true if there's no --checksum or data has it.
+func rawChecksumMatches(data string) bool {
+	if RawChecksum == "" {
+		return true
+	}
+	return strings.EqualFold(ComputeChecksum(data), strings.TrimSpace(RawChecksum))
+}
+
+func checkRawInFlags() {
+	Log("Checking cli flags.", "debug")
+	if RawKeyInLocation == "" {
+		fmt.Println("Need a key location in -k")
+		os.Exit(1)
+	}
+	if RawFiletoRead == "" {
+		fmt.Println("Need a file to read in -f")
+		os.Exit(1)
+	}
+	Log("Required cli flags present.", "debug")
+}
+
 func checkRawFlags() {
 	Log("Checking cli flags.", "debug")
 	if RawKeyOutLocation == "" {
@@ -64,6 +178,7 @@ func checkRawFlags() {
 		fmt.Println("Need a file to write in -f")
 		os.Exit(1)
 	}
+	ExitOnError(CheckAllowedDir(RawFiletoWrite), RawFiletoWrite, "check_flags")
 	Log("Required cli flags present.", "debug")
 }
 
@@ -76,10 +191,28 @@ var (
 
 	// RawFiletoWrite is the location we want to write the data to.
 	RawFiletoWrite string
+
+	// RawKeyInLocation is the complete path of the key raw in saves to.
+	RawKeyInLocation string
+
+	// RawFiletoRead is the file raw in saves - or - for stdin.
+	RawFiletoRead string
+
+	// RawChecksum is the sha256 checksum the data has to have.
+	RawChecksum string
 )
 
 func init() {
 	RootCmd.AddCommand(rawCmd)
 	rawCmd.Flags().StringVarP(&RawKeyOutLocation, "key", "k", "", "Raw key to pull data from")
 	rawCmd.Flags().StringVarP(&RawFiletoWrite, "file", "f", "", "where to write the data")
+	rawCmd.Flags().StringVarP(&RawChecksum, "checksum", "", "", "only write the data if it has this sha256 checksum")
+	rawCmd.AddCommand(rawOutCmd)
+	rawOutCmd.Flags().StringVarP(&RawKeyOutLocation, "key", "k", "", "Raw key to pull data from")
+	rawOutCmd.Flags().StringVarP(&RawFiletoWrite, "file", "f", "", "where to write the data")
+	rawOutCmd.Flags().StringVarP(&RawChecksum, "checksum", "", "", "only write the data if it has this sha256 checksum")
+	rawCmd.AddCommand(rawInCmd)
+	rawInCmd.Flags().StringVarP(&RawKeyInLocation, "key", "k", "", "Raw key to save the data to")
+	rawInCmd.Flags().StringVarP(&RawFiletoRead, "file", "f", "", "file to read the data from - or - for stdin")
+	rawInCmd.Flags().StringVarP(&RawChecksum, "checksum", "", "", "only save the data if it has this sha256 checksum")
 }
@@ -0,0 +1,22 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRawChecksumMatches(t *testing.T) {
+	t.Cleanup(func() { RawChecksum = "" })
+	if !rawChecksumMatches(exampleData) {
+		t.Error("Any data matches without --checksum.")
+	}
+	RawChecksum = strings.ToUpper(exampleDataSHA) + "\n"
+	if !rawChecksumMatches(exampleData) {
+		t.Error("The checksum should match.")
+	}
+	if rawChecksumMatches(exampleData + "more") {
+		t.Error("Different data shouldn't match the checksum.")
+	}
+}
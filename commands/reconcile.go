@@ -0,0 +1,123 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/spf13/cobra"
+	"strings"
+	"time"
+)
+
+var reconcileCmd = &cobra.Command{
+	Use:   "reconcile",
+	Short: "Find and fix checksum keys that don't match their data.",
+	Long:  `Reconcile is for finding keys whose stored checksum has drifted from the data - usually from an interrupted write.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		AutoEnable()
+	},
+	Run: reconcileRun,
+}
+
+func reconcileRun(cmd *cobra.Command, args []string) {
+	start := time.Now()
+
+	c, err := Connect(ConsulServer, Token)
+	if err != nil {
+		LogFatal("Could not connect to Consul.", "reconcile", "consul_connect")
+	}
+
+	prefix := keyRoot(keyLayout(KeyReconcileLocation, "data", "manifest"))
+
+	drifted, err := Reconcile(c, prefix, ReconcileFix)
+	ExitOnError(err, "reconcile", "reconcile")
+	for _, drift := range drifted {
+		fmt.Printf("%s stored='%s' computed='%s' fixed='%t'\n", drift.Key, drift.Stored, drift.Computed, drift.Fixed)
+	}
+	Log(fmt.Sprintf("reconcile prefix='%s' drifted='%d' fix='%t'", prefix, len(drifted), ReconcileFix), "info")
+
+	// Any drift that's left behind is an error so it can be alerted on.
+	if len(drifted) > 0 && !ReconcileFix {
+		exitRun(1, start, "reconcile", "drifted", "")
+	}
+	RunTime(start, "reconcile", "complete")
+}
+
+// Drift is a kvexpress key whose stored checksum doesn't match its data.
+type Drift struct {
+	Key      string
+	Stored   string
+	Computed string
+	Fixed    bool
+}
+
+// Reconcile looks at every data key underneath prefix, recomputes the checksum
+// and compares it to the stored checksum key. With fix the checksum key is
+// rewritten to match the data - the data is written first, so an interrupted
+// write leaves the old checksum behind.
+func Reconcile(c *consul.Client, prefix string, fix bool) ([]Drift, error) {
+	var drifted []Drift
+	root := strings.TrimPrefix(PrefixLocation, "/") + "/"
+	layout := keyLayout("", "data", "manifest")
+	keys, err := Keys(c, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		name, ok := keyName(layout, key)
+		if !ok {
+			continue
+		}
+		base := root + name
+		data, err := GetData(c, name)
+		if err == nil {
+			data, err = DecodeData(c, name, data)
+		}
+		if errors.Is(err, ErrNoMoreRetries) {
+			return drifted, err
+		}
+		if err != nil {
+			Log(fmt.Sprintf("reconcile key='%s' message='%v' - skipping.", base, err), "info")
+			continue
+		}
+		stored, err := Get(c, KeyPath(name, "checksum"))
+		if err != nil {
+			return drifted, err
+		}
+		stored = strings.TrimSpace(stored)
+		computed := ChecksumAs(data, stored)
+		if stored == computed {
+			continue
+		}
+		Log(fmt.Sprintf("reconcile key='%s' stored='%s' computed='%s' drifted='true'", base, stored, computed), "info")
+		drift := Drift{Key: base, Stored: stored, Computed: computed}
+		if fix {
+			if err := Set(c, KeyPath(name, "checksum"), computed); err != nil {
+				return drifted, err
+			}
+			if err := Set(c, KeyPath(name, "updated"), ReturnCurrentUTC()); err != nil {
+				return drifted, err
+			}
+			drift.Fixed = true
+		}
+		drifted = append(drifted, drift)
+	}
+	return drifted, nil
+}
+
+var (
+	// KeyReconcileLocation limits reconcile to the keys underneath it.
+	// If it's blank every key in PrefixLocation is checked.
+	KeyReconcileLocation string
+
+	// ReconcileFix rewrites any checksum keys that have drifted.
+	ReconcileFix bool
+)
+
+func init() {
+	RootCmd.AddCommand(reconcileCmd)
+	reconcileCmd.Flags().StringVarP(&KeyReconcileLocation, "key", "k", "", "only check keys underneath this key")
+	reconcileCmd.Flags().BoolVarP(&ReconcileFix, "fix", "", false, "rewrite checksums that have drifted")
+}
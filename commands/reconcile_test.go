@@ -0,0 +1,40 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"testing"
+)
+
+func TestReconcile(t *testing.T) {
+	tc, c := newTestConsul(t)
+	tc.put("testing/hosts/data", exampleData)
+	tc.put("testing/hosts/checksum", exampleDataSHA)
+	tc.put("testing/drifted/data", exampleData+"\nan extra line")
+	tc.put("testing/drifted/checksum", exampleDataSHA)
+
+	drifted, err := Reconcile(c, "testing/", false)
+	if err != nil || len(drifted) != 1 || drifted[0].Key != "testing/drifted" {
+		t.Fatalf("Only testing/drifted should have drifted: %v", drifted)
+	}
+	if drifted[0].Fixed {
+		t.Error("Nothing should be fixed without fix.")
+	}
+	if checksum, _ := tc.value("testing/drifted/checksum"); checksum != exampleDataSHA {
+		t.Error("The checksum should not have changed without fix.")
+	}
+
+	drifted, err = Reconcile(c, "testing/", true)
+	if err != nil || len(drifted) != 1 || !drifted[0].Fixed {
+		t.Fatalf("testing/drifted should have been fixed: %v", drifted)
+	}
+	if checksum, _ := tc.value("testing/drifted/checksum"); checksum != ComputeChecksum(exampleData+"\nan extra line") {
+		t.Errorf("The checksum was not fixed: '%s'", checksum)
+	}
+	if _, ok := tc.value("testing/drifted/updated"); !ok {
+		t.Error("The updated key should be set when fixing.")
+	}
+	if drifted, err = Reconcile(c, "testing/", false); err != nil || len(drifted) != 0 {
+		t.Errorf("Nothing should drift after fixing: %v", drifted)
+	}
+}
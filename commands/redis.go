@@ -0,0 +1,488 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redisBackend talks to Redis with RESP - every key is a Redis key. Every
+// write is published on --redis-channel so watch can write the file as soon
+// as the key changes.
+type redisBackend struct {
+	sync.Mutex
+	address  string
+	useTLS   bool
+	password string
+	db       int
+	channel  string
+	timeout  time.Duration
+	conn     net.Conn
+	reader   *bufio.Reader
+
+	// subscribers are the watches - one for each prefix.
+	subscribers map[string]*redisSubscriber
+}
+
+// redisTxnScript checks every cas key and then sets or removes every key - a
+// script runs on its own so nothing else can write in between. A cas key's
+// index is the start of the sha1 of its value and blank when it doesn't
+// exist. Every key that's written is published on ARGV[1].
+const redisTxnScript = `
+for i = 1, #KEYS do
+  local verb, index = ARGV[i*3-1], ARGV[i*3]
+  if verb == 'cas' then
+    local current = redis.call('GET', KEYS[i])
+    if index == '' then
+      if current then return 0 end
+    elseif not current or string.sub(redis.sha1hex(current), 1, 16) ~= index then
+      return 0
+    end
+  end
+end
+for i = 1, #KEYS do
+  if ARGV[i*3-1] == 'del' then
+    redis.call('DEL', KEYS[i])
+  else
+    redis.call('SET', KEYS[i], ARGV[i*3+1])
+  end
+  redis.call('PUBLISH', ARGV[1], KEYS[i])
+end
+return 1
+`
+
+// redisNil is a nil reply - a key that doesn't exist.
+var redisNil = errors.New("redis: nil")
+
+// redisError is an error reply from Redis.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// newRedisBackend reads --redis-server - host:port or
+// redis://:password@host:port/db, and rediss:// for TLS. --redis-password-file
+// and then --redis-password win over the password in the URL.
+func newRedisBackend(server string) (*redisBackend, error) {
+	r := &redisBackend{channel: RedisChannel, timeout: 30 * time.Second, subscribers: make(map[string]*redisSubscriber)}
+	if !strings.Contains(server, "://") {
+		server = "redis://" + server
+	}
+	u, err := url.Parse(server)
+	if err != nil || u.Host == "" || (u.Scheme != "redis" && u.Scheme != "rediss") {
+		return nil, fmt.Errorf("'%s' isn't a Redis server - use host:port or redis://host:port/db", server)
+	}
+	r.address, r.useTLS = u.Host, u.Scheme == "rediss"
+	if u.Port() == "" {
+		r.address = net.JoinHostPort(u.Host, "6379")
+	}
+	if password, ok := u.User.Password(); ok {
+		r.password = password
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if r.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("'%s' isn't a Redis database number", db)
+		}
+	}
+	switch {
+	case RedisPasswordFile != "":
+		if r.password, err = ReadTokenFile(RedisPasswordFile); err != nil {
+			return nil, err
+		}
+	case RedisPassword != "":
+		r.password = RedisPassword
+	}
+	if r.channel == "" {
+		return nil, errors.New("need a --redis-channel")
+	}
+	return r, nil
+}
+
+// dial connects to Redis, logs in and picks the database.
+func (r *redisBackend) dial() (net.Conn, *bufio.Reader, error) {
+	var conn net.Conn
+	var err error
+	if r.useTLS {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: r.timeout}, "tcp", r.address, &tls.Config{})
+	} else {
+		conn, err = net.DialTimeout("tcp", r.address, r.timeout)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(conn)
+	setup := [][]string{}
+	if r.password != "" {
+		setup = append(setup, []string{"AUTH", r.password})
+	}
+	if r.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(r.db)})
+	}
+	for _, command := range setup {
+		conn.SetDeadline(time.Now().Add(r.timeout))
+		if err = redisSend(conn, command...); err == nil {
+			_, err = redisReply(reader)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, nil, fmt.Errorf("could not %s: %v", strings.ToLower(command[0]), err)
+		}
+	}
+	return conn, reader, nil
+}
+
+// redisSend writes a command as an array of bulk strings.
+func redisSend(conn net.Conn, args ...string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := io.WriteString(conn, b.String())
+	return err
+}
+
+// redisReply reads a reply - a string, an int64, a []interface{} or nil. An
+// error reply is a redisError and a nil bulk string is redisNil.
+func redisReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, redisNil
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return nil, redisNil
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			items[i], err = redisReply(reader)
+			if err != nil && err != redisNil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply '%s'", line)
+}
+
+// do runs a command - a connection that fails is made again on the next one.
+func (r *redisBackend) do(args ...string) (interface{}, error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.conn == nil {
+		conn, reader, err := r.dial()
+		if err != nil {
+			return nil, err
+		}
+		r.conn, r.reader = conn, reader
+	}
+	r.conn.SetDeadline(time.Now().Add(r.timeout))
+	err := redisSend(r.conn, args...)
+	var reply interface{}
+	if err == nil {
+		reply, err = redisReply(r.reader)
+	}
+	if err != nil && err != redisNil {
+		if _, ok := err.(redisError); !ok {
+			r.conn.Close()
+			r.conn = nil
+		}
+	}
+	return reply, err
+}
+
+func (r *redisBackend) Get(key string) (string, error) {
+	key = strings.TrimPrefix(key, "/")
+	reply, err := r.do("GET", key)
+	Log(fmt.Sprintf("action='redisGet' key='%s'", key), "debug")
+	if err == redisNil {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	value, _ := reply.(string)
+	return value, nil
+}
+
+// Index is the start of the sha1 of the value - Redis doesn't keep a version.
+func (r *redisBackend) Index(key string) (uint64, string, error) {
+	key = strings.TrimPrefix(key, "/")
+	reply, err := r.do("GET", key)
+	if err == redisNil {
+		return 0, "", nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	value, _ := reply.(string)
+	return redisIndex(value), value, nil
+}
+
+// redisIndex is the first 64 bits of the sha1 of value - what the script
+// compares with redis.sha1hex.
+func redisIndex(value string) uint64 {
+	sum := sha1.Sum([]byte(value))
+	index, _ := strconv.ParseUint(fmt.Sprintf("%x", sum[:8]), 16, 64)
+	return index
+}
+
+func (r *redisBackend) Set(key, value string) (bool, error) {
+	key = strings.TrimPrefix(key, "/")
+	if _, err := r.do("SET", key, value); err != nil {
+		return false, err
+	}
+	Log(fmt.Sprintf("action='redisSet' key='%s'", key), "debug")
+	return true, r.publish(key)
+}
+
+func (r *redisBackend) Del(key string) (bool, error) {
+	key = strings.TrimPrefix(key, "/")
+	if _, err := r.do("DEL", key); err != nil {
+		return false, err
+	}
+	Log(fmt.Sprintf("action='redisDel' key='%s'", key), "info")
+	return true, r.publish(key)
+}
+
+// publish tells the watches that key was written.
+func (r *redisBackend) publish(key string) error {
+	_, err := r.do("PUBLISH", r.channel, key)
+	return err
+}
+
+// redisGlob escapes the characters that mean something in a MATCH pattern.
+func redisGlob(prefix string) string {
+	var b strings.Builder
+	for _, ch := range prefix {
+		if strings.ContainsRune(`*?[]\`, ch) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(ch)
+	}
+	return b.String() + "*"
+}
+
+func (r *redisBackend) Keys(prefix string) ([]string, error) {
+	prefix = strings.TrimPrefix(prefix, "/")
+	found := make(map[string]bool)
+	cursor := "0"
+	for {
+		reply, err := r.do("SCAN", cursor, "MATCH", redisGlob(prefix), "COUNT", "1000")
+		if err != nil {
+			return nil, err
+		}
+		items, ok := reply.([]interface{})
+		if !ok || len(items) != 2 {
+			return nil, errors.New("redis: SCAN didn't answer with a cursor and keys")
+		}
+		cursor, _ = items[0].(string)
+		keys, _ := items[1].([]interface{})
+		for _, key := range keys {
+			if name, ok := key.(string); ok {
+				found[name] = true
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			break
+		}
+	}
+	keys := make([]string, 0, len(found))
+	for key := range found {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	Log(fmt.Sprintf("action='redisKeys' prefix='%s' keys='%d'", prefix, len(keys)), "debug")
+	return keys, nil
+}
+
+// Txn runs the KVSet, KVCAS, KVDelete and KVDeleteTree operations in a single
+// script. It's false when a KVCAS lost.
+func (r *redisBackend) Txn(ops consul.TxnOps) (bool, error) {
+	var keys []string
+	args := []string{r.channel}
+	add := func(key, verb, index, value string) {
+		keys = append(keys, strings.TrimPrefix(key, "/"))
+		args = append(args, verb, index, value)
+	}
+	for _, op := range ops {
+		if op.KV == nil {
+			return false, errors.New("redis only supports key value operations")
+		}
+		switch op.KV.Verb {
+		case consul.KVSet:
+			add(op.KV.Key, "set", "", string(op.KV.Value))
+		case consul.KVCAS:
+			index := ""
+			if op.KV.Index != 0 {
+				index = fmt.Sprintf("%016x", op.KV.Index)
+			}
+			add(op.KV.Key, "cas", index, string(op.KV.Value))
+		case consul.KVDelete:
+			add(op.KV.Key, "del", "", "")
+		case consul.KVDeleteTree:
+			tree, err := r.Keys(op.KV.Key)
+			if err != nil {
+				return false, err
+			}
+			for _, key := range tree {
+				add(key, "del", "", "")
+			}
+		default:
+			return false, fmt.Errorf("redis doesn't support the '%s' operation", op.KV.Verb)
+		}
+	}
+	command := append([]string{"EVAL", redisTxnScript, strconv.Itoa(len(keys))}, keys...)
+	reply, err := r.do(append(command, args...)...)
+	if err != nil {
+		return false, err
+	}
+	Log(fmt.Sprintf("action='redisTxn' ops='%d' ok='%v'", len(ops), reply), "debug")
+	return reply == int64(1), nil
+}
+
+// redisSubscriber counts the writes underneath a prefix that were published
+// on the channel.
+type redisSubscriber struct {
+	sync.Mutex
+	prefix  string
+	index   uint64
+	err     error
+	changed chan struct{}
+}
+
+// Wait is the Redis version of a blocking query - it returns a new index as
+// soon as a key underneath prefix is published, or index after wait.
+func (r *redisBackend) Wait(prefix string, index uint64, wait time.Duration) (uint64, error) {
+	prefix = strings.TrimPrefix(prefix, "/")
+	r.Lock()
+	sub, ok := r.subscribers[prefix]
+	if !ok {
+		sub = &redisSubscriber{prefix: prefix, index: 1, changed: make(chan struct{})}
+		r.subscribers[prefix] = sub
+		go r.subscribe(sub)
+	}
+	r.Unlock()
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		sub.Lock()
+		current, err, changed := sub.index, sub.err, sub.changed
+		sub.Unlock()
+		if current != index {
+			return current, nil
+		}
+		if err != nil {
+			return index, err
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			Log(fmt.Sprintf("action='redisWait' prefix='%s' index='%d' changed='false'", prefix, index), "debug")
+			return index, nil
+		}
+	}
+}
+
+// subscribe listens on the channel for sub until kvexpress stops. When the
+// subscription is lost the index moves on once it's back, so a change that
+// was missed is still written.
+func (r *redisBackend) subscribe(sub *redisSubscriber) {
+	for attempt := 1; ; attempt++ {
+		err := r.listen(sub)
+		Log(fmt.Sprintf("action='redisSubscribe' channel='%s' message='%v'", r.channel, err), "info")
+		sub.bump(err)
+		time.Sleep(RetryBackoff(attempt))
+	}
+}
+
+// listen subscribes to the channel and counts the keys that are published.
+func (r *redisBackend) listen(sub *redisSubscriber) error {
+	conn, reader, err := r.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := redisSend(conn, "SUBSCRIBE", r.channel); err != nil {
+		return err
+	}
+	subscribed := false
+	for {
+		// Nothing is sent while it's quiet - the connection stays open.
+		conn.SetDeadline(time.Time{})
+		reply, err := redisReply(reader)
+		if err != nil {
+			return err
+		}
+		items, _ := reply.([]interface{})
+		if len(items) != 3 {
+			continue
+		}
+		kind, _ := items[0].(string)
+		switch kind {
+		case "subscribe":
+			if !subscribed {
+				subscribed = true
+				// Anything that was written while it wasn't listening is
+				// picked up by a new index.
+				sub.bump(nil)
+			}
+		case "message":
+			if key, _ := items[2].(string); strings.HasPrefix(key, sub.prefix) {
+				sub.bump(nil)
+			}
+		}
+	}
+}
+
+// bump moves the index on - or records why the subscription was lost.
+func (s *redisSubscriber) bump(err error) {
+	s.Lock()
+	defer s.Unlock()
+	if err == nil {
+		s.index++
+	}
+	s.err = err
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
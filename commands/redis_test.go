@@ -0,0 +1,268 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testRedis is a small in-memory stand-in for a Redis server - it knows the
+// commands redisBackend sends and runs redisTxnScript in Go.
+type testRedis struct {
+	sync.Mutex
+	kv          map[string]string
+	subscribers []net.Conn
+	evals       int
+}
+
+func newTestRedis(t *testing.T) *testRedis {
+	tr := &testRedis{kv: make(map[string]string)}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go tr.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { backend = nil })
+	RedisChannel = "kvexpress"
+	redis, err := newRedisBackend(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend = redis
+	return tr
+}
+
+func (tr *testRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		request, err := redisReply(reader)
+		if err != nil {
+			return
+		}
+		items, _ := request.([]interface{})
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i], _ = item.(string)
+		}
+		tr.Lock()
+		reply := tr.handle(conn, args)
+		tr.Unlock()
+		conn.Write([]byte(reply))
+	}
+}
+
+func redisBulk(value string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+}
+
+func (tr *testRedis) publish(channel, key string) {
+	for _, conn := range tr.subscribers {
+		conn.Write([]byte("*3\r\n" + redisBulk("message") + redisBulk(channel) + redisBulk(key)))
+	}
+}
+
+func (tr *testRedis) handle(conn net.Conn, args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		value, ok := tr.kv[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return redisBulk(value)
+	case "SET":
+		tr.kv[args[1]] = args[2]
+		return "+OK\r\n"
+	case "DEL":
+		delete(tr.kv, args[1])
+		return ":1\r\n"
+	case "SCAN":
+		// redisBackend only sends an escaped prefix and a *.
+		prefix := strings.TrimSuffix(strings.Replace(args[3], `\`, "", -1), "*")
+		var keys []string
+		for key := range tr.kv {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, redisBulk(key))
+			}
+		}
+		return "*2\r\n" + redisBulk("0") + fmt.Sprintf("*%d\r\n", len(keys)) + strings.Join(keys, "")
+	case "PUBLISH":
+		tr.publish(args[1], args[2])
+		return fmt.Sprintf(":%d\r\n", len(tr.subscribers))
+	case "SUBSCRIBE":
+		tr.subscribers = append(tr.subscribers, conn)
+		return "*3\r\n" + redisBulk("subscribe") + redisBulk(args[1]) + ":1\r\n"
+	case "EVAL":
+		tr.evals++
+		count, _ := strconv.Atoi(args[2])
+		keys, argv := args[3:3+count], args[3+count:]
+		for i, key := range keys {
+			if argv[i*3+1] != "cas" {
+				continue
+			}
+			current, ok := tr.kv[key]
+			index := argv[i*3+2]
+			if index == "" && ok || index != "" && (!ok || fmt.Sprintf("%x", sha1.Sum([]byte(current)))[:16] != index) {
+				return ":0\r\n"
+			}
+		}
+		for i, key := range keys {
+			if argv[i*3+1] == "del" {
+				delete(tr.kv, key)
+			} else {
+				tr.kv[key] = argv[i*3+3]
+			}
+			tr.publish(argv[0], key)
+		}
+		return ":1\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func (tr *testRedis) value(key string) (string, bool) {
+	tr.Lock()
+	defer tr.Unlock()
+	value, ok := tr.kv[key]
+	return value, ok
+}
+
+func TestRedisBackend(t *testing.T) {
+	tr := newTestRedis(t)
+	tc, c := newTestConsul(t)
+	if err := Set(c, "/testing/keyname/data", exampleData); err != nil {
+		t.Fatal(err)
+	}
+	Set(c, "testing/keyname/checksum", exampleDataSHA)
+	if value, _ := tr.value("testing/keyname/data"); value != exampleData {
+		t.Error("Set did not store the data in Redis.")
+	}
+	if tc.count("PUT") != 0 {
+		t.Error("Consul should not be used with the redis backend.")
+	}
+	if value, err := Get(c, "testing/keyname/data"); err != nil || value != exampleData {
+		t.Errorf("Get did not return the data from Redis: '%s' %v", value, err)
+	}
+	if value, err := Get(c, "testing/missing/data"); err != nil || value != "" {
+		t.Error("Get of a missing key should be blank.")
+	}
+	keys, err := Keys(c, "testing/")
+	if err != nil || strings.Join(keys, ",") != "testing/keyname/checksum,testing/keyname/data" {
+		t.Errorf("Keys did not list the keys: %v %v", keys, err)
+	}
+	Del(c, "testing/keyname/checksum")
+	if _, ok := tr.value("testing/keyname/checksum"); ok {
+		t.Error("Del did not remove the key.")
+	}
+}
+
+func TestRedisServer(t *testing.T) {
+	RedisChannel, RedisPassword = "kvexpress", ""
+	r, err := newRedisBackend("rediss://:secret@redis.example.com/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.address != "redis.example.com:6379" || !r.useTLS || r.password != "secret" || r.db != 2 {
+		t.Errorf("The server URL wasn't read: %+v", r)
+	}
+	if _, err := newRedisBackend("http://redis.example.com"); err == nil {
+		t.Error("An http URL isn't a Redis server.")
+	}
+
+	RedisPasswordFile = filepath.Join(t.TempDir(), "redis.password")
+	defer func() { RedisPasswordFile = "" }()
+	ioutil.WriteFile(RedisPasswordFile, []byte("from-file\n"), 0600)
+	if r, err := newRedisBackend("rediss://:secret@redis.example.com/2"); err != nil || r.password != "from-file" {
+		t.Errorf("The password should be read from --redis-password-file: %+v %v", r, err)
+	}
+}
+
+func TestRedisSaveCAS(t *testing.T) {
+	PrefixLocation = "testing"
+	tr := newTestRedis(t)
+	_, c := newTestConsul(t)
+	Set(c, "testing/hosts/data/0", "left over")
+	saved, err := SaveCAS(c, "hosts", exampleData, exampleDataSHA, "")
+	if err != nil || !saved {
+		t.Fatalf("The data should be saved: %t %v", saved, err)
+	}
+	if tr.evals != 1 {
+		t.Errorf("The data and checksum should be saved in a single script: %d", tr.evals)
+	}
+	for key, expected := range map[string]string{"testing/hosts/data": exampleData, "testing/hosts/checksum": exampleDataSHA} {
+		if value, _ := tr.value(key); value != expected {
+			t.Errorf("'%s' should be '%s': '%s'", key, expected, value)
+		}
+	}
+	if _, ok := tr.value("testing/hosts/data/0"); ok {
+		t.Error("The chunks should be removed.")
+	}
+
+	// A KVCAS that lost changes nothing.
+	redis := backend.(txnBackend)
+	index, _, _ := redis.Index("testing/hosts/checksum")
+	Set(c, "testing/hosts/checksum", "changed")
+	ok, err := redis.Txn(consul.TxnOps{
+		{KV: &consul.KVTxnOp{Verb: consul.KVSet, Key: "testing/hosts/data", Value: []byte("new")}},
+		{KV: &consul.KVTxnOp{Verb: consul.KVCAS, Key: "testing/hosts/checksum", Value: []byte("new"), Index: index}},
+	})
+	if err != nil || ok {
+		t.Errorf("The script should lose: %t %v", ok, err)
+	}
+	if value, _ := tr.value("testing/hosts/data"); value != exampleData {
+		t.Errorf("A script that lost shouldn't change anything: '%s'", value)
+	}
+}
+
+func TestRedisWait(t *testing.T) {
+	newTestRedis(t)
+	_, c := newTestConsul(t)
+	index, err := Wait(c, "testing/hosts", 0, time.Second)
+	if err != nil || index == 0 {
+		t.Fatalf("The first wait should return an index straight away: %d %v", index, err)
+	}
+	// Let the subscription settle.
+	for start := time.Now(); time.Since(start) < time.Second; {
+		newIndex, _ := Wait(c, "testing/hosts", index, 50*time.Millisecond)
+		if newIndex == index {
+			break
+		}
+		index = newIndex
+	}
+	if newIndex, _ := Wait(c, "testing/hosts", index, 50*time.Millisecond); newIndex != index {
+		t.Errorf("Nothing changed so the index should stay the same: %d %d", index, newIndex)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		Set(c, "testing/other/data", "not watched")
+		Set(c, "testing/hosts/data", exampleData)
+	}()
+	start := time.Now()
+	newIndex, err := Wait(c, "testing/hosts", index, 5*time.Second)
+	if err != nil || newIndex <= index {
+		t.Fatalf("Publishing the key should wake the wait: %d %d %v", index, newIndex, err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("The wait should end when the key is published: %s", time.Since(start))
+	}
+}
@@ -0,0 +1,182 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"time"
+)
+
+var repairCmd = &cobra.Command{
+	Use:   "repair",
+	Short: "Rewrite a checksum that doesn't match the data.",
+	Long:  `Repair is for a key whose checksum doesn't match its data - after a write that stopped half way. It computes the checksum of the data that's in Consul and saves it once you've confirmed it or with --yes. The data isn't changed.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		checkRepairFlags()
+		AutoEnable()
+	},
+	Run: repairRun,
+}
+
+func repairRun(cmd *cobra.Command, args []string) {
+	start := time.Now()
+	c, err := Connect(ConsulServer, Token)
+	if err != nil {
+		LogFatal("Could not connect to Consul.", KeyRepairLocation, "consul_connect")
+	}
+	result, err := Repair(c, KeyRepairLocation, repairConfirm)
+	ExitOnError(err, KeyRepairLocation, "repair")
+	RecordDetails(result)
+	switch {
+	case result.Matches:
+		fmt.Printf("The checksum for '%s' already matches its data.\n", KeyRepairLocation)
+		exitRun(ExitNoChange, start, KeyRepairLocation, "consul_checksums_match", "")
+	case !result.Repaired:
+		fmt.Printf("Not repaired - the checksum for '%s' still doesn't match its data.\n", KeyRepairLocation)
+		exitRun(ExitChecksumMismatch, start, KeyRepairLocation, "not_repaired", "")
+	}
+	fmt.Printf("Repaired the checksum for '%s'.\n", KeyRepairLocation)
+	RunTime(start, KeyRepairLocation, "complete")
+}
+
+// RepairResult is the checksum that was saved and the one the data has.
+type RepairResult struct {
+	Before   string `json:"before"`
+	After    string `json:"after"`
+	Matches  bool   `json:"matches"`
+	Repaired bool   `json:"repaired"`
+}
+
+// Repair saves the checksum of the data in key if the checksum that's there
+// doesn't match it - it's reconcile for a single key. The data is decoded first
+// and the checksums keep their algorithms. confirm is asked before anything is
+// written and the checksum key is only written if nobody else has changed it
+// since it was read.
+func Repair(c *consul.Client, key string, confirm func(RepairResult) bool) (RepairResult, error) {
+	var result RepairResult
+	KeyChecksum := KeyPath(key, "checksum")
+	KeyChecksums := KeyPath(key, "checksums")
+	var index uint64
+	var stored string
+	var err error
+	if atomicWrites() {
+		index, stored, err = consulIndex(c, KeyChecksum)
+	} else {
+		stored, err = Get(c, KeyChecksum)
+	}
+	if err != nil {
+		return result, err
+	}
+	result.Before = strings.TrimSpace(stored)
+	checksums, err := Get(c, KeyChecksums)
+	if err != nil {
+		return result, err
+	}
+	checksums = strings.TrimSpace(checksums)
+	data, err := GetData(c, key)
+	if err != nil {
+		return result, err
+	}
+	if data == "" {
+		return result, fmt.Errorf("there's no data in '%s'", key)
+	}
+	if data, err = DecodeData(c, key, data); err != nil {
+		return result, err
+	}
+	result.After = StoreChecksum(data)
+	if result.Before != "" {
+		result.After = ChecksumAs(data, result.Before)
+	}
+	repaired := repairChecksums(data, checksums)
+	if result.After == result.Before && repaired == checksums {
+		result.Matches = true
+		return result, nil
+	}
+	Log(fmt.Sprintf("repair key='%s' before='%s' after='%s'", key, result.Before, result.After), "info")
+	if !confirm(result) || DryRunSkip(fmt.Sprintf("save the checksum '%s' for '%s'", result.After, key)) {
+		Log(fmt.Sprintf("repair key='%s' repaired='false'", key), "info")
+		return result, nil
+	}
+	if !atomicWrites() {
+		if err := Set(c, KeyChecksum, result.After); err != nil {
+			return result, err
+		}
+		if err := SetChecksums(c, key, repaired); err != nil {
+			return result, err
+		}
+		if err := Set(c, KeyPath(key, "updated"), ReturnCurrentUTC()); err != nil {
+			return result, err
+		}
+	} else {
+		ops := consul.TxnOps{
+			{KV: &consul.KVTxnOp{Verb: consul.KVCAS, Key: KeyChecksum, Value: []byte(result.After), Index: index}},
+			checksumsOp(key, repaired),
+			setOp(KeyPath(key, "updated"), ReturnCurrentUTC()),
+		}
+		ok, err := kvTxn(c, ops)
+		if err != nil {
+			return result, err
+		}
+		if !ok {
+			return result, fmt.Errorf("'%s' was written while it was being repaired: %w", key, ErrCASConflict)
+		}
+	}
+	result.Repaired = true
+	Log(fmt.Sprintf("repair key='%s' before='%s' after='%s' repaired='true'", key, result.Before, result.After), "info")
+	return result, nil
+}
+
+// repairChecksums computes every line of the checksums key again for data.
+func repairChecksums(data, checksums string) string {
+	if checksums == "" {
+		return ""
+	}
+	var lines []string
+	for _, line := range strings.Split(checksums, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, ChecksumAs(data, line))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// repairConfirm shows the checksums and asks before the new one is saved -
+// --yes doesn't ask.
+func repairConfirm(result RepairResult) bool {
+	before := result.Before
+	if before == "" {
+		before = "missing"
+	}
+	fmt.Printf("checksum: %s\ndata:     %s\n", before, result.After)
+	if RepairYes {
+		return true
+	}
+	return Confirm(fmt.Sprintf("Save '%s' as the checksum for '%s'?", result.After, KeyRepairLocation))
+}
+
+func checkRepairFlags() {
+	Log("Checking cli flags.", "debug")
+	if KeyRepairLocation == "" {
+		fmt.Println("Need a key location in -k")
+		os.Exit(1)
+	}
+	Log("Required cli flags present.", "debug")
+}
+
+var (
+	// KeyRepairLocation is the key whose checksum is repaired.
+	KeyRepairLocation string
+
+	// RepairYes saves the checksum without asking.
+	RepairYes bool
+)
+
+func init() {
+	RootCmd.AddCommand(repairCmd)
+	repairCmd.Flags().StringVarP(&KeyRepairLocation, "key", "k", "", "key to repair")
+	repairCmd.Flags().BoolVarP(&RepairYes, "yes", "y", false, "save the checksum without asking")
+}
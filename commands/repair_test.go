@@ -0,0 +1,53 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+	PrefixLocation = "testing"
+	tc, c := newTestConsul(t)
+	tc.put("testing/repair/data", exampleData)
+	tc.put("testing/repair/checksum", "0000")
+
+	result, err := Repair(c, "repair", func(RepairResult) bool { return false })
+	if err != nil || result.Matches || result.Repaired || result.Before != "0000" || result.After != exampleDataSHA {
+		t.Errorf("A bad checksum should be found but not saved without a yes: %+v %v", result, err)
+	}
+	if value, _ := tc.value("testing/repair/checksum"); value != "0000" {
+		t.Errorf("The checksum shouldn't be written without a yes: %s", value)
+	}
+	if result, err = Repair(c, "repair", func(RepairResult) bool { return true }); err != nil || !result.Repaired {
+		t.Errorf("The checksum should be saved: %+v %v", result, err)
+	}
+	if value, _ := tc.value("testing/repair/checksum"); value != exampleDataSHA {
+		t.Errorf("The checksum should be the data's: %s", value)
+	}
+	if result, err = Repair(c, "repair", nil); err != nil || !result.Matches || result.Repaired {
+		t.Errorf("A checksum that matches shouldn't be asked about: %+v %v", result, err)
+	}
+
+	tc.put("testing/repair/checksum", "0000")
+	if _, err := Repair(c, "repair", func(RepairResult) bool {
+		tc.put("testing/repair/checksum", "1111")
+		return true
+	}); err == nil {
+		t.Error("A checksum that changed while it was asked about shouldn't be overwritten.")
+	}
+	if value, _ := tc.value("testing/repair/checksum"); value != "1111" {
+		t.Errorf("The other writer's checksum should be left alone: %s", value)
+	}
+	tc.put("testing/repair/checksum", exampleDataSHA)
+	tc.put("testing/repair/checksums", "sha512:00\nsha256:00")
+	if result, err := Repair(c, "repair", func(RepairResult) bool { return true }); err != nil || !result.Repaired {
+		t.Errorf("A checksums key that doesn't match should be saved: %+v %v", result, err)
+	}
+	if value, _ := tc.value("testing/repair/checksums"); value != "sha512:"+HashData(exampleData, "sha512")+"\nsha256:"+exampleDataSHA {
+		t.Errorf("Every line should keep its algorithm: %s", value)
+	}
+	if _, err := Repair(c, "missing", nil); err == nil {
+		t.Error("A key without data should be an error.")
+	}
+}
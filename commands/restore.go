@@ -0,0 +1,291 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var restoreCmd = &cobra.Command{
+	Use:   "restore",
+	Short: "Put back the files in a snapshot.",
+	Long:  `Restore writes the files in a signed snapshot tarball that are inside --path or the --manifest back with their owner, mode and mtime - files that already have the right checksum are left alone. The state files only go back in --tmp-dir on the host that took the snapshot.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		checkRestoreFlags()
+		AutoEnable()
+	},
+	Run: restoreRun,
+}
+
+func restoreRun(cmd *cobra.Command, args []string) {
+	start := time.Now()
+	snapshot, contents, err := ReadSnapshot(SnapshotArchive, verifyPublicKey)
+	ExitOnError(err, SnapshotArchive, "read_snapshot")
+	results, err := RestoreSnapshot(snapshot, contents, snapshotPaths())
+	ExitOnError(err, SnapshotArchive, "restore")
+	restored := 0
+	for _, result := range results {
+		fmt.Printf("%-9s %-8s %s\n", result.Status, result.Kind, result.Path)
+		if result.Status == "restored" {
+			restored++
+		}
+	}
+	Log(fmt.Sprintf("restore file='%s' host='%s' files='%d' restored='%d'", SnapshotArchive, snapshot.Host, len(results), restored), "info")
+	RecordDetails(results)
+	PrintResult("restore", "complete", time.Since(start), "")
+	if restored == 0 && !DryRun {
+		exitRun(ExitNoChange, start, "restore", "checksums_match", "")
+	}
+	RunTime(start, "restore", "complete")
+}
+
+// RestoreResult is what restore did with a file - restored, unchanged,
+// skipped with the reason or dry_run.
+type RestoreResult struct {
+	Path   string `json:"path"`
+	Kind   string `json:"kind"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// snapshotManifestMax and snapshotSignatureMax are the most ReadSnapshot
+// reads of the manifest and its signature before they're verified.
+const (
+	snapshotManifestMax  = 16 * 1024 * 1024
+	snapshotSignatureMax = 4096
+)
+
+// ReadSnapshot reads the Snapshot and the files in the tarball at archive -
+// the manifest has to be signed by key. The manifest and its signature are
+// the first two entries and are verified before anything else is read, and
+// then only the files the manifest names are read - each at most its size.
+func ReadSnapshot(archive string, key ed25519.PublicKey) (Snapshot, map[string][]byte, error) {
+	var snapshot Snapshot
+	in, err := os.Open(archive)
+	if err != nil {
+		return snapshot, nil, err
+	}
+	defer in.Close()
+	gz, err := gzip.NewReader(in)
+	if err != nil {
+		return snapshot, nil, fmt.Errorf("'%s' isn't a snapshot: %v", archive, err)
+	}
+	tr := tar.NewReader(gz)
+	manifest, err := readSnapshotEntry(tr, archive, snapshotManifest, snapshotManifestMax)
+	if err != nil {
+		return snapshot, nil, err
+	}
+	signature, err := readSnapshotEntry(tr, archive, snapshotSignature, snapshotSignatureMax)
+	if err != nil {
+		return snapshot, nil, fmt.Errorf("'%s' isn't signed: %v", archive, err)
+	}
+	if err := VerifyData(key, string(manifest), string(signature)); err != nil {
+		return snapshot, nil, fmt.Errorf("the %s in '%s' doesn't match --verify-key: %v", snapshotManifest, archive, err)
+	}
+	if err := json.Unmarshal(manifest, &snapshot); err != nil {
+		return snapshot, nil, fmt.Errorf("could not read the %s in '%s': %v", snapshotManifest, archive, err)
+	}
+	sizes := make(map[string]int64)
+	for _, file := range snapshot.Files {
+		sizes[snapshotName(file)] = file.Size
+	}
+	contents := make(map[string][]byte)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return snapshot, nil, fmt.Errorf("'%s' isn't a snapshot: %v", archive, err)
+		}
+		size, ok := sizes[header.Name]
+		if !ok {
+			return snapshot, nil, fmt.Errorf("'%s' has '%s' and it isn't in the %s", archive, header.Name, snapshotManifest)
+		}
+		if _, ok := contents[header.Name]; ok {
+			return snapshot, nil, fmt.Errorf("'%s' has '%s' more than once", archive, header.Name)
+		}
+		data, err := readTarEntry(tr, header, size)
+		if err != nil {
+			return snapshot, nil, fmt.Errorf("'%s' in '%s' %v", header.Name, archive, err)
+		}
+		contents[header.Name] = data
+	}
+	return snapshot, contents, nil
+}
+
+// readSnapshotEntry reads the next entry in tr - it has to be name and at
+// most max bytes.
+func readSnapshotEntry(tr *tar.Reader, archive, name string, max int64) ([]byte, error) {
+	header, err := tr.Next()
+	if err == io.EOF {
+		return nil, fmt.Errorf("'%s' doesn't have a %s", archive, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("'%s' isn't a snapshot: %v", archive, err)
+	}
+	if header.Name != name {
+		return nil, fmt.Errorf("'%s' has '%s' where the %s should be", archive, header.Name, name)
+	}
+	if header.Size > max {
+		return nil, fmt.Errorf("the %s in '%s' is bigger than %d bytes", name, archive, max)
+	}
+	data, err := readTarEntry(tr, header, header.Size)
+	if err != nil {
+		return nil, fmt.Errorf("the %s in '%s' %v", name, archive, err)
+	}
+	return data, nil
+}
+
+// readTarEntry reads the entry in tr - it has to be size bytes, and no
+// more than that is read.
+func readTarEntry(tr *tar.Reader, header *tar.Header, size int64) ([]byte, error) {
+	if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeRegA {
+		return nil, fmt.Errorf("isn't a regular file")
+	}
+	if header.Size != size {
+		return nil, fmt.Errorf("is %d bytes and should be %d", header.Size, size)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(tr, size))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != size {
+		return nil, fmt.Errorf("was cut short at %d bytes", len(data))
+	}
+	return data, nil
+}
+
+// snapshotKinds are the kinds of file a snapshot has.
+var snapshotKinds = map[string]bool{"file": true, "locked": true, "last": true, "compare": true, "state": true}
+
+// RestoreSnapshot writes the files in snapshot that are inside paths back -
+// it won't restore anything without them. Every file is checked against its
+// checksum before anything is written, and a file outside --allowed-dir or
+// --allowed-paths is skipped. The setuid and setgid bits aren't restored, and
+// the state files are only restored on the host that took the snapshot.
+func RestoreSnapshot(snapshot Snapshot, contents map[string][]byte, paths []string) ([]RestoreResult, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("need the files to restore in --path or --manifest")
+	}
+	for _, file := range snapshot.Files {
+		if !snapshotKinds[file.Kind] {
+			return nil, fmt.Errorf("'%s' has kind '%s' in the snapshot", file.Path, file.Kind)
+		}
+		if !filepath.IsAbs(file.Path) || filepath.Clean(file.Path) != file.Path {
+			return nil, fmt.Errorf("'%s' in the snapshot isn't a clean absolute path", file.Path)
+		}
+		data, ok := contents[snapshotName(file)]
+		if !ok {
+			return nil, fmt.Errorf("the snapshot doesn't have '%s'", file.Path)
+		}
+		if ComputeChecksum(string(data)) != file.Checksum {
+			return nil, fmt.Errorf("'%s' in the snapshot doesn't match its checksum", file.Path)
+		}
+	}
+	sameHost := snapshot.Host == GetHostname()
+	results := []RestoreResult{}
+	for _, file := range snapshot.Files {
+		dest := file.Path
+		if file.Kind == "state" {
+			dest = filepath.Join(StateDir(), filepath.Base(file.Path))
+			if !sameHost || !strings.HasPrefix(filepath.Base(file.Path), "kvexpress-") {
+				results = append(results, RestoreResult{Path: dest, Kind: file.Kind, Status: "skipped", Reason: fmt.Sprintf("the state is from %s", snapshot.Host)})
+				continue
+			}
+		} else if !restorePath(dest, paths) {
+			continue
+		}
+		result := RestoreResult{Path: dest, Kind: file.Kind}
+		if err := CheckAllowedDir(dest); err != nil {
+			result.Status, result.Reason = "skipped", err.Error()
+			results = append(results, result)
+			continue
+		}
+		if matches, err := FileChecksumMatches(dest, file.Checksum); err == nil && matches {
+			result.Status = "unchanged"
+			results = append(results, result)
+			continue
+		}
+		if DryRunSkip(fmt.Sprintf("restore '%s' checksum='%s'", dest, file.Checksum)) {
+			result.Status = "dry_run"
+			results = append(results, result)
+			continue
+		}
+		perms, err := strconv.ParseInt(file.Mode, 8, 32)
+		if err != nil {
+			return results, fmt.Errorf("'%s' has mode '%s' in the snapshot", file.Path, file.Mode)
+		}
+		perms &^= 06000
+		owner := Owner
+		if file.UID >= 0 && file.GID >= 0 {
+			owner = fmt.Sprintf("%d:%d", file.UID, file.GID)
+		}
+		if err := WriteFile(string(contents[snapshotName(file)]), dest, int(perms), owner); err != nil {
+			return results, err
+		}
+		if modified, err := time.Parse(time.RFC3339Nano, file.Modified); err == nil {
+			os.Chtimes(dest, modified, modified)
+		}
+		result.Status = "restored"
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// restorePath is true when file is inside paths or is the .locked, .last or
+// .compare file of one of them.
+func restorePath(file string, paths []string) bool {
+	if longestDirMatch(file, paths) >= 0 {
+		return true
+	}
+	for _, path := range paths {
+		if path, err := filepath.Abs(path); err == nil && (file == LockFilePath(path) || file == LastFilename(path) || file == CompareFilename(path)) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkRestoreFlags() {
+	Log("Checking cli flags.", "debug")
+	if SnapshotArchive == "" {
+		fmt.Println("Need a snapshot to restore with -f")
+		os.Exit(1)
+	}
+	if len(SnapshotPaths) == 0 && SnapshotManifest == "" {
+		fmt.Println("Need the files to restore with --path or --manifest")
+		os.Exit(1)
+	}
+	if VerifyKey == "" {
+		fmt.Println("Need the --verify-key the snapshot was signed with")
+		os.Exit(1)
+	}
+	key, err := LoadVerifyKey(VerifyKey)
+	if err != nil {
+		fmt.Printf("Could not load --verify-key: %v\n", err)
+		os.Exit(1)
+	}
+	verifyPublicKey = key
+	Log("Required cli flags present.", "debug")
+}
+
+func init() {
+	RootCmd.AddCommand(restoreCmd)
+	restoreCmd.Flags().StringVarP(&SnapshotArchive, "file", "f", "", "snapshot tarball to restore")
+	restoreCmd.Flags().StringVarP(&SnapshotManifest, "manifest", "m", "", "apply manifest - only restore the files in it")
+	restoreCmd.Flags().StringSliceVarP(&SnapshotPaths, "path", "", []string{}, "only restore the files inside this file or directory (repeatable)")
+	restoreCmd.Flags().StringVarP(&VerifyKey, "verify-key", "", "", "ed25519 public key the snapshot has to be signed with")
+}
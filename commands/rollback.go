@@ -0,0 +1,157 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/spf13/cobra"
+	"os"
+	"time"
+)
+
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "Restore a saved version of a key.",
+	Long:  `Rollback puts a version that in saved back into the key - every node picks it up on the next out.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		checkRollbackFlags()
+		AutoEnable()
+	},
+	Run: rollbackRun,
+}
+
+func rollbackRun(cmd *cobra.Command, args []string) {
+	start := time.Now()
+	c, err := Connect(ConsulServer, Token)
+	if err != nil {
+		LogFatal("Could not connect to Consul.", KeyRollbackLocation, "consul_connect")
+	}
+	if DryRunSkip(fmt.Sprintf("rollback '%s' to '%s'", KeyRollbackLocation, RollbackVersion)) {
+		RunTime(start, KeyRollbackLocation, "dry_run")
+		return
+	}
+	saved, err := Rollback(c, KeyRollbackLocation, RollbackVersion)
+	ExitOnError(err, KeyRollbackLocation, "rollback")
+	if !saved {
+		Log(fmt.Sprintf("rollback key='%s' version='%s' checksum='match' saved='false'", KeyRollbackLocation, RollbackVersion), "info")
+		RunTime(start, KeyRollbackLocation, "consul_checksums_match")
+		return
+	}
+	fmt.Printf("Rolled '%s' back to '%s'.\n", KeyRollbackLocation, RollbackVersion)
+	RunTime(start, KeyRollbackLocation, "complete")
+}
+
+// Rollback restores a saved version of key. The data is decoded, checked
+// against the checksum saved with it and encoded again with this run's flags.
+// It returns false if the key already has that version's data.
+func Rollback(c *consul.Client, key, version string) (bool, error) {
+	saved, err := GetHistory(c, key, version)
+	if err != nil {
+		return false, err
+	}
+	hkey := historyKey(key, version)
+	data, err := GetData(c, hkey)
+	if err != nil {
+		return false, err
+	}
+	data, encoding, err := DecodeKeyData(c, hkey, data)
+	if err != nil {
+		return false, err
+	}
+	// Binary data stays binary when it's saved again.
+	Binary = Binary || BinaryEncoding(encoding)
+	if !ChecksumCompare(data, saved.Checksum) {
+		return false, fmt.Errorf("version '%s' of '%s' doesn't match its checksum", version, key)
+	}
+	var rolling string
+	if Rolling {
+		rolling = RollingHash(data)
+	}
+	stored, err := EncodeData(key, data)
+	if err != nil {
+		return false, err
+	}
+	// The old signature is still valid for the old data - and a stale one
+	// would stop a --verify-key consumer. It's saved with the data so a
+	// reader never sees one without the other.
+	parts := map[string]string{"signature": saved.Signature, "rolling": rolling}
+	if singleTxn(len(stored)) {
+		var extra []*consul.TxnOp
+		for _, part := range []string{"signature", "rolling"} {
+			op := &consul.TxnOp{KV: &consul.KVTxnOp{Verb: consul.KVDelete, Key: KeyPath(key, part)}}
+			if parts[part] != "" {
+				op = setOp(KeyPath(key, part), parts[part])
+			}
+			extra = append(extra, op)
+		}
+		extra = append(extra, metaOp(key, "rollback:"+version))
+		ok, err := SaveCAS(c, key, stored, saved.Checksum, "", extra...)
+		if err != nil || !ok {
+			return false, err
+		}
+	} else {
+		if err := SetData(c, key, stored); err != nil {
+			return false, err
+		}
+		if err := Set(c, KeyPath(key, "checksum"), saved.Checksum); err != nil {
+			return false, err
+		}
+		if err := SetChecksums(c, key, ""); err != nil {
+			return false, err
+		}
+		if err := Set(c, KeyPath(key, "updated"), ReturnCurrentUTC()); err != nil {
+			return false, err
+		}
+		if err := SetEncoding(c, key); err != nil {
+			return false, err
+		}
+		for _, part := range []string{"signature", "rolling"} {
+			if parts[part] != "" {
+				err = Set(c, KeyPath(key, part), parts[part])
+			} else {
+				err = Del(c, KeyPath(key, part))
+			}
+			if err != nil {
+				return true, err
+			}
+		}
+		saveMeta(c, key, "rollback:"+version)
+	}
+	Log(fmt.Sprintf("rollback key='%s' version='%s' checksum='%s' saved='true'", key, version, saved.Checksum), "info")
+	if HistoryKeep > 0 {
+		diff := fmt.Sprintf("rollback to %s", version)
+		if err := SaveHistory(c, key, stored, saved.Checksum, saved.Signature, diff, HistoryKeep); err != nil {
+			Log(fmt.Sprintf("history key='%s' saved='false' message='%v'", key, err), "info")
+		}
+	}
+	return true, nil
+}
+
+func checkRollbackFlags() {
+	Log("Checking cli flags.", "debug")
+	if KeyRollbackLocation == "" {
+		fmt.Println("Need a key location in -k")
+		os.Exit(1)
+	}
+	if RollbackVersion == "" {
+		fmt.Println("Need a version to roll back to in --to - see kvexpress history.")
+		os.Exit(1)
+	}
+	Log("Required cli flags present.", "debug")
+}
+
+var (
+	// KeyRollbackLocation is the key to roll back.
+	KeyRollbackLocation string
+
+	// RollbackVersion is the version to restore - from kvexpress history.
+	RollbackVersion string
+)
+
+func init() {
+	RootCmd.AddCommand(rollbackCmd)
+	rollbackCmd.Flags().StringVarP(&KeyRollbackLocation, "key", "k", "", "key to roll back")
+	rollbackCmd.Flags().StringVarP(&RollbackVersion, "to", "", "", "version to restore")
+	rollbackCmd.Flags().IntVarP(&HistoryKeep, "history", "", 10, "versions of the key to keep - 0 keeps none")
+}
@@ -0,0 +1,175 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// rollingBlockSize is the size of each block hashed by RollingHash.
+	rollingBlockSize = 4096
+)
+
+// RollingHash computes a weak rsync-style adler32 hash for each block of data.
+// The format is `blocksize:length:hash,hash,...` so that `out` can check if
+// a local file is an unchanged prefix of the data without a full checksum.
+func RollingHash(data string) string {
+	var hashes []string
+	for start := 0; start < len(data); start += rollingBlockSize {
+		end := start + rollingBlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		hashes = append(hashes, fmt.Sprintf("%08x", adler32.Checksum([]byte(data[start:end]))))
+	}
+	rolling := fmt.Sprintf("%d:%d:%s", rollingBlockSize, len(data), strings.Join(hashes, ","))
+	Log(fmt.Sprintf("rolling='true' blocks='%d' length='%d'", len(hashes), len(data)), "debug")
+	return rolling
+}
+
+// ParseRollingHash splits a value created by RollingHash into its parts.
+func ParseRollingHash(rolling string) (int, int, []uint32, error) {
+	parts := strings.SplitN(strings.TrimSpace(rolling), ":", 3)
+	if len(parts) != 3 {
+		return 0, 0, nil, errors.New("rolling hash is malformed")
+	}
+	blockSize, err := strconv.Atoi(parts[0])
+	if err != nil || blockSize < 1 {
+		return 0, 0, nil, errors.New("rolling hash has a bad block size")
+	}
+	length, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, nil, errors.New("rolling hash has a bad length")
+	}
+	var hashes []uint32
+	if parts[2] != "" {
+		for _, hash := range strings.Split(parts[2], ",") {
+			value, err := strconv.ParseUint(hash, 16, 32)
+			if err != nil {
+				return 0, 0, nil, errors.New("rolling hash has a bad block hash")
+			}
+			hashes = append(hashes, uint32(value))
+		}
+	}
+	return blockSize, length, hashes, nil
+}
+
+// AppendOnlyChange returns true if the local data is a strict prefix of data
+// according to the stored rolling hash. The weak block hashes only rule an
+// append out - adler32 is easy to collide - so a match is confirmed by
+// comparing local with the start of data. Both are already in memory.
+func AppendOnlyChange(local, data, rolling string) bool {
+	blockSize, length, hashes, err := ParseRollingHash(rolling)
+	if err != nil {
+		Log(fmt.Sprintf("rolling='error' message='%v'", err), "info")
+		return false
+	}
+	// The rolling hash needs to describe this data - and the local file
+	// has to be shorter than it for this to be an append.
+	if length != len(data) || len(local) == 0 || len(local) >= len(data) {
+		return false
+	}
+	for start := 0; start < len(local); start += blockSize {
+		end := start + blockSize
+		if end > len(local) {
+			end = len(local)
+		}
+		if !blockMatches([]byte(local[start:end]), start, data, blockSize, hashes) {
+			return false
+		}
+	}
+	return local == data[:len(local)]
+}
+
+// blockMatches is true if block - at start in the local file - has the
+// rolling hash of the same block of data. A partial last block is compared
+// with the same range of data.
+func blockMatches(block []byte, start int, data string, blockSize int, hashes []uint32) bool {
+	if len(block) < blockSize {
+		return adler32.Checksum(block) == adler32.Checksum([]byte(data[start:start+len(block)]))
+	}
+	index := start / blockSize
+	return index < len(hashes) && adler32.Checksum(block) == hashes[index]
+}
+
+// checkAppend runs --check-exec on what file will be once data is appended -
+// a temp copy of it, since the append can't be taken back the way a rename
+// can be skipped.
+func checkAppend(data, file string) error {
+	if CheckExec == "" || DryRun {
+		return nil
+	}
+	staged, err := stageFile(data, file, FilePermissions, Owner, CheckExec)
+	if err != nil {
+		return err
+	}
+	staged.discard()
+	return nil
+}
+
+// AppendFile adds the part of data that isn't already in the file to the end
+// of it - only those bytes are written and they're synced before it returns.
+// The file has to still be localLength bytes that match rolling, the rolling
+// hash of data. Unlike a rename a reader can see an append that's half done.
+func AppendFile(data string, filepath string, localLength int, rolling string, perms int, owner string) error {
+	info, err := os.Lstat(filepath)
+	if err == nil {
+		err = checkRegularFile(filepath, info)
+	}
+	if err != nil {
+		Log(fmt.Sprintf("function='AppendFile' panic='true' file='%s'", filepath), "info")
+		return err
+	}
+	blockSize, length, hashes, err := ParseRollingHash(rolling)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filepath, os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		return filesystemError(fmt.Errorf("could not open file '%s': %w", filepath, err))
+	}
+	defer file.Close()
+	// The open file is checked - a path that was swapped after the Lstat isn't
+	// appended to.
+	opened, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	changed := fmt.Errorf("'%s' changed since it was checked - it wasn't appended to", filepath)
+	if length != len(data) || localLength >= len(data) || !os.SameFile(info, opened) || opened.Size() != int64(localLength) {
+		return changed
+	}
+	block := make([]byte, blockSize)
+	for start := 0; start < localLength; start += blockSize {
+		size := blockSize
+		if localLength-start < size {
+			size = localLength - start
+		}
+		if _, err := io.ReadFull(file, block[:size]); err != nil || !blockMatches(block[:size], start, data, blockSize, hashes) {
+			return changed
+		}
+	}
+	appended, err := file.WriteString(data[localLength:])
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		Log(fmt.Sprintf("function='AppendFile' panic='true' file='%s'", filepath), "info")
+		return filesystemError(fmt.Errorf("could not append to file '%s': %w", filepath, err))
+	}
+	if _, _, err := ChownFile(filepath, owner); err != nil {
+		return err
+	}
+	if err := file.Chmod(osFileMode(perms)); err != nil {
+		return fmt.Errorf("could not chmod '%s': %v", filepath, err)
+	}
+	Log(fmt.Sprintf("file_appended='true' location='%s' bytes='%d'", filepath, appended), "info")
+	return nil
+}
@@ -0,0 +1,169 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"errors"
+	"hash/adler32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var rollingBase = strings.Repeat("192.168.0.1\n", 1000)
+
+func TestAppendOnlyChange(t *testing.T) {
+	data := rollingBase + "10.0.0.1\n10.0.0.2\n"
+	rolling := RollingHash(data)
+	if !AppendOnlyChange(rollingBase, data, rolling) {
+		t.Error("The data was only appended to - it should have been detected.")
+	}
+}
+
+func TestAppendOnlyChangeModified(t *testing.T) {
+	data := rollingBase + "10.0.0.1\n"
+	rolling := RollingHash(data)
+	modified := strings.Replace(rollingBase, "192.168.0.1", "192.168.0.2", 1)
+	if AppendOnlyChange(modified, data, rolling) {
+		t.Error("The start of the file was changed - it's not an append.")
+	}
+	truncated := rollingBase[:len(rollingBase)-5] + "XXXXX"
+	if AppendOnlyChange(truncated, data, rolling) {
+		t.Error("The end of the local file was changed - it's not an append.")
+	}
+	if AppendOnlyChange(data, data, rolling) {
+		t.Error("Identical data is not an append.")
+	}
+	// +1, -2, +1 on three bytes in a row leaves the adler32 the same.
+	collided := "273" + rollingBase[3:]
+	if adler32.Checksum([]byte(collided[:rollingBlockSize])) != adler32.Checksum([]byte(rollingBase[:rollingBlockSize])) {
+		t.Fatal("The changed block should collide.")
+	}
+	if AppendOnlyChange(collided, data, rolling) {
+		t.Error("A block with the same adler32 but different data is not an append.")
+	}
+	if AppendOnlyChange(rollingBase, data, RollingHash(rollingBase)) {
+		t.Error("A rolling hash for different data should never match.")
+	}
+}
+
+func TestAppendFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvexpress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "appended")
+	ioutil.WriteFile(file, []byte(rollingBase), 0640)
+	before, _ := os.Stat(file)
+	written := bytesWritten(t)
+	data := rollingBase + "10.0.0.1\n"
+	err = AppendFile(data, file, len(rollingBase), RollingHash(data), 0640, GetCurrentUsername())
+	if err != nil || ReadFile(file) != data {
+		t.Errorf("The file wasn't appended to correctly: %v", err)
+	}
+	// It's the same file with only the new line written to it.
+	if after, _ := os.Stat(file); !os.SameFile(before, after) {
+		t.Error("The file should be appended to - not replaced.")
+	}
+	if written >= 0 {
+		if n := bytesWritten(t) - written; n >= int64(len(rollingBase)) {
+			t.Errorf("Only the appended bytes should be written - not the whole file: %d", n)
+		}
+	}
+	if _, err := os.Stat(TmpFilename(file)); !os.IsNotExist(err) {
+		t.Error("An append shouldn't leave a temp file.")
+	}
+	// The file changed after it was checked.
+	changed := strings.Replace(rollingBase, "192", "10.", 1)
+	ioutil.WriteFile(file, []byte(changed), 0640)
+	if err := AppendFile(data, file, len(rollingBase), RollingHash(data), 0640, GetCurrentUsername()); err == nil || ReadFile(file) != changed {
+		t.Error("A file that isn't the start of the data shouldn't be appended to.")
+	}
+	ioutil.WriteFile(file, []byte(rollingBase+"10."), 0640)
+	if err := AppendFile(data, file, len(rollingBase), RollingHash(data), 0640, GetCurrentUsername()); err == nil {
+		t.Error("A file that grew since it was checked shouldn't be appended to.")
+	}
+}
+
+// bytesWritten is how many bytes this process has written - -1 where there's
+// no /proc/self/io.
+func bytesWritten(t *testing.T) int64 {
+	stats, err := ioutil.ReadFile("/proc/self/io")
+	if err != nil {
+		return -1
+	}
+	for _, line := range strings.Split(string(stats), "\n") {
+		if strings.HasPrefix(line, "wchar: ") {
+			n, err := strconv.ParseInt(strings.TrimPrefix(line, "wchar: "), 10, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return n
+		}
+	}
+	return -1
+}
+
+func TestWriteTargetsAppendCheck(t *testing.T) {
+	dir := t.TempDir()
+	FilePermissions = 0640
+	Owner = GetCurrentUsername()
+	file := filepath.Join(dir, "appended")
+	ioutil.WriteFile(file, []byte(rollingBase), 0640)
+	before, _ := os.Stat(file)
+	data := rollingBase + "10.0.0.1\n"
+	// The check sees the whole file the append would leave.
+	CheckExec = "grep -q ^10.0.0.2 %f"
+	defer func() { CheckExec = "" }()
+	if written, err := WriteTargets([]OutTarget{{File: file, Output: data}}, ComputeChecksum(data), RollingHash(data)); !errors.Is(err, ErrCheckFailed) || written != 0 {
+		t.Errorf("An append that fails --check-exec shouldn't be written: %d %v", written, err)
+	}
+	if ReadFile(file) != rollingBase {
+		t.Error("The file shouldn't be appended to when the check fails.")
+	}
+	if _, err := os.Stat(TmpFilename(file)); !os.IsNotExist(err) {
+		t.Error("The checked copy should be removed.")
+	}
+	CheckExec = "grep -q ^10.0.0.1 %f"
+	if written, err := WriteTargets([]OutTarget{{File: file, Output: data}}, ComputeChecksum(data), RollingHash(data)); err != nil || written != 1 || ReadFile(file) != data {
+		t.Errorf("An append that passes the check should be written: %d %v", written, err)
+	}
+	if after, _ := os.Stat(file); !os.SameFile(before, after) {
+		t.Error("The file should be appended to - not replaced.")
+	}
+}
+
+func TestAppendFileSpecial(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "appended")
+	ioutil.WriteFile(file, []byte(rollingBase), 0640)
+	link := filepath.Join(dir, "link")
+	os.Symlink(file, link)
+	if err := AppendFile(rollingBase+"10.0.0.1\n", link, len(rollingBase), RollingHash(rollingBase+"10.0.0.1\n"), 0640, ""); err == nil {
+		t.Error("A symlink shouldn't be appended through.")
+	}
+
+	fifo := filepath.Join(dir, "fifo")
+	if err := syscall.Mkfifo(fifo, 0640); err != nil {
+		t.Skip(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := WriteTargets([]OutTarget{{File: fifo, Output: rollingBase}}, exampleDataSHA, RollingHash(rollingBase))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrNotRegular) {
+			t.Errorf("A FIFO should be refused before it's read: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Reading a FIFO for the rolling hash blocked.")
+	}
+}
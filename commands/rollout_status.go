@@ -0,0 +1,208 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/spf13/cobra"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var rolloutStatusCmd = &cobra.Command{
+	Use:   "rollout-status",
+	Short: "Show how many hosts have applied a key's current data.",
+	Long:  `Rollout-status compares the checksum each host announced with out --announce-key in <prefix>/_applied/<key>/ to the key's checksum - it prints how many hosts have the current data and the ones that don't.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		checkRolloutStatusFlags()
+		AutoEnable()
+	},
+	Run: rolloutStatusRun,
+}
+
+// rolloutWait is how long --watch waits for a host to announce.
+const rolloutWait = 5 * time.Minute
+
+func rolloutStatusRun(cmd *cobra.Command, args []string) {
+	start := time.Now()
+	c, err := Connect(ConsulServer, Token)
+	if err != nil {
+		LogFatal("Could not connect to Consul.", KeyRolloutLocation, "consul_connect")
+	}
+	var report RolloutReport
+	var index uint64
+	var last string
+	for {
+		report, err = GetRollout(c, KeyRolloutLocation, RolloutExpectedHosts, RolloutPruneAfter)
+		ExitOnError(err, KeyRolloutLocation, "rollout_status")
+		// --watch prints a line every time a host catches up.
+		if summary := report.Summary(); summary != last {
+			fmt.Println(summary)
+			last = summary
+		}
+		if report.Converged() || !RolloutWatch {
+			break
+		}
+		// A new version of the key makes every host announce again.
+		index, err = Wait(c, hostKeyRoot("applied", KeyRolloutLocation), index, rolloutWait)
+		ExitOnError(err, KeyRolloutLocation, "consul_wait")
+	}
+	if len(report.Lagging) > 0 {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "HOST\tKEY\tCHECKSUM\tAPPLIED")
+		for _, host := range report.Lagging {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", host.Host, host.Key, host.Checksum, host.Applied)
+		}
+		w.Flush()
+	}
+	Log(fmt.Sprintf("rollout-status key='%s' checksum='%s' hosts='%d' applied='%d' lagging='%d' pruned='%d'", KeyRolloutLocation, report.Checksum, report.Hosts, report.Applied, len(report.Lagging), report.Pruned), "info")
+	RecordResult(0, report.Checksum)
+	RecordDetails(report)
+	if !report.Converged() {
+		exitRun(ExitError, start, KeyRolloutLocation, "not_converged", "")
+	}
+	RunTime(start, KeyRolloutLocation, "converged")
+}
+
+// RolloutReport is how far the key's current checksum has got. Expected is
+// --expected-hosts - the hosts that haven't announced anything yet aren't in
+// Lagging. Pruned is the hosts that hadn't announced for --prune-after.
+type RolloutReport struct {
+	Key      string         `json:"key"`
+	Checksum string         `json:"checksum"`
+	Hosts    int            `json:"hosts"`
+	Applied  int            `json:"applied"`
+	Expected int            `json:"expected,omitempty"`
+	Percent  float64        `json:"percent"`
+	Lagging  []Announcement `json:"lagging"`
+	Pruned   int            `json:"pruned,omitempty"`
+}
+
+// Converged is true once every host has the current checksum.
+func (r RolloutReport) Converged() bool {
+	return r.Checksum != "" && r.Hosts > 0 && r.Applied == r.total() && len(r.Lagging) == 0
+}
+
+// total is how many hosts there should be.
+func (r RolloutReport) total() int {
+	if r.Expected > r.Hosts {
+		return r.Expected
+	}
+	return r.Hosts
+}
+
+// Summary is the line rollout-status prints.
+func (r RolloutReport) Summary() string {
+	return fmt.Sprintf("%d/%d hosts (%.1f%%) have '%s' checksum %s", r.Applied, r.total(), r.Percent, r.Key, r.Checksum)
+}
+
+// GetRollout compares every announcement in <prefix>/_applied/<key>/ to the
+// key's checksum. A host with any of the key's checksums - from --hash with
+// more than one algorithm - has the current data. With pruneAfter an
+// announcement that's older than that is a host that's gone - it's removed
+// and not counted.
+func GetRollout(c *consul.Client, key string, expected int, pruneAfter time.Duration) (RolloutReport, error) {
+	report := RolloutReport{Key: key, Expected: expected, Lagging: []Announcement{}}
+	checksum, err := Get(c, KeyPath(key, "checksum"))
+	if err != nil {
+		return report, err
+	}
+	report.Checksum = strings.TrimSpace(checksum)
+	current := map[string]bool{report.Checksum: true}
+	checksums, err := Get(c, KeyPath(key, "checksums"))
+	if err != nil {
+		return report, err
+	}
+	for _, line := range strings.Split(checksums, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			current[line] = true
+		}
+	}
+
+	prefix := hostKeyRoot("applied", key)
+	values, err := List(c, prefix)
+	if err != nil {
+		return report, err
+	}
+	keys := make([]string, 0, len(values))
+	for path := range values {
+		keys = append(keys, path)
+	}
+	sort.Strings(keys)
+	for _, path := range keys {
+		announcement, err := ParseAnnouncement(values[path])
+		if err != nil {
+			Log(fmt.Sprintf("rollout-status path='%s' message='%v' - skipping.", path, err), "info")
+			continue
+		}
+		if announcement.Host == "" {
+			announcement.Host = strings.TrimPrefix(path, prefix)
+		}
+		if applied, err := time.Parse(time.RFC3339, announcement.Applied); err == nil && pruneAfter > 0 && time.Since(applied) > pruneAfter {
+			Log(fmt.Sprintf("rollout-status path='%s' applied='%s' prune_after='%s' - pruning it.", path, announcement.Applied, pruneAfter), "info")
+			report.Pruned++
+			if !DryRunSkip(fmt.Sprintf("remove '%s'", path)) {
+				if err := Del(c, path); err != nil {
+					return report, err
+				}
+			}
+			continue
+		}
+		report.Hosts++
+		if report.Checksum != "" && current[announcement.Checksum] {
+			report.Applied++
+			continue
+		}
+		report.Lagging = append(report.Lagging, announcement)
+	}
+	if total := report.total(); total > 0 {
+		report.Percent = 100 * float64(report.Applied) / float64(total)
+	}
+	return report, nil
+}
+
+func checkRolloutStatusFlags() {
+	Log("Checking cli flags.", "debug")
+	if KeyRolloutLocation == "" {
+		fmt.Println("Need a key in -k")
+		os.Exit(1)
+	}
+	if RolloutExpectedHosts < 0 {
+		fmt.Println("Need an --expected-hosts that's 0 or more")
+		os.Exit(1)
+	}
+	if RolloutPruneAfter != 0 && RolloutPruneAfter <= announceRefresh {
+		fmt.Printf("Need a --prune-after longer than %s - a host that's up to date announces again that often\n", announceRefresh)
+		os.Exit(1)
+	}
+	Log("Required cli flags present.", "debug")
+}
+
+var (
+	// KeyRolloutLocation is the key whose hosts are checked - the one out
+	// was given in --announce-key.
+	KeyRolloutLocation string
+
+	// RolloutExpectedHosts is how many hosts should announce - the hosts that
+	// haven't announced yet count against the rollout.
+	RolloutExpectedHosts int
+
+	// RolloutWatch keeps printing until every host has the data.
+	RolloutWatch bool
+
+	// RolloutPruneAfter removes the announcements of hosts that haven't
+	// announced for this long - 0 keeps them.
+	RolloutPruneAfter time.Duration
+)
+
+func init() {
+	RootCmd.AddCommand(rolloutStatusCmd)
+	rolloutStatusCmd.Flags().StringVarP(&KeyRolloutLocation, "key", "k", "", "key out announces in with --announce-key")
+	rolloutStatusCmd.Flags().IntVarP(&RolloutExpectedHosts, "expected-hosts", "", 0, "how many hosts should have the data - 0 for the ones that announced")
+	rolloutStatusCmd.Flags().BoolVarP(&RolloutWatch, "watch", "w", false, "print a line every time a host catches up until they all have")
+	rolloutStatusCmd.Flags().DurationVarP(&RolloutPruneAfter, "prune-after", "", 0, "remove the hosts that haven't announced for this long - 0 keeps them")
+}
@@ -0,0 +1,60 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetRollout(t *testing.T) {
+	tc, c := newTestConsul(t)
+	PrefixLocation = "testing"
+	tc.put("testing/hosts/checksum", exampleDataSHA)
+	tc.put("testing/hosts/checksums", exampleDataSHA+"\nsha512:abcd\n")
+	tc.put("testing/_applied/hosts/web1", `{"host":"web1","key":"hosts","checksum":"`+exampleDataSHA+`"}`)
+	tc.put("testing/_applied/hosts/web2", `{"host":"web2","key":"hosts","checksum":"sha512:abcd"}`)
+	tc.put("testing/_applied/hosts/web3", `{"host":"web3","key":"hosts","checksum":"old"}`)
+	tc.put("testing/_applied/hosts/web4", `not json`)
+
+	report, err := GetRollout(c, "hosts", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Hosts != 3 || report.Applied != 2 || len(report.Lagging) != 1 || report.Lagging[0].Host != "web3" {
+		t.Errorf("web3 should be the only host that's lagging: %+v", report)
+	}
+	if report.Converged() {
+		t.Error("A rollout with a host that's lagging hasn't converged.")
+	}
+
+	tc.put("testing/_applied/hosts/web3", `{"key":"hosts","checksum":"`+exampleDataSHA+`"}`)
+	if report, _ = GetRollout(c, "hosts", 0, 0); !report.Converged() || report.Percent != 100 {
+		t.Errorf("Every host has the data: %+v", report)
+	}
+	if report, _ = GetRollout(c, "hosts", 4, 0); report.Converged() || report.Percent != 75 {
+		t.Errorf("A host that hasn't announced should count with --expected-hosts: %+v", report)
+	}
+	if report.Summary() != "3/4 hosts (75.0%) have 'hosts' checksum "+exampleDataSHA {
+		t.Errorf("The summary is wrong: '%s'", report.Summary())
+	}
+}
+
+func TestGetRolloutPrune(t *testing.T) {
+	tc, c := newTestConsul(t)
+	PrefixLocation = "testing"
+	tc.put("testing/hosts/checksum", exampleDataSHA)
+	tc.put("testing/_applied/hosts/web1", `{"host":"web1","key":"hosts","checksum":"`+exampleDataSHA+`","applied":"`+ReturnCurrentUTC()+`"}`)
+	tc.put("testing/_applied/hosts/web2", `{"host":"web2","key":"hosts","checksum":"old","applied":"2020-01-01T00:00:00Z"}`)
+
+	report, err := GetRollout(c, "hosts", 0, 48*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Hosts != 1 || report.Pruned != 1 || !report.Converged() {
+		t.Errorf("web2 hasn't announced in years and should be pruned: %+v", report)
+	}
+	if _, ok := tc.value("testing/_applied/hosts/web2"); ok {
+		t.Error("The pruned announcement should be removed.")
+	}
+}
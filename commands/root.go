@@ -1,10 +1,12 @@
-// +build linux darwin freebsd
+// +build linux darwin freebsd windows
 
 package commands
 
 import (
 	"fmt"
 	"github.com/spf13/cobra"
+	"os"
+	"time"
 )
 
 // RootCmd is the default Cobra struct that starts it all off.
@@ -13,6 +15,13 @@ var RootCmd = &cobra.Command{
 	Use:   "kvexpress",
 	Short: "Configuration data -> Consul KV -> Filesytem",
 	Long:  `Small Go program to put and pull configuration data out of Consul and write to filesystem.`,
+	// The ${VAR}s are expanded before any command checks its flags.
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if err := ExpandFlags(cmd.Flags()); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Println("`kvexpress -h` for help information.")
 		fmt.Println("`kvexpress -v` for version information.")
@@ -24,6 +33,12 @@ var (
 	// to control access the KV store: https://www.consul.io/docs/internals/acl.html
 	Token string
 
+	// TokenFile holds the Token - so it isn't in `ps` or the cron logs.
+	TokenFile string
+
+	// VaultConsulRole gets a short-lived Token from Vault's Consul secrets engine.
+	VaultConsulRole string
+
 	// PostExec refers to an optional command to run upon
 	// successful completion of the command's task. An example:
 	// kvexpress out -k hosts -f /etc/hosts -e "sudo pkill -HUP dnsmasq"
@@ -32,14 +47,119 @@ var (
 	// ConsulServer if you are not talking to a Consul node on localhost - this is for you.
 	ConsulServer string
 
+	// Datacenter is the Consul datacenter to talk to - the local one if it's blank.
+	Datacenter string
+
+	// Namespace is the Consul Enterprise namespace for the keys - the token's if it's blank.
+	Namespace string
+
+	// Partition is the Consul Enterprise admin partition for the keys - the token's if it's blank.
+	Partition string
+
+	// ConsulSSL talks to Consul over HTTPS.
+	ConsulSSL bool
+
+	// ConsulSSLVerify checks the certificate presented by Consul when using HTTPS.
+	ConsulSSLVerify bool
+
+	// ConsulCACert is a CA file used to verify the Consul server certificate.
+	ConsulCACert string
+
+	// ConsulCAPath is a directory of CA files used to verify the Consul server certificate.
+	ConsulCAPath string
+
+	// ConsulClientCert is the client certificate for Consul servers with verify_incoming.
+	ConsulClientCert string
+
+	// ConsulClientKey is the key for ConsulClientCert.
+	ConsulClientKey string
+
+	// TLSServerName is the server name used for SNI and certificate verification.
+	TLSServerName string
+
+	// AllowStale lets any Consul server answer reads - not just the leader.
+	AllowStale bool
+
+	// Consistency is the Consul read mode - default, stale or consistent.
+	// SetupConsistency picks one if it's blank.
+	Consistency string
+
+	// Retries is how many times a Consul operation is tried before giving up.
+	Retries int
+
+	// RetryWait is how long to wait after the first failure - it doubles every time.
+	RetryWait time.Duration
+
+	// RetryMaxWait is the longest wait between retries.
+	RetryMaxWait time.Duration
+
+	// MaxStaleness is how far behind the leader a stale read can be. If it's more
+	// stale than this, the read falls back to a consistent read or fails.
+	MaxStaleness time.Duration
+
+	// StaleFallback retries reads that are too stale as consistent reads.
+	// When it's false kvexpress stops instead.
+	StaleFallback bool
+
+	// Backend is the key value store to use - consul, etcd, zookeeper or redis.
+	Backend string
+
+	// EtcdEndpoints are the etcd v3 servers to use with --backend etcd.
+	EtcdEndpoints []string
+
+	// EtcdCACert is a CA file used to verify the etcd server certificate.
+	EtcdCACert string
+
+	// EtcdCert is a client certificate for etcd.
+	EtcdCert string
+
+	// EtcdKey is the key for EtcdCert.
+	EtcdKey string
+
+	// ZookeeperServers are the ZooKeeper servers to use with --backend zookeeper.
+	ZookeeperServers []string
+
+	// ZookeeperAuth is the user:password to log in to ZooKeeper with digest auth.
+	ZookeeperAuth string
+
+	// ZookeeperAuthFile is a file with ZookeeperAuth in it.
+	ZookeeperAuthFile string
+
+	// ZookeeperACL is the ACL the znodes are created with - creator, creator-read
+	// or open.
+	ZookeeperACL string
+
+	// RedisServer is the Redis server to use with --backend redis.
+	RedisServer string
+
+	// RedisPassword logs in to RedisServer - it wins over a password in the URL.
+	RedisPassword string
+
+	// RedisPasswordFile has the RedisPassword in it - so it isn't in `ps`.
+	RedisPasswordFile string
+
+	// RedisChannel is where every write is published for watch.
+	RedisChannel string
+
 	// PrefixLocation all Consul KV data related to kvexpress is stored underneath
 	// this path. Defaults to `kvexpress` which
 	PrefixLocation string
 
+	// KeyTemplate is how a key's path is built from the prefix, the key and the
+	// part - data, checksum, updated and the rest. Blank is the standard layout.
+	KeyTemplate string
+
 	// MinFileLength is the minimum number of lines a file is expected to have.
 	// Keeps blank or truncated files out of the KV store.
 	MinFileLength int
 
+	// MaxFileLength is the most lines a file is expected to have - 0 is off.
+	// Keeps runaway data out of the KV store and off the filesystem.
+	MaxFileLength int
+
+	// MaxFileBytes is the largest a file is expected to be - 0 is off.
+	MaxFileBytes int
+
 	// FilePermissions are the permissions for the files that are written to the filesystem.
 	FilePermissions int
 
@@ -50,6 +170,14 @@ var (
 	// Owner will be the owner of any file that's been written to the filesystem.
 	Owner string
 
+	// Group will be the group of any file that's been written to the filesystem.
+	// The Owner's group is used if it's blank.
+	Group string
+
+	// NoChown writes files as the user running kvexpress - for a user that
+	// can't chown them. --owner and --group aren't used.
+	NoChown bool
+
 	// ConfigFile is the path to a yaml encoded configuration file.
 	// Loaded with LoadConfig.
 	ConfigFile string
@@ -57,37 +185,274 @@ var (
 	// DogStatsdAddress if you're not running a local Datadog agent.
 	DogStatsdAddress string
 
+	// StatsdNamespace is put in front of every dogstatsd metric name.
+	StatsdNamespace string
+
+	// StatsdTags are added to every dogstatsd metric.
+	StatsdTags []string
+
+	// NoStats turns off dogstatsd - even on hosts with a Datadog agent.
+	NoStats bool
+
 	// DatadogAPIKey is for sending events to Datadog through the HTTP api.
 	DatadogAPIKey string
 
 	// DatadogAPPKey is for sending events to Datadog through the HTTP api.
 	DatadogAPPKey string
 
+	// DatadogAPIKeyFile is a file with the Datadog API key so it isn't on the command line.
+	DatadogAPIKeyFile string
+
+	// DatadogAPPKeyFile is a file with the Datadog App key so it isn't on the command line.
+	DatadogAPPKeyFile string
+
+	// DatadogSite is the Datadog site events are sent to - datadoghq.eu for the EU.
+	DatadogSite string
+
+	// DatadogProxy is an HTTP proxy for the Datadog API - --proxy if it's blank.
+	DatadogProxy string
+
 	// Compress is for compressing data on the way in and out of Consul.
 	Compress bool
 
+	// Binary treats the data as bytes instead of lines - it's base64 encoded
+	// in Consul and the line checks are skipped.
+	Binary bool
+
+	// EncryptKey is a base64 encoded AES key file - the data is encrypted with
+	// AES-GCM before it's saved and decrypted after it's read.
+	EncryptKey string
+
+	// EncryptVault is the name of a key in Vault's transit secrets engine that's
+	// used to encrypt and decrypt the data instead of EncryptKey.
+	EncryptVault string
+
+	// VaultAddr is the Vault server for EncryptVault, --vault-consul-role and
+	// --vault-path - VAULT_ADDR if it's blank.
+	VaultAddr string
+
+	// VaultToken is the token for VaultAddr - VAULT_TOKEN if it's blank.
+	VaultToken string
+
+	// ChunkSize is the largest value that's saved in a single key - larger data
+	// is split into chunks. Consul doesn't allow values over 512KB.
+	ChunkSize int
+
+	// Rolling stores a weak rolling hash next to the data so that `out` can
+	// append to a file rather than rewriting it when the data only grew.
+	Rolling bool
+
+	// ExecTimeout is how long PostExec can run before it's killed - 0 for no limit.
+	ExecTimeout time.Duration
+
 	// Direction adds information about which command is running to the logs.
 	Direction string
 
 	// Verbose logs all output to stdout.
 	Verbose bool
+
+	// Quiet doesn't print anything for people - the exit code says what happened.
+	Quiet bool
+
+	// OutputFormat is text for people or json for a single result object.
+	OutputFormat string
+
+	// LogFormat is text for the key='value' lines or json for one JSON object per line.
+	LogFormat string
+
+	// LogLevel is the lowest priority that's logged: debug, info, warn or error.
+	LogLevel string
+
+	// LogFile is where the logs go instead of syslog.
+	LogFile string
+
+	// DryRun does all of the reads and checks but only logs what would be
+	// written, removed or executed.
+	DryRun bool
+
+	// RunID correlates the logs, metrics and events from a single run.
+	// One is generated if it's not passed with --run-id.
+	RunID string
+
+	// AuditLog is a file that every file and key written and every command run
+	// is appended to as a line of JSON.
+	AuditLog string
+
+	// AuditKeyFile is a file with the key the audit log is signed with.
+	AuditKeyFile string
+
+	// MetricsEnable limits the statsd metrics sent to only these names.
+	MetricsEnable []string
+
+	// MetricsDisable stops these statsd metrics from being sent.
+	MetricsDisable []string
+
+	// MetricsTextfile is where the Prometheus metrics are written at the end of
+	// every run - for the node_exporter textfile collector.
+	MetricsTextfile string
+
+	// OTLPEndpoint is the OpenTelemetry collector the in, out and copy spans
+	// are sent to - OTEL_EXPORTER_OTLP_ENDPOINT if blank.
+	OTLPEndpoint string
+
+	// Version is the kvexpress version - main sets it from the build flags.
+	Version = "No version provided."
+
+	// HashAlgorithms are the checksums saved with the data - the first one is
+	// the checksum key. Readers verify with the first one that was saved.
+	HashAlgorithms []string
+
+	// NoFsync skips flushing files and their directories to disk before and
+	// after they're renamed into place - faster, but a crash can leave an
+	// empty file.
+	NoFsync bool
+
+	// SELinuxContext is keep, restore or a context to give every file that's
+	// written - keep copies the context of the file that's replaced and
+	// restore runs restorecon once it's in place.
+	SELinuxContext string
+
+	// TmpDir is where the temporary files are written - it has to be on the
+	// same filesystem as the files. Blank writes them next to each file.
+	TmpDir string
+
+	// KeepXattrs copies the extended attributes and ACLs of the file that's
+	// replaced onto the new one.
+	KeepXattrs bool
+
+	// NoRunLock lets out and in start while the last run for the same key is
+	// still going.
+	NoRunLock bool
+
+	// FollowSymlinks writes the file a symlink points to instead of replacing
+	// the link.
+	FollowSymlinks bool
+
+	// VersionKey is the key with the version every host should run - see
+	// VersionRelease.
+	VersionKey string
+
+	// RequiredVersion is the version kvexpress has to be to run - or consul
+	// for the one in VersionKey.
+	RequiredVersion string
+
+	// RedactPatterns are regular expressions for the secrets that are masked
+	// in the logs, diffs, Datadog events and the audit log.
+	RedactPatterns []string
+
+	// AllowedDirs are the only directories that files can be written to.
+	// If it's empty, anywhere outside of the sensitive system directories is allowed.
+	AllowedDirs []string
+
+	// AllowedPaths are the only files and directories kvexpress manages on
+	// the host. allowed_paths in the config file wins over --allowed-paths.
+	AllowedPaths []string
 )
 
 func init() {
 	// Do some setup.
 	Direction = SetDirection()
+	cobra.OnInitialize(SetRunID)
 	RootCmd.PersistentFlags().StringVarP(&ConfigFile, "config", "C", "", "Config file location")
-	RootCmd.PersistentFlags().StringVarP(&ConsulServer, "server", "s", "localhost:8500", "Consul server location")
+	RootCmd.PersistentFlags().StringVarP(&ConsulServer, "server", "s", "localhost:8500", "Consul server location - a comma separated list or a DNS SRV name to fail over, or unix:///path/to/http.sock")
 	RootCmd.PersistentFlags().StringVarP(&Token, "token", "t", "anonymous", "Token for Consul access")
+	RootCmd.PersistentFlags().StringVarP(&TokenFile, "token-file", "", "", "file with the token for Consul access")
+	RootCmd.PersistentFlags().StringVarP(&VaultConsulRole, "vault-consul-role", "", "", "get a Consul token for this role from Vault")
+	RootCmd.PersistentFlags().StringVarP(&Datacenter, "dc", "", "", "Consul datacenter - the local one if blank")
+	RootCmd.PersistentFlags().StringVarP(&Namespace, "namespace", "", "", "Consul Enterprise namespace - the token's if blank")
+	RootCmd.PersistentFlags().StringVarP(&Partition, "partition", "", "", "Consul Enterprise admin partition - the token's if blank")
+	RootCmd.PersistentFlags().BoolVarP(&ConsulSSL, "ssl", "", false, "use HTTPS to talk to Consul")
+	RootCmd.PersistentFlags().BoolVarP(&ConsulSSLVerify, "ssl-verify", "", true, "verify the Consul certificate")
+	RootCmd.PersistentFlags().StringVarP(&ConsulCACert, "ssl-ca-cert", "", "", "CA file to verify the Consul certificate")
+	RootCmd.PersistentFlags().StringVarP(&ConsulCAPath, "ssl-ca-path", "", "", "directory of CA files to verify the Consul certificate")
+	RootCmd.PersistentFlags().StringVarP(&ConsulClientCert, "ssl-cert", "", "", "client certificate for Consul")
+	RootCmd.PersistentFlags().StringVarP(&ConsulClientKey, "ssl-key", "", "", "client certificate key for Consul")
+	RootCmd.PersistentFlags().StringVarP(&TLSServerName, "tls-server-name", "", "", "server name to use when verifying the Consul certificate")
+	RootCmd.PersistentFlags().BoolVarP(&AllowStale, "stale", "", false, "allow stale reads from any Consul server")
+	RootCmd.PersistentFlags().StringVarP(&Consistency, "consistency", "", "", "Consul reads: default, stale or consistent - consistent for in if blank")
+	RootCmd.PersistentFlags().IntVarP(&Retries, "retries", "", 5, "times to try a Consul operation before giving up")
+	RootCmd.PersistentFlags().DurationVarP(&RetryWait, "retry-wait", "", time.Second, "wait after the first failure - doubled for every retry")
+	RootCmd.PersistentFlags().DurationVarP(&RetryMaxWait, "retry-max-wait", "", 30*time.Second, "longest wait between retries")
+	RootCmd.PersistentFlags().DurationVarP(&MaxStaleness, "max-staleness", "", 0, "most stale a stale read can be - 0 for no limit")
+	RootCmd.PersistentFlags().BoolVarP(&StaleFallback, "stale-fallback", "", true, "use a consistent read when a stale read is too stale")
+	RootCmd.PersistentFlags().StringVarP(&Backend, "backend", "", "consul", "key value store to use: consul, etcd, zookeeper or redis")
+	RootCmd.PersistentFlags().StringSliceVarP(&EtcdEndpoints, "etcd-endpoint", "", []string{"http://localhost:2379"}, "etcd server location (repeatable)")
+	RootCmd.PersistentFlags().StringVarP(&EtcdCACert, "etcd-ca-cert", "", "", "CA file to verify the etcd certificate")
+	RootCmd.PersistentFlags().StringVarP(&EtcdCert, "etcd-cert", "", "", "client certificate for etcd")
+	RootCmd.PersistentFlags().StringVarP(&EtcdKey, "etcd-key", "", "", "client certificate key for etcd")
+	RootCmd.PersistentFlags().StringSliceVarP(&ZookeeperServers, "zk-server", "", []string{"localhost:2181"}, "ZooKeeper server location (repeatable)")
+	RootCmd.PersistentFlags().StringVarP(&ZookeeperAuth, "zk-auth", "", "", "user:password to log in to ZooKeeper with digest auth - or KVEXPRESS_ZK_AUTH")
+	RootCmd.PersistentFlags().StringVarP(&ZookeeperAuthFile, "zk-auth-file", "", "", "file with the --zk-auth user:password in it")
+	RootCmd.PersistentFlags().StringVarP(&ZookeeperACL, "zk-acl", "", "", "ACL for new znodes: creator, creator-read or open - creator with --zk-auth, open without")
+	RootCmd.PersistentFlags().StringVarP(&RedisServer, "redis-server", "", "localhost:6379", "Redis server - host:port or redis://host:port/db, rediss:// for TLS")
+	RootCmd.PersistentFlags().StringVarP(&RedisPassword, "redis-password", "", "", "password for the Redis server - or KVEXPRESS_REDIS_PASSWORD")
+	RootCmd.PersistentFlags().StringVarP(&RedisPasswordFile, "redis-password-file", "", "", "file with the --redis-password in it")
+	RootCmd.PersistentFlags().StringVarP(&RedisChannel, "redis-channel", "", "kvexpress", "Redis channel every write is published on for watch")
 	RootCmd.PersistentFlags().StringVarP(&PrefixLocation, "prefix", "p", "kvexpress", "prefix for the key")
+	RootCmd.PersistentFlags().StringVarP(&KeyTemplate, "key-template", "", DefaultKeyTemplate, "layout of the keys - {{.Prefix}}, {{.Key}} and {{.Part}} like data or checksum")
 	RootCmd.PersistentFlags().StringVarP(&PostExec, "exec", "e", "", "Execute this command after")
+	RootCmd.PersistentFlags().DurationVarP(&ExecTimeout, "exec-timeout", "", 0, "kill the exec command after this long - 0 for no limit")
+	RootCmd.PersistentFlags().StringVarP(&RunAs, "run-as", "", "", "run the exec, hook and source commands and the in --url and --s3 fetches as this user with a clean environment - checks get the clean environment too")
+	RootCmd.PersistentFlags().DurationVarP(&ExecDebounce, "exec-debounce", "", 0, "run the exec command at most once in this long on a host - 0 runs it every time")
+	RootCmd.PersistentFlags().DurationVarP(&Splay, "splay", "", 0, "sleep a random time up to this long before contacting Consul")
+	RootCmd.PersistentFlags().Float64VarP(&ConsulRate, "consul-rate", "", 0, "most requests a second to make to Consul - 0 for no limit")
+	RootCmd.PersistentFlags().DurationVarP(&ConsulTimeout, "consul-timeout", "", 0, "give up on a Consul request after this long - blocking queries get their wait on top - 0 for no limit")
+	RootCmd.PersistentFlags().DurationVarP(&Deadline, "deadline", "", 0, "give up on the whole run after this long - 0 for no limit")
+	RootCmd.PersistentFlags().StringArrayVarP(&ExecOnChange, "exec-on-change", "", []string{}, "run this command after a file or key is written (repeatable)")
+	RootCmd.PersistentFlags().StringArrayVarP(&ExecOnError, "exec-on-error", "", []string{}, "run this command when kvexpress stops with an error (repeatable)")
+	RootCmd.PersistentFlags().StringArrayVarP(&ExecOnLock, "exec-on-lock", "", []string{}, "run this command when a lock stops a file from being written (repeatable)")
 	RootCmd.PersistentFlags().IntVarP(&MinFileLength, "length", "l", 10, "minimum amount of lines in the file")
-	RootCmd.PersistentFlags().IntVarP(&FilePermissions, "chmod", "c", 0640, "permissions for the file")
+	RootCmd.PersistentFlags().IntVarP(&MaxFileLength, "max-length", "", 0, "maximum amount of lines in the file - 0 is off")
+	RootCmd.PersistentFlags().IntVarP(&MaxFileBytes, "max-bytes", "", 0, "maximum size of the file in bytes - 0 is off")
+	RootCmd.PersistentFlags().VarP(newModeValue(0640, &FilePermissions), "chmod", "c", "permissions for the file - octal like 2750 or symbolic like u=rw,g=r")
 	RootCmd.PersistentFlags().BoolVarP(&DogStatsd, "dogstatsd", "d", false, "send metrics to dogstatsd")
 	RootCmd.PersistentFlags().BoolVarP(&Compress, "compress", "z", false, "gzip in and out of the KV store")
+	RootCmd.PersistentFlags().BoolVarP(&Binary, "binary", "", false, "base64 encode the data in the KV store and skip the line checks")
+	RootCmd.PersistentFlags().StringVarP(&EncryptKey, "encrypt-key", "", "", "encrypt the data with this AES key file")
+	RootCmd.PersistentFlags().StringVarP(&EncryptVault, "encrypt-vault", "", "", "encrypt the data with this Vault transit key")
+	RootCmd.PersistentFlags().StringVarP(&VaultAddr, "vault-addr", "", "", "Vault server location - VAULT_ADDR if blank")
+	RootCmd.PersistentFlags().StringVarP(&VaultToken, "vault-token", "", "", "Token for Vault access - VAULT_TOKEN if blank")
+	RootCmd.PersistentFlags().IntVarP(&ChunkSize, "chunk-size", "", 500*1024, "split data larger than this many bytes into chunks")
+	RootCmd.PersistentFlags().BoolVarP(&Rolling, "rolling", "", false, "use a rolling hash to append to files that only grew")
 	RootCmd.PersistentFlags().StringVarP(&DogStatsdAddress, "dogstatsd_address", "D", "localhost:8125", "address for dogstatsd server")
+	RootCmd.PersistentFlags().StringVarP(&StatsdNamespace, "statsd-namespace", "", "kvexpress", "namespace for the dogstatsd metrics")
+	RootCmd.PersistentFlags().StringSliceVarP(&StatsdTags, "statsd-tags", "", []string{}, "add these tags to every dogstatsd metric")
+	RootCmd.PersistentFlags().BoolVarP(&NoStats, "no-stats", "", false, "don't send any dogstatsd metrics")
+	RootCmd.PersistentFlags().StringSliceVarP(&MetricsEnable, "metrics-enable", "", []string{}, "only send these statsd metrics")
+	RootCmd.PersistentFlags().StringSliceVarP(&MetricsDisable, "metrics-disable", "", []string{}, "do not send these statsd metrics")
+	RootCmd.PersistentFlags().StringVarP(&MetricsTextfile, "metrics-textfile", "", "", "write Prometheus metrics to this node_exporter textfile")
+	RootCmd.PersistentFlags().StringVarP(&OTLPEndpoint, "otlp-endpoint", "", "", "send trace spans to this OTLP/HTTP collector - http://localhost:4318")
 	RootCmd.PersistentFlags().StringVarP(&DatadogAPIKey, "datadog_api_key", "a", "", "Datadog API Key")
 	RootCmd.PersistentFlags().StringVarP(&DatadogAPPKey, "datadog_app_key", "A", "", "Datadog App Key")
+	RootCmd.PersistentFlags().StringVarP(&DatadogAPIKeyFile, "datadog-api-key-file", "", "", "read the Datadog API Key from this file")
+	RootCmd.PersistentFlags().StringVarP(&DatadogAPPKeyFile, "datadog-app-key-file", "", "", "read the Datadog App Key from this file")
+	RootCmd.PersistentFlags().StringVarP(&DatadogSite, "datadog-site", "", "", "Datadog site for events - datadoghq.eu for the EU")
+	RootCmd.PersistentFlags().StringVarP(&DatadogProxy, "datadog-proxy", "", "", "HTTP proxy for the Datadog API - --proxy if blank")
+	RootCmd.PersistentFlags().StringVarP(&Proxy, "proxy", "", "", "HTTP proxy for Consul, --url and Datadog - HTTP_PROXY and HTTPS_PROXY if blank")
+	RootCmd.PersistentFlags().StringVarP(&ConsulProxy, "consul-proxy", "", "", "HTTP proxy for Consul - --proxy if blank or direct for none")
 	RootCmd.PersistentFlags().StringVarP(&Owner, "owner", "o", "", "who to write the file as")
+	RootCmd.PersistentFlags().StringVarP(&Group, "group", "", "", "group to write the file as - the owner's group if blank")
+	RootCmd.PersistentFlags().BoolVarP(&NoChown, "no-chown", "", false, "don't chown the files - they're owned by the user running kvexpress")
 	RootCmd.PersistentFlags().BoolVarP(&Verbose, "verbose", "", false, "log output to stdout")
+	RootCmd.PersistentFlags().BoolVarP(&Quiet, "quiet", "q", false, "don't print anything - only the exit code says what happened")
+	RootCmd.PersistentFlags().StringVarP(&OutputFormat, "output", "", "text", "what to print: text or json for a result object")
+	RootCmd.PersistentFlags().StringVarP(&LogFormat, "log-format", "", "text", "format for the logs: text or json")
+	RootCmd.PersistentFlags().StringVarP(&LogLevel, "log-level", "", "info", "lowest level to log: debug, info, warn or error")
+	RootCmd.PersistentFlags().StringVarP(&LogFile, "log-file", "", "", "append the logs to this file instead of syslog")
+	RootCmd.PersistentFlags().BoolVarP(&DryRun, "dry-run", "", false, "log what would be written, removed or run without doing it")
+	RootCmd.PersistentFlags().StringVarP(&RunID, "run-id", "", "", "ID to correlate logs, traces and events - generated if blank")
+	RootCmd.PersistentFlags().StringVarP(&AuditLog, "audit-log", "", "", "append every file and key written and every exec to this JSON lines file")
+	RootCmd.PersistentFlags().StringVarP(&AuditKeyFile, "audit-key-file", "", "", "file with the key to sign the audit log with HMAC-SHA256 - or KVEXPRESS_AUDIT_KEY")
+	RootCmd.PersistentFlags().StringSliceVarP(&HashAlgorithms, "hash", "", []string{"sha256"}, "checksums to save and verify with: sha256, sha512 or blake2b")
+	RootCmd.PersistentFlags().BoolVarP(&NoFsync, "no-fsync", "", false, "don't fsync files before they're renamed into place")
+	RootCmd.PersistentFlags().StringVarP(&SELinuxContext, "selinux-context", "", "", "SELinux context for the files: keep, restore or a context")
+	RootCmd.PersistentFlags().StringVarP(&TmpDir, "tmp-dir", "", "", "directory for temporary files - on the same filesystem as the files")
+	RootCmd.PersistentFlags().BoolVarP(&KeepXattrs, "keep-xattrs", "", false, "copy the extended attributes and ACLs of the file that's replaced")
+	RootCmd.PersistentFlags().BoolVarP(&NoRunLock, "no-run-lock", "", false, "start even if the last out or in for the same key is still running")
+	RootCmd.PersistentFlags().BoolVarP(&FollowSymlinks, "follow-symlinks", "", false, "write the file a symlink points to instead of replacing the link")
+	RootCmd.PersistentFlags().StringVarP(&VersionKey, "version-key", "", "", "key with the version every host should run - prefix/kvexpress-version if blank")
+	RootCmd.PersistentFlags().StringVarP(&RequiredVersion, "required-version", "", "", "only run as this version of kvexpress - consul for the one in --version-key")
+	RootCmd.PersistentFlags().StringArrayVarP(&RedactPatterns, "redact", "", []string{}, "regular expression for secrets to mask in logs, diffs, events and the audit log - only its groups if it has any (repeatable)")
+	RootCmd.PersistentFlags().StringSliceVarP(&AllowedDirs, "allowed-dir", "", []string{}, "only write files inside this directory (repeatable)")
+	RootCmd.PersistentFlags().StringSliceVarP(&AllowedPaths, "allowed-paths", "", []string{}, "only manage these files and directories - allowed_paths in the config file wins")
 }
@@ -0,0 +1,118 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+)
+
+// RunAs is the user --exec, the hooks and --source-exec run as when kvexpress
+// runs as root. They get a clean environment so the Consul and Vault tokens
+// in kvexpress's own aren't handed to them - and so do the --validate-exec
+// and --check commands, which still run as kvexpress. in --url and --s3 are
+// fetched by fetch-as as the user too. The Consul and Vault requests need
+// the tokens so they're made by kvexpress itself.
+var RunAs string
+
+// runAsIDs are the IDs the commands run with.
+type runAsIDs struct {
+	uid, gid uint32
+	groups   []uint32
+	env      []string
+	// checkEnv is the clean environment for the commands that run as
+	// kvexpress - its own HOME and USER.
+	checkEnv []string
+}
+
+// runAsUser is set by SetupRunAs - it's nil without --run-as.
+var runAsUser *runAsIDs
+
+// runAsKeep are the only variables kvexpress passes on from its own
+// environment.
+var runAsKeep = []string{"PATH", "LANG", "LC_ALL", "TZ"}
+
+// SetupRunAs looks up the --run-as user. Only root can run commands as
+// another user - running as that user already is fine.
+func SetupRunAs() error {
+	runAsUser = nil
+	if RunAs == "" {
+		return nil
+	}
+	if !runAsSupported {
+		return errors.New("--run-as isn't supported on this platform")
+	}
+	usr, err := user.Lookup(RunAs)
+	if _, numeric := strconv.Atoi(RunAs); numeric == nil {
+		usr, err = user.LookupId(RunAs)
+	}
+	if err != nil {
+		return fmt.Errorf("could not find the --run-as user '%s': %v", RunAs, err)
+	}
+	uid, err := strconv.ParseUint(usr.Uid, 10, 32)
+	if err != nil {
+		return fmt.Errorf("--run-as user '%s' has uid '%s'", RunAs, usr.Uid)
+	}
+	gid, err := strconv.ParseUint(usr.Gid, 10, 32)
+	if err != nil {
+		return fmt.Errorf("--run-as user '%s' has gid '%s'", RunAs, usr.Gid)
+	}
+	if os.Geteuid() != 0 && os.Geteuid() != int(uid) {
+		return fmt.Errorf("--run-as %s needs kvexpress to run as root", RunAs)
+	}
+	ids := &runAsIDs{uid: uint32(uid), gid: uint32(gid)}
+	groups, _ := usr.GroupIds()
+	for _, group := range groups {
+		if id, err := strconv.ParseUint(group, 10, 32); err == nil {
+			ids.groups = append(ids.groups, uint32(id))
+		}
+	}
+	ids.env = []string{"HOME=" + usr.HomeDir, "USER=" + usr.Username, "LOGNAME=" + usr.Username}
+	for _, name := range append([]string{"HOME", "USER", "LOGNAME"}, runAsKeep...) {
+		if value, ok := os.LookupEnv(name); ok {
+			ids.checkEnv = append(ids.checkEnv, name+"="+value)
+		}
+	}
+	for _, name := range runAsKeep {
+		if value, ok := os.LookupEnv(name); ok {
+			ids.env = append(ids.env, name+"="+value)
+		}
+	}
+	Log(fmt.Sprintf("run_as='%s' uid='%d' gid='%d'", RunAs, ids.uid, ids.gid), "debug")
+	runAsUser = ids
+	return nil
+}
+
+// runAsCommand sets up cmd to run as --run-as with env added to its clean
+// environment. Without --run-as env is added to kvexpress's environment.
+func runAsCommand(cmd *exec.Cmd, env ...string) {
+	if runAsUser == nil {
+		if len(env) > 0 {
+			cmd.Env = append(os.Environ(), env...)
+		}
+		return
+	}
+	cmd.Env = append(append([]string{}, runAsUser.env...), env...)
+	// Someone who isn't root is already the --run-as user.
+	if os.Geteuid() == 0 {
+		setCredential(cmd, runAsUser)
+	}
+}
+
+// cleanEnvCommand gives cmd the clean environment without switching to the
+// --run-as user - a check has to read the temp file only kvexpress can, but
+// it shouldn't get the tokens either. Without --run-as env is added to
+// kvexpress's environment.
+func cleanEnvCommand(cmd *exec.Cmd, env ...string) {
+	if runAsUser == nil {
+		if len(env) > 0 {
+			cmd.Env = append(os.Environ(), env...)
+		}
+		return
+	}
+	cmd.Env = append(append([]string{}, runAsUser.checkEnv...), env...)
+}
@@ -0,0 +1,93 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runLock is held until kvexpress exits - the lock goes with it, even if it's
+// killed.
+var runLock *os.File
+
+// ErrRunInProgress is returned by AcquireRunLock when the last run for the
+// key still has the lock.
+var ErrRunInProgress = errors.New("the previous run is still in progress")
+
+// errWouldBlock is returned by tryLockFile when another process has the lock.
+var errWouldBlock = errors.New("the file is locked")
+
+// runLockName is everything in a lock file's name that isn't a letter, number,
+// dot or dash.
+var runLockName = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// RunLockPath is the lock file for command and key in --prefix - it's in
+// StateDir.
+func RunLockPath(command, key string) string {
+	name := runLockName.ReplaceAllString(strings.Trim(PrefixLocation+"/"+key, "/"), "-")
+	return filepath.Join(StateDir(), fmt.Sprintf("kvexpress-%s-%s.lock", command, name))
+}
+
+// AcquireRunLock takes the run lock for command and key without waiting for
+// it - it's ErrRunInProgress if another run has it. The lock file has the pid
+// of the run that has it.
+func AcquireRunLock(command, key string) error {
+	if NoRunLock {
+		return nil
+	}
+	path := RunLockPath(command, key)
+	f, err := openStateFile(path)
+	if err != nil {
+		return fmt.Errorf("could not open the run lock '%s': %v", path, err)
+	}
+	if err := tryLockFile(f); err != nil {
+		pid := make([]byte, 32)
+		n, _ := f.Read(pid)
+		f.Close()
+		if errors.Is(err, errWouldBlock) {
+			return fmt.Errorf("%w - pid %s has '%s'", ErrRunInProgress, strings.TrimSpace(string(pid[:n])), path)
+		}
+		return fmt.Errorf("could not lock '%s': %v", path, err)
+	}
+	f.Truncate(0)
+	f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	runLock = f
+	Log(fmt.Sprintf("run_lock='%s' acquired='true'", path), "debug")
+	return nil
+}
+
+// ReleaseRunLock lets the next run have the lock before kvexpress exits.
+func ReleaseRunLock() {
+	if runLock == nil {
+		return
+	}
+	unlockFile(runLock)
+	runLock.Close()
+	runLock = nil
+}
+
+// checkRunLock stops with ExitInProgress if the last run for key is still
+// going. A lock that can't be taken for any other reason doesn't stop the run.
+// Dry runs don't write anything so they don't need it.
+func checkRunLock(start time.Time, command, key string) {
+	if DryRun {
+		return
+	}
+	err := AcquireRunLock(command, key)
+	switch {
+	case errors.Is(err, ErrRunInProgress):
+		Log(fmt.Sprintf("run_lock='true' key='%s' message='%v' - stopping.", key, err), "info")
+		fmt.Printf("%v - stopping.\n", err)
+		StatsdRunInProgress(key)
+		exitRun(ExitInProgress, start, key, "run_in_progress", "")
+	case err != nil:
+		Log(fmt.Sprintf("run_lock='false' key='%s' message='%v' - continuing.", key, err), "info")
+	}
+}
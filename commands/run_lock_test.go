@@ -0,0 +1,46 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAcquireRunLock(t *testing.T) {
+	PrefixLocation = "testing"
+	TmpDir = t.TempDir()
+	defer func() { TmpDir = "" }()
+	if path := RunLockPath("out", "apps/web"); !strings.HasSuffix(path, "kvexpress-out-testing-apps-web.lock") {
+		t.Errorf("The lock should be named after the command and key: %s", path)
+	}
+	if err := AcquireRunLock("out", "hosts"); err != nil {
+		t.Fatal(err)
+	}
+	defer ReleaseRunLock()
+	if data, _ := ioutil.ReadFile(RunLockPath("out", "hosts")); strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		t.Errorf("The lock should have the pid: '%s'", data)
+	}
+
+	// The in lock replaces runLock - the out lock is put back after it's released.
+	held := runLock
+	err := AcquireRunLock("out", "hosts")
+	if !errors.Is(err, ErrRunInProgress) || !strings.Contains(err.Error(), strconv.Itoa(os.Getpid())) {
+		t.Errorf("A second run for the key should be ErrRunInProgress: %v", err)
+	}
+	if err := AcquireRunLock("in", "hosts"); err != nil {
+		t.Errorf("in has its own lock: %v", err)
+	}
+	ReleaseRunLock()
+	runLock = held
+
+	NoRunLock = true
+	defer func() { NoRunLock = false }()
+	if err := AcquireRunLock("out", "hosts"); err != nil {
+		t.Errorf("--no-run-lock shouldn't take the lock: %v", err)
+	}
+}
@@ -0,0 +1,239 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptySHA256 is the hash of an empty request body.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// imdsAddress is the EC2 instance metadata service.
+var imdsAddress = "http://169.254.169.254"
+
+// awsCredentials sign the requests to S3.
+type awsCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+}
+
+// ReadS3 downloads an s3://bucket/key object with the credentials from the
+// environment - or the instance's IAM role if there aren't any. With --run-as
+// it's downloaded by fetch-as as that user.
+func ReadS3(location string) (string, error) {
+	if fetchAsUser() {
+		body, _, err := fetchAs(fetchRequest{S3: location})
+		return body, err
+	}
+	bucket, key, err := ParseS3URL(location)
+	if err != nil {
+		return "", err
+	}
+	creds, err := s3Credentials()
+	if err != nil {
+		return "", err
+	}
+	region := s3Region()
+	endpoint := S3Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", region)
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(endpoint, "/"), bucket, s3Escape(key)), nil)
+	if err != nil {
+		return "", err
+	}
+	signV4(req, creds, region, time.Now())
+	client := cancelClient(&http.Client{Timeout: URLTimeout, Transport: &http.Transport{Proxy: proxyFunc(URLProxy)}})
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not get '%s': %v", location, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("could not read '%s': %v", location, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("could not get '%s': %s %s", location, resp.Status, s3Error(body))
+	}
+	Log(fmt.Sprintf("function='ReadS3' bucket='%s' key='%s' size='%d'", bucket, key, len(body)), "debug")
+	return string(body), nil
+}
+
+// ParseS3URL splits s3://bucket/key into the bucket and key.
+func ParseS3URL(location string) (string, string, error) {
+	if !strings.HasPrefix(location, "s3://") {
+		return "", "", fmt.Errorf("'%s' should look like s3://bucket/key", location)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(location, "s3://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("'%s' should look like s3://bucket/key", location)
+	}
+	return parts[0], parts[1], nil
+}
+
+// s3Region is --s3-region, AWS_REGION or AWS_DEFAULT_REGION - us-east-1 if
+// none of them are set.
+func s3Region() string {
+	for _, region := range []string{S3Region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION")} {
+		if region != "" {
+			return region
+		}
+	}
+	return "us-east-1"
+}
+
+// s3Credentials uses AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY - or the
+// instance's IAM role from the metadata service.
+func s3Credentials() (awsCredentials, error) {
+	if os.Getenv("AWS_ACCESS_KEY_ID") != "" && os.Getenv("AWS_SECRET_ACCESS_KEY") != "" {
+		return awsCredentials{
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			Token:           os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+	return instanceCredentials()
+}
+
+// instanceCredentials gets the IAM role's credentials with IMDSv2.
+func instanceCredentials() (awsCredentials, error) {
+	var creds awsCredentials
+	client := cancelClient(&http.Client{Timeout: 2 * time.Second})
+	req, _ := http.NewRequest("PUT", imdsAddress+"/latest/api/token", nil)
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	token, err := imdsGet(client, req)
+	if err != nil {
+		return creds, fmt.Errorf("there are no AWS credentials in the environment or from the instance: %v", err)
+	}
+	path := imdsAddress + "/latest/meta-data/iam/security-credentials/"
+	req, _ = http.NewRequest("GET", path, nil)
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+	role, err := imdsGet(client, req)
+	if err != nil {
+		return creds, fmt.Errorf("the instance doesn't have an IAM role: %v", err)
+	}
+	req, _ = http.NewRequest("GET", path+strings.TrimSpace(strings.SplitN(role, "\n", 2)[0]), nil)
+	req.Header.Set("X-aws-ec2-metadata-token", token)
+	data, err := imdsGet(client, req)
+	if err != nil {
+		return creds, err
+	}
+	if err := json.Unmarshal([]byte(data), &creds); err != nil {
+		return creds, fmt.Errorf("could not parse the instance credentials: %v", err)
+	}
+	if creds.AccessKeyID == "" {
+		return creds, errors.New("the instance credentials are empty")
+	}
+	return creds, nil
+}
+
+// imdsGet makes a request to the metadata service and returns the body.
+func imdsGet(client *http.Client, req *http.Request) (string, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s %s", req.URL.Path, resp.Status)
+	}
+	return string(body), nil
+}
+
+// signV4 adds an AWS Signature Version 4 Authorization header to a request
+// without a body. Every header that's already on the request is signed.
+func signV4(req *http.Request, creds awsCredentials, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptySHA256,
+	}, "\n")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, region)
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(hashed[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	for _, part := range []string{region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// hmacSHA256 is a single step of the SigV4 signing key.
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape escapes everything in an object key but the unreserved characters
+// and the slashes - the way SigV4 wants it.
+func s3Escape(key string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', strings.IndexByte("-_.~/", c) != -1:
+			escaped.WriteByte(c)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
+
+// s3Error pulls the message out of an S3 XML error.
+func s3Error(body []byte) string {
+	text := string(body)
+	start := strings.Index(text, "<Message>")
+	end := strings.Index(text, "</Message>")
+	if start == -1 || end < start {
+		return ""
+	}
+	return text[start+len("<Message>") : end]
+}
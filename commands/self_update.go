@@ -0,0 +1,288 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+var selfUpdateCmd = &cobra.Command{
+	Use:   "self-update",
+	Short: "Replace kvexpress with the version in the version key.",
+	Long:  `Self-update reads the version every host should run from --version-key, downloads it over https and checks its sha256 and its signature from --release-key - then replaces the running binary with it.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		checkSelfUpdateFlags()
+		AutoEnable()
+	},
+	Run: selfUpdateRun,
+}
+
+func selfUpdateRun(cmd *cobra.Command, args []string) {
+	start := time.Now()
+	key := VersionKeyPath()
+	c, err := Connect(ConsulServer, Token)
+	if err != nil {
+		LogFatal("Could not connect to Consul.", key, "consul_connect")
+	}
+	release, err := GetRelease(c)
+	ExitOnError(err, key, "version_key")
+	if release.Version == Version {
+		Log(fmt.Sprintf("self-update version='%s' current='true'", Version), "info")
+		PrintResult(key, "no_change", time.Since(start), release.Version)
+		exitRun(ExitNoChange, start, key, "no_change", "")
+	}
+	artifact, err := release.Artifact(runtime.GOOS, runtime.GOARCH)
+	ExitOnError(err, key, "version_key")
+	if DryRunSkip(fmt.Sprintf("update kvexpress %s to %s from '%s'", Version, release.Version, artifact.URL)) {
+		RunTime(start, key, "dry_run")
+		return
+	}
+	err = SelfUpdate(kvexpressPath(), release.Version, artifact, releaseKey)
+	if errors.Is(err, ErrReleaseSignature) {
+		Log(fmt.Sprintf("self-update version='%s' url='%s' signature='invalid'", release.Version, artifact.URL), "error")
+		fmt.Printf("%v - not updating.\n", err)
+		StatsdSelfUpdate(key, "signature_invalid")
+		exitRun(ExitChecksumMismatch, start, key, "signature_invalid", "")
+	}
+	if errors.Is(err, ErrReleaseChecksum) {
+		Log(fmt.Sprintf("self-update version='%s' url='%s' checksum='mismatch'", release.Version, artifact.URL), "error")
+		fmt.Printf("%v - not updating.\n", err)
+		StatsdSelfUpdate(key, "checksum_mismatch")
+		exitRun(ExitChecksumMismatch, start, key, "checksum_mismatch", "")
+	}
+	ExitOnError(err, key, "self_update")
+	Log(fmt.Sprintf("self-update from='%s' to='%s' updated='true'", Version, release.Version), "info")
+	fmt.Printf("Updated kvexpress %s to %s.\n", Version, release.Version)
+	StatsdSelfUpdate(key, "updated")
+	PrintResult(key, "updated", time.Since(start), release.Version)
+	RunTime(start, key, "complete")
+}
+
+// ErrReleaseChecksum is returned when the binary that was downloaded doesn't
+// match the checksum in the version key.
+var ErrReleaseChecksum = errors.New("the download does not match its checksum")
+
+// ErrReleaseSignature is returned when the release isn't signed by
+// --release-key.
+var ErrReleaseSignature = errors.New("the release isn't signed by --release-key")
+
+// ReleaseKey is the ed25519 public key every release has to be signed with -
+// the version key can be written by anyone with write access to the prefix, so
+// it isn't trusted on its own.
+var ReleaseKey string
+
+// releaseKey is ReleaseKey once it's loaded.
+var releaseKey ed25519.PublicKey
+
+// defaultReleaseKey is where the release key is unless --release-key says
+// otherwise - it should only be writable by root.
+const defaultReleaseKey = "/etc/kvexpress/release.pub"
+
+// VersionRelease is what's in the version key - the version every host
+// should run and where to get it. Artifacts are for each os/arch - like
+// linux/amd64 - and URL and Checksum are for any platform that isn't in them.
+type VersionRelease struct {
+	Version   string                     `json:"version"`
+	URL       string                     `json:"url,omitempty"`
+	Checksum  string                     `json:"checksum,omitempty"`
+	Artifacts map[string]ReleaseArtifact `json:"artifacts,omitempty"`
+}
+
+// ReleaseArtifact is the binary for one platform, its sha256 and the base64
+// ed25519 signature of its ReleaseMessage.
+type ReleaseArtifact struct {
+	URL       string `json:"url"`
+	Checksum  string `json:"checksum"`
+	Signature string `json:"signature"`
+}
+
+// ReleaseMessage is what the release key signs for a binary - the version
+// and the sha256 of the binary, so a signed binary can't be passed off as
+// another version.
+func ReleaseMessage(version, checksum string) string {
+	_, hex, _ := ParseChecksum(checksum)
+	return fmt.Sprintf("kvexpress %s %s\n", version, strings.ToLower(hex))
+}
+
+// Artifact is the binary for goos and goarch.
+func (r VersionRelease) Artifact(goos, goarch string) (ReleaseArtifact, error) {
+	artifact, ok := r.Artifacts[goos+"/"+goarch]
+	if !ok {
+		artifact = ReleaseArtifact{URL: r.URL, Checksum: r.Checksum}
+	}
+	if artifact.URL == "" || artifact.Checksum == "" {
+		return artifact, fmt.Errorf("version %s doesn't have a url and checksum for %s/%s", r.Version, goos, goarch)
+	}
+	if !strings.HasPrefix(artifact.URL, "https://") {
+		return artifact, fmt.Errorf("version %s has to be downloaded over https - not '%s'", r.Version, artifact.URL)
+	}
+	if alg, _, _ := ParseChecksum(artifact.Checksum); alg != "sha256" {
+		return artifact, fmt.Errorf("version %s needs a sha256 checksum - not %s", r.Version, alg)
+	}
+	return artifact, nil
+}
+
+// VersionKeyPath is --version-key - or prefix/kvexpress-version.
+func VersionKeyPath() string {
+	if VersionKey != "" {
+		return strings.TrimPrefix(VersionKey, "/")
+	}
+	return strings.TrimPrefix(PrefixLocation, "/") + "/kvexpress-version"
+}
+
+// GetRelease reads the version key.
+func GetRelease(c *consul.Client) (VersionRelease, error) {
+	var release VersionRelease
+	key := VersionKeyPath()
+	value, err := Get(c, key)
+	if err != nil {
+		return release, err
+	}
+	if value == "" {
+		return release, fmt.Errorf("there's no version in '%s'", key)
+	}
+	if err := json.Unmarshal([]byte(value), &release); err != nil {
+		return release, fmt.Errorf("could not parse '%s': %v", key, err)
+	}
+	if release.Version == "" {
+		return release, fmt.Errorf("'%s' doesn't have a version", key)
+	}
+	return release, nil
+}
+
+// SelfUpdate downloads the artifact and replaces self with it. The new
+// binary has to match the checksum and be signed by key before it's written
+// or run, and it has to say it's that version before the old one is replaced.
+// On Windows the running binary can't be replaced so it's moved out of the way
+// to self.old first.
+func SelfUpdate(self, version string, artifact ReleaseArtifact, key ed25519.PublicKey) error {
+	data, err := readRelease(artifact.URL)
+	if err != nil {
+		return err
+	}
+	if !ChecksumCompare(data, artifact.Checksum) {
+		return fmt.Errorf("%w: '%s' isn't %s", ErrReleaseChecksum, artifact.URL, artifact.Checksum)
+	}
+	if key == nil || VerifyData(key, ReleaseMessage(version, artifact.Checksum), artifact.Signature) != nil {
+		return fmt.Errorf("%w: '%s'", ErrReleaseSignature, artifact.URL)
+	}
+	tmp := self + ".new"
+	if err := ioutil.WriteFile(tmp, []byte(data), 0755); err != nil {
+		return filesystemError(fmt.Errorf("could not write '%s': %w", tmp, err))
+	}
+	if err := checkBinaryVersion(tmp, version); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		old := self + ".old"
+		os.Remove(old)
+		if err := os.Rename(self, old); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := os.Rename(tmp, self); err != nil {
+		os.Remove(tmp)
+		return filesystemError(fmt.Errorf("could not replace '%s': %w", self, err))
+	}
+	return nil
+}
+
+// readRelease downloads a release over https - the --url-header headers are
+// for -u and are never sent to the host the version key names, and a redirect
+// can't go to plain http.
+func readRelease(url string) (string, error) {
+	if !strings.HasPrefix(url, "https://") {
+		return "", fmt.Errorf("'%s' isn't an https url", url)
+	}
+	client, err := urlClient()
+	if err != nil {
+		return "", err
+	}
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if req.URL.Scheme != "https" {
+			return fmt.Errorf("'%s' redirected to '%s' - it isn't https", url, req.URL)
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+	body, _, err := readURLRetries(client, url, URLValidators{}, nil)
+	return body, err
+}
+
+// checkBinaryVersion runs binary --version and makes sure it's version.
+func checkBinaryVersion(binary, version string) error {
+	output, err := exec.CommandContext(RunContext(), binary, "--version").Output()
+	if err != nil {
+		return fmt.Errorf("could not run the new kvexpress: %v", err)
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.SplitN(line, ":", 2)
+		if len(fields) == 2 && strings.TrimSpace(fields[0]) == "Version" && strings.TrimSpace(fields[1]) == version {
+			return nil
+		}
+	}
+	return fmt.Errorf("the new kvexpress isn't version %s", version)
+}
+
+// CheckRequiredVersion stops the run when kvexpress isn't --required-version.
+// With --required-version consul it's the version in --version-key - if that
+// can't be read the run goes ahead rather than stopping every host - and lint,
+// which never talks to Consul, doesn't read it. self-update is never stopped.
+func CheckRequiredVersion() {
+	if RequiredVersion == "" || Direction == "self-update" || (RequiredVersion == "consul" && Direction == "lint") {
+		return
+	}
+	required := RequiredVersion
+	if required == "consul" {
+		c, err := Connect(ConsulServer, Token)
+		if err == nil {
+			var release VersionRelease
+			release, err = GetRelease(c)
+			required = release.Version
+		}
+		if err != nil {
+			Log(fmt.Sprintf("required_version='consul' key='%s' message='%v' - not checking.", VersionKeyPath(), err), "info")
+			return
+		}
+	}
+	if required == Version {
+		return
+	}
+	message := fmt.Sprintf("kvexpress %s is running but %s is required - run kvexpress self-update.", Version, required)
+	Log(fmt.Sprintf("version='%s' required_version='%s' - stopping.", Version, required), "error")
+	fmt.Println(message)
+	StatsdVersionMismatch(VersionKeyPath())
+	exitRun(ExitWrongVersion, processStart, VersionKeyPath(), "version_mismatch", "")
+}
+
+func checkSelfUpdateFlags() {
+	Log("Checking cli flags.", "debug")
+	key, err := LoadVerifyKey(ReleaseKey)
+	if err != nil {
+		fmt.Printf("Could not load the --release-key every release has to be signed with: %v\n", err)
+		os.Exit(1)
+	}
+	releaseKey = key
+	Log("Required cli flags present.", "debug")
+}
+
+func init() {
+	RootCmd.AddCommand(selfUpdateCmd)
+	selfUpdateCmd.Flags().StringVarP(&ReleaseKey, "release-key", "", defaultReleaseKey, "ed25519 public key every release has to be signed with")
+}
@@ -0,0 +1,120 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGetRelease(t *testing.T) {
+	tc, c := newTestConsul(t)
+	PrefixLocation = "testing"
+	if _, err := GetRelease(c); err == nil {
+		t.Error("A missing version key should be an error.")
+	}
+	tc.put("testing/kvexpress-version", `{"version":"2.0.0","url":"https://example.com/kvexpress","checksum":"abcd","artifacts":{"darwin/arm64":{"url":"https://example.com/kvexpress-darwin","checksum":"ef01"}}}`)
+	release, err := GetRelease(c)
+	if err != nil || release.Version != "2.0.0" {
+		t.Fatalf("The version key should be read: %v %v", release, err)
+	}
+	if artifact, _ := release.Artifact("darwin", "arm64"); artifact.URL != "https://example.com/kvexpress-darwin" {
+		t.Errorf("The platform's artifact should be used: %v", artifact)
+	}
+	if artifact, _ := release.Artifact("linux", "amd64"); artifact.URL != "https://example.com/kvexpress" || artifact.Checksum != "abcd" {
+		t.Errorf("Any other platform should use the url and checksum: %v", artifact)
+	}
+	if _, err := (VersionRelease{Version: "2.0.0"}).Artifact("linux", "amd64"); err == nil {
+		t.Error("A version without a url should be an error.")
+	}
+	if _, err := (VersionRelease{Version: "2.0.0", URL: "http://example.com/kvexpress", Checksum: "abcd"}).Artifact("linux", "amd64"); err == nil {
+		t.Error("A release that isn't https should be an error.")
+	}
+	if _, err := (VersionRelease{Version: "2.0.0", URL: "https://example.com/kvexpress", Checksum: "blake2b:abcd"}).Artifact("linux", "amd64"); err == nil {
+		t.Error("A release that isn't sha256 should be an error.")
+	}
+	VersionKey = "/fleet/kvexpress"
+	defer func() { VersionKey = "" }()
+	if key := VersionKeyPath(); key != "fleet/kvexpress" {
+		t.Errorf("--version-key should be used: '%s'", key)
+	}
+}
+
+func TestSelfUpdate(t *testing.T) {
+	binaries := map[string]string{
+		"/2.0.0": "#!/bin/sh\necho 'Version  : 2.0.0'\n",
+		"/wrong": "#!/bin/sh\necho 'Version  : 1.0.0'\n",
+	}
+	var headers []string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.Header.Get("Authorization"))
+		w.Write([]byte(binaries[r.URL.Path]))
+	}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "kvexpress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := filepath.Join(dir, "ca.pem")
+	ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0644)
+	URLCACert, URLHeaders = ca, []string{"Authorization: Bearer upload-secret"}
+	defer func() { URLCACert, URLHeaders = "", nil }()
+	privateFile, publicFile := testSigningKeys(t)
+	private, _ := LoadSigningKey(privateFile)
+	public, _ := LoadVerifyKey(publicFile)
+	signed := func(path, version string) ReleaseArtifact {
+		checksum := ComputeChecksum(binaries[path])
+		return ReleaseArtifact{URL: server.URL + path, Checksum: checksum, Signature: SignData(private, ReleaseMessage(version, checksum))}
+	}
+	self := filepath.Join(dir, "kvexpress")
+	ioutil.WriteFile(self, []byte("old"), 0755)
+
+	artifact := signed("/2.0.0", "2.0.0")
+	artifact.Checksum = ComputeChecksum("something else")
+	if err := SelfUpdate(self, "2.0.0", artifact, public); !errors.Is(err, ErrReleaseChecksum) {
+		t.Errorf("A download that doesn't match its checksum should be an error: %v", err)
+	}
+	if err := SelfUpdate(self, "2.0.0", signed("/2.0.0", "1.9.0"), public); !errors.Is(err, ErrReleaseSignature) {
+		t.Errorf("A signature for another version should be an error: %v", err)
+	}
+	if err := SelfUpdate(self, "2.0.0", signed("/2.0.0", "2.0.0"), nil); !errors.Is(err, ErrReleaseSignature) {
+		t.Errorf("Without a release key nothing is trusted: %v", err)
+	}
+	if err := SelfUpdate(self, "1.0.0", signed("/wrong", "2.0.0"), public); err == nil {
+		t.Error("A binary that isn't the version should be an error.")
+	}
+	if _, err := os.Stat(self + ".new"); !os.IsNotExist(err) {
+		t.Error("A binary that isn't signed shouldn't be written.")
+	}
+	if data, _ := ioutil.ReadFile(self); string(data) != "old" {
+		t.Errorf("kvexpress shouldn't be replaced when the update fails: '%s'", data)
+	}
+	plain := signed("/2.0.0", "2.0.0")
+	plain.URL = strings.Replace(plain.URL, "https://", "http://", 1)
+	if err := SelfUpdate(self, "2.0.0", plain, public); err == nil {
+		t.Error("A release over http should be an error.")
+	}
+
+	if err := SelfUpdate(self, "2.0.0", signed("/2.0.0", "2.0.0"), public); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(self); string(data) != binaries["/2.0.0"] {
+		t.Errorf("kvexpress should be replaced: '%s'", data)
+	}
+	if _, err := os.Stat(self + ".new"); !os.IsNotExist(err) {
+		t.Error("The download should be renamed into place.")
+	}
+	for _, header := range headers {
+		if header != "" {
+			t.Errorf("--url-header shouldn't be sent to the release server: '%s'", header)
+		}
+	}
+}
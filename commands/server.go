@@ -0,0 +1,316 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var serverCmd = &cobra.Command{
+	Use:   "server",
+	Short: "Serve the status of keys and renders over HTTP.",
+	Long:  `Server is for deploy tooling - it answers /v1/status/<key> with the key's checksum, last write and lock, /v1/render/<key> rewrites a file from the manifest right away and /healthz shows whether Consul can be reached.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		checkServerFlags()
+		AutoEnable()
+	},
+	Run: serverRun,
+}
+
+func serverRun(cmd *cobra.Command, args []string) {
+	c, err := Connect(ConsulServer, Token)
+	if err != nil {
+		LogFatal("Could not connect to Consul.", "server", "consul_connect")
+	}
+	var entries []ApplyEntry
+	if ServerManifest != "" {
+		data, err := ioutil.ReadFile(ServerManifest)
+		if err != nil {
+			fmt.Printf("Could not read the manifest: %v\n", err)
+			os.Exit(1)
+		}
+		if entries, err = ParseManifest(data); err != nil {
+			fmt.Printf("Could not parse the manifest: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	globals, secrets := ApplyGlobalArgs(RootCmd.PersistentFlags()), ApplyGlobalEnv(RootCmd.PersistentFlags())
+	handler := ServerHandler(c, entries, func(entry ApplyEntry) int {
+		return runApplyEntry(append([]string{entry.Direction}, append(EntryGlobalArgs(globals, entry), entry.Args()...)...), EntryGlobalEnv(secrets, entry))
+	})
+	server, err := newServer(ServerAuth(handler, serverToken))
+	if err != nil {
+		LogFatal(fmt.Sprintf("Could not set up TLS: %v", err), "server", "server_tls")
+	}
+	listener, err := serverListener(ServerListen)
+	if err != nil {
+		LogFatal(fmt.Sprintf("Could not listen on '%s': %v", ServerListen, err), "server", "server_listen")
+	}
+	Log(fmt.Sprintf("server listen='%s' manifest='%s' entries='%d' token='%t' mtls='%t'", ServerListen, ServerManifest, len(entries), serverToken != "", ServerClientCA != ""), "info")
+	if ServerTLSCert != "" {
+		err = server.ServeTLS(listener, ServerTLSCert, ServerTLSKey)
+	} else {
+		err = server.Serve(listener)
+	}
+	if err != nil {
+		LogFatal(fmt.Sprintf("Could not serve on '%s': %v", ServerListen, err), "server", "server_listen")
+	}
+}
+
+// The server's timeouts - a render runs out, so a response can take a while.
+const (
+	serverReadTimeout  = 30 * time.Second
+	serverWriteTimeout = 5 * time.Minute
+	serverIdleTimeout  = 2 * time.Minute
+)
+
+// newServer is the http.Server for handler - with --tls-client-ca every client
+// has to show a certificate it signed.
+func newServer(handler http.Handler) (*http.Server, error) {
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: serverReadTimeout,
+		ReadTimeout:       serverReadTimeout,
+		WriteTimeout:      serverWriteTimeout,
+		IdleTimeout:       serverIdleTimeout,
+	}
+	if ServerClientCA == "" {
+		return server, nil
+	}
+	pem, err := ioutil.ReadFile(ServerClientCA)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("there are no certificates in '%s'", ServerClientCA)
+	}
+	server.TLSConfig = &tls.Config{ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert, MinVersion: tls.VersionTLS12}
+	return server, nil
+}
+
+// serverListener listens on a TCP address or a unix:///path socket. The
+// socket is only usable by the user kvexpress runs as.
+func serverListener(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, "unix://") {
+		return net.Listen("tcp", address)
+	}
+	path := strings.TrimPrefix(address, "unix://")
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// ServerAuth makes every request but /healthz send token as a bearer token -
+// a blank token lets everything through.
+func ServerAuth(handler http.Handler, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token != "" && r.URL.Path != "/healthz" {
+			sent := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "Need the bearer token from --auth-token-file.\n", http.StatusUnauthorized)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// ServerFile is the file on this host that the manifest writes from a key.
+type ServerFile struct {
+	Path     string `json:"path"`
+	Checksum string `json:"checksum"`
+	Matches  bool   `json:"matches"`
+}
+
+// ServerStatus is what /v1/status/<key> returns - the key's status and, if the
+// key is in the manifest, whether the file on this host matches it.
+type ServerStatus struct {
+	Key  string `json:"key"`
+	Host string `json:"host"`
+	KeyStatus
+	File *ServerFile `json:"file,omitempty"`
+}
+
+// ServerRender is what /v1/render/<key> returns - Code is the out's exit code.
+type ServerRender struct {
+	Key     string `json:"key"`
+	Host    string `json:"host"`
+	File    string `json:"file"`
+	Code    int    `json:"code"`
+	Written bool   `json:"written"`
+}
+
+// ServerHandler serves /healthz, /v1/status/<key> and /v1/render/<key>. Only
+// the out entries in the manifest can be rendered - render runs one of them
+// and returns its exit code. Renders are run one at a time.
+func ServerHandler(c *consul.Client, entries []ApplyEntry, render func(ApplyEntry) int) http.Handler {
+	outs := make(map[string]ApplyEntry)
+	for _, entry := range entries {
+		if entry.Direction == "out" {
+			outs[strings.Trim(entry.Key, "/")] = entry
+		}
+	}
+	var renderLock sync.Mutex
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if _, err := Get(c, strings.TrimPrefix(PrefixLocation, "/")); err != nil {
+			Log(fmt.Sprintf("server healthz='critical' message='%v'", err), "info")
+			http.Error(w, fmt.Sprintf("critical: %v\n", err), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/v1/status/", func(w http.ResponseWriter, r *http.Request) {
+		key := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/status/"), "/")
+		if key == "" {
+			http.Error(w, "Need a key.\n", http.StatusBadRequest)
+			return
+		}
+		status, err := GetStatus(c, key)
+		if err != nil {
+			Log(fmt.Sprintf("server status key='%s' message='%v'", key, err), "info")
+			http.Error(w, fmt.Sprintf("Could not get the status of '%s': %v\n", key, err), http.StatusBadGateway)
+			return
+		}
+		if status.Size == 0 && status.Checksum == "" {
+			http.Error(w, fmt.Sprintf("There's no data in '%s'.\n", key), http.StatusNotFound)
+			return
+		}
+		result := ServerStatus{Key: key, Host: GetHostname(), KeyStatus: status}
+		if entry, ok := outs[key]; ok {
+			result.File = serverFile(entry.File, status.Checksum)
+		}
+		serverJSON(w, http.StatusOK, result)
+	})
+	mux.HandleFunc("/v1/render/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Render needs a POST.\n", http.StatusMethodNotAllowed)
+			return
+		}
+		key := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/render/"), "/")
+		entry, ok := outs[key]
+		if !ok {
+			http.Error(w, fmt.Sprintf("'%s' isn't an out in the manifest.\n", key), http.StatusNotFound)
+			return
+		}
+		start := time.Now()
+		renderLock.Lock()
+		code := render(entry)
+		renderLock.Unlock()
+		Log(fmt.Sprintf("server render key='%s' file='%s' code='%d' time='%s'", key, entry.File, code, time.Since(start)), "info")
+		status := http.StatusOK
+		if !Succeeded(code) {
+			status = http.StatusInternalServerError
+		}
+		serverJSON(w, status, ServerRender{Key: key, Host: GetHostname(), File: entry.File, Code: code, Written: code == ExitWrote})
+	})
+	return mux
+}
+
+// serverFile checks the file against the key's checksum - a file that doesn't
+// exist doesn't match.
+func serverFile(file, checksum string) *ServerFile {
+	result := &ServerFile{Path: file, Checksum: "missing"}
+	if info, err := os.Stat(file); err != nil || info.IsDir() {
+		return result
+	}
+	result.Checksum = ChecksumAs(ReadFile(file), checksum)
+	result.Matches = checksum != "" && result.Checksum == checksum
+	return result
+}
+
+// serverJSON writes value as the JSON response.
+func serverJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
+
+func checkServerFlags() {
+	Log("Checking cli flags.", "debug")
+	if ServerListen == "" {
+		fmt.Println("Need an address to listen on in --listen")
+		os.Exit(1)
+	}
+	if (ServerTLSCert == "") != (ServerTLSKey == "") {
+		fmt.Println("Need both --tls-cert and --tls-key")
+		os.Exit(1)
+	}
+	if ServerClientCA != "" && ServerTLSCert == "" {
+		fmt.Println("--tls-client-ca needs --tls-cert and --tls-key")
+		os.Exit(1)
+	}
+	if ServerTokenFile != "" {
+		data, err := ioutil.ReadFile(ServerTokenFile)
+		if err != nil || strings.TrimSpace(string(data)) == "" {
+			fmt.Printf("Could not read a token from --auth-token-file '%s': %v\n", ServerTokenFile, err)
+			os.Exit(1)
+		}
+		serverToken = strings.TrimSpace(string(data))
+	}
+	// A render rewrites files and reloads services - only a unix socket, which
+	// only this user can connect to, is left without a token or client certificates.
+	if serverToken == "" && ServerClientCA == "" && !strings.HasPrefix(ServerListen, "unix://") {
+		fmt.Println("Need --auth-token-file or --tls-client-ca - or listen on a unix:// socket")
+		os.Exit(1)
+	}
+	Log("Required cli flags present.", "debug")
+}
+
+var (
+	// ServerListen is the address server listens on.
+	ServerListen string
+
+	// ServerManifest is the apply manifest with the files that can be rendered.
+	ServerManifest string
+
+	// ServerTokenFile has the bearer token the API needs.
+	ServerTokenFile string
+
+	// serverToken is what's in ServerTokenFile.
+	serverToken string
+
+	// ServerTLSCert and ServerTLSKey serve the API over HTTPS.
+	ServerTLSCert string
+	ServerTLSKey  string
+
+	// ServerClientCA is the CA every client certificate has to be signed by.
+	ServerClientCA string
+)
+
+func init() {
+	RootCmd.AddCommand(serverCmd)
+	serverCmd.Flags().StringVarP(&ServerListen, "listen", "", "127.0.0.1:8282", "address to serve the API on - or unix:///path for a socket")
+	serverCmd.Flags().StringVarP(&ServerTokenFile, "auth-token-file", "", "", "file with the bearer token every request but /healthz needs")
+	serverCmd.Flags().StringVarP(&ServerTLSCert, "tls-cert", "", "", "certificate to serve the API over HTTPS with")
+	serverCmd.Flags().StringVarP(&ServerTLSKey, "tls-key", "", "", "key for --tls-cert")
+	serverCmd.Flags().StringVarP(&ServerClientCA, "tls-client-ca", "", "", "CA that has to sign every client's certificate")
+	serverCmd.Flags().StringVarP(&ServerManifest, "manifest", "m", "", "yaml manifest of the files that can be rendered")
+}
@@ -0,0 +1,112 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServerHandler(t *testing.T) {
+	file := ensureTestFile(t)
+	tc, c := newTestConsul(t)
+	tc.put("testing/server/data", exampleData)
+	tc.put("testing/server/checksum", exampleDataSHA)
+	if err := ioutil.WriteFile(file, []byte(exampleData), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	var rendered []string
+	entries := []ApplyEntry{{Direction: "out", Key: "server", File: file}, {Direction: "in", Key: "upload", File: file}}
+	server := httptest.NewServer(ServerHandler(c, entries, func(entry ApplyEntry) int {
+		rendered = append(rendered, entry.Key)
+		return ExitNoChange
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/v1/status/server")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("The status should be returned: %v %v", resp, err)
+	}
+	var status ServerStatus
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if status.Key != "server" || status.Checksum != exampleDataSHA || !status.ChecksumMatches || status.File == nil || !status.File.Matches {
+		t.Errorf("The status should show the key and the file: %+v %+v", status, status.File)
+	}
+	if resp, _ := http.Get(server.URL + "/v1/status/missing"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("A key without data should be a 404: %d", resp.StatusCode)
+	}
+
+	if resp, _ := http.Get(server.URL + "/v1/render/server"); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("A render should need a POST: %d", resp.StatusCode)
+	}
+	if resp, _ := http.Post(server.URL+"/v1/render/upload", "", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Only an out can be rendered: %d", resp.StatusCode)
+	}
+	resp, err = http.Post(server.URL+"/v1/render/server", "", nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("The render should run: %v %v", resp, err)
+	}
+	var render ServerRender
+	json.NewDecoder(resp.Body).Decode(&render)
+	resp.Body.Close()
+	if len(rendered) != 1 || render.Code != ExitNoChange || render.Written || render.File != file {
+		t.Errorf("The out should run once without a write: %v %+v", rendered, render)
+	}
+
+	if resp, _ := http.Get(server.URL + "/healthz"); resp.StatusCode != http.StatusOK {
+		t.Errorf("Consul is up so it should be healthy: %d", resp.StatusCode)
+	}
+	defer func(wait time.Duration) { RetryWait = wait }(RetryWait)
+	RetryWait = 0
+	tc.server.Close()
+	if resp, _ := http.Get(server.URL + "/healthz"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Consul is down so it should be critical: %d", resp.StatusCode)
+	}
+}
+
+func TestServerAuth(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	server := httptest.NewServer(ServerAuth(handler, "s3cret"))
+	defer server.Close()
+
+	if resp, _ := http.Post(server.URL+"/v1/render/hosts", "", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("A render without the token should be a 401: %d", resp.StatusCode)
+	}
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/v1/render/hosts", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	if resp, _ := http.DefaultClient.Do(req); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("The wrong token should be a 401: %d", resp.StatusCode)
+	}
+	req.Header.Set("Authorization", "Bearer s3cret")
+	if resp, _ := http.DefaultClient.Do(req); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("The token should let the render through: %d", resp.StatusCode)
+	}
+	if resp, _ := http.Get(server.URL + "/healthz"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("/healthz shouldn't need the token: %d", resp.StatusCode)
+	}
+}
+
+func TestServerListenerSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvexpress-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "api.sock")
+	listener, err := serverListener("unix://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Only this user should be able to use the socket: %v %v", info.Mode(), err)
+	}
+}
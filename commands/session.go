@@ -0,0 +1,100 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"strings"
+	"time"
+)
+
+// ErrKeyOwned is returned when another host owns a key with --acquire-session -
+// the host is added to the end.
+var ErrKeyOwned = errors.New("the key is owned by host")
+
+// AcquireSessionKey holds key for this host with a Consul session that has a
+// TTL - the value is the hostname. If this host already holds it the session
+// is renewed. It returns the host that holds it when it's another one - and
+// a blank holder when this host has it.
+func AcquireSessionKey(c *consul.Client, key string, ttl time.Duration) (string, error) {
+	hostname := GetHostname()
+	key = strings.TrimPrefix(key, "/")
+	pair, _, err := c.KV().Get(key, &consul.QueryOptions{RequireConsistent: true})
+	if err != nil {
+		return "", err
+	}
+	if pair != nil && pair.Session != "" {
+		if string(pair.Value) != hostname {
+			return string(pair.Value), nil
+		}
+		entry, _, err := c.Session().Renew(pair.Session, nil)
+		if err == nil && entry != nil {
+			Log(fmt.Sprintf("session='renewed' key='%s'", key), "debug")
+			return "", nil
+		}
+	}
+	entry := &consul.SessionEntry{
+		Name:     fmt.Sprintf("kvexpress-%s", hostname),
+		TTL:      ttl.String(),
+		Behavior: consul.SessionBehaviorDelete,
+	}
+	session, _, err := c.Session().Create(entry, nil)
+	if err != nil {
+		return "", err
+	}
+	acquired, _, err := c.KV().Acquire(&consul.KVPair{Key: key, Value: []byte(hostname), Session: session}, nil)
+	if err != nil || !acquired {
+		c.Session().Destroy(session, nil)
+		if err != nil {
+			return "", err
+		}
+		// Another host got there first.
+		holder := "another host"
+		if pair, _, err := c.KV().Get(key, &consul.QueryOptions{RequireConsistent: true}); err == nil && pair != nil {
+			holder = string(pair.Value)
+		}
+		return holder, nil
+	}
+	Log(fmt.Sprintf("session='acquired' key='%s' ttl='%s'", key, ttl), "info")
+	return "", nil
+}
+
+// ownerOps keep a transaction from saving a key another host owns with
+// --acquire-session - whether this run passed it or not. The owner key has to
+// be the same when the data is saved as it was when it was read here, so a
+// host that takes the key in between makes it a conflict. Only Consul has
+// sessions.
+func ownerOps(c *consul.Client, key string) ([]*consul.TxnOp, error) {
+	if backend != nil {
+		return nil, nil
+	}
+	KeyOwner := KeyPath(key, "owner")
+	pair, _, err := c.KV().Get(KeyOwner, &consul.QueryOptions{RequireConsistent: true})
+	if err != nil {
+		return nil, err
+	}
+	if pair == nil {
+		return []*consul.TxnOp{{KV: &consul.KVTxnOp{Verb: consul.KVCheckNotExists, Key: KeyOwner}}}, nil
+	}
+	if pair.Session != "" && string(pair.Value) != GetHostname() {
+		return nil, fmt.Errorf("%w %s", ErrKeyOwned, pair.Value)
+	}
+	return []*consul.TxnOp{{KV: &consul.KVTxnOp{Verb: consul.KVCheckIndex, Key: KeyOwner, Index: pair.ModifyIndex}}}, nil
+}
+
+// AcquireOwnership makes this host the owner of key with --acquire-session.
+// It's an ErrKeyOwned that names the owner if another host has it.
+func AcquireOwnership(c *consul.Client, key string, ttl time.Duration) error {
+	holder, err := AcquireSessionKey(c, KeyPath(key, "owner"), ttl)
+	if err != nil {
+		return fmt.Errorf("could not acquire the session for '%s': %v", key, err)
+	}
+	if holder != "" {
+		Log(fmt.Sprintf("owner='false' key='%s' holder='%s'", key, holder), "info")
+		return fmt.Errorf("%w %s", ErrKeyOwned, holder)
+	}
+	Log(fmt.Sprintf("owner='true' key='%s'", key), "debug")
+	return nil
+}
@@ -0,0 +1,56 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcquireOwnership(t *testing.T) {
+	ensureTestFile(t)
+	tc, c := newTestConsul(t)
+	if err := AcquireOwnership(c, "owned", time.Hour); err != nil {
+		t.Fatalf("The first host should own the key: %v", err)
+	}
+	if value, _ := tc.value("testing/owned/owner"); value != GetHostname() {
+		t.Errorf("The owner key should have the hostname: '%s'", value)
+	}
+	if err := AcquireOwnership(c, "owned", time.Hour); err != nil {
+		t.Errorf("The owner should keep the key on the next run: %v", err)
+	}
+
+	tc.put("testing/owned/owner", "producer-2")
+	tc.Lock()
+	tc.kv["testing/owned/owner"].Session = "session-other"
+	tc.Unlock()
+	err := AcquireOwnership(c, "owned", time.Hour)
+	if !errors.Is(err, ErrKeyOwned) || !strings.Contains(err.Error(), "owned by host producer-2") {
+		t.Errorf("Another host should own the key: %v", err)
+	}
+}
+
+func TestSaveCASOwned(t *testing.T) {
+	ensureTestFile(t)
+	tc, c := newTestConsul(t)
+	tc.put("testing/owned/owner", "producer-2")
+	tc.Lock()
+	tc.kv["testing/owned/owner"].Session = "session-other"
+	tc.Unlock()
+	if _, err := SaveCAS(c, "owned", exampleData, exampleDataSHA, ""); !errors.Is(err, ErrKeyOwned) {
+		t.Errorf("A key another host owns shouldn't be saved without --acquire-session: %v", err)
+	}
+	if _, ok := tc.value("testing/owned/data"); ok {
+		t.Error("Nothing should be saved.")
+	}
+
+	tc.put("testing/owned/owner", GetHostname())
+	if saved, err := SaveCAS(c, "owned", exampleData, exampleDataSHA, ""); err != nil || !saved {
+		t.Errorf("The owner should save the key: %t %v", saved, err)
+	}
+	if saved, err := SaveCAS(c, "unowned", exampleData, exampleDataSHA, ""); err != nil || !saved {
+		t.Errorf("A key nobody owns should be saved: %t %v", saved, err)
+	}
+}
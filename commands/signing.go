@@ -0,0 +1,102 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/DataDog/kvexpress/pkg/kvexpress"
+	consul "github.com/hashicorp/consul/api"
+	"io/ioutil"
+	"time"
+)
+
+// ErrBadSignature is returned when the data doesn't match its signature.
+var ErrBadSignature = kvexpress.ErrBadSignature
+
+// LoadSigningKey reads a PEM encoded ed25519 private key - the kind made by
+// `openssl genpkey -algorithm ed25519`.
+func LoadSigningKey(file string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(file)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse '%s': %v", file, err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("'%s' is not an ed25519 private key", file)
+	}
+	return key, nil
+}
+
+// LoadVerifyKey reads a PEM encoded ed25519 public key - the kind made by
+// `openssl pkey -pubout`.
+func LoadVerifyKey(file string) (ed25519.PublicKey, error) {
+	block, err := readPEM(file)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse '%s': %v", file, err)
+	}
+	key, ok := parsed.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("'%s' is not an ed25519 public key", file)
+	}
+	return key, nil
+}
+
+// readPEM returns the first PEM block in file.
+func readPEM(file string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("there's no PEM data in '%s'", file)
+	}
+	return block, nil
+}
+
+// SignData signs data and returns the base64 encoded signature.
+func SignData(key ed25519.PrivateKey, data string) string {
+	return kvexpress.SignData(key, data)
+}
+
+// VerifyData returns ErrBadSignature unless signature is a valid signature of
+// data.
+func VerifyData(key ed25519.PublicKey, data, signature string) error {
+	return kvexpress.VerifyData(key, data, signature)
+}
+
+// signedKey is the key a signature is made for - canary and staged data are
+// signed for the key they're promoted to.
+func signedKey(key string) string {
+	return kvexpress.SignedKey(key)
+}
+
+// SignKeyData signs the uncompressed data for key with its checksum and the
+// time, and returns what's saved in KeyPath(key, "signature").
+func SignKeyData(private ed25519.PrivateKey, key, checksum, data string) string {
+	return kvexpress.Sign(private, key, checksum, ReturnCurrentUTC(), data)
+}
+
+// VerifyKeyData returns when the data was signed, or ErrBadSignature unless
+// signature was made by SignKeyData for the same key, checksum and data.
+func VerifyKeyData(public ed25519.PublicKey, key, checksum, data, signature string) (time.Time, error) {
+	return kvexpress.VerifySignature(public, key, checksum, data, signature)
+}
+
+// verifyKeySignature checks the uncompressed data read from key against the
+// checksum and signature saved with it.
+func verifyKeySignature(c *consul.Client, key, data string) error {
+	_, err := kvexpress.VerifyKey(kvStore{c}, verifyPublicKey, key, "", data)
+	return err
+}
@@ -0,0 +1,95 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSigningKeys writes a new ed25519 key pair and returns the private and public key files.
+func testSigningKeys(t *testing.T) (string, string) {
+	dir, err := ioutil.TempDir("", "kvexpress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateDER, _ := x509.MarshalPKCS8PrivateKey(private)
+	publicDER, _ := x509.MarshalPKIXPublicKey(public)
+	privateFile := filepath.Join(dir, "sign.pem")
+	publicFile := filepath.Join(dir, "verify.pem")
+	ioutil.WriteFile(privateFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0600)
+	ioutil.WriteFile(publicFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0644)
+	return privateFile, publicFile
+}
+
+func TestSignVerifyData(t *testing.T) {
+	privateFile, publicFile := testSigningKeys(t)
+	private, err := LoadSigningKey(privateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := LoadVerifyKey(publicFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := SignData(private, exampleData)
+	if err := VerifyData(public, exampleData, signature+"\n"); err != nil {
+		t.Errorf("The signature should be valid: %v", err)
+	}
+	if err := VerifyData(public, exampleData+"10.0.0.1 evil\n", signature); err != ErrBadSignature {
+		t.Errorf("Changed data should not match the signature: %v", err)
+	}
+	if err := VerifyData(public, exampleData, ""); err != ErrBadSignature {
+		t.Errorf("A missing signature should not be valid: %v", err)
+	}
+}
+
+func TestSignVerifyKeyData(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := SignKeyData(private, "hosts/canary", exampleDataSHA, exampleData)
+	if signed, err := VerifyKeyData(public, "hosts", exampleDataSHA+"\n", exampleData, signature+"\n"); err != nil || time.Since(signed) > time.Minute {
+		t.Errorf("The canary's signature should be valid for the key it's promoted to: %s %v", signed, err)
+	}
+	if _, err := VerifyKeyData(public, "other", exampleDataSHA, exampleData, signature); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("The signature for one key shouldn't be valid for another: %v", err)
+	}
+	if _, err := VerifyKeyData(public, "hosts", ComputeChecksum("other"), exampleData, signature); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("The signature should be bound to the checksum: %v", err)
+	}
+	if _, err := VerifyKeyData(public, "hosts", exampleDataSHA, exampleData, strings.Replace(signature, "20", "19", 1)); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("The time the data was signed can't be changed: %v", err)
+	}
+	if _, err := VerifyKeyData(public, "hosts", exampleDataSHA, exampleData, SignData(private, exampleData)); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("A signature of the data alone should not be valid: %v", err)
+	}
+}
+
+func TestLoadKeysWrongType(t *testing.T) {
+	privateFile, publicFile := testSigningKeys(t)
+	if _, err := LoadSigningKey(publicFile); err == nil {
+		t.Error("A public key should not load as a signing key.")
+	}
+	if _, err := LoadVerifyKey(privateFile); err == nil {
+		t.Error("A private key should not load as a verify key.")
+	}
+	if _, err := LoadVerifyKey(filepath.Join(filepath.Dir(publicFile), "missing.pem")); err == nil {
+		t.Error("A missing file should be an error.")
+	}
+}
@@ -0,0 +1,276 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Save the files kvexpress manages on this host to a tarball.",
+	Long:  `Snapshot is for cloning a host and for incidents - it saves every managed file with its checksum, owner and mode, the .locked, .last and .compare files next to them and the state kvexpress keeps in --tmp-dir. restore puts them back.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		checkSnapshotFlags()
+		AutoEnable()
+	},
+	Run: snapshotRun,
+}
+
+func snapshotRun(cmd *cobra.Command, args []string) {
+	start := time.Now()
+	files := SnapshotFiles(snapshotPaths(), lockDirs())
+	snapshot, err := WriteSnapshot(SnapshotArchive, files, signingKey)
+	ExitOnError(err, SnapshotArchive, "snapshot")
+	for _, file := range snapshot.Files {
+		fmt.Printf("%-8s %s\n", file.Kind, file.Path)
+	}
+	Log(fmt.Sprintf("snapshot file='%s' files='%d'", SnapshotArchive, len(snapshot.Files)), "info")
+	RecordDetails(snapshot)
+	PrintResult("snapshot", "complete", time.Since(start), "")
+	RunTime(start, "snapshot", "complete")
+}
+
+// Snapshot is what's in snapshot.json at the top of the tarball.
+type Snapshot struct {
+	Host    string         `json:"host"`
+	Created string         `json:"created"`
+	RunID   string         `json:"run_id,omitempty"`
+	Files   []SnapshotFile `json:"files"`
+}
+
+// SnapshotFile is a file in the tarball. Kind is file for a managed file,
+// locked, last or compare for the files next to it and state for kvexpress's
+// own files in --tmp-dir - they're restored to --tmp-dir on the new host.
+type SnapshotFile struct {
+	Path     string `json:"path"`
+	Kind     string `json:"kind"`
+	Checksum string `json:"checksum"`
+	Size     int64  `json:"size"`
+	Mode     string `json:"mode"`
+	UID      int    `json:"uid"`
+	GID      int    `json:"gid"`
+	Modified string `json:"modified"`
+}
+
+// snapshotManifest is the name of the Snapshot in the tarball and
+// snapshotSignature is its --sign-key signature - the manifest has every
+// file's checksum, so it covers the whole tarball.
+const (
+	snapshotManifest  = "snapshot.json"
+	snapshotSignature = "snapshot.json.sig"
+)
+
+// snapshotStateSuffixes are the files in --tmp-dir that are kept - the run
+// locks and temp files only mean something to the process that made them.
+var snapshotStateSuffixes = []string{".pending", ".state", ".json"}
+
+// snapshotPaths are --path and every file in the --manifest entries.
+func snapshotPaths() []string {
+	paths := append([]string{}, SnapshotPaths...)
+	if SnapshotManifest == "" {
+		return paths
+	}
+	data, err := ioutil.ReadFile(SnapshotManifest)
+	ExitOnError(err, SnapshotManifest, "read_manifest")
+	entries, err := ParseManifest(data)
+	ExitOnError(err, SnapshotManifest, "parse_manifest")
+	for _, entry := range entries {
+		if entry.File != "" {
+			paths = append(paths, entry.File)
+		}
+		for _, output := range entry.Outputs {
+			paths = append(paths, output.File)
+		}
+	}
+	return paths
+}
+
+// SnapshotFiles finds what a snapshot saves: every file in paths - a
+// directory has all the files in it - and every file in dirs with a .locked
+// file, with their .locked, .last and .compare files, and kvexpress's state
+// in --tmp-dir. The map is path to kind.
+func SnapshotFiles(paths, dirs []string) map[string]string {
+	files := make(map[string]string)
+	add := func(file string) {
+		file, err := filepath.Abs(file)
+		if err != nil {
+			return
+		}
+		info, err := os.Stat(file)
+		if err != nil || !info.Mode().IsRegular() {
+			return
+		}
+		files[file] = "file"
+		for kind, companion := range map[string]string{"locked": LockFilePath(file), "last": LastFilename(file), "compare": CompareFilename(file)} {
+			if info, err := os.Stat(companion); err == nil && info.Mode().IsRegular() {
+				files[companion] = kind
+			}
+		}
+	}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			Log(fmt.Sprintf("snapshot path='%s' message='%v' - skipping it.", path, err), "info")
+			continue
+		}
+		if !info.IsDir() {
+			add(path)
+			continue
+		}
+		filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() && !strings.HasSuffix(file, "."+fileSuffix) {
+				if _, ok := files[file]; !ok {
+					add(file)
+				}
+			}
+			return nil
+		})
+	}
+	for _, file := range LockedFiles(dirs) {
+		add(file)
+	}
+	state, _ := filepath.Glob(filepath.Join(StateDir(), "kvexpress-*"))
+	for _, file := range state {
+		for _, suffix := range snapshotStateSuffixes {
+			if strings.HasSuffix(file, suffix) {
+				files[file] = "state"
+			}
+		}
+	}
+	return files
+}
+
+// snapshotName is where file is kept in the tarball.
+func snapshotName(file SnapshotFile) string {
+	if file.Kind == "state" {
+		return "state/" + filepath.Base(file.Path)
+	}
+	return "files/" + strings.TrimPrefix(filepath.ToSlash(file.Path), "/")
+}
+
+// WriteSnapshot saves files to a gzipped tarball at archive with the manifest
+// signed by key. It's written to a temp file that's only readable by the user
+// that wrote it and renamed - the files can have secrets in them, and an
+// archive that was already there would keep its mode.
+func WriteSnapshot(archive string, files map[string]string, key ed25519.PrivateKey) (Snapshot, error) {
+	snapshot := Snapshot{Host: GetHostname(), Created: ReturnCurrentUTC(), RunID: RunID, Files: []SnapshotFile{}}
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	contents := make(map[string][]byte)
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return snapshot, err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return snapshot, err
+		}
+		uid, gid := fileOwnerIDs(info)
+		snapshot.Files = append(snapshot.Files, SnapshotFile{
+			Path:     path,
+			Kind:     files[path],
+			Checksum: ComputeChecksum(string(data)),
+			Size:     int64(len(data)),
+			Mode:     fmt.Sprintf("%04o", unixMode(info.Mode())),
+			UID:      uid,
+			GID:      gid,
+			Modified: info.ModTime().UTC().Format(time.RFC3339Nano),
+		})
+		contents[path] = data
+	}
+	if DryRunSkip(fmt.Sprintf("write the snapshot of %d files to '%s'", len(snapshot.Files), archive)) {
+		return snapshot, nil
+	}
+	out, err := ioutil.TempFile(filepath.Dir(archive), "."+filepath.Base(archive)+".")
+	if err != nil {
+		return snapshot, err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+	manifest, _ := json.MarshalIndent(snapshot, "", "\t")
+	if err := writeTarFile(tw, snapshotManifest, manifest); err != nil {
+		return snapshot, err
+	}
+	if err := writeTarFile(tw, snapshotSignature, []byte(SignData(key, string(manifest)))); err != nil {
+		return snapshot, err
+	}
+	for _, file := range snapshot.Files {
+		if err := writeTarFile(tw, snapshotName(file), contents[file.Path]); err != nil {
+			return snapshot, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return snapshot, err
+	}
+	if err := gz.Close(); err != nil {
+		return snapshot, err
+	}
+	if err := out.Sync(); err != nil {
+		return snapshot, err
+	}
+	if err := out.Close(); err != nil {
+		return snapshot, err
+	}
+	return snapshot, os.Rename(out.Name(), archive)
+}
+
+// writeTarFile adds data to the tarball as name.
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: time.Now()}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+func checkSnapshotFlags() {
+	Log("Checking cli flags.", "debug")
+	if SnapshotArchive == "" {
+		fmt.Println("Need a file to save the snapshot to with -f")
+		os.Exit(1)
+	}
+	if SignKey == "" {
+		fmt.Println("Need a --sign-key to sign the snapshot with - restore only takes a signed one")
+		os.Exit(1)
+	}
+	loadSignKey()
+	Log("Required cli flags present.", "debug")
+}
+
+var (
+	// SnapshotArchive is the tarball snapshot writes and restore reads.
+	SnapshotArchive string
+
+	// SnapshotPaths are the files and directories kvexpress manages.
+	SnapshotPaths []string
+
+	// SnapshotManifest is an apply manifest - its files are saved too.
+	SnapshotManifest string
+)
+
+func init() {
+	RootCmd.AddCommand(snapshotCmd)
+	snapshotCmd.Flags().StringVarP(&SnapshotArchive, "file", "f", "", "tarball to save the snapshot to")
+	snapshotCmd.Flags().StringSliceVarP(&SnapshotPaths, "path", "", []string{}, "file or directory kvexpress manages (repeatable)")
+	snapshotCmd.Flags().StringVarP(&SnapshotManifest, "manifest", "m", "", "apply manifest - every file in it is saved")
+	snapshotCmd.Flags().StringVarP(&SignKey, "sign-key", "", "", "ed25519 private key to sign the snapshot with")
+	snapshotCmd.Flags().StringSliceVarP(&LockDirs, "dir", "", []string{}, "directories to look for .locked files in - --allowed-dir or /etc if blank")
+}
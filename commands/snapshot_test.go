@@ -0,0 +1,176 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvexpress-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	TmpDir = filepath.Join(dir, "tmp")
+	os.Mkdir(TmpDir, 0755)
+	defer func() { TmpDir = "" }()
+	conf := filepath.Join(dir, "etc")
+	os.Mkdir(conf, 0755)
+	hosts := filepath.Join(conf, "hosts")
+	ioutil.WriteFile(hosts, []byte(exampleData), 0640)
+	ioutil.WriteFile(hosts+".locked", []byte("Reason Locked: testing"), 0644)
+	ioutil.WriteFile(hosts+".last", []byte(exampleData), 0640)
+	ioutil.WriteFile(filepath.Join(TmpDir, "kvexpress-out-hosts.pending"), []byte("2020-01-01T00:00:00Z abc"), 0644)
+	ioutil.WriteFile(filepath.Join(TmpDir, "kvexpress-out-hosts.lock"), []byte("1234"), 0644)
+
+	files := SnapshotFiles([]string{hosts}, []string{})
+	for file, kind := range map[string]string{hosts: "file", hosts + ".locked": "locked", hosts + ".last": "last", filepath.Join(TmpDir, "kvexpress-out-hosts.pending"): "state"} {
+		if files[file] != kind {
+			t.Errorf("'%s' should be in the snapshot as %s: %v", file, kind, files)
+		}
+	}
+	if _, ok := files[filepath.Join(TmpDir, "kvexpress-out-hosts.lock")]; ok {
+		t.Error("A run lock shouldn't be in the snapshot.")
+	}
+	privateFile, publicFile := testSigningKeys(t)
+	private, _ := LoadSigningKey(privateFile)
+	public, _ := LoadVerifyKey(publicFile)
+	archive := filepath.Join(dir, "host-state.tar.gz")
+	ioutil.WriteFile(archive, []byte("old"), 0644)
+	if _, err := WriteSnapshot(archive, files, private); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(archive); info.Mode().Perm() != 0600 {
+		t.Errorf("The snapshot should only be readable by its owner: %s", info.Mode())
+	}
+
+	// Something went wrong on the host.
+	ioutil.WriteFile(hosts, []byte("broken"), 0600)
+	os.Remove(hosts + ".locked")
+	_, otherPublicFile := testSigningKeys(t)
+	other, _ := LoadVerifyKey(otherPublicFile)
+	if _, _, err := ReadSnapshot(archive, other); err == nil {
+		t.Error("A snapshot signed with another key shouldn't be read.")
+	}
+	snapshot, contents, err := ReadSnapshot(archive, public)
+	if err != nil || len(snapshot.Files) != 4 {
+		t.Fatalf("The snapshot should have every file: %+v %v", snapshot, err)
+	}
+	if _, err := RestoreSnapshot(snapshot, contents, nil); err == nil {
+		t.Error("Nothing should be restored without --path or --manifest.")
+	}
+	results, err := RestoreSnapshot(snapshot, contents, []string{hosts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := make(map[string]string)
+	for _, result := range results {
+		statuses[result.Path] = result.Status
+	}
+	if statuses[hosts] != "restored" || statuses[hosts+".locked"] != "restored" || statuses[hosts+".last"] != "unchanged" {
+		t.Errorf("Only the files that changed should be restored: %v", statuses)
+	}
+	if data, _ := ioutil.ReadFile(hosts); string(data) != exampleData {
+		t.Errorf("The file should be put back: %q", data)
+	}
+	if info, _ := os.Stat(hosts); info.Mode().Perm() != 0640 {
+		t.Errorf("The file should get its mode back: %s", info.Mode())
+	}
+
+	// The state only goes back on the host that took the snapshot, and the
+	// setuid and setgid bits never do.
+	snapshot.Host = "another-host"
+	for i := range snapshot.Files {
+		if snapshot.Files[i].Path == hosts {
+			snapshot.Files[i].Mode = "4755"
+		}
+	}
+	ioutil.WriteFile(hosts, []byte("broken"), 0600)
+	results, _ = RestoreSnapshot(snapshot, contents, []string{conf})
+	for _, result := range results {
+		if result.Kind == "state" && result.Status != "skipped" {
+			t.Errorf("The state from another host shouldn't be restored: %+v", result)
+		}
+	}
+	if info, _ := os.Stat(hosts); info.Mode()&os.ModeSetuid != 0 || info.Mode().Perm() != 0755 {
+		t.Errorf("The setuid bit shouldn't be restored: %s", info.Mode())
+	}
+
+	// A path that isn't clean stops the restore.
+	snapshot.Files[0].Path = conf + "/../etc/hosts"
+	if _, err := RestoreSnapshot(snapshot, contents, []string{conf}); err == nil {
+		t.Error("A path with .. in it should be an error.")
+	}
+	snapshot.Files[0].Path = hosts
+
+	// A file that doesn't match its checksum stops the restore before anything is written.
+	contents[snapshotName(snapshot.Files[0])] = []byte("tampered")
+	if _, err := RestoreSnapshot(snapshot, contents, nil); err == nil {
+		t.Error("A file that doesn't match its checksum should be an error.")
+	}
+}
+
+// tarEntry is a file in a tarball written by writeTestTarball.
+type tarEntry struct {
+	name string
+	data []byte
+}
+
+func writeTestTarball(t *testing.T, archive string, entries []tarEntry) {
+	out, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+	for _, entry := range entries {
+		if err := writeTarFile(tw, entry.name, entry.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+	gz.Close()
+}
+
+func TestReadSnapshotHostile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvexpress-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	privateFile, publicFile := testSigningKeys(t)
+	private, _ := LoadSigningKey(privateFile)
+	public, _ := LoadVerifyKey(publicFile)
+	file := SnapshotFile{Path: "/etc/hosts", Kind: "file", Checksum: ComputeChecksum(exampleData), Size: int64(len(exampleData)), Mode: "0644"}
+	manifest, _ := json.Marshal(Snapshot{Host: "web1", Files: []SnapshotFile{file}})
+	signed := []tarEntry{{snapshotManifest, manifest}, {snapshotSignature, []byte(SignData(private, string(manifest)))}}
+	archive := filepath.Join(dir, "snapshot.tar.gz")
+
+	writeTestTarball(t, archive, append(signed, tarEntry{snapshotName(file), []byte(exampleData)}))
+	if _, contents, err := ReadSnapshot(archive, public); err != nil || string(contents[snapshotName(file)]) != exampleData {
+		t.Fatalf("A signed snapshot should be read: %v", err)
+	}
+
+	for name, entries := range map[string][]tarEntry{
+		"an unsigned tarball":          {{snapshotName(file), make([]byte, 1<<20)}, {snapshotManifest, manifest}},
+		"a file before the manifest":   {{snapshotName(file), []byte(exampleData)}, signed[0], signed[1]},
+		"a manifest with no signature": {signed[0], {snapshotName(file), []byte(exampleData)}},
+		"a huge manifest":              {{snapshotManifest, make([]byte, snapshotManifestMax+1)}, signed[1]},
+		"a file it doesn't name":       append(signed, tarEntry{"files/etc/shadow", []byte("root::0:0")}),
+		"a file twice":                 append(signed, tarEntry{snapshotName(file), []byte(exampleData)}, tarEntry{snapshotName(file), []byte(exampleData)}),
+		"a file bigger than its size":  append(signed, tarEntry{snapshotName(file), []byte(exampleData + exampleData)}),
+	} {
+		writeTestTarball(t, archive, entries)
+		if _, _, err := ReadSnapshot(archive, public); err == nil {
+			t.Errorf("A snapshot with %s shouldn't be read.", name)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// ActivateAt saves the data in the staged key with the time out and watch
+	// switch to it.
+	ActivateAt string
+
+	// activateTime is ActivateAt once it's been parsed.
+	activateTime time.Time
+)
+
+// activateLayouts are the times --activate-at takes - RFC3339 with or without
+// the seconds.
+var activateLayouts = []string{time.RFC3339, "2006-01-02T15:04Z07:00"}
+
+// StagedKey is where the staged data for key is saved - <key>/staged.
+func StagedKey(key string) string {
+	return strings.TrimSuffix(key, "/") + "/staged"
+}
+
+// ParseActivateAt parses an --activate-at time.
+func ParseActivateAt(value string) (time.Time, error) {
+	for _, layout := range activateLayouts {
+		if at, err := time.Parse(layout, value); err == nil {
+			return at.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("'%s' isn't an RFC3339 time like 2024-06-01T00:00Z", value)
+}
+
+// StagedActivation is when the staged data for key becomes the key's data -
+// zero if nothing is staged.
+func StagedActivation(c *consul.Client, key string) (time.Time, error) {
+	staged := StagedKey(key)
+	checksum, err := Get(c, KeyPath(staged, "checksum"))
+	if err != nil || checksum == "" {
+		return time.Time{}, err
+	}
+	value, err := Get(c, KeyPath(staged, "activate_at"))
+	if err != nil || value == "" {
+		return time.Time{}, err
+	}
+	at, err := time.Parse(time.RFC3339, strings.TrimSpace(value))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not parse the activate_at time for '%s': %v", staged, err)
+	}
+	return at, nil
+}
+
+// StagedOutKey is the key to read - the staged key once its activation time
+// has passed, or key. Saving key again after that time wins over the staged
+// data, so the staged key doesn't have to be removed.
+func StagedOutKey(c *consul.Client, key string) (string, error) {
+	at, err := StagedActivation(c, key)
+	if err != nil || at.IsZero() {
+		return key, err
+	}
+	staged := StagedKey(key)
+	if time.Now().Before(at) {
+		Log(fmt.Sprintf("staged key='%s' activate_at='%s' - reading the key until then.", staged, at.Format(time.RFC3339)), "debug")
+		return key, nil
+	}
+	updated, err := Get(c, KeyPath(key, "updated"))
+	if err != nil {
+		return key, err
+	}
+	if saved, err := time.Parse(time.RFC3339, strings.TrimSpace(updated)); err == nil && !saved.Before(at) {
+		Log(fmt.Sprintf("staged key='%s' activate_at='%s' updated='%s' - the key was saved since, reading the key.", staged, at.Format(time.RFC3339), strings.TrimSpace(updated)), "debug")
+		return key, nil
+	}
+	Log(fmt.Sprintf("staged key='%s' activate_at='%s' - reading the staged key.", staged, at.Format(time.RFC3339)), "info")
+	return staged, nil
+}
+
+// stagedWake is when watch should render the staged data for key if that's
+// before the blocking query would come back on its own - zero if it isn't.
+// Nothing changes in Consul when the time passes.
+func stagedWake(c *consul.Client, key string, wait time.Duration) time.Time {
+	at, err := StagedActivation(c, key)
+	if err != nil {
+		Log(fmt.Sprintf("staged key='%s' message='%v'", StagedKey(key), err), "debug")
+		return time.Time{}
+	}
+	if at.IsZero() || !time.Now().Before(at) || time.Until(at) > wait {
+		return time.Time{}
+	}
+	return at
+}
+
+// PromoteStaged saves the staged data for key as the key once it's active, so
+// staging the next version doesn't send every host back to the key's old
+// data. It's saved with a CAS on the key's data and checksum as they were
+// when the staged data was found to be active - a key that's saved since wins
+// and nothing is promoted.
+func PromoteStaged(c *consul.Client, key string) (bool, error) {
+	staged := StagedKey(key)
+	dataIndex, _, err := consulIndex(c, KeyPath(key, "data"))
+	if err != nil {
+		return false, err
+	}
+	checksumIndex, current, err := consulIndex(c, KeyPath(key, "checksum"))
+	if err != nil {
+		return false, err
+	}
+	read, err := StagedOutKey(c, key)
+	if err != nil || read != staged {
+		return false, err
+	}
+	checksum, err := Get(c, KeyPath(staged, "checksum"))
+	if err != nil {
+		return false, err
+	}
+	checksum = strings.TrimSpace(checksum)
+	if checksum == strings.TrimSpace(current) {
+		return false, nil
+	}
+	stored, err := GetData(c, staged)
+	if err != nil {
+		return false, err
+	}
+	data, encoding, err := DecodeKeyData(c, staged, stored)
+	if err != nil {
+		return false, err
+	}
+	if !ChecksumCompare(data, checksum) {
+		return false, fmt.Errorf("the staged data for '%s' doesn't match its checksum", key)
+	}
+	ops := casOps(key, stored, checksum, "", encoding, dataIndex, checksumIndex)
+	for _, part := range []string{"checksums", "signature", "rolling"} {
+		value, err := Get(c, KeyPath(staged, part))
+		if err != nil {
+			return false, err
+		}
+		op := &consul.TxnOp{KV: &consul.KVTxnOp{Verb: consul.KVDelete, Key: KeyPath(key, part)}}
+		if value != "" {
+			op = setOp(KeyPath(key, part), value)
+		}
+		ops = append(ops, op)
+	}
+	ok, err := kvTxn(c, ops)
+	if err != nil || !ok {
+		Log(fmt.Sprintf("staged key='%s' promoted='false' - the key was saved since.", staged), "info")
+		return false, err
+	}
+	Log(fmt.Sprintf("staged key='%s' promoted='true' checksum='%s'", staged, checksum), "info")
+	return true, nil
+}
+
+// activateAtOp saves --activate-at in the same transaction as the staged data
+// in key.
+func activateAtOp(key string) *consul.TxnOp {
+	return setOp(KeyPath(key, "activate_at"), activateTime.Format(time.RFC3339))
+}
+
+// saveActivateAt saves a new --activate-at for staged data that's already
+// in key - a new time for the same data still has to be saved.
+func saveActivateAt(c *consul.Client, key string) error {
+	KeyActivate := KeyPath(key, "activate_at")
+	at := activateTime.Format(time.RFC3339)
+	current, err := Get(c, KeyActivate)
+	if err != nil || strings.TrimSpace(current) == at || DryRunSkip(fmt.Sprintf("save '%s' activate_at='%s'", KeyActivate, at)) {
+		return err
+	}
+	Log(fmt.Sprintf("staged key='%s' activate_at='%s'", key, at), "info")
+	return Set(c, KeyActivate, at)
+}
+
+// checkActivateFlags parses --activate-at - staged data is a single key saved
+// with SaveCAS, so it can't be used with the flags that save somewhere else
+// or another way.
+func checkActivateFlags() {
+	if ActivateAt == "" {
+		return
+	}
+	at, err := ParseActivateAt(ActivateAt)
+	if err != nil {
+		fmt.Printf("Need an RFC3339 time in --activate-at: %v\n", err)
+		os.Exit(1)
+	}
+	if InCanary || InAppend || Recurse || len(InTargets) > 0 || ContentAddressed || Delta {
+		fmt.Println("--activate-at can't be used with --canary, --append, --recurse, --target, --content-addressed or --delta")
+		os.Exit(1)
+	}
+	activateTime = at
+}
@@ -0,0 +1,120 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseActivateAt(t *testing.T) {
+	at, err := ParseActivateAt("2024-06-01T00:00Z")
+	if err != nil || !at.Equal(time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("A time without seconds should parse: %s %v", at, err)
+	}
+	if at, err := ParseActivateAt("2024-06-01T02:00:30+02:00"); err != nil || at.Format(time.RFC3339) != "2024-06-01T00:00:30Z" {
+		t.Errorf("An RFC3339 time should parse to UTC: %s %v", at, err)
+	}
+	if _, err := ParseActivateAt("tomorrow"); err == nil {
+		t.Error("'tomorrow' isn't a time.")
+	}
+}
+
+func TestStagedOutKey(t *testing.T) {
+	PrefixLocation = "testing"
+	tc, c := newTestConsul(t)
+	if StagedKey("hosts") != "hosts/staged" {
+		t.Errorf("The staged data should be saved next to the key: %s", StagedKey("hosts"))
+	}
+	if key, err := StagedOutKey(c, "hosts"); err != nil || key != "hosts" {
+		t.Errorf("Without staged data the key should be read: %s %v", key, err)
+	}
+
+	past := time.Now().Add(-time.Hour).UTC()
+	tc.put("testing/hosts/staged/checksum", exampleDataSHA)
+	tc.put("testing/hosts/staged/activate_at", time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	tc.put("testing/hosts/updated", past.Add(-time.Hour).Format(time.RFC3339))
+	if key, err := StagedOutKey(c, "hosts"); err != nil || key != "hosts" {
+		t.Errorf("The key should be read until the staged data is active: %s %v", key, err)
+	}
+	if wake := stagedWake(c, "hosts", 2*time.Hour); wake.IsZero() {
+		t.Error("watch should wake up when the staged data is active.")
+	}
+	if wake := stagedWake(c, "hosts", time.Minute); !wake.IsZero() {
+		t.Errorf("The blocking query comes back before the staged data is active: %s", wake)
+	}
+
+	tc.put("testing/hosts/staged/activate_at", past.Format(time.RFC3339))
+	if key, err := StagedOutKey(c, "hosts"); err != nil || key != "hosts/staged" {
+		t.Errorf("The staged key should be read once it's active: %s %v", key, err)
+	}
+
+	// Saving the key after the time wins over the staged data.
+	tc.put("testing/hosts/updated", past.Add(time.Minute).Format(time.RFC3339))
+	if key, err := StagedOutKey(c, "hosts"); err != nil || key != "hosts" {
+		t.Errorf("A key saved after the staged data went active should be read: %s %v", key, err)
+	}
+
+	tc.put("testing/hosts/staged/activate_at", "soon")
+	if _, err := StagedOutKey(c, "hosts"); err == nil {
+		t.Error("An activate_at that isn't a time should be an error.")
+	}
+}
+
+func TestPromoteStaged(t *testing.T) {
+	PrefixLocation = "testing"
+	tc, c := newTestConsul(t)
+	past := time.Now().Add(-time.Hour).UTC()
+	tc.put("testing/hosts/data", "old")
+	tc.put("testing/hosts/checksum", ComputeChecksum("old"))
+	tc.put("testing/hosts/updated", past.Add(-time.Hour).Format(time.RFC3339))
+	tc.put("testing/hosts/staged/data", exampleData)
+	tc.put("testing/hosts/staged/checksum", exampleDataSHA)
+	tc.put("testing/hosts/staged/encoding", EncodingNone)
+	tc.put("testing/hosts/staged/signature", "signed")
+	tc.put("testing/hosts/staged/activate_at", time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	if promoted, err := PromoteStaged(c, "hosts"); err != nil || promoted {
+		t.Errorf("Staged data that isn't active yet shouldn't be promoted: %t %v", promoted, err)
+	}
+
+	tc.put("testing/hosts/staged/activate_at", past.Format(time.RFC3339))
+	if promoted, err := PromoteStaged(c, "hosts"); err != nil || !promoted {
+		t.Fatalf("Active staged data should be promoted: %t %v", promoted, err)
+	}
+	if data, _ := tc.value("testing/hosts/data"); data != exampleData {
+		t.Errorf("The key should have the staged data: %q", data)
+	}
+	if signature, _ := tc.value("testing/hosts/signature"); signature != "signed" {
+		t.Errorf("The staged signature should go with it: %q", signature)
+	}
+	// Staging the next version now leaves every host on the promoted data.
+	tc.put("testing/hosts/staged/activate_at", time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	if key, err := StagedOutKey(c, "hosts"); err != nil || key != "hosts" {
+		t.Errorf("The promoted key should be read: %s %v", key, err)
+	}
+	if promoted, _ := PromoteStaged(c, "hosts"); promoted {
+		t.Error("The staged data was already promoted.")
+	}
+}
+
+func TestPromoteStagedEncrypted(t *testing.T) {
+	PrefixLocation = "testing"
+	testEncryptKey(t)
+	tc, c := newTestConsul(t)
+	stored, err := EncodeData("hosts/staged", exampleData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.put("testing/hosts/staged/data", stored)
+	tc.put("testing/hosts/staged/checksum", exampleDataSHA)
+	tc.put("testing/hosts/staged/encoding", StoredEncoding())
+	tc.put("testing/hosts/staged/activate_at", time.Now().Add(-time.Hour).UTC().Format(time.RFC3339))
+	if promoted, err := PromoteStaged(c, "hosts"); err != nil || !promoted {
+		t.Fatalf("Encrypted staged data should be promoted: %t %v", promoted, err)
+	}
+	// It's encrypted for the key, so it's moved as it is.
+	data, _ := tc.value("testing/hosts/data")
+	if decoded, err := DecodeData(c, "hosts", data); err != nil || decoded != exampleData {
+		t.Errorf("The promoted data should decrypt in the key: %q %v", decoded, err)
+	}
+}
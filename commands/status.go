@@ -0,0 +1,193 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/DataDog/kvexpress/pkg/kvexpress"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"time"
+)
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show who last changed a key and what's in it.",
+	Long:  `Status prints the meta key that in and copy save with the data - the host, user, version and source of the last change - along with the size and checksum of the data.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		checkStatusFlags()
+		AutoEnable()
+	},
+	Run: statusRun,
+}
+
+func statusRun(cmd *cobra.Command, args []string) {
+	start := time.Now()
+	c, err := Connect(ConsulServer, Token)
+	if err != nil {
+		LogFatal("Could not connect to Consul.", KeyStatusLocation, "consul_connect")
+	}
+	status, err := GetStatus(c, KeyStatusLocation)
+	ExitOnError(err, KeyStatusLocation, "status")
+	if status.Size == 0 && status.Checksum == "" {
+		fmt.Printf("There's no data in '%s'.\n", KeyStatusLocation)
+		exitRun(1, start, KeyStatusLocation, "no_data", "")
+	}
+	fmt.Printf("key:      %s\n", strings.TrimSuffix(KeyRoot(KeyStatusLocation), "/"))
+	fmt.Printf("checksum: %s %s\n", status.Checksum, verifyLabel(status.ChecksumMatches))
+	fmt.Printf("size:     %d bytes - %d stored as %s\n", status.Size, status.StoredSize, status.Encoding)
+	fmt.Printf("updated:  %s\n", status.Updated)
+	if status.Meta != nil {
+		fmt.Printf("host:     %s\nuser:     %s\nversion:  %s\nsource:   %s\nrun_id:   %s\n", status.Meta.Host, status.Meta.User, status.Meta.Version, status.Meta.Source, status.Meta.RunID)
+	}
+	if status.Lock != "" {
+		fmt.Printf("lock:     %s\n", status.Lock)
+	}
+	if status.Stop != "" {
+		fmt.Printf("stop:     %s\n", status.Stop)
+	}
+	if status.Traffic != nil {
+		fmt.Printf("traffic:  %d bytes read and %d written by %d runs on this host since %s\n", status.Traffic.Read, status.Traffic.Written, status.Traffic.Runs, status.Traffic.Since)
+	}
+	Log(fmt.Sprintf("status key='%s' size='%d' checksum_matches='%t'", KeyStatusLocation, status.Size, status.ChecksumMatches), "info")
+	RecordResult(status.Size, status.Checksum)
+	RecordDetails(status)
+	PrintResult(KeyStatusLocation, "status", time.Since(start), "")
+}
+
+// KeyMeta is saved in the meta key every time the data is changed - the
+// library's Save saves it too.
+type KeyMeta = kvexpress.Meta
+
+// SaveMeta records who changed the data for key and where it came from.
+func SaveMeta(c *consul.Client, key, source string) error {
+	return Set(c, KeyPath(key, "meta"), metaValue(source))
+}
+
+// metaOp saves the meta key in the same transaction as the data.
+func metaOp(key, source string) *consul.TxnOp {
+	return setOp(KeyPath(key, "meta"), metaValue(source))
+}
+
+// metaValue is the meta key for a change from source made by this run. Anyone
+// who can read the key can see it, so the source is redacted like a log line.
+func metaValue(source string) string {
+	meta := KeyMeta{
+		Host:    GetHostname(),
+		User:    GetCurrentUsername(),
+		Version: Version,
+		Source:  Redact(source),
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		RunID:   RunID,
+	}
+	encoded, _ := json.Marshal(meta)
+	return string(encoded)
+}
+
+// saveMeta is SaveMeta for the commands - the data is already saved so a meta
+// key that isn't saved is only logged.
+func saveMeta(c *consul.Client, key, source string) {
+	if err := SaveMeta(c, key, source); err != nil {
+		Log(fmt.Sprintf("meta key='%s' saved='false' message='%v'", key, err), "info")
+	}
+}
+
+// GetMeta returns the meta key for key - or nil if there isn't one.
+func GetMeta(c *consul.Client, key string) (*KeyMeta, error) {
+	value, err := Get(c, KeyPath(key, "meta"))
+	if err != nil || value == "" {
+		return nil, err
+	}
+	var meta KeyMeta
+	if err := json.Unmarshal([]byte(value), &meta); err != nil {
+		return nil, fmt.Errorf("could not parse the meta for '%s': %v", key, err)
+	}
+	return &meta, nil
+}
+
+// KeyStatus is everything status shows about a key.
+type KeyStatus struct {
+	Checksum        string   `json:"checksum"`
+	ChecksumMatches bool     `json:"checksum_matches"`
+	Size            int      `json:"size"`
+	StoredSize      int      `json:"stored_size"`
+	Encoding        string   `json:"encoding"`
+	Updated         string   `json:"updated"`
+	Lock            string   `json:"lock,omitempty"`
+	Stop            string   `json:"stop,omitempty"`
+	Meta            *KeyMeta `json:"meta,omitempty"`
+
+	// Traffic is what the runs for the key on this host have moved.
+	Traffic *KeyTraffic `json:"traffic,omitempty"`
+}
+
+// GetStatus reads the data, checksum, meta and locks for key.
+func GetStatus(c *consul.Client, key string) (KeyStatus, error) {
+	var status KeyStatus
+	stored, err := GetData(c, key)
+	if err != nil {
+		return status, err
+	}
+	data, err := DecodeData(c, key, stored)
+	if err != nil {
+		return status, err
+	}
+	status.Size, status.StoredSize = len(data), len(stored)
+	if status.Encoding, err = Get(c, KeyPath(key, "encoding")); err != nil {
+		return status, err
+	}
+	if status.Encoding == "" {
+		status.Encoding = "none"
+	}
+	checksum, err := GetChecksum(c, key)
+	if err != nil {
+		return status, err
+	}
+	status.Checksum = strings.TrimSpace(checksum)
+	status.ChecksumMatches = status.Checksum != "" && ChecksumCompare(data, status.Checksum)
+	if status.Updated, err = Get(c, KeyPath(key, "updated")); err != nil {
+		return status, err
+	}
+	// CheckGlobalLock would remove an expired lock - status only looks.
+	lock, err := Get(c, KeyPath(key, "lock"))
+	if err != nil {
+		return status, err
+	}
+	if reason, expires := ParseLock(lock); !expires.IsZero() {
+		status.Lock = fmt.Sprintf("%s - expires %s", reason, expires.Format(time.RFC3339))
+	} else {
+		status.Lock = reason
+	}
+	if status.Stop, err = Get(c, KeyPath(key, "stop")); err != nil {
+		return status, err
+	}
+	if status.Meta, err = GetMeta(c, key); err != nil {
+		return status, err
+	}
+	if traffic, err := GetTraffic(key); err == nil && traffic.Runs > 0 {
+		status.Traffic = &traffic
+	}
+	return status, nil
+}
+
+func checkStatusFlags() {
+	Log("Checking cli flags.", "debug")
+	if KeyStatusLocation == "" {
+		fmt.Println("Need a key location in -k")
+		os.Exit(1)
+	}
+	Log("Required cli flags present.", "debug")
+}
+
+var (
+	// KeyStatusLocation is the key to show the status of.
+	KeyStatusLocation string
+)
+
+func init() {
+	RootCmd.AddCommand(statusCmd)
+	statusCmd.Flags().StringVarP(&KeyStatusLocation, "key", "k", "", "key to show the status of")
+}
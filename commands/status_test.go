@@ -0,0 +1,33 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"testing"
+)
+
+func TestGetStatus(t *testing.T) {
+	ensureTestFile(t)
+	tc, c := newTestConsul(t)
+	tc.put("testing/status/data", exampleData)
+	tc.put("testing/status/checksum", exampleDataSHA)
+	tc.put("testing/status/lock", LockValue("Fixing it by hand.", 0))
+
+	status, err := GetStatus(c, "status")
+	if err != nil || !status.ChecksumMatches || status.Size != len(exampleData) || status.Meta != nil {
+		t.Errorf("The status should be read without a meta key: %+v %v", status, err)
+	}
+	if status.Lock != "Fixing it by hand." || status.Encoding != "none" {
+		t.Errorf("The lock and encoding should be shown: %+v", status)
+	}
+
+	RunID = "status-test"
+	defer func() { RunID = "" }()
+	if err := SaveMeta(c, "status", "file:/etc/hosts"); err != nil {
+		t.Fatalf("The meta key should be saved: %v", err)
+	}
+	status, err = GetStatus(c, "status")
+	if err != nil || status.Meta == nil || status.Meta.Source != "file:/etc/hosts" || status.Meta.Host != GetHostname() || status.Meta.RunID != "status-test" {
+		t.Errorf("The meta key should be part of the status: %+v %v", status.Meta, err)
+	}
+}
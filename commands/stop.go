@@ -1,4 +1,4 @@
-// +build linux darwin freebsd
+// +build linux darwin freebsd windows
 
 package commands
 
@@ -36,19 +36,18 @@ func stopRun(cmd *cobra.Command, args []string) {
 		dog = DDAPIConnect(DatadogAPIKey, DatadogAPPKey)
 	}
 
-	saved := Set(c, KeyStop, KeyStopReason)
-
-	if saved {
-		Log(fmt.Sprintf("KeyStop='%s' saved='true' KeyStopReason='%s'", KeyStop, KeyStopReason), "info")
-		if DatadogAPIKey != "" && DatadogAPPKey != "" {
-			DDSaveStopEvent(dog, KeyStop, KeyStopReason)
-		}
+	ExitOnError(Set(c, KeyStop, KeyStopReason), KeyStop, "consul_set")
+	Log(fmt.Sprintf("KeyStop='%s' saved='true' KeyStopReason='%s'", KeyStop, KeyStopReason), "info")
+	if DatadogAPIKey != "" && DatadogAPPKey != "" {
+		DDSaveStopEvent(dog, KeyStop, KeyStopReason)
 	}
 
 	// Run this command after the key is stopped.
 	if PostExec != "" {
 		Log(fmt.Sprintf("exec='%s'", PostExec), "debug")
-		RunCommand(PostExec)
+		if status := RunPostExec(PostExec); status != 0 {
+			exitExecFailed(status, KeyStopLocation)
+		}
 	}
 	RunTime(start, KeyStopLocation, "complete")
 }
@@ -0,0 +1,513 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// OutParallel is how many keys out --recurse writes at once.
+	OutParallel int
+
+	// Recurse mirrors a tree of keys into RecurseDir with out - or a directory
+	// into a tree of keys with in.
+	Recurse bool
+
+	// RecurseDir is the directory --recurse mirrors to or from.
+	RecurseDir string
+
+	// MaxRemoveRatio stops SyncDir when more than this fraction of the files
+	// it wrote would be removed - 0 is off.
+	MaxRemoveRatio float64
+)
+
+// ErrTooManyRemoved is returned by SyncDir instead of removing most of the
+// files it manages - an empty or half empty tree is more likely a mistake
+// than a decision.
+var ErrTooManyRemoved = errors.New("too many of the managed files would be removed")
+
+// managedFile lists the files SyncDir wrote into a directory - only those are
+// ever removed, so files that were already there are left alone.
+const managedFile = ".kvexpress-managed"
+
+// SyncSummary counts what SyncDir did with each key.
+type SyncSummary struct {
+	Written   int
+	Unchanged int
+	Removed   int
+	Skipped   int
+}
+
+// Changed is true if any file was written or removed.
+func (s SyncSummary) Changed() bool {
+	return s.Written > 0 || s.Removed > 0
+}
+
+// reservedSubkeys are the keys kvexpress keeps underneath a key - its saved
+// versions and canary and staged data. What each host has applied, written
+// or appended is kept in <prefix>/_<kind>/ now, but an older kvexpress saved
+// it underneath the key. They aren't keys of their own.
+var reservedSubkeys = []string{"history", "canary", "staged", "applied", "parts", "written"}
+
+// reservedName is true when name is or is underneath one of the
+// reservedSubkeys of a key.
+func reservedName(name string) bool {
+	for _, sub := range reservedSubkeys {
+		if strings.Contains("/"+name+"/", "/"+sub+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// TreeKeys returns every kvexpress key underneath key - the names are relative
+// to key. The reservedSubkeys - history, canaries, staged data and the rest -
+// aren't included.
+func TreeKeys(c *consul.Client, key string) ([]string, error) {
+	// Chunked data has a manifest instead of a single data key.
+	layout := keyLayout(key, "data", "manifest")
+	keys, err := Keys(c, keyRoot(layout))
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, k := range keys {
+		name, ok := keyName(layout, k)
+		if !ok || seen[name] || reservedName(name) {
+			continue
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// SyncDir mirrors every kvexpress key underneath key into dir - each one is
+// written to the file with the same relative name. Keys that are locked or
+// don't pass the length, checksum and signature checks are skipped and their
+// files are left as they are. Files that SyncDir wrote before but whose keys
+// are gone are removed - unless every one of them or more than
+// MaxRemoveRatio would be, and then nothing is written or removed.
+func SyncDir(c *consul.Client, key, dir string) (SyncSummary, error) {
+	var summary SyncSummary
+	names, err := TreeKeys(c, key)
+	if err != nil {
+		return summary, err
+	}
+	managed := readManaged(dir)
+	wasManaged := make(map[string]bool)
+	for _, name := range managed {
+		wasManaged[name] = true
+	}
+	keep := make(map[string]bool)
+	for _, name := range names {
+		keep[name] = true
+	}
+	removing := 0
+	for _, name := range managed {
+		if !keep[name] {
+			removing++
+		}
+	}
+	if removing > 0 && (len(names) == 0 || (MaxRemoveRatio > 0 && float64(removing)/float64(len(managed)) > MaxRemoveRatio)) {
+		Log(fmt.Sprintf("sync key='%s' dir='%s' keys='%d' managed='%d' removing='%d' max_remove_ratio='%.3f' - stopping.", key, dir, len(names), len(managed), removing, MaxRemoveRatio), "info")
+		return summary, fmt.Errorf("%w - %d of %d with %d keys under '%s'", ErrTooManyRemoved, removing, len(managed), len(names), key)
+	}
+	// The keys are written by --parallel workers that share the client - the
+	// results are counted in order once they're all done.
+	results := make([]syncResult, len(names))
+	var giveUp int32
+	syncEach(len(names), OutParallel, func(i int) {
+		// Once Consul is gone the rest of the keys would only retry too.
+		if atomic.LoadInt32(&giveUp) == 1 {
+			results[i].err = ErrNoMoreRetries
+			return
+		}
+		full := strings.TrimSuffix(key, "/") + "/" + names[i]
+		file := filepath.Join(dir, filepath.FromSlash(names[i]))
+		// A key can't write outside of the directory.
+		if !strings.HasPrefix(file, filepath.Clean(dir)+string(filepath.Separator)) {
+			Log(fmt.Sprintf("sync key='%s' file='%s' outside='true' - skipping.", full, file), "info")
+			results[i].outside = true
+			return
+		}
+		results[i].written, results[i].err = syncKey(c, full, file)
+		if errors.Is(results[i].err, ErrNoMoreRetries) {
+			atomic.StoreInt32(&giveUp, 1)
+		}
+	})
+	var current []string
+	for i, name := range names {
+		full := strings.TrimSuffix(key, "/") + "/" + name
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if results[i].outside {
+			summary.Skipped++
+			continue
+		}
+		written, err := results[i].written, results[i].err
+		if errors.Is(err, ErrNoMoreRetries) {
+			return summary, err
+		}
+		switch {
+		case err != nil:
+			Log(fmt.Sprintf("sync key='%s' file='%s' message='%v' - skipping.", full, file, err), "info")
+			summary.Skipped++
+			// A file that was never written isn't ours to remove later.
+			if !wasManaged[name] {
+				continue
+			}
+		case written:
+			summary.Written++
+		default:
+			summary.Unchanged++
+		}
+		current = append(current, name)
+	}
+
+	for _, name := range managed {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if keep[name] || !strings.HasPrefix(file, filepath.Clean(dir)+string(filepath.Separator)) {
+			continue
+		}
+		if !DryRunSkip(fmt.Sprintf("remove '%s'", file)) {
+			oldChecksum, oldSize := auditState(file)
+			if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+				return summary, err
+			}
+			Audit(AuditRecord{Event: AuditRemove, Key: strings.TrimSuffix(key, "/") + "/" + name, File: file, OldChecksum: oldChecksum, ByteDelta: -oldSize})
+		}
+		Log(fmt.Sprintf("sync file='%s' removed='true'", file), "info")
+		summary.Removed++
+	}
+	if !DryRunSkip(fmt.Sprintf("write '%s'", filepath.Join(dir, managedFile))) {
+		if err := writeManaged(dir, current); err != nil {
+			return summary, err
+		}
+	}
+	return summary, nil
+}
+
+// syncResult is what happened to a single key in SyncDir.
+type syncResult struct {
+	written bool
+	outside bool
+	err     error
+}
+
+// syncEach calls run for 0 to n-1 with a pool of workers.
+func syncEach(n, workers int, run func(i int)) {
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				run(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// PushDir saves every file in dir to the kvexpress key underneath key with the
+// same relative name and removes the keys whose files are gone. All of the
+// files are read and checked before anything is saved so a bad file changes
+// nothing. Hidden files and directories are left out.
+func PushDir(c *consul.Client, key, dir string) (SyncSummary, error) {
+	var summary SyncSummary
+	files, err := LocalFiles(dir)
+	if err != nil {
+		return summary, err
+	}
+	// An empty directory would remove every key.
+	if len(files) == 0 {
+		return summary, fmt.Errorf("there are no files in '%s'", dir)
+	}
+	data := make(map[string]string)
+	for _, name := range files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		content, err := normalizeInData(ReadFile(file))
+		if err != nil {
+			return summary, fmt.Errorf("'%s': %w", file, err)
+		}
+		content = sortInLines(filterInLines(content))
+		minLength, maxLength := lineLimits(false)
+		if !LengthCheck(content, minLength) {
+			return summary, fmt.Errorf("'%s' is not long enough", file)
+		}
+		if err := SizeCheck(content, maxLength, MaxFileBytes); err != nil {
+			StatsdTooLarge(key)
+			return summary, fmt.Errorf("'%s' is %v", file, err)
+		}
+		if ValidateType != "" {
+			if err := ValidateContent(content, ValidateType); err != nil {
+				StatsdValidateFailed(key)
+				return summary, fmt.Errorf("'%s' is not valid: %v", file, err)
+			}
+		}
+		if ValidateExec != "" {
+			if err := ValidateFile(ValidateExec, file); err != nil {
+				StatsdValidateFailed(key)
+				return summary, fmt.Errorf("'%s' is not valid: %v", file, err)
+			}
+		}
+		data[name] = content
+	}
+	existing, err := TreeKeys(c, key)
+	if err != nil {
+		return summary, err
+	}
+
+	for _, name := range files {
+		full := strings.TrimSuffix(key, "/") + "/" + name
+		saved, err := pushKey(c, full, data[name], "file:"+filepath.Join(dir, filepath.FromSlash(name)), Binary)
+		if err != nil {
+			return summary, err
+		}
+		if saved {
+			summary.Written++
+		} else {
+			summary.Unchanged++
+		}
+	}
+	for _, name := range existing {
+		if _, ok := data[name]; ok {
+			continue
+		}
+		full := strings.TrimSuffix(key, "/") + "/" + name
+		if !DryRunSkip(fmt.Sprintf("remove '%s'", full)) {
+			if err := removeKey(c, full); err != nil {
+				return summary, err
+			}
+			Audit(AuditRecord{Event: AuditRemove, Key: full})
+		}
+		Log(fmt.Sprintf("sync key='%s' removed='true'", full), "info")
+		summary.Removed++
+	}
+	return summary, nil
+}
+
+// LocalFiles returns the relative names of the files underneath dir - without
+// the ones that TreeKeys wouldn't find again.
+func LocalFiles(dir string) ([]string, error) {
+	var names []string
+	err := filepath.Walk(dir, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if file != dir && strings.HasPrefix(info.Name(), ".") {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		name, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		// The key would be one of another key's reservedSubkeys.
+		if reservedName(filepath.ToSlash(name)) {
+			Log(fmt.Sprintf("sync file='%s' reserved='true' - skipping.", file), "info")
+			return nil
+		}
+		names = append(names, filepath.ToSlash(name))
+		return nil
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+// pushKey saves data to key the way in does if the checksum has changed.
+// source is saved in the meta key, and binary data is base64 encoded.
+func pushKey(c *consul.Client, key, data, source string, binary bool) (bool, error) {
+	checksum, checksums := StoreChecksum(data), StoreChecksums(data)
+	current, err := Get(c, KeyPath(key, "checksum"))
+	if err != nil {
+		return false, err
+	}
+	if strings.TrimSpace(current) == checksum {
+		return false, nil
+	}
+	var signature string
+	if signingKey != nil {
+		signature = SignKeyData(signingKey, key, checksum, data)
+	}
+	var extra []*consul.TxnOp
+	if Rolling {
+		extra = append(extra, setOp(KeyPath(key, "rolling"), RollingHash(data)))
+	}
+	if signingKey != nil {
+		extra = append(extra, setOp(KeyPath(key, "signature"), signature))
+	}
+	encoded, err := encodeData(key, data, binary)
+	if err != nil {
+		return false, err
+	}
+	encoding := storedEncoding(binary)
+	if DryRunSkip(fmt.Sprintf("save '%s' size='%d' checksum='%s'", KeyPath(key, "data"), len(encoded), checksum)) {
+		return true, nil
+	}
+	oldSize := auditKeyBytes(c, key)
+	atomic := singleTxn(len(encoded))
+	if atomic {
+		if saved, err := saveCAS(c, key, encoded, checksum, checksums, encoding, extra...); err != nil || !saved {
+			return false, err
+		}
+	} else {
+		if err := SetData(c, key, encoded); err != nil {
+			return false, err
+		}
+		if err := Set(c, KeyPath(key, "checksum"), checksum); err != nil {
+			return false, err
+		}
+		if err := SetChecksums(c, key, checksums); err != nil {
+			return false, err
+		}
+		if err := Set(c, KeyPath(key, "updated"), ReturnCurrentUTC()); err != nil {
+			return false, err
+		}
+		if err := Set(c, KeyPath(key, "encoding"), encoding); err != nil {
+			return false, err
+		}
+	}
+	Log(fmt.Sprintf("sync key='%s' saved='true' size='%d'", key, len(encoded)), "info")
+	Audit(AuditRecord{Event: AuditKey, Key: key, File: strings.TrimPrefix(source, "file:"), OldChecksum: strings.TrimSpace(current), NewChecksum: checksum, ByteDelta: len(encoded) - oldSize})
+	saveMeta(c, key, source)
+	if Rolling && !atomic {
+		if err := Set(c, KeyPath(key, "rolling"), RollingHash(data)); err != nil {
+			return false, err
+		}
+	}
+	if signingKey != nil && !atomic {
+		if err := Set(c, KeyPath(key, "signature"), signature); err != nil {
+			return false, err
+		}
+	}
+	if HistoryKeep > 0 {
+		if err := SaveHistory(c, key, encoded, checksum, signature, "", HistoryKeep); err != nil {
+			Log(fmt.Sprintf("history key='%s' saved='false' message='%v'", key, err), "info")
+		}
+	}
+	return true, nil
+}
+
+// keyParts are the parts of a key removeKey deletes - the data and what's
+// saved with it, and the key's own stop key, locks and sessions.
+var keyParts = append([]string{"activate_at", "stop", "lock", "leader", "owner", "version"}, canaryParts...)
+
+// removeKey deletes the data, checksum and the rest of a kvexpress key. Only
+// the paths of its own parts and data chunks are removed - with a
+// --key-template like {{.Prefix}}/{{.Key}}.{{.Part}} a key next to it can
+// start with the same path. Its history and any keys nested underneath it are
+// kept.
+func removeKey(c *consul.Client, key string) error {
+	parts := make(map[string]bool)
+	for _, part := range keyParts {
+		parts[strings.TrimPrefix(KeyPath(key, part), "/")] = true
+	}
+	chunks := strings.TrimPrefix(KeyPath(key, "data"), "/") + "/"
+	keys, err := Keys(c, KeyRoot(key))
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if !parts[k] && !(strings.HasPrefix(k, chunks) && len(k) > len(chunks)) {
+			continue
+		}
+		if err := Del(c, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncKey writes a single key to file if it's changed.
+func syncKey(c *consul.Client, key, file string) (bool, error) {
+	if err := CheckAllowedDir(file); err != nil {
+		return false, err
+	}
+	if lock, err := CheckGlobalLock(c, key); err != nil || lock != "" {
+		return false, lockError(err, lock)
+	}
+	if lock, err := CheckLock(c, file); err != nil || lock != "" {
+		return false, lockError(err, lock)
+	}
+	data, err := GetVerifiedData(c, key)
+	if err != nil {
+		return false, err
+	}
+	if ValidateType != "" {
+		if err := ValidateContent(data, ValidateType); err != nil {
+			StatsdValidateFailed(key)
+			return false, err
+		}
+	}
+	matches, err := FileChecksumMatches(file, ComputeChecksum(data))
+	if err != nil || matches {
+		return false, err
+	}
+	if DryRunSkip(fmt.Sprintf("write %d bytes to '%s'", len(data), file)) {
+		return true, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return false, err
+	}
+	if err := backupTarget(file); err != nil {
+		return false, err
+	}
+	oldChecksum, oldSize := auditState(file)
+	err = WriteCheckedFile(data, file, FilePermissions, Owner, CheckExec)
+	AuditFileWrite(key, file, oldChecksum, oldSize, data, err)
+	return true, err
+}
+
+// lockError is the reason a locked key is skipped.
+func lockError(err error, lock string) error {
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("locked - %s", lock)
+}
+
+// readManaged returns the files listed in dir's managed file.
+func readManaged(dir string) []string {
+	var names []string
+	for _, line := range strings.Split(ReadFile(filepath.Join(dir, managedFile)), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			names = append(names, line)
+		}
+	}
+	return names
+}
+
+// writeManaged saves the list of files SyncDir manages in dir.
+func writeManaged(dir string, names []string) error {
+	data := strings.Join(names, "\n")
+	if data != "" {
+		data += "\n"
+	}
+	return ioutil.WriteFile(filepath.Join(dir, managedFile), []byte(data), 0640)
+}
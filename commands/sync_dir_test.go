@@ -0,0 +1,157 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSyncDir(t *testing.T) {
+	dir := filepath.Dir(ensureTestFile(t))
+	tc, c := newTestConsul(t)
+	tc.put("testing/conf.d/a.conf/data", exampleData)
+	tc.put("testing/conf.d/a.conf/checksum", exampleDataSHA)
+	tc.put("testing/conf.d/a.conf/history/20260101T000000.000Z/data", "old")
+	tc.put("testing/conf.d/a.conf/canary/data", "canary")
+	tc.put("testing/conf.d/a.conf/staged/data", "staged")
+	tc.put("testing/conf.d/a.conf/parts/web1/data", "part")
+	tc.put("testing/conf.d/nested/b.conf/data", exampleData)
+	tc.put("testing/conf.d/nested/b.conf/checksum", exampleDataSHA)
+	tc.put("testing/conf.d/bad.conf/data", exampleData)
+	tc.put("testing/conf.d/bad.conf/checksum", "not-the-checksum")
+	ioutil.WriteFile(filepath.Join(dir, "local.conf"), []byte("not managed"), 0640)
+
+	summary, err := SyncDir(c, "conf.d", dir)
+	if err != nil || summary != (SyncSummary{Written: 2, Skipped: 1}) {
+		t.Fatalf("Both good keys should be written: %+v %v", summary, err)
+	}
+	if data := ReadFile(filepath.Join(dir, "nested", "b.conf")); data != exampleData {
+		t.Errorf("A nested key should be written to a nested file: %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bad.conf")); err == nil {
+		t.Error("A key that doesn't match its checksum should not be written.")
+	}
+
+	if summary, _ := SyncDir(c, "conf.d", dir); summary.Changed() || summary.Unchanged != 2 {
+		t.Errorf("Nothing changed the second time: %+v", summary)
+	}
+
+	Del(c, "testing/conf.d/nested/b.conf/data")
+	Del(c, "testing/conf.d/bad.conf/data")
+	summary, err = SyncDir(c, "conf.d", dir)
+	if err != nil || summary.Removed != 1 {
+		t.Errorf("The file for the deleted key should be removed: %+v %v", summary, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "nested", "b.conf")); err == nil {
+		t.Error("The file for the deleted key is still there.")
+	}
+	if data := ReadFile(filepath.Join(dir, "local.conf")); data != "not managed" {
+		t.Error("A file that wasn't written by kvexpress should never be removed.")
+	}
+
+	// An empty tree doesn't remove every file.
+	Del(c, "testing/conf.d/a.conf/data")
+	if _, err := SyncDir(c, "conf.d", dir); !errors.Is(err, ErrTooManyRemoved) {
+		t.Errorf("An empty tree should stop the sync: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.conf")); err != nil {
+		t.Error("The files should be left alone when the tree is empty.")
+	}
+}
+
+func TestSyncDirMaxRemoveRatio(t *testing.T) {
+	dir := filepath.Dir(ensureTestFile(t))
+	tc, c := newTestConsul(t)
+	for _, name := range []string{"a", "b", "c", "d"} {
+		tc.put("testing/ratio/"+name+".conf/data", exampleData)
+		tc.put("testing/ratio/"+name+".conf/checksum", exampleDataSHA)
+	}
+	if _, err := SyncDir(c, "ratio", dir); err != nil {
+		t.Fatal(err)
+	}
+	MaxRemoveRatio = 0.5
+	defer func() { MaxRemoveRatio = 0.5 }()
+	for _, name := range []string{"a", "b", "c"} {
+		Del(c, "testing/ratio/"+name+".conf/data")
+	}
+	if _, err := SyncDir(c, "ratio", dir); !errors.Is(err, ErrTooManyRemoved) {
+		t.Errorf("Removing 3 of 4 files should be more than --max-remove-ratio 0.5: %v", err)
+	}
+	MaxRemoveRatio = 0
+	if summary, err := SyncDir(c, "ratio", dir); err != nil || summary.Removed != 3 {
+		t.Errorf("--max-remove-ratio 0 is off: %+v %v", summary, err)
+	}
+}
+
+func TestSyncDirParallel(t *testing.T) {
+	dir := filepath.Dir(ensureTestFile(t))
+	tc, c := newTestConsul(t)
+	for i := 0; i < 20; i++ {
+		tc.put(fmt.Sprintf("testing/parallel/%02d.conf/data", i), exampleData)
+		tc.put(fmt.Sprintf("testing/parallel/%02d.conf/checksum", i), exampleDataSHA)
+	}
+	OutParallel = 4
+	defer func() { OutParallel = 1 }()
+
+	summary, err := SyncDir(c, "parallel", dir)
+	if err != nil || summary != (SyncSummary{Written: 20}) {
+		t.Fatalf("Every key should be written: %+v %v", summary, err)
+	}
+	managed := readManaged(dir)
+	if len(managed) != 20 || managed[0] != "00.conf" || managed[19] != "19.conf" {
+		t.Errorf("The managed files should be in order: %v", managed)
+	}
+	if summary, _ := SyncDir(c, "parallel", dir); summary.Unchanged != 20 {
+		t.Errorf("Nothing changed the second time: %+v", summary)
+	}
+}
+
+func TestPushDir(t *testing.T) {
+	dir := filepath.Dir(ensureTestFile(t))
+	tc, c := newTestConsul(t)
+	value := func(key string) string {
+		v, _ := tc.value(key)
+		return v
+	}
+	os.MkdirAll(filepath.Join(dir, "nested"), 0755)
+	os.MkdirAll(filepath.Join(dir, ".git"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "a.conf"), []byte(exampleData), 0640)
+	ioutil.WriteFile(filepath.Join(dir, "nested", "b.conf"), []byte(exampleData), 0640)
+	ioutil.WriteFile(filepath.Join(dir, ".git", "HEAD"), []byte("ref: refs/heads/main"), 0640)
+	tc.put("testing/conf.d/gone.conf/data", exampleData)
+	tc.put("testing/conf.d/gone.conf/checksum", exampleDataSHA)
+	tc.put("testing/conf.d/nested/data", exampleData)
+	tc.put("testing/conf.d/nested/checksum", exampleDataSHA)
+
+	summary, err := PushDir(c, "conf.d", dir)
+	if err != nil || summary != (SyncSummary{Written: 2, Removed: 2}) {
+		t.Fatalf("Both files should be saved and the missing ones removed: %+v %v", summary, err)
+	}
+	if value("testing/conf.d/nested/b.conf/checksum") != exampleDataSHA {
+		t.Error("A nested file should be saved to a nested key.")
+	}
+	if value("testing/conf.d/nested/checksum") != "" || value("testing/conf.d/nested/b.conf/data") == "" {
+		t.Error("Removing a key shouldn't remove the keys nested underneath it.")
+	}
+	if value("testing/conf.d/.git/HEAD/data") != "" {
+		t.Error("Hidden directories should be left out.")
+	}
+
+	if summary, _ := PushDir(c, "conf.d", dir); summary.Changed() || summary.Unchanged != 2 {
+		t.Errorf("Nothing changed the second time: %+v", summary)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "a.conf"), []byte("# changed\n"+exampleData), 0640)
+	ioutil.WriteFile(filepath.Join(dir, "nested", "b.conf"), []byte("short"), 0640)
+	if _, err := PushDir(c, "conf.d", dir); err == nil {
+		t.Error("A file that is too short should be an error.")
+	}
+	if value("testing/conf.d/a.conf/checksum") != exampleDataSHA {
+		t.Error("Nothing should be saved if any file is bad.")
+	}
+}
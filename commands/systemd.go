@@ -0,0 +1,56 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// SdNotify sends state - like READY=1 - to systemd when kvexpress runs as a
+// Type=notify service. It returns false without an error if there's no
+// NOTIFY_SOCKET.
+func SdNotify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	// An abstract socket starts with @.
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	Log(fmt.Sprintf("function='SdNotify' state='%s'", state), "debug")
+	return true, nil
+}
+
+// WatchdogInterval is how often systemd expects WATCHDOG=1 with WatchdogSec -
+// 0 if the watchdog isn't on for this process.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// sdNotify logs a notification that couldn't be sent - systemd will restart
+// or time out the service on its own.
+func sdNotify(state string) {
+	if _, err := SdNotify(state); err != nil {
+		Log(fmt.Sprintf("function='SdNotify' state='%s' message='%v'", state, err), "info")
+	}
+}
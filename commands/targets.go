@@ -0,0 +1,237 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/smallfish/simpleyaml"
+	"strings"
+	"sync"
+)
+
+// Target is a Consul cluster that in writes to with --target or the targets
+// section of the config.
+type Target struct {
+	Name   string `json:"name"`
+	Server string `json:"server"`
+	Token  string `json:"-"`
+}
+
+// TargetResult is what happened on a single target.
+type TargetResult struct {
+	Name   string `json:"name"`
+	Server string `json:"server"`
+	Action string `json:"action"`
+	Error  string `json:"error,omitempty"`
+}
+
+// The actions in a TargetResult.
+const (
+	TargetSaved     = "saved"
+	TargetUnchanged = "unchanged"
+	TargetFailed    = "failed"
+)
+
+var (
+	// InTargets are the --target flags - name=server or a server.
+	InTargets []string
+
+	// configTargets is the targets section of the config file.
+	configTargets []Target
+)
+
+// ParseTargets reads the --target flags - the targets in the config are
+// used when there aren't any. A target without a token uses --token.
+func ParseTargets(flags []string, config []Target) ([]Target, error) {
+	targets := config
+	if len(flags) > 0 {
+		targets = nil
+		for _, flag := range flags {
+			name, server := flag, flag
+			if i := strings.Index(flag, "="); i >= 0 {
+				name, server = flag[:i], flag[i+1:]
+			}
+			targets = append(targets, Target{Name: name, Server: server})
+		}
+	}
+	seen := make(map[string]bool)
+	for i, target := range targets {
+		if target.Server == "" || target.Name == "" {
+			return nil, fmt.Errorf("target '%s' needs a name and a server", target.Name)
+		}
+		if _, err := ConsulServers(target.Server); err != nil {
+			return nil, fmt.Errorf("target '%s': %v", target.Name, err)
+		}
+		if seen[target.Name] {
+			return nil, fmt.Errorf("target '%s' is listed twice", target.Name)
+		}
+		seen[target.Name] = true
+		if target.Token == "" {
+			targets[i].Token = Token
+		}
+	}
+	return targets, nil
+}
+
+// loadConfigTargets reads the targets section of the config - a list of
+// servers or of name, server and token.
+func loadConfigTargets(config *simpleyaml.Yaml) {
+	section := config.Get("targets")
+	if !section.IsFound() {
+		return
+	}
+	size, err := section.GetArraySize()
+	if err != nil {
+		Log("config: key='targets' message='not a list'", "info")
+		return
+	}
+	configTargets = nil
+	for i := 0; i < size; i++ {
+		entry := section.GetIndex(i)
+		if server, err := entry.String(); err == nil {
+			configTargets = append(configTargets, Target{Name: server, Server: server})
+			continue
+		}
+		target := Target{
+			Name:   GetStringConfig(entry, "name"),
+			Server: GetStringConfig(entry, "server"),
+			Token:  GetStringConfig(entry, "token"),
+		}
+		if target.Name == "" {
+			target.Name = target.Server
+		}
+		configTargets = append(configTargets, target)
+	}
+	Log(fmt.Sprintf("config: key='targets' targets='%d'", len(configTargets)), "debug")
+}
+
+// errTargetStopped is a target with a stop key.
+var errTargetStopped = errors.New("the stop key is present")
+
+// targetClient is a target that's been checked before anything is written.
+type targetClient struct {
+	Target
+	client   *consul.Client
+	checksum string
+}
+
+// PrepareTargets connects to every target and reads its checksum for key.
+// Nothing should be written unless every target answered - so it's an error
+// if any of them didn't - or errTargetStopped if one of them has a stop key.
+func PrepareTargets(targets []Target, key string) ([]targetClient, []TargetResult, error) {
+	clients := make([]targetClient, len(targets))
+	results := make([]TargetResult, len(targets))
+	var failed []string
+	stopped := false
+	for i, target := range targets {
+		clients[i].Target = target
+		results[i] = TargetResult{Name: target.Name, Server: target.Server}
+		err := clients[i].prepare(key)
+		if err != nil {
+			results[i].Action, results[i].Error = TargetFailed, err.Error()
+			failed = append(failed, target.Name)
+			stopped = stopped || errors.Is(err, errTargetStopped)
+			Log(fmt.Sprintf("target='%s' server='%s' prepared='false' message='%v'", target.Name, target.Server, err), "info")
+		}
+	}
+	if stopped {
+		return nil, results, fmt.Errorf("%w on %s", errTargetStopped, strings.Join(failed, ", "))
+	}
+	if len(failed) > 0 {
+		return nil, results, fmt.Errorf("not writing to any target - %s failed", strings.Join(failed, ", "))
+	}
+	return clients, results, nil
+}
+
+func (t *targetClient) prepare(key string) error {
+	c, err := Connect(t.Server, t.Token)
+	if err != nil {
+		return err
+	}
+	stop, err := Get(c, KeyPath(key, "stop"))
+	if err != nil {
+		return err
+	}
+	if stop != "" {
+		return fmt.Errorf("%w: %s", errTargetStopped, stop)
+	}
+	t.client = c
+	t.checksum, err = Get(c, KeyPath(key, "checksum"))
+	return err
+}
+
+// SaveTargets saves the data, checksum and the other keys on every target
+// that doesn't have checksum yet - all at the same time so they're different
+// for as short a time as possible. Each target is saved in a single
+// transaction, but a target that fails doesn't undo the others. The error is
+// the targets that failed.
+func SaveTargets(clients []targetClient, key, data, checksum, checksums, rolling, signature string) ([]TargetResult, error) {
+	results := make([]TargetResult, len(clients))
+	var wg sync.WaitGroup
+	for i := range clients {
+		target := clients[i]
+		results[i] = TargetResult{Name: target.Name, Server: target.Server, Action: TargetUnchanged}
+		if strings.TrimSpace(target.checksum) == checksum {
+			continue
+		}
+		wg.Add(1)
+		go func(result *TargetResult) {
+			defer wg.Done()
+			saved, err := saveTarget(target.client, key, data, checksum, checksums, rolling, signature)
+			switch {
+			case err != nil:
+				result.Action, result.Error = TargetFailed, err.Error()
+			case saved:
+				result.Action = TargetSaved
+			}
+			Log(fmt.Sprintf("target='%s' server='%s' key='%s' action='%s' message='%s'", result.Name, result.Server, key, result.Action, result.Error), "info")
+		}(&results[i])
+	}
+	wg.Wait()
+	var failed []string
+	for _, result := range results {
+		if result.Action == TargetFailed {
+			failed = append(failed, result.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return results, fmt.Errorf("could not save to %s", strings.Join(failed, ", "))
+	}
+	return results, nil
+}
+
+// saveTarget saves the keys on one target - the same way in saves them on
+// --server. It's false when the checksum was already saved.
+func saveTarget(c *consul.Client, key, data, checksum, checksums, rolling, signature string) (bool, error) {
+	if singleTxn(len(data)) {
+		var extra []*consul.TxnOp
+		if Rolling {
+			extra = append(extra, setOp(KeyPath(key, "rolling"), rolling))
+		}
+		if signingKey != nil {
+			extra = append(extra, setOp(KeyPath(key, "signature"), signature))
+		}
+		return SaveCAS(c, key, data, checksum, checksums, extra...)
+	}
+	steps := []func() error{
+		func() error { return SetData(c, key, data) },
+		func() error { return Set(c, KeyPath(key, "checksum"), checksum) },
+		func() error { return SetChecksums(c, key, checksums) },
+		func() error { return Set(c, KeyPath(key, "updated"), ReturnCurrentUTC()) },
+		func() error { return SetEncoding(c, key) },
+	}
+	if Rolling {
+		steps = append(steps, func() error { return Set(c, KeyPath(key, "rolling"), rolling) })
+	}
+	if signingKey != nil {
+		steps = append(steps, func() error { return Set(c, KeyPath(key, "signature"), signature) })
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
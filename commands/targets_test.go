@@ -0,0 +1,81 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseTargets(t *testing.T) {
+	Token = "anonymous"
+	targets, err := ParseTargets([]string{"east=consul-east:8500", "consul-west:8500,consul-west-2:8500"}, nil)
+	if err != nil || len(targets) != 2 {
+		t.Fatalf("The targets should be parsed: %v %v", targets, err)
+	}
+	if targets[0].Name != "east" || targets[0].Server != "consul-east:8500" || targets[0].Token != "anonymous" {
+		t.Errorf("A name=server target wasn't read: %+v", targets[0])
+	}
+	if targets[1].Name != targets[1].Server {
+		t.Errorf("A target without a name should be named after its server: %+v", targets[1])
+	}
+	if _, err := ParseTargets([]string{"east=a:8500", "east=b:8500"}, nil); err == nil {
+		t.Error("A target can't be listed twice.")
+	}
+
+	config := ParseConfig([]byte("targets:\n  - consul-east:8500\n  - name: west\n    server: consul-west:8500\n    token: west-token\n"))
+	loadConfigTargets(config)
+	defer func() { configTargets = nil }()
+	targets, err = ParseTargets(nil, configTargets)
+	if err != nil || len(targets) != 2 || targets[1].Name != "west" || targets[1].Token != "west-token" {
+		t.Errorf("The targets in the config should be used: %+v %v", targets, err)
+	}
+	if targets, _ := ParseTargets([]string{"east=a:8500"}, configTargets); len(targets) != 1 {
+		t.Errorf("--target should win over the config: %+v", targets)
+	}
+}
+
+func TestSaveTargets(t *testing.T) {
+	PrefixLocation = "testing"
+	east, _ := newTestConsul(t)
+	west, _ := newTestConsul(t)
+	west.put("testing/hosts/checksum", exampleDataSHA)
+	targets := []Target{
+		{Name: "east", Server: strings.TrimPrefix(east.server.URL, "http://")},
+		{Name: "west", Server: strings.TrimPrefix(west.server.URL, "http://")},
+	}
+	clients, _, err := PrepareTargets(targets, "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := SaveTargets(clients, "hosts", exampleData, exampleDataSHA, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Action != TargetSaved || results[1].Action != TargetUnchanged {
+		t.Errorf("east should be saved and west unchanged: %+v", results)
+	}
+	if value, _ := east.value("testing/hosts/data"); value != exampleData {
+		t.Errorf("The data wasn't saved on east: '%s'", value)
+	}
+	if west.count("PUT") != 0 {
+		t.Error("west already had the checksum and shouldn't be written.")
+	}
+
+	// Nothing is written when a target doesn't answer.
+	down, _ := newTestConsul(t)
+	down.server.Close()
+	Retries = 1
+	defer func() { Retries = 5 }()
+	_, results, err = PrepareTargets([]Target{targets[0], {Name: "down", Server: strings.TrimPrefix(down.server.URL, "http://")}}, "hosts")
+	if err == nil || results[0].Action == TargetFailed || results[1].Action != TargetFailed {
+		t.Errorf("A target that didn't answer should fail them all: %+v %v", results, err)
+	}
+
+	// A target with a stop key isn't written either.
+	west.put("testing/hosts/stop", "maintenance")
+	if _, _, err := PrepareTargets(targets, "hosts"); !errors.Is(err, errTargetStopped) || !strings.Contains(err.Error(), "west") {
+		t.Errorf("A stop key on one target should stop them all: %v", err)
+	}
+}
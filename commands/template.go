@@ -0,0 +1,102 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"bytes"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// TemplateData is what a --template is rendered with.
+type TemplateData struct {
+	Key  string
+	Data string
+}
+
+// ParseTemplate reads and parses a text/template file. The key function can't
+// be used until the template is rendered with RenderTemplate.
+func ParseTemplate(file string) (*template.Template, error) {
+	text, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return template.New(filepath.Base(file)).Option("missingkey=error").Funcs(templateFuncs(nil)).Parse(string(text))
+}
+
+// RenderTemplate renders tmpl with the data from key. Other kvexpress keys can
+// be read with {{ key "name" }} - they have to match their checksums too. The
+// secrets from --vault-path are {{ vault "name" }}.
+func RenderTemplate(c *consul.Client, tmpl *template.Template, key, data string) (string, error) {
+	var rendered bytes.Buffer
+	if err := tmpl.Funcs(templateFuncs(c)).Execute(&rendered, TemplateData{Key: key, Data: data}); err != nil {
+		return "", err
+	}
+	return rendered.String(), nil
+}
+
+// templateFuncs are the helpers a template can use.
+func templateFuncs(c *consul.Client) template.FuncMap {
+	return template.FuncMap{
+		"split": func(sep, s string) []string { return strings.Split(s, sep) },
+		"join":  func(sep string, list []string) string { return strings.Join(list, sep) },
+		"lines": func(s string) []string { return BlankLineStrip(strings.Split(s, "\n")) },
+		"trim":  strings.TrimSpace,
+		"env":   os.Getenv,
+		"key": func(name string) (string, error) {
+			if c == nil {
+				return "", fmt.Errorf("can not read '%s' outside of out", name)
+			}
+			return GetVerifiedData(c, name)
+		},
+		"vault": func(name string) (string, error) {
+			value, ok := outSecrets[name]
+			if !ok {
+				return "", fmt.Errorf("there's no secret '%s' in --vault-path", name)
+			}
+			return value, nil
+		},
+	}
+}
+
+// GetVerifiedData returns the decoded data for key if it's long enough and
+// matches the checksum key - and is signed if there's a --verify-key.
+func GetVerifiedData(c *consul.Client, key string) (string, error) {
+	data, err := GetData(c, key)
+	if err != nil {
+		return "", err
+	}
+	data, encoding, err := DecodeKeyData(c, key, data)
+	if err != nil {
+		return "", err
+	}
+	checksum, err := GetChecksum(c, key)
+	if err != nil {
+		return "", err
+	}
+	minLength, maxLength := lineLimits(BinaryEncoding(encoding))
+	if !LengthCheck(data, minLength) {
+		StatsdLength(key)
+		return "", fmt.Errorf("the data in '%s' is not long enough", key)
+	}
+	if err := SizeCheck(data, maxLength, MaxFileBytes); err != nil {
+		StatsdTooLarge(key)
+		return "", fmt.Errorf("the data in '%s' is %v", key, err)
+	}
+	if !ChecksumCompare(data, checksum) {
+		StatsdChecksum(key)
+		return "", fmt.Errorf("the data in '%s' does not match the checksum", key)
+	}
+	if verifyPublicKey != nil {
+		if err := verifyKeySignature(c, key, data); err != nil {
+			StatsdSignatureInvalid(key)
+			return "", fmt.Errorf("'%s': %w", key, err)
+		}
+	}
+	return data, nil
+}
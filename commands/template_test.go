@@ -0,0 +1,54 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	file := ensureTestFile(t)
+	tc, c := newTestConsul(t)
+	MinFileLength = 1
+	tc.put("testing/backends/data", "10.0.0.1\n10.0.0.2\n")
+	tc.put("testing/backends/checksum", ComputeChecksum("10.0.0.1\n10.0.0.2\n"))
+	os.Setenv("KVEXPRESS_TEST_PORT", "8080")
+	defer os.Unsetenv("KVEXPRESS_TEST_PORT")
+
+	ioutil.WriteFile(file, []byte(`# {{ .Key }} {{ trim .Data }}
+{{ range lines (key "backends") }}server {{ . }}:{{ env "KVEXPRESS_TEST_PORT" }}
+{{ end }}{{ join "," (split " " "a b") }}
+`), 0640)
+	tmpl, err := ParseTemplate(file)
+	if err != nil {
+		t.Fatalf("The template should parse: %v", err)
+	}
+	rendered, err := RenderTemplate(c, tmpl, "haproxy", "  global  ")
+	expected := "# haproxy global\nserver 10.0.0.1:8080\nserver 10.0.0.2:8080\na,b\n"
+	if err != nil || rendered != expected {
+		t.Errorf("The template isn't rendered right: %q %v", rendered, err)
+	}
+
+	public, _, _ := ed25519.GenerateKey(rand.Reader)
+	verifyPublicKey = public
+	_, err = RenderTemplate(c, tmpl, "haproxy", "global")
+	verifyPublicKey = nil
+	if !errors.Is(err, ErrBadSignature) {
+		t.Errorf("A key without a signature shouldn't render with --verify-key: %v", err)
+	}
+
+	tc.put("testing/backends/checksum", "not-the-checksum")
+	if _, err := RenderTemplate(c, tmpl, "haproxy", "global"); err == nil {
+		t.Error("A key that doesn't match its checksum should be an error.")
+	}
+
+	ioutil.WriteFile(file, []byte("{{ .Missing }"), 0640)
+	if _, err := ParseTemplate(file); err == nil {
+		t.Error("A broken template should be an error.")
+	}
+}
@@ -0,0 +1,129 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ConsulTimeout is how long a single Consul request can take - a blocking
+	// query gets its wait on top. 0 for no limit.
+	ConsulTimeout time.Duration
+
+	// Deadline is how long the whole run can take before kvexpress gives up
+	// with ExitTimeout - 0 for no limit.
+	Deadline time.Duration
+)
+
+// ErrConsulTimeout is returned when Consul didn't answer in --consul-timeout.
+var ErrConsulTimeout = errors.New("timed out waiting for Consul")
+
+// consulTimedOut is set when the last Consul request timed out - so giving up
+// on Consul exits ExitTimeout rather than ExitConsulError.
+var consulTimedOut int32
+
+// timeoutTransport gives up on a Consul request after --consul-timeout.
+type timeoutTransport struct {
+	base    http.RoundTripper
+	timeout time.Duration
+}
+
+// RoundTrip sends req with a deadline - it's kept until the body is closed.
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	timeout := requestTimeout(req, t.timeout)
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, consulTimeout(req, timeout)
+		}
+		return nil, err
+	}
+	atomic.StoreInt32(&consulTimedOut, 0)
+	resp.Body = &timeoutBody{ReadCloser: resp.Body, ctx: ctx, cancel: cancel, req: req, timeout: timeout}
+	return resp, nil
+}
+
+// timeoutBody cancels the request's deadline when it's closed.
+type timeoutBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	cancel  context.CancelFunc
+	req     *http.Request
+	timeout time.Duration
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF && b.ctx.Err() == context.DeadlineExceeded {
+		return n, consulTimeout(b.req, b.timeout)
+	}
+	return n, err
+}
+
+func (b *timeoutBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// consulTimeout logs a request that timed out and remembers it for the exit code.
+func consulTimeout(req *http.Request, timeout time.Duration) error {
+	atomic.StoreInt32(&consulTimedOut, 1)
+	Log(fmt.Sprintf("consul='timeout' path='%s' timeout='%s'", req.URL.Path, timeout), "info")
+	return fmt.Errorf("%w: %s %s after %s", ErrConsulTimeout, req.Method, req.URL.Path, timeout)
+}
+
+// requestTimeout is timeout plus the wait of a blocking query - and the
+// wait/16 of jitter Consul adds to it.
+func requestTimeout(req *http.Request, timeout time.Duration) time.Duration {
+	if wait, err := time.ParseDuration(req.URL.Query().Get("wait")); err == nil && wait > 0 {
+		return timeout + wait + wait/16
+	}
+	return timeout
+}
+
+// timeoutClient makes client give up on a request after --consul-timeout.
+func timeoutClient(client *http.Client) *http.Client {
+	client.Transport = &timeoutTransport{base: client.Transport, timeout: ConsulTimeout}
+	return client
+}
+
+// StartDeadline stops kvexpress with ExitTimeout once --deadline has passed.
+func StartDeadline() {
+	if Deadline <= 0 {
+		return
+	}
+	time.AfterFunc(Deadline, deadlineExpired)
+}
+
+// deadlineExpired is what happens when the run took longer than --deadline.
+// Everything in flight is cancelled like it is for a signal - a file that's
+// being written gets stopGrace to finish its rename so it's never left half
+// written.
+func deadlineExpired() {
+	message := fmt.Sprintf("Gave up after the %s deadline.", Deadline)
+	Log(fmt.Sprintf("deadline='%s' command='%s' - stopping.", Deadline, Direction), "error")
+	atomic.StoreInt32(&deadlineHit, 1)
+	StopRun("deadline")
+	afterStopGrace(func() {
+		exitTimeout(Direction, "deadline", message)
+	})
+}
+
+// exitTimeout sends the timeout metric and stops with ExitTimeout.
+func exitTimeout(id, timeout, message string) {
+	stopExit.Do(func() {
+		fmt.Println(message)
+		runStopHooks(Hook{Event: HookError, Key: id, Message: message})
+		StatsdTimeout(id, timeout)
+		exitRun(ExitTimeout, processStart, id, timeout+"_timeout", message)
+	})
+}
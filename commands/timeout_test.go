@@ -0,0 +1,45 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTimeoutTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("[]"))
+	}))
+	defer server.Close()
+	defer atomic.StoreInt32(&consulTimedOut, 0)
+	client := &http.Client{Transport: &timeoutTransport{base: http.DefaultTransport, timeout: 20 * time.Millisecond}}
+
+	_, err := client.Get(server.URL + "/v1/kv/testing/hosts/data")
+	if !errors.Is(err, ErrConsulTimeout) {
+		t.Fatalf("A request that takes too long should time out: %v", err)
+	}
+	if code := fatalExitCode("no_more_retries"); code != ExitTimeout {
+		t.Errorf("Giving up on Consul after a timeout should exit %d: %d", ExitTimeout, code)
+	}
+
+	// A blocking query gets its wait on top of the timeout.
+	resp, err := client.Get(server.URL + "/v1/kv/testing/hosts/data?index=10&wait=200ms")
+	if err != nil {
+		t.Fatalf("A blocking query shouldn't time out within its wait: %v", err)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(data) != "[]" {
+		t.Errorf("The body should be read before the deadline is cancelled: '%s' %v", data, err)
+	}
+	if code := fatalExitCode("consul_get"); code != ExitConsulError {
+		t.Errorf("A request that answered should clear the timeout: %d", code)
+	}
+}
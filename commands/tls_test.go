@@ -0,0 +1,102 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	consul "github.com/hashicorp/consul/api"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCert creates a certificate signed by parent - or a self-signed CA if
+// parent is nil - and writes it and its key to dir.
+func testCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return cert, key
+}
+
+func TestConsulMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := testCert(t, dir, "ca", nil, nil)
+	testCert(t, dir, "server", ca, caKey)
+	testCert(t, dir, "client", ca, caKey)
+
+	tc := &testConsul{kv: make(map[string]*consul.KVPair), sessions: make(map[string]bool), index: 1,
+		requests: make(map[string]int), datacenters: make(map[string]int), namespaces: make(map[string]int)}
+	tc.server = httptest.NewUnstartedServer(http.HandlerFunc(tc.handle))
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	tc.server.TLS = &tls.Config{Certificates: []tls.Certificate{serverCert}, ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}
+	tc.server.StartTLS()
+	defer tc.server.Close()
+	tc.put("testing/keyname/data", exampleData)
+
+	defer func() {
+		ConsulSSL, ConsulCACert, ConsulClientCert, ConsulClientKey = false, "", "", ""
+	}()
+	ConsulSSL = true
+	ConsulCACert = filepath.Join(dir, "ca.pem")
+	ConsulClientCert = filepath.Join(dir, "client.pem")
+	ConsulClientKey = filepath.Join(dir, "client-key.pem")
+	server := strings.TrimPrefix(tc.server.URL, "https://")
+
+	c, err := Connect(server, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, err := consulGet(c, "testing/keyname/data"); err != nil || value != exampleData {
+		t.Errorf("The client certificate should be accepted: '%s' %v", value, err)
+	}
+
+	ConsulClientCert, ConsulClientKey = "", ""
+	c, err = Connect(server, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := consulGet(c, "testing/keyname/data"); err == nil {
+		t.Error("Without a client certificate the connection should be refused.")
+	}
+}
@@ -0,0 +1,196 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"fmt"
+	"github.com/smallfish/simpleyaml"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// consulLease is the Vault lease for the token from --vault-consul-role. It's
+// renewed while kvexpress runs and revoked when it's done, so the token isn't
+// left working until the lease runs out.
+var consulLease struct {
+	sync.Mutex
+	id       string
+	duration time.Duration
+}
+
+// keepVaultLease is set by watch - RunTime after every write doesn't revoke
+// the token it's still using. It's revoked when watch stops.
+var keepVaultLease bool
+
+// prefixTokens are the token files for the prefixes in the prefix_tokens
+// section of the config.
+var prefixTokens map[string]string
+
+// SetupToken sets the Consul token from --vault-consul-role or --token-file
+// so it doesn't have to be passed on the command line. A token from Vault wins
+// over a token file, and a token file wins over --token and CONSUL_HTTP_TOKEN.
+// A --prefix in prefix_tokens uses its own token file over all of them.
+func SetupToken() error {
+	switch {
+	case PrefixTokenFile(PrefixLocation) != "":
+		file := PrefixTokenFile(PrefixLocation)
+		token, err := ReadTokenFile(file)
+		if err != nil {
+			return err
+		}
+		Token = token
+		Log(fmt.Sprintf("token='prefix' prefix='%s' file='%s' token='%s'", PrefixLocation, file, cleanupToken(Token)), "debug")
+	case VaultConsulRole != "":
+		token, err := VaultConsulToken(VaultConsulRole)
+		if err != nil {
+			return err
+		}
+		Token = token
+		Log(fmt.Sprintf("token='vault' role='%s' token='%s'", VaultConsulRole, cleanupToken(Token)), "debug")
+	case TokenFile != "":
+		token, err := ReadTokenFile(TokenFile)
+		if err != nil {
+			return err
+		}
+		Token = token
+		Log(fmt.Sprintf("token='file' file='%s' token='%s'", TokenFile, cleanupToken(Token)), "debug")
+	}
+	return nil
+}
+
+// PrefixTokenFile is the token file for prefix from prefix_tokens - the
+// longest prefix that it's in wins. It's blank if there isn't one.
+func PrefixTokenFile(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	longest, file := -1, ""
+	for tokenPrefix, tokenFile := range prefixTokens {
+		tokenPrefix = strings.Trim(tokenPrefix, "/")
+		if prefix != tokenPrefix && !strings.HasPrefix(prefix, tokenPrefix+"/") {
+			continue
+		}
+		if len(tokenPrefix) > longest {
+			longest, file = len(tokenPrefix), tokenFile
+		}
+	}
+	return file
+}
+
+// loadConfigPrefixTokens reads the prefix_tokens section of the config - a
+// map of prefix to token file.
+func loadConfigPrefixTokens(config *simpleyaml.Yaml) {
+	section := config.Get("prefix_tokens")
+	if !section.IsFound() {
+		return
+	}
+	prefixes, err := section.GetMapKeys()
+	if err != nil {
+		Log("config: key='prefix_tokens' message='not a map'", "info")
+		return
+	}
+	prefixTokens = make(map[string]string)
+	for _, prefix := range prefixes {
+		if file := GetStringConfig(section, prefix); file != "" {
+			prefixTokens[prefix] = file
+		}
+	}
+	Log(fmt.Sprintf("config: key='prefix_tokens' prefixes='%d'", len(prefixTokens)), "debug")
+}
+
+// ReadTokenFile reads a Consul token from the first line of file.
+func ReadTokenFile(file string) (string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(strings.SplitN(string(data), "\n", 2)[0])
+	if token == "" {
+		return "", fmt.Errorf("there's no token in '%s'", file)
+	}
+	return token, nil
+}
+
+// VaultConsulToken gets a short-lived Consul token for role from Vault's
+// Consul secrets engine - it uses the same Vault server and token as
+// --encrypt-vault.
+func VaultConsulToken(role string) (string, error) {
+	var resp struct {
+		LeaseID       string `json:"lease_id"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+		Data          struct {
+			Token string `json:"token"`
+		} `json:"data"`
+	}
+	addr, token := vaultConfig()
+	client := cancelClient(&http.Client{Timeout: 10 * time.Second})
+	if err := vaultCall(client, addr, token, "GET", fmt.Sprintf("consul/creds/%s", role), nil, &resp); err != nil {
+		return "", err
+	}
+	if resp.Data.Token == "" {
+		return "", fmt.Errorf("vault didn't return a Consul token for '%s'", role)
+	}
+	Log(fmt.Sprintf("token='vault' role='%s' lease='%d'", role, resp.LeaseDuration), "info")
+	if resp.LeaseID != "" {
+		consulLease.Lock()
+		consulLease.id, consulLease.duration = resp.LeaseID, time.Duration(resp.LeaseDuration)*time.Second
+		consulLease.Unlock()
+		if resp.Renewable && resp.LeaseDuration > 0 {
+			go renewVaultLease(resp.LeaseID)
+		}
+	}
+	return resp.Data.Token, nil
+}
+
+// renewVaultLease renews the lease when two thirds of it have gone - only a
+// run that's still going by then needs it. It stops once the lease is revoked
+// or Vault won't renew it.
+func renewVaultLease(id string) {
+	addr, token := vaultConfig()
+	client := cancelClient(&http.Client{Timeout: 10 * time.Second})
+	for {
+		consulLease.Lock()
+		duration := consulLease.duration
+		consulLease.Unlock()
+		time.Sleep(duration * 2 / 3)
+		consulLease.Lock()
+		current := consulLease.id
+		consulLease.Unlock()
+		if current != id {
+			return
+		}
+		var resp struct {
+			LeaseDuration int `json:"lease_duration"`
+		}
+		body := map[string]string{"lease_id": id, "increment": fmt.Sprintf("%ds", int(duration/time.Second))}
+		if err := vaultCall(client, addr, token, "PUT", "sys/leases/renew", body, &resp); err != nil || resp.LeaseDuration <= 0 {
+			Log(fmt.Sprintf("token='vault' renewed='false' message='%v' - the Consul token stops working when its lease is over.", err), "warn")
+			return
+		}
+		consulLease.Lock()
+		consulLease.duration = time.Duration(resp.LeaseDuration) * time.Second
+		consulLease.Unlock()
+		Log(fmt.Sprintf("token='vault' renewed='true' lease='%d'", resp.LeaseDuration), "debug")
+	}
+}
+
+// RevokeVaultLease revokes the lease for the token from --vault-consul-role.
+// It only does anything the first time.
+func RevokeVaultLease() {
+	consulLease.Lock()
+	id := consulLease.id
+	consulLease.id = ""
+	consulLease.Unlock()
+	if id == "" || DryRun {
+		return
+	}
+	addr, token := vaultConfig()
+	client := &http.Client{Timeout: 5 * time.Second}
+	if err := vaultCall(client, addr, token, "PUT", "sys/leases/revoke", map[string]string{"lease_id": id}, nil); err != nil {
+		Log(fmt.Sprintf("token='vault' revoked='false' message='%v'", err), "warn")
+		return
+	}
+	Log("token='vault' revoked='true'", "debug")
+}
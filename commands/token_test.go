@@ -0,0 +1,108 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSetupTokenFile(t *testing.T) {
+	file := ensureTestFile(t)
+	ioutil.WriteFile(file, []byte("0ef2b339-4d52-4a5c-8f20-1a96d6b1e7d9\n"), 0600)
+	defer func(token string) { Token, TokenFile = token, "" }(Token)
+	Token, TokenFile = "anonymous", file
+	if err := SetupToken(); err != nil || Token != "0ef2b339-4d52-4a5c-8f20-1a96d6b1e7d9" {
+		t.Errorf("The token should be read from the file: '%s' %v", Token, err)
+	}
+
+	ioutil.WriteFile(file, []byte("\n"), 0600)
+	if err := SetupToken(); err == nil {
+		t.Error("An empty token file should be an error.")
+	}
+}
+
+func TestPrefixTokens(t *testing.T) {
+	file := ensureTestFile(t)
+	ioutil.WriteFile(file, []byte("team-b-token\n"), 0600)
+	loadConfigPrefixTokens(ParseConfig([]byte("prefix_tokens:\n  team-a: /etc/kvexpress/team-a.token\n  team-b: /etc/kvexpress/team-b.token\n  team-b/apps: " + file + "\n")))
+	defer func(token, prefix string) { Token, PrefixLocation, prefixTokens = token, prefix, nil }(Token, PrefixLocation)
+	if PrefixTokenFile("team-a") != "/etc/kvexpress/team-a.token" || PrefixTokenFile("/team-b/apps/web") != file {
+		t.Errorf("The longest prefix should win: %v", prefixTokens)
+	}
+	if PrefixTokenFile("team-ab") != "" || PrefixTokenFile("kvexpress") != "" {
+		t.Error("A prefix that isn't in prefix_tokens shouldn't have a token file.")
+	}
+	Token, PrefixLocation = "super-token", "team-b/apps"
+	if err := SetupToken(); err != nil || Token != "team-b-token" {
+		t.Errorf("The prefix's token should win over --token: '%s' %v", Token, err)
+	}
+}
+
+func TestVaultConsulToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" || r.URL.Path != "/v1/consul/creds/kvexpress" || r.Header.Get("X-Vault-Token") != "vault-token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		w.Write([]byte(`{"lease_duration":3600,"data":{"token":"from-vault"}}`))
+	}))
+	defer server.Close()
+	defer func(token string) { Token, VaultConsulRole, VaultAddr, VaultToken = token, "", "", "" }(Token)
+	VaultConsulRole, VaultAddr, VaultToken = "kvexpress", server.URL, "vault-token"
+
+	if err := SetupToken(); err != nil || Token != "from-vault" {
+		t.Errorf("The token should come from Vault: '%s' %v", Token, err)
+	}
+	VaultConsulRole = "other"
+	if err := SetupToken(); err == nil {
+		t.Error("A role Vault doesn't know should be an error.")
+	}
+}
+
+func TestRevokeVaultLease(t *testing.T) {
+	var lock sync.Mutex
+	var revoked []string
+	var renewed int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		lock.Lock()
+		defer lock.Unlock()
+		switch r.URL.Path {
+		case "/v1/consul/creds/kvexpress":
+			w.Write([]byte(`{"lease_id":"consul/creds/kvexpress/abc","lease_duration":1,"renewable":true,"data":{"token":"from-vault"}}`))
+		case "/v1/sys/leases/renew":
+			renewed++
+			w.Write([]byte(`{"lease_id":"consul/creds/kvexpress/abc","lease_duration":1}`))
+		case "/v1/sys/leases/revoke":
+			revoked = append(revoked, body["lease_id"])
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+	defer func(token string) { Token, VaultConsulRole, VaultAddr, VaultToken = token, "", "", "" }(Token)
+	VaultConsulRole, VaultAddr, VaultToken = "kvexpress", server.URL, "vault-token"
+
+	if err := SetupToken(); err != nil || Token != "from-vault" {
+		t.Fatalf("The token should come from Vault: '%s' %v", Token, err)
+	}
+	// The lease is renewed while the run is still going.
+	time.Sleep(1500 * time.Millisecond)
+	RevokeVaultLease()
+	RevokeVaultLease()
+	lock.Lock()
+	defer lock.Unlock()
+	if len(revoked) != 1 || revoked[0] != "consul/creds/kvexpress/abc" {
+		t.Errorf("The lease should be revoked once: %q", revoked)
+	}
+	if renewed == 0 {
+		t.Error("The lease should be renewed before it's over.")
+	}
+}
@@ -0,0 +1,263 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tracedCommands are the commands that send a trace with --otlp-endpoint.
+var tracedCommands = map[string]bool{"in": true, "out": true, "copy": true}
+
+// Span is a single timed step of a run - it's sent to the collector as an
+// OTLP span when the run is done.
+type Span struct {
+	Name       string
+	TraceID    string
+	SpanID     string
+	ParentID   string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+	Error      string
+}
+
+// tracer has the root span of the run and every span that's finished.
+var tracer struct {
+	sync.Mutex
+	root  *Span
+	spans []*Span
+}
+
+// tracesEndpoint is where the spans are posted.
+var tracesEndpoint string
+
+// SetupTracing starts the trace for in, out and copy if there's an
+// --otlp-endpoint - or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT or
+// OTEL_EXPORTER_OTLP_ENDPOINT. The root span starts when kvexpress did.
+func SetupTracing() error {
+	tracesEndpoint = ""
+	switch {
+	case OTLPEndpoint != "":
+		tracesEndpoint = strings.TrimSuffix(OTLPEndpoint, "/")
+		if !strings.HasSuffix(tracesEndpoint, "/v1/traces") {
+			tracesEndpoint += "/v1/traces"
+		}
+	case os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "":
+		tracesEndpoint = os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	case os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "":
+		tracesEndpoint = strings.TrimSuffix(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "/") + "/v1/traces"
+	default:
+		return nil
+	}
+	if endpoint, err := url.Parse(tracesEndpoint); err != nil || endpoint.Host == "" {
+		return fmt.Errorf("'%s' isn't an OTLP endpoint", tracesEndpoint)
+	}
+	if !tracedCommands[Direction] {
+		return nil
+	}
+	tracer.Lock()
+	defer tracer.Unlock()
+	tracer.root = &Span{Name: "kvexpress " + Direction, TraceID: randomHex(16), SpanID: randomHex(8), Start: processStart, Attributes: map[string]string{}}
+	tracer.spans = nil
+	Log(fmt.Sprintf("tracing endpoint='%s' trace_id='%s'", tracesEndpoint, tracer.root.TraceID), "debug")
+	return nil
+}
+
+// StartSpan starts a span underneath the run's root span - attributes are
+// key and value pairs. It's nil if the run isn't traced.
+func StartSpan(name string, attributes ...string) *Span {
+	tracer.Lock()
+	defer tracer.Unlock()
+	if tracer.root == nil {
+		return nil
+	}
+	span := &Span{Name: name, TraceID: tracer.root.TraceID, SpanID: randomHex(8), ParentID: tracer.root.SpanID, Start: time.Now(), Attributes: map[string]string{}}
+	for i := 0; i+1 < len(attributes); i += 2 {
+		span.Attributes[attributes[i]] = attributes[i+1]
+	}
+	return span
+}
+
+// SetAttribute adds an attribute to the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	tracer.Lock()
+	defer tracer.Unlock()
+	s.Attributes[key] = value
+}
+
+// Finish ends the span - err marks it as failed.
+func (s *Span) Finish(err error) {
+	if s == nil {
+		return
+	}
+	tracer.Lock()
+	defer tracer.Unlock()
+	s.End = time.Now()
+	if err != nil {
+		s.Error = err.Error()
+	}
+	tracer.spans = append(tracer.spans, s)
+}
+
+// TraceFlush ends the root span where the run stopped and sends every span
+// to the collector. A collector that can't be reached is only logged.
+func TraceFlush(key, location, message string) {
+	tracer.Lock()
+	root := tracer.root
+	if root == nil {
+		tracer.Unlock()
+		return
+	}
+	tracer.root = nil
+	root.End = time.Now()
+	root.Error = message
+	root.Attributes["kvexpress.key"] = key
+	root.Attributes["kvexpress.location"] = location
+	spans := append(tracer.spans, root)
+	tracer.spans = nil
+	tracer.Unlock()
+
+	if err := exportSpans(tracesEndpoint, spans); err != nil {
+		Log(fmt.Sprintf("tracing endpoint='%s' message='%v'", tracesEndpoint, err), "info")
+		return
+	}
+	Log(fmt.Sprintf("tracing trace_id='%s' spans='%d'", root.TraceID, len(spans)), "debug")
+}
+
+// exportSpans posts the spans to an OTLP/HTTP collector as JSON.
+func exportSpans(endpoint string, spans []*Span) error {
+	body, err := json.Marshal(otlpTraces(spans))
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("the collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// The OTLP JSON encoding of a trace - only the parts kvexpress uses.
+type (
+	otlpValue struct {
+		StringValue string `json:"stringValue"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+	otlpScopeSpans struct {
+		Scope struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		} `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpResourceSpans struct {
+		Resource struct {
+			Attributes []otlpAttribute `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpTracesRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+)
+
+// otlpTraces is the export request for the spans - the host and run ID are
+// resource attributes so every span has them.
+func otlpTraces(spans []*Span) otlpTracesRequest {
+	var scope otlpScopeSpans
+	scope.Scope.Name, scope.Scope.Version = "kvexpress", Version
+	for _, span := range spans {
+		converted := otlpSpan{
+			TraceID:           span.TraceID,
+			SpanID:            span.SpanID,
+			ParentSpanID:      span.ParentID,
+			Name:              span.Name,
+			Kind:              1,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes),
+			Status:            otlpStatus{Code: 1},
+		}
+		// Consul calls are client spans so the backend shows their latency as a dependency.
+		if strings.HasPrefix(span.Name, "consul.") {
+			converted.Kind = 3
+		}
+		if span.Error != "" {
+			converted.Status = otlpStatus{Code: 2, Message: span.Error}
+		}
+		scope.Spans = append(scope.Spans, converted)
+	}
+	var resource otlpResourceSpans
+	resource.Resource.Attributes = otlpAttributes(map[string]string{
+		"service.name":     "kvexpress",
+		"service.version":  Version,
+		"host.name":        GetHostname(),
+		"kvexpress.run_id": RunID,
+	})
+	resource.ScopeSpans = []otlpScopeSpans{scope}
+	return otlpTracesRequest{ResourceSpans: []otlpResourceSpans{resource}}
+}
+
+// otlpAttributes are the attributes sorted by key.
+func otlpAttributes(attributes map[string]string) []otlpAttribute {
+	var keys []string
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	converted := make([]otlpAttribute, 0, len(keys))
+	for _, key := range keys {
+		converted = append(converted, otlpAttribute{Key: key, Value: otlpValue{StringValue: attributes[key]}})
+	}
+	return converted
+}
+
+// randomHex is n random bytes as hex - for the trace and span IDs.
+func randomHex(n int) string {
+	id := make([]byte, n)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("%0*x", n*2, time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,67 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTracing(t *testing.T) {
+	file := ensureTestFile(t)
+	tc, c := newTestConsul(t)
+	tc.put("testing/trace/data", exampleData)
+
+	var request otlpTracesRequest
+	var path string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&request)
+	}))
+	defer collector.Close()
+
+	direction := Direction
+	OTLPEndpoint, Direction = collector.URL, "out"
+	defer func() { OTLPEndpoint, Direction = "", direction }()
+	if err := SetupTracing(); err != nil {
+		t.Fatalf("The tracing should be setup: %v", err)
+	}
+
+	data, err := Get(c, KeyPath("trace", "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ChecksumCompare(data, exampleDataSHA)
+	if err := WriteFile(data, file, 0640, ""); err != nil {
+		t.Fatal(err)
+	}
+	TraceFlush("trace", "complete", "")
+
+	if path != "/v1/traces" || len(request.ResourceSpans) != 1 || len(request.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("The spans should be posted to /v1/traces: %s %+v", path, request)
+	}
+	spans := request.ResourceSpans[0].ScopeSpans[0].Spans
+	names := []string{"consul.get", "checksum.compare", "file.write", "kvexpress out"}
+	if len(spans) != len(names) {
+		t.Fatalf("There should be a span for every step and the run: %+v", spans)
+	}
+	root := spans[len(spans)-1]
+	for i, span := range spans {
+		if span.Name != names[i] || span.TraceID != root.TraceID || span.Status.Code != 1 {
+			t.Errorf("The span should be part of the trace: %+v", span)
+		}
+		if i < len(spans)-1 && span.ParentSpanID != root.SpanID {
+			t.Errorf("The span should be underneath the run: %+v", span)
+		}
+	}
+	if spans[0].Kind != 3 || len(root.TraceID) != 32 || len(root.SpanID) != 16 {
+		t.Errorf("The Consul span should be a client span with OTLP IDs: %+v", spans[0])
+	}
+
+	// Once it's flushed nothing else is traced.
+	if span := StartSpan("consul.get"); span != nil {
+		t.Error("There shouldn't be a span after the trace is sent.")
+	}
+}
@@ -0,0 +1,123 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// consulTraffic is the bytes sent to and read from Consul since the last
+// RecordTraffic.
+var consulTraffic struct {
+	read    int64
+	written int64
+}
+
+// trafficTransport counts the bytes in every Consul request and response.
+type trafficTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip counts the request's body and wraps the response's so it's
+// counted as it's read.
+func (t *trafficTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.ContentLength > 0 {
+		atomic.AddInt64(&consulTraffic.written, req.ContentLength)
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &trafficBody{ReadCloser: resp.Body}
+	return resp, nil
+}
+
+// trafficBody is a response body that counts what's read from it.
+type trafficBody struct {
+	io.ReadCloser
+}
+
+func (b *trafficBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&consulTraffic.read, int64(n))
+	return n, err
+}
+
+// trafficClient counts client's traffic.
+func trafficClient(client *http.Client) *http.Client {
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.Transport = &trafficTransport{base: base}
+	return client
+}
+
+// KeyTraffic is the bytes the runs for a key have read from and written to
+// Consul on this host.
+type KeyTraffic struct {
+	Read    int64  `json:"read_bytes"`
+	Written int64  `json:"written_bytes"`
+	Runs    int64  `json:"runs"`
+	Since   string `json:"since"`
+}
+
+// TrafficPath is where the traffic for key in --prefix is added up - it's
+// next to the run lock.
+func TrafficPath(key string) string {
+	name := runLockName.ReplaceAllString(strings.Trim(PrefixLocation+"/"+key, "/"), "-")
+	return filepath.Join(StateDir(), fmt.Sprintf("kvexpress-traffic-%s.json", name))
+}
+
+// GetTraffic reads the traffic for key on this host - it's blank if there
+// hasn't been any.
+func GetTraffic(key string) (KeyTraffic, error) {
+	var traffic KeyTraffic
+	data, err := ioutil.ReadFile(TrafficPath(key))
+	if os.IsNotExist(err) {
+		return traffic, nil
+	}
+	if err != nil {
+		return traffic, err
+	}
+	if err := json.Unmarshal(data, &traffic); err != nil {
+		return traffic, fmt.Errorf("could not parse '%s': %v", TrafficPath(key), err)
+	}
+	return traffic, nil
+}
+
+// RecordTraffic sends the bytes read from and written to Consul since it was
+// last called as metrics for key and adds them to its TrafficPath. A file
+// that can't be saved is only logged.
+func RecordTraffic(key string) {
+	read := atomic.SwapInt64(&consulTraffic.read, 0)
+	written := atomic.SwapInt64(&consulTraffic.written, 0)
+	if key == "" || (read == 0 && written == 0) {
+		return
+	}
+	StatsdTraffic(key, read, written)
+	traffic, err := GetTraffic(key)
+	if err != nil {
+		Log(fmt.Sprintf("traffic key='%s' message='%v' - starting again.", key, err), "info")
+		traffic = KeyTraffic{}
+	}
+	if traffic.Since == "" {
+		traffic.Since = ReturnCurrentUTC()
+	}
+	traffic.Read += read
+	traffic.Written += written
+	traffic.Runs++
+	encoded, _ := json.Marshal(traffic)
+	path := TrafficPath(key)
+	if err := writeStateFile(path, encoded); err != nil {
+		Log(fmt.Sprintf("traffic key='%s' file='%s' message='%v'", key, path, err), "info")
+	}
+}
@@ -0,0 +1,53 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRecordTraffic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvexpress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	TmpDir = dir
+	defer func() { TmpDir = "" }()
+	PrefixLocation = "testing"
+	tc, c := newTestConsul(t)
+	tc.put("testing/hosts/data", exampleData)
+	RecordTraffic("")
+
+	if err := Set(c, "testing/hosts/checksum", exampleDataSHA); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Get(c, "testing/hosts/data"); err != nil {
+		t.Fatal(err)
+	}
+	if written := atomic.LoadInt64(&consulTraffic.written); written != int64(len(exampleDataSHA)) {
+		t.Errorf("The checksum should be counted as written: %d", written)
+	}
+	if read := atomic.LoadInt64(&consulTraffic.read); read < int64(len(exampleData)) {
+		t.Errorf("The data should be counted as read: %d", read)
+	}
+	RecordTraffic("hosts")
+	first, err := GetTraffic("hosts")
+	if err != nil || first.Runs != 1 || first.Written != int64(len(exampleDataSHA)) || first.Since == "" {
+		t.Fatalf("The run should be saved: %+v %v", first, err)
+	}
+
+	Get(c, "testing/hosts/data")
+	RecordTraffic("hosts")
+	second, _ := GetTraffic("hosts")
+	if second.Runs != 2 || second.Read <= first.Read || second.Since != first.Since {
+		t.Errorf("The runs should add up: %+v", second)
+	}
+	RecordTraffic("hosts")
+	if third, _ := GetTraffic("hosts"); third.Runs != 2 {
+		t.Errorf("A run that didn't move anything shouldn't count: %+v", third)
+	}
+}
@@ -1,11 +1,13 @@
-// +build linux darwin freebsd
+// +build linux darwin freebsd windows
 
 package commands
 
 import (
 	"fmt"
+	consul "github.com/hashicorp/consul/api"
 	"github.com/spf13/cobra"
 	"os"
+	"time"
 )
 
 var unlockCmd = &cobra.Command{
@@ -20,33 +22,131 @@ var unlockCmd = &cobra.Command{
 }
 
 func unlockRun(cmd *cobra.Command, args []string) {
+	if UnlockAll {
+		unlockAllRun()
+		return
+	}
+	if UnlockGlobal {
+		KeyLockLocation := KeyPath(KeyUnlock, "lock")
+		if err := UnlockFile(KeyLockLocation); err != nil {
+			Log(fmt.Sprintf("'%s' was NOT unlocked - something went wrong.", KeyUnlock), "info")
+			ExitOnError(err, KeyLockLocation, "unlock")
+		}
+		Log(fmt.Sprintf("'%s' was unlocked on every host.", KeyUnlock), "info")
+		return
+	}
 	KeyLockLocation := FileLockPath(FiletoUnlock)
 
-	result := UnlockFile(KeyLockLocation)
-	if result {
-		LockFileRemove(FiletoUnlock)
-		Log(fmt.Sprintf("'%s' was unlocked.", FiletoUnlock), "info")
-	} else {
+	if err := UnlockFile(KeyLockLocation); err != nil {
 		Log(fmt.Sprintf("'%s' was NOT unlocked - something went wrong.", FiletoUnlock), "info")
+		ExitOnError(err, KeyLockLocation, "unlock")
 	}
+	ExitOnError(LockFileRemove(FiletoUnlock), FiletoUnlock, "remove_file")
+	Log(fmt.Sprintf("'%s' was unlocked.", FiletoUnlock), "info")
+}
+
+// unlockAllRun clears every file lock on this host - or every global lock
+// with --global - once they've been confirmed.
+func unlockAllRun() {
+	start := time.Now()
+	c, err := Connect(ConsulServer, Token)
+	if err != nil {
+		LogFatal("Could not connect to Consul.", "unlock", "consul_connect")
+	}
+	entries, err := ListLocks(c, lockDirs())
+	ExitOnError(err, "unlock", "locks")
+	var unlock []LockEntry
+	for _, entry := range entries {
+		if entry.Global == UnlockGlobal {
+			unlock = append(unlock, entry)
+		}
+	}
+	if len(unlock) == 0 {
+		fmt.Println("Nothing is locked.")
+		RunTime(start, "unlock", "no_locks")
+		return
+	}
+	printLocks(unlock)
+	if !UnlockYes && !Confirm(fmt.Sprintf("Unlock these %d?", len(unlock))) {
+		fmt.Println("Nothing was unlocked.")
+		exitRun(1, start, "unlock", "not_unlocked", "")
+	}
+	ExitOnError(UnlockLocks(c, unlock), "unlock", "unlock")
+	fmt.Printf("Unlocked %d.\n", len(unlock))
+	RunTime(start, "unlock", "complete")
+}
+
+// UnlockLocks removes the lock keys and the `.locked` files of entries.
+func UnlockLocks(c *consul.Client, entries []LockEntry) error {
+	for _, entry := range entries {
+		if DryRunSkip(fmt.Sprintf("unlock '%s%s'", entry.File, entry.Key)) {
+			continue
+		}
+		if entry.LockKey != "" {
+			if err := Del(c, entry.LockKey); err != nil {
+				return err
+			}
+			StatsdUnlock(entry.LockKey)
+		}
+		if entry.File != "" {
+			if err := LockFileRemove(entry.File); err != nil {
+				return err
+			}
+		}
+		Log(fmt.Sprintf("unlock file='%s' key='%s' lock_key='%s' reason='%s' unlocked='true'", entry.File, entry.Key, entry.LockKey, entry.Reason), "info")
+	}
+	return nil
 }
 
 func checkUnlockFlags() {
 	Log("Checking cli flags.", "debug")
+	if UnlockAll {
+		if FiletoUnlock != "" || KeyUnlock != "" {
+			fmt.Println("--all can't be used with -f or -k")
+			os.Exit(1)
+		}
+		Log("Required cli flags present.", "debug")
+		return
+	}
+	if UnlockGlobal {
+		if KeyUnlock == "" {
+			fmt.Println("Need a key to unlock with -k")
+			os.Exit(1)
+		}
+		Log("Required cli flags present.", "debug")
+		return
+	}
 	if FiletoUnlock == "" {
 		fmt.Println("Need a file to lock with -f")
 		os.Exit(1)
 	}
-	CheckFullFilename(FiletoUnlock)
+	ExitOnError(CheckFullFilename(FiletoUnlock), FiletoUnlock, "check_flags")
 	Log("Required cli flags present.", "debug")
 }
 
 var (
 	// FiletoUnlock is the location we want to write the data to.
 	FiletoUnlock string
+
+	// UnlockGlobal unlocks KeyUnlock on every host instead of a file on this one.
+	UnlockGlobal bool
+
+	// KeyUnlock is the key that's unlocked with --global.
+	KeyUnlock string
+
+	// UnlockAll unlocks every file that locks lists - or every global lock.
+	UnlockAll bool
+
+	// UnlockYes unlocks everything with --all without asking.
+	UnlockYes bool
 )
 
 func init() {
 	RootCmd.AddCommand(unlockCmd)
 	unlockCmd.Flags().StringVarP(&FiletoUnlock, "file", "f", "", "file to unlock")
+	unlockCmd.Flags().BoolVarP(&UnlockGlobal, "global", "", false, "unlock the key on every host")
+	unlockCmd.Flags().StringVarP(&KeyUnlock, "key", "k", "", "key to unlock with --global")
+	unlockCmd.Flags().BoolVarP(&UnlockAll, "all", "", false, "unlock every file on this host - or every key with --global")
+	unlockCmd.Flags().BoolVarP(&UnlockYes, "yes", "y", false, "unlock everything with --all without asking")
+	unlockCmd.Flags().StringSliceVarP(&LockDirs, "dir", "", []string{}, "directories to look for .locked files in - --allowed-dir or /etc if blank")
 }
@@ -0,0 +1,199 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotModified is returned by ReadURLIfModified when the URL answers 304.
+var ErrNotModified = errors.New("the URL hasn't changed")
+
+// URLValidators are the ETag and Last-Modified a URL was last read with - they're
+// sent back as If-None-Match and If-Modified-Since.
+type URLValidators struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// ReadURL grabs a URL and returns the string from the body. It sends the
+// --url-header headers and a response that isn't a 2xx is an error. Network
+// errors and 5xx responses are tried again up to --url-retries times.
+func ReadURL(url string) (string, error) {
+	body, _, err := ReadURLIfModified(url, URLValidators{})
+	return body, err
+}
+
+// ReadURLIfModified is ReadURL with the validators from the last read - a 304
+// is ErrNotModified. It returns the validators the URL sent this time. With
+// --run-as it's read by fetch-as as that user.
+func ReadURLIfModified(url string, last URLValidators) (string, URLValidators, error) {
+	if fetchAsUser() {
+		return fetchAs(fetchRequest{URL: url, Last: last, Headers: URLHeaders})
+	}
+	client, err := urlClient()
+	if err != nil {
+		return "", URLValidators{}, err
+	}
+	return readURLRetries(client, url, last, URLHeaders)
+}
+
+// ReadHeaderFile reads the "Name: value" headers in file - one on each line.
+// Blank lines and lines that start with # are skipped.
+func ReadHeaderFile(file string) ([]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var headers []string
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.Contains(line, ":") {
+			return nil, fmt.Errorf("line %d of '%s' should be a 'Name: value' header", n+1, file)
+		}
+		headers = append(headers, line)
+	}
+	return headers, nil
+}
+
+// readURLRetries reads url with client and headers, trying again up to
+// --url-retries times.
+func readURLRetries(client *http.Client, url string, last URLValidators, headers []string) (string, URLValidators, error) {
+	var err error
+	var body string
+	var validators URLValidators
+	tries := URLRetries
+	if tries < 1 {
+		tries = 1
+	}
+	for i := 1; i <= tries; i++ {
+		var retry bool
+		body, validators, retry, err = readURL(client, url, last, headers)
+		if err == nil || !retry {
+			return body, validators, err
+		}
+		Log(fmt.Sprintf("function='ReadURL' url='%s' try='%d' max='%d' message='%v'", url, i, tries, err), "info")
+		if i < tries && !sleepRun(RetryBackoff(i)) {
+			break
+		}
+	}
+	return "", URLValidators{}, runStopped(err)
+}
+
+// readURL makes a single request and returns whether it's worth trying again.
+func readURL(client *http.Client, url string, last URLValidators, headers []string) (string, URLValidators, bool, error) {
+	validators := URLValidators{URL: url}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", validators, false, fmt.Errorf("could not open URL '%s': %v", url, err)
+	}
+	for _, header := range headers {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 {
+			return "", validators, false, fmt.Errorf("'%s' should be a 'Name: value' header", header)
+		}
+		req.Header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	if last.URL == url {
+		if last.ETag != "" {
+			req.Header.Set("If-None-Match", last.ETag)
+		}
+		if last.LastModified != "" {
+			req.Header.Set("If-Modified-Since", last.LastModified)
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", validators, true, fmt.Errorf("could not open URL '%s': %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && last.URL == url {
+		return "", last, false, ErrNotModified
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", validators, resp.StatusCode >= 500, fmt.Errorf("could not read URL '%s': %s", url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", validators, true, fmt.Errorf("could not read the body of URL '%s': %v", url, err)
+	}
+	validators.ETag = resp.Header.Get("ETag")
+	validators.LastModified = resp.Header.Get("Last-Modified")
+	return string(body), validators, false, nil
+}
+
+// URLValidatorsFile is where the validators for reading url into key are kept
+// between runs - it's in --tmp-dir.
+func URLValidatorsFile(key, url string) string {
+	sum := sha256.Sum256([]byte(key + "\n" + url))
+	return filepath.Join(ScratchDir(), fmt.Sprintf("kvexpress-url-%x.json", sum[:8]))
+}
+
+// LoadURLValidators reads the validators in file - if it's missing or broken
+// there aren't any and the URL is read in full.
+func LoadURLValidators(file string) URLValidators {
+	var validators URLValidators
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return validators
+	}
+	if err := json.Unmarshal(data, &validators); err != nil {
+		Log(fmt.Sprintf("function='LoadURLValidators' file='%s' message='%v'", file, err), "info")
+		return URLValidators{}
+	}
+	return validators
+}
+
+// SaveURLValidators writes the validators to file - if the URL didn't send
+// any the file is removed so the next read is in full.
+func SaveURLValidators(file string, validators URLValidators) error {
+	if validators.ETag == "" && validators.LastModified == "" {
+		return RemoveFile(file)
+	}
+	data, err := json.Marshal(validators)
+	if err != nil {
+		return err
+	}
+	return WriteFile(string(data), file, FilePermissions, Owner)
+}
+
+// urlClient is an HTTP client with --url-timeout, --url-ca-cert, --url-insecure
+// and --url-proxy.
+func urlClient() (*http.Client, error) {
+	var ca []byte
+	if URLCACert != "" {
+		var err error
+		if ca, err = ioutil.ReadFile(URLCACert); err != nil {
+			return nil, err
+		}
+	}
+	return urlClientCA(ca, URLCACert)
+}
+
+// urlClientCA is urlClient with the certificates in ca - read from file.
+func urlClientCA(ca []byte, file string) (*http.Client, error) {
+	config := &tls.Config{InsecureSkipVerify: URLInsecure}
+	if ca != nil {
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("there are no certificates in '%s'", file)
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	transport.Proxy = proxyFunc(URLProxy)
+	return cancelClient(&http.Client{Timeout: URLTimeout, Transport: transport}), nil
+}
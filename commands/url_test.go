@@ -0,0 +1,112 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadURL(t *testing.T) {
+	failures := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Header.Get("Authorization") != "Bearer secret":
+			w.WriteHeader(http.StatusUnauthorized)
+		case r.URL.Path == "/flaky" && failures < 2:
+			failures++
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Write([]byte(exampleData))
+		}
+	}))
+	defer server.Close()
+	defer func(wait time.Duration) { RetryWait, URLHeaders = wait, nil }(RetryWait)
+	RetryWait = 0
+
+	if _, err := ReadURL(server.URL); err == nil {
+		t.Error("A 401 should be an error - not the data.")
+	}
+	URLHeaders = []string{"Authorization: Bearer secret"}
+	if data, err := ReadURL(server.URL); err != nil || data != exampleData {
+		t.Errorf("The header should be sent: %q %v", data, err)
+	}
+	if data, err := ReadURL(server.URL + "/flaky"); err != nil || data != exampleData || failures != 2 {
+		t.Errorf("A 500 should be retried: %q %v %d", data, err, failures)
+	}
+	URLHeaders = []string{"not a header"}
+	if _, err := ReadURL(server.URL); err == nil {
+		t.Error("A header without a colon should be an error.")
+	}
+}
+
+func TestReadHeaderFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "headers")
+	ioutil.WriteFile(file, []byte("# inventory\nAuthorization: Bearer secret\n\nX-Team: infra\n"), 0600)
+	headers, err := ReadHeaderFile(file)
+	if err != nil || len(headers) != 2 || headers[0] != "Authorization: Bearer secret" || headers[1] != "X-Team: infra" {
+		t.Errorf("Every header in the file should be read: %q %v", headers, err)
+	}
+	ioutil.WriteFile(file, []byte("Authorization Bearer secret\n"), 0600)
+	if _, err := ReadHeaderFile(file); err == nil {
+		t.Error("A line without a colon should be an error.")
+	}
+}
+
+func TestReadURLTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(exampleData))
+	}))
+	defer server.Close()
+	defer func(wait time.Duration) { RetryWait, URLInsecure = wait, false }(RetryWait)
+	RetryWait = 0
+
+	if _, err := ReadURL(server.URL); err == nil {
+		t.Error("A self-signed certificate should not be trusted.")
+	}
+	URLInsecure = true
+	if data, err := ReadURL(server.URL); err != nil || data != exampleData {
+		t.Errorf("--url-insecure should skip verification: %q %v", data, err)
+	}
+}
+
+func TestReadURLIfModified(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Mon, 12 Oct 2026 10:00:00 GMT")
+		w.Write([]byte(exampleData))
+	}))
+	defer server.Close()
+	defer func(dir string) { TmpDir = dir }(TmpDir)
+	TmpDir = t.TempDir()
+
+	file := URLValidatorsFile("testing/url", server.URL)
+	data, validators, err := ReadURLIfModified(server.URL, LoadURLValidators(file))
+	if err != nil || data != exampleData || validators.ETag != `"v1"` || validators.LastModified == "" {
+		t.Fatalf("The first read should get the data and the validators: %q %+v %v", data, validators, err)
+	}
+	if err := SaveURLValidators(file, validators); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ReadURLIfModified(server.URL, LoadURLValidators(file)); !errors.Is(err, ErrNotModified) {
+		t.Errorf("The saved ETag should be sent and a 304 is ErrNotModified: %v", err)
+	}
+	if file == URLValidatorsFile("testing/other", server.URL) {
+		t.Error("Each key should have its own validators.")
+	}
+	if data, _, err := ReadURLIfModified(server.URL+"/other", LoadURLValidators(file)); err != nil || data != exampleData {
+		t.Errorf("Validators for another URL shouldn't be sent: %q %v", data, err)
+	}
+	if err := SaveURLValidators(file, URLValidators{URL: server.URL}); err != nil || LoadURLValidators(file).ETag != "" {
+		t.Errorf("A URL without validators should remove the file: %v", err)
+	}
+}
@@ -1,18 +1,23 @@
-// +build linux darwin freebsd
+// +build linux darwin freebsd windows
 
 package commands
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"github.com/DataDog/kvexpress/pkg/kvexpress"
 	"log"
 	"os"
 	"os/user"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -40,38 +45,147 @@ func SetDirection() string {
 // RunTime sends time coded logs and dogstatsd metrics when called.
 // Location is set when the RunTime function is called.
 func RunTime(start time.Time, key string, location string) {
+	finishRun(start, key, location, "")
+}
+
+// finishRun is RunTime with the error the run stopped with - it's in the
+// JSON result and the trace, and blank if the run didn't fail.
+func finishRun(start time.Time, key, location, message string) {
 	elapsed := time.Since(start)
 	milliseconds := int64(elapsed / time.Millisecond)
+	RecordTraffic(key)
 	StatsdRunTime(key, location, milliseconds)
+	if message != "" {
+		StatsdRunEvent(key, location, message)
+	}
 	Log(fmt.Sprintf("location='%s', elapsed='%s'", location, elapsed), "info")
+	PrintResult(key, location, elapsed, message)
+	PromFlush()
+	TraceFlush(key, location, message)
+	CloseBackend()
+	if !keepVaultLease {
+		RevokeVaultLease()
+	}
+}
+
+// SetRunID generates a RunID if one wasn't passed with --run-id.
+func SetRunID() {
+	if RunID == "" {
+		RunID = GenerateRunID()
+	}
+}
+
+// GenerateRunID returns a random ID to correlate everything from a single run.
+func GenerateRunID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
+
+// Confirm asks question on stdin and is true for a y or yes - anything else,
+// or no answer at all, is a no.
+func Confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// DryRunSkip logs and prints what would happen and returns true if --dry-run
+// was passed - the caller should skip doing it.
+func DryRunSkip(action string) bool {
+	if !DryRun {
+		return false
+	}
+	Log(fmt.Sprintf("dry_run='true' would='%s'", action), "info")
+	fmt.Printf("Dry run - would %s\n", action)
+	return true
 }
 
-// Log adds the global Direction to a message and sends to syslog.
-// Syslog is setup in main.go
+// Log adds the global Direction and RunID to a message and sends to syslog -
+// or --log-file. Syslog is setup in main.go
 func Log(message, priority string) {
-	message = fmt.Sprintf("%s: %s", Direction, message)
+	message = formatLog(Redact(message), priority)
 	if Verbose {
-		time := ReturnCurrentUTC()
-		fmt.Printf("%s: %s\n", time, message)
-	}
-	switch {
-	case priority == "debug":
-		if os.Getenv("KVEXPRESS_DEBUG") != "" {
-			log.Print(message)
+		if LogFormat == "json" {
+			fmt.Println(message)
+		} else {
+			fmt.Printf("%s: %s\n", ReturnCurrentUTC(), message)
 		}
-	default:
+	}
+	if logEnabled(priority) {
 		log.Print(message)
 	}
 }
 
 // LogFatal prints to screen, sends to syslog, creates a fatal error
-// and stops
+// and stops. It's only for the commands - everything else returns an error.
 func LogFatal(message string, id string, location string) {
 	fullMessage := fmt.Sprintf("%s id:%s location:%s\n", message, id, location)
-	Log(fullMessage, "info")
-	fmt.Printf(fullMessage)
-	StatsdPanic(id, location)
-	// StatsdPanic exists with os.Exit(0)
+	Log(fullMessage, "error")
+	fmt.Print(fullMessage)
+	RunHooks(Hook{Event: HookError, Key: id, Message: message})
+	if DogStatsd || PrometheusEnabled() {
+		StatsdPanic(id, location)
+	}
+	code := fatalExitCode(location)
+	if code == ExitTimeout {
+		StatsdTimeout(id, "consul")
+	}
+	RevokeVaultLease()
+	// If we're going to panic, we might as well stop right here.
+	// Means we can't connect to Consul, download a URL or
+	// write and/or chown files.
+	exitRun(code, processStart, id, location, message)
+}
+
+// ExitOnError is how the commands stop when a function returns an error. A
+// path that isn't safe to write exits ExitError, a read that's too stale
+// exits ExitConsulError and a full or read-only filesystem exits
+// ExitFilesystem - anything else is a LogFatal.
+func ExitOnError(err error, id string, location string) {
+	if err == nil {
+		return
+	}
+	RevokeVaultLease()
+	switch {
+	case errors.Is(err, ErrDirectory), errors.Is(err, ErrNotRegular), errors.Is(err, ErrNotAllowed), errors.Is(err, ErrTooStale):
+		Log(fmt.Sprintf("id='%s' location='%s' message='%v' - stopping.", id, location, err), "error")
+		fmt.Printf("%v - stopping.\n", err)
+		RunHooks(Hook{Event: HookError, Key: id, Message: err.Error()})
+		if errors.Is(err, ErrTooStale) {
+			exitRun(ExitConsulError, processStart, id, location, err.Error())
+		}
+		exitRun(ExitError, processStart, id, location, err.Error())
+	case errors.Is(err, ErrFilesystem):
+		Log(fmt.Sprintf("id='%s' location='%s' message='%v' - stopping.", id, location, err), "error")
+		fmt.Printf("%v - stopping.\n", err)
+		StatsdFilesystem(id, FilesystemReason(err))
+		if DatadogAPIKey != "" && DatadogAPPKey != "" {
+			DDFilesystemEvent(DDAPIConnect(DatadogAPIKey, DatadogAPPKey), id, err.Error())
+		}
+		RunHooks(Hook{Event: HookError, Key: id, Message: err.Error()})
+		exitRun(ExitFilesystem, processStart, id, "filesystem_error", err.Error())
+	case errors.Is(err, ErrKeyOwned):
+		Log(fmt.Sprintf("id='%s' location='%s' message='%v' - stopping.", id, location, err), "info")
+		fmt.Printf("Not updating '%s' - %v.\n", id, err)
+		RunHooks(Hook{Event: HookLock, Key: id, Message: err.Error()})
+		exitRun(ExitLocked, processStart, id, "key_owned", err.Error())
+	case errors.Is(err, ErrCheckFailed):
+		Log(fmt.Sprintf("id='%s' location='%s' message='%v' - stopping.", id, location, err), "error")
+		fmt.Printf("%v - stopping.\n", err)
+		StatsdValidateFailed(id)
+		RunHooks(Hook{Event: HookError, Key: id, Message: err.Error()})
+		exitRun(ExitRejected, processStart, id, "check_failed", err.Error())
+	case errors.Is(err, ErrRunStopped), runCtx.Err() != nil:
+		exitRunStopped(id, fmt.Sprintf("%v - stopping.", err))
+	case errors.Is(err, ErrNoMoreRetries):
+		LogFatal("Panic: Giving up on Consul.", id, "no_more_retries")
+	default:
+		LogFatal(fmt.Sprintf("Panic: %v", err), id, location)
+	}
 }
 
 // GetCurrentUsername grabs the current user running the kvexpress binary.
@@ -86,52 +200,104 @@ func GetCurrentUsername() string {
 	return username
 }
 
-// GetOwnerID looks up the User Id for the owner passed.
-func GetOwnerID(owner string) int {
-	var uid = ""
-	var status = ""
-	usr, err := user.Lookup(owner)
-	if err != nil {
-		usr, err = user.Current()
-		if err != nil {
-			Log("GetOwnerID(): Both user.Lookup and user.Current have failed.", "info")
-		}
-		uid = usr.Uid
-		status = "not_found"
-	} else {
-		uid = usr.Uid
-		status = "found"
+// SplitOwner splits an owner like chown's - "user:group" or ":group". A group
+// is blank when there isn't one.
+func SplitOwner(owner string) (string, string) {
+	if i := strings.Index(owner, ":"); i >= 0 {
+		return owner[:i], owner[i+1:]
 	}
-	Log(fmt.Sprintf("owner='%s' status='%s' uid='%s'", owner, status, uid), "debug")
-	uidInt, err := strconv.ParseInt(uid, 10, 64)
-	if err != nil {
-		Log("GetOwnerID(): Could not convert string into UID.", "info")
+	return owner, ""
+}
+
+// ownerIDs are the uid and gid files are written with for an owner.
+type ownerIDs struct {
+	uid, gid int
+}
+
+var (
+	// ownerCache and groupCache keep the IDs that have been looked up so
+	// writing many files doesn't look them up every time.
+	ownerCache = make(map[string]ownerIDs)
+	groupCache = make(map[string]int)
+	idCacheMu  sync.Mutex
+)
+
+// GetOwnerID looks up the User Id for the owner passed. A numeric owner is
+// used as is - it doesn't have to be in /etc/passwd.
+func GetOwnerID(owner string) int {
+	if id, err := strconv.Atoi(owner); err == nil {
+		Log(fmt.Sprintf("owner='%s' status='numeric' uid='%d'", owner, id), "debug")
+		return id
 	}
-	return int(uidInt)
+	return lookupOwner(owner).uid
 }
 
 // GetGroupID looks up the Group Id for the owner passed.
 func GetGroupID(owner string) int {
-	var gid = ""
-	var status = ""
+	return lookupOwner(owner).gid
+}
+
+// lookupOwner returns the IDs for owner. An owner that doesn't exist yet -
+// like on a host that's still being built - falls back to the user kvexpress
+// runs as with a warning and the owner_not_found metric, so the file is still
+// written. A numeric owner that isn't in /etc/passwd gets the current group.
+func lookupOwner(owner string) ownerIDs {
+	idCacheMu.Lock()
+	defer idCacheMu.Unlock()
+	if ids, ok := ownerCache[owner]; ok {
+		return ids
+	}
+	ids := ownerIDs{uid: os.Getuid(), gid: os.Getgid()}
+	status := "found"
+	_, numeric := strconv.Atoi(owner)
 	usr, err := user.Lookup(owner)
+	if numeric == nil {
+		usr, err = user.LookupId(owner)
+	}
 	if err != nil {
-		usr, err = user.Current()
-		if err != nil {
-			Log("GetGroupID(): Both user.Lookup and user.Current have failed.", "info")
-		}
-		gid = usr.Gid
 		status = "not_found"
+		if numeric != nil {
+			Log(fmt.Sprintf("owner='%s' status='not_found' message='%v' - using the current user.", owner, err), "warn")
+			StatsdOwnerNotFound(owner)
+		}
+		usr, err = user.Current()
+	}
+	if err != nil {
+		Log("lookupOwner(): Both user.Lookup and user.Current have failed.", "info")
 	} else {
-		gid = usr.Gid
-		status = "found"
+		if uid, err := strconv.Atoi(usr.Uid); err == nil {
+			ids.uid = uid
+		}
+		if gid, err := strconv.Atoi(usr.Gid); err == nil {
+			ids.gid = gid
+		}
+	}
+	Log(fmt.Sprintf("owner='%s' status='%s' uid='%d' gid='%d'", owner, status, ids.uid, ids.gid), "debug")
+	ownerCache[owner] = ids
+	return ids
+}
+
+// LookupGroupID looks up the Group Id for a group name - a numeric group is
+// used as is.
+func LookupGroupID(group string) (int, error) {
+	if id, err := strconv.Atoi(group); err == nil {
+		return id, nil
+	}
+	idCacheMu.Lock()
+	defer idCacheMu.Unlock()
+	if gid, ok := groupCache[group]; ok {
+		return gid, nil
 	}
-	Log(fmt.Sprintf("owner='%s' status='%s' gid='%s'", owner, status, gid), "debug")
-	gidInt, err := strconv.ParseInt(gid, 10, 64)
+	grp, err := user.LookupGroup(group)
 	if err != nil {
-		Log("GetGroupID(): Could not convert string into GID.", "info")
+		return 0, fmt.Errorf("could not find group '%s': %v", group, err)
 	}
-	return int(gidInt)
+	Log(fmt.Sprintf("group='%s' status='found' gid='%s'", group, grp.Gid), "debug")
+	gid, err := strconv.Atoi(grp.Gid)
+	if err == nil {
+		groupCache[group] = gid
+	}
+	return gid, err
 }
 
 // CompressData compresses and base64 encodes a string to place into Consul's KV store.
@@ -147,32 +313,16 @@ func CompressData(data string) string {
 }
 
 // DecompressData base64 decodes and decompresses a string taken from Consul's KV store.
-func DecompressData(data string) string {
+func DecompressData(data string) (string, error) {
+	uncompressed, err := kvexpress.Decompress(data)
+	if err != nil {
+		Log(fmt.Sprintf("function='DecompressData' panic='true' message='%v'", err), "info")
+		return "", err
+	}
 	if data != "" {
-		// If it's been compressed, it's been base64 encoded.
-		raw, err := base64.StdEncoding.DecodeString(data)
-		if err != nil {
-			Log("function='DecompressData' panic='true' method='base64.StdEncoding.DecodeString'", "info")
-			fmt.Println("Panic: Could not base64 decode string.")
-			StatsdPanic("key", "DecompressData")
-		}
-		// gunzip the string.
-		unzipped, err := gzip.NewReader(strings.NewReader(string(raw)))
-		if err != nil {
-			Log("function='DecompressData' panic='true' method='gzip.NewReader'", "info")
-			fmt.Println("Panic: Could not gunzip string.")
-			StatsdPanic("key", "DecompressData")
-		}
-		uncompressed, err := ioutil.ReadAll(unzipped)
-		if err != nil {
-			Log("function='DecompressData' panic='true' method='ioutil.ReadAll'", "info")
-			fmt.Println("Panic: Could not ioutil.ReadAll string.")
-			StatsdPanic("key", "DecompressData")
-		}
 		Log(fmt.Sprintf("decompressing='true' size='%d'", len(uncompressed)), "info")
-		return string(uncompressed)
 	}
-	return ""
+	return uncompressed, nil
 }
 
 // GetHostname returns the hostname.
@@ -190,17 +340,109 @@ func AutoEnable() {
 	if ConfigFile != "" {
 		LoadConfig(ConfigFile)
 	}
+	// The host's policy applies whatever the config says.
+	loadPolicy()
+	// The secrets apply passes to the commands it runs.
+	SecretEnv(RootCmd.PersistentFlags())
+	// The Consul CLI environment variables are used for anything not passed as a flag.
+	ConsulEnv(RootCmd.PersistentFlags())
+	// The config can use ${VAR} too.
+	if err := ExpandFlags(RootCmd.PersistentFlags()); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := SetupRedaction(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := SetupOutput(); err != nil {
+		fmt.Printf("Could not setup the output: %v\n", err)
+		os.Exit(1)
+	}
+	if err := SetupLogging(); err != nil {
+		fmt.Printf("Could not setup logging: %v\n", err)
+		os.Exit(1)
+	}
+	if err := SetupAudit(); err != nil {
+		fmt.Printf("Could not read --audit-key-file: %v\n", err)
+		os.Exit(1)
+	}
+	if ConsulRate < 0 {
+		fmt.Println("Need a --consul-rate that's 0 or more")
+		os.Exit(1)
+	}
+	if TmpDir != "" {
+		if info, err := os.Stat(TmpDir); err != nil || !info.IsDir() {
+			fmt.Printf("--tmp-dir '%s' is not a directory.\n", TmpDir)
+			os.Exit(1)
+		}
+	}
+	HandleStopSignals()
+	// lint never talks to Consul - it doesn't have to wait its turn or get a token.
+	offline := Direction == "lint"
+	if !offline {
+		SplaySleep()
+	}
+	StartDeadline()
+	if !offline {
+		if err := SetupToken(); err != nil {
+			fmt.Printf("Could not get the Consul token: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if err := ValidateHashes(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := SetupKeyTemplate(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := SetupConsistency(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := SetupRunAs(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := SetupBackend(); err != nil {
+		fmt.Printf("Could not setup the backend: %v\n", err)
+		os.Exit(1)
+	}
+	if err := SetupEncryption(); err != nil {
+		fmt.Printf("Could not setup encryption: %v\n", err)
+		os.Exit(1)
+	}
+	if err := SetupProxy(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := SetupDatadog(); err != nil {
+		fmt.Printf("Could not setup Datadog: %v\n", err)
+		os.Exit(1)
+	}
+	if err := SetupTracing(); err != nil {
+		fmt.Printf("Could not setup tracing: %v\n", err)
+		os.Exit(1)
+	}
 	// Check for dd-agent configuration file.
 	if _, err := os.Stat("/etc/dd-agent/datadog.conf"); err == nil {
 		DogStatsd = true
 	}
+	// --no-stats wins over the agent - and without an address there's nowhere to send them.
+	if NoStats || DogStatsdAddress == "" {
+		DogStatsd = false
+	}
 	if Owner == "" {
 		Owner = GetCurrentUsername()
 	}
 	if DogStatsd {
 		Log("Enabling Dogstatsd metrics.", "debug")
+		CheckMetricNames()
 	}
 	if DatadogAPIKey != "" && DatadogAPPKey != "" {
 		Log("Enabling Datadog API.", "debug")
 	}
+	CheckRequiredVersion()
 }
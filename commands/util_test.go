@@ -3,6 +3,10 @@
 package commands
 
 import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
 	"testing"
 )
 
@@ -17,15 +21,107 @@ func TestCompressData(t *testing.T) {
 }
 
 func TestDecompressData(t *testing.T) {
-	decompressed := DecompressData(compressedTestData)
-	if decompressed != testData {
+	decompressed, err := DecompressData(compressedTestData)
+	if err != nil || decompressed != testData {
 		t.Error("The decompression is off.")
 	}
 }
 
 func TestDecompressBlankData(t *testing.T) {
-	blank := DecompressData("")
-	if blank != "" {
+	blank, err := DecompressData("")
+	if err != nil || blank != "" {
 		t.Error("The decompression isn't working with blank input.")
 	}
 }
+
+func TestDecompressBadData(t *testing.T) {
+	if _, err := DecompressData("not base64!"); err == nil {
+		t.Error("Data that isn't base64 should return an error.")
+	}
+}
+
+func TestSetRunID(t *testing.T) {
+	defer func() { RunID = "" }()
+	RunID = "passed-in"
+	SetRunID()
+	if RunID != "passed-in" {
+		t.Errorf("A passed --run-id should be kept: '%s'", RunID)
+	}
+	RunID = ""
+	SetRunID()
+	if len(RunID) != 16 || RunID == GenerateRunID() {
+		t.Errorf("A random RunID should be generated: '%s'", RunID)
+	}
+}
+
+func TestRunIDInLogsNotMetrics(t *testing.T) {
+	defer func() { RunID = "" }()
+	RunID = "abcd1234"
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	conn := listenStatsd(t)
+
+	Log("testing='true'", "info")
+	StatsdOut("testing")
+
+	if !strings.Contains(logs.String(), "run_id='abcd1234' testing='true'") {
+		t.Errorf("The RunID is missing from the log: '%s'", logs.String())
+	}
+	if lines := strings.Join(readStatsd(conn), " "); !strings.Contains(lines, "kvexpress.") || strings.Contains(lines, "run_id") {
+		t.Errorf("The RunID shouldn't be a metric tag: '%s'", lines)
+	}
+}
+
+func TestGetOwnerIDNumeric(t *testing.T) {
+	if uid := GetOwnerID("1001"); uid != 1001 {
+		t.Errorf("A numeric owner should be used as is, got %d", uid)
+	}
+}
+
+func TestGetOwnerIDMissing(t *testing.T) {
+	delete(ownerCache, "kvexpress-no-such-user")
+	if uid, gid := GetOwnerID("kvexpress-no-such-user"), GetGroupID("kvexpress-no-such-user"); uid != os.Getuid() || gid != os.Getgid() {
+		t.Errorf("A missing owner should fall back to the current user, got %d %d", uid, gid)
+	}
+	if _, ok := ownerCache["kvexpress-no-such-user"]; !ok {
+		t.Error("The lookup should be cached.")
+	}
+}
+
+func TestGetOwnerIDCurrent(t *testing.T) {
+	name := GetCurrentUsername()
+	delete(ownerCache, name)
+	if uid, gid := GetOwnerID(name), GetGroupID(name); uid != os.Getuid() || gid != os.Getgid() {
+		t.Errorf("The current user should be found, got %d %d", uid, gid)
+	}
+	if ids, ok := ownerCache[name]; !ok || ids.uid != os.Getuid() {
+		t.Errorf("The lookup should be cached: %+v", ids)
+	}
+}
+
+func TestSplitOwner(t *testing.T) {
+	for owner, want := range map[string][2]string{
+		"www-data":     {"www-data", ""},
+		"www-data:www": {"www-data", "www"},
+		":www":         {"", "www"},
+		"1001:2002":    {"1001", "2002"},
+		"":             {"", ""},
+	} {
+		if name, group := SplitOwner(owner); name != want[0] || group != want[1] {
+			t.Errorf("'%s' should split into %q, got %q %q", owner, want, name, group)
+		}
+	}
+}
+
+func TestLookupGroupID(t *testing.T) {
+	if gid, err := LookupGroupID("2002"); err != nil || gid != 2002 {
+		t.Errorf("A numeric group should be used as is, got %d %v", gid, err)
+	}
+	if gid, err := LookupGroupID("root"); err != nil || gid != 0 {
+		t.Errorf("root should be gid 0, got %d %v", gid, err)
+	}
+	if _, err := LookupGroupID("kvexpress-no-such-group"); err == nil {
+		t.Error("A group that doesn't exist should be an error.")
+	}
+}
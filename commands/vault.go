@@ -0,0 +1,51 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// VaultSecrets reads every secret in paths from Vault's KV engine and puts
+// their values together - a value in a later path replaces an earlier one.
+// It uses the same Vault server and token as --encrypt-vault, so a Vault
+// agent that adds the token works without one.
+func VaultSecrets(paths []string) (map[string]string, error) {
+	addr, token := vaultConfig()
+	client := cancelClient(&http.Client{Timeout: 10 * time.Second})
+	secrets := make(map[string]string)
+	for _, path := range paths {
+		var resp struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		path = strings.Trim(path, "/")
+		if err := vaultCall(client, addr, token, "GET", path, nil, &resp); err != nil {
+			return nil, err
+		}
+		data := resp.Data
+		// Version 2 of the engine wraps the secret with its metadata.
+		if inner, ok := data["data"].(map[string]interface{}); ok {
+			if _, ok := data["metadata"]; ok {
+				data = inner
+			}
+		}
+		if len(data) == 0 {
+			return nil, fmt.Errorf("there's no secret at '%s'", path)
+		}
+		for name, value := range data {
+			switch value := value.(type) {
+			case string:
+				secrets[name] = value
+			default:
+				encoded, _ := json.Marshal(value)
+				secrets[name] = string(encoded)
+			}
+		}
+		Log(fmt.Sprintf("vault path='%s' secrets='%d'", path, len(data)), "debug")
+	}
+	return secrets, nil
+}
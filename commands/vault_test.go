@@ -0,0 +1,60 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVaultSecrets(t *testing.T) {
+	var tokens []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens = append(tokens, r.Header.Get("X-Vault-Token"))
+		switch r.URL.Path {
+		case "/v1/secret/data/app":
+			w.Write([]byte(`{"data":{"data":{"password":"hunter2","port":5432},"metadata":{"version":3}}}`))
+		case "/v1/legacy/app":
+			w.Write([]byte(`{"data":{"password":"from-v1","user":"app"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+	defer server.Close()
+	t.Setenv("VAULT_TOKEN", "")
+	VaultAddr, VaultToken = server.URL, "vault-token"
+	defer func() { VaultAddr, VaultToken, outSecrets = "", "", nil }()
+
+	secrets, err := VaultSecrets([]string{"legacy/app", "/secret/data/app"})
+	if err != nil || len(secrets) != 3 || secrets["password"] != "hunter2" || secrets["port"] != "5432" || secrets["user"] != "app" {
+		t.Fatalf("Both secrets should be put together: %v %v", secrets, err)
+	}
+	if _, err := VaultSecrets([]string{"secret/data/missing"}); err == nil {
+		t.Error("A secret that isn't there should be an error.")
+	}
+
+	// A Vault agent adds the token itself.
+	VaultToken, tokens = "", nil
+	if _, err := VaultSecrets([]string{"legacy/app"}); err != nil || len(tokens) != 1 || tokens[0] != "" {
+		t.Errorf("There shouldn't be a token header without a token: %v %v", tokens, err)
+	}
+
+	file := ensureTestFile(t)
+	_, c := newTestConsul(t)
+	ioutil.WriteFile(file, []byte(`password={{ vault "password" }}`), 0640)
+	tmpl, err := ParseTemplate(file)
+	if err != nil {
+		t.Fatalf("The template should parse: %v", err)
+	}
+	outSecrets = secrets
+	if rendered, err := RenderTemplate(c, tmpl, "app", ""); err != nil || rendered != "password=hunter2" {
+		t.Errorf("The secret should be in the file: %q %v", rendered, err)
+	}
+	outSecrets = nil
+	if _, err := RenderTemplate(c, tmpl, "app", ""); err == nil {
+		t.Error("A secret that wasn't read should be an error.")
+	}
+}
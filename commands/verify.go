@@ -0,0 +1,154 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// VerifyFileDrift is the exit status when the file doesn't match the checksum.
+	VerifyFileDrift = 1
+
+	// VerifyDataMismatch is the exit status when the data in the key doesn't
+	// match the checksum - with a drifted file too it's 3.
+	VerifyDataMismatch = 2
+
+	// VerifyError is the exit status when the key couldn't be checked.
+	VerifyError = 4
+)
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Check that a key and a file match their checksum.",
+	Long:  `Verify is for monitoring - it checks the checksum key against the data and the file without writing anything.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		checkVerifyFlags()
+		AutoEnable()
+	},
+	Run: verifyRun,
+}
+
+func verifyRun(cmd *cobra.Command, args []string) {
+	start := time.Now()
+
+	c, err := Connect(ConsulServer, Token)
+	if err != nil {
+		fmt.Printf("Could not connect to Consul: %v\n", err)
+		exitRun(VerifyError, start, KeyVerifyLocation, "consul_connect", err.Error())
+	}
+	result, err := Verify(c, KeyVerifyLocation, FiletoVerify)
+	if err != nil {
+		Log(fmt.Sprintf("verify key='%s' message='%v'", KeyVerifyLocation, err), "info")
+		fmt.Printf("Could not verify '%s': %v\n", KeyVerifyLocation, err)
+		StatsdVerify(KeyVerifyLocation, VerifyError)
+		exitRun(VerifyError, start, KeyVerifyLocation, "verify_error", err.Error())
+	}
+	fmt.Printf("checksum: %s\ndata:     %s %s\nfile:     %s %s\n", result.Stored, result.Data, verifyLabel(result.DataMatches), result.File, verifyLabel(result.FileMatches))
+	status := result.Status()
+	Log(fmt.Sprintf("verify key='%s' file='%s' data_matches='%t' file_matches='%t' status='%d'", KeyVerifyLocation, FiletoVerify, result.DataMatches, result.FileMatches, status), "info")
+	StatsdVerify(KeyVerifyLocation, status)
+	RecordResult(0, result.Stored, FiletoVerify)
+	RecordDetails(result)
+	exitRun(status, start, KeyVerifyLocation, "verify", "")
+}
+
+// VerifyResult is the checksum key and the checksums of the data and the file.
+type VerifyResult struct {
+	Stored      string `json:"checksum"`
+	Data        string `json:"data"`
+	File        string `json:"file"`
+	DataMatches bool   `json:"data_matches"`
+	FileMatches bool   `json:"file_matches"`
+}
+
+// Status is the exit status for the result - 0 if everything matches.
+func (r VerifyResult) Status() int {
+	status := 0
+	if !r.FileMatches {
+		status |= VerifyFileDrift
+	}
+	if !r.DataMatches {
+		status |= VerifyDataMismatch
+	}
+	return status
+}
+
+// Verify compares the checksum key for key with the checksums of the decoded
+// data and the file. A file that doesn't exist doesn't match.
+func Verify(c *consul.Client, key, file string) (VerifyResult, error) {
+	var result VerifyResult
+	stored, err := GetChecksum(c, key)
+	if err != nil {
+		return result, err
+	}
+	result.Stored = strings.TrimSpace(stored)
+	if result.Stored == "" {
+		return result, fmt.Errorf("there's no checksum for '%s'", key)
+	}
+	data, err := GetData(c, key)
+	if err != nil {
+		return result, err
+	}
+	if data, err = DecodeData(c, key, data); err != nil {
+		return result, err
+	}
+	result.Data = ChecksumAs(data, result.Stored)
+	result.DataMatches = result.Data == result.Stored
+
+	info, err := os.Stat(file)
+	switch {
+	case os.IsNotExist(err):
+		result.File = "missing"
+	case err != nil:
+		return result, err
+	case info.IsDir():
+		return result, fmt.Errorf("can not verify '%s': %w", file, ErrDirectory)
+	case !info.Mode().IsRegular():
+		return result, fmt.Errorf("can not verify '%s' - it's a %s: %w", file, fileType(info.Mode()), ErrNotRegular)
+	default:
+		result.File = ChecksumAs(ReadFile(file), result.Stored)
+		result.FileMatches = result.File == result.Stored
+	}
+	return result, nil
+}
+
+// verifyLabel is how a match is shown in the report.
+func verifyLabel(matches bool) string {
+	if matches {
+		return "ok"
+	}
+	return "MISMATCH"
+}
+
+func checkVerifyFlags() {
+	Log("Checking cli flags.", "debug")
+	if KeyVerifyLocation == "" {
+		fmt.Println("Need a key location in -k")
+		os.Exit(VerifyError)
+	}
+	if FiletoVerify == "" {
+		fmt.Println("Need a file to verify in -f")
+		os.Exit(VerifyError)
+	}
+	Log("Required cli flags present.", "debug")
+}
+
+var (
+	// KeyVerifyLocation is the key to verify.
+	KeyVerifyLocation string
+
+	// FiletoVerify is the file to verify against the key.
+	FiletoVerify string
+)
+
+func init() {
+	RootCmd.AddCommand(verifyCmd)
+	verifyCmd.Flags().StringVarP(&KeyVerifyLocation, "key", "k", "", "key to verify")
+	verifyCmd.Flags().StringVarP(&FiletoVerify, "file", "f", "", "file to verify against the key")
+}
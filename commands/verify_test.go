@@ -0,0 +1,40 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	file := ensureTestFile(t)
+	tc, c := newTestConsul(t)
+	tc.put("testing/hosts/data", exampleData)
+	tc.put("testing/hosts/checksum", exampleDataSHA)
+
+	os.Remove(file)
+	result, err := Verify(c, "hosts", file)
+	if err != nil || !result.DataMatches || result.FileMatches || result.Status() != VerifyFileDrift {
+		t.Errorf("A missing file has drifted: %+v %v", result, err)
+	}
+
+	ioutil.WriteFile(file, []byte(exampleData), 0640)
+	if result, err := Verify(c, "hosts", file); err != nil || result.Status() != 0 {
+		t.Errorf("The key and file should match: %+v %v", result, err)
+	}
+
+	tc.put("testing/hosts/data", "changed")
+	if result, err := Verify(c, "hosts", file); err != nil || result.Status() != VerifyDataMismatch {
+		t.Errorf("The data doesn't match the checksum: %+v %v", result, err)
+	}
+	ioutil.WriteFile(file, []byte("changed"), 0640)
+	if result, _ := Verify(c, "hosts", file); result.Status() != VerifyFileDrift|VerifyDataMismatch {
+		t.Errorf("Neither match the checksum: %+v", result)
+	}
+
+	if _, err := Verify(c, "missing", file); err == nil {
+		t.Error("A key without a checksum should be an error.")
+	}
+}
@@ -0,0 +1,464 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"errors"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/spf13/cobra"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var watchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Watch a kvexpress key and write a file every time it changes.",
+	Long:  `Watch is a long running version of out - it uses Consul blocking queries to write the file as soon as the key changes.`,
+	PreRun: func(cmd *cobra.Command, args []string) {
+		checkWatchFlags()
+		AutoEnable()
+	},
+	Run: watchRun,
+}
+
+func watchRun(cmd *cobra.Command, args []string) {
+	// The Vault token is revoked when watch stops, not after every write.
+	keepVaultLease = true
+	c, err := Connect(ConsulServer, Token)
+	if err != nil {
+		LogFatal("Could not connect to Consul.", KeyWatchLocation, "consul_connect")
+	}
+	if MetricsListen != "" {
+		PromListen(MetricsListen)
+	}
+
+	state := &WatchState{Key: KeyWatchLocation, File: FiletoWatch, Started: time.Now()}
+	handleWatchSignals(c, state)
+	if watchdog := WatchdogInterval(); watchdog > 0 {
+		// Every blocking query has to come back before systemd gives up on us.
+		if WatchWait > watchdog/3 {
+			WatchWait = watchdog / 3
+			Log(fmt.Sprintf("watch watchdog='%s' wait='%s'", watchdog, WatchWait), "info")
+		}
+		go petWatchdog(state, watchdog)
+	}
+	if WatchMetricsInterval > 0 {
+		go sendWatchFreshness(state, WatchMetricsInterval)
+	}
+	if WatchService != "" {
+		ExitOnError(RegisterWatchCheck(c, state), KeyWatchLocation, "consul_service_register")
+		go updateWatchCheck(c, state)
+	}
+
+	var index uint64
+	var ready bool
+	for {
+		var written bool
+		previous := index
+		index, written, err = WatchOnce(c, KeyWatchLocation, FiletoWatch, index)
+		// SIGTERM cancelled the blocking query - the file is never half written.
+		if errors.Is(err, ErrRunStopped) {
+			Log(fmt.Sprintf("watch key='%s' signal='%s' - stopping.", KeyWatchLocation, stopSignal), "info")
+			sdNotify("STOPPING=1")
+			deregisterWatch(c, state)
+			if !waitWebhooks(stopGrace) {
+				Log(fmt.Sprintf("watch key='%s' - stopping before every webhook was sent.", KeyWatchLocation), "info")
+			}
+			RunTime(state.Started, KeyWatchLocation, "watch_stopped")
+			return
+		}
+		if errors.Is(err, ErrNoMoreRetries) {
+			deregisterWatch(c, state)
+			ExitOnError(err, KeyWatchLocation, "watch")
+		}
+		state.Update(index, written)
+		// Consul answered even if the change couldn't be written - the watchdog
+		// and READY=1 are about reaching Consul, a bad change is retried.
+		render := errors.Is(err, ErrWatchRender)
+		if err == nil || render {
+			state.Contacted()
+			if !ready {
+				sdNotify(fmt.Sprintf("READY=1\nSTATUS=Watching %s", KeyWatchLocation))
+				ready = true
+			}
+		}
+		if err != nil {
+			state.Failed(err, render)
+			Log(fmt.Sprintf("watch key='%s' error='%v'", KeyWatchLocation, err), "info")
+			RunHooks(Hook{Event: HookError, Key: KeyWatchLocation, File: FiletoWatch, Message: err.Error()})
+			continue
+		}
+		if index > previous {
+			state.Rendered()
+			// The age of the data is how long since it was saved upstream.
+			if updated, err := Get(c, KeyPath(KeyWatchLocation, "updated")); err == nil {
+				state.KeyUpdated(updated)
+			}
+		}
+		// Run this command only when the file was actually rewritten.
+		if written && PostExec != "" {
+			Log(fmt.Sprintf("exec='%s'", PostExec), "debug")
+			RunPostExec(PostExec)
+		}
+		if written {
+			RunHooks(Hook{Event: HookChange, Key: KeyWatchLocation, File: FiletoWatch})
+		}
+	}
+}
+
+// petWatchdog tells systemd that watch is alive every half interval - as long as
+// Consul has answered within the interval. If it hasn't the watchdog runs out
+// and systemd restarts kvexpress.
+func petWatchdog(state *WatchState, interval time.Duration) {
+	for range time.Tick(interval / 2) {
+		if since := state.SinceContact(); since > interval {
+			Log(fmt.Sprintf("watch key='%s' last_contact='%s' watchdog='stopped'", state.Key, since.Round(time.Second)), "info")
+			continue
+		}
+		sdNotify("WATCHDOG=1")
+	}
+}
+
+// watchWrite stops a SIGHUP render and a change from writing the file at the
+// same time.
+var watchWrite sync.Mutex
+
+// WatchState is what watch has done so far - it's logged on SIGUSR1.
+type WatchState struct {
+	sync.Mutex
+	Key       string
+	File      string
+	Index     uint64
+	Started   time.Time
+	LastWrite time.Time
+	Writes    int
+
+	// LastContact is the last time a blocking query came back from Consul.
+	LastContact time.Time
+
+	// ContactError is why the last blocking query failed - it's cleared
+	// when Consul answers again.
+	ContactError string
+
+	// RenderError is why the last change couldn't be written - it's cleared
+	// when a change is written or the data is already in the file.
+	RenderError string
+
+	// LastRender is the last time a change was written or was already in
+	// the file.
+	LastRender time.Time
+
+	// Updated is the key's updated time when it was last rendered.
+	Updated time.Time
+}
+
+// Update saves the index watch is waiting on and counts a write.
+func (s *WatchState) Update(index uint64, written bool) {
+	s.Lock()
+	s.Index = index
+	s.Unlock()
+	if written {
+		s.Wrote()
+	}
+}
+
+// Contacted is called every time Consul answers a blocking query.
+func (s *WatchState) Contacted() {
+	s.Lock()
+	defer s.Unlock()
+	s.LastContact = time.Now()
+	s.ContactError = ""
+}
+
+// Failed saves why watch couldn't reach Consul - or with render why the
+// change couldn't be written.
+func (s *WatchState) Failed(err error, render bool) {
+	s.Lock()
+	defer s.Unlock()
+	if render {
+		s.RenderError = err.Error()
+	} else {
+		s.ContactError = err.Error()
+	}
+}
+
+// Rendered is called when a change was written or didn't need to be.
+func (s *WatchState) Rendered() {
+	s.Lock()
+	defer s.Unlock()
+	s.RenderError = ""
+	s.LastRender = time.Now()
+}
+
+// KeyUpdated saves the RFC3339 time from the key's updated key - it's left
+// alone if it can't be parsed.
+func (s *WatchState) KeyUpdated(updated string) {
+	updatedTime, err := time.Parse(time.RFC3339, strings.TrimSpace(updated))
+	if err != nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.Updated = updatedTime
+}
+
+// WatchFreshness is how fresh the file is - a value that isn't known yet is
+// -1.
+type WatchFreshness struct {
+	SinceRender time.Duration
+	Age         time.Duration
+	Bytes       int64
+}
+
+// Freshness is how long since the file was rendered, how long since the
+// data was saved and how big the file is now.
+func (s *WatchState) Freshness(now time.Time) WatchFreshness {
+	s.Lock()
+	defer s.Unlock()
+	freshness := WatchFreshness{SinceRender: -1, Age: -1, Bytes: -1}
+	if !s.LastRender.IsZero() {
+		freshness.SinceRender = now.Sub(s.LastRender)
+	}
+	if !s.Updated.IsZero() {
+		freshness.Age = now.Sub(s.Updated)
+	}
+	if info, err := os.Stat(s.File); err == nil {
+		freshness.Bytes = info.Size()
+	}
+	return freshness
+}
+
+// sendWatchFreshness sends the freshness gauges every interval - so a
+// dashboard shows a file that's falling behind even when nothing changes.
+func sendWatchFreshness(state *WatchState, interval time.Duration) {
+	for range time.Tick(interval) {
+		StatsdFreshness(state.Key, state.File, state.Freshness(time.Now()))
+	}
+}
+
+// SinceContact is how long it's been since Consul last answered - or since
+// watch started if it never has.
+func (s *WatchState) SinceContact() time.Duration {
+	s.Lock()
+	defer s.Unlock()
+	if s.LastContact.IsZero() {
+		return time.Since(s.Started)
+	}
+	return time.Since(s.LastContact)
+}
+
+// Wrote counts a write of the file.
+func (s *WatchState) Wrote() {
+	s.Lock()
+	defer s.Unlock()
+	s.LastWrite = time.Now()
+	s.Writes++
+}
+
+// String is the state as a log line.
+func (s *WatchState) String() string {
+	s.Lock()
+	defer s.Unlock()
+	lastWrite := "never"
+	if !s.LastWrite.IsZero() {
+		lastWrite = s.LastWrite.UTC().Format(time.RFC3339)
+	}
+	return fmt.Sprintf("watch key='%s' file='%s' index='%d' writes='%d' last_write='%s' uptime='%s'", s.Key, s.File, s.Index, s.Writes, lastWrite, time.Since(s.Started).Round(time.Second))
+}
+
+// WatchRender fetches the key and writes the file right away if it's changed -
+// it's what SIGHUP does. A stop key or a lock is still honored.
+func WatchRender(c *consul.Client, key, file string) (bool, error) {
+	start := time.Now()
+	watchWrite.Lock()
+	defer watchWrite.Unlock()
+	StopKeyData, err := Get(c, KeyPath(key, "stop"))
+	if err != nil {
+		return false, err
+	}
+	if StopKeyData != "" {
+		Log(fmt.Sprintf("Stop Key is present - not writing. Reason: %s", StopKeyData), "info")
+		return false, nil
+	}
+	// The file is only read again for the checksums when there's a webhook.
+	var old string
+	if WatchWebhook != "" {
+		old = fileChecksum(file)
+	}
+	written, err := EnsureConsumer(c, key, file)
+	if err != nil {
+		return false, err
+	}
+	if written {
+		RunTime(start, key, "watch_write")
+		StatsdWatchEvent(key, file)
+		if WatchWebhook != "" {
+			notifyWebhook(WebhookChange{Event: HookChange, Host: GetHostname(), Key: key, File: file, OldChecksum: old, NewChecksum: fileChecksum(file), Timestamp: ReturnCurrentUTC(), RunID: RunID})
+		}
+	}
+	return written, nil
+}
+
+// ErrWatchRender wraps an error writing a change - Consul answered.
+var ErrWatchRender = errors.New("could not write the change")
+
+// watchRenderError is an ErrWatchRender for err - errors.Is sees both.
+type watchRenderError struct {
+	err error
+}
+
+func (e watchRenderError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrWatchRender, e.err)
+}
+
+func (e watchRenderError) Is(target error) bool {
+	return target == ErrWatchRender
+}
+
+func (e watchRenderError) Unwrap() error {
+	return e.err
+}
+
+// WatchOnce blocks until the key changes after index, then writes the file if
+// the data is valid and different. It returns the index to wait on next and
+// whether the file was written - an error writing it is an ErrWatchRender. Anything underneath the key is watched so a
+// checksum that's saved after the data is still seen.
+func WatchOnce(c *consul.Client, key, file string, index uint64) (uint64, bool, error) {
+	// Staged data that becomes active during the wait is written on time.
+	wait := WatchWait
+	activate := stagedWake(c, key, wait)
+	if !activate.IsZero() {
+		wait = time.Until(activate)
+		if wait < time.Second {
+			wait = time.Second
+		}
+	}
+	newIndex, err := Wait(c, KeyRoot(key), index, wait)
+	if err != nil {
+		return index, false, err
+	}
+	switch {
+	case newIndex == index && !activate.IsZero():
+		if !sleepRun(time.Until(activate)) {
+			return index, false, ErrRunStopped
+		}
+		Log(fmt.Sprintf("watch key='%s' activate_at='%s' - writing the staged data.", key, activate.Format(time.RFC3339)), "info")
+	case newIndex == index:
+		Log(fmt.Sprintf("watch key='%s' index='%d' changed='false'", key, index), "debug")
+		return index, false, nil
+	case newIndex < index:
+		// The index can go backwards if Consul's state is restored - start over.
+		Log(fmt.Sprintf("watch key='%s' index='%d' newIndex='%d' reset='true'", key, index, newIndex), "info")
+		return 0, false, nil
+	default:
+		Log(fmt.Sprintf("watch key='%s' index='%d' newIndex='%d' changed='true'", key, index, newIndex), "info")
+	}
+
+	// Spread the writes out so the whole fleet doesn't reload at once.
+	if WatchJitter > 0 && !sleepRun(time.Duration(rand.Int63n(int64(WatchJitter)))) {
+		return index, false, ErrRunStopped
+	}
+
+	written, err := WatchRender(c, key, file)
+	if err != nil {
+		return newIndex, written, watchRenderError{err}
+	}
+	return newIndex, written, nil
+}
+
+func checkWatchFlags() {
+	Log("Checking cli flags.", "debug")
+	if KeyWatchLocation == "" {
+		fmt.Println("Need a key location in -k")
+		os.Exit(1)
+	}
+	if FiletoWatch == "" {
+		fmt.Println("Need a file to write in -f")
+		os.Exit(1)
+	}
+	if WatchWait <= 0 {
+		fmt.Println("Need a --wait that's more than 0")
+		os.Exit(1)
+	}
+	if !canWait() {
+		fmt.Printf("watch needs Consul blocking queries or Redis pub/sub and can't be used with --backend %s\n", Backend)
+		os.Exit(1)
+	}
+	if WatchService != "" && WatchCheckTTL <= 0 {
+		fmt.Println("Need a --check-ttl that's more than 0")
+		os.Exit(1)
+	}
+	if WatchService != "" && WatchStaleAfter <= WatchWait {
+		fmt.Println("Need a --stale-after that's longer than --wait")
+		os.Exit(1)
+	}
+	if WatchWebhook != "" && !strings.HasPrefix(WatchWebhook, "http://") && !strings.HasPrefix(WatchWebhook, "https://") {
+		fmt.Println("Need an http:// or https:// URL in --webhook")
+		os.Exit(1)
+	}
+	if WatchWebhook != "" && WatchWebhookTimeout <= 0 {
+		fmt.Println("Need a --webhook-timeout that's more than 0")
+		os.Exit(1)
+	}
+	for _, header := range WatchWebhookHeaders {
+		if _, _, err := parseWebhookHeader(header); err != nil {
+			fmt.Printf("Need a 'Name: value' header in --webhook-header: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	ExitOnError(CheckAllowedDir(FiletoWatch), FiletoWatch, "check_flags")
+	rand.Seed(time.Now().UnixNano())
+	Log("Required cli flags present.", "debug")
+}
+
+var (
+	// KeyWatchLocation is the key to watch for changes.
+	KeyWatchLocation string
+
+	// FiletoWatch is the file that's written every time the key changes.
+	FiletoWatch string
+
+	// WatchWait is the longest a single blocking query waits for a change.
+	WatchWait time.Duration
+
+	// WatchJitter is the most time to wait after a change before writing.
+	WatchJitter time.Duration
+
+	// MetricsListen is the address to serve Prometheus metrics on.
+	MetricsListen string
+
+	// WatchService is the Consul service to register with a TTL check that
+	// shows whether watch is working.
+	WatchService string
+
+	// WatchCheckTTL is how long the check stays passing without an update.
+	WatchCheckTTL time.Duration
+
+	// WatchStaleAfter is how long watch can go without hearing from Consul
+	// before the check is critical.
+	WatchStaleAfter time.Duration
+
+	// WatchMetricsInterval is how often the freshness gauges are sent - 0
+	// doesn't send them.
+	WatchMetricsInterval time.Duration
+)
+
+func init() {
+	RootCmd.AddCommand(watchCmd)
+	watchCmd.Flags().StringVarP(&KeyWatchLocation, "key", "k", "", "key to watch")
+	watchCmd.Flags().StringVarP(&FiletoWatch, "file", "f", "", "where to write the data")
+	watchCmd.Flags().DurationVarP(&WatchWait, "wait", "w", 5*time.Minute, "how long each blocking query waits for a change")
+	watchCmd.Flags().DurationVarP(&WatchJitter, "jitter", "j", 0, "random wait up to this long before writing a change")
+	watchCmd.Flags().StringVarP(&MetricsListen, "metrics-listen", "", "", "serve Prometheus metrics on this address - :9123")
+	watchCmd.Flags().DurationVarP(&WatchMetricsInterval, "metrics-interval", "", time.Minute, "how often to send the file freshness gauges - 0 for never")
+	watchCmd.Flags().StringVarP(&WatchService, "service", "", "", "register a Consul service with this name and a TTL check for watch")
+	watchCmd.Flags().DurationVarP(&WatchCheckTTL, "check-ttl", "", time.Minute, "how long the --service check stays passing without an update")
+	watchCmd.Flags().DurationVarP(&WatchStaleAfter, "stale-after", "", 15*time.Minute, "the --service check is critical after this long without an answer from Consul")
+	watchCmd.Flags().StringVarP(&WatchWebhook, "webhook", "", "", "POST a JSON change notice to this URL every time the file is written")
+	watchCmd.Flags().StringArrayVarP(&WatchWebhookHeaders, "webhook-header", "", []string{}, "header to send with the webhook - 'Name: value' (repeatable)")
+	watchCmd.Flags().DurationVarP(&WatchWebhookTimeout, "webhook-timeout", "", 10*time.Second, "how long each try at the webhook can take")
+}
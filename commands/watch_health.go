@@ -0,0 +1,102 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"strings"
+	"time"
+)
+
+// watchServiceID is the service ID for a key - more than one watch can
+// register the same --service on a node.
+func watchServiceID(service, key string) string {
+	return fmt.Sprintf("%s-%s", service, strings.Replace(strings.Trim(key, "/"), "/", "-", -1))
+}
+
+// watchCheckID is the ID of the TTL check for the service.
+func watchCheckID(serviceID string) string {
+	return "service:" + serviceID
+}
+
+// RegisterWatchCheck registers --service with the local Consul agent with a
+// TTL check that watch keeps up to date. If watch stops updating it the check
+// goes critical once the TTL runs out.
+func RegisterWatchCheck(c *consul.Client, state *WatchState) error {
+	id := watchServiceID(WatchService, state.Key)
+	service := &consul.AgentServiceRegistration{
+		ID:   id,
+		Name: WatchService,
+		Tags: []string{"kvexpress"},
+		Meta: map[string]string{"key": state.Key, "file": state.File},
+		Check: &consul.AgentServiceCheck{
+			CheckID: watchCheckID(id),
+			Name:    fmt.Sprintf("kvexpress watch %s", state.Key),
+			TTL:     WatchCheckTTL.String(),
+			Notes:   fmt.Sprintf("Critical when %s can't be written or Consul hasn't answered for %s.", state.File, WatchStaleAfter),
+			Status:  consul.HealthCritical,
+		},
+	}
+	if err := c.Agent().ServiceRegister(service); err != nil {
+		return fmt.Errorf("could not register the '%s' service: %v", WatchService, err)
+	}
+	Log(fmt.Sprintf("watch service='%s' id='%s' ttl='%s'", WatchService, id, WatchCheckTTL), "info")
+	return nil
+}
+
+// DeregisterWatchCheck removes the --service that RegisterWatchCheck
+// registered and its check - a watch that was stopped on purpose shouldn't
+// leave a critical service behind.
+func DeregisterWatchCheck(c *consul.Client, state *WatchState) error {
+	id := watchServiceID(WatchService, state.Key)
+	if err := c.Agent().ServiceDeregister(id); err != nil {
+		return fmt.Errorf("could not deregister the '%s' service: %v", WatchService, err)
+	}
+	Log(fmt.Sprintf("watch service='%s' id='%s' deregistered='true'", WatchService, id), "info")
+	return nil
+}
+
+// deregisterWatch deregisters --service when watch stops - if it can't the
+// check goes critical once its TTL runs out.
+func deregisterWatch(c *consul.Client, state *WatchState) {
+	if WatchService == "" {
+		return
+	}
+	if err := DeregisterWatchCheck(c, state); err != nil {
+		Log(fmt.Sprintf("watch key='%s' message='%v'", state.Key, err), "info")
+	}
+}
+
+// updateWatchCheck updates the TTL check three times every TTL.
+func updateWatchCheck(c *consul.Client, state *WatchState) {
+	checkID := watchCheckID(watchServiceID(WatchService, state.Key))
+	for ; ; time.Sleep(WatchCheckTTL / 3) {
+		status, output := state.Health(WatchStaleAfter)
+		if err := c.Agent().UpdateTTL(checkID, output, status); err != nil {
+			Log(fmt.Sprintf("watch check='%s' error='%v'", checkID, err), "info")
+			continue
+		}
+		Log(fmt.Sprintf("watch check='%s' status='%s'", checkID, status), "debug")
+	}
+}
+
+// Health is the status of the TTL check and its output. It's critical when
+// the last change couldn't be written, Consul can't be reached or hasn't
+// answered for staleAfter - and before the first answer.
+func (s *WatchState) Health(staleAfter time.Duration) (string, string) {
+	since := s.SinceContact()
+	s.Lock()
+	defer s.Unlock()
+	switch {
+	case s.RenderError != "":
+		return consul.HealthCritical, fmt.Sprintf("Could not write %s: %s", s.File, s.RenderError)
+	case s.ContactError != "":
+		return consul.HealthCritical, fmt.Sprintf("Could not watch %s: %s", s.Key, s.ContactError)
+	case s.LastContact.IsZero():
+		return consul.HealthCritical, fmt.Sprintf("Waiting for %s.", s.Key)
+	case since > staleAfter:
+		return consul.HealthCritical, fmt.Sprintf("Consul hasn't answered for %s - %s could be stale.", since.Round(time.Second), s.File)
+	}
+	return consul.HealthPassing, fmt.Sprintf("Watching %s - %d writes to %s.", s.Key, s.Writes, s.File)
+}
@@ -0,0 +1,44 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleWatchSignals writes the file right away on SIGHUP - without waiting
+// for the key to change - and logs the state on SIGUSR1.
+func handleWatchSignals(c *consul.Client, state *WatchState) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGUSR1)
+	go func() {
+		for sig := range signals {
+			if sig == syscall.SIGUSR1 {
+				Log(state.String(), "info")
+				continue
+			}
+			Log(fmt.Sprintf("watch key='%s' signal='SIGHUP' render='true'", state.Key), "info")
+			written, err := WatchRender(c, state.Key, state.File)
+			if err != nil {
+				state.Failed(err, true)
+				Log(fmt.Sprintf("watch key='%s' error='%v'", state.Key, err), "info")
+				continue
+			}
+			state.Rendered()
+			if written {
+				state.Wrote()
+			}
+			if written && PostExec != "" {
+				Log(fmt.Sprintf("exec='%s'", PostExec), "debug")
+				RunPostExec(PostExec)
+			}
+			if written {
+				RunHooks(Hook{Event: HookChange, Key: state.Key, File: state.File})
+			}
+		}
+	}()
+}
@@ -0,0 +1,13 @@
+// +build windows
+
+package commands
+
+import (
+	consul "github.com/hashicorp/consul/api"
+)
+
+// handleWatchSignals doesn't do anything on Windows - there's no SIGHUP or
+// SIGUSR1.
+func handleWatchSignals(c *consul.Client, state *WatchState) {
+	Log("function='handleWatchSignals' skipped='windows'", "debug")
+}
@@ -0,0 +1,172 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"errors"
+	consul "github.com/hashicorp/consul/api"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchOnce(t *testing.T) {
+	tc, c := newTestConsul(t)
+	file := ensureTestFile(t)
+	tc.put("testing/watch/data", exampleData)
+	tc.put("testing/watch/checksum", exampleDataSHA)
+
+	index, written, err := WatchOnce(c, "watch", file, 0)
+	if err != nil || !written || index == 0 {
+		t.Fatalf("The first change should be written: index='%d' %v", index, err)
+	}
+	if data, _ := ioutil.ReadFile(file); string(data) != exampleData {
+		t.Error("The file was not written.")
+	}
+
+	if next, written, _ := WatchOnce(c, "watch", file, index); written || next != index {
+		t.Errorf("Nothing changed so nothing should be written: index='%d'", next)
+	}
+
+	// The key changed but the data is the same - so the file is left alone.
+	tc.put("testing/watch/updated", ReturnCurrentUTC())
+	next, written, err := WatchOnce(c, "watch", file, index)
+	if err != nil || written || next <= index {
+		t.Errorf("The same data should not be written again: index='%d' %v", next, err)
+	}
+
+	tc.put("testing/watch/stop", "maintenance")
+	tc.put("testing/watch/data", exampleData+"\nextra")
+	tc.put("testing/watch/checksum", ComputeChecksum(exampleData+"\nextra"))
+	if _, written, _ := WatchOnce(c, "watch", file, next); written {
+		t.Error("Nothing should be written with a stop key.")
+	}
+	if data, _ := ioutil.ReadFile(file); string(data) != exampleData {
+		t.Error("The file should not change with a stop key.")
+	}
+}
+
+func TestWatchOnceRenderError(t *testing.T) {
+	tc, c := newTestConsul(t)
+	file := ensureTestFile(t)
+	tc.put("testing/watch/data", exampleData)
+	tc.put("testing/watch/checksum", ComputeChecksum("other data"))
+	index, written, err := WatchOnce(c, "watch", file, 0)
+	if !errors.Is(err, ErrWatchRender) || written || index == 0 {
+		t.Errorf("A change that can't be written should be an ErrWatchRender - Consul answered: index='%d' %v", index, err)
+	}
+	if err := (watchRenderError{ErrRunStopped}); !errors.Is(err, ErrWatchRender) || !errors.Is(err, ErrRunStopped) {
+		t.Errorf("An ErrWatchRender should still be the error it wraps: %v", err)
+	}
+}
+
+func TestWatchOnceIndexReset(t *testing.T) {
+	tc, c := newTestConsul(t)
+	file := ensureTestFile(t)
+	tc.put("testing/watch/data", exampleData)
+	if index, written, _ := WatchOnce(c, "watch", file, 1000); index != 0 || written {
+		t.Errorf("An index that went backwards should reset to 0: '%d'", index)
+	}
+}
+
+func TestWatchRender(t *testing.T) {
+	tc, c := newTestConsul(t)
+	file := ensureTestFile(t)
+	tc.put("testing/watch/data", exampleData)
+	tc.put("testing/watch/checksum", exampleDataSHA)
+	if written, err := WatchRender(c, "watch", file); err != nil || !written {
+		t.Fatalf("The file should be written right away: %v", err)
+	}
+	// Someone edited the file by hand - a SIGHUP puts it back.
+	ioutil.WriteFile(file, []byte("edited"), 0640)
+	if written, err := WatchRender(c, "watch", file); err != nil || !written || ReadFile(file) != exampleData {
+		t.Errorf("The file should be written again: %v", err)
+	}
+	if written, _ := WatchRender(c, "watch", file); written {
+		t.Error("A file that matches shouldn't be written.")
+	}
+}
+
+func TestWatchState(t *testing.T) {
+	state := &WatchState{Key: "watch", File: "/etc/app.conf", Started: time.Now()}
+	if line := state.String(); !strings.Contains(line, "writes='0'") || !strings.Contains(line, "last_write='never'") {
+		t.Errorf("Nothing has been written yet: %s", line)
+	}
+	state.Update(42, true)
+	if line := state.String(); !strings.Contains(line, "index='42'") || !strings.Contains(line, "writes='1'") {
+		t.Errorf("The index and write should be in the state: %s", line)
+	}
+}
+
+func TestWatchHealth(t *testing.T) {
+	state := &WatchState{Key: "watch", File: "/etc/app.conf", Started: time.Now()}
+	if status, _ := state.Health(time.Minute); status != consul.HealthCritical {
+		t.Errorf("The check should be critical before Consul answers: %s", status)
+	}
+	state.Contacted()
+	if status, output := state.Health(time.Minute); status != consul.HealthPassing {
+		t.Errorf("The check should pass once Consul answers: %s %s", status, output)
+	}
+	state.Failed(errors.New("the data is too short"), true)
+	state.Contacted()
+	if status, output := state.Health(time.Minute); status != consul.HealthCritical || !strings.Contains(output, "too short") {
+		t.Errorf("A failed render should stay critical until a change is written: %s %s", status, output)
+	}
+	state.Rendered()
+	state.Failed(errors.New("connection refused"), false)
+	if status, output := state.Health(time.Minute); status != consul.HealthCritical || !strings.Contains(output, "connection refused") {
+		t.Errorf("A failed blocking query should be critical: %s %s", status, output)
+	}
+	state.Contacted()
+	state.LastContact = time.Now().Add(-2 * time.Minute)
+	if status, output := state.Health(time.Minute); status != consul.HealthCritical || !strings.Contains(output, "stale") {
+		t.Errorf("The check should be critical when Consul hasn't answered for too long: %s %s", status, output)
+	}
+}
+
+func TestWatchFreshness(t *testing.T) {
+	file := ensureTestFile(t)
+	state := &WatchState{Key: "watch", File: file, Started: time.Now()}
+	if freshness := state.Freshness(time.Now()); freshness.SinceRender != -1 || freshness.Age != -1 || freshness.Bytes != -1 {
+		t.Errorf("Nothing is known before the first render: %+v", freshness)
+	}
+	WriteFile(exampleData, file, 0640, Owner)
+	state.Rendered()
+	state.KeyUpdated("2016-05-01T12:00:00Z\n")
+	now, _ := time.Parse(time.RFC3339, "2016-05-01T13:00:00Z")
+	state.LastRender = now.Add(-time.Minute)
+	freshness := state.Freshness(now)
+	if freshness.SinceRender != time.Minute || freshness.Age != time.Hour || freshness.Bytes != int64(len(exampleData)) {
+		t.Errorf("The freshness is wrong: %+v", freshness)
+	}
+	state.KeyUpdated("yesterday")
+	if state.Freshness(now).Age != time.Hour {
+		t.Error("An updated time that can't be parsed should be ignored.")
+	}
+}
+
+func TestRegisterWatchCheck(t *testing.T) {
+	tc, c := newTestConsul(t)
+	WatchService, WatchCheckTTL, WatchStaleAfter = "app-config", time.Minute, time.Hour
+	defer func() { WatchService = "" }()
+	state := &WatchState{Key: "app/web", File: "/etc/app.conf", Started: time.Now()}
+	if err := RegisterWatchCheck(c, state); err != nil {
+		t.Fatalf("The service should be registered: %v", err)
+	}
+	service := tc.services["app-config-app-web"]
+	if service == nil || service.Name != "app-config" || service.Check.TTL != "1m0s" || service.Meta["key"] != "app/web" {
+		t.Fatalf("The service should have a TTL check for the key: %+v", service)
+	}
+	if tc.checks["service:app-config-app-web"] != consul.HealthCritical {
+		t.Errorf("The check should start critical: %v", tc.checks)
+	}
+	state.Contacted()
+	status, output := state.Health(WatchStaleAfter)
+	if err := c.Agent().UpdateTTL(watchCheckID(service.ID), output, status); err != nil || tc.checks["service:app-config-app-web"] != consul.HealthPassing {
+		t.Errorf("The check should pass after an update: %v %v", tc.checks, err)
+	}
+	if err := DeregisterWatchCheck(c, state); err != nil || tc.services["app-config-app-web"] != nil || len(tc.checks) != 0 {
+		t.Errorf("The service and its check should be gone: %v %v", tc.checks, err)
+	}
+}
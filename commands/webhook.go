@@ -0,0 +1,170 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// WatchWebhook is the URL watch POSTs a WebhookChange to every time it
+	// rewrites the file.
+	WatchWebhook string
+
+	// WatchWebhookHeaders are "Name: value" headers sent with the webhook -
+	// like an Authorization header.
+	WatchWebhookHeaders []string
+
+	// WatchWebhookTimeout is how long each try at the webhook can take.
+	WatchWebhookTimeout time.Duration
+)
+
+// webhookTries is how many times the webhook is tried before it's given up on.
+const webhookTries = 3
+
+// webhookQueueSize is how many changes can wait for the webhook. watch doesn't
+// wait for a slow webhook before it renders again - once the queue is full
+// the newest change is dropped.
+const webhookQueueSize = 16
+
+var (
+	// webhookQueue is the changes waiting for the webhook - they're sent one at
+	// a time and in order.
+	webhookQueue chan WebhookChange
+
+	// webhookStart starts the goroutine that sends them.
+	webhookStart sync.Once
+
+	// webhookPending counts the changes in the queue and the one being sent.
+	webhookPending sync.WaitGroup
+)
+
+// WebhookChange is the JSON body of the webhook. OldChecksum is blank if the
+// file didn't exist.
+type WebhookChange struct {
+	Event       string `json:"event"`
+	Host        string `json:"host"`
+	Key         string `json:"key"`
+	File        string `json:"file"`
+	OldChecksum string `json:"old_checksum"`
+	NewChecksum string `json:"new_checksum"`
+	Timestamp   string `json:"timestamp"`
+	RunID       string `json:"run_id,omitempty"`
+}
+
+// fileChecksum is the checksum of what's in file now - blank if it can't be
+// read.
+func fileChecksum(file string) string {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	return ComputeChecksum(string(data))
+}
+
+// notifyWebhook queues the change for --webhook and returns without waiting
+// for it. A change that doesn't fit in the queue is only logged - the file has
+// been written either way.
+func notifyWebhook(change WebhookChange) {
+	if WatchWebhook == "" || DryRunSkip(fmt.Sprintf("POST the change to '%s' to the webhook", change.File)) {
+		return
+	}
+	webhookStart.Do(func() {
+		webhookQueue = make(chan WebhookChange, webhookQueueSize)
+		go func() {
+			for change := range webhookQueue {
+				sendWebhook(change)
+				webhookPending.Done()
+			}
+		}()
+	})
+	webhookPending.Add(1)
+	select {
+	case webhookQueue <- change:
+	default:
+		webhookPending.Done()
+		Log(fmt.Sprintf("webhook key='%s' checksum='%s' queued='false' - %d changes are already waiting.", change.Key, change.NewChecksum, webhookQueueSize), "info")
+		StatsdWebhookFailed(change.Key)
+	}
+}
+
+// waitWebhooks waits up to timeout for the queued changes to be sent - false
+// if some are still waiting.
+func waitWebhooks(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		webhookPending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// sendWebhook POSTs the change to --webhook. It's tried webhookTries times
+// and a failure is only logged.
+func sendWebhook(change WebhookChange) {
+	body, _ := json.Marshal(change)
+	client := cancelClient(&http.Client{Timeout: WatchWebhookTimeout, Transport: &http.Transport{Proxy: proxyFunc("")}})
+	var err error
+	for i := 1; i <= webhookTries; i++ {
+		var retry bool
+		if retry, err = postWebhook(client, body); err == nil {
+			Log(fmt.Sprintf("webhook key='%s' checksum='%s' sent='true'", change.Key, change.NewChecksum), "info")
+			return
+		}
+		Log(fmt.Sprintf("webhook key='%s' try='%d' max='%d' message='%v'", change.Key, i, webhookTries, err), "info")
+		if !retry || i == webhookTries || !sleepRun(RetryBackoff(i)) {
+			break
+		}
+	}
+	StatsdWebhookFailed(change.Key)
+}
+
+// postWebhook makes a single POST and returns whether it's worth trying
+// again - a 4xx won't get better.
+func postWebhook(client *http.Client, body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", WatchWebhook, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("could not make the webhook request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "kvexpress/"+Version)
+	for _, header := range WatchWebhookHeaders {
+		name, value, err := parseWebhookHeader(header)
+		if err != nil {
+			return false, err
+		}
+		req.Header.Add(name, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, fmt.Errorf("the webhook answered %s", resp.Status)
+	}
+	return false, nil
+}
+
+// parseWebhookHeader splits a --webhook-header into its name and value.
+func parseWebhookHeader(header string) (string, string, error) {
+	parts := strings.SplitN(header, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.ContainsAny(strings.TrimSpace(parts[0]), " \t") {
+		return "", "", fmt.Errorf("'%s' should be a 'Name: value' header", header)
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]), nil
+}
@@ -0,0 +1,167 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchRenderWebhook(t *testing.T) {
+	var changes []WebhookChange
+	var auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var change WebhookChange
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &change)
+		changes = append(changes, change)
+		auth = r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+	WatchWebhook, WatchWebhookHeaders, WatchWebhookTimeout = server.URL, []string{"Authorization: Bearer abc"}, time.Second
+	defer func() { WatchWebhook, WatchWebhookHeaders = "", []string{} }()
+
+	tc, c := newTestConsul(t)
+	file := ensureTestFile(t)
+	ioutil.WriteFile(file, []byte("edited"), 0640)
+	tc.put("testing/watch/data", exampleData)
+	tc.put("testing/watch/checksum", exampleDataSHA)
+	if written, err := WatchRender(c, "watch", file); err != nil || !written {
+		t.Fatalf("The file should be written: %v", err)
+	}
+	if !waitWebhooks(5 * time.Second) {
+		t.Fatal("The webhook should be sent.")
+	}
+	if len(changes) != 1 {
+		t.Fatalf("A rewrite should send one webhook: %+v", changes)
+	}
+	change := changes[0]
+	if change.Key != "watch" || change.File != file || change.OldChecksum != ComputeChecksum("edited") || change.NewChecksum != exampleDataSHA || change.Timestamp == "" {
+		t.Errorf("The webhook should have the key, file and both checksums: %+v", change)
+	}
+	if auth != "Bearer abc" {
+		t.Errorf("The --webhook-header should be sent: '%s'", auth)
+	}
+	written, _ := WatchRender(c, "watch", file)
+	waitWebhooks(5 * time.Second)
+	if written || len(changes) != 1 {
+		t.Error("A file that wasn't written shouldn't send a webhook.")
+	}
+}
+
+func TestWatchRunID(t *testing.T) {
+	var change WebhookChange
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &change)
+	}))
+	defer server.Close()
+	WatchWebhook, WatchWebhookTimeout, RunID = server.URL, time.Second, "deploy-1234"
+	defer func() { WatchWebhook, RunID = "", "" }()
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	conn := listenStatsd(t)
+
+	tc, c := newTestConsul(t)
+	file := ensureTestFile(t)
+	tc.put("testing/watch/data", exampleData)
+	tc.put("testing/watch/checksum", exampleDataSHA)
+	if written, err := WatchRender(c, "watch", file); err != nil || !written {
+		t.Fatalf("The file should be written: %v", err)
+	}
+	if !waitWebhooks(5 * time.Second) {
+		t.Fatal("The webhook should be sent.")
+	}
+	if !strings.Contains(logs.String(), "run_id='deploy-1234'") {
+		t.Errorf("The logs should have the run ID: %q", logs.String())
+	}
+	if change.RunID != "deploy-1234" {
+		t.Errorf("The webhook should have the run ID: %+v", change)
+	}
+	var event bool
+	for _, line := range readStatsd(conn) {
+		switch {
+		case strings.HasPrefix(line, "_e{"):
+			event = strings.Contains(line, "run_id:deploy-1234")
+		case strings.Contains(line, "run_id"):
+			t.Errorf("A metric shouldn't have the run ID: %s", line)
+		}
+	}
+	if !event {
+		t.Error("The dogstatsd event should have the run ID.")
+	}
+}
+
+func TestPostWebhook(t *testing.T) {
+	status := http.StatusBadRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	WatchWebhook = server.URL
+	defer func() { WatchWebhook = "" }()
+	client := &http.Client{Timeout: time.Second}
+	if retry, err := postWebhook(client, []byte("{}")); err == nil || retry {
+		t.Errorf("A 400 should fail without a retry: %t %v", retry, err)
+	}
+	status = http.StatusBadGateway
+	if retry, err := postWebhook(client, []byte("{}")); err == nil || !retry {
+		t.Errorf("A 502 should be tried again: %t %v", retry, err)
+	}
+	status = http.StatusNoContent
+	if _, err := postWebhook(client, []byte("{}")); err != nil {
+		t.Errorf("A 204 should be fine: %v", err)
+	}
+}
+
+func TestWebhookQueue(t *testing.T) {
+	release := make(chan struct{})
+	var sent int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		sent++
+	}))
+	defer server.Close()
+	WatchWebhook, WatchWebhookTimeout = server.URL, 5*time.Second
+	defer func() { WatchWebhook = "" }()
+
+	// A webhook that doesn't answer doesn't hold up watch - and the queue
+	// only keeps so many.
+	started := time.Now()
+	for i := 0; i < webhookQueueSize+5; i++ {
+		notifyWebhook(WebhookChange{Key: "watch", File: "file"})
+	}
+	if time.Since(started) > time.Second {
+		t.Errorf("Queueing the changes shouldn't wait for the webhook: %s", time.Since(started))
+	}
+	if waitWebhooks(50 * time.Millisecond) {
+		t.Error("The changes should still be waiting.")
+	}
+	close(release)
+	if !waitWebhooks(5 * time.Second) {
+		t.Fatal("Every change that was queued should be sent.")
+	}
+	if sent < webhookQueueSize || sent > webhookQueueSize+1 {
+		t.Errorf("The changes that didn't fit should be dropped: %d", sent)
+	}
+}
+
+func TestParseWebhookHeader(t *testing.T) {
+	if name, value, err := parseWebhookHeader("Authorization: Bearer abc"); err != nil || name != "Authorization" || value != "Bearer abc" {
+		t.Errorf("A 'Name: value' header should parse: %s %s %v", name, value, err)
+	}
+	for _, header := range []string{"Authorization", ": abc", "Bad name: abc"} {
+		if _, _, err := parseWebhookHeader(header); err == nil {
+			t.Errorf("'%s' isn't a header.", header)
+		}
+	}
+}
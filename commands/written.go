@@ -0,0 +1,133 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// ReportWritten saves the checksum and mtime of every file out wrote in
+// <prefix>/_written/<key>/<hostname> - so an audit job can find files that
+// were changed on disk.
+var ReportWritten bool
+
+// WrittenFile is a file as it is on disk after out wrote it. The checksum is
+// always sha256 like the other local files.
+type WrittenFile struct {
+	File     string `json:"file"`
+	Checksum string `json:"checksum"`
+	Size     int64  `json:"size"`
+	Modified string `json:"modified"`
+}
+
+// WrittenReport is what a host saves in <prefix>/_written/<key>/<hostname>.
+// Checksum is the checksum of the data it wrote - a file with a --format has
+// its own.
+type WrittenReport struct {
+	Host     string        `json:"host"`
+	Key      string        `json:"key"`
+	Checksum string        `json:"checksum"`
+	Reported string        `json:"reported"`
+	Files    []WrittenFile `json:"files"`
+	RunID    string        `json:"run_id,omitempty"`
+}
+
+// WrittenPath is where host reports the files it wrote for key.
+func WrittenPath(key, host string) string {
+	return hostKeyRoot("written", key) + host
+}
+
+// ParseWrittenReport reads a report saved by reportWrittenOut.
+func ParseWrittenReport(value string) (WrittenReport, error) {
+	var report WrittenReport
+	err := json.Unmarshal([]byte(value), &report)
+	return report, err
+}
+
+// WrittenFiles reads the checksum, size and mtime of every target that's a
+// file.
+func WrittenFiles(targets []OutTarget) ([]WrittenFile, error) {
+	files := []WrittenFile{}
+	for _, target := range targets {
+		if target.File == Stdio {
+			continue
+		}
+		info, err := os.Stat(target.File)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadFile(target.File)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, WrittenFile{
+			File:     target.File,
+			Checksum: ComputeChecksum(string(data)),
+			Size:     info.Size(),
+			Modified: info.ModTime().UTC().Format(time.RFC3339),
+		})
+	}
+	return files, nil
+}
+
+// sameFiles is true if a and b have the same files with the same checksums
+// and mtimes.
+func sameFiles(a, b []WrittenFile) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// reportWrittenOut saves the files out wrote for reportKey with
+// --report-written. When nothing changed it's only saved if the files aren't
+// the ones that were reported - so a run that didn't do anything doesn't
+// write to Consul. A failure is logged: the files were still written.
+func reportWrittenOut(c *consul.Client, reportKey, key, checksum string, targets []OutTarget, changed bool) {
+	if !ReportWritten {
+		return
+	}
+	path := WrittenPath(reportKey, GetHostname())
+	files, err := WrittenFiles(targets)
+	if err != nil {
+		Log(fmt.Sprintf("written key='%s' message='%v' reported='false'", reportKey, err), "error")
+		return
+	}
+	report := WrittenReport{
+		Host:     GetHostname(),
+		Key:      key,
+		Checksum: strings.TrimSpace(checksum),
+		Reported: ReturnCurrentUTC(),
+		Files:    files,
+		RunID:    RunID,
+	}
+	if !changed {
+		value, err := Get(c, path)
+		if err == nil && value != "" {
+			if reported, err := ParseWrittenReport(value); err == nil && reported.Checksum == report.Checksum && reported.Key == key && sameFiles(reported.Files, files) {
+				Log(fmt.Sprintf("written key='%s' checksum='%s' reported='true'", reportKey, report.Checksum), "debug")
+				return
+			}
+		}
+	}
+	if DryRunSkip(fmt.Sprintf("report written files in '%s'", path)) {
+		return
+	}
+	value, _ := json.Marshal(report)
+	if err := Set(c, path, string(value)); err != nil {
+		Log(fmt.Sprintf("written key='%s' message='%v' reported='false'", reportKey, err), "error")
+		return
+	}
+	Log(fmt.Sprintf("written key='%s' path='%s' files='%d' reported='true'", reportKey, path, len(files)), "info")
+}
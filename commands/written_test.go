@@ -0,0 +1,53 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReportWrittenOut(t *testing.T) {
+	tc, c := newTestConsul(t)
+	PrefixLocation = "testing"
+	ReportWritten = true
+	defer func() { ReportWritten = false }()
+	dir, _ := ioutil.TempDir("", "kvexpress-written")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "hosts")
+	ioutil.WriteFile(file, []byte(exampleData), 0644)
+	targets := []OutTarget{{File: file}, {File: Stdio}}
+	path := "testing/_written/hosts/" + GetHostname()
+
+	reportWrittenOut(c, "hosts", "hosts/canary", exampleDataSHA+"\n", targets, true)
+	value, ok := tc.value(path)
+	if !ok {
+		t.Fatal("The files should be reported after a write.")
+	}
+	report, err := ParseWrittenReport(value)
+	if err != nil || report.Checksum != exampleDataSHA || report.Key != "hosts/canary" || report.Host != GetHostname() {
+		t.Errorf("The report should have the host, key and checksum: %+v %v", report, err)
+	}
+	if len(report.Files) != 1 || report.Files[0].File != file || report.Files[0].Checksum != ComputeChecksum(exampleData) || report.Files[0].Size != int64(len(exampleData)) {
+		t.Errorf("Only the file should be reported with its checksum and size: %+v", report.Files)
+	}
+
+	// A run that didn't change anything doesn't report it again.
+	puts := tc.count("PUT")
+	reportWrittenOut(c, "hosts", "hosts/canary", exampleDataSHA, targets, false)
+	if tc.count("PUT") != puts {
+		t.Error("The same files shouldn't be reported again.")
+	}
+
+	// Unless the file changed on disk.
+	ioutil.WriteFile(file, []byte("edited by hand\n"), 0644)
+	os.Chtimes(file, time.Now().Add(time.Hour), time.Now().Add(time.Hour))
+	reportWrittenOut(c, "hosts", "hosts/canary", exampleDataSHA, targets, false)
+	value, _ = tc.value(path)
+	if report, _ := ParseWrittenReport(value); len(report.Files) != 1 || report.Files[0].Checksum != ComputeChecksum("edited by hand\n") {
+		t.Errorf("A file that was edited should be reported again: %+v", report.Files)
+	}
+}
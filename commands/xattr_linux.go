@@ -0,0 +1,74 @@
+// +build linux
+
+package commands
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// copyXattrs copies the extended attributes of from onto to - only the one
+// called name if it isn't blank. A from that doesn't exist or a filesystem
+// without extended attributes has nothing to copy.
+func copyXattrs(from, to, name string) error {
+	names, err := listXattrs(from)
+	if err == syscall.ENOENT || err == syscall.ENOTSUP {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not list the attributes of '%s': %v", from, err)
+	}
+	for _, attr := range names {
+		if name != "" && attr != name {
+			continue
+		}
+		value, err := getXattr(from, attr)
+		if err != nil {
+			return fmt.Errorf("could not read %s from '%s': %v", attr, from, err)
+		}
+		if err := syscall.Setxattr(to, attr, value, 0); err != nil {
+			return fmt.Errorf("could not set %s on '%s': %v", attr, to, err)
+		}
+		Log(fmt.Sprintf("function='copyXattrs' from='%s' to='%s' attr='%s'", from, to, attr), "debug")
+	}
+	return nil
+}
+
+// setXattr sets the extended attribute name on file.
+func setXattr(file, name, value string) error {
+	if err := syscall.Setxattr(file, name, []byte(value), 0); err != nil {
+		return fmt.Errorf("could not set %s on '%s': %v", name, file, err)
+	}
+	return nil
+}
+
+// listXattrs returns the names of file's extended attributes.
+func listXattrs(file string) ([]string, error) {
+	size, err := syscall.Listxattr(file, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if size, err = syscall.Listxattr(file, buf); err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range strings.Split(string(buf[:size]), "\x00") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// getXattr returns the value of file's extended attribute name.
+func getXattr(file, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(file, name, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	value := make([]byte, size)
+	size, err = syscall.Getxattr(file, name, value)
+	return value[:size], err
+}
@@ -0,0 +1,38 @@
+// +build linux
+
+package commands
+
+import (
+	"io/ioutil"
+	"syscall"
+	"testing"
+)
+
+func TestKeepXattrs(t *testing.T) {
+	file := ensureTestFile(t)
+	if err := ioutil.WriteFile(file, []byte("old\n"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Setxattr(file, "user.kvexpress", []byte("managed"), 0); err != nil {
+		t.Skipf("The filesystem doesn't have user attributes: %v", err)
+	}
+	t.Cleanup(func() { KeepXattrs = false })
+
+	if err := WriteFile(exampleData, file, 0640, Owner); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := getXattr(file, "user.kvexpress"); len(value) != 0 {
+		t.Errorf("The attribute shouldn't be copied without --keep-xattrs: %q", value)
+	}
+	syscall.Setxattr(file, "user.kvexpress", []byte("managed"), 0)
+	KeepXattrs = true
+	if err := WriteFile(exampleData+"more\n", file, 0640, Owner); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := getXattr(file, "user.kvexpress"); string(value) != "managed" {
+		t.Errorf("The attribute should be copied: %q %v", value, err)
+	}
+	if err := copyXattrs(file+".missing", file, ""); err != nil {
+		t.Errorf("A missing file has nothing to copy: %v", err)
+	}
+}
@@ -0,0 +1,21 @@
+// +build darwin freebsd windows
+
+package commands
+
+import (
+	"errors"
+)
+
+// errNoXattrs is returned when --keep-xattrs or --selinux-context are used
+// anywhere but Linux.
+var errNoXattrs = errors.New("extended attributes and SELinux contexts are only supported on Linux")
+
+// copyXattrs isn't supported outside of Linux.
+func copyXattrs(from, to, name string) error {
+	return errNoXattrs
+}
+
+// setXattr isn't supported outside of Linux.
+func setXattr(file, name, value string) error {
+	return errNoXattrs
+}
@@ -0,0 +1,665 @@
+// +build linux darwin freebsd windows
+
+package commands
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// zkBackend talks to ZooKeeper with its own protocol - every key is a znode,
+// so kvexpress/hosts/data is /kvexpress/hosts/data. The data and checksum are
+// saved together with a multi, the way SaveCAS uses a Consul transaction.
+type zkBackend struct {
+	sync.Mutex
+	servers []string
+	timeout time.Duration
+	auth    string
+	acls    []zkACL
+	conn    net.Conn
+	xid     int32
+}
+
+// zkACL is one entry in a znode's ACL.
+type zkACL struct {
+	perms  int32
+	scheme string
+	id     string
+}
+
+// zkPermAll and zkPermRead are the ZooKeeper ACL permissions.
+const (
+	zkPermRead = 1
+	zkPermAll  = 31
+)
+
+// zkACLs are the --zk-acl choices. The creator ACLs are ZooKeeper's
+// CREATOR_ALL_ACL - every permission for whoever logged in with --zk-auth -
+// and creator-read lets everyone else read too. open is world:anyone with
+// every permission, ZooKeeper's OPEN_ACL_UNSAFE.
+var zkACLs = map[string][]zkACL{
+	"creator":      {{zkPermAll, "auth", ""}},
+	"creator-read": {{zkPermAll, "auth", ""}, {zkPermRead, "world", "anyone"}},
+	"open":         {{zkPermAll, "world", "anyone"}},
+}
+
+// The ZooKeeper operations kvexpress uses.
+const (
+	zkOpCreate       = 1
+	zkOpDelete       = 2
+	zkOpGetData      = 4
+	zkOpSetData      = 5
+	zkOpGetChildren2 = 12
+	zkOpMulti        = 14
+	zkOpAuth         = 100
+	zkOpCloseSession = -11
+)
+
+// zkAuthXid is the xid ZooKeeper expects on an auth request and answers with.
+const zkAuthXid = -4
+
+// zkError is an error code from ZooKeeper.
+type zkError int32
+
+// The ZooKeeper errors kvexpress expects.
+const (
+	zkNoNode     zkError = -101
+	zkBadVersion zkError = -103
+	zkNodeExists zkError = -110
+	zkNotEmpty   zkError = -111
+	zkNoAuth     zkError = -102
+	zkAuthFailed zkError = -115
+)
+
+func (e zkError) Error() string {
+	switch e {
+	case zkNoNode:
+		return "zookeeper: the znode doesn't exist"
+	case zkBadVersion:
+		return "zookeeper: the znode was changed"
+	case zkNodeExists:
+		return "zookeeper: the znode already exists"
+	case zkNotEmpty:
+		return "zookeeper: the znode has children"
+	case zkNoAuth:
+		return "zookeeper: not allowed by the znode's ACL"
+	case zkAuthFailed:
+		return "zookeeper: --zk-auth was refused"
+	}
+	return fmt.Sprintf("zookeeper: error %d", int32(e))
+}
+
+// zkConflict is true for the errors a multi gets when another writer changed
+// a znode first.
+func zkConflict(err error) bool {
+	return err == zkBadVersion || err == zkNodeExists || err == zkNoNode || err == zkNotEmpty
+}
+
+// zkSessionTimeout is how long ZooKeeper keeps the session after the last
+// request - kvexpress only needs it for a single run.
+const zkSessionTimeout = 10 * time.Second
+
+// newZookeeperBackend logs in with auth - user:password, or from authFile -
+// and creates znodes with the acl ACL. SecretEnv has already moved
+// KVEXPRESS_ZK_AUTH into --zk-auth.
+func newZookeeperBackend(servers []string, auth, authFile, acl string) (*zkBackend, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("need at least one --zk-server")
+	}
+	if authFile != "" {
+		value, err := ReadTokenFile(authFile)
+		if err != nil {
+			return nil, err
+		}
+		auth = value
+	}
+	if auth != "" && !strings.Contains(auth, ":") {
+		return nil, errors.New("--zk-auth has to be user:password")
+	}
+	if acl == "" && auth != "" {
+		acl = "creator"
+	}
+	if acl == "" {
+		acl = "open"
+		Log("zookeeper acl='open' - anyone who can reach ZooKeeper can change the znodes kvexpress creates, use --zk-auth.", "warn")
+	}
+	acls, ok := zkACLs[acl]
+	if !ok {
+		return nil, fmt.Errorf("unknown --zk-acl '%s' - use creator, creator-read or open", acl)
+	}
+	if acl != "open" && auth == "" {
+		return nil, fmt.Errorf("--zk-acl %s needs --zk-auth to know who the creator is", acl)
+	}
+	var clean []string
+	for _, server := range servers {
+		server = strings.TrimPrefix(strings.TrimSpace(server), "zk://")
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "2181")
+		}
+		clean = append(clean, server)
+	}
+	return &zkBackend{servers: clean, timeout: 30 * time.Second, auth: auth, acls: acls}, nil
+}
+
+// zkPath is the znode for key.
+func zkPath(key string) string {
+	return "/" + strings.Trim(key, "/")
+}
+
+// zkWriter builds a ZooKeeper request.
+type zkWriter struct {
+	buf []byte
+}
+
+func (w *zkWriter) int32(v int32) *zkWriter {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(v))
+	w.buf = append(w.buf, b[:]...)
+	return w
+}
+
+func (w *zkWriter) int64(v int64) *zkWriter {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	w.buf = append(w.buf, b[:]...)
+	return w
+}
+
+func (w *zkWriter) bool(v bool) *zkWriter {
+	if v {
+		w.buf = append(w.buf, 1)
+	} else {
+		w.buf = append(w.buf, 0)
+	}
+	return w
+}
+
+func (w *zkWriter) bytes(v []byte) *zkWriter {
+	if v == nil {
+		return w.int32(-1)
+	}
+	w.int32(int32(len(v)))
+	w.buf = append(w.buf, v...)
+	return w
+}
+
+func (w *zkWriter) string(v string) *zkWriter {
+	return w.bytes([]byte(v))
+}
+
+// acl is the ACL that new znodes are created with.
+func (w *zkWriter) acl(acls []zkACL) *zkWriter {
+	w.int32(int32(len(acls)))
+	for _, acl := range acls {
+		w.int32(acl.perms).string(acl.scheme).string(acl.id)
+	}
+	return w
+}
+
+// zkReader reads a ZooKeeper response - the first error sticks.
+type zkReader struct {
+	buf []byte
+	err error
+}
+
+func (r *zkReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.buf) < n {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	v := r.buf[:n]
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *zkReader) int32() int32 {
+	if v := r.next(4); v != nil {
+		return int32(binary.BigEndian.Uint32(v))
+	}
+	return 0
+}
+
+func (r *zkReader) int64() int64 {
+	if v := r.next(8); v != nil {
+		return int64(binary.BigEndian.Uint64(v))
+	}
+	return 0
+}
+
+func (r *zkReader) bool() bool {
+	v := r.next(1)
+	return v != nil && v[0] != 0
+}
+
+func (r *zkReader) bytes() []byte {
+	n := r.int32()
+	if n == -1 {
+		return nil
+	}
+	return r.next(int(n))
+}
+
+func (r *zkReader) string() string {
+	return string(r.bytes())
+}
+
+// zkStat is the part of a znode's stat that kvexpress uses.
+type zkStat struct {
+	version     int32
+	dataLength  int32
+	numChildren int32
+}
+
+func (r *zkReader) stat() zkStat {
+	var s zkStat
+	r.next(32) // czxid, mzxid, ctime and mtime
+	s.version = r.int32()
+	r.next(16) // cversion, aversion and ephemeralOwner
+	s.dataLength = r.int32()
+	s.numChildren = r.int32()
+	r.next(8) // pzxid
+	return s
+}
+
+// connect starts a session on the first server that answers.
+func (z *zkBackend) connect() error {
+	var err error
+	for _, server := range z.servers {
+		var conn net.Conn
+		conn, err = net.DialTimeout("tcp", server, z.timeout)
+		if err != nil {
+			Log(fmt.Sprintf("zookeeper server='%s' error='%v'", server, err), "info")
+			continue
+		}
+		request := (&zkWriter{}).int32(0).int64(0).int32(int32(zkSessionTimeout / time.Millisecond)).int64(0).bytes(make([]byte, 16))
+		conn.SetDeadline(time.Now().Add(z.timeout))
+		var response *zkReader
+		if err = zkSend(conn, request.buf); err == nil {
+			response, err = zkReceive(conn)
+		}
+		if err == nil {
+			response.int32()
+			if timeout := response.int32(); response.err == nil && timeout <= 0 {
+				err = errors.New("zookeeper refused the session")
+			}
+		}
+		if err == nil && z.auth != "" {
+			err = zkLogin(conn, z.auth)
+			// Another server won't take the same user:password either.
+			if err == zkAuthFailed {
+				conn.Close()
+				return err
+			}
+		}
+		if err != nil {
+			conn.Close()
+			Log(fmt.Sprintf("zookeeper server='%s' error='%v'", server, err), "info")
+			continue
+		}
+		Log(fmt.Sprintf("zookeeper server='%s' connected='true' auth='%t'", server, z.auth != ""), "debug")
+		z.conn = conn
+		return nil
+	}
+	return err
+}
+
+// zkLogin adds digest auth to the session on conn.
+func zkLogin(conn net.Conn, auth string) error {
+	request := (&zkWriter{}).int32(zkAuthXid).int32(zkOpAuth).int32(0).string("digest").string(auth)
+	if err := zkSend(conn, request.buf); err != nil {
+		return err
+	}
+	for {
+		response, err := zkReceive(conn)
+		if err != nil {
+			return err
+		}
+		xid := response.int32()
+		response.int64() // zxid
+		code := response.int32()
+		if response.err != nil {
+			return response.err
+		}
+		if xid != zkAuthXid {
+			continue
+		}
+		if code != 0 {
+			return zkError(code)
+		}
+		return nil
+	}
+}
+
+// zkSend writes a request with its length in front.
+func zkSend(conn net.Conn, request []byte) error {
+	_, err := conn.Write(append((&zkWriter{}).int32(int32(len(request))).buf, request...))
+	return err
+}
+
+// zkReceive reads a response with its length in front.
+func zkReceive(conn net.Conn) (*zkReader, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	return &zkReader{buf: buf}, nil
+}
+
+// call sends an operation and returns its response - a ZooKeeper error is a
+// zkError. A connection that fails is started again on the next call.
+func (z *zkBackend) call(op int32, request *zkWriter) (*zkReader, error) {
+	z.Lock()
+	defer z.Unlock()
+	if z.conn == nil {
+		if err := z.connect(); err != nil {
+			return nil, err
+		}
+	}
+	z.xid++
+	header := (&zkWriter{}).int32(z.xid).int32(op)
+	z.conn.SetDeadline(time.Now().Add(z.timeout))
+	if err := zkSend(z.conn, append(header.buf, request.buf...)); err != nil {
+		z.close()
+		return nil, err
+	}
+	for {
+		response, err := zkReceive(z.conn)
+		if err != nil {
+			z.close()
+			return nil, err
+		}
+		xid := response.int32()
+		response.int64() // zxid
+		code := response.int32()
+		// -1 is a watch event and -2 a ping - neither is asked for.
+		if xid == -1 || xid == -2 {
+			continue
+		}
+		if response.err != nil || xid != z.xid {
+			z.close()
+			return nil, fmt.Errorf("zookeeper answered %d out of order", xid)
+		}
+		if code != 0 {
+			return response, zkError(code)
+		}
+		return response, nil
+	}
+}
+
+func (z *zkBackend) close() {
+	z.conn.Close()
+	z.conn = nil
+}
+
+// Close ends the session - otherwise ZooKeeper keeps it for zkSessionTimeout
+// after kvexpress exits.
+func (z *zkBackend) Close() error {
+	z.Lock()
+	defer z.Unlock()
+	if z.conn == nil {
+		return nil
+	}
+	defer z.close()
+	z.xid++
+	z.conn.SetDeadline(time.Now().Add(z.timeout))
+	if err := zkSend(z.conn, (&zkWriter{}).int32(z.xid).int32(zkOpCloseSession).buf); err != nil {
+		return err
+	}
+	_, err := zkReceive(z.conn)
+	Log("zookeeper session='closed'", "debug")
+	return err
+}
+
+// getData returns the data in a znode, its stat and whether it exists.
+func (z *zkBackend) getData(path string) ([]byte, zkStat, bool, error) {
+	response, err := z.call(zkOpGetData, (&zkWriter{}).string(path).bool(false))
+	if err == zkNoNode {
+		return nil, zkStat{}, false, nil
+	}
+	if err != nil {
+		return nil, zkStat{}, false, err
+	}
+	data := response.bytes()
+	stat := response.stat()
+	return data, stat, true, response.err
+}
+
+// createParents makes the znodes above path - ZooKeeper doesn't make them.
+func (z *zkBackend) createParents(path string) error {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for i := 1; i < len(parts); i++ {
+		parent := "/" + strings.Join(parts[:i], "/")
+		_, err := z.call(zkOpCreate, (&zkWriter{}).string(parent).bytes(nil).acl(z.acls).int32(0))
+		if err != nil && err != zkNodeExists {
+			return err
+		}
+	}
+	return nil
+}
+
+func (z *zkBackend) Get(key string) (string, error) {
+	data, _, _, err := z.getData(zkPath(key))
+	Log(fmt.Sprintf("action='zkGet' key='%s'", key), "debug")
+	return string(data), err
+}
+
+// Index is the znode's version plus one - 0 is a znode that doesn't exist
+// the same way it is for a Consul KVCAS.
+func (z *zkBackend) Index(key string) (uint64, string, error) {
+	data, stat, ok, err := z.getData(zkPath(key))
+	if err != nil || !ok {
+		return 0, "", err
+	}
+	return uint64(stat.version) + 1, string(data), nil
+}
+
+func (z *zkBackend) Set(key, value string) (bool, error) {
+	path := zkPath(key)
+	_, err := z.call(zkOpSetData, (&zkWriter{}).string(path).bytes([]byte(value)).int32(-1))
+	if err == zkNoNode {
+		if err = z.createParents(path); err != nil {
+			return false, err
+		}
+		_, err = z.call(zkOpCreate, (&zkWriter{}).string(path).bytes([]byte(value)).acl(z.acls).int32(0))
+		if err == zkNodeExists {
+			_, err = z.call(zkOpSetData, (&zkWriter{}).string(path).bytes([]byte(value)).int32(-1))
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	Log(fmt.Sprintf("action='zkSet' key='%s'", key), "debug")
+	return true, nil
+}
+
+// Del removes the znode. One that still has children - data that has chunks
+// underneath it - is emptied instead.
+func (z *zkBackend) Del(key string) (bool, error) {
+	path := zkPath(key)
+	_, err := z.call(zkOpDelete, (&zkWriter{}).string(path).int32(-1))
+	if err == zkNotEmpty {
+		_, err = z.call(zkOpSetData, (&zkWriter{}).string(path).bytes(nil).int32(-1))
+	}
+	if err != nil && err != zkNoNode {
+		return false, err
+	}
+	Log(fmt.Sprintf("action='zkDel' key='%s'", key), "info")
+	return true, nil
+}
+
+// zkNode is a znode found underneath a prefix - a key is one with data or
+// without children, the rest only hold the znodes underneath them.
+type zkNode struct {
+	key   string
+	isKey bool
+}
+
+// tree finds every znode whose key starts with prefix - deepest first.
+func (z *zkBackend) tree(prefix string) ([]zkNode, error) {
+	var nodes []zkNode
+	var walk func(key string) error
+	walk = func(key string) error {
+		response, err := z.call(zkOpGetChildren2, (&zkWriter{}).string(zkPath(key)).bool(false))
+		if err == zkNoNode {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		count := response.int32()
+		var children []string
+		for i := int32(0); i < count && response.err == nil; i++ {
+			children = append(children, response.string())
+		}
+		stat := response.stat()
+		if response.err != nil {
+			return response.err
+		}
+		sort.Strings(children)
+		for _, child := range children {
+			childKey := strings.TrimPrefix(key+"/"+child, "/")
+			if childKey == "zookeeper" {
+				continue
+			}
+			if strings.HasPrefix(childKey, prefix) || strings.HasPrefix(prefix, childKey+"/") {
+				if err := walk(childKey); err != nil {
+					return err
+				}
+			}
+		}
+		if key != "" && strings.HasPrefix(key, prefix) {
+			nodes = append(nodes, zkNode{key: key, isKey: stat.dataLength > 0 || stat.numChildren == 0})
+		}
+		return nil
+	}
+	root := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		root = prefix[:i]
+	}
+	return nodes, walk(root)
+}
+
+func (z *zkBackend) Keys(prefix string) ([]string, error) {
+	prefix = strings.TrimPrefix(prefix, "/")
+	nodes, err := z.tree(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, node := range nodes {
+		if node.isKey {
+			keys = append(keys, node.key)
+		}
+	}
+	sort.Strings(keys)
+	Log(fmt.Sprintf("action='zkKeys' prefix='%s' keys='%d'", prefix, len(keys)), "debug")
+	return keys, nil
+}
+
+// Txn runs the KVSet, KVCAS, KVDelete and KVDeleteTree operations in a single
+// multi. A KVCAS with an index of 0 creates the znode and any other index is
+// the version plus one from Index. It's false when another writer changed one
+// of the znodes first.
+func (z *zkBackend) Txn(ops consul.TxnOps) (bool, error) {
+	multi := &zkWriter{}
+	add := func(op int32) *zkWriter {
+		return multi.int32(op).bool(false).int32(-1)
+	}
+	for _, op := range ops {
+		if op.KV == nil {
+			return false, errors.New("zookeeper only supports key value operations")
+		}
+		path := zkPath(op.KV.Key)
+		switch op.KV.Verb {
+		case consul.KVSet, consul.KVCAS:
+			index := op.KV.Index
+			if op.KV.Verb == consul.KVSet {
+				current, _, err := z.Index(op.KV.Key)
+				if err != nil {
+					return false, err
+				}
+				index = current
+			}
+			if index == 0 {
+				if err := z.createParents(path); err != nil {
+					return false, err
+				}
+				add(zkOpCreate).string(path).bytes(op.KV.Value).acl(z.acls).int32(0)
+				continue
+			}
+			version := int32(index - 1)
+			if op.KV.Verb == consul.KVSet {
+				version = -1
+			}
+			add(zkOpSetData).string(path).bytes(op.KV.Value).int32(version)
+		case consul.KVDelete:
+			_, stat, ok, err := z.getData(path)
+			if err != nil {
+				return false, err
+			}
+			switch {
+			case !ok:
+			case stat.numChildren > 0:
+				add(zkOpSetData).string(path).bytes(nil).int32(-1)
+			default:
+				add(zkOpDelete).string(path).int32(-1)
+			}
+		case consul.KVDeleteTree:
+			nodes, err := z.tree(strings.TrimPrefix(op.KV.Key, "/"))
+			if err != nil {
+				return false, err
+			}
+			for _, node := range nodes {
+				add(zkOpDelete).string(zkPath(node.key)).int32(-1)
+			}
+		default:
+			return false, fmt.Errorf("zookeeper doesn't support the '%s' operation", op.KV.Verb)
+		}
+	}
+	multi.int32(-1).bool(true).int32(-1)
+	response, err := z.call(zkOpMulti, multi)
+	if zkConflict(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for response.err == nil {
+		op := response.int32()
+		done := response.bool()
+		response.int32()
+		if done {
+			break
+		}
+		switch op {
+		case -1:
+			if code := zkError(response.int32()); code != 0 {
+				if zkConflict(code) {
+					return false, nil
+				}
+				return false, code
+			}
+		case zkOpCreate:
+			response.string()
+		case zkOpSetData:
+			response.stat()
+		}
+	}
+	Log(fmt.Sprintf("action='zkTxn' ops='%d'", len(ops)), "debug")
+	return true, response.err
+}
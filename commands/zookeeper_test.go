@@ -0,0 +1,371 @@
+// +build linux darwin freebsd
+
+package commands
+
+import (
+	consul "github.com/hashicorp/consul/api"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testZookeeper is a small in-memory stand-in for a ZooKeeper server - it
+// knows the operations zkBackend sends.
+type testZookeeper struct {
+	sync.Mutex
+	nodes  map[string]*testZnode
+	multis int
+	// auth is the user:password it takes - logins counts the ones that worked
+	// and closed the sessions that were ended.
+	auth   string
+	addr   string
+	logins int
+	closed int
+}
+
+type testZnode struct {
+	data    []byte
+	version int32
+	acl     []zkACL
+}
+
+// newTestZookeeper starts a testZookeeper and makes it the backend.
+func newTestZookeeper(t *testing.T) *testZookeeper {
+	tz := startTestZookeeper(t, "")
+	t.Cleanup(func() { backend = nil })
+	zk, err := newZookeeperBackend([]string{tz.addr}, "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend = zk
+	return tz
+}
+
+// startTestZookeeper starts a testZookeeper that takes auth.
+func startTestZookeeper(t *testing.T, auth string) *testZookeeper {
+	tz := &testZookeeper{nodes: map[string]*testZnode{"/": {}}, auth: auth}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go tz.serve(conn)
+		}
+	}()
+	tz.addr = listener.Addr().String()
+	return tz
+}
+
+func (tz *testZookeeper) serve(conn net.Conn) {
+	defer conn.Close()
+	if _, err := zkReceive(conn); err != nil {
+		return
+	}
+	zkSend(conn, (&zkWriter{}).int32(0).int32(10000).int64(1).bytes(make([]byte, 16)).buf)
+	for {
+		request, err := zkReceive(conn)
+		if err != nil {
+			return
+		}
+		xid, op := request.int32(), request.int32()
+		tz.Lock()
+		var response *zkWriter
+		var code zkError
+		switch op {
+		case zkOpAuth:
+			request.int32()
+			response = &zkWriter{}
+			if request.string() != "digest" || request.string() != tz.auth || tz.auth == "" {
+				code = zkAuthFailed
+			} else {
+				tz.logins++
+			}
+		case zkOpCloseSession:
+			response = &zkWriter{}
+			tz.closed++
+		default:
+			response, code = tz.handle(op, request)
+		}
+		tz.Unlock()
+		header := (&zkWriter{}).int32(xid).int64(0).int32(int32(code))
+		zkSend(conn, append(header.buf, response.buf...))
+		if op == zkOpCloseSession || code == zkAuthFailed {
+			return
+		}
+	}
+}
+
+func (tz *testZookeeper) children(path string) []string {
+	var children []string
+	for node := range tz.nodes {
+		if node != "/" && node != path && parentPath(node) == path {
+			children = append(children, node[strings.LastIndex(node, "/")+1:])
+		}
+	}
+	sort.Strings(children)
+	return children
+}
+
+func parentPath(path string) string {
+	if i := strings.LastIndex(path, "/"); i > 0 {
+		return path[:i]
+	}
+	return "/"
+}
+
+func (tz *testZookeeper) stat(w *zkWriter, node *testZnode, path string) {
+	w.int64(0).int64(0).int64(0).int64(0).int32(node.version).int32(0).int32(0).int64(0)
+	w.int32(int32(len(node.data))).int32(int32(len(tz.children(path)))).int64(0)
+}
+
+// apply runs one operation - it returns the response and the error code.
+func (tz *testZookeeper) apply(op int32, r *zkReader) (*zkWriter, zkError) {
+	w := &zkWriter{}
+	path := r.string()
+	node := tz.nodes[path]
+	switch op {
+	case zkOpCreate:
+		data := r.bytes()
+		var acl []zkACL
+		for i := r.int32(); i > 0; i-- {
+			acl = append(acl, zkACL{perms: r.int32(), scheme: r.string(), id: r.string()})
+		}
+		r.int32()
+		if node != nil {
+			return w, zkNodeExists
+		}
+		if tz.nodes[parentPath(path)] == nil {
+			return w, zkNoNode
+		}
+		tz.nodes[path] = &testZnode{data: data, acl: acl}
+		return w.string(path), 0
+	case zkOpDelete:
+		version := r.int32()
+		switch {
+		case node == nil:
+			return w, zkNoNode
+		case version != -1 && version != node.version:
+			return w, zkBadVersion
+		case len(tz.children(path)) > 0:
+			return w, zkNotEmpty
+		}
+		delete(tz.nodes, path)
+		return w, 0
+	case zkOpGetData:
+		r.bool()
+		if node == nil {
+			return w, zkNoNode
+		}
+		w.bytes(node.data)
+		tz.stat(w, node, path)
+		return w, 0
+	case zkOpSetData:
+		data, version := r.bytes(), r.int32()
+		if node == nil {
+			return w, zkNoNode
+		}
+		if version != -1 && version != node.version {
+			return w, zkBadVersion
+		}
+		node.data, node.version = data, node.version+1
+		tz.stat(w, node, path)
+		return w, 0
+	case zkOpGetChildren2:
+		r.bool()
+		if node == nil {
+			return w, zkNoNode
+		}
+		children := tz.children(path)
+		w.int32(int32(len(children)))
+		for _, child := range children {
+			w.string(child)
+		}
+		tz.stat(w, node, path)
+		return w, 0
+	}
+	return w, zkError(-6)
+}
+
+func (tz *testZookeeper) handle(op int32, r *zkReader) (*zkWriter, zkError) {
+	if op != zkOpMulti {
+		return tz.apply(op, r)
+	}
+	tz.multis++
+	saved := make(map[string]*testZnode)
+	for path, node := range tz.nodes {
+		copied := *node
+		saved[path] = &copied
+	}
+	var results []*zkWriter
+	var types []int32
+	var failed zkError
+	for {
+		kind, done := r.int32(), r.bool()
+		r.int32()
+		if done || r.err != nil {
+			break
+		}
+		result, code := tz.apply(kind, r)
+		if code != 0 && failed == 0 {
+			failed = code
+		}
+		results, types = append(results, result), append(types, kind)
+	}
+	w := &zkWriter{}
+	if failed != 0 {
+		tz.nodes = saved
+		for range results {
+			w.int32(-1).bool(false).int32(int32(failed)).int32(int32(failed))
+		}
+	} else {
+		for i, result := range results {
+			w.int32(types[i]).bool(false).int32(0)
+			w.buf = append(w.buf, result.buf...)
+		}
+	}
+	w.int32(-1).bool(true).int32(-1)
+	return w, failed
+}
+
+func (tz *testZookeeper) value(path string) (string, bool) {
+	tz.Lock()
+	defer tz.Unlock()
+	node, ok := tz.nodes[path]
+	if !ok {
+		return "", false
+	}
+	return string(node.data), true
+}
+
+func TestZookeeperBackend(t *testing.T) {
+	tz := newTestZookeeper(t)
+	tc, c := newTestConsul(t)
+	if err := Set(c, "/testing/keyname/data", exampleData); err != nil {
+		t.Fatal(err)
+	}
+	Set(c, "testing/keyname/checksum", exampleDataSHA)
+	if value, _ := tz.value("/testing/keyname/data"); value != exampleData {
+		t.Error("Set did not store the data in a znode.")
+	}
+	if tc.count("PUT") != 0 {
+		t.Error("Consul should not be used with the zookeeper backend.")
+	}
+	if value, err := Get(c, "testing/keyname/data"); err != nil || value != exampleData {
+		t.Errorf("Get did not return the data from ZooKeeper: '%s' %v", value, err)
+	}
+	if value, err := Get(c, "testing/missing/data"); err != nil || value != "" {
+		t.Error("Get of a missing key should be blank.")
+	}
+	// The znodes that only hold others aren't keys.
+	keys, err := Keys(c, "testing/")
+	if err != nil || strings.Join(keys, ",") != "testing/keyname/checksum,testing/keyname/data" {
+		t.Errorf("Keys did not list the keys: %v %v", keys, err)
+	}
+	if keys, _ := Keys(c, "testing/keyname/ch"); strings.Join(keys, ",") != "testing/keyname/checksum" {
+		t.Errorf("Keys should match part of a name: %v", keys)
+	}
+	Set(c, "testing/keyname/data/0", "chunk")
+	Del(c, "testing/keyname/data")
+	if value, ok := tz.value("/testing/keyname/data"); value != "" || !ok {
+		t.Error("A znode with children should be emptied.")
+	}
+	Del(c, "testing/keyname/checksum")
+	if _, ok := tz.value("/testing/keyname/checksum"); ok {
+		t.Error("Del did not remove the znode.")
+	}
+}
+
+func TestZookeeperSaveCAS(t *testing.T) {
+	PrefixLocation = "testing"
+	tz := newTestZookeeper(t)
+	_, c := newTestConsul(t)
+	Set(c, "testing/hosts/data/0", "left over")
+	saved, err := SaveCAS(c, "hosts", exampleData, exampleDataSHA, "")
+	if err != nil || !saved {
+		t.Fatalf("The data should be saved: %t %v", saved, err)
+	}
+	if tz.multis != 1 {
+		t.Errorf("The data and checksum should be saved in a single multi: %d", tz.multis)
+	}
+	for path, expected := range map[string]string{"/testing/hosts/data": exampleData, "/testing/hosts/checksum": exampleDataSHA} {
+		if value, _ := tz.value(path); value != expected {
+			t.Errorf("'%s' should be '%s': '%s'", path, expected, value)
+		}
+	}
+	if _, ok := tz.value("/testing/hosts/data/0"); ok {
+		t.Error("The chunks should be removed.")
+	}
+	if saved, err := SaveCAS(c, "hosts", exampleData, exampleDataSHA, ""); err != nil || saved {
+		t.Errorf("The same checksum shouldn't be saved again: %t %v", saved, err)
+	}
+
+	// A KVCAS that lost changes nothing.
+	zk := backend.(txnBackend)
+	index, _, _ := zk.Index("testing/hosts/checksum")
+	Set(c, "testing/hosts/checksum", "changed")
+	ok, err := zk.Txn(consul.TxnOps{
+		{KV: &consul.KVTxnOp{Verb: consul.KVSet, Key: "testing/hosts/data", Value: []byte("new")}},
+		{KV: &consul.KVTxnOp{Verb: consul.KVCAS, Key: "testing/hosts/checksum", Value: []byte("new"), Index: index}},
+	})
+	if err != nil || ok {
+		t.Errorf("The multi should lose: %t %v", ok, err)
+	}
+	if value, _ := tz.value("/testing/hosts/data"); value != exampleData {
+		t.Errorf("A multi that lost shouldn't change anything: '%s'", value)
+	}
+}
+
+func TestZookeeperAuth(t *testing.T) {
+	tz := startTestZookeeper(t, "kvexpress:secret")
+	t.Cleanup(func() { backend = nil })
+	zk, err := newZookeeperBackend([]string{tz.addr}, "kvexpress:secret", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend = zk
+	_, c := newTestConsul(t)
+	if err := Set(c, "testing/hosts/data", exampleData); err != nil {
+		t.Fatal(err)
+	}
+	if tz.logins != 1 {
+		t.Errorf("The session should log in with --zk-auth: %d", tz.logins)
+	}
+	for _, path := range []string{"/testing", "/testing/hosts", "/testing/hosts/data"} {
+		tz.Lock()
+		acl := tz.nodes[path].acl
+		tz.Unlock()
+		if len(acl) != 1 || acl[0] != (zkACL{zkPermAll, "auth", ""}) {
+			t.Errorf("'%s' should only be open to its creator: %v", path, acl)
+		}
+	}
+	CloseBackend()
+	if tz.closed != 1 {
+		t.Errorf("The session should be closed: %d", tz.closed)
+	}
+	// The next call starts a new session.
+	if value, err := Get(c, "testing/hosts/data"); err != nil || value != exampleData || tz.logins != 2 {
+		t.Errorf("A closed backend should connect again: %q %d %v", value, tz.logins, err)
+	}
+
+	wrong, _ := newZookeeperBackend([]string{tz.addr}, "kvexpress:wrong", "", "")
+	if _, err := wrong.Get("testing/hosts/data"); err != zkAuthFailed {
+		t.Errorf("A wrong password should be refused: %v", err)
+	}
+	if _, err := newZookeeperBackend([]string{tz.addr}, "", "", "creator"); err == nil {
+		t.Error("A creator ACL needs --zk-auth.")
+	}
+	if _, err := newZookeeperBackend([]string{tz.addr}, "kvexpress", "", ""); err == nil {
+		t.Error("--zk-auth needs a user and a password.")
+	}
+	if _, err := newZookeeperBackend([]string{tz.addr}, "kvexpress:secret", "", "everyone"); err == nil {
+		t.Error("An unknown --zk-acl should be an error.")
+	}
+}
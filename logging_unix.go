@@ -0,0 +1,17 @@
+// +build linux darwin freebsd
+
+package main
+
+import (
+	"log"
+	"log/syslog"
+)
+
+// setupLogging sends the logs to syslog.
+func setupLogging() {
+	logwriter, e := syslog.New(syslog.LOG_NOTICE, "kvexpress")
+	if e == nil {
+		log.SetFlags(log.Lmicroseconds)
+		log.SetOutput(logwriter)
+	}
+}
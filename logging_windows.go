@@ -0,0 +1,12 @@
+// +build windows
+
+package main
+
+import (
+	"log"
+)
+
+// setupLogging leaves the logs on stderr - there's no syslog on Windows.
+func setupLogging() {
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+}
@@ -1,12 +1,10 @@
-// +build linux darwin freebsd
+// +build linux darwin freebsd windows
 
 package main
 
 import (
 	"fmt"
 	"github.com/DataDog/kvexpress/commands"
-	"log"
-	"log/syslog"
 	"os"
 	"runtime"
 )
@@ -27,11 +25,7 @@ var Version = "No version provided."
 var GoVersion = runtime.Version()
 
 func main() {
-	logwriter, e := syslog.New(syslog.LOG_NOTICE, "kvexpress")
-	if e == nil {
-		log.SetFlags(log.Lmicroseconds)
-		log.SetOutput(logwriter)
-	}
+	setupLogging()
 	commands.Log(fmt.Sprintf("kvexpress version:%s", Version), "info")
 
 	args := os.Args[1:]
@@ -42,5 +36,8 @@ func main() {
 		}
 	}
 
+	commands.Version = Version
 	commands.RootCmd.Execute()
+	commands.CloseBackend()
+	commands.RevokeVaultLease()
 }
@@ -0,0 +1,42 @@
+// +build linux darwin freebsd windows
+
+package kvexpress
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DeltaHunk replaces Delete lines of the base from line At with Insert.
+type DeltaHunk struct {
+	At     int      `json:"at"`
+	Delete int      `json:"delete,omitempty"`
+	Insert []string `json:"insert,omitempty"`
+}
+
+// SplitLines splits data into lines that keep their newlines - so putting
+// them back together is the same data.
+func SplitLines(data string) []string {
+	lines := strings.SplitAfter(data, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// ApplyDelta puts the hunks into base.
+func ApplyDelta(base string, hunks []DeltaHunk) (string, error) {
+	lines := SplitLines(base)
+	var data strings.Builder
+	position := 0
+	for _, hunk := range hunks {
+		if hunk.At < position || hunk.At+hunk.Delete > len(lines) {
+			return "", fmt.Errorf("the delta doesn't fit the base at line %d", hunk.At)
+		}
+		data.WriteString(strings.Join(lines[position:hunk.At], ""))
+		data.WriteString(strings.Join(hunk.Insert, ""))
+		position = hunk.At + hunk.Delete
+	}
+	data.WriteString(strings.Join(lines[position:], ""))
+	return data.String(), nil
+}
@@ -0,0 +1,97 @@
+// +build linux darwin freebsd windows
+
+package kvexpress
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	// EncodingGzip is data that's been gzipped and base64 encoded.
+	EncodingGzip = "gzip"
+
+	// EncodingNone is data that's stored as is.
+	EncodingNone = "none"
+
+	// EncodingBase64 is binary data that's been base64 encoded.
+	EncodingBase64 = "base64"
+
+	// EncodingBinaryGzip is binary data that's been gzipped and base64
+	// encoded.
+	EncodingBinaryGzip = "gzip-binary"
+)
+
+// Decrypter decrypts the stored data for key that was encrypted with scheme -
+// the part of the encoding key after the +. It's called for every key,
+// with a blank scheme for data that isn't encrypted.
+type Decrypter func(key, data, scheme string) (string, error)
+
+// SplitEncoding splits a saved encoding into the encoding and the encryption
+// scheme - it's blank for data that isn't encrypted.
+func SplitEncoding(encoding string) (string, string) {
+	parts := strings.SplitN(strings.TrimSpace(encoding), "+", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// BinaryEncoding is true for the encodings binary data is saved with.
+func BinaryEncoding(encoding string) bool {
+	encoding, _ = SplitEncoding(encoding)
+	return encoding == EncodingBase64 || encoding == EncodingBinaryGzip
+}
+
+// Decompress base64 decodes and gunzips data.
+func Decompress(data string) (string, error) {
+	if data == "" {
+		return "", nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", fmt.Errorf("could not base64 decode string: %v", err)
+	}
+	unzipped, err := gzip.NewReader(strings.NewReader(string(raw)))
+	if err != nil {
+		return "", fmt.Errorf("could not gunzip string: %v", err)
+	}
+	uncompressed, err := ioutil.ReadAll(unzipped)
+	if err != nil {
+		return "", fmt.Errorf("could not ioutil.ReadAll string: %v", err)
+	}
+	return string(uncompressed), nil
+}
+
+// Decode decrypts and decodes the stored data for key with the encoding that
+// was saved with it. Without decrypt only data that isn't encrypted can be
+// decoded.
+func Decode(key, data, encoding string, decrypt Decrypter) (string, error) {
+	encoding, scheme := SplitEncoding(encoding)
+	var err error
+	switch {
+	case decrypt != nil:
+		data, err = decrypt(key, data, scheme)
+	case scheme != "":
+		err = ErrEncrypted
+	}
+	if err != nil {
+		return "", err
+	}
+	switch encoding {
+	case EncodingGzip, EncodingBinaryGzip:
+		return Decompress(data)
+	case EncodingBase64:
+		decoded, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return "", fmt.Errorf("could not base64 decode '%s': %v", key, err)
+		}
+		return string(decoded), nil
+	case EncodingNone:
+		return data, nil
+	}
+	return "", fmt.Errorf("%w: '%s'", ErrUnsupported, encoding)
+}
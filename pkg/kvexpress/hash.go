@@ -0,0 +1,96 @@
+// +build linux darwin freebsd windows
+
+package kvexpress
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"golang.org/x/crypto/blake2b"
+	"strings"
+)
+
+// HashData returns the hex checksum of data with alg - sha256, sha512 or
+// blake2b. It's blank for any other algorithm.
+func HashData(data, alg string) string {
+	switch alg {
+	case "sha256":
+		return fmt.Sprintf("%x", sha256.Sum256([]byte(data)))
+	case "sha512":
+		return fmt.Sprintf("%x", sha512.Sum512([]byte(data)))
+	case "blake2b":
+		return fmt.Sprintf("%x", blake2b.Sum512([]byte(data)))
+	}
+	return ""
+}
+
+// ParseChecksum splits a stored checksum into its algorithm and hex value. A
+// plain hex value is sha256 - that's what every checksum was before there
+// was a choice.
+func ParseChecksum(checksum string) (string, string, bool) {
+	checksum = strings.TrimSpace(checksum)
+	if parts := strings.SplitN(checksum, ":", 2); len(parts) == 2 {
+		return parts[0], parts[1], true
+	}
+	return "sha256", checksum, false
+}
+
+// ChecksumAs computes the checksum of data in the same algorithm and format
+// as checksum so the two can be compared.
+func ChecksumAs(data, checksum string) string {
+	alg, _, prefixed := ParseChecksum(checksum)
+	hash := HashData(data, alg)
+	if prefixed && hash != "" {
+		return alg + ":" + hash
+	}
+	return hash
+}
+
+// ChecksumMatches is true if data has checksum - in whatever algorithm the
+// checksum was made with.
+func ChecksumMatches(data, checksum string) bool {
+	return strings.TrimSpace(ChecksumAs(data, checksum)) == strings.TrimSpace(checksum)
+}
+
+// StoreChecksum is the checksum key for data - with the first of algs. A
+// sha256 checksum is saved as plain hex so older versions can still read it.
+func StoreChecksum(data string, algs []string) string {
+	if len(algs) == 0 || algs[0] == "sha256" {
+		return Checksum(data)
+	}
+	return algs[0] + ":" + HashData(data, algs[0])
+}
+
+// StoreChecksums is the checksums key for data - a line for each of algs.
+// It's blank when there's only one as the checksum key has that.
+func StoreChecksums(data string, algs []string) string {
+	if len(algs) < 2 {
+		return ""
+	}
+	var lines []string
+	for _, alg := range algs {
+		lines = append(lines, alg+":"+HashData(data, alg))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ReadChecksum returns the checksum to verify key with. If there's a
+// checksums key the first of algs that's in it is used - otherwise it's the
+// checksum key. That way readers can move to a new algorithm before the
+// writers stop saving the old one.
+func ReadChecksum(s Store, key string, algs []string) (string, error) {
+	checksums, err := s.Get(s.Path(key, "checksums"))
+	if err != nil {
+		return "", err
+	}
+	if checksums != "" {
+		for _, alg := range algs {
+			for _, line := range strings.Split(checksums, "\n") {
+				if lineAlg, _, _ := ParseChecksum(line); lineAlg == alg {
+					return strings.TrimSpace(line), nil
+				}
+			}
+		}
+	}
+	return s.Get(s.Path(key, "checksum"))
+}
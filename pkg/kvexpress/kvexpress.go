@@ -0,0 +1,275 @@
+// +build linux darwin freebsd windows
+
+// Package kvexpress is the core of kvexpress as a library - reading and
+// saving keys with their checksums, writing files atomically and the file
+// locks - for tools that embed it instead of running the binary. Nothing in
+// it reads flags or globals: everything comes from the Client, and errors
+// are returned instead of exiting.
+//
+// The command reads and saves keys with the same code - the manifest,
+// chunks, content-addressed data, deltas, encodings, checksums and
+// signatures - so Load gives the same answer as `kvexpress out` before a
+// template or the checks on the data. The keys are laid out the same way as
+// the command's standard layout - prefix/key/data.
+package kvexpress
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+)
+
+// DefaultPrefix is the prefix kvexpress uses without --prefix.
+const DefaultPrefix = "kvexpress"
+
+var (
+	// ErrNoData is returned by Load when there isn't any data in the key.
+	ErrNoData = errors.New("kvexpress: there's no data in the key")
+
+	// ErrChecksumMismatch is returned by Load when the data doesn't match
+	// its checksum.
+	ErrChecksumMismatch = errors.New("kvexpress: the data doesn't match its checksum")
+
+	// ErrConflict is returned by Save when another producer changed the key
+	// while it was being saved - read it again and retry.
+	ErrConflict = errors.New("kvexpress: the key changed while it was saved")
+
+	// ErrUnsupported is returned by Load for data that was saved with an
+	// encoding it doesn't know.
+	ErrUnsupported = errors.New("kvexpress: unknown encoding")
+
+	// ErrEncrypted is returned by Load for encrypted data when the Client
+	// doesn't have a Decrypt.
+	ErrEncrypted = errors.New("kvexpress: the data is encrypted")
+
+	// ErrBadSignature is returned when the data doesn't match its signature.
+	ErrBadSignature = errors.New("kvexpress: the data does not match the signature")
+)
+
+// Client reads and writes kvexpress keys. The zero Prefix is DefaultPrefix
+// and the zero Hostname is the host's name.
+type Client struct {
+	Consul   *consul.Client
+	Prefix   string
+	Hostname string
+
+	// Hashes are the checksums Save makes and the ones Load picks from a
+	// key's checksums - in order, like --hash. The zero Hashes is sha256.
+	Hashes []string
+
+	// SignKey signs the data Save saves and VerifyKey makes Load check the
+	// signature saved with it - like --sign-key and --verify-key. Data
+	// without a signature doesn't load with a VerifyKey.
+	SignKey   ed25519.PrivateKey
+	VerifyKey ed25519.PublicKey
+
+	// Decrypt decrypts data that was saved encrypted.
+	Decrypt Decrypter
+
+	// Source is saved in the meta key with every change Save makes.
+	Source string
+}
+
+// Meta is saved in the meta key every time the data is changed.
+type Meta struct {
+	Host    string `json:"host"`
+	User    string `json:"user"`
+	Version string `json:"version"`
+	Source  string `json:"source"`
+	Updated string `json:"updated"`
+	RunID   string `json:"run_id,omitempty"`
+}
+
+// New returns a Client for the keys under prefix.
+func New(c *consul.Client, prefix string) *Client {
+	return &Client{Consul: c, Prefix: prefix}
+}
+
+// Checksum is the SHA256 checksum kvexpress saves with the data.
+func Checksum(data string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(data)))
+}
+
+// KeyPath is the path of part - data, checksum, updated, lock or stop - for key.
+func KeyPath(prefix, key, part string) string {
+	return fmt.Sprintf("%s/%s/%s", strings.TrimPrefix(prefix, "/"), key, part)
+}
+
+// KeyPath is the path of part for key under the Client's prefix.
+func (cl *Client) KeyPath(key, part string) string {
+	return KeyPath(cl.prefix(), key, part)
+}
+
+// prefix is the Client's Prefix - or DefaultPrefix.
+func (cl *Client) prefix() string {
+	if cl.Prefix == "" {
+		return DefaultPrefix
+	}
+	return cl.Prefix
+}
+
+// clientStore reads the parts of a key for the Client with ctx.
+type clientStore struct {
+	cl  *Client
+	ctx context.Context
+}
+
+// Path is the Client's KeyPath.
+func (s clientStore) Path(key, part string) string {
+	return s.cl.KeyPath(key, part)
+}
+
+// Get is the Client's Get with the store's context.
+func (s clientStore) Get(path string) (string, error) {
+	return s.cl.Get(s.ctx, path)
+}
+
+// hostname is the name the file locks are saved under.
+func (cl *Client) hostname() string {
+	if cl.Hostname != "" {
+		return cl.Hostname
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return hostname
+}
+
+// Get returns the value of path - "" if it doesn't exist.
+func (cl *Client) Get(ctx context.Context, path string) (string, error) {
+	pair, _, err := cl.Consul.KV().Get(strings.TrimPrefix(path, "/"), (&consul.QueryOptions{}).WithContext(ctx))
+	if err != nil || pair == nil {
+		return "", err
+	}
+	return string(pair.Value), nil
+}
+
+// Set saves value at path.
+func (cl *Client) Set(ctx context.Context, path, value string) error {
+	_, err := cl.Consul.KV().Put(&consul.KVPair{Key: strings.TrimPrefix(path, "/"), Value: []byte(value)}, (&consul.WriteOptions{}).WithContext(ctx))
+	return err
+}
+
+// Delete removes path.
+func (cl *Client) Delete(ctx context.Context, path string) error {
+	_, err := cl.Consul.KV().Delete(strings.TrimPrefix(path, "/"), (&consul.WriteOptions{}).WithContext(ctx))
+	return err
+}
+
+// Load reads the data of key - from wherever its manifest says it is - and
+// decodes it, then makes sure it matches its checksum and, with a VerifyKey,
+// its signature.
+func (cl *Client) Load(ctx context.Context, key string) (string, string, error) {
+	s := clientStore{cl: cl, ctx: ctx}
+	manifest, err := ReadManifest(s, key)
+	if err != nil {
+		return "", "", err
+	}
+	stored, contentChecksum, err := ReadData(s, key, manifest)
+	if err != nil {
+		return "", "", err
+	}
+	encoding, err := cl.Get(ctx, cl.KeyPath(key, "encoding"))
+	if err != nil {
+		return "", "", err
+	}
+	if strings.TrimSpace(encoding) == "" {
+		encoding = EncodingNone
+	}
+	data, err := Decode(key, stored, encoding, cl.Decrypt)
+	if err != nil {
+		return "", "", err
+	}
+	checksum := contentChecksum
+	if checksum == "" {
+		if checksum, err = ReadChecksum(s, key, cl.hashes()); err != nil {
+			return "", "", err
+		}
+	}
+	checksum = strings.TrimSpace(checksum)
+	if stored == "" || checksum == "" {
+		return "", "", ErrNoData
+	}
+	if !ChecksumMatches(data, checksum) {
+		return "", "", ErrChecksumMismatch
+	}
+	if cl.VerifyKey != nil {
+		if _, err := VerifyKey(s, cl.VerifyKey, key, contentChecksum, data); err != nil {
+			return "", "", err
+		}
+	}
+	return data, checksum, nil
+}
+
+// Save saves data and its checksum in key - with a check-and-set on the data
+// and checksum, in one transaction with the updated, encoding, checksums,
+// meta and signature keys, so a reader never sees the data with another
+// checksum. Anything that was saved in another layout is removed. It returns
+// false if the data was already saved and ErrConflict if another producer
+// saved at the same time.
+func (cl *Client) Save(ctx context.Context, key, data string) (bool, error) {
+	checksum := StoreChecksum(data, cl.hashes())
+	dataIndex, _, err := cl.index(ctx, cl.KeyPath(key, "data"))
+	if err != nil {
+		return false, err
+	}
+	checksumIndex, current, err := cl.index(ctx, cl.KeyPath(key, "checksum"))
+	if err != nil {
+		return false, err
+	}
+	if strings.TrimSpace(current) == checksum {
+		return false, nil
+	}
+	updated := time.Now().UTC().Format(time.RFC3339)
+	ops := SaveOps(clientStore{cl: cl, ctx: ctx}, key, data, checksum, StoreChecksums(data, cl.hashes()), EncodingNone, updated, dataIndex, checksumIndex)
+	meta, _ := json.Marshal(Meta{Host: cl.hostname(), User: currentUser(), Source: cl.Source, Updated: updated})
+	ops = append(ops, &consul.TxnOp{KV: &consul.KVTxnOp{Verb: consul.KVSet, Key: cl.KeyPath(key, "meta"), Value: meta}})
+	if cl.SignKey != nil {
+		signature := Sign(cl.SignKey, key, checksum, updated, data)
+		ops = append(ops, &consul.TxnOp{KV: &consul.KVTxnOp{Verb: consul.KVSet, Key: cl.KeyPath(key, "signature"), Value: []byte(signature)}})
+	}
+	ok, _, _, err := cl.Consul.Txn().Txn(ops, (&consul.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, ErrConflict
+	}
+	return true, nil
+}
+
+// index is the ModifyIndex and value of path from a consistent read - 0 if
+// it isn't there.
+func (cl *Client) index(ctx context.Context, path string) (uint64, string, error) {
+	pair, _, err := cl.Consul.KV().Get(strings.TrimPrefix(path, "/"), (&consul.QueryOptions{RequireConsistent: true}).WithContext(ctx))
+	if err != nil || pair == nil {
+		return 0, "", err
+	}
+	return pair.ModifyIndex, string(pair.Value), nil
+}
+
+// hashes is the Client's Hashes - or sha256.
+func (cl *Client) hashes() []string {
+	if len(cl.Hashes) == 0 {
+		return []string{"sha256"}
+	}
+	return cl.Hashes
+}
+
+// currentUser is the name of the user saving the data.
+func currentUser() string {
+	current, err := user.Current()
+	if err != nil {
+		return "unknown"
+	}
+	return current.Username
+}
@@ -0,0 +1,303 @@
+// +build linux darwin freebsd
+
+package kvexpress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	consul "github.com/hashicorp/consul/api"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testKV is a small in-memory stand-in for the Consul KV and txn endpoints.
+type testKV struct {
+	sync.Mutex
+	kv    map[string]*consul.KVPair
+	index uint64
+}
+
+func newTestClient(t *testing.T) (*testKV, *Client) {
+	tkv := &testKV{kv: make(map[string]*consul.KVPair), index: 1}
+	server := httptest.NewServer(http.HandlerFunc(tkv.handle))
+	t.Cleanup(server.Close)
+	c, err := consul.NewClient(&consul.Config{Address: strings.TrimPrefix(server.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tkv, &Client{Consul: c, Prefix: "testing", Hostname: "host"}
+}
+
+func (tkv *testKV) value(key string) (string, bool) {
+	tkv.Lock()
+	defer tkv.Unlock()
+	pair, ok := tkv.kv[key]
+	if !ok {
+		return "", false
+	}
+	return string(pair.Value), true
+}
+
+func (tkv *testKV) put(key, value string) {
+	tkv.Lock()
+	defer tkv.Unlock()
+	tkv.set(key, []byte(value))
+}
+
+func (tkv *testKV) set(key string, value []byte) {
+	tkv.index++
+	tkv.kv[key] = &consul.KVPair{Key: key, Value: value, ModifyIndex: tkv.index}
+}
+
+func (tkv *testKV) remove(key string, tree bool) {
+	for k := range tkv.kv {
+		if k == key || tree && strings.HasPrefix(k, key) {
+			delete(tkv.kv, k)
+		}
+	}
+}
+
+func (tkv *testKV) handle(w http.ResponseWriter, r *http.Request) {
+	tkv.Lock()
+	defer tkv.Unlock()
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(tkv.index, 10))
+	if r.URL.Path == "/v1/txn" {
+		var ops consul.TxnOps
+		json.NewDecoder(r.Body).Decode(&ops)
+		for i, op := range ops {
+			pair, ok := tkv.kv[op.KV.Key]
+			if op.KV.Verb == consul.KVCAS && ((op.KV.Index == 0 && ok) || (op.KV.Index != 0 && (!ok || pair.ModifyIndex != op.KV.Index))) {
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(consul.TxnResponse{Errors: consul.TxnErrors{{OpIndex: i, What: "cas failed"}}})
+				return
+			}
+		}
+		for _, op := range ops {
+			switch op.KV.Verb {
+			case consul.KVSet, consul.KVCAS:
+				tkv.set(op.KV.Key, op.KV.Value)
+			case consul.KVDelete, consul.KVDeleteTree:
+				tkv.remove(op.KV.Key, op.KV.Verb == consul.KVDeleteTree)
+			}
+		}
+		json.NewEncoder(w).Encode(consul.TxnResponse{})
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	switch r.Method {
+	case "GET":
+		pair, ok := tkv.kv[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode([]*consul.KVPair{pair})
+	case "PUT":
+		body, _ := ioutil.ReadAll(r.Body)
+		tkv.set(key, body)
+		w.Write([]byte("true"))
+	case "DELETE":
+		tkv.remove(key, false)
+		w.Write([]byte("true"))
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	tkv, cl := newTestClient(t)
+	ctx := context.Background()
+	if _, _, err := cl.Load(ctx, "hosts"); err != ErrNoData {
+		t.Errorf("A key without data should be ErrNoData: %v", err)
+	}
+	tkv.put("testing/hosts/manifest", `{"count":2}`)
+	saved, err := cl.Save(ctx, "hosts", "data\n")
+	if err != nil || !saved {
+		t.Fatalf("The data should be saved: %t %v", saved, err)
+	}
+	if _, ok := tkv.value("testing/hosts/manifest"); ok {
+		t.Error("The manifest from another layout should be removed.")
+	}
+	data, checksum, err := cl.Load(ctx, "hosts")
+	if err != nil || data != "data\n" || checksum != Checksum("data\n") {
+		t.Errorf("The data should be loaded: '%s' '%s' %v", data, checksum, err)
+	}
+	if saved, err := cl.Save(ctx, "hosts", "data\n"); err != nil || saved {
+		t.Errorf("The same data shouldn't be saved again: %t %v", saved, err)
+	}
+
+	tkv.put("testing/hosts/data", "changed\n")
+	if _, _, err := cl.Load(ctx, "hosts"); err != ErrChecksumMismatch {
+		t.Errorf("Data that doesn't match its checksum should be ErrChecksumMismatch: %v", err)
+	}
+	tkv.put("testing/hosts/encoding", "zstd")
+	if _, _, err := cl.Load(ctx, "hosts"); !errors.Is(err, ErrUnsupported) {
+		t.Errorf("An unknown encoding should be ErrUnsupported: %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := cl.Save(cancelled, "hosts", "new\n"); err == nil {
+		t.Error("A cancelled context should stop the save.")
+	}
+}
+
+func TestLoadLayouts(t *testing.T) {
+	tkv, cl := newTestClient(t)
+	ctx := context.Background()
+	data := "a\nb\nc\n"
+
+	// Chunks.
+	tkv.put("testing/hosts/manifest", `{"count":2,"size":6,"checksums":["`+Checksum("a\nb")+`","`+Checksum("\nc\n")+`"]}`)
+	tkv.put("testing/hosts/data/0", "a\nb")
+	tkv.put("testing/hosts/data/1", "\nc\n")
+	tkv.put("testing/hosts/checksum", Checksum(data))
+	if loaded, _, err := cl.Load(ctx, "hosts"); err != nil || loaded != data {
+		t.Errorf("Chunked data should be reassembled: %q %v", loaded, err)
+	}
+	tkv.put("testing/hosts/data/1", "\nd\n")
+	if _, _, err := cl.Load(ctx, "hosts"); err == nil {
+		t.Error("A chunk that doesn't match the manifest should be an error.")
+	}
+
+	// Content-addressed - the checksum comes with the manifest.
+	tkv.put("testing/hosts/manifest", `{"count":0,"checksums":[],"checksum":"`+Checksum(data)+`"}`)
+	tkv.put("testing/hosts/data/"+Checksum(data), data)
+	tkv.put("testing/hosts/checksum", "stale")
+	if loaded, checksum, err := cl.Load(ctx, "hosts"); err != nil || loaded != data || checksum != Checksum(data) {
+		t.Errorf("Content-addressed data should be read: %q %s %v", loaded, checksum, err)
+	}
+
+	// A delta from a base.
+	hunks, _ := json.Marshal([]DeltaHunk{{At: 1, Delete: 1, Insert: []string{"x\n"}}})
+	tkv.put("testing/hosts/base", data)
+	tkv.put("testing/hosts/delta", string(hunks))
+	tkv.put("testing/hosts/manifest", `{"count":0,"checksums":[],"base":"`+Checksum(data)+`","delta":"`+Checksum(string(hunks))+`"}`)
+	tkv.put("testing/hosts/checksum", Checksum("a\nx\nc\n"))
+	if loaded, _, err := cl.Load(ctx, "hosts"); err != nil || loaded != "a\nx\nc\n" {
+		t.Errorf("The delta should be put into the base: %q %v", loaded, err)
+	}
+
+	// Gzipped, with a checksums key.
+	tkv.Lock()
+	tkv.remove("testing/hosts/", true)
+	tkv.Unlock()
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write([]byte(data))
+	gz.Close()
+	tkv.put("testing/hosts/data", base64.StdEncoding.EncodeToString(compressed.Bytes()))
+	tkv.put("testing/hosts/encoding", EncodingGzip)
+	tkv.put("testing/hosts/checksum", "stale")
+	tkv.put("testing/hosts/checksums", StoreChecksums(data, []string{"sha256", "sha512"}))
+	cl.Hashes = []string{"sha512"}
+	if loaded, checksum, err := cl.Load(ctx, "hosts"); err != nil || loaded != data || checksum != "sha512:"+HashData(data, "sha512") {
+		t.Errorf("Gzipped data should be checked with the first hash in checksums: %q %s %v", loaded, checksum, err)
+	}
+
+	tkv.put("testing/hosts/encoding", EncodingGzip+"+aes-gcm")
+	if _, _, err := cl.Load(ctx, "hosts"); !errors.Is(err, ErrEncrypted) {
+		t.Errorf("Encrypted data without a Decrypt should be ErrEncrypted: %v", err)
+	}
+}
+
+func TestSaveSigned(t *testing.T) {
+	tkv, cl := newTestClient(t)
+	ctx := context.Background()
+	public, private, _ := ed25519.GenerateKey(nil)
+	cl.Hashes, cl.SignKey, cl.Source = []string{"sha256", "blake2b"}, private, "testing"
+	if saved, err := cl.Save(ctx, "hosts", "data\n"); err != nil || !saved {
+		t.Fatalf("The data should be saved: %t %v", saved, err)
+	}
+	if checksums, _ := tkv.value("testing/hosts/checksums"); checksums != StoreChecksums("data\n", cl.Hashes) {
+		t.Errorf("Every hash should be saved: %q", checksums)
+	}
+	var meta Meta
+	value, _ := tkv.value("testing/hosts/meta")
+	if err := json.Unmarshal([]byte(value), &meta); err != nil || meta.Source != "testing" || meta.Host != "host" {
+		t.Errorf("The meta key should be saved with the data: %q %v", value, err)
+	}
+
+	cl.VerifyKey = public
+	if data, _, err := cl.Load(ctx, "hosts"); err != nil || data != "data\n" {
+		t.Errorf("The signature should verify: %q %v", data, err)
+	}
+	tkv.put("testing/hosts/signature", Sign(private, "other", Checksum("data\n"), "2024-01-01T00:00:00Z", "data\n"))
+	if _, _, err := cl.Load(ctx, "hosts"); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("A signature for another key shouldn't verify: %v", err)
+	}
+	tkv.Lock()
+	tkv.remove("testing/hosts/signature", false)
+	tkv.Unlock()
+	if _, _, err := cl.Load(ctx, "hosts"); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Data without a signature shouldn't load with a VerifyKey: %v", err)
+	}
+}
+
+func TestKeyPaths(t *testing.T) {
+	cl := &Client{Hostname: "host"}
+	if path := cl.KeyPath("hosts", "data"); path != "kvexpress/hosts/data" {
+		t.Errorf("The blank prefix should be the default: '%s'", path)
+	}
+	if path := FileLockPath("/testing", "host", "/etc/hosts"); path != "testing/locks/"+Checksum("/etc/hosts")+"/host" {
+		t.Errorf("The lock path should be under the prefix: '%s'", path)
+	}
+}
+
+func TestLock(t *testing.T) {
+	tkv, cl := newTestClient(t)
+	ctx := context.Background()
+	if err := cl.Lock(ctx, "/etc/hosts", "testing", 0); err != nil {
+		t.Fatal(err)
+	}
+	if reason, err := cl.CheckLock(ctx, "/etc/hosts"); err != nil || reason != "testing" {
+		t.Errorf("The file should be locked: '%s' %v", reason, err)
+	}
+	if err := cl.Unlock(ctx, "/etc/hosts"); err != nil {
+		t.Fatal(err)
+	}
+	if reason, _ := cl.CheckLock(ctx, "/etc/hosts"); reason != "" {
+		t.Errorf("The file should be unlocked: '%s'", reason)
+	}
+
+	expired := `{"reason":"old","expires":"` + time.Now().Add(-time.Minute).UTC().Format(time.RFC3339) + `"}`
+	tkv.put(cl.FileLockPath("/etc/hosts"), expired)
+	if reason, err := cl.CheckLock(ctx, "/etc/hosts"); err != nil || reason != "" {
+		t.Errorf("An expired lock shouldn't lock the file: '%s' %v", reason, err)
+	}
+	if _, ok := tkv.value(cl.FileLockPath("/etc/hosts")); ok {
+		t.Error("The expired lock should be removed.")
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvexpress")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "hosts")
+	ioutil.WriteFile(file, []byte("old\n"), 0644)
+	if err := WriteFile(file, []byte("new\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(file)
+	info, _ := os.Stat(file)
+	if string(data) != "new\n" || info.Mode().Perm() != 0600 {
+		t.Errorf("The file should be replaced: '%s' %v", data, info.Mode())
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("The temporary file should be gone: %d files", len(files))
+	}
+}
@@ -0,0 +1,78 @@
+// +build linux darwin freebsd windows
+
+package kvexpress
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// lockExpiry is the value of a lock key with a ttl.
+type lockExpiry struct {
+	Reason  string    `json:"reason"`
+	Locked  time.Time `json:"locked,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// FileLockPath is the lock key for file on hostname - the same key
+// `kvexpress lock` saves.
+func FileLockPath(prefix, hostname, file string) string {
+	return fmt.Sprintf("%s/locks/%x/%s", strings.TrimPrefix(prefix, "/"), sha256.Sum256([]byte(file)), hostname)
+}
+
+// FileLockPath is the lock key for file on the Client's host.
+func (cl *Client) FileLockPath(file string) string {
+	return FileLockPath(cl.prefix(), cl.hostname(), file)
+}
+
+// LockValue is what's saved in a lock key. Without a ttl it's just the
+// reason - the same as older versions of kvexpress.
+func LockValue(reason string, ttl time.Duration) string {
+	if ttl <= 0 {
+		return reason
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	value, _ := json.Marshal(lockExpiry{Reason: reason, Locked: now, Expires: now.Add(ttl)})
+	return string(value)
+}
+
+// ParseLock returns the reason and expiry from a lock key - the expiry is zero
+// if the lock doesn't expire.
+func ParseLock(value string) (string, time.Time) {
+	var lock lockExpiry
+	if err := json.Unmarshal([]byte(value), &lock); err != nil || lock.Expires.IsZero() {
+		return value, time.Time{}
+	}
+	return lock.Reason, lock.Expires
+}
+
+// Lock stops `kvexpress out` writing file on this host - until Unlock or,
+// with a ttl, until it expires.
+func (cl *Client) Lock(ctx context.Context, file, reason string, ttl time.Duration) error {
+	return cl.Set(ctx, cl.FileLockPath(file), LockValue(reason, ttl))
+}
+
+// Unlock removes the lock on file.
+func (cl *Client) Unlock(ctx context.Context, file string) error {
+	return cl.Delete(ctx, cl.FileLockPath(file))
+}
+
+// CheckLock returns the reason file is locked on this host - or "" if it
+// isn't. An expired lock is removed. The `$filename.locked` file the
+// command leaves next to a locked file is up to the caller.
+func (cl *Client) CheckLock(ctx context.Context, file string) (string, error) {
+	path := cl.FileLockPath(file)
+	value, err := cl.Get(ctx, path)
+	if err != nil || value == "" {
+		return "", err
+	}
+	reason, expires := ParseLock(value)
+	if expires.IsZero() || time.Now().Before(expires) {
+		return reason, nil
+	}
+	return "", cl.Delete(ctx, path)
+}
@@ -0,0 +1,170 @@
+// +build linux darwin freebsd windows
+
+package kvexpress
+
+import (
+	"encoding/json"
+	"fmt"
+	consul "github.com/hashicorp/consul/api"
+	"strings"
+)
+
+// Store is where the parts of a key are read from. The Client reads them
+// from Consul - the command reads them with its retries, stale reads and
+// --backend, and its --key-template paths.
+type Store interface {
+	// Path is where part of key is saved.
+	Path(key, part string) string
+
+	// Get returns the value at path - "" if it isn't there.
+	Get(path string) (string, error)
+}
+
+// Manifest describes data that's too large for a single Consul value and has
+// been split into Path(key, "data")/0..Count-1. Content-addressed data has a
+// Checksum instead - it's in Path(key, "data")/<checksum>. Data saved as a
+// delta has the checksums of its Base and Delta keys.
+type Manifest struct {
+	Count     int      `json:"count"`
+	Size      int      `json:"size"`
+	Checksums []string `json:"checksums"`
+	Checksum  string   `json:"checksum,omitempty"`
+	Base      string   `json:"base,omitempty"`
+	Delta     string   `json:"delta,omitempty"`
+}
+
+// ParseManifest reads a manifest - nil if it's blank.
+func ParseManifest(value string) (*Manifest, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var manifest Manifest
+	if err := json.Unmarshal([]byte(value), &manifest); err != nil {
+		return nil, fmt.Errorf("could not parse the manifest: %v", err)
+	}
+	if len(manifest.Checksums) != manifest.Count {
+		return nil, fmt.Errorf("the manifest has %d checksums for %d chunks", len(manifest.Checksums), manifest.Count)
+	}
+	return &manifest, nil
+}
+
+// ReadManifest returns the manifest for key - or nil if the data is in the
+// data key.
+func ReadManifest(s Store, key string) (*Manifest, error) {
+	value, err := s.Get(s.Path(key, "manifest"))
+	if err != nil {
+		return nil, err
+	}
+	return ParseManifest(value)
+}
+
+// ChunkPath is where chunk of the data for key is saved.
+func ChunkPath(s Store, key string, chunk int) string {
+	return fmt.Sprintf("%s/%d", s.Path(key, "data"), chunk)
+}
+
+// ContentName is the key the data with checksum is saved at - a checksum
+// with an algorithm has its colon swapped so it's one path segment.
+func ContentName(checksum string) string {
+	return strings.Replace(strings.TrimSpace(checksum), ":", "-", -1)
+}
+
+// ContentPath is where the content-addressed data with checksum is saved
+// for key.
+func ContentPath(s Store, key, checksum string) string {
+	return s.Path(key, "data") + "/" + ContentName(checksum)
+}
+
+// ReadData returns the data for key as it's stored - still encoded - from
+// wherever manifest says it is. It's reassembled and checked against the
+// manifest if it was saved in chunks or as a delta. The checksum is only
+// returned for content-addressed data - it's read with the data so the two
+// always go together, even while a new version is switched in.
+func ReadData(s Store, key string, manifest *Manifest) (string, string, error) {
+	switch {
+	case manifest == nil:
+		data, err := s.Get(s.Path(key, "data"))
+		return data, "", err
+	case manifest.Checksum != "":
+		data, err := ReadContent(s, key, manifest.Checksum)
+		return data, manifest.Checksum, err
+	case manifest.Base != "":
+		data, err := readDelta(s, key, manifest)
+		return data, "", err
+	}
+	var data strings.Builder
+	for i := 0; i < manifest.Count; i++ {
+		chunk, err := s.Get(ChunkPath(s, key, i))
+		if err != nil {
+			return "", "", err
+		}
+		if Checksum(chunk) != manifest.Checksums[i] {
+			return "", "", fmt.Errorf("chunk %d does not match its checksum", i)
+		}
+		data.WriteString(chunk)
+	}
+	return data.String(), "", nil
+}
+
+// ReadContent reads the content-addressed data for checksum. The data at a
+// checksum never changes, so it doesn't matter if the manifest has moved on
+// since it was read.
+func ReadContent(s Store, key, checksum string) (string, error) {
+	data, err := s.Get(ContentPath(s, key, checksum))
+	if err != nil {
+		return "", err
+	}
+	if data == "" {
+		return "", fmt.Errorf("the data for checksum '%s' is missing", checksum)
+	}
+	return data, nil
+}
+
+// readDelta reads the base and delta the manifest points at and puts them
+// together. They're checked against the manifest - a new base or delta that
+// was saved while they were read is an error rather than the wrong data.
+func readDelta(s Store, key string, manifest *Manifest) (string, error) {
+	base, err := s.Get(s.Path(key, "base"))
+	if err != nil {
+		return "", err
+	}
+	if Checksum(base) != manifest.Base {
+		return "", fmt.Errorf("the base doesn't match the manifest")
+	}
+	delta, err := s.Get(s.Path(key, "delta"))
+	if err != nil {
+		return "", err
+	}
+	if Checksum(delta) != manifest.Delta {
+		return "", fmt.Errorf("the delta doesn't match the manifest")
+	}
+	var hunks []DeltaHunk
+	if err := json.Unmarshal([]byte(delta), &hunks); err != nil {
+		return "", fmt.Errorf("could not parse the delta: %v", err)
+	}
+	return ApplyDelta(base, hunks)
+}
+
+// SaveOps saves data in key's data key with a check-and-set on the data and
+// checksum keys at the indexes they were read at - 0 if they weren't there -
+// along with the updated, encoding and checksums keys. Anything left over
+// from data that was saved in chunks, content-addressed or as a delta is
+// removed in the same transaction.
+func SaveOps(s Store, key, data, checksum, checksums, encoding, updated string, dataIndex, checksumIndex uint64) consul.TxnOps {
+	KeyData := s.Path(key, "data")
+	checksumsOp := &consul.TxnOp{KV: &consul.KVTxnOp{Verb: consul.KVDelete, Key: s.Path(key, "checksums")}}
+	if checksums != "" {
+		checksumsOp = &consul.TxnOp{KV: &consul.KVTxnOp{Verb: consul.KVSet, Key: s.Path(key, "checksums"), Value: []byte(checksums)}}
+	}
+	return consul.TxnOps{
+		{KV: &consul.KVTxnOp{Verb: consul.KVCAS, Key: KeyData, Value: []byte(data), Index: dataIndex}},
+		{KV: &consul.KVTxnOp{Verb: consul.KVCAS, Key: s.Path(key, "checksum"), Value: []byte(checksum), Index: checksumIndex}},
+		{KV: &consul.KVTxnOp{Verb: consul.KVSet, Key: s.Path(key, "updated"), Value: []byte(updated)}},
+		{KV: &consul.KVTxnOp{Verb: consul.KVSet, Key: s.Path(key, "encoding"), Value: []byte(encoding)}},
+		checksumsOp,
+		{KV: &consul.KVTxnOp{Verb: consul.KVDelete, Key: s.Path(key, "manifest")}},
+		{KV: &consul.KVTxnOp{Verb: consul.KVDeleteTree, Key: KeyData + "/"}},
+		{KV: &consul.KVTxnOp{Verb: consul.KVDelete, Key: s.Path(key, "base")}},
+		{KV: &consul.KVTxnOp{Verb: consul.KVDelete, Key: s.Path(key, "delta")}},
+	}
+}
@@ -0,0 +1,92 @@
+// +build linux darwin freebsd windows
+
+package kvexpress
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// signatureVersion starts the signature saved in Path(key, "signature"). The
+// key, its checksum and when it was signed are signed with the data, so the
+// signature for one key - or an older version of it - can't be saved with
+// another.
+const signatureVersion = "v2"
+
+// SignedKey is the key a signature is made for - canary and staged data are
+// signed for the key they're promoted to.
+func SignedKey(key string) string {
+	key = strings.Trim(key, "/")
+	for _, suffix := range []string{"/canary", "/staged"} {
+		key = strings.TrimSuffix(key, suffix)
+	}
+	return key
+}
+
+// signedMessage is what's signed for the uncompressed data in key.
+func signedMessage(key, checksum, signed, data string) string {
+	return fmt.Sprintf("kvexpress signature %s\nkey: %s\nchecksum: %s\nsigned: %s\n\n%s", signatureVersion, SignedKey(key), strings.TrimSpace(checksum), signed, data)
+}
+
+// SignData signs data and returns the base64 encoded signature.
+func SignData(private ed25519.PrivateKey, data string) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(private, []byte(data)))
+}
+
+// VerifyData returns ErrBadSignature unless signature is a valid signature of
+// data.
+func VerifyData(public ed25519.PublicKey, data, signature string) error {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signature))
+	if err != nil || !ed25519.Verify(public, []byte(data), raw) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Sign signs the uncompressed data for key with its checksum and signed - an
+// RFC3339 time - and returns what's saved in Path(key, "signature").
+func Sign(private ed25519.PrivateKey, key, checksum, signed, data string) string {
+	return fmt.Sprintf("%s %s %s", signatureVersion, signed, SignData(private, signedMessage(key, checksum, signed, data)))
+}
+
+// VerifySignature returns when the data was signed, or ErrBadSignature
+// unless signature was made by Sign for the same key, checksum and data.
+func VerifySignature(public ed25519.PublicKey, key, checksum, data, signature string) (time.Time, error) {
+	fields := strings.Fields(signature)
+	if len(fields) != 3 || fields[0] != signatureVersion {
+		return time.Time{}, fmt.Errorf("%w - it isn't a %s signature, save the key again with --sign-key", ErrBadSignature, signatureVersion)
+	}
+	signed, err := time.Parse(time.RFC3339, fields[1])
+	if err != nil {
+		return time.Time{}, ErrBadSignature
+	}
+	if err := VerifyData(public, signedMessage(key, checksum, fields[1], data), fields[2]); err != nil {
+		return time.Time{}, err
+	}
+	return signed, nil
+}
+
+// VerifyKey checks the uncompressed data read from key against the signature
+// saved with it - a key without one is ErrBadSignature. The signature is made with what's in the checksum key - or
+// contentChecksum, the checksum content-addressed data was read with - not
+// the checksum a reader picks from the checksums key.
+func VerifyKey(s Store, public ed25519.PublicKey, key, contentChecksum, data string) (time.Time, error) {
+	checksum := contentChecksum
+	if checksum == "" {
+		var err error
+		if checksum, err = s.Get(s.Path(key, "checksum")); err != nil {
+			return time.Time{}, err
+		}
+	}
+	signature, err := s.Get(s.Path(key, "signature"))
+	if err != nil {
+		return time.Time{}, err
+	}
+	if strings.TrimSpace(signature) == "" {
+		return time.Time{}, fmt.Errorf("%w - '%s' has no signature", ErrBadSignature, key)
+	}
+	return VerifySignature(public, key, checksum, data, signature)
+}